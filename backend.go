@@ -2,13 +2,10 @@ package gostatsd
 
 import (
 	"context"
-
-	"github.com/spf13/viper"
+	"errors"
+	"io"
 )
 
-// BackendFactory is a function that returns a Backend.
-type BackendFactory func(*viper.Viper) (Backend, error)
-
 // SendCallback is called by Backend.SendMetricsAsync() to notify about the result of operation.
 // A list of errors is passed to the callback. It may be empty or contain nil values. Every non-nil value is an error
 // that happened while sending metrics.
@@ -25,9 +22,141 @@ type Backend interface {
 	SendEvent(context.Context, *Event) error
 }
 
+// RawTimersBackend is implemented by backends which want the raw timer samples in Timer.Values, or the histograms in
+// Timer.Histogram.  Other backends receive timers with only the computed statistics, and both set to nil.
+type RawTimersBackend interface {
+	Backend
+	// WantsRawTimers returns true if the backend wants the raw timer samples.  The samples and histograms are handed
+	// over to the backend, and remain valid after SendMetricsAsync returns, until the callback is called.
+	WantsRawTimers() bool
+}
+
+// WantsRawTimers returns true if b wants the raw timer samples.
+func WantsRawTimers(b Backend) bool {
+	rb, ok := b.(RawTimersBackend)
+	return ok && rb.WantsRawTimers()
+}
+
+// BackfillBackend is implemented by backends which store each metric at its own timestamp, so they can be sent
+// metrics for a past interval after it was flushed.  Other backends are not sent MetricMaps with Late set.
+type BackfillBackend interface {
+	Backend
+	// WantsBackfill returns true if the backend wants the metrics which arrived late for a past interval.
+	WantsBackfill() bool
+}
+
+// WantsBackfill returns true if b wants the metrics which arrived late for a past interval.
+func WantsBackfill(b Backend) bool {
+	bb, ok := b.(BackfillBackend)
+	return ok && bb.WantsBackfill()
+}
+
 // RunnableBackend represents a backend that needs a Run method to be executed to work.
 type RunnableBackend interface {
 	Backend
 	// Run executes backend send operations. Should be started in a goroutine.
 	Run(context.Context)
 }
+
+// ConnectingBackend is implemented by backends which must connect to a server before they can send.  The factory of
+// the backend only validates the configuration, and Connect establishes or probes the connection.  Connect may
+// be retried if it fails.
+type ConnectingBackend interface {
+	Backend
+	// Connect connects to the server, returning an error if it is unreachable.
+	Connect(context.Context) error
+}
+
+// StatusBackend is implemented by backends which may not be ready to send.
+type StatusBackend interface {
+	Backend
+	// Status returns a short description of the state of the backend, such as "ready" or "initializing".
+	Status() string
+}
+
+// BackendStatus returns the status of b, which is "ready" unless b reports otherwise.
+func BackendStatus(b Backend) string {
+	if sb, ok := b.(StatusBackend); ok {
+		return sb.Status()
+	}
+	return "ready"
+}
+
+// StatefulBackend is implemented by backends with state which should survive a restart, such as the totals of
+// cumulative counters.  The state is saved to the state file when the server shuts down, and restored when it
+// starts if the file is recent enough.
+type StatefulBackend interface {
+	Backend
+	// SaveState returns the state of the backend, or nil if there is nothing to save.
+	SaveState() ([]byte, error)
+	// RestoreState restores state returned by SaveState before a restart.  It is called before the backend is run.
+	RestoreState(state []byte) error
+}
+
+// SaveBackendState returns the state of b if it is a StatefulBackend, otherwise nil.
+func SaveBackendState(b Backend) ([]byte, error) {
+	if sb, ok := b.(StatefulBackend); ok {
+		return sb.SaveState()
+	}
+	return nil, nil
+}
+
+// RestoreBackendState restores the state of b if it is a StatefulBackend.
+func RestoreBackendState(b Backend, state []byte) error {
+	if sb, ok := b.(StatefulBackend); ok {
+		return sb.RestoreState(state)
+	}
+	return nil
+}
+
+// ReportingBackend is implemented by backends with a report to show on request, such as the differences found by a
+// comparison.
+type ReportingBackend interface {
+	Backend
+	// WriteReport writes the most recent report of the backend to w.
+	WriteReport(w io.Writer) error
+}
+
+// ErrNoReport is returned by BackendReport for a backend which has no report.
+var ErrNoReport = errors.New("backend has no report")
+
+// BackendReport writes the report of b to w if it is a ReportingBackend, otherwise it returns ErrNoReport.  Backends
+// which wrap another forward WriteReport with it, so the report is found however the backend is wrapped.
+func BackendReport(b Backend, w io.Writer) error {
+	if rb, ok := b.(ReportingBackend); ok {
+		return rb.WriteReport(w)
+	}
+	return ErrNoReport
+}
+
+// NameValidatingBackend is implemented by backends with rules for metric names, such as the characters allowed.
+type NameValidatingBackend interface {
+	Backend
+	// ValidateMetricName returns an error describing why name is invalid for the backend, or nil if it is valid.
+	ValidateMetricName(name string) error
+}
+
+// ValidateMetricName returns the error from b for name if it is a NameValidatingBackend, otherwise nil.
+func ValidateMetricName(b Backend, name string) error {
+	if vb, ok := b.(NameValidatingBackend); ok {
+		return vb.ValidateMetricName(name)
+	}
+	return nil
+}
+
+// TransferStatsBackend is implemented by backends which measure the data they send, such as the bytes written to the
+// network.
+type TransferStatsBackend interface {
+	Backend
+	// TransferStats returns the lifetime totals of the data the backend has sent, and false if it doesn't measure
+	// them, such as a wrapper around a backend which doesn't.
+	TransferStats() (TransferStats, bool)
+}
+
+// BackendTransferStats returns the lifetime totals of the data b has sent, and false if b doesn't measure them.
+func BackendTransferStats(b Backend) (TransferStats, bool) {
+	if tb, ok := b.(TransferStatsBackend); ok {
+		return tb.TransferStats()
+	}
+	return TransferStats{}, false
+}
@@ -2,14 +2,8 @@ package gostatsd
 
 import (
 	"context"
-
-	"github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
-// CloudProviderFactory is a function that returns a CloudProvider.
-type CloudProviderFactory func(v *viper.Viper, logger logrus.FieldLogger) (CloudProvider, error)
-
 // Instance represents a cloud instance.
 type Instance struct {
 	ID   string
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultBenchAddr is the default address bench sends metrics to.
+	DefaultBenchAddr = "localhost:8125"
+	// DefaultBenchDuration is the default time bench sends metrics for.
+	DefaultBenchDuration = 10 * time.Second
+	// DefaultBenchRate is the default number of metrics per second bench sends, 0 for as fast as it can.
+	DefaultBenchRate = 0
+	// DefaultBenchWorkers is the default number of goroutines bench sends metrics from.
+	DefaultBenchWorkers = 1
+	// DefaultBenchNames is the default number of distinct metric names bench sends.
+	DefaultBenchNames = 1000
+	// DefaultBenchLinesPerDatagram is the default number of metrics bench sends in each datagram.
+	DefaultBenchLinesPerDatagram = 10
+)
+
+// benchTypes are the types of the metrics bench sends, in turn.
+var benchTypes = []string{"c", "g", "ms", "s"}
+
+// benchLines appends lines metrics to buf, numbered from seq, with names cycling through names distinct names.
+func benchLines(buf *bytes.Buffer, seq uint64, lines, names int) {
+	for i := 0; i < lines; i++ {
+		n := seq + uint64(i)
+		typ := benchTypes[n%uint64(len(benchTypes))]
+		buf.WriteString("bench.")
+		buf.WriteString(typ)
+		buf.WriteByte('.')
+		buf.WriteString(strconv.FormatUint(n%uint64(names), 10))
+		buf.WriteByte(':')
+		buf.WriteString(strconv.FormatUint(n%100, 10))
+		buf.WriteByte('|')
+		buf.WriteString(typ)
+		buf.WriteByte('\n')
+	}
+}
+
+// benchCommand sends generated metrics over UDP and reports the rate they were sent at.
+func benchCommand(name string, args []string, w io.Writer) error {
+	fs := newFlagSet(name, "", w)
+	addr := fs.String("addr", DefaultBenchAddr, "Address of the server to send metrics to")
+	duration := fs.Duration("duration", DefaultBenchDuration, "How long to send metrics for")
+	metricsPerSecond := fs.Int("rate", DefaultBenchRate, "Number of metrics to send per second, 0 to send as fast as possible")
+	workers := fs.Int("workers", DefaultBenchWorkers, "Number of goroutines sending metrics")
+	names := fs.Int("names", DefaultBenchNames, "Number of distinct metric names to send")
+	linesPerDatagram := fs.Int("lines-per-datagram", DefaultBenchLinesPerDatagram, "Number of metrics in each datagram")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+	if *duration <= 0 || *metricsPerSecond < 0 || *workers <= 0 || *names <= 0 || *linesPerDatagram <= 0 {
+		return fmt.Errorf("duration, workers, names and lines-per-datagram must be positive, and rate not negative")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	cancelOnInterrupt(ctx, cancel)
+
+	var limiter *rate.Limiter
+	if *metricsPerSecond > 0 {
+		burst := *linesPerDatagram
+		if burst < *metricsPerSecond/10 {
+			burst = *metricsPerSecond / 10
+		}
+		limiter = rate.NewLimiter(rate.Limit(*metricsPerSecond), burst)
+	}
+
+	conns := make([]net.Conn, *workers)
+	for i := range conns {
+		conn, err := net.Dial("udp", *addr)
+		if err != nil {
+			for _, c := range conns[:i] {
+				_ = c.Close()
+			}
+			return err
+		}
+		conns[i] = conn
+	}
+
+	var sent, datagrams, errs uint64
+	var seq uint64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			defer conn.Close()
+			var buf bytes.Buffer
+			for ctx.Err() == nil {
+				if limiter != nil && limiter.WaitN(ctx, *linesPerDatagram) != nil {
+					return
+				}
+				buf.Reset()
+				benchLines(&buf, atomic.AddUint64(&seq, uint64(*linesPerDatagram))-uint64(*linesPerDatagram), *linesPerDatagram, *names)
+				if _, err := conn.Write(buf.Bytes()); err != nil {
+					atomic.AddUint64(&errs, 1)
+					continue
+				}
+				atomic.AddUint64(&sent, uint64(*linesPerDatagram))
+				atomic.AddUint64(&datagrams, 1)
+			}
+		}(conn)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	_, err := fmt.Fprintf(w, "Sent %d metrics in %d datagrams to %s in %v, %.0f metrics/s, %d send errors\n",
+		sent, datagrams, *addr, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds(), errs)
+	return err
+}
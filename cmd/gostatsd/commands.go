@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/atlassian/gostatsd/pkg/statsd"
+	stats "github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/spf13/pflag"
+)
+
+// command is a subcommand of gostatsd, such as serve.
+type command struct {
+	name        string
+	usage       string
+	description string
+	// run runs the command with the arguments after its name.  name is the program name followed by the command name,
+	// for usage messages.  Output for the user is written to w.
+	run func(name string, args []string, w io.Writer) error
+}
+
+// commands are the subcommands of gostatsd, in the order they are listed in the help.  It is filled in by init as
+// the help command refers to it.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "serve [<flags>]", "Run the server, the default if no command is given", serveCommand},
+		{"check", "check [<flags>]", "Check the configuration, taking the same flags as serve, and exit", checkCommand},
+		{"version", "version", "Print the version and exit", versionCommand},
+		{"bench", "bench [<flags>]", "Send generated metrics to a server and report the rate they were sent at", benchCommand},
+		{"dump", "dump [<flags>] <address> [<command>...]", "Show the status of a running server from its HTTP API", dumpCommand},
+		{"help", "help", "List the commands", helpCommand},
+	}
+}
+
+// findCommand returns the command called name.
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// dispatch runs the command named by the first of args.  If args do not start with a command, the server is run with
+// them as it was before there were commands, which is deprecated.
+func dispatch(program string, args []string, w io.Writer) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return serve(program, args, w, true)
+	}
+	cmd, ok := findCommand(args[0])
+	if !ok {
+		return fmt.Errorf("unknown command %q, run %s help to list the commands", args[0], program)
+	}
+	return cmd.run(program+" "+cmd.name, args[1:], w)
+}
+
+// newFlagSet returns the flag set of the command name, which prints its usage, with the arguments after the flags,
+// and the flags.
+func newFlagSet(name, arguments string, w io.Writer) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	fs.SetOutput(w)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(w, "Usage: %s [<flags>]%s\n\nFlags:\n", name, arguments)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func serveCommand(name string, args []string, w io.Writer) error {
+	return serve(name, args, w, false)
+}
+
+// serve runs the server.  legacy is true if it was run without a command.
+func serve(name string, args []string, w io.Writer, legacy bool) error {
+	v, version, err := setupConfiguration(name, args)
+	if err != nil {
+		if err == pflag.ErrHelp {
+			return err
+		}
+		return fmt.Errorf("error while parsing configuration: %v", err)
+	}
+	if version {
+		return printVersion(w)
+	}
+	if legacy {
+		logger.Warnf("Running without a command is deprecated, use %s serve", name)
+	}
+	return run(v)
+}
+
+// checkCommand constructs and validates each server of the configuration without starting them.
+func checkCommand(name string, args []string, w io.Writer) error {
+	v, _, err := setupConfiguration(name, args)
+	if err != nil {
+		return err
+	}
+	names, servers, err := constructServers(v, stats.NewRegistry())
+	if err != nil {
+		return err
+	}
+	for i, s := range servers {
+		if err := validateServer(s); err != nil {
+			if names[i] == "" {
+				return err
+			}
+			return fmt.Errorf("server %s: %v", names[i], err)
+		}
+	}
+	if len(servers) == 1 && names[0] == "" {
+		_, err = fmt.Fprintln(w, "Configuration OK")
+	} else {
+		_, err = fmt.Fprintf(w, "Configuration OK for servers %s\n", strings.Join(names, ", "))
+	}
+	return err
+}
+
+// validateServer checks the configuration of s, and the rules it reads from its configuration when it is run.
+func validateServer(s *statsd.Server) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	if _, err := statsd.NewDerivedMetricsFromViper(s.Viper); err != nil {
+		return err
+	}
+	if _, err := statsd.NewAggregationRulesFromViper(s.Viper); err != nil {
+		return err
+	}
+	_, err := statsd.NewRouterFromViper(s.Viper, s.BackendNames)
+	return err
+}
+
+func versionCommand(name string, args []string, w io.Writer) error {
+	fs := newFlagSet(name, "", w)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return printVersion(w)
+}
+
+func printVersion(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "Version: %s - Commit: %s - Date: %s\n", Version, GitCommit, BuildDate)
+	return err
+}
+
+func helpCommand(name string, args []string, w io.Writer) error {
+	program := strings.TrimSuffix(name, " help")
+	if _, err := fmt.Fprintf(w, "Usage: %s <command> [<flags>]\n\nCommands:\n", program); err != nil {
+		return err
+	}
+	for _, cmd := range commands {
+		if _, err := fmt.Fprintf(w, "  %-40s %s\n", cmd.usage, cmd.description); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "\nRun %s <command> --help for the flags of a command.\n", program)
+	return err
+}
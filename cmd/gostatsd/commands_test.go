@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatch(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	require.NoError(t, dispatch("gostatsd", []string{"version"}, &buf))
+	assert.True(t, strings.HasPrefix(buf.String(), "Version: "), buf.String())
+
+	buf.Reset()
+	require.NoError(t, dispatch("gostatsd", []string{"help"}, &buf))
+	for _, cmd := range commands {
+		assert.Contains(t, buf.String(), "\n  "+cmd.usage+" ")
+	}
+
+	err := dispatch("gostatsd", []string{"bogus"}, &buf)
+	assert.EqualError(t, err, `unknown command "bogus", run gostatsd help to list the commands`)
+}
+
+func TestBenchLines(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	benchLines(&buf, 98, 5, 100)
+	assert.Equal(t, "bench.ms.98:98|ms\n"+
+		"bench.s.99:99|s\n"+
+		"bench.c.0:0|c\n"+
+		"bench.g.1:1|g\n"+
+		"bench.ms.2:2|ms\n", buf.String())
+}
+
+func TestDumpCommand(t *testing.T) {
+	t.Parallel()
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.RequestURI())
+		switch r.URL.Path {
+		case "/api/v1/health":
+			_, _ = w.Write([]byte("ok\nparser up\n"))
+		case "/api/v1/counters":
+			_, _ = w.Write([]byte("counter a 1\n"))
+		case "/api/v1/set-log-level":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+			}
+		default:
+			http.Error(w, "unknown command", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	var buf bytes.Buffer
+	require.NoError(t, dumpCommand("gostatsd dump", []string{addr, "health", "counters 0 10"}, &buf))
+	assert.Equal(t, "== health ==\n  ok\n  parser up\n\n== counters 0 10 ==\n  counter a 1\n", buf.String())
+	assert.Equal(t, []string{"/api/v1/health", "/api/v1/counters?arg=0&arg=10"}, paths)
+
+	buf.Reset()
+	err := dumpCommand("gostatsd dump", []string{srv.URL, "set-log-level debug"}, &buf)
+	assert.EqualError(t, err, "set-log-level debug: 401 Unauthorized: unauthorized")
+	require.NoError(t, dumpCommand("gostatsd dump", []string{"--token=secret", srv.URL, "set-log-level debug"}, &buf))
+
+	buf.Reset()
+	assert.Error(t, dumpCommand("gostatsd dump", nil, &buf))
+	assert.Contains(t, buf.String(), "Usage: gostatsd dump [<flags>] <address> [<command>...]")
+}
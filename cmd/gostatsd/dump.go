@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/atlassian/gostatsd/pkg/console"
+)
+
+// DefaultDumpTimeout is the default time dump waits for each command.
+const DefaultDumpTimeout = 10 * time.Second
+
+// defaultDumpCommands are the commands dump runs if none are given.
+var defaultDumpCommands = []string{"health", "backends", "tuning", "parse-errors"}
+
+// dumpCommand runs console commands on a server through its HTTP API and prints their output, each under a heading.
+// A command with arguments is given as one argument, such as "counters 0 10".
+func dumpCommand(name string, args []string, w io.Writer) error {
+	fs := newFlagSet(name, " <address> [<command>...]", w)
+	token := fs.String("token", "", "Admin token of the API, for admin commands")
+	timeout := fs.Duration("timeout", DefaultDumpTimeout, "How long to wait for each command")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("the address of the API is required")
+	}
+	base := fs.Arg(0)
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	commands := fs.Args()[1:]
+	if len(commands) == 0 {
+		commands = defaultDumpCommands
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	for i, command := range commands {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "== %s ==\n", command); err != nil {
+			return err
+		}
+		if err := dumpAPICommand(client, base, *token, command, w); err != nil {
+			return fmt.Errorf("%s: %v", command, err)
+		}
+	}
+	return nil
+}
+
+// dumpAPICommand runs the command, its name followed by its arguments, on the API at base and writes its output
+// indented to w.
+func dumpAPICommand(client *http.Client, base, token, command string, w io.Writer) error {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	query := url.Values{}
+	for _, arg := range fields[1:] {
+		query.Add("arg", arg)
+	}
+	u := strings.TrimSuffix(base, "/") + console.APIPrefix + url.PathEscape(fields[0])
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(body))
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if _, err := fmt.Fprintf(w, "  %s\n", scanner.Text()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -9,7 +9,6 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -17,7 +16,10 @@ import (
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/backends"
 	"github.com/atlassian/gostatsd/pkg/cloudproviders"
+	"github.com/atlassian/gostatsd/pkg/logging"
 	"github.com/atlassian/gostatsd/pkg/statsd"
+	stats "github.com/atlassian/gostatsd/pkg/statser"
+	"github.com/atlassian/gostatsd/pkg/util"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
@@ -26,66 +28,140 @@ import (
 )
 
 const (
-	// ParamVerbose enables verbose logging.
+	// ParamVerbose enables verbose logging, deprecated in favour of ParamLogLevel.
 	ParamVerbose = "verbose"
+	// ParamLogLevel is the level of logging.
+	ParamLogLevel = "log-level"
+	// ParamLogFormat is the format of log entries, text or json.
+	ParamLogFormat = "log-format"
 	// ParamProfile enables profiler endpoint on the specified address and port.
 	ParamProfile = "profile"
-	// ParamJSON makes logger log in JSON format.
+	// ParamJSON makes logger log in JSON format, deprecated in favour of ParamLogFormat.
 	ParamJSON = "json"
 	// ParamConfigPath provides file with configuration.
 	ParamConfigPath = "config-path"
+	// ParamMultiConfig provides file with a section of configuration for each server run in the process.
+	ParamMultiConfig = "multi-config"
 	// ParamVersion makes program output its version.
 	ParamVersion = "version"
+	// ParamBackendInit is the mode of connecting backends at startup, strict or lazy.
+	ParamBackendInit = "backend-init"
+	// ParamBackendQueueSize is the number of flushes queued for each backend, 0 to send flushes synchronously.
+	ParamBackendQueueSize = "backend-queue-size"
 )
 
 // EnvPrefix is the prefix of the inspected environment variables.
 const EnvPrefix = "GSD" //Go Stats D
 
+var logger = logging.Component("main")
+
 func main() {
 	rand.Seed(time.Now().UnixNano())
-	v, version, err := setupConfiguration()
-	if err != nil {
+	if err := dispatch(os.Args[0], os.Args[1:], os.Stdout); err != nil {
 		if err == pflag.ErrHelp {
 			return
 		}
-		logrus.Fatalf("Error while parsing configuration: %v", err)
-	}
-	if version {
-		fmt.Printf("Version: %s - Commit: %s - Date: %s\n", Version, GitCommit, BuildDate)
-		return
-	}
-	if err := run(v); err != nil {
-		logrus.Fatalf("%v", err)
+		logger.WithError(err).Fatal("Exiting")
 	}
 }
 
 func run(v *viper.Viper) error {
+	// The internal metrics of every server are served on the profiler endpoint as well.
+	registry := stats.NewRegistry()
 	profileAddr := v.GetString(ParamProfile)
 	if profileAddr != "" {
+		http.Handle("/metrics", registry)
 		go func() {
-			logrus.Errorf("Profiler server failed: %v", http.ListenAndServe(profileAddr, nil))
+			err := http.ListenAndServe(profileAddr, nil)
+			logger.WithError(err).WithField(logging.FieldAddress, profileAddr).Error("Profiler server failed")
 		}()
 	}
 
-	logrus.Info("Starting server")
-	s, err := constructServer(v)
+	names, servers, err := constructServers(v, registry)
 	if err != nil {
 		return err
 	}
 
+	for _, name := range names {
+		if name == "" {
+			logger.Info("Starting server")
+		} else {
+			logger.WithField("server", name).Info("Starting server")
+		}
+	}
+
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 	cancelOnInterrupt(ctx, cancelFunc)
 
-	if err := s.Run(ctx); err != nil && err != context.Canceled {
-		return fmt.Errorf("server error: %v", err)
+	errs := make(chan error, len(servers))
+	for i, s := range servers {
+		go func(name string, s *statsd.Server) {
+			err := s.Run(ctx)
+			// A server which stops stops the others, so the process never runs with only some of its servers.
+			cancelFunc()
+			switch {
+			case err == nil || err == context.Canceled:
+				errs <- nil
+			case name == "":
+				errs <- fmt.Errorf("server error: %v", err)
+			default:
+				errs <- fmt.Errorf("server %s error: %v", name, err)
+			}
+		}(names[i], s)
+	}
+	var firstErr error
+	for range servers {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// constructServers constructs the server configured by v, or each of the servers of the multi-config file, with their
+// names, empty for a single server.
+func constructServers(v *viper.Viper, registry *stats.Registry) ([]string, []*statsd.Server, error) {
+	multiConfig := v.GetString(ParamMultiConfig)
+	if multiConfig == "" {
+		s, err := constructServer(v, logrus.StandardLogger(), registry)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{""}, []*statsd.Server{s}, nil
+	}
+	names, vipers, err := statsd.ReadMultiConfig(v, multiConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	servers := make([]*statsd.Server, 0, len(names))
+	for i, name := range names {
+		if err := statsd.ResolveSecrets(vipers[i]); err != nil {
+			return nil, nil, fmt.Errorf("server %s: %v", name, err)
+		}
+		s, err := constructServer(vipers[i], logrus.StandardLogger().WithField("server", name), registry.WithTags(gostatsd.Tags{"server:" + name}))
+		if err != nil {
+			return nil, nil, fmt.Errorf("server %s: %v", name, err)
+		}
+		servers = append(servers, s)
 	}
-	return nil
+	return names, servers, nil
 }
 
-func constructServer(v *viper.Viper) (*statsd.Server, error) {
-	// Logger
-	logger := logrus.StandardLogger()
+func constructServer(v *viper.Viper, logger logrus.FieldLogger, registry *stats.Registry) (*statsd.Server, error) {
+	// Percentiles, checked before anything is started
+	pt, err := statsd.GetFloatSlice(v, statsd.ParamPercentThreshold, statsd.ValidatePercentThreshold)
+	if err != nil {
+		return nil, err
+	}
+	underThresholds, err := statsd.GetFloatSlice(v, statsd.ParamTimerUnderThresholds, statsd.ValidateTimerUnderThreshold)
+	if err != nil {
+		return nil, err
+	}
+	peakWindows, err := statsd.ParsePeakWindows(v.GetStringSlice(statsd.ParamPeakWindows))
+	if err != nil {
+		return nil, err
+	}
 
 	// Cloud provider
 	cloud, err := cloudproviders.Init(v.GetString(statsd.ParamCloudProvider), v, logger)
@@ -93,44 +169,85 @@ func constructServer(v *viper.Viper) (*statsd.Server, error) {
 		return nil, err
 	}
 	// Backends
-	backendNames := v.GetStringSlice(statsd.ParamBackends)
-	backendsList := make([]gostatsd.Backend, len(backendNames))
-	for i, backendName := range backendNames {
-		backend, errBackend := backends.InitBackend(backendName, v)
-		if errBackend != nil {
-			return nil, errBackend
-		}
-		backendsList[i] = backend
+	backendSpecs := v.GetStringSlice(statsd.ParamBackends)
+	backendNames := make([]string, len(backendSpecs))
+	backendsList := make([]gostatsd.Backend, len(backendSpecs))
+	// Internal metrics can only be told apart from other metrics if they have a namespace of their own.
+	var internalNamespace string
+	if v.GetString(statsd.ParamInternalNamespace) != "" || v.GetString(statsd.ParamInternalPrefix) != "" {
+		internalNamespace = statsd.InternalMetricsPrefix(v.GetString(statsd.ParamNamespace), v.GetString(statsd.ParamInternalNamespace), v.GetString(statsd.ParamInternalPrefix))
 	}
-	// Percentiles
-	pt, err := getPercentiles(v.GetStringSlice(statsd.ParamPercentThreshold))
-	if err != nil {
-		return nil, err
+	queueSize := v.GetInt(ParamBackendQueueSize)
+	if queueSize < 0 {
+		return nil, fmt.Errorf("%s should be non-negative", ParamBackendQueueSize)
+	}
+	for i, backendSpec := range backendSpecs {
+		// A backend may be followed by fallback backends, such as "graphite|stdout"
+		chainNames := strings.Split(backendSpec, backends.FallbackSeparator)
+		chain := make([]gostatsd.Backend, len(chainNames))
+		for j, backendName := range chainNames {
+			backend, errBackend := backends.InitBackend(backendName, v)
+			if errBackend != nil {
+				return nil, errBackend
+			}
+			if backend != nil {
+				backend, errBackend = backends.WrapBackend(backend, v.GetString(ParamBackendInit))
+				if errBackend != nil {
+					return nil, errBackend
+				}
+				backend, errBackend = backends.WrapHashNames(backendName, backend, v)
+				if errBackend != nil {
+					return nil, errBackend
+				}
+				backend, errBackend = backends.WrapInternalMetrics(backendName, backend, v, internalNamespace)
+				if errBackend != nil {
+					return nil, errBackend
+				}
+				backend = backends.NewSequencedBackend(backendName, backend)
+			} else if len(chainNames) > 1 {
+				return nil, fmt.Errorf("empty backend name in %q", backendSpec)
+			}
+			chain[j] = backend
+		}
+		backendNames[i] = chainNames[0]
+		backendsList[i] = chain[0]
+		if len(chain) > 1 {
+			backendsList[i] = backends.NewFallbackBackend(chainNames, chain)
+		}
+		if queueSize > 0 && backendsList[i] != nil {
+			backendsList[i] = backends.NewQueuedBackend(chainNames[0], backendsList[i], queueSize)
+		}
 	}
 	// Create server
 	return &statsd.Server{
-		Backends:            backendsList,
-		CloudProvider:       cloud,
-		Limiter:             rate.NewLimiter(rate.Limit(v.GetInt(statsd.ParamMaxCloudRequests)), v.GetInt(statsd.ParamBurstCloudRequests)),
-		InternalTags:        v.GetStringSlice(statsd.ParamInternalTags),
-		InternalNamespace:   v.GetString(statsd.ParamInternalNamespace),
-		DefaultTags:         v.GetStringSlice(statsd.ParamDefaultTags),
-		ExpiryInterval:      v.GetDuration(statsd.ParamExpiryInterval),
-		FlushInterval:       v.GetDuration(statsd.ParamFlushInterval),
-		IgnoreHost:          v.GetBool(statsd.ParamIgnoreHost),
-		MaxReaders:          v.GetInt(statsd.ParamMaxReaders),
-		MaxParsers:          v.GetInt(statsd.ParamMaxParsers),
-		MaxWorkers:          v.GetInt(statsd.ParamMaxWorkers),
-		MaxQueueSize:        v.GetInt(statsd.ParamMaxQueueSize),
-		MaxConcurrentEvents: v.GetInt(statsd.ParamMaxConcurrentEvents),
-		EstimatedTags:       v.GetInt(statsd.ParamEstimatedTags),
-		MetricsAddr:         v.GetString(statsd.ParamMetricsAddr),
-		Namespace:           v.GetString(statsd.ParamNamespace),
-		StatserType:         v.GetString(statsd.ParamStatserType),
-		PercentThreshold:    pt,
-		HeartbeatEnabled:    v.GetBool(statsd.ParamHeartbeatEnabled),
-		ReceiveBatchSize:    v.GetInt(statsd.ParamReceiveBatchSize),
-		ConnPerReader:       v.GetBool(statsd.ParamConnPerReader),
+		Backends:                 backendsList,
+		BackendNames:             backendNames,
+		CloudProvider:            cloud,
+		Limiter:                  rate.NewLimiter(rate.Limit(v.GetInt(statsd.ParamMaxCloudRequests)), v.GetInt(statsd.ParamBurstCloudRequests)),
+		InternalTags:             v.GetStringSlice(statsd.ParamInternalTags),
+		InternalNamespace:        v.GetString(statsd.ParamInternalNamespace),
+		InternalPrefix:           v.GetString(statsd.ParamInternalPrefix),
+		DefaultTags:              v.GetStringSlice(statsd.ParamDefaultTags),
+		ExpiryInterval:           v.GetDuration(statsd.ParamExpiryInterval),
+		FlushInterval:            v.GetDuration(statsd.ParamFlushInterval),
+		ForceFlushInterval:       v.GetBool(statsd.ParamForceFlushInterval),
+		IgnoreHost:               v.GetBool(statsd.ParamIgnoreHost),
+		MaxReaders:               v.GetInt(statsd.ParamMaxReaders),
+		MaxParsers:               v.GetInt(statsd.ParamMaxParsers),
+		MaxWorkers:               v.GetInt(statsd.ParamMaxWorkers),
+		SeparateTypeWorkers:      v.GetBool(statsd.ParamSeparateTypeWorkers),
+		AutoTune:                 v.GetBool(statsd.ParamAutoTune),
+		ExpectedPacketsPerSecond: v.GetInt(statsd.ParamExpectedPacketsPerSecond),
+		MaxQueueSize:             v.GetInt(statsd.ParamMaxQueueSize),
+		MaxConcurrentEvents:      v.GetInt(statsd.ParamMaxConcurrentEvents),
+		EstimatedTags:            v.GetInt(statsd.ParamEstimatedTags),
+		MetricsAddr:              v.GetString(statsd.ParamMetricsAddr),
+		Namespace:                v.GetString(statsd.ParamNamespace),
+		StatserType:              v.GetString(statsd.ParamStatserType),
+		PercentThreshold:         pt,
+		HeartbeatEnabled:         v.GetBool(statsd.ParamHeartbeatEnabled),
+		ReceiveBatchSize:         v.GetInt(statsd.ParamReceiveBatchSize),
+		ConnPerReader:            v.GetBool(statsd.ParamConnPerReader),
 		CacheOptions: statsd.CacheOptions{
 			CacheRefreshPeriod:        v.GetDuration(statsd.ParamCacheRefreshPeriod),
 			CacheEvictAfterIdlePeriod: v.GetDuration(statsd.ParamCacheEvictAfterIdlePeriod),
@@ -141,24 +258,108 @@ func constructServer(v *viper.Viper) (*statsd.Server, error) {
 			fmt.Sprintf("version:%s", Version),
 			fmt.Sprintf("commit:%s", GitCommit),
 		},
-		DisabledSubTypes:          gostatsd.DisabledSubMetrics(v),
+		BuildInfoTags: gostatsd.Tags{
+			fmt.Sprintf("version:%s", Version),
+			fmt.Sprintf("commit:%s", GitCommit),
+		},
+		DisabledSubTypes:          util.DisabledSubMetrics(v),
 		BadLineRateLimitPerSecond: rate.Limit(v.GetFloat64(statsd.ParamBadLinesPerMinute) / 60.0),
-		Viper: v,
+		LogFlushSummary:           v.GetBool(statsd.ParamLogFlushSummary),
+		SortMetrics:               v.GetBool(statsd.ParamSortMetrics),
+		TimerRate:                 v.GetBool(statsd.ParamTimerRate),
+		RetryFailedFlushes:        v.GetBool(statsd.ParamRetryFailedFlushes),
+		GaugeFlapThreshold:        v.GetInt(statsd.ParamGaugeFlapThreshold),
+		ReceiveQueuePolicy:        v.GetString(statsd.ParamReceiveQueuePolicy),
+		ReceiveQueueSize:          v.GetInt(statsd.ParamReceiveQueueSize),
+		ReceiveQueueMaxAge:        v.GetDuration(statsd.ParamReceiveQueueMaxAge),
+		ConsoleAddr:               v.GetString(statsd.ParamConsoleAddr),
+		APIAddr:                   v.GetString(statsd.ParamAPIAddr),
+		AdminAPIAddr:              v.GetString(statsd.ParamAdminAPIAddr),
+		AdminAPIToken:             v.GetString(statsd.ParamAdminAPIToken),
+		CaptureDir:                v.GetString(statsd.ParamCaptureDir),
+		CaptureMaxBytes:           v.GetInt64(statsd.ParamCaptureMaxBytes),
+		TagListener:               v.GetBool(statsd.ParamTagListener),
+		DisablePacketAggregation:  v.GetBool(statsd.ParamDisablePacketAggregation),
+		MaxMetricTTL:              v.GetDuration(statsd.ParamMaxMetricTTL),
+		DisableMetricTTL:          v.GetBool(statsd.ParamDisableMetricTTL),
+		TCPMetricsAddr:            v.GetString(statsd.ParamTCPMetricsAddr),
+		HTTPMetricsAddr:           v.GetString(statsd.ParamHTTPMetricsAddr),
+		MaxDecompressionRatio:     v.GetFloat64(statsd.ParamMaxDecompressionRatio),
+		MaxTCPConns:               v.GetInt(statsd.ParamMaxTCPConns),
+		TCPIdleTimeout:            v.GetDuration(statsd.ParamTCPIdleTimeout),
+		SetDelimiter:              v.GetString(statsd.ParamSetDelimiter),
+		SetExactLimit:             v.GetInt(statsd.ParamSetExactLimit),
+		CounterGracePeriod:        v.GetDuration(statsd.ParamCounterGracePeriod),
+		SourceBlocklist:           v.GetString(statsd.ParamSourceBlocklist),
+		SampleRateRules:           v.GetString(statsd.ParamSampleRateRules),
+		GaugeDeltaRules:           v.GetString(statsd.ParamGaugeDeltaRules),
+		RulesFile:                 v.GetString(statsd.ParamRulesFile),
+		MaxComponentRestarts:      v.GetInt(statsd.ParamMaxComponentRestarts),
+		DedupWindow:               v.GetDuration(statsd.ParamDedupWindow),
+		MetricDedupWindow:         v.GetDuration(statsd.ParamMetricDedupWindow),
+		MetricDedupMatch:          v.GetStringSlice(statsd.ParamMetricDedupMatch),
+		TraceMetrics:              v.GetString(statsd.ParamTraceMetrics),
+		TraceMetricsDuration:      v.GetDuration(statsd.ParamTraceMetricsDuration),
+		PercentileInterpolation:   v.GetString(statsd.ParamPercentileInterpolation),
+		CounterOverflow:           v.GetString(statsd.ParamCounterOverflow),
+		ColdStart:                 v.GetString(statsd.ParamColdStart),
+		FlushWarmup:               v.GetDuration(statsd.ParamFlushWarmup),
+		GaugeEWMAMatch:            v.GetStringSlice(statsd.ParamGaugeEWMAMatch),
+		GaugeEWMADecay:            v.GetFloat64(statsd.ParamGaugeEWMADecay),
+		GaugeDerivativeMatch:      v.GetStringSlice(statsd.ParamGaugeDerivativeMatch),
+		GaugeMinMax:               v.GetBool(statsd.ParamGaugeMinMax),
+		GaugeConflict:             v.GetStringSlice(statsd.ParamGaugeConflict),
+		PeakMatch:                 v.GetStringSlice(statsd.ParamPeakMatch),
+		PeakWindows:               peakWindows,
+		TimerUnderThresholds:      underThresholds,
+		MetricsAddrCounters:       v.GetString(statsd.ParamMetricsAddrCounters),
+		MetricsAddrGauges:         v.GetString(statsd.ParamMetricsAddrGauges),
+		MetricsAddrTimers:         v.GetString(statsd.ParamMetricsAddrTimers),
+		MetricsAddrSets:           v.GetString(statsd.ParamMetricsAddrSets),
+		TypedPortPolicy:           v.GetString(statsd.ParamTypedPortPolicy),
+		UnknownTypePolicy:         v.GetString(statsd.ParamUnknownTypePolicy),
+		NameWhitespace:            v.GetString(statsd.ParamNameWhitespace),
+		MaxTags:                   v.GetInt(statsd.ParamMaxTags),
+		MaxTagKeyLength:           v.GetInt(statsd.ParamMaxTagKeyLength),
+		MaxTagValueLength:         v.GetInt(statsd.ParamMaxTagValueLength),
+		TagLimitPolicy:            v.GetString(statsd.ParamTagLimitPolicy),
+		NormalizeTags:             v.GetBool(statsd.ParamNormalizeTags),
+		StateFile:                 v.GetString(statsd.ParamStateFile),
+		StateMaxAge:               v.GetDuration(statsd.ParamStateMaxAge),
+		JournalFile:               v.GetString(statsd.ParamJournalFile),
+		JournalMatch:              v.GetStringSlice(statsd.ParamJournalMatch),
+		JournalSyncInterval:       v.GetDuration(statsd.ParamJournalSyncInterval),
+		JournalQueueSize:          v.GetInt(statsd.ParamJournalQueueSize),
+		PipelineTraceRate:         v.GetInt(statsd.ParamPipelineTraceRate),
+		Lint:                      v.GetBool(statsd.ParamLint),
+		LintRules:                 v.GetStringSlice(statsd.ParamLintRules),
+		ContainerResolver:         v.GetString(statsd.ParamContainerResolver),
+		DockerSocket:              v.GetString(statsd.ParamDockerSocket),
+		ContainerCacheTTL:         v.GetDuration(statsd.ParamContainerCacheTTL),
+		StripContainerID:          v.GetBool(statsd.ParamStripContainerID),
+		RecentLinesMaxBytes:       v.GetInt64(statsd.ParamRecentLinesMaxBytes),
+		GRPCAddr:                  v.GetString(statsd.ParamGRPCAddr),
+		LateArrivalWindow:         v.GetDuration(statsd.ParamLateArrivalWindow),
+		FlushHistory:              v.GetInt(statsd.ParamFlushHistory),
+		ClockSkewPolicy:           v.GetString(statsd.ParamClockSkewPolicy),
+		ClockSkewWindow:           v.GetDuration(statsd.ParamClockSkewWindow),
+		ClockSkewLearnWindow:      v.GetDuration(statsd.ParamClockSkewLearnWindow),
+		ClockSkewMaxSources:       v.GetInt(statsd.ParamClockSkewMaxSources),
+		LastSeenMaxSources:        v.GetInt(statsd.ParamLastSeenMaxSources),
+		LastSeenExpiry:            v.GetDuration(statsd.ParamLastSeenExpiry),
+		SilentSourceThreshold:     v.GetDuration(statsd.ParamSilentSourceThreshold),
+		TimerAggregation:          v.GetString(statsd.ParamTimerAggregation),
+		ExpHistogramScale:         v.GetInt(statsd.ParamExpHistogramScale),
+		ExpHistogramMaxBuckets:    v.GetInt(statsd.ParamExpHistogramMaxBuckets),
+		HDRMatch:                  v.GetStringSlice(statsd.ParamHDRMatch),
+		HDRSignificantDigits:      v.GetInt(statsd.ParamHDRSignificantDigits),
+		HDRMaxValue:               v.GetFloat64(statsd.ParamHDRMaxValue),
+		Viper:                     v,
+		Logger:                    logger,
+		Registry:                  registry,
 	}, nil
 }
 
-func getPercentiles(s []string) ([]float64, error) {
-	percentThresholds := make([]float64, len(s))
-	for i, sPercentThreshold := range s {
-		pt, err := strconv.ParseFloat(sPercentThreshold, 64)
-		if err != nil {
-			return nil, err
-		}
-		percentThresholds[i] = pt
-	}
-	return percentThresholds, nil
-}
-
 // cancelOnInterrupt calls f when os.Interrupt or SIGTERM is received.
 func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
 	c := make(chan os.Signal, 1)
@@ -172,9 +373,16 @@ func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
 	}()
 }
 
-func setupConfiguration() (*viper.Viper, bool, error) {
+// setupConfiguration parses the flags of the command name from args, with the configuration file and environment
+// variables, and configures logging.
+func setupConfiguration(name string, args []string) (_ *viper.Viper, _ bool, err error) {
 	v := viper.New()
-	defer setupLogger(v) // Apply logging configuration in case of early exit
+	defer func() {
+		// Apply logging configuration in case of early exit
+		if logErr := setupLogger(v); logErr != nil && err == nil {
+			err = logErr
+		}
+	}()
 	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	v.SetEnvPrefix(EnvPrefix)
 	v.SetTypeByDefaultValue(true)
@@ -182,13 +390,21 @@ func setupConfiguration() (*viper.Viper, bool, error) {
 
 	var version bool
 
-	cmd := pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+	cmd := pflag.NewFlagSet(name, pflag.ContinueOnError)
 
 	cmd.BoolVar(&version, ParamVersion, false, "Print the version and exit")
 	cmd.Bool(ParamVerbose, false, "Verbose")
 	cmd.Bool(ParamJSON, false, "Log in JSON format")
-	cmd.String(ParamProfile, "", "Enable profiler endpoint on the specified address and port")
+	cmd.String(ParamLogLevel, logrus.InfoLevel.String(), "Level of logging, one of trace, debug, info, warning, error, fatal or panic")
+	cmd.String(ParamLogFormat, logging.FormatText, "Format of log entries, text or json")
+	_ = cmd.MarkDeprecated(ParamVerbose, "use --"+ParamLogLevel+"=debug instead")
+	_ = cmd.MarkDeprecated(ParamJSON, "use --"+ParamLogFormat+"=json instead")
+	_ = cmd.MarkDeprecated(ParamVersion, "use the version command instead")
+	cmd.String(ParamProfile, "", "Enable profiler endpoint on the specified address and port, which also serves the internal metrics at /metrics in the Prometheus format")
 	cmd.String(ParamConfigPath, "", "Path to the configuration file")
+	cmd.String(ParamMultiConfig, "", "Path to a configuration file with a section for each of several independent servers to run, over the shared configuration")
+	cmd.String(ParamBackendInit, backends.DefaultBackendInit, "Use backends as soon as they are created (strict), or check they can connect in the background first, retrying until they can (lazy)")
+	cmd.Int(ParamBackendQueueSize, backends.DefaultBackendQueueSize, "Number of flushes queued for each backend so a slow backend doesn't delay the others, 0 to send flushes synchronously")
 
 	statsd.AddFlags(cmd)
 
@@ -198,7 +414,7 @@ func setupConfiguration() (*viper.Viper, bool, error) {
 		}
 	})
 
-	if err := cmd.Parse(os.Args[1:]); err != nil {
+	if err := cmd.Parse(args); err != nil {
 		return nil, false, err
 	}
 
@@ -209,15 +425,23 @@ func setupConfiguration() (*viper.Viper, bool, error) {
 			return nil, false, err
 		}
 	}
+	if err := statsd.ResolveSecrets(v); err != nil {
+		return nil, false, err
+	}
 
 	return v, version, nil
 }
 
-func setupLogger(v *viper.Viper) {
+// setupLogger sets the level and format of the standard logger.  --verbose and --json override --log-level and
+// --log-format.
+func setupLogger(v *viper.Viper) error {
+	level := v.GetString(ParamLogLevel)
 	if v.GetBool(ParamVerbose) {
-		logrus.SetLevel(logrus.DebugLevel)
+		level = logrus.DebugLevel.String()
 	}
+	format := v.GetString(ParamLogFormat)
 	if v.GetBool(ParamJSON) {
-		logrus.SetFormatter(&logrus.JSONFormatter{})
+		format = logging.FormatJSON
 	}
+	return logging.Configure(logrus.StandardLogger(), level, format)
 }
@@ -5,8 +5,6 @@ import (
 	"net"
 	"sync/atomic"
 	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
 func (s *Server) load() {
@@ -23,7 +21,7 @@ func (s *Server) load() {
 					go func() {
 						conn, err := net.Dial("udp", s.MetricsAddr)
 						if err != nil {
-							log.Panicf("Error connecting to statsd backend: %v", err)
+							logger.WithError(err).Panic("Error connecting to statsd backend")
 						}
 						defer conn.Close()
 						buf := new(bytes.Buffer)
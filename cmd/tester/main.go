@@ -9,9 +9,9 @@ import (
 	"time"
 
 	"github.com/atlassian/gostatsd/pkg/fakesocket"
+	"github.com/atlassian/gostatsd/pkg/logging"
 	"github.com/atlassian/gostatsd/pkg/statsd"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -25,6 +25,9 @@ var (
 	Version string
 )
 
+// logger logs through a child of the standard logger for the tester.
+var logger = logging.Component("tester")
+
 func main() {
 	rand.Seed(time.Now().UnixNano())
 	s := newServer()
@@ -52,7 +55,7 @@ func main() {
 		if s.CPUProfile {
 			f, e := os.Create("profile.pprof")
 			if e != nil {
-				log.Fatal(e)
+				logger.WithError(e).Fatal("Failed to create CPU profile")
 			}
 			defer f.Close()
 			_ = pprof.StartCPUProfile(f)
@@ -60,9 +63,9 @@ func main() {
 		}
 		err := server.RunWithCustomSocket(ctx, fakesocket.Factory)
 		if err != nil && err != context.Canceled && err != context.DeadlineExceeded {
-			log.Errorf("statsd run failed: %v", err)
+			logger.WithError(err).Error("statsd run failed")
 		}
 	} else if err := s.Run(); err != nil {
-		log.Fatalf("%v\n", err)
+		logger.WithError(err).Fatal("Tester failed")
 	}
 }
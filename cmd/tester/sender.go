@@ -9,8 +9,6 @@ import (
 	"time"
 
 	"github.com/atlassian/gostatsd"
-
-	log "github.com/sirupsen/logrus"
 )
 
 // Metrics store the metrics to send.
@@ -38,7 +36,7 @@ var metrics = &Metrics{
 func (s *Server) write(conn net.Conn, buf *bytes.Buffer) {
 	_, err := buf.WriteTo(conn)
 	if err != nil {
-		log.Errorf("Error sending to statsd backend: %v", err)
+		logger.WithError(err).Error("Error sending to statsd backend")
 	}
 	atomic.AddInt64(&s.Stats.NumPackets, 1)
 }
@@ -48,7 +46,7 @@ func (s *Server) writeLine(conn net.Conn, buf *bytes.Buffer, format, name string
 	atomic.AddInt64(&s.Stats.NumMetrics, 1)
 	// Make sure we don't go over max udp datagram size of 1500
 	if buf.Len() > s.MaxPacketSize {
-		log.Debugf("Buffer length: %d", buf.Len())
+		logger.Debugf("Buffer length: %d", buf.Len())
 		s.write(conn, buf)
 		buf.Reset()
 	}
@@ -93,12 +91,12 @@ func (s *Server) send() {
 			go func() {
 				conn, err := net.Dial("udp", s.MetricsAddr)
 				if err != nil {
-					log.Panicf("Error connecting to statsd backend: %v", err)
+					logger.WithError(err).Panic("Error connecting to statsd backend")
 				}
 				defer conn.Close()
 				buf := new(bytes.Buffer)
 				for t := range flushTicker.C {
-					log.Debugf("Tick at %v", t)
+					logger.Debugf("Tick at %v", t)
 					s.writeLines(conn, buf)
 					if buf.Len() > 0 {
 						s.write(conn, buf)
@@ -116,20 +116,20 @@ func (s *Server) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) startHandler(w http.ResponseWriter, r *http.Request) {
-	log.Info("starting process\n")
+	logger.Info("starting process")
 	s.start <- true
 	w.Write([]byte("process started"))
 }
 
 func (s *Server) stopHandler(w http.ResponseWriter, r *http.Request) {
 	if atomic.LoadInt32(&s.Started) != 0 {
-		log.Info("stopping process")
+		logger.Info("stopping process")
 		s.stop <- true
 		stats := <-s.stats
 		w.Header().Set("Content-Type", "application/json")
 		bytes, err := json.Marshal(stats)
 		if err != nil {
-			log.Errorf("unable to marshal TimeSeries, %s\n", err.Error())
+			logger.WithError(err).Error("unable to marshal TimeSeries")
 			w.Write([]byte("process stopped"))
 			return
 		}
@@ -142,7 +142,7 @@ func (s *Server) stopHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) exitHandler(w http.ResponseWriter, r *http.Request) {
-	log.Info("exiting process\n")
+	logger.Info("exiting process")
 	s.stop <- true
 	os.Exit(0)
 }
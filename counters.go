@@ -1,5 +1,10 @@
 package gostatsd
 
+import (
+	"sort"
+	"time"
+)
+
 // Counter is used for storing aggregated values for counters.
 type Counter struct {
 	PerSecond float64  // The calculated per second rate
@@ -7,6 +12,8 @@ type Counter struct {
 	Timestamp Nanotime // Last time value was updated
 	Hostname  string   // Hostname of the source of the metric
 	Tags      Tags     // The tags for the counter
+
+	TTL time.Duration // Expiry interval set by the client, 0 to use the server's
 }
 
 // NewCounter initialises a new counter.
@@ -45,3 +52,23 @@ func (c Counters) Each(f func(string, string, Counter)) {
 		}
 	}
 }
+
+// EachSorted iterates over each counter in order of name, then tags.
+func (c Counters) EachSorted(f func(string, string, Counter)) {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := c[key]
+		tagsKeys := make([]string, 0, len(value))
+		for tags := range value {
+			tagsKeys = append(tagsKeys, tags)
+		}
+		sort.Strings(tagsKeys)
+		for _, tags := range tagsKeys {
+			f(key, tags, value[tags])
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package gostatsd
 
+import (
+	"sort"
+	"time"
+)
+
 // Gauge is used for storing aggregated values for gauges.
 type Gauge struct {
 	Value     float64  // The numeric value of the metric
 	Timestamp Nanotime // Last time value was updated
 	Hostname  string   // Hostname of the source of the metric
 	Tags      Tags     // The tags for the gauge
+
+	TTL time.Duration // Expiry interval set by the client, 0 to use the server's
 }
 
 // NewGauge initialises a new gauge.
@@ -44,3 +51,23 @@ func (g Gauges) Each(f func(string, string, Gauge)) {
 		}
 	}
 }
+
+// EachSorted iterates over each gauge in order of name, then tags.
+func (g Gauges) EachSorted(f func(string, string, Gauge)) {
+	keys := make([]string, 0, len(g))
+	for key := range g {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := g[key]
+		tagsKeys := make([]string, 0, len(value))
+		for tags := range value {
+			tagsKeys = append(tagsKeys, tags)
+		}
+		sort.Strings(tagsKeys)
+		for _, tags := range tagsKeys {
+			f(key, tags, value[tags])
+		}
+	}
+}
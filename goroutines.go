@@ -0,0 +1,30 @@
+package gostatsd
+
+import (
+	"context"
+)
+
+// GoRunner runs functions in new goroutines, recovering from a panic in them and counting it under a component,
+// such as the supervisor of the server.
+type GoRunner interface {
+	// Go runs f in a new goroutine, recovering from a panic in it.
+	Go(component string, f func())
+}
+
+type goRunnerKey struct{}
+
+// WithGoRunner returns a copy of ctx which carries r, so goroutines started with Go for ctx are run with r.
+func WithGoRunner(ctx context.Context, r GoRunner) context.Context {
+	return context.WithValue(ctx, goRunnerKey{}, r)
+}
+
+// Go runs f in a new goroutine with the GoRunner of ctx, so a panic in f is recovered and counted under component,
+// or with a plain go statement if ctx has none.  It is for the short-lived goroutines of packages which are given a
+// context by the server, such as the sends of a backend and the connections of the console.
+func Go(ctx context.Context, component string, f func()) {
+	if r, ok := ctx.Value(goRunnerKey{}).(GoRunner); ok {
+		r.Go(component, f)
+		return
+	}
+	go f()
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"hash/adler32"
+	"time"
 )
 
 // MetricType is an enumeration of all the possible types of Metric.
@@ -39,6 +40,7 @@ func (m MetricType) String() string {
 type Metric struct {
 	Name        string     // The name of the metric
 	Value       float64    // The numeric value of the metric
+	Values      []float64  // Further values of a timer which were pre-aggregated with Value, usually empty
 	Rate        float64    // The sampling rate of the metric
 	Tags        Tags       // The tags for the metric
 	TagsKey     string     // The tags rendered as a string to uniquely identify the tagset in a map
@@ -47,12 +49,34 @@ type Metric struct {
 	SourceIP    IP         // IP of the source of the metric
 	Type        MetricType // The type of metric
 	DoneFunc    func()     // Returns the metric to the pool. May be nil. Call Metric.Done(), not this.
+
+	TTL time.Duration // How long the series lives without updates, set by the client, 0 to use the expiry interval
+
+	ContainerID string // ID of the container which sent the metric, from the dogstatsd c: field, usually empty
+
+	GaugeDelta bool // The gauge value had an explicit sign, so Value changes the gauge rather than sets it
+
+	Timestamp Nanotime // When the metric was received, 0 if unknown
+
+	ClientTimestamp Nanotime // When the client says the metric was measured, from the dogstatsd T field, usually 0
+
+	Trace *PipelineTrace // Timestamps of the metric passing through the pipeline if it was sampled, usually nil
+}
+
+// PipelineTrace records when a sampled datagram, and the first metric parsed from it, reached each stage of the
+// pipeline.  A stage which has not been reached, or was skipped, is the zero time.
+type PipelineTrace struct {
+	Read     time.Time // Read from the socket
+	Parsed   time.Time // Parsed into a metric
+	Enqueued time.Time // Queued for its aggregator
+	Applied  time.Time // Applied to its aggregator
 }
 
 // Reset is used to reset a metric to as clean state, called on re-use from the pool.
 func (m *Metric) Reset() {
 	m.Name = ""
 	m.Value = 0
+	m.Values = m.Values[:0]
 	m.Rate = 1
 	m.Tags = m.Tags[:0]
 	m.TagsKey = ""
@@ -60,6 +84,12 @@ func (m *Metric) Reset() {
 	m.Hostname = ""
 	m.SourceIP = ""
 	m.Type = 0
+	m.TTL = 0
+	m.ContainerID = ""
+	m.GaugeDelta = false
+	m.Timestamp = 0
+	m.ClientTimestamp = 0
+	m.Trace = nil
 }
 
 // Bucket will pick a distribution bucket for this metric to land in.  max is exclusive.
@@ -97,6 +127,132 @@ type MetricMap struct {
 	Timers   Timers
 	Gauges   Gauges
 	Sets     Sets
+	Sorted   bool // Whether EachCounter, EachTimer, EachGauge and EachSet iterate in order of name, then tags
+
+	// Interval is the time the metrics were aggregated over, which per-second rates are computed from.  It is
+	// measured between flushes, so it differs from NominalInterval, the configured flush interval, when a flush is
+	// late.  Both are 0 if unknown.
+	Interval        time.Duration
+	NominalInterval time.Duration
+
+	// Sequence numbers the flush interval the metrics were aggregated in, starting at 1, and Part numbers the snapshot
+	// within the flush, as a flush sends one from each aggregator.  Parts are numbered in the order the snapshots are
+	// made, so a part number only identifies a snapshot together with its sequence number.  A snapshot which is sent
+	// again, such as when a failed flush is retried, keeps both, so a backend can recognize one it has already
+	// acknowledged.  Both are 0 if unknown.
+	Sequence uint64
+	Part     int
+
+	// Late is set on metrics which were received in a past interval, but only reached the aggregator after it was
+	// flushed.  They are sent with the next flush to backends which backfill, with timestamps in the past interval,
+	// and Interval set to its length.
+	Late bool
+}
+
+// EachCounter iterates over each counter, in order if m.Sorted is set.
+func (m *MetricMap) EachCounter(f func(string, string, Counter)) {
+	if m.Sorted {
+		m.Counters.EachSorted(f)
+	} else {
+		m.Counters.Each(f)
+	}
+}
+
+// EachTimer iterates over each timer, in order if m.Sorted is set.
+func (m *MetricMap) EachTimer(f func(string, string, Timer)) {
+	if m.Sorted {
+		m.Timers.EachSorted(f)
+	} else {
+		m.Timers.Each(f)
+	}
+}
+
+// EachGauge iterates over each gauge, in order if m.Sorted is set.
+func (m *MetricMap) EachGauge(f func(string, string, Gauge)) {
+	if m.Sorted {
+		m.Gauges.EachSorted(f)
+	} else {
+		m.Gauges.Each(f)
+	}
+}
+
+// EachSet iterates over each set, in order if m.Sorted is set.
+func (m *MetricMap) EachSet(f func(string, string, Set)) {
+	if m.Sorted {
+		m.Sets.EachSorted(f)
+	} else {
+		m.Sets.Each(f)
+	}
+}
+
+// Len returns the number of metrics in m, counting each tag set of a name separately.
+func (m *MetricMap) Len() int {
+	n := 0
+	for _, tagged := range m.Counters {
+		n += len(tagged)
+	}
+	for _, tagged := range m.Timers {
+		n += len(tagged)
+	}
+	for _, tagged := range m.Gauges {
+		n += len(tagged)
+	}
+	for _, tagged := range m.Sets {
+		n += len(tagged)
+	}
+	return n
+}
+
+// Copy returns a copy of m which is not affected by later changes to m, such as the aggregator being reset.  The
+// raw timer samples and histograms are copied, other values of each metric such as tags are shared.
+func (m *MetricMap) Copy() *MetricMap {
+	c := &MetricMap{
+		Counters: make(Counters, len(m.Counters)),
+		Timers:   make(Timers, len(m.Timers)),
+		Gauges:   make(Gauges, len(m.Gauges)),
+		Sets:     make(Sets, len(m.Sets)),
+		Sorted:   m.Sorted,
+
+		Interval:        m.Interval,
+		NominalInterval: m.NominalInterval,
+		Sequence:        m.Sequence,
+		Part:            m.Part,
+		Late:            m.Late,
+	}
+	for key, tagged := range m.Counters {
+		cc := make(map[string]Counter, len(tagged))
+		for tagsKey, counter := range tagged {
+			cc[tagsKey] = counter
+		}
+		c.Counters[key] = cc
+	}
+	for key, tagged := range m.Timers {
+		ct := make(map[string]Timer, len(tagged))
+		for tagsKey, timer := range tagged {
+			if timer.Values != nil {
+				timer.Values = append([]float64(nil), timer.Values...)
+			}
+			timer.Histogram = timer.Histogram.Copy()
+			timer.HDR = timer.HDR.Copy()
+			ct[tagsKey] = timer
+		}
+		c.Timers[key] = ct
+	}
+	for key, tagged := range m.Gauges {
+		cg := make(map[string]Gauge, len(tagged))
+		for tagsKey, gauge := range tagged {
+			cg[tagsKey] = gauge
+		}
+		c.Gauges[key] = cg
+	}
+	for key, tagged := range m.Sets {
+		cs := make(map[string]Set, len(tagged))
+		for tagsKey, set := range tagged {
+			cs[tagsKey] = set
+		}
+		c.Sets[key] = cs
+	}
+	return c
 }
 
 func (m *MetricMap) String() string {
@@ -113,7 +269,7 @@ func (m *MetricMap) String() string {
 		fmt.Fprintf(buf, "stats.gauge.%s: %f tags=%s\n", k, gauge.Value, tags)
 	})
 	m.Sets.Each(func(k, tags string, set Set) {
-		fmt.Fprintf(buf, "stats.set.%s: %d tags=%s\n", k, len(set.Values), tags)
+		fmt.Fprintf(buf, "stats.set.%s: %d tags=%s\n", k, set.Cardinality(), tags)
 	})
 	return buf.String()
 }
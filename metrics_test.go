@@ -0,0 +1,76 @@
+package gostatsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricMapEachSorted(t *testing.T) {
+	t.Parallel()
+	m := &MetricMap{
+		Counters: Counters{
+			"b": {"t:2": {Value: 3}, "t:1": {Value: 2}},
+			"a": {"": {Value: 1}},
+			"c": {"": {Value: 4}},
+		},
+		Sorted: true,
+	}
+	for i := 0; i < 10; i++ {
+		var names []string
+		var values []int64
+		m.EachCounter(func(name, tagsKey string, c Counter) {
+			names = append(names, name+"|"+tagsKey)
+			values = append(values, c.Value)
+		})
+		assert.Equal(t, []string{"a|", "b|t:1", "b|t:2", "c|"}, names)
+		assert.Equal(t, []int64{1, 2, 3, 4}, values)
+	}
+
+	// Unsorted iteration still visits everything.
+	m.Sorted = false
+	count := 0
+	m.EachCounter(func(name, tagsKey string, c Counter) {
+		count++
+	})
+	assert.Equal(t, 4, count)
+}
+
+func TestMetricMapCopy(t *testing.T) {
+	t.Parallel()
+	m := &MetricMap{
+		Counters: Counters{"c": {"": {Value: 1}}},
+		Timers:   Timers{"t": {"": {Values: []float64{1, 2}}}},
+		Gauges:   Gauges{"g": {"": {Value: 3}}},
+		Sets:     Sets{"s": {"": {Values: map[string]struct{}{"a": {}}}}},
+		Sorted:   true,
+
+		Interval:        1100 * time.Millisecond,
+		NominalInterval: time.Second,
+		Sequence:        7,
+		Part:            2,
+	}
+	c := m.Copy()
+	assert.Equal(t, m, c)
+
+	m.Counters["c"][""] = Counter{Value: 2}
+	m.Timers["t"][""].Values[0] = 5
+	m.Gauges["g"] = map[string]Gauge{}
+	m.Sets["s"][""] = Set{}
+	assert.Equal(t, Counters{"c": {"": {Value: 1}}}, c.Counters)
+	assert.Equal(t, []float64{1, 2}, c.Timers["t"][""].Values)
+	assert.Equal(t, Gauges{"g": {"": {Value: 3}}}, c.Gauges)
+	assert.Len(t, c.Sets["s"][""].Values, 1)
+}
+
+func TestMetricMapLen(t *testing.T) {
+	t.Parallel()
+	m := &MetricMap{
+		Counters: Counters{"c": {"": {}, "a:b": {}}},
+		Timers:   Timers{"t": {"": {}}},
+		Gauges:   Gauges{"g1": {"": {}}, "g2": {"": {}}},
+	}
+	assert.Equal(t, 5, m.Len())
+	assert.Zero(t, (&MetricMap{}).Len())
+}
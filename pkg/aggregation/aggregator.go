@@ -0,0 +1,1039 @@
+// Package aggregation aggregates counters, gauges, timers and sets into the values flushed at each interval.  It has
+// no goroutines, channels or clock of its own, so it can be embedded in other programs such as stream processors,
+// and the time is always given by the caller.
+package aggregation
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// approxTag is added to sets whose cardinality is estimated.
+const approxTag = "approx"
+
+const (
+	// PercentileNearestRank computes the upper and lower percentiles of timers as the nearest ranked value.
+	PercentileNearestRank = "nearest-rank"
+	// PercentileLinear computes the upper and lower percentiles of timers by linear interpolation between the
+	// values at the ranks either side of the percentile.
+	PercentileLinear = "linear"
+)
+
+const (
+	// CounterOverflowSaturate keeps counters which would overflow int64 at the largest or smallest value.
+	CounterOverflowSaturate = "saturate"
+	// CounterOverflowWrap lets counters which overflow int64 wrap around, as two's complement addition does.
+	CounterOverflowWrap = "wrap"
+)
+
+// Policies deciding which value is flushed for a gauge updated more than once in the flush interval, such as by
+// several hosts which disagree.
+const (
+	// GaugeConflictLast flushes the last value received, so the value depends on the order updates arrive in.
+	GaugeConflictLast = "last"
+	// GaugeConflictMax flushes the highest value received in the interval.
+	GaugeConflictMax = "max"
+	// GaugeConflictMin flushes the lowest value received in the interval.
+	GaugeConflictMin = "min"
+	// GaugeConflictMean flushes the mean of the values received in the interval.
+	GaugeConflictMean = "mean"
+	// GaugeConflictSum flushes the sum of the values received in the interval.
+	GaugeConflictSum = "sum"
+)
+
+// GaugeConflicts decides, by name, which value is flushed for a gauge updated more than once in the flush interval.
+type GaugeConflicts interface {
+	// Policy returns the GaugeConflict* policy of the gauge name.
+	Policy(name string) string
+}
+
+// GaugeSmoother blends the values received by some gauges into a running value, rather than keeping the last value.
+type GaugeSmoother interface {
+	// Matches returns true if the gauge name is smoothed.
+	Matches(name string) bool
+	// Blend returns the running value after value is received.
+	Blend(running, value float64) float64
+}
+
+// TimerMatcher selects timers by name.
+type TimerMatcher interface {
+	// Matches returns true if the timer name is selected.
+	Matches(name string) bool
+}
+
+// GaugeMatcher selects gauges by name.
+type GaugeMatcher interface {
+	// Matches returns true if the gauge name is selected.
+	Matches(name string) bool
+}
+
+// Options configures an Aggregator.  Other than PercentThresholds and UnderThresholds, which are prepared by New,
+// the options may be changed between calls.
+type Options struct {
+	PercentThresholds []float64     // Percentiles computed for timers, may be changed with SetPercentThresholds
+	ExpiryInterval    time.Duration // How long a metric is kept without being received, 0 to keep metrics forever
+	DisabledSubtypes  gostatsd.TimerSubtypes
+
+	// Gauge debouncing, disabled if GaugeFlapThreshold is 0.
+	GaugeFlapThreshold int // Maximum number of value changes per flush interval
+
+	SetDelimiter  string // If not empty, set values are split in to multiple members on this delimiter
+	SetExactLimit int    // Sets with more members than this are approximated, 0 to disable
+
+	// Timer values are handed to backends which want raw timers, so they must not be reused after Expire.
+	HandOffTimerValues bool
+
+	// Idle counters are flushed as zero for this long before they expire, 0 to use ExpiryInterval.
+	CounterGracePeriod time.Duration
+
+	LinearPercentiles bool      // Interpolate percentiles rather than using the nearest rank
+	UnderThresholds   []float64 // Thresholds to count the timer values at or under
+	WrapCounters      bool      // Counters which overflow wrap around rather than saturating
+
+	GaugeSmoothing  GaugeSmoother // Gauges which are smoothed rather than taking the last value, may be nil
+	GaugeDerivative GaugeMatcher  // Gauges flushed as their per-second rate of change, may be nil
+
+	// Also flush <name>.min and <name>.max, the lowest and highest values of each gauge updated in the interval.
+	GaugeMinMax bool
+
+	// Which value is flushed for gauges updated more than once in the interval, may be nil to flush the last value.
+	// A policy other than GaugeConflictLast is computed from the values received, so it overrides GaugeSmoothing.
+	// The gauge keeps its last value for the next interval.
+	GaugeConflicts GaugeConflicts
+
+	// Counters and gauges which are also flushed as <name>.peak_<window> and <name>.trough_<window>, their highest
+	// and lowest values in the current window of each of PeakWindows, may be nil.  Windows are aligned to the wall
+	// clock, so a 24h window starts at midnight UTC.  The value of a counter is its per-second rate.
+	Peaks       GaugeMatcher
+	PeakWindows []time.Duration
+
+	// Counters and timers which arrive up to this long after the end of the interval they were received in, by
+	// Metric.Timestamp, are bucketed in to that interval rather than the current one.  0 to disable.
+	LateArrivalWindow time.Duration
+
+	// Fold the values of timers in to an exponential histogram in Timer.Histogram rather than keeping them in Values,
+	// starting at HistogramScale with at most HistogramMaxBuckets buckets of each sign.  The statistics other than
+	// the count, sum, min and max, and the percentiles, are estimated from the histogram, and LinearPercentiles is
+	// ignored.
+	TimerHistograms     bool
+	HistogramScale      int32
+	HistogramMaxBuckets int
+
+	// Record the values of timers matching HDRTimers in an HDR histogram in Timer.HDR rather than keeping them in
+	// Values or an exponential histogram, from HDRLowestValue to HDRHighestValue to HDRSignificantDigits significant
+	// decimal digits.  As with TimerHistograms, the statistics other than the count, sum, min and max, and the
+	// percentiles, are estimated from the histogram.  May be nil.
+	HDRTimers            TimerMatcher
+	HDRSignificantDigits int
+	HDRLowestValue       float64
+	HDRHighestValue      float64
+
+	Logger log.FieldLogger // Logs of the aggregator, a child of the standard logger if nil
+}
+
+// percentStruct is a cache of percentile names to avoid creating them for each timer.
+type percentStruct struct {
+	count      string
+	mean       string
+	sum        string
+	sumSquares string
+	upper      string
+	lower      string
+}
+
+// underThreshold is a threshold to count the timer values at or under, with a cache of its name.
+type underThreshold struct {
+	value float64
+	name  string
+}
+
+// Aggregator aggregates metrics.  Metrics are received until Flush computes the values of the interval in the
+// MetricMap, then Expire prepares it for the next interval.  An Aggregator is not safe for concurrent use.
+type Aggregator struct {
+	Options
+
+	metricsReceived  uint64
+	percentNames     map[float64]percentStruct
+	underNames       []underThreshold
+	counterOverflows uint64 // Number of times a counter overflowed since creation
+	overflowLogged   bool   // An overflow has been logged this flush interval
+
+	gaugeChanges    map[string]map[string]int // Number of value changes this flush interval, by name and tags
+	heldGauges      gostatsd.Gauges           // Gauges held back from the current flush, restored by Expire
+	gaugesDebounced int                       // Number of flapping gauges debounced by the last flush
+
+	gaugePrevious map[string]map[string]float64    // Value of each derivative gauge at the last flush, by name and tags
+	gaugeRaw      map[string]map[string]float64    // Value of each derivative gauge replaced by its rate in the flush
+	gaugeRanges   map[string]map[string]gaugeRange // Values of each gauge updated this interval, by name and tags
+
+	gaugePeaks   map[string]map[string]*peakSeries // Peaks of each gauge selected by Peaks, by name and tags
+	counterPeaks map[string]map[string]*peakSeries // Peaks of each counter selected by Peaks, by name and tags
+	flushedPeaks []flushedPeak                     // Gauges added by the last flush with the peaks
+	peakNow      gostatsd.Nanotime                 // Start of the current interval, for the peaks of idle metrics
+
+	intervalStart time.Time       // When the current interval started, zero before the first Expire
+	pastStarts    []time.Time     // Start of each past interval which late metrics may still be bucketed in to
+	late          []*LateInterval // Past intervals late metrics were bucketed in to since the last Expire
+	lateMetrics   uint64          // Number of metrics bucketed in to a past interval since creation
+
+	gostatsd.MetricMap
+}
+
+// New creates a new Aggregator.
+func New(opts Options) *Aggregator {
+	a := Aggregator{
+		Options: opts,
+		MetricMap: gostatsd.MetricMap{
+			Counters: gostatsd.Counters{},
+			Timers:   gostatsd.Timers{},
+			Gauges:   gostatsd.Gauges{},
+			Sets:     gostatsd.Sets{},
+		},
+		gaugeChanges:  map[string]map[string]int{},
+		heldGauges:    gostatsd.Gauges{},
+		gaugePrevious: map[string]map[string]float64{},
+		gaugeRaw:      map[string]map[string]float64{},
+		gaugeRanges:   map[string]map[string]gaugeRange{},
+		gaugePeaks:    map[string]map[string]*peakSeries{},
+		counterPeaks:  map[string]map[string]*peakSeries{},
+	}
+	if a.Logger == nil {
+		a.Logger = logging.Component("aggregator")
+	}
+	a.SetPercentThresholds(opts.PercentThresholds)
+	for _, t := range opts.UnderThresholds {
+		a.underNames = append(a.underNames, underThreshold{
+			value: t,
+			name:  "under_" + strconv.FormatFloat(t, 'f', -1, 64),
+		})
+	}
+	return &a
+}
+
+// SetPercentThresholds replaces the percentiles computed for timers.
+func (a *Aggregator) SetPercentThresholds(percentThresholds []float64) {
+	a.PercentThresholds = percentThresholds
+	a.percentNames = make(map[float64]percentStruct, len(percentThresholds))
+	for _, pct := range percentThresholds {
+		sPct := strconv.Itoa(int(pct))
+		a.percentNames[pct] = percentStruct{
+			count:      "count_" + sPct,
+			mean:       "mean_" + sPct,
+			sum:        "sum_" + sPct,
+			sumSquares: "sum_squares_" + sPct,
+			upper:      "upper_" + sPct,
+			lower:      "lower_" + sPct,
+		}
+	}
+}
+
+// MetricsReceived returns the number of metrics received since the last Expire.
+func (a *Aggregator) MetricsReceived() uint64 {
+	return a.metricsReceived
+}
+
+// CounterOverflows returns the number of times a counter overflowed since the Aggregator was created.
+func (a *Aggregator) CounterOverflows() uint64 {
+	return a.counterOverflows
+}
+
+// GaugesDebounced returns the number of flapping gauges which only had their last value flushed by the last Flush.
+func (a *Aggregator) GaugesDebounced() int {
+	return a.gaugesDebounced
+}
+
+// interpolatePercentile returns the percentile pct of the sorted values, by linear interpolation between the two
+// closest ranks.  A negative pct is the lower bound of the values, so -10 is the 90th percentile.
+func interpolatePercentile(values []float64, pct float64) float64 {
+	if pct < 0 {
+		pct = 100 + pct
+	}
+	rank := pct / 100 * float64(len(values)-1)
+	lower := int(math.Floor(rank))
+	if lower >= len(values)-1 {
+		return values[len(values)-1]
+	}
+	return values[lower] + (rank-float64(lower))*(values[lower+1]-values[lower])
+}
+
+// PercentileValue returns the value at percentile pct of the sorted values, as reported by Flush for upper_XX or
+// lower_XX, or false if the percentile holds no values.
+func (a *Aggregator) PercentileValue(values []float64, pct float64) (float64, bool) {
+	n := len(values)
+	switch n {
+	case 0:
+		return 0, false
+	case 1:
+		return values[0], true
+	}
+	numInThreshold := int(round(math.Abs(pct) / 100 * float64(n)))
+	switch {
+	case numInThreshold == 0:
+		return 0, false
+	case a.LinearPercentiles:
+		return interpolatePercentile(values, pct), true
+	case pct > 0:
+		return values[numInThreshold-1], true
+	default:
+		return values[n-numInThreshold], true
+	}
+}
+
+// round rounds a number to its nearest integer value.
+// poor man's math.Round(x) = math.Floor(x + 0.5).
+func round(v float64) float64 {
+	return math.Floor(v + 0.5)
+}
+
+// Flush computes the values of the metrics received over flushInterval, and returns the MetricMap holding them.
+// The MetricMap is only valid until Expire is called.
+func (a *Aggregator) Flush(flushInterval time.Duration) *gostatsd.MetricMap {
+	a.overflowLogged = false
+	a.Interval = flushInterval
+
+	flushInSeconds := float64(flushInterval) / float64(time.Second)
+
+	a.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		counter.PerSecond = float64(counter.Value) / flushInSeconds
+		a.Counters[key][tagsKey] = counter
+	})
+
+	a.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		if timer.Histogram != nil {
+			a.flushTimerHistogram(&timer, flushInSeconds)
+			a.Timers[key][tagsKey] = timer
+			return
+		}
+		if timer.HDR != nil {
+			a.flushTimerHDR(&timer, flushInSeconds)
+			a.Timers[key][tagsKey] = timer
+			return
+		}
+		if count := len(timer.Values); count > 0 {
+			sort.Float64s(timer.Values)
+			timer.Min = timer.Values[0]
+			timer.Max = timer.Values[count-1]
+			n := len(timer.Values)
+			count := float64(n)
+
+			cumulativeValues := make([]float64, n)
+			cumulSumSquaresValues := make([]float64, n)
+			cumulativeValues[0] = timer.Min
+			cumulSumSquaresValues[0] = timer.Min * timer.Min
+			for i := 1; i < n; i++ {
+				cumulativeValues[i] = timer.Values[i] + cumulativeValues[i-1]
+				cumulSumSquaresValues[i] = timer.Values[i]*timer.Values[i] + cumulSumSquaresValues[i-1]
+			}
+
+			var sumSquares = timer.Min * timer.Min
+			var mean = timer.Min
+			var sum = timer.Min
+			var thresholdBoundary = timer.Max
+
+			for pct, pctStruct := range a.percentNames {
+				numInThreshold := n
+				if n > 1 {
+					numInThreshold = int(round(math.Abs(pct) / 100 * count))
+					if numInThreshold == 0 {
+						continue
+					}
+					if pct > 0 {
+						sum = cumulativeValues[numInThreshold-1]
+						sumSquares = cumulSumSquaresValues[numInThreshold-1]
+					} else {
+						sum = cumulativeValues[n-1] - cumulativeValues[n-numInThreshold-1]
+						sumSquares = cumulSumSquaresValues[n-1] - cumulSumSquaresValues[n-numInThreshold-1]
+					}
+					mean = sum / float64(numInThreshold)
+					thresholdBoundary, _ = a.PercentileValue(timer.Values, pct)
+				}
+
+				a.setPercentile(&timer, pct, pctStruct, float64(numInThreshold), mean, sum, sumSquares, thresholdBoundary)
+			}
+
+			for _, under := range a.underNames {
+				// Values equal to the threshold are counted, as with the le buckets of a Prometheus histogram.
+				numUnder := sort.Search(n, func(i int) bool {
+					return timer.Values[i] > under.value
+				})
+				timer.Percentiles.Set(under.name, float64(numUnder))
+			}
+
+			sum = cumulativeValues[n-1]
+			sumSquares = cumulSumSquaresValues[n-1]
+			mean = sum / count
+
+			var sumOfDiffs float64
+			for i := 0; i < n; i++ {
+				sumOfDiffs += (timer.Values[i] - mean) * (timer.Values[i] - mean)
+			}
+
+			mid := int(math.Floor(count / 2))
+			if math.Mod(count, 2) == 0 {
+				timer.Median = (timer.Values[mid-1] + timer.Values[mid]) / 2
+			} else {
+				timer.Median = timer.Values[mid]
+			}
+
+			timer.Mean = mean
+			timer.StdDev = math.Sqrt(sumOfDiffs / count)
+			timer.Sum = sum
+			timer.SumSquares = sumSquares
+
+			timer.Count = int(round(timer.SampledCount))
+			timer.PerSecond = timer.SampledCount / flushInSeconds
+
+			a.Timers[key][tagsKey] = timer
+		} else {
+			timer.Count = 0
+			timer.SampledCount = 0
+			timer.PerSecond = 0
+		}
+	})
+
+	a.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		if set.Approximate() {
+			// Copy the tags, as they are shared with the set after Expire.
+			set.Tags = append(set.Tags[:len(set.Tags):len(set.Tags)], approxTag)
+			a.Sets[key][tagsKey] = set
+		}
+	})
+
+	if a.Peaks != nil {
+		a.trackFlushedPeaks()
+	}
+	if a.GaugeConflicts != nil {
+		a.resolveGaugeConflicts()
+	}
+	if a.GaugeDerivative != nil {
+		a.deriveGauges(flushInSeconds)
+	}
+	if a.GaugeFlapThreshold > 0 {
+		a.debounceFlappingGauges()
+	}
+	if a.GaugeMinMax {
+		a.flushGaugeRanges()
+	}
+	if a.Peaks != nil {
+		a.flushPeaks()
+	}
+	for _, late := range a.late {
+		late.Flush(late.End.Sub(late.Start))
+		late.MetricMap.Late = true
+	}
+	return &a.MetricMap
+}
+
+// deriveGauges replaces the value of each gauge matching GaugeDerivative with its per-second rate of change since the
+// last flush.  A decrease is taken to be a reset of the underlying counter, and flushed as 0.  A gauge seen for the
+// first time has no rate yet, so it is held back from the flush.  The values are restored by Expire.
+func (a *Aggregator) deriveGauges(flushInSeconds float64) {
+	a.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		if !a.GaugeDerivative.Matches(key) {
+			return
+		}
+		previous, ok := a.gaugePrevious[key][tagsKey]
+		setGaugeValue(a.gaugePrevious, key, tagsKey, gauge.Value)
+		if !ok {
+			deleteMetric(key, tagsKey, a.Gauges)
+			held, ok := a.heldGauges[key]
+			if !ok {
+				held = map[string]gostatsd.Gauge{}
+				a.heldGauges[key] = held
+			}
+			held[tagsKey] = gauge
+			return
+		}
+		setGaugeValue(a.gaugeRaw, key, tagsKey, gauge.Value)
+		delta := gauge.Value - previous
+		if delta < 0 {
+			delta = 0
+		}
+		gauge.Value = delta / flushInSeconds
+		a.Gauges[key][tagsKey] = gauge
+	})
+}
+
+func setGaugeValue(values map[string]map[string]float64, key, tagsKey string, value float64) {
+	v, ok := values[key]
+	if !ok {
+		v = map[string]float64{}
+		values[key] = v
+	}
+	v[tagsKey] = value
+}
+
+// debounceFlappingGauges flushes only the last value of each gauge which changed value more than GaugeFlapThreshold
+// times in the flush interval, rather than the value chosen by its gauge conflict policy or its min and max, and
+// counts them.
+func (a *Aggregator) debounceFlappingGauges() {
+	debounced := 0
+	for key, tagged := range a.gaugeChanges {
+		for tagsKey, changes := range tagged {
+			if changes <= a.GaugeFlapThreshold {
+				continue
+			}
+			gauge, ok := a.Gauges[key][tagsKey]
+			if !ok {
+				continue
+			}
+			if r, ok := a.gaugeRanges[key][tagsKey]; ok {
+				if r.resolved && (a.GaugeDerivative == nil || !a.GaugeDerivative.Matches(key)) {
+					gauge.Value = r.last
+					a.Gauges[key][tagsKey] = gauge
+				}
+				delete(a.gaugeRanges[key], tagsKey)
+				if len(a.gaugeRanges[key]) == 0 {
+					delete(a.gaugeRanges, key)
+				}
+			}
+			debounced++
+		}
+	}
+	a.gaugesDebounced = debounced
+}
+
+// gaugeRange is the lowest, highest and sum of the values of a gauge in the flush interval.
+type gaugeRange struct {
+	min, max float64
+	sum      float64
+	count    int
+	policy   string  // GaugeConflict* policy of the gauge
+	last     float64 // Value of the gauge before it was replaced by the value of the policy for the flush
+	resolved bool    // The value of the gauge was replaced by the value of the policy for the flush
+	flushed  bool    // The .min and .max gauges were added to the MetricMap by the flush
+}
+
+// value returns the value of the gauge by the conflict policy.
+func (r *gaugeRange) value() float64 {
+	switch r.policy {
+	case GaugeConflictMax:
+		return r.max
+	case GaugeConflictMin:
+		return r.min
+	case GaugeConflictMean:
+		return r.sum / float64(r.count)
+	case GaugeConflictSum:
+		return r.sum
+	}
+	return r.last
+}
+
+// gaugeConflictPolicy returns the conflict policy of the gauge name.
+func (a *Aggregator) gaugeConflictPolicy(name string) string {
+	if a.GaugeConflicts == nil {
+		return GaugeConflictLast
+	}
+	return a.GaugeConflicts.Policy(name)
+}
+
+// trackGaugeRange records value as a value of the gauge key with tagsKey in the flush interval.
+func (a *Aggregator) trackGaugeRange(key, tagsKey string, value float64, policy string) {
+	tagged, ok := a.gaugeRanges[key]
+	if !ok {
+		tagged = map[string]gaugeRange{}
+		a.gaugeRanges[key] = tagged
+	}
+	r, ok := tagged[tagsKey]
+	if !ok {
+		r = gaugeRange{min: value, max: value, policy: policy}
+	} else if value < r.min {
+		r.min = value
+	} else if value > r.max {
+		r.max = value
+	}
+	r.sum += value
+	r.count++
+	tagged[tagsKey] = r
+}
+
+// resolveGaugeConflicts replaces the value of each gauge updated in the flush interval which has a conflict policy
+// other than GaugeConflictLast with the value of its policy.  The last values are restored by Expire.
+func (a *Aggregator) resolveGaugeConflicts() {
+	for key, tagged := range a.gaugeRanges {
+		for tagsKey, r := range tagged {
+			if r.policy == GaugeConflictLast {
+				continue
+			}
+			gauge, ok := a.Gauges[key][tagsKey]
+			if !ok {
+				continue
+			}
+			r.last = gauge.Value
+			r.resolved = true
+			tagged[tagsKey] = r
+			gauge.Value = r.value()
+			a.Gauges[key][tagsKey] = gauge
+		}
+	}
+}
+
+// flushGaugeRanges adds <name>.min and <name>.max gauges with the lowest and highest values of each gauge updated in
+// the flush interval, unless the gauge has been held back, or a gauge with that name and tags was received.  They are
+// removed by Expire.
+func (a *Aggregator) flushGaugeRanges() {
+	for key, tagged := range a.gaugeRanges {
+		minKey, maxKey := key+".min", key+".max"
+		for tagsKey, r := range tagged {
+			gauge, ok := a.Gauges[key][tagsKey]
+			if !ok {
+				continue
+			}
+			if _, ok := a.Gauges[minKey][tagsKey]; ok {
+				continue
+			}
+			if _, ok := a.Gauges[maxKey][tagsKey]; ok {
+				continue
+			}
+			for _, g := range []struct {
+				key   string
+				value float64
+			}{{minKey, r.min}, {maxKey, r.max}} {
+				v, ok := a.Gauges[g.key]
+				if !ok {
+					v = map[string]gostatsd.Gauge{}
+					a.Gauges[g.key] = v
+				}
+				gauge.Value = g.value
+				v[tagsKey] = gauge
+			}
+			r.flushed = true
+			tagged[tagsKey] = r
+		}
+	}
+}
+
+// expireGaugeRanges removes the gauges added by flushGaugeRanges, restores the last value of the gauges replaced by
+// resolveGaugeConflicts, and starts tracking the next interval.
+func (a *Aggregator) expireGaugeRanges() {
+	for key, tagged := range a.gaugeRanges {
+		for tagsKey, r := range tagged {
+			if r.flushed {
+				deleteMetric(key+".min", tagsKey, a.Gauges)
+				deleteMetric(key+".max", tagsKey, a.Gauges)
+			}
+			if gauge, ok := a.Gauges[key][tagsKey]; ok && r.resolved {
+				gauge.Value = r.last
+				a.Gauges[key][tagsKey] = gauge
+			}
+		}
+	}
+	a.gaugeRanges = map[string]map[string]gaugeRange{}
+}
+
+// isExpired returns whether a metric last updated at ts has expired.  A ttl set by the client overrides the
+// expiry interval.
+func (a *Aggregator) isExpired(now, ts gostatsd.Nanotime, ttl time.Duration) bool {
+	if ttl != 0 {
+		return time.Duration(now-ts) > ttl
+	}
+	return a.ExpiryInterval != 0 && time.Duration(now-ts) > a.ExpiryInterval
+}
+
+// isCounterExpired is isExpired for counters, which may have their own grace period.
+func (a *Aggregator) isCounterExpired(now, ts gostatsd.Nanotime, ttl time.Duration) bool {
+	if ttl == 0 && a.CounterGracePeriod != 0 {
+		return time.Duration(now-ts) > a.CounterGracePeriod
+	}
+	return a.isExpired(now, ts, ttl)
+}
+
+func deleteMetric(key, tagsKey string, metrics gostatsd.AggregatedMetrics) {
+	metrics.DeleteChild(key, tagsKey)
+	if !metrics.HasChildren(key) {
+		metrics.Delete(key)
+	}
+}
+
+// Expire removes the metrics which have expired at now, and clears the values of the others for the next interval.
+func (a *Aggregator) Expire(now time.Time) {
+	a.metricsReceived = 0
+	if a.LateArrivalWindow > 0 {
+		a.startInterval(now)
+	}
+	if a.Peaks != nil {
+		a.expirePeakGauges(now)
+	}
+	nowNano := gostatsd.Nanotime(now.UnixNano())
+
+	a.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		if a.isCounterExpired(nowNano, counter.Timestamp, counter.TTL) {
+			deleteMetric(key, tagsKey, a.Counters)
+		} else {
+			a.Counters[key][tagsKey] = gostatsd.Counter{
+				Timestamp: counter.Timestamp,
+				Hostname:  counter.Hostname,
+				Tags:      counter.Tags,
+				TTL:       counter.TTL,
+			}
+		}
+	})
+
+	a.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		if a.isExpired(nowNano, timer.Timestamp, timer.TTL) {
+			deleteMetric(key, tagsKey, a.Timers)
+		} else {
+			values := timer.Values[:0]
+			histogram, hdr := timer.Histogram, timer.HDR
+			if a.HandOffTimerValues {
+				values = nil
+				histogram, hdr = nil, nil
+			} else {
+				if histogram != nil {
+					histogram.Reset()
+				}
+				if hdr != nil {
+					hdr.Reset()
+				}
+			}
+			a.Timers[key][tagsKey] = gostatsd.Timer{
+				Timestamp: timer.Timestamp,
+				Hostname:  timer.Hostname,
+				Tags:      timer.Tags,
+				Values:    values,
+				TTL:       timer.TTL,
+				Histogram: histogram,
+				HDR:       hdr,
+			}
+		}
+	})
+
+	if len(a.heldGauges) > 0 {
+		a.heldGauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+			v, ok := a.Gauges[key]
+			if !ok {
+				v = map[string]gostatsd.Gauge{}
+				a.Gauges[key] = v
+			}
+			v[tagsKey] = gauge
+		})
+		a.heldGauges = gostatsd.Gauges{}
+	}
+	if a.GaugeFlapThreshold > 0 {
+		a.gaugeChanges = map[string]map[string]int{}
+	}
+	if len(a.gaugeRaw) > 0 {
+		for key, tagged := range a.gaugeRaw {
+			for tagsKey, value := range tagged {
+				if gauge, ok := a.Gauges[key][tagsKey]; ok {
+					gauge.Value = value
+					a.Gauges[key][tagsKey] = gauge
+				}
+			}
+		}
+		a.gaugeRaw = map[string]map[string]float64{}
+	}
+	// After the held and derivative gauges are restored, so the last values of those with a conflict policy are too.
+	if len(a.gaugeRanges) > 0 {
+		a.expireGaugeRanges()
+	}
+
+	a.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		if a.isExpired(nowNano, gauge.Timestamp, gauge.TTL) {
+			deleteMetric(key, tagsKey, a.Gauges)
+			if previous, ok := a.gaugePrevious[key]; ok {
+				delete(previous, tagsKey)
+				if len(previous) == 0 {
+					delete(a.gaugePrevious, key)
+				}
+			}
+		}
+		// No reset for gauges, they keep the last value until expiration
+	})
+
+	a.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		if a.isExpired(nowNano, set.Timestamp, set.TTL) {
+			deleteMetric(key, tagsKey, a.Sets)
+		} else {
+			tags := set.Tags
+			if set.Approximate() && len(tags) > 0 && tags[len(tags)-1] == approxTag {
+				tags = tags[:len(tags)-1] // Added by Flush
+			}
+			a.Sets[key][tagsKey] = gostatsd.Set{
+				Values:    make(map[string]struct{}),
+				Timestamp: set.Timestamp,
+				Hostname:  set.Hostname,
+				Tags:      tags,
+				TTL:       set.TTL,
+			}
+		}
+	})
+}
+
+func (a *Aggregator) receiveCounter(m *gostatsd.Metric, tagsKey string, now gostatsd.Nanotime) {
+	value := a.counterValue(m)
+	v, ok := a.Counters[m.Name]
+	if ok {
+		c, ok := v[tagsKey]
+		if ok {
+			c.Value = a.addCounter(m.Name, c.Value, value)
+			c.Timestamp = now
+		} else {
+			c = gostatsd.NewCounter(now, value, m.Hostname, m.Tags)
+		}
+		c.TTL = metricTTL(m, c.TTL)
+		v[tagsKey] = c
+	} else {
+		c := gostatsd.NewCounter(now, value, m.Hostname, m.Tags)
+		c.TTL = m.TTL
+		a.Counters[m.Name] = map[string]gostatsd.Counter{
+			tagsKey: c,
+		}
+	}
+}
+
+// counterValue returns the value of m scaled by its sample rate, limited to the range of int64.
+func (a *Aggregator) counterValue(m *gostatsd.Metric) int64 {
+	value := m.Value / m.Rate
+	switch {
+	case value >= -math.MinInt64: // 2^63, which is not representable as an int64
+		a.counterOverflowed(m.Name, value)
+		return math.MaxInt64
+	case value < math.MinInt64:
+		a.counterOverflowed(m.Name, value)
+		return math.MinInt64
+	}
+	return int64(value)
+}
+
+// addCounter returns the counter value c incremented by value, saturating or wrapping around on overflow.
+func (a *Aggregator) addCounter(name string, c, value int64) int64 {
+	sum := c + value
+	if (value > 0 && sum < c) || (value < 0 && sum > c) {
+		a.counterOverflowed(name, float64(c)+float64(value))
+		if !a.WrapCounters {
+			if value > 0 {
+				return math.MaxInt64
+			}
+			return math.MinInt64
+		}
+	}
+	return sum
+}
+
+// counterOverflowed counts an overflow of the counter name, logging the first overflow of each flush interval.
+func (a *Aggregator) counterOverflowed(name string, value float64) {
+	a.counterOverflows++
+	if a.overflowLogged {
+		return
+	}
+	a.overflowLogged = true
+	action := "saturated"
+	if a.WrapCounters {
+		action = "wrapped around"
+	}
+	a.Logger.WithFields(log.Fields{
+		logging.FieldBucket: name,
+		"value":             value,
+	}).Warnf("Counter overflowed int64, %s", action)
+}
+
+func (a *Aggregator) receiveGauge(m *gostatsd.Metric, tagsKey string, now gostatsd.Nanotime) {
+	// A gauge is a point in time value, so the sample rate has no meaning and is ignored.
+	// A delta to a gauge which doesn't exist yet changes it from 0, as in statsd.
+	policy := a.gaugeConflictPolicy(m.Name)
+	trackRange := a.GaugeMinMax || policy != GaugeConflictLast
+	v, ok := a.Gauges[m.Name]
+	if ok {
+		g, ok := v[tagsKey]
+		if ok {
+			value := m.Value
+			if m.GaugeDelta {
+				value += g.Value
+			}
+			if trackRange {
+				// The range is of the values received, whatever the smoothing.
+				a.trackGaugeRange(m.Name, tagsKey, value, policy)
+			}
+			if a.Peaks != nil && a.Peaks.Matches(m.Name) {
+				trackPeak(a.gaugePeaks, a.PeakWindows, m.Name, tagsKey, value, g.Hostname, g.Tags, now)
+			}
+			if a.GaugeSmoothing != nil && a.GaugeSmoothing.Matches(m.Name) {
+				value = a.GaugeSmoothing.Blend(g.Value, value)
+			}
+			if a.GaugeFlapThreshold > 0 && g.Value != value {
+				a.countGaugeChange(m.Name, tagsKey)
+			}
+			g.Value = value
+			g.Timestamp = now
+		} else {
+			g = gostatsd.NewGauge(now, m.Value, m.Hostname, m.Tags)
+			if trackRange {
+				a.trackGaugeRange(m.Name, tagsKey, m.Value, policy)
+			}
+			if a.Peaks != nil && a.Peaks.Matches(m.Name) {
+				trackPeak(a.gaugePeaks, a.PeakWindows, m.Name, tagsKey, m.Value, g.Hostname, g.Tags, now)
+			}
+		}
+		g.TTL = metricTTL(m, g.TTL)
+		v[tagsKey] = g
+	} else {
+		g := gostatsd.NewGauge(now, m.Value, m.Hostname, m.Tags)
+		g.TTL = m.TTL
+		a.Gauges[m.Name] = map[string]gostatsd.Gauge{
+			tagsKey: g,
+		}
+		if trackRange {
+			a.trackGaugeRange(m.Name, tagsKey, m.Value, policy)
+		}
+		if a.Peaks != nil && a.Peaks.Matches(m.Name) {
+			trackPeak(a.gaugePeaks, a.PeakWindows, m.Name, tagsKey, m.Value, g.Hostname, g.Tags, now)
+		}
+	}
+}
+
+func (a *Aggregator) countGaugeChange(key, tagsKey string) {
+	v, ok := a.gaugeChanges[key]
+	if !ok {
+		v = map[string]int{}
+		a.gaugeChanges[key] = v
+	}
+	v[tagsKey]++
+}
+
+func (a *Aggregator) receiveTimer(m *gostatsd.Metric, tagsKey string, now gostatsd.Nanotime) {
+	if a.HDRTimers != nil && a.HDRTimers.Matches(m.Name) {
+		a.receiveTimerHDR(m, tagsKey, now)
+		return
+	}
+	if a.TimerHistograms {
+		a.receiveTimerHistogram(m, tagsKey, now)
+		return
+	}
+	// A pre-aggregated timer carries further values in m.Values, each sampled at the same rate.
+	sampledCount := float64(1+len(m.Values)) / m.Rate
+	v, ok := a.Timers[m.Name]
+	if ok {
+		t, ok := v[tagsKey]
+		if ok {
+			t.Values = append(t.Values, m.Value)
+			t.Values = append(t.Values, m.Values...)
+			t.Timestamp = now
+			t.SampledCount += sampledCount
+		} else {
+			t = gostatsd.NewTimer(now, timerValues(m), m.Hostname, m.Tags)
+			t.SampledCount = sampledCount
+		}
+		t.TTL = metricTTL(m, t.TTL)
+		v[tagsKey] = t
+	} else {
+		t := gostatsd.NewTimer(now, timerValues(m), m.Hostname, m.Tags)
+		t.SampledCount = sampledCount
+		t.TTL = m.TTL
+
+		a.Timers[m.Name] = map[string]gostatsd.Timer{
+			tagsKey: t,
+		}
+	}
+}
+
+// metricTTL returns the TTL of a bucket with the TTL current after receiving m.  The last TTL set by the client
+// wins, and a metric without one leaves it unchanged.
+func metricTTL(m *gostatsd.Metric, current time.Duration) time.Duration {
+	if m.TTL != 0 {
+		return m.TTL
+	}
+	return current
+}
+
+// timerValues returns a new slice holding all the values of a timer metric.
+func timerValues(m *gostatsd.Metric) []float64 {
+	values := make([]float64, 0, 1+len(m.Values))
+	values = append(values, m.Value)
+	return append(values, m.Values...)
+}
+
+func (a *Aggregator) receiveSet(m *gostatsd.Metric, tagsKey string, now gostatsd.Nanotime) {
+	v, ok := a.Sets[m.Name]
+	if ok {
+		s, ok := v[tagsKey]
+		if ok {
+			s.Timestamp = now
+		} else {
+			s = gostatsd.NewSet(now, nil, m.Hostname, m.Tags)
+		}
+		s.TTL = metricTTL(m, s.TTL)
+		a.insertSetMembers(&s, m)
+		v[tagsKey] = s
+	} else {
+		s := gostatsd.NewSet(now, nil, m.Hostname, m.Tags)
+		s.TTL = m.TTL
+		a.insertSetMembers(&s, m)
+
+		a.Sets[m.Name] = map[string]gostatsd.Set{
+			tagsKey: s,
+		}
+	}
+}
+
+// insertSetMembers adds the members in the value of m to s.
+func (a *Aggregator) insertSetMembers(s *gostatsd.Set, m *gostatsd.Metric) {
+	// The sample rate does not change the cardinality of a set, so it is ignored.
+	if a.SetDelimiter == "" {
+		s.Insert(m.StringValue, a.SetExactLimit)
+		return
+	}
+	for _, member := range strings.Split(m.StringValue, a.SetDelimiter) {
+		if member != "" {
+			s.Insert(member, a.SetExactLimit)
+		}
+	}
+}
+
+// Receive aggregates a metric received at now.
+func (a *Aggregator) Receive(m *gostatsd.Metric, now time.Time) {
+	if a.LateArrivalWindow > 0 && m.Timestamp != 0 && (m.Type == gostatsd.COUNTER || m.Type == gostatsd.TIMER) {
+		if late := a.lateInterval(time.Unix(0, int64(m.Timestamp)), now); late != nil {
+			a.lateMetrics++
+			late.Receive(m, time.Unix(0, int64(m.Timestamp)))
+			return
+		}
+	}
+	a.metricsReceived++
+	tagsKey := m.TagsKey
+	nowNano := gostatsd.Nanotime(now.UnixNano())
+
+	switch m.Type {
+	case gostatsd.COUNTER:
+		a.receiveCounter(m, tagsKey, nowNano)
+	case gostatsd.GAUGE:
+		a.receiveGauge(m, tagsKey, nowNano)
+	case gostatsd.TIMER:
+		a.receiveTimer(m, tagsKey, nowNano)
+	case gostatsd.SET:
+		a.receiveSet(m, tagsKey, nowNano)
+	default:
+		a.Logger.WithField(logging.FieldBucket, m.Name).Errorf("Unknown metric type %s", m.Type)
+	}
+}
+
+// AggregatedValue returns the current aggregated value of the metric m was applied to.  For timers, this is the
+// number of values.
+func (a *Aggregator) AggregatedValue(m *gostatsd.Metric) interface{} {
+	switch m.Type {
+	case gostatsd.COUNTER:
+		return a.Counters[m.Name][m.TagsKey].Value
+	case gostatsd.GAUGE:
+		return a.Gauges[m.Name][m.TagsKey].Value
+	case gostatsd.TIMER:
+		if h := a.Timers[m.Name][m.TagsKey].Histogram; h != nil {
+			return int(h.Count)
+		}
+		if h := a.Timers[m.Name][m.TagsKey].HDR; h != nil {
+			return int(h.Count)
+		}
+		return len(a.Timers[m.Name][m.TagsKey].Values)
+	case gostatsd.SET:
+		set := a.Sets[m.Name][m.TagsKey]
+		return set.Cardinality()
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package aggregation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsExpired(t *testing.T) {
+	t.Parallel()
+	assrt := assert.New(t)
+
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+
+	a := New(Options{ExpiryInterval: 0})
+	assrt.Equal(false, a.isExpired(now, now, 0))
+
+	a.ExpiryInterval = 10 * time.Second
+
+	ts := gostatsd.Nanotime(time.Now().Add(-30 * time.Second).UnixNano())
+	assrt.Equal(true, a.isExpired(now, ts, 0))
+
+	ts = gostatsd.Nanotime(time.Now().Add(-1 * time.Second).UnixNano())
+	assrt.Equal(false, a.isExpired(now, ts, 0))
+
+	// A TTL set by the client overrides the expiry interval, even when expiry is disabled.
+	assrt.Equal(true, a.isExpired(now, ts, 500*time.Millisecond))
+	ts = gostatsd.Nanotime(time.Now().Add(-30 * time.Second).UnixNano())
+	assrt.Equal(false, a.isExpired(now, ts, time.Minute))
+	a.ExpiryInterval = 0
+	assrt.Equal(true, a.isExpired(now, ts, 10*time.Second))
+}
+
+func TestCounterGracePeriodDefault(t *testing.T) {
+	t.Parallel()
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	ts := gostatsd.Nanotime(time.Now().Add(-time.Minute).UnixNano())
+
+	a := New(Options{ExpiryInterval: 30 * time.Second})
+	assert.True(t, a.isCounterExpired(now, ts, 0))
+	a.CounterGracePeriod = 2 * time.Minute
+	assert.False(t, a.isCounterExpired(now, ts, 0))
+}
+
+func TestGaugeDebounceDisabled(t *testing.T) {
+	t.Parallel()
+	a := New(Options{})
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		a.Receive(&gostatsd.Metric{Name: "flapping", Value: float64(i % 2), Type: gostatsd.GAUGE, Rate: 1}, now)
+	}
+	a.Flush(1 * time.Second)
+	assert.Equal(t, 1.0, a.Gauges["flapping"][""].Value)
+	assert.Empty(t, a.gaugeChanges)
+}
+
+func TestGaugeDeltas(t *testing.T) {
+	t.Parallel()
+	a := New(Options{})
+	now := time.Now()
+	// A delta to a gauge which doesn't exist changes it from 0.
+	a.Receive(&gostatsd.Metric{Name: "level", Value: -5, GaugeDelta: true, Type: gostatsd.GAUGE, Rate: 1}, now)
+	assert.Equal(t, -5.0, a.Gauges["level"][""].Value)
+	a.Receive(&gostatsd.Metric{Name: "level", Value: 20, Type: gostatsd.GAUGE, Rate: 1}, now)
+	a.Receive(&gostatsd.Metric{Name: "level", Value: 5, GaugeDelta: true, Type: gostatsd.GAUGE, Rate: 1}, now)
+	a.Receive(&gostatsd.Metric{Name: "level", Value: -2, GaugeDelta: true, Type: gostatsd.GAUGE, Rate: 1}, now)
+	a.Flush(1 * time.Second)
+	assert.Equal(t, 23.0, a.Gauges["level"][""].Value)
+
+	// Deltas carry on from the value kept from the previous interval.
+	a.Expire(now)
+	a.Receive(&gostatsd.Metric{Name: "level", Value: 1, GaugeDelta: true, Type: gostatsd.GAUGE, Rate: 1}, now)
+	a.Flush(1 * time.Second)
+	assert.Equal(t, 24.0, a.Gauges["level"][""].Value)
+}
+
+func TestInterpolatePercentile(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, 7.0, interpolatePercentile([]float64{7}, 90))
+	assert.Equal(t, 7.0, interpolatePercentile([]float64{7}, -90))
+	assert.Equal(t, 2.0, interpolatePercentile([]float64{1, 2}, 100))
+	assert.Equal(t, 1.0, interpolatePercentile([]float64{1, 2}, 0))
+	assert.Equal(t, 1.5, interpolatePercentile([]float64{1, 2}, 50))
+}
+
+// TestIntervals runs an Aggregator through several intervals with a fake clock, as a stream processor would.
+func TestIntervals(t *testing.T) {
+	t.Parallel()
+	start := time.Unix(1000, 0)
+	at := func(d time.Duration) time.Time {
+		return start.Add(d)
+	}
+	a := New(Options{PercentThresholds: []float64{90}, ExpiryInterval: 15 * time.Second})
+
+	a.Receive(&gostatsd.Metric{Name: "hits", Value: 3, Type: gostatsd.COUNTER, Rate: 0.5}, at(time.Second))
+	a.Receive(&gostatsd.Metric{Name: "hits", Value: 4, Type: gostatsd.COUNTER, Rate: 1}, at(2*time.Second))
+	a.Receive(&gostatsd.Metric{Name: "temp", Value: 20, Type: gostatsd.GAUGE, Rate: 1}, at(3*time.Second))
+	for _, v := range []float64{4, 1, 3, 2} {
+		a.Receive(&gostatsd.Metric{Name: "lat", Value: v, Type: gostatsd.TIMER, Rate: 1}, at(4*time.Second))
+	}
+	a.Receive(&gostatsd.Metric{Name: "users", StringValue: "bob", Type: gostatsd.SET, Rate: 1}, at(5*time.Second))
+	assert.EqualValues(t, 8, a.MetricsReceived())
+
+	m := a.Flush(10 * time.Second)
+	assert.Equal(t, gostatsd.Counter{Value: 10, PerSecond: 1, Timestamp: gostatsd.Nanotime(at(2 * time.Second).UnixNano())}, m.Counters["hits"][""])
+	assert.Equal(t, 20.0, m.Gauges["temp"][""].Value)
+	timer := m.Timers["lat"][""]
+	assert.Equal(t, 4, timer.Count)
+	assert.Equal(t, 0.4, timer.PerSecond)
+	assert.Equal(t, 1.0, timer.Min)
+	assert.Equal(t, 4.0, timer.Max)
+	assert.Equal(t, 2.5, timer.Median)
+	assert.Equal(t, gostatsd.Percentiles{
+		{Float: 4, Str: "count_90"},
+		{Float: 2.5, Str: "mean_90"},
+		{Float: 10, Str: "sum_90"},
+		{Float: 30, Str: "sum_squares_90"},
+		{Float: 4, Str: "upper_90"},
+	}, timer.Percentiles)
+	assert.Equal(t, 1, m.Sets["users"][""].Cardinality())
+
+	// Nothing is received in the next interval, so the counter and timer are flushed as zero until they expire.
+	a.Expire(at(10 * time.Second))
+	assert.Zero(t, a.MetricsReceived())
+	m = a.Flush(10 * time.Second)
+	assert.Zero(t, m.Counters["hits"][""].Value)
+	assert.Zero(t, m.Timers["lat"][""].Count)
+	assert.Equal(t, 20.0, m.Gauges["temp"][""].Value)
+	assert.Zero(t, m.Sets["users"][""].Cardinality())
+
+	a.Expire(at(21 * time.Second))
+	m = a.Flush(10 * time.Second)
+	require.NotNil(t, m)
+	assert.Empty(t, m.Counters)
+	assert.Empty(t, m.Timers)
+	assert.Empty(t, m.Gauges)
+	assert.Empty(t, m.Sets)
+}
+
+func TestLateArrivals(t *testing.T) {
+	t.Parallel()
+	start := time.Unix(1000, 0)
+	at := func(d time.Duration) time.Time {
+		return start.Add(d)
+	}
+	received := func(d time.Duration) gostatsd.Nanotime {
+		return gostatsd.Nanotime(at(d).UnixNano())
+	}
+	a := New(Options{ExpiryInterval: time.Minute, LateArrivalWindow: 5 * time.Second})
+	a.Expire(at(0))
+	a.Flush(10 * time.Second)
+	a.Expire(at(10 * time.Second))
+	a.Flush(10 * time.Second)
+	a.Expire(at(20 * time.Second))
+
+	// Received in the second interval, and reached the aggregator within the window after it was flushed.
+	a.Receive(&gostatsd.Metric{Name: "hits", Value: 2, Type: gostatsd.COUNTER, Rate: 1, Timestamp: received(19 * time.Second)}, at(21*time.Second))
+	a.Receive(&gostatsd.Metric{Name: "lat", Value: 7, Type: gostatsd.TIMER, Rate: 1, Timestamp: received(15 * time.Second)}, at(21*time.Second))
+	// Received in the first interval, which ended more than the window ago.
+	a.Receive(&gostatsd.Metric{Name: "hits", Value: 4, Type: gostatsd.COUNTER, Rate: 1, Timestamp: received(9 * time.Second)}, at(21*time.Second))
+	// Gauges, metrics with no timestamp and metrics received in the current interval are never late.
+	a.Receive(&gostatsd.Metric{Name: "temp", Value: 1, Type: gostatsd.GAUGE, Rate: 1, Timestamp: received(19 * time.Second)}, at(21*time.Second))
+	a.Receive(&gostatsd.Metric{Name: "hits", Value: 8, Type: gostatsd.COUNTER, Rate: 1}, at(21*time.Second))
+	a.Receive(&gostatsd.Metric{Name: "hits", Value: 16, Type: gostatsd.COUNTER, Rate: 1, Timestamp: received(21 * time.Second)}, at(21*time.Second))
+
+	m := a.Flush(10 * time.Second)
+	assert.EqualValues(t, 28, m.Counters["hits"][""].Value)
+	assert.Equal(t, 1.0, m.Gauges["temp"][""].Value)
+	assert.Empty(t, m.Timers["lat"])
+	assert.False(t, m.Late)
+	assert.EqualValues(t, 4, a.MetricsReceived())
+	assert.EqualValues(t, 2, a.LateMetrics())
+
+	require.Len(t, a.Late(), 1)
+	late := a.Late()[0]
+	assert.Equal(t, at(10*time.Second), late.Start)
+	assert.Equal(t, at(20*time.Second), late.End)
+	assert.True(t, late.MetricMap.Late)
+	assert.Equal(t, 10*time.Second, late.MetricMap.Interval)
+	assert.Equal(t, gostatsd.Counter{Value: 2, PerSecond: 0.2, Timestamp: received(19 * time.Second)}, late.Counters["hits"][""])
+	assert.Equal(t, 1, late.Timers["lat"][""].Count)
+	assert.Equal(t, 7.0, late.Timers["lat"][""].Max)
+
+	// The late metrics are dropped once flushed, and the second interval is now too long ago.
+	a.Expire(at(30 * time.Second))
+	assert.Empty(t, a.Late())
+	a.Receive(&gostatsd.Metric{Name: "hits", Value: 1, Type: gostatsd.COUNTER, Rate: 1, Timestamp: received(19 * time.Second)}, at(31*time.Second))
+	a.Receive(&gostatsd.Metric{Name: "hits", Value: 1, Type: gostatsd.COUNTER, Rate: 1, Timestamp: received(29 * time.Second)}, at(31*time.Second))
+	require.Len(t, a.Late(), 1)
+	assert.Equal(t, at(20*time.Second), a.Late()[0].Start)
+	assert.EqualValues(t, 1, a.MetricsReceived())
+}
+
+func TestGaugeMinMax(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	gauge := func(name string, value float64, delta bool, tagsKey string) *gostatsd.Metric {
+		return &gostatsd.Metric{Name: name, Value: value, GaugeDelta: delta, Type: gostatsd.GAUGE, Rate: 1, TagsKey: tagsKey}
+	}
+
+	a := New(Options{})
+	a.Receive(gauge("temp", 5, false, ""), now)
+	a.Receive(gauge("temp", 2, false, ""), now)
+	m := a.Flush(time.Second)
+	assert.Len(t, m.Gauges, 1, "off by default")
+
+	a = New(Options{GaugeMinMax: true, ExpiryInterval: time.Minute})
+	for _, v := range []float64{5, 2, 9, 4} {
+		a.Receive(gauge("temp", v, false, ""), now)
+	}
+	a.Receive(gauge("temp", 7, false, "host:b"), now)
+	a.Receive(gauge("level", 10, false, ""), now)
+	a.Receive(gauge("level", -15, true, ""), now)
+	a.Receive(gauge("level", 8, true, ""), now)
+	// A gauge received with the name of a range gauge is kept as it is.
+	a.Receive(gauge("level.max", 100, false, ""), now)
+	m = a.Flush(time.Second)
+	assert.Equal(t, 4.0, m.Gauges["temp"][""].Value)
+	assert.Equal(t, 2.0, m.Gauges["temp.min"][""].Value)
+	assert.Equal(t, 9.0, m.Gauges["temp.max"][""].Value)
+	assert.Equal(t, 7.0, m.Gauges["temp.min"]["host:b"].Value)
+	assert.Equal(t, 7.0, m.Gauges["temp.max"]["host:b"].Value)
+	assert.Equal(t, 3.0, m.Gauges["level"][""].Value)
+	assert.Empty(t, m.Gauges["level.min"])
+	assert.Equal(t, 100.0, m.Gauges["level.max"][""].Value)
+	assert.Equal(t, 100.0, m.Gauges["level.max.min"][""].Value)
+
+	// The range gauges are removed for the next interval, and only gauges updated in it have a range.
+	a.Expire(now)
+	a.Receive(gauge("temp", 3, false, ""), now)
+	m = a.Flush(time.Second)
+	assert.Equal(t, 3.0, m.Gauges["temp.min"][""].Value)
+	assert.Equal(t, 3.0, m.Gauges["temp.max"][""].Value)
+	assert.Empty(t, m.Gauges["temp.min"]["host:b"])
+	assert.Equal(t, 7.0, m.Gauges["temp"]["host:b"].Value)
+	assert.Empty(t, m.Gauges["level.max.min"])
+	a.Expire(now)
+	assert.NotContains(t, a.Gauges, "temp.min")
+	assert.NotContains(t, a.Gauges, "temp.max")
+}
+
+// gaugeConflicts is a GaugeConflicts with the policy of each gauge by name.
+type gaugeConflicts map[string]string
+
+func (gc gaugeConflicts) Policy(name string) string {
+	if policy, ok := gc[name]; ok {
+		return policy
+	}
+	return GaugeConflictLast
+}
+
+func TestGaugeConflicts(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	gauge := func(name string, value float64) *gostatsd.Metric {
+		return &gostatsd.Metric{Name: name, Value: value, Type: gostatsd.GAUGE, Rate: 1}
+	}
+
+	a := New(Options{
+		GaugeConflicts: gaugeConflicts{"temp": GaugeConflictMax, "level": GaugeConflictMean},
+		GaugeMinMax:    true,
+		ExpiryInterval: time.Minute,
+	})
+	for _, v := range []float64{5, 2, 9, 4} {
+		a.Receive(gauge("temp", v), now)
+		a.Receive(gauge("level", v), now)
+	}
+	m := a.Flush(time.Second)
+	assert.Equal(t, 9.0, m.Gauges["temp"][""].Value)
+	assert.Equal(t, 5.0, m.Gauges["level"][""].Value)
+	// The range is of the values received, whatever the policy.
+	assert.Equal(t, 2.0, m.Gauges["level.min"][""].Value)
+	assert.Equal(t, 9.0, m.Gauges["level.max"][""].Value)
+
+	a.Expire(now)
+	assert.Equal(t, 4.0, a.Gauges["temp"][""].Value)
+	a.Receive(gauge("temp", 1), now)
+	m = a.Flush(time.Second)
+	assert.Equal(t, 1.0, m.Gauges["temp"][""].Value)
+	assert.Equal(t, 4.0, m.Gauges["level"][""].Value)
+}
@@ -0,0 +1,194 @@
+package aggregation
+
+import (
+	"math"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/exphist"
+	"github.com/atlassian/gostatsd/pkg/hdrhist"
+)
+
+// sketch is the estimate of the values of a timer kept by a histogram.
+type sketch interface {
+	ValueAtRank(rank uint64) float64
+	SumBelowRank(rank uint64) (float64, float64)
+	CountAtOrBelow(x float64) uint64
+}
+
+// sketchStats are the exact statistics of the values in a sketch.
+type sketchStats struct {
+	count           uint64
+	sum, sumSquares float64
+	min, max        float64
+}
+
+// receiveTimerHistogram folds the values of a timer metric in to the histogram of its timer.
+func (a *Aggregator) receiveTimerHistogram(m *gostatsd.Metric, tagsKey string, now gostatsd.Nanotime) {
+	v, ok := a.Timers[m.Name]
+	if !ok {
+		v = map[string]gostatsd.Timer{}
+		a.Timers[m.Name] = v
+	}
+	t, ok := v[tagsKey]
+	if ok {
+		t.Timestamp = now
+	} else {
+		t = gostatsd.NewTimer(now, nil, m.Hostname, m.Tags)
+	}
+	if t.Histogram == nil {
+		t.Histogram = exphist.New(a.HistogramScale, a.HistogramMaxBuckets)
+	}
+	t.Histogram.Insert(m.Value)
+	for _, value := range m.Values {
+		t.Histogram.Insert(value)
+	}
+	// A pre-aggregated timer carries further values in m.Values, each sampled at the same rate.
+	t.SampledCount += float64(1+len(m.Values)) / m.Rate
+	t.TTL = metricTTL(m, t.TTL)
+	v[tagsKey] = t
+}
+
+// receiveTimerHDR records the values of a timer metric in the HDR histogram of its timer.
+func (a *Aggregator) receiveTimerHDR(m *gostatsd.Metric, tagsKey string, now gostatsd.Nanotime) {
+	v, ok := a.Timers[m.Name]
+	if !ok {
+		v = map[string]gostatsd.Timer{}
+		a.Timers[m.Name] = v
+	}
+	t, ok := v[tagsKey]
+	if ok {
+		t.Timestamp = now
+	} else {
+		t = gostatsd.NewTimer(now, nil, m.Hostname, m.Tags)
+	}
+	if t.HDR == nil {
+		t.HDR = hdrhist.New(a.HDRLowestValue, a.HDRHighestValue, a.HDRSignificantDigits)
+	}
+	t.HDR.Insert(m.Value)
+	for _, value := range m.Values {
+		t.HDR.Insert(value)
+	}
+	t.SampledCount += float64(1+len(m.Values)) / m.Rate
+	t.TTL = metricTTL(m, t.TTL)
+	v[tagsKey] = t
+}
+
+// flushTimerHistogram computes the statistics and percentiles of a timer from its histogram, as Flush does from
+// the values of other timers.
+func (a *Aggregator) flushTimerHistogram(timer *gostatsd.Timer, flushInSeconds float64) {
+	h := timer.Histogram
+	a.flushTimerSketch(timer, h, sketchStats{h.Count, h.Sum, h.SumSquares, h.Min, h.Max}, flushInSeconds)
+}
+
+// flushTimerHDR computes the statistics and percentiles of a timer from its HDR histogram.
+func (a *Aggregator) flushTimerHDR(timer *gostatsd.Timer, flushInSeconds float64) {
+	h := timer.HDR
+	a.flushTimerSketch(timer, h, sketchStats{h.Count, h.Sum, h.SumSquares, h.Min, h.Max}, flushInSeconds)
+}
+
+// flushTimerSketch computes the statistics and percentiles of a timer from a histogram of its values.
+func (a *Aggregator) flushTimerSketch(timer *gostatsd.Timer, h sketch, stats sketchStats, flushInSeconds float64) {
+	if stats.count == 0 {
+		timer.Count = 0
+		timer.SampledCount = 0
+		timer.PerSecond = 0
+		return
+	}
+	n := stats.count
+	count := float64(n)
+	timer.Min = stats.min
+	timer.Max = stats.max
+
+	for pct, pctStruct := range a.percentNames {
+		numInThreshold := n
+		sum, sumSquares := stats.sum, stats.sumSquares
+		thresholdBoundary := stats.max
+		if n > 1 {
+			numInThreshold = uint64(round(math.Abs(pct) / 100 * count))
+			if numInThreshold == 0 {
+				continue
+			}
+			if pct > 0 {
+				sum, sumSquares = h.SumBelowRank(numInThreshold)
+				thresholdBoundary = h.ValueAtRank(numInThreshold)
+			} else {
+				lowSum, lowSumSquares := h.SumBelowRank(n - numInThreshold)
+				sum, sumSquares = stats.sum-lowSum, stats.sumSquares-lowSumSquares
+				thresholdBoundary = h.ValueAtRank(n - numInThreshold + 1)
+			}
+		}
+		a.setPercentile(timer, pct, pctStruct, float64(numInThreshold), sum/float64(numInThreshold), sum, sumSquares, thresholdBoundary)
+	}
+
+	for _, under := range a.underNames {
+		timer.Percentiles.Set(under.name, float64(h.CountAtOrBelow(under.value)))
+	}
+
+	if n%2 == 0 {
+		timer.Median = (h.ValueAtRank(n/2) + h.ValueAtRank(n/2+1)) / 2
+	} else {
+		timer.Median = h.ValueAtRank(n/2 + 1)
+	}
+	timer.Mean = stats.sum / count
+	timer.StdDev = math.Sqrt(math.Max(0, stats.sumSquares/count-timer.Mean*timer.Mean))
+	timer.Sum = stats.sum
+	timer.SumSquares = stats.sumSquares
+
+	timer.Count = int(round(timer.SampledCount))
+	timer.PerSecond = timer.SampledCount / flushInSeconds
+}
+
+// HistogramPercentileValue returns the estimated value at percentile pct of a histogram, as reported by Flush for
+// upper_XX or lower_XX, or false if the percentile holds no values.
+func (a *Aggregator) HistogramPercentileValue(h *exphist.Histogram, pct float64) (float64, bool) {
+	return sketchPercentileValue(h, h.Count, h.Max, pct)
+}
+
+// HDRPercentileValue returns the estimated value at percentile pct of an HDR histogram, as reported by Flush for
+// upper_XX or lower_XX, or false if the percentile holds no values.
+func (a *Aggregator) HDRPercentileValue(h *hdrhist.Histogram, pct float64) (float64, bool) {
+	return sketchPercentileValue(h, h.Count, h.Max, pct)
+}
+
+func sketchPercentileValue(h sketch, n uint64, max, pct float64) (float64, bool) {
+	switch n {
+	case 0:
+		return 0, false
+	case 1:
+		return max, true
+	}
+	numInThreshold := uint64(round(math.Abs(pct) / 100 * float64(n)))
+	switch {
+	case numInThreshold == 0:
+		return 0, false
+	case pct > 0:
+		return h.ValueAtRank(numInThreshold), true
+	default:
+		return h.ValueAtRank(n - numInThreshold + 1), true
+	}
+}
+
+// setPercentile sets the statistics of the values of a timer within percentile pct, other than the disabled ones.
+func (a *Aggregator) setPercentile(timer *gostatsd.Timer, pct float64, pctStruct percentStruct, count, mean, sum, sumSquares, thresholdBoundary float64) {
+	if !a.DisabledSubtypes.CountPct {
+		timer.Percentiles.Set(pctStruct.count, count)
+	}
+	if !a.DisabledSubtypes.MeanPct {
+		timer.Percentiles.Set(pctStruct.mean, mean)
+	}
+	if !a.DisabledSubtypes.SumPct {
+		timer.Percentiles.Set(pctStruct.sum, sum)
+	}
+	if !a.DisabledSubtypes.SumSquaresPct {
+		timer.Percentiles.Set(pctStruct.sumSquares, sumSquares)
+	}
+	if pct > 0 {
+		if !a.DisabledSubtypes.UpperPct {
+			timer.Percentiles.Set(pctStruct.upper, thresholdBoundary)
+		}
+	} else {
+		if !a.DisabledSubtypes.LowerPct {
+			timer.Percentiles.Set(pctStruct.lower, thresholdBoundary)
+		}
+	}
+}
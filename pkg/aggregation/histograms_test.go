@@ -0,0 +1,182 @@
+package aggregation
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/exphist"
+	"github.com/atlassian/gostatsd/pkg/hdrhist"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimerHistograms(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	opts := Options{PercentThresholds: []float64{90, -10}, UnderThresholds: []float64{50}}
+	exact := New(opts)
+	opts.TimerHistograms = true
+	opts.HistogramScale = exphist.MaxScale
+	opts.HistogramMaxBuckets = 160
+	a := New(opts)
+
+	r := rand.New(rand.NewSource(3))
+	values := make([]float64, 5000)
+	for i := range values {
+		values[i] = math.Exp(r.NormFloat64() + 3)
+		m := &gostatsd.Metric{Name: "lat", Value: values[i], Type: gostatsd.TIMER, Rate: 0.5}
+		exact.Receive(m, now)
+		a.Receive(m, now)
+	}
+	assert.Empty(t, a.Timers["lat"][""].Values)
+	require.NotNil(t, a.Timers["lat"][""].Histogram)
+	assert.Equal(t, len(values), a.AggregatedValue(&gostatsd.Metric{Name: "lat", Type: gostatsd.TIMER}))
+
+	expected := exact.Flush(10 * time.Second).Timers["lat"][""]
+	timer := a.Flush(10 * time.Second).Timers["lat"][""]
+	bound := exphist.RelativeError(timer.Histogram.Scale)
+
+	// The count, rate, min, max, sum and mean are exact.
+	assert.Equal(t, expected.Count, timer.Count)
+	assert.Equal(t, expected.SampledCount, timer.SampledCount)
+	assert.Equal(t, expected.PerSecond, timer.PerSecond)
+	assert.Equal(t, expected.Min, timer.Min)
+	assert.Equal(t, expected.Max, timer.Max)
+	assert.InEpsilon(t, expected.Sum, timer.Sum, 1e-9)
+	assert.InEpsilon(t, expected.SumSquares, timer.SumSquares, 1e-9)
+	assert.InEpsilon(t, expected.Mean, timer.Mean, 1e-9)
+	assert.InEpsilon(t, expected.StdDev, timer.StdDev, 1e-9)
+
+	// The percentiles are within the relative error of the buckets.
+	assert.InEpsilon(t, expected.Median, timer.Median, bound)
+	for _, name := range []string{"upper_90", "lower_-10", "mean_90", "sum_90", "mean_-10", "sum_-10"} {
+		assert.InEpsilon(t, percentile(t, expected, name), percentile(t, timer, name), bound, name)
+	}
+	assert.InEpsilon(t, percentile(t, expected, "sum_squares_90"), percentile(t, timer, "sum_squares_90"), 2*bound)
+	assert.Equal(t, percentile(t, expected, "count_90"), percentile(t, timer, "count_90"))
+	assert.Equal(t, percentile(t, expected, "count_-10"), percentile(t, timer, "count_-10"))
+
+	// A value counted under a threshold is at most the relative error above it.
+	sort.Float64s(values)
+	countAtOrBelow := func(x float64) float64 {
+		return float64(sort.Search(len(values), func(i int) bool { return values[i] > x }))
+	}
+	under := percentile(t, timer, "under_50")
+	assert.True(t, countAtOrBelow(50/(1+bound)) <= under && under <= countAtOrBelow(50/(1-bound)), "under_50 %v", under)
+}
+
+func TestTimerHistogramsExpire(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	opts := Options{ExpiryInterval: time.Minute, TimerHistograms: true, HistogramScale: 4, HistogramMaxBuckets: 20}
+	for _, handOff := range []bool{false, true} {
+		opts.HandOffTimerValues = handOff
+		a := New(opts)
+		a.Receive(&gostatsd.Metric{Name: "lat", Value: 5, Values: []float64{6, 7}, Type: gostatsd.TIMER, Rate: 1}, now)
+		m := a.Flush(time.Second)
+		h := m.Timers["lat"][""].Histogram
+		require.NotNil(t, h)
+		assert.EqualValues(t, 3, h.Count)
+		assert.Equal(t, 3, m.Timers["lat"][""].Count)
+
+		// The histogram is emptied to be reused, unless it was handed off with the flush.
+		a.Expire(now)
+		if handOff {
+			assert.EqualValues(t, 3, h.Count)
+			assert.Nil(t, a.Timers["lat"][""].Histogram)
+		} else {
+			assert.Zero(t, h.Count)
+			assert.Equal(t, int32(4), h.Scale)
+			assert.Same(t, h, a.Timers["lat"][""].Histogram)
+		}
+		timer := a.Flush(time.Second).Timers["lat"][""]
+		assert.Zero(t, timer.Count)
+		assert.Empty(t, timer.Percentiles)
+
+		a.Receive(&gostatsd.Metric{Name: "lat", Value: 1, Type: gostatsd.TIMER, Rate: 1}, now)
+		timer = a.Flush(time.Second).Timers["lat"][""]
+		assert.Equal(t, 1, timer.Count)
+		assert.Equal(t, 1.0, timer.Median)
+	}
+}
+
+func TestTimerHDR(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	opts := Options{PercentThresholds: []float64{50, 90, 99, -10}, UnderThresholds: []float64{50}}
+	exact := New(opts)
+	opts.HDRTimers = prefixMatcher("lat")
+	opts.HDRSignificantDigits = 3
+	opts.HDRLowestValue = 0.001
+	opts.HDRHighestValue = 3600000
+	a := New(opts)
+
+	r := rand.New(rand.NewSource(5))
+	values := make([]float64, 20000)
+	for i := range values {
+		// Latencies from a fraction of a millisecond to several seconds.
+		values[i] = math.Exp(r.NormFloat64()*2 + 3)
+		m := &gostatsd.Metric{Name: "lat", Value: values[i], Type: gostatsd.TIMER, Rate: 0.5}
+		exact.Receive(m, now)
+		a.Receive(m, now)
+	}
+	a.Receive(&gostatsd.Metric{Name: "other", Value: 1, Type: gostatsd.TIMER, Rate: 1}, now)
+	assert.Empty(t, a.Timers["lat"][""].Values)
+	require.NotNil(t, a.Timers["lat"][""].HDR)
+	assert.True(t, a.Timers["lat"][""].HDR.Buckets() < len(values)/2, "fewer buckets than samples")
+	assert.Nil(t, a.Timers["other"][""].HDR, "only the timers matched are recorded in an HDR histogram")
+	assert.Equal(t, []float64{1}, a.Timers["other"][""].Values)
+	assert.Equal(t, len(values), a.AggregatedValue(&gostatsd.Metric{Name: "lat", Type: gostatsd.TIMER}))
+
+	expected := exact.Flush(10 * time.Second).Timers["lat"][""]
+	timer := a.Flush(10 * time.Second).Timers["lat"][""]
+	bound := hdrhist.RelativeError(3)
+
+	// The count, rate, min, max, sum and mean are exact.
+	assert.Equal(t, expected.Count, timer.Count)
+	assert.Equal(t, expected.PerSecond, timer.PerSecond)
+	assert.Equal(t, expected.Min, timer.Min)
+	assert.Equal(t, expected.Max, timer.Max)
+	assert.InEpsilon(t, expected.Sum, timer.Sum, 1e-9)
+	assert.InEpsilon(t, expected.Mean, timer.Mean, 1e-9)
+	assert.InEpsilon(t, expected.StdDev, timer.StdDev, 1e-9)
+
+	// The percentiles are within the relative error of the significant digits, or the lowest value for tiny values.
+	assert.InDelta(t, expected.Median, timer.Median, bound*expected.Median+0.001)
+	for _, name := range []string{"upper_50", "upper_90", "upper_99", "lower_-10"} {
+		want := percentile(t, expected, name)
+		assert.InDelta(t, want, percentile(t, timer, name), bound*want+0.001, name)
+	}
+	for _, name := range []string{"mean_90", "sum_90", "mean_-10"} {
+		want := percentile(t, expected, name)
+		assert.InDelta(t, want, percentile(t, timer, name), bound*want+0.001, name)
+	}
+	assert.Equal(t, percentile(t, expected, "count_90"), percentile(t, timer, "count_90"))
+
+	value, ok := a.HDRPercentileValue(timer.HDR, 90)
+	assert.True(t, ok)
+	assert.Equal(t, percentile(t, timer, "upper_90"), value)
+
+	// The histogram is emptied to be reused.
+	h := timer.HDR
+	a.Expire(now)
+	assert.Zero(t, h.Count)
+	assert.Same(t, h, a.Timers["lat"][""].HDR)
+	assert.Zero(t, a.Flush(time.Second).Timers["lat"][""].Count)
+}
+
+// percentile returns the value of the percentile named name of timer, failing the test if it has none.
+func percentile(t *testing.T, timer gostatsd.Timer, name string) float64 {
+	for _, pct := range timer.Percentiles {
+		if pct.Str == name {
+			return pct.Float
+		}
+	}
+	require.Failf(t, "missing percentile", "%s not in %v", name, timer.Percentiles)
+	return 0
+}
@@ -0,0 +1,79 @@
+package aggregation
+
+import (
+	"time"
+)
+
+// LateInterval holds the counters and timers which were received in a past interval, but reached the aggregator
+// after that interval was flushed.  They are flushed with the current interval, for backends which backfill.
+type LateInterval struct {
+	Start time.Time
+	End   time.Time
+	*Aggregator
+}
+
+// Late returns the past intervals which late metrics were bucketed in to since the last Expire.  Flush computes their
+// values along with the current interval.
+func (a *Aggregator) Late() []*LateInterval {
+	return a.late
+}
+
+// LateMetrics returns the number of metrics bucketed in to a past interval since creation.
+func (a *Aggregator) LateMetrics() uint64 {
+	return a.lateMetrics
+}
+
+// startInterval starts a new interval at now, dropping the late metrics which have been flushed, and the past
+// intervals which ended more than LateArrivalWindow ago.
+func (a *Aggregator) startInterval(now time.Time) {
+	a.late = nil
+	if !a.intervalStart.IsZero() {
+		a.pastStarts = append(a.pastStarts, a.intervalStart)
+	}
+	a.intervalStart = now
+	for len(a.pastStarts) > 0 && now.Sub(a.pastEnd(0)) > a.LateArrivalWindow {
+		a.pastStarts = a.pastStarts[1:]
+	}
+}
+
+// pastEnd returns the end of the past interval i, which is the start of the next one.
+func (a *Aggregator) pastEnd(i int) time.Time {
+	if i+1 < len(a.pastStarts) {
+		return a.pastStarts[i+1]
+	}
+	return a.intervalStart
+}
+
+// lateInterval returns the past interval a metric received at received belongs in, if it reached the aggregator at
+// now no more than LateArrivalWindow after the interval ended.  It returns nil if the metric belongs in the current
+// interval.
+func (a *Aggregator) lateInterval(received, now time.Time) *LateInterval {
+	if a.intervalStart.IsZero() || !received.Before(a.intervalStart) {
+		return nil
+	}
+	for i := len(a.pastStarts) - 1; i >= 0; i-- {
+		if received.Before(a.pastStarts[i]) {
+			continue
+		}
+		start, end := a.pastStarts[i], a.pastEnd(i)
+		if now.Sub(end) > a.LateArrivalWindow {
+			return nil
+		}
+		for _, late := range a.late {
+			if late.Start.Equal(start) {
+				return late
+			}
+		}
+		opts := a.Options
+		opts.LateArrivalWindow = 0
+		opts.Peaks = nil // The peaks are of the current interval
+		late := &LateInterval{
+			Start:      start,
+			End:        end,
+			Aggregator: New(opts),
+		}
+		a.late = append(a.late, late)
+		return late
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package aggregation
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// peakWindow is the highest and lowest value of a metric in one window.
+type peakWindow struct {
+	start    time.Time // Start of the window the values are in, zero if no value has been seen in it
+	max, min float64
+}
+
+// peakSeries is the peaks of a metric with a set of tags, one for each of PeakWindows.  It is kept separately from
+// the metric, so the peaks are flushed until the end of their window even if the metric expires.
+type peakSeries struct {
+	hostname  string
+	tags      gostatsd.Tags
+	timestamp gostatsd.Nanotime
+	windows   []peakWindow
+}
+
+// peakNames returns the names of the gauges a peak over window is flushed as, such as peak_1h and trough_1h.
+func peakNames(window time.Duration) (string, string) {
+	var suffix string
+	switch {
+	case window%time.Hour == 0:
+		suffix = strconv.FormatInt(int64(window/time.Hour), 10) + "h"
+	case window%time.Minute == 0:
+		suffix = strconv.FormatInt(int64(window/time.Minute), 10) + "m"
+	default:
+		suffix = strconv.FormatInt(int64(window/time.Second), 10) + "s"
+	}
+	return "peak_" + suffix, "trough_" + suffix
+}
+
+// trackPeak records value as a value of the metric key with tagsKey at now, in the peaks of each window.  A window
+// which has ended is started again.
+func trackPeak(peaks map[string]map[string]*peakSeries, windows []time.Duration, key, tagsKey string, value float64, hostname string, tags gostatsd.Tags, now gostatsd.Nanotime) {
+	tagged, ok := peaks[key]
+	if !ok {
+		tagged = map[string]*peakSeries{}
+		peaks[key] = tagged
+	}
+	series, ok := tagged[tagsKey]
+	if !ok {
+		series = &peakSeries{
+			windows: make([]peakWindow, len(windows)),
+		}
+		tagged[tagsKey] = series
+	}
+	series.hostname = hostname
+	series.tags = tags
+	if now > series.timestamp {
+		series.timestamp = now
+	}
+	t := time.Unix(0, int64(now))
+	for i, window := range windows {
+		w := &series.windows[i]
+		start := t.Truncate(window)
+		switch {
+		case start.After(w.start):
+			*w = peakWindow{start: start, max: value, min: value}
+		case start.Before(w.start):
+			// The value was received in an earlier window than the current one, by a late flush.
+		case value > w.max:
+			w.max = value
+		case value < w.min:
+			w.min = value
+		}
+	}
+}
+
+// expirePeaks starts the windows which have ended at now again, and forgets the metrics which have no value in any
+// window.
+func expirePeaks(peaks map[string]map[string]*peakSeries, windows []time.Duration, now time.Time) {
+	for key, tagged := range peaks {
+		for tagsKey, series := range tagged {
+			empty := true
+			for i, window := range windows {
+				w := &series.windows[i]
+				if !w.start.IsZero() && now.Truncate(window).After(w.start) {
+					*w = peakWindow{}
+				}
+				empty = empty && w.start.IsZero()
+			}
+			if empty {
+				delete(tagged, tagsKey)
+			}
+		}
+		if len(tagged) == 0 {
+			delete(peaks, key)
+		}
+	}
+}
+
+// trackFlushedPeaks records the per-second rate of each counter, and the value of each gauge, selected by Peaks as a
+// value in their windows.  A gauge keeps its value until it expires, so it counts towards a window even if it
+// wasn't updated in it.
+func (a *Aggregator) trackFlushedPeaks() {
+	a.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		if a.Peaks.Matches(key) {
+			trackPeak(a.counterPeaks, a.PeakWindows, key, tagsKey, counter.PerSecond, counter.Hostname, counter.Tags, a.peakTime(counter.Timestamp))
+		}
+	})
+	a.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		if a.Peaks.Matches(key) {
+			trackPeak(a.gaugePeaks, a.PeakWindows, key, tagsKey, gauge.Value, gauge.Hostname, gauge.Tags, a.peakTime(gauge.Timestamp))
+		}
+	})
+}
+
+// peakTime returns the time the value of a metric last updated at ts is flushed at for its peaks, the start of the
+// current interval if it is later, as an idle metric still has a value in the current windows.
+func (a *Aggregator) peakTime(ts gostatsd.Nanotime) gostatsd.Nanotime {
+	if a.peakNow > ts {
+		ts = a.peakNow
+	}
+	return ts
+}
+
+// flushPeaks adds <name>.peak_<window> and <name>.trough_<window> gauges with the highest and lowest value of each
+// metric selected by Peaks in the current window of each of PeakWindows, unless a gauge with that name and tags was
+// received.  They are removed by Expire.
+func (a *Aggregator) flushPeaks() {
+	a.flushedPeaks = a.flushedPeaks[:0]
+	for _, peaks := range []map[string]map[string]*peakSeries{a.gaugePeaks, a.counterPeaks} {
+		for key, tagged := range peaks {
+			for tagsKey, series := range tagged {
+				for i, window := range a.PeakWindows {
+					w := series.windows[i]
+					if w.start.IsZero() {
+						continue
+					}
+					peakName, troughName := peakNames(window)
+					a.addPeakGauge(key+"."+peakName, tagsKey, series, w.max)
+					a.addPeakGauge(key+"."+troughName, tagsKey, series, w.min)
+				}
+			}
+		}
+	}
+}
+
+// addPeakGauge adds a gauge with the value of a peak, unless a gauge with the same name and tags is in the flush.
+func (a *Aggregator) addPeakGauge(key, tagsKey string, series *peakSeries, value float64) {
+	v, ok := a.Gauges[key]
+	if !ok {
+		v = map[string]gostatsd.Gauge{}
+		a.Gauges[key] = v
+	} else if _, ok := v[tagsKey]; ok {
+		return
+	}
+	gauge := gostatsd.NewGauge(series.timestamp, value, series.hostname, series.tags)
+	v[tagsKey] = gauge
+	a.flushedPeaks = append(a.flushedPeaks, flushedPeak{key: key, tagsKey: tagsKey})
+}
+
+// flushedPeak is a gauge added to the flush by flushPeaks.
+type flushedPeak struct {
+	key, tagsKey string
+}
+
+// expirePeakGauges removes the gauges added by flushPeaks, and starts the windows which have ended at now again.
+func (a *Aggregator) expirePeakGauges(now time.Time) {
+	for _, p := range a.flushedPeaks {
+		deleteMetric(p.key, p.tagsKey, a.Gauges)
+	}
+	a.flushedPeaks = a.flushedPeaks[:0]
+	a.peakNow = gostatsd.Nanotime(now.UnixNano())
+	expirePeaks(a.gaugePeaks, a.PeakWindows, now)
+	expirePeaks(a.counterPeaks, a.PeakWindows, now)
+}
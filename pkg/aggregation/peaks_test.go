@@ -0,0 +1,135 @@
+package aggregation
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type prefixMatcher string
+
+func (p prefixMatcher) Matches(name string) bool {
+	return strings.HasPrefix(name, string(p))
+}
+
+func TestPeakNames(t *testing.T) {
+	t.Parallel()
+	for window, expected := range map[time.Duration]string{
+		time.Hour:        "peak_1h",
+		24 * time.Hour:   "peak_24h",
+		90 * time.Minute: "peak_90m",
+		45 * time.Second: "peak_45s",
+	} {
+		peak, trough := peakNames(window)
+		assert.Equal(t, expected, peak)
+		assert.Equal(t, "trough"+strings.TrimPrefix(expected, "peak"), trough)
+	}
+}
+
+func TestGaugePeaks(t *testing.T) {
+	t.Parallel()
+	start := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	gauge := func(name string, value float64, tagsKey string) *gostatsd.Metric {
+		return &gostatsd.Metric{Name: name, Value: value, Type: gostatsd.GAUGE, Rate: 1, TagsKey: tagsKey}
+	}
+	a := New(Options{
+		Peaks:          prefixMatcher("sessions"),
+		PeakWindows:    []time.Duration{time.Hour, 24 * time.Hour},
+		ExpiryInterval: 5 * time.Minute,
+	})
+
+	a.Receive(gauge("sessions", 5, ""), start.Add(time.Minute))
+	a.Receive(gauge("sessions", 12, ""), start.Add(time.Minute))
+	a.Receive(gauge("sessions", 3, ""), start.Add(time.Minute))
+	a.Receive(gauge("sessions", 7, "host:b"), start.Add(time.Minute))
+	a.Receive(gauge("other", 100, ""), start.Add(time.Minute))
+	m := a.Flush(10 * time.Second)
+	assert.Equal(t, 3.0, m.Gauges["sessions"][""].Value)
+	assert.Equal(t, 12.0, m.Gauges["sessions.peak_1h"][""].Value)
+	assert.Equal(t, 3.0, m.Gauges["sessions.trough_1h"][""].Value)
+	assert.Equal(t, 12.0, m.Gauges["sessions.peak_24h"][""].Value)
+	assert.Equal(t, 3.0, m.Gauges["sessions.trough_24h"][""].Value)
+	assert.Equal(t, 7.0, m.Gauges["sessions.peak_1h"]["host:b"].Value)
+	assert.NotContains(t, m.Gauges, "other.peak_1h")
+
+	// The peaks are removed for the next interval, and a gauge which keeps its value stays in the window.
+	a.Expire(start.Add(2 * time.Minute))
+	assert.NotContains(t, a.Gauges, "sessions.peak_1h")
+	a.Receive(gauge("sessions", 20, "host:b"), start.Add(3*time.Minute))
+	m = a.Flush(10 * time.Second)
+	assert.Equal(t, 12.0, m.Gauges["sessions.peak_1h"][""].Value)
+	assert.Equal(t, 3.0, m.Gauges["sessions.trough_1h"][""].Value)
+	assert.Equal(t, 20.0, m.Gauges["sessions.peak_1h"]["host:b"].Value)
+	assert.Equal(t, 7.0, m.Gauges["sessions.trough_1h"]["host:b"].Value)
+
+	// The peaks outlive the gauge they are of until the end of the window.
+	a.Expire(start.Add(30 * time.Minute))
+	assert.NotContains(t, a.Gauges, "sessions")
+	m = a.Flush(10 * time.Second)
+	assert.Equal(t, 12.0, m.Gauges["sessions.peak_1h"][""].Value)
+	assert.Equal(t, 20.0, m.Gauges["sessions.peak_24h"]["host:b"].Value)
+
+	// The hour window starts again on the hour, the day window carries on.
+	a.Expire(start.Add(time.Hour))
+	a.Receive(gauge("sessions", 4, ""), start.Add(time.Hour+time.Second))
+	m = a.Flush(10 * time.Second)
+	assert.Equal(t, 4.0, m.Gauges["sessions.peak_1h"][""].Value)
+	assert.Equal(t, 4.0, m.Gauges["sessions.trough_1h"][""].Value)
+	assert.Equal(t, 12.0, m.Gauges["sessions.peak_24h"][""].Value)
+	assert.Equal(t, 3.0, m.Gauges["sessions.trough_24h"][""].Value)
+	assert.NotContains(t, m.Gauges["sessions.peak_1h"], "host:b")
+	assert.Equal(t, 20.0, m.Gauges["sessions.peak_24h"]["host:b"].Value)
+
+	// Metrics with nothing in any window are forgotten.
+	a.Expire(start.Add(24 * time.Hour))
+	assert.Empty(t, a.gaugePeaks)
+}
+
+func TestCounterPeaks(t *testing.T) {
+	t.Parallel()
+	start := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	counter := func(value float64) *gostatsd.Metric {
+		return &gostatsd.Metric{Name: "logins", Value: value, Type: gostatsd.COUNTER, Rate: 1}
+	}
+	a := New(Options{
+		Peaks:       prefixMatcher("logins"),
+		PeakWindows: []time.Duration{time.Hour},
+	})
+	a.Expire(start)
+
+	for _, value := range []float64{20, 50, 10} {
+		a.Receive(counter(value), start.Add(time.Minute))
+		m := a.Flush(10 * time.Second)
+		require.Contains(t, m.Gauges, "logins.peak_1h")
+		a.Expire(start.Add(2 * time.Minute))
+	}
+	// An idle counter is flushed as 0 until it expires, which counts towards the trough.
+	m := a.Flush(10 * time.Second)
+	assert.Equal(t, 5.0, m.Gauges["logins.peak_1h"][""].Value)
+	assert.Equal(t, 0.0, m.Gauges["logins.trough_1h"][""].Value)
+}
+
+func TestPeaksKeepReceivedGauges(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	a := New(Options{
+		Peaks:       prefixMatcher("sessions"),
+		PeakWindows: []time.Duration{time.Hour},
+	})
+	a.Receive(&gostatsd.Metric{Name: "sessions", Value: 5, Type: gostatsd.GAUGE, Rate: 1}, now)
+	a.Receive(&gostatsd.Metric{Name: "x.peak_1h", Value: 100, Type: gostatsd.GAUGE, Rate: 1}, now)
+	a.Receive(&gostatsd.Metric{Name: "sessions.trough_1h", Value: -1, Type: gostatsd.GAUGE, Rate: 1}, now)
+	m := a.Flush(10 * time.Second)
+	assert.Equal(t, 5.0, m.Gauges["sessions.peak_1h"][""].Value)
+	assert.Equal(t, -1.0, m.Gauges["sessions.trough_1h"][""].Value)
+	assert.Equal(t, 100.0, m.Gauges["x.peak_1h"][""].Value)
+
+	a.Expire(now)
+	assert.Contains(t, a.Gauges, "sessions.trough_1h")
+	assert.NotContains(t, a.Gauges, "sessions.peak_1h")
+}
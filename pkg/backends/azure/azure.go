@@ -0,0 +1,447 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/oauth"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	stats "github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/cenkalti/backoff"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName                  = "azure"
+	defaultNamespace             = "gostatsd"
+	defaultMaxRequestElapsedTime = 15 * time.Second
+	defaultClientTimeout         = 9 * time.Second
+	// defaultSeriesPerRequest is the default number of series sent in a single request for a metric.
+	defaultSeriesPerRequest = 100
+	// maxDimensions is the maximum number of dimensions the API accepts for a metric.
+	maxDimensions = 10
+	// maxNameLength is the maximum length the API accepts for a metric name, dimension name or dimension value.
+	maxNameLength = 256
+	// maxResponseSize is the maximum response size we are willing to read.
+	maxResponseSize = 10 * 1024
+)
+
+// logger logs through a child of the standard logger for this backend.
+var logger = logging.Backend(BackendName)
+
+// Client represents an Azure Monitor custom metrics client.
+type Client struct {
+	batchesCreated    uint64 // Accumulated number of batches created
+	batchesRetried    uint64 // Accumulated number of batches retried (first send is not a retry)
+	batchesDropped    uint64 // Accumulated number of batches aborted (data loss)
+	batchesSent       uint64 // Accumulated number of batches successfully sent
+	batchesThrottled  uint64 // Accumulated number of requests rejected by the API due to throttling
+	dimensionsDropped uint64 // Accumulated number of tags not sent as they were over the dimension limit
+
+	metricsURL            string
+	namespace             string
+	seriesPerRequest      int
+	maxRequestElapsedTime time.Duration
+	client                *http.Client
+	tokens                oauth.TokenSource
+	now                   func() time.Time // Returns current time. Useful for testing.
+}
+
+// metricRequest is the body of a request to the custom metrics API, which holds the series of a single metric.
+type metricRequest struct {
+	Time string     `json:"time"`
+	Data metricData `json:"data"`
+}
+
+type metricData struct {
+	BaseData baseData `json:"baseData"`
+}
+
+type baseData struct {
+	Metric    string   `json:"metric"`
+	Namespace string   `json:"namespace"`
+	DimNames  []string `json:"dimNames,omitempty"`
+	Series    []series `json:"series"`
+}
+
+type series struct {
+	DimValues []string `json:"dimValues,omitempty"`
+	Min       float64  `json:"min"`
+	Max       float64  `json:"max"`
+	Sum       float64  `json:"sum"`
+	Count     int      `json:"count"`
+}
+
+// statusError is an error response from the API.
+type statusError struct {
+	code       int
+	retryAfter time.Duration // The delay asked for by a throttling response, 0 if none
+}
+
+func (se *statusError) Error() string {
+	return fmt.Sprintf("received bad status code %d", se.code)
+}
+
+// retryable returns true if the request may succeed if it is sent again.
+func (se *statusError) retryable() bool {
+	return se.code == http.StatusTooManyRequests || se.code >= http.StatusInternalServerError
+}
+
+// NewClientFromViper returns a new Azure Monitor client.
+func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
+	az := getSubViper(v, "azure")
+	az.SetDefault("namespace", defaultNamespace)
+	az.SetDefault("auth", AuthManagedIdentity)
+	az.SetDefault("identity_endpoint", defaultIdentityEndpoint)
+	az.SetDefault("authority_host", defaultAuthorityHost)
+	az.SetDefault("series_per_request", defaultSeriesPerRequest)
+	az.SetDefault("client_timeout", defaultClientTimeout)
+	az.SetDefault("max_request_elapsed_time", defaultMaxRequestElapsedTime)
+
+	apiEndpoint := az.GetString("api_endpoint")
+	if apiEndpoint == "" {
+		region := az.GetString("region")
+		if region == "" {
+			return nil, fmt.Errorf("[%s] region is required", BackendName)
+		}
+		apiEndpoint = "https://" + region + ".monitoring.azure.com"
+	}
+
+	client := &http.Client{
+		Timeout: az.GetDuration("client_timeout"),
+	}
+	var tokens oauth.TokenSource
+	switch auth := az.GetString("auth"); auth {
+	case AuthManagedIdentity:
+		tokens = NewManagedIdentityTokenSource(client, az.GetString("identity_endpoint"), az.GetString("client_id"))
+	case AuthServicePrincipal:
+		var err error
+		tokens, err = NewServicePrincipalTokenSource(client, az.GetString("authority_host"), az.GetString("tenant_id"), az.GetString("client_id"), az.GetString("client_secret"))
+		if err != nil {
+			return nil, fmt.Errorf("[%s] %v", BackendName, err)
+		}
+	default:
+		return nil, fmt.Errorf("[%s] unknown auth %q, must be %s or %s", BackendName, auth, AuthManagedIdentity, AuthServicePrincipal)
+	}
+
+	return NewClient(
+		apiEndpoint,
+		az.GetString("resource_id"),
+		az.GetString("namespace"),
+		az.GetInt("series_per_request"),
+		az.GetDuration("max_request_elapsed_time"),
+		client,
+		tokens,
+	)
+}
+
+// NewClient returns a new Azure Monitor client, sending the metrics of the Azure resource resourceID to apiEndpoint.
+func NewClient(apiEndpoint, resourceID, namespace string, seriesPerRequest int, maxRequestElapsedTime time.Duration, client *http.Client, tokens oauth.TokenSource) (*Client, error) {
+	if apiEndpoint == "" {
+		return nil, fmt.Errorf("[%s] api_endpoint is required", BackendName)
+	}
+	if !strings.HasPrefix(resourceID, "/") {
+		return nil, fmt.Errorf("[%s] resource_id is required, such as /subscriptions/<id>/resourceGroups/<group>/providers/...", BackendName)
+	}
+	if namespace == "" {
+		return nil, fmt.Errorf("[%s] namespace is required", BackendName)
+	}
+	if seriesPerRequest <= 0 {
+		return nil, fmt.Errorf("[%s] series_per_request must be positive", BackendName)
+	}
+	if maxRequestElapsedTime <= 0 {
+		return nil, fmt.Errorf("[%s] max_request_elapsed_time must be positive", BackendName)
+	}
+
+	logger.WithFields(log.Fields{
+		"api_endpoint":       apiEndpoint,
+		"resource_id":        resourceID,
+		"namespace":          namespace,
+		"series_per_request": seriesPerRequest,
+	}).Info("Configured backend")
+
+	return &Client{
+		metricsURL:            strings.TrimSuffix(apiEndpoint, "/") + strings.TrimSuffix(resourceID, "/") + "/metrics",
+		namespace:             truncate(namespace),
+		seriesPerRequest:      seriesPerRequest,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		client:                client,
+		tokens:                tokens,
+		now:                   time.Now,
+	}, nil
+}
+
+// SendMetricsAsync flushes the metrics to Azure Monitor, preparing payload synchronously but doing the send asynchronously.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	requests := c.processMetrics(metrics)
+	if len(requests) == 0 {
+		cb(nil)
+		return
+	}
+	atomic.AddUint64(&c.batchesCreated, uint64(len(requests)))
+
+	go func() {
+		errs := make([]error, 0, len(requests))
+		for _, req := range requests {
+			errs = append(errs, c.post(ctx, req))
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		cb(errs)
+	}()
+}
+
+// RunMetrics emits internal metrics for the backend until the context is closed.
+func (c *Client) RunMetrics(ctx context.Context, statser stats.Statser) {
+	statser = statser.WithTags(gostatsd.Tags{"backend:" + BackendName})
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.created", float64(atomic.LoadUint64(&c.batchesCreated)), nil)
+			statser.Gauge("backend.retried", float64(atomic.LoadUint64(&c.batchesRetried)), nil)
+			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&c.batchesDropped)), nil)
+			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&c.batchesSent)), nil)
+			statser.Gauge("backend.throttled", float64(atomic.LoadUint64(&c.batchesThrottled)), nil)
+			statser.Gauge("backend.dimensions_dropped", float64(atomic.LoadUint64(&c.dimensionsDropped)), nil)
+		}
+	}
+}
+
+// processMetrics converts metrics to requests, each holding at most seriesPerRequest series of a single metric with
+// the same dimension names.  Counters, gauges and set cardinality are sent as a single value, and timers as their
+// min, max, sum and count, with each percentile as a metric of its own.
+func (c *Client) processMetrics(metrics *gostatsd.MetricMap) []*metricRequest {
+	metricsByKey := map[string]*baseData{}
+
+	add := func(name, hostname string, tags gostatsd.Tags, s series) {
+		dimNames, dimValues := c.dimensions(hostname, tags)
+		name = truncate(name)
+		key := name + "|" + strings.Join(dimNames, ",")
+		bd, ok := metricsByKey[key]
+		if !ok {
+			bd = &baseData{Metric: name, Namespace: c.namespace, DimNames: dimNames}
+			metricsByKey[key] = bd
+		}
+		s.DimValues = dimValues
+		bd.Series = append(bd.Series, s)
+	}
+	single := func(value float64) series {
+		return series{Min: value, Max: value, Sum: value, Count: 1}
+	}
+
+	metrics.EachCounter(func(key, tagsKey string, counter gostatsd.Counter) {
+		add(key, counter.Hostname, counter.Tags, single(float64(counter.Value)))
+	})
+
+	metrics.EachTimer(func(key, tagsKey string, timer gostatsd.Timer) {
+		// The API rejects series without values, so timers without values since the last flush are not sent.
+		if timer.Count == 0 {
+			return
+		}
+		add(key, timer.Hostname, timer.Tags, series{Min: timer.Min, Max: timer.Max, Sum: timer.Sum, Count: timer.Count})
+		for _, pct := range timer.Percentiles {
+			add(key+"."+pct.Str, timer.Hostname, timer.Tags, single(pct.Float))
+		}
+	})
+
+	metrics.EachGauge(func(key, tagsKey string, g gostatsd.Gauge) {
+		add(key, g.Hostname, g.Tags, single(g.Value))
+	})
+
+	metrics.EachSet(func(key, tagsKey string, set gostatsd.Set) {
+		add(key, set.Hostname, set.Tags, single(float64(set.Cardinality())))
+	})
+
+	keys := make([]string, 0, len(metricsByKey))
+	for key := range metricsByKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	timestamp := c.now().UTC().Format(time.RFC3339)
+	var requests []*metricRequest
+	for _, key := range keys {
+		bd := metricsByKey[key]
+		for start := 0; start < len(bd.Series); start += c.seriesPerRequest {
+			end := start + c.seriesPerRequest
+			if end > len(bd.Series) {
+				end = len(bd.Series)
+			}
+			chunk := *bd
+			chunk.Series = bd.Series[start:end]
+			requests = append(requests, &metricRequest{Time: timestamp, Data: metricData{BaseData: chunk}})
+		}
+	}
+	return requests
+}
+
+// dimensions converts the hostname and tags to sorted dimension names and their values.  Tags without a value are
+// given the value "set".  Only the first maxDimensions dimensions by name are kept.
+func (c *Client) dimensions(hostname string, tags gostatsd.Tags) ([]string, []string) {
+	if hostname == "" && len(tags) == 0 {
+		return nil, nil
+	}
+	dims := make(map[string]string, len(tags)+1)
+	for _, tag := range tags {
+		key, value := tag, "set"
+		if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+			key, value = tag[:idx], tag[idx+1:]
+		}
+		dims[truncate(key)] = truncate(value)
+	}
+	if hostname != "" {
+		dims["host"] = truncate(hostname)
+	}
+	names := make([]string, 0, len(dims))
+	for name := range dims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > maxDimensions {
+		atomic.AddUint64(&c.dimensionsDropped, uint64(len(names)-maxDimensions))
+		names = names[:maxDimensions]
+	}
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = dims[name]
+	}
+	return names, values
+}
+
+// truncate shortens s to the maximum length of a name or value.
+func truncate(s string) string {
+	if len(s) > maxNameLength {
+		return s[:maxNameLength]
+	}
+	return s
+}
+
+func (c *Client) post(ctx context.Context, req *metricRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		atomic.AddUint64(&c.batchesDropped, 1)
+		return fmt.Errorf("[%s] unable to marshal metric %s: %v", BackendName, req.Data.BaseData.Metric, err)
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = c.maxRequestElapsedTime
+	for {
+		err = c.doPost(ctx, body)
+		if err == nil {
+			atomic.AddUint64(&c.batchesSent, 1)
+			return nil
+		}
+
+		next := b.NextBackOff()
+		if se, ok := err.(*statusError); ok {
+			if !se.retryable() {
+				next = backoff.Stop
+			} else if se.code == http.StatusTooManyRequests {
+				atomic.AddUint64(&c.batchesThrottled, 1)
+				if next != backoff.Stop && se.retryAfter > next {
+					next = se.retryAfter
+				}
+			}
+		}
+		if next == backoff.Stop {
+			atomic.AddUint64(&c.batchesDropped, 1)
+			return fmt.Errorf("[%s] %v", BackendName, err)
+		}
+
+		logger.WithError(err).WithFields(log.Fields{
+			logging.FieldBucket:   req.Data.BaseData.Metric,
+			logging.FieldDuration: next,
+		}).Warn("Failed to send metric, retrying")
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		atomic.AddUint64(&c.batchesRetried, 1)
+	}
+}
+
+func (c *Client) doPost(ctx context.Context, body []byte) error {
+	token, err := c.tokens.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get access token: %v", err)
+	}
+	req, err := http.NewRequest("POST", c.metricsURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error POSTing: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(respBody)
+		logger.WithFields(log.Fields{
+			"status": resp.StatusCode,
+			"body":   string(b),
+		}).Info("Failed request")
+		se := &statusError{code: resp.StatusCode}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			se.retryAfter = time.Duration(secs) * time.Second
+		}
+		return se
+	}
+	_, _ = io.Copy(ioutil.Discard, respBody)
+	return nil
+}
+
+// Connect checks an access token can be obtained.
+func (c *Client) Connect(ctx context.Context) error {
+	if _, err := c.tokens.Token(ctx); err != nil {
+		return fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	return nil
+}
+
+// SendEvent discards events, as Azure Monitor custom metrics have no events.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+func getSubViper(v *viper.Viper, key string) *viper.Viper {
+	n := v.Sub(key)
+	if n == nil {
+		n = viper.New()
+	}
+	return n
+}
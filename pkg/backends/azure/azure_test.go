@@ -0,0 +1,225 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testResourceID = "/subscriptions/sub/resourceGroups/group/providers/Microsoft.Compute/virtualMachines/vm"
+
+type staticTokenSource string
+
+func (s staticTokenSource) Token(ctx context.Context) (string, error) {
+	return string(s), nil
+}
+
+type recordingServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []metricRequest
+}
+
+// newRecordingServer returns a server which records each request, after responding to the first throttled requests
+// with 429 Too Many Requests.
+func newRecordingServer(t *testing.T, throttled int32) *recordingServer {
+	rs := &recordingServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(testResourceID+"/metrics", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		assert.Equal(t, "Bearer token123", r.Header.Get("Authorization"))
+		if atomic.AddInt32(&throttled, -1) >= 0 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		var req metricRequest
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&req)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rs.mu.Lock()
+		rs.requests = append(rs.requests, req)
+		rs.mu.Unlock()
+	})
+	rs.Server = httptest.NewServer(mux)
+	return rs
+}
+
+func (rs *recordingServer) metrics() map[string]baseData {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	metrics := map[string]baseData{}
+	for _, req := range rs.requests {
+		metrics[req.Data.BaseData.Metric] = req.Data.BaseData
+	}
+	return metrics
+}
+
+func newTestClient(t *testing.T, url string, seriesPerRequest int) *Client {
+	client, err := NewClient(url, testResourceID, defaultNamespace, seriesPerRequest, 5*time.Second, http.DefaultClient, staticTokenSource("token123"))
+	require.NoError(t, err)
+	return client
+}
+
+func send(client *Client, mm *gostatsd.MetricMap) []error {
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+		res <- errs
+	})
+	return <-res
+}
+
+func newMetricMap() *gostatsd.MetricMap {
+	return &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{},
+		Timers:   gostatsd.Timers{},
+		Gauges:   gostatsd.Gauges{},
+		Sets:     gostatsd.Sets{},
+	}
+}
+
+func TestNewClientValidation(t *testing.T) {
+	t.Parallel()
+	_, err := NewClient("https://westus2.monitoring.azure.com", "", defaultNamespace, defaultSeriesPerRequest, time.Second, http.DefaultClient, staticTokenSource(""))
+	assert.Error(t, err)
+	_, err = NewClient("https://westus2.monitoring.azure.com", testResourceID, defaultNamespace, 0, time.Second, http.DefaultClient, staticTokenSource(""))
+	assert.Error(t, err)
+	client, err := NewClient("https://westus2.monitoring.azure.com/", testResourceID, defaultNamespace, defaultSeriesPerRequest, time.Second, http.DefaultClient, staticTokenSource(""))
+	require.NoError(t, err)
+	assert.Equal(t, "https://westus2.monitoring.azure.com"+testResourceID+"/metrics", client.metricsURL)
+}
+
+func TestSendMetrics(t *testing.T) {
+	t.Parallel()
+	rs := newRecordingServer(t, 0)
+	defer rs.Close()
+	client := newTestClient(t, rs.URL, defaultSeriesPerRequest)
+	client.now = func() time.Time {
+		return time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	}
+
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	mm := newMetricMap()
+	mm.Counters["stat.count"] = map[string]gostatsd.Counter{
+		"env:prod,s:host": gostatsd.NewCounter(now, 5, "host", gostatsd.Tags{"env:prod", "canary"}),
+	}
+	mm.Gauges["stat.gauge"] = map[string]gostatsd.Gauge{
+		"": gostatsd.NewGauge(now, 1.5, "", nil),
+	}
+	timer := gostatsd.NewTimer(now, []float64{1, 2}, "", nil)
+	timer.Count, timer.Min, timer.Max, timer.Sum = 2, 1, 2, 3
+	timer.Percentiles.Set("upper_90", 2)
+	mm.Timers["stat.timer"] = map[string]gostatsd.Timer{"": timer}
+	mm.Timers["stat.idle"] = map[string]gostatsd.Timer{"": gostatsd.NewTimer(now, nil, "", nil)}
+
+	require.Equal(t, []error{nil, nil, nil, nil}, send(client, mm))
+	assert.Equal(t, "2020-01-02T03:04:05Z", rs.requests[0].Time)
+
+	metrics := rs.metrics()
+	assert.Equal(t, baseData{
+		Metric:    "stat.count",
+		Namespace: "gostatsd",
+		DimNames:  []string{"canary", "env", "host"},
+		Series:    []series{{DimValues: []string{"set", "prod", "host"}, Min: 5, Max: 5, Sum: 5, Count: 1}},
+	}, metrics["stat.count"])
+	assert.Equal(t, []series{{Min: 1.5, Max: 1.5, Sum: 1.5, Count: 1}}, metrics["stat.gauge"].Series)
+	assert.Equal(t, []series{{Min: 1, Max: 2, Sum: 3, Count: 2}}, metrics["stat.timer"].Series)
+	assert.Equal(t, []series{{Min: 2, Max: 2, Sum: 2, Count: 1}}, metrics["stat.timer.upper_90"].Series)
+	// A timer without values is not sent.
+	assert.NotContains(t, metrics, "stat.idle")
+}
+
+func TestSendMetricsInBatches(t *testing.T) {
+	t.Parallel()
+	rs := newRecordingServer(t, 0)
+	defer rs.Close()
+	client := newTestClient(t, rs.URL, 2)
+
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	mm := newMetricMap()
+	mm.Gauges["gauge"] = map[string]gostatsd.Gauge{}
+	for i := 0; i < 5; i++ {
+		tags := gostatsd.Tags{fmt.Sprintf("id:%d", i)}
+		mm.Gauges["gauge"][tags.String()] = gostatsd.NewGauge(now, 1, "", tags)
+	}
+	// Series with different dimensions are sent separately.
+	mm.Gauges["gauge"]["other"] = gostatsd.NewGauge(now, 1, "", gostatsd.Tags{"other:1"})
+	assert.Len(t, send(client, mm), 4)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	var sizes []int
+	for _, req := range rs.requests {
+		sizes = append(sizes, len(req.Data.BaseData.Series))
+	}
+	assert.ElementsMatch(t, []int{2, 2, 1, 1}, sizes)
+	assert.EqualValues(t, 4, client.batchesCreated)
+}
+
+func TestDimensionLimits(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, "http://localhost", defaultSeriesPerRequest)
+	var tags gostatsd.Tags
+	for i := 0; i < 12; i++ {
+		tags = append(tags, fmt.Sprintf("tag%02d:%d", i, i))
+	}
+	long := make([]byte, 300)
+	for i := range long {
+		long[i] = 'x'
+	}
+	tags = append(tags, "a:"+string(long))
+
+	names, values := client.dimensions("", tags)
+	require.Len(t, names, maxDimensions)
+	assert.Equal(t, "a", names[0])
+	assert.Len(t, values[0], maxNameLength)
+	assert.Equal(t, "tag08", names[9])
+	assert.Equal(t, "8", values[9])
+	assert.EqualValues(t, 3, client.dimensionsDropped)
+}
+
+func TestThrottlingIsRetried(t *testing.T) {
+	t.Parallel()
+	rs := newRecordingServer(t, 2)
+	defer rs.Close()
+	client := newTestClient(t, rs.URL, defaultSeriesPerRequest)
+
+	mm := newMetricMap()
+	mm.Gauges["gauge"] = map[string]gostatsd.Gauge{"": gostatsd.NewGauge(gostatsd.Nanotime(time.Now().UnixNano()), 1, "", nil)}
+	assert.Equal(t, []error{nil}, send(client, mm))
+	assert.Contains(t, rs.metrics(), "gauge")
+	assert.EqualValues(t, 2, client.batchesThrottled)
+	assert.EqualValues(t, 2, client.batchesRetried)
+	assert.EqualValues(t, 1, client.batchesSent)
+}
+
+func TestBadRequestIsNotRetried(t *testing.T) {
+	t.Parallel()
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+	client, err := NewClient(ts.URL, testResourceID, defaultNamespace, defaultSeriesPerRequest, 5*time.Second, http.DefaultClient, staticTokenSource("token123"))
+	require.NoError(t, err)
+
+	mm := newMetricMap()
+	mm.Gauges["gauge"] = map[string]gostatsd.Gauge{"": gostatsd.NewGauge(gostatsd.Nanotime(time.Now().UnixNano()), 1, "", nil)}
+	errs := send(client, mm)
+	require.Len(t, errs, 1)
+	assert.Error(t, errs[0])
+	assert.EqualValues(t, 1, atomic.LoadInt32(&requests))
+	assert.EqualValues(t, 1, client.batchesDropped)
+}
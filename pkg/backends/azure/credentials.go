@@ -0,0 +1,63 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/atlassian/gostatsd/pkg/backends/oauth"
+)
+
+const (
+	// AuthManagedIdentity gets tokens from the managed identity of the Azure VM or container the server runs on.
+	AuthManagedIdentity = "managed_identity"
+	// AuthServicePrincipal gets tokens for a service principal, using its client secret.
+	AuthServicePrincipal = "service_principal"
+
+	monitoringResource      = "https://monitoring.azure.com/"
+	defaultIdentityEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	defaultAuthorityHost    = "https://login.microsoftonline.com"
+)
+
+// NewManagedIdentityTokenSource returns a TokenSource for the managed identity of the host, from the instance
+// metadata service at endpoint.  clientID selects a user assigned identity, and may be empty for the system assigned
+// identity.
+func NewManagedIdentityTokenSource(client *http.Client, endpoint, clientID string) oauth.TokenSource {
+	query := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {monitoringResource},
+	}
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	tokenURL := endpoint + "?" + query.Encode()
+	return oauth.NewCachingTokenSource(client, func(ctx context.Context, client *http.Client) (*oauth.TokenResponse, error) {
+		req, err := http.NewRequest("GET", tokenURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata", "true")
+		return oauth.Do(client, req.WithContext(ctx))
+	})
+}
+
+// NewServicePrincipalTokenSource returns a TokenSource for a service principal of the tenant, authenticating with
+// the client secret of the application.
+func NewServicePrincipalTokenSource(client *http.Client, authorityHost, tenantID, clientID, clientSecret string) (oauth.TokenSource, error) {
+	if tenantID == "" || clientID == "" || clientSecret == "" {
+		return nil, errors.New("tenant_id, client_id and client_secret are required for a service principal")
+	}
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/token", strings.TrimSuffix(authorityHost, "/"), url.PathEscape(tenantID))
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"resource":      {monitoringResource},
+	}
+	return oauth.NewCachingTokenSource(client, func(ctx context.Context, client *http.Client) (*oauth.TokenResponse, error) {
+		return oauth.PostForm(ctx, client, tokenURL, form)
+	}), nil
+}
@@ -0,0 +1,59 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagedIdentityTokenSource(t *testing.T) {
+	t.Parallel()
+	var requests uint32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&requests, 1)
+		assert.Equal(t, "true", r.Header.Get("Metadata"))
+		assert.Equal(t, monitoringResource, r.URL.Query().Get("resource"))
+		assert.Equal(t, "my-identity", r.URL.Query().Get("client_id"))
+		// The instance metadata service encodes expires_in as a string.
+		_, _ = w.Write([]byte(`{"access_token":"token123","expires_in":"3599"}`))
+	}))
+	defer ts.Close()
+
+	tokens := NewManagedIdentityTokenSource(http.DefaultClient, ts.URL, "my-identity")
+	for i := 0; i < 2; i++ {
+		token, err := tokens.Token(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "token123", token)
+	}
+	assert.EqualValues(t, 1, atomic.LoadUint32(&requests)) // Token is cached
+}
+
+func TestServicePrincipalTokenSource(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/my-tenant/oauth2/token", r.URL.Path)
+		if !assert.NoError(t, r.ParseForm()) {
+			return
+		}
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "my-app", r.PostForm.Get("client_id"))
+		assert.Equal(t, "secret", r.PostForm.Get("client_secret"))
+		assert.Equal(t, monitoringResource, r.PostForm.Get("resource"))
+		_, _ = w.Write([]byte(`{"access_token":"token456","expires_in":3599}`))
+	}))
+	defer ts.Close()
+
+	tokens, err := NewServicePrincipalTokenSource(http.DefaultClient, ts.URL, "my-tenant", "my-app", "secret")
+	require.NoError(t, err)
+	token, err := tokens.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token456", token)
+
+	_, err = NewServicePrincipalTokenSource(http.DefaultClient, ts.URL, "my-tenant", "my-app", "")
+	assert.Error(t, err)
+}
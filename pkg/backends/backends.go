@@ -2,22 +2,32 @@ package backends
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/azure"
 	"github.com/atlassian/gostatsd/pkg/backends/cloudwatch"
 	"github.com/atlassian/gostatsd/pkg/backends/datadog"
 	"github.com/atlassian/gostatsd/pkg/backends/graphite"
 	"github.com/atlassian/gostatsd/pkg/backends/newrelic"
 	"github.com/atlassian/gostatsd/pkg/backends/null"
+	"github.com/atlassian/gostatsd/pkg/backends/redis"
+	"github.com/atlassian/gostatsd/pkg/backends/shadow"
+	"github.com/atlassian/gostatsd/pkg/backends/sse"
+	"github.com/atlassian/gostatsd/pkg/backends/stackdriver"
 	"github.com/atlassian/gostatsd/pkg/backends/statsdaemon"
 	"github.com/atlassian/gostatsd/pkg/backends/stdout"
+	"github.com/atlassian/gostatsd/pkg/backends/webhook"
+	"github.com/atlassian/gostatsd/pkg/logging"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// Factory is a function that returns a Backend.
+type Factory func(*viper.Viper) (gostatsd.Backend, error)
+
 // All known backends.
-var backends = map[string]gostatsd.BackendFactory{
+var backends = map[string]Factory{
 	datadog.BackendName:     datadog.NewClientFromViper,
 	graphite.BackendName:    graphite.NewClientFromViper,
 	null.BackendName:        null.NewClientFromViper,
@@ -25,6 +35,12 @@ var backends = map[string]gostatsd.BackendFactory{
 	stdout.BackendName:      stdout.NewClientFromViper,
 	cloudwatch.BackendName:  cloudwatch.NewClientFromViper,
 	newrelic.BackendName:    newrelic.NewClientFromViper,
+	stackdriver.BackendName: stackdriver.NewClientFromViper,
+	redis.BackendName:       redis.NewClientFromViper,
+	webhook.BackendName:     webhook.NewClientFromViper,
+	shadow.BackendName:      shadow.NewClientFromViper,
+	azure.BackendName:       azure.NewClientFromViper,
+	sse.BackendName:         sse.NewClientFromViper,
 }
 
 // GetBackend creates an instance of the named backend, or nil if
@@ -38,21 +54,63 @@ func GetBackend(name string, v *viper.Viper) (gostatsd.Backend, error) {
 	return f(v)
 }
 
-// InitBackend creates an instance of the named backend.
+// InitBackend creates an instance of the named backend.  The name may be of the form <backend>:<instance>, to create
+// several instances of the same backend.  An instance is configured by the settings in the [<backend>.<instance>]
+// section, which override those in the [<backend>] section.
 func InitBackend(name string, v *viper.Viper) (gostatsd.Backend, error) {
 	if name == "" {
-		log.Info("No backend specified")
+		logging.Component("backends").Info("No backend specified")
 		return nil, nil
 	}
 
-	backend, err := GetBackend(name, v)
+	backendName := name
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		backendName = name[:i]
+		if backendName == "" || i == len(name)-1 {
+			return nil, fmt.Errorf("invalid backend instance %q", name)
+		}
+		v = instanceViper(v, backendName, name[i+1:])
+	}
+
+	backend, err := GetBackend(backendName, v)
 	if err != nil {
 		return nil, fmt.Errorf("could not init backend %q: %v", name, err)
 	}
 	if backend == nil {
 		return nil, fmt.Errorf("unknown backend %q", name)
 	}
-	log.Infof("Initialised backend %q", name)
+	logging.Backend(name).Info("Initialised backend")
 
 	return backend, nil
 }
+
+// backendSection returns the settings in the section of the named backend, which may be of the form
+// <backend>:<instance>.
+func backendSection(name string, v *viper.Viper) *viper.Viper {
+	backendName := name
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		backendName = name[:i]
+		v = instanceViper(v, backendName, name[i+1:])
+	}
+	section := v.Sub(backendName)
+	if section == nil {
+		section = viper.New()
+	}
+	return section
+}
+
+// instanceViper returns a copy of v, with the settings in the [<backend>.<instance>] section also applied to the
+// [<backend>] section.
+func instanceViper(v *viper.Viper, backendName, instance string) *viper.Viper {
+	iv := viper.New()
+	for _, key := range v.AllKeys() {
+		iv.Set(key, v.Get(key))
+	}
+	prefix := strings.ToLower(backendName + "." + instance + ".")
+	for _, key := range v.AllKeys() {
+		if strings.HasPrefix(key, prefix) {
+			iv.Set(backendName+"."+key[len(prefix):], v.Get(key))
+		}
+	}
+	return iv
+}
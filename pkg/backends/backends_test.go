@@ -0,0 +1,89 @@
+package backends
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/null"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstanceViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+flush-interval='10s'
+
+[graphite]
+address='shared:2003'
+global_prefix='stats'
+
+[graphite.teamA]
+address='team-a:2003'
+`)))
+
+	iv := instanceViper(v, "graphite", "teamA")
+	g := iv.Sub("graphite")
+	require.NotNil(t, g)
+	assert.Equal(t, "team-a:2003", g.GetString("address"))
+	assert.Equal(t, "stats", g.GetString("global_prefix"))
+	assert.Equal(t, "10s", iv.GetString("flush-interval"))
+	// The original is unchanged.
+	assert.Equal(t, "shared:2003", v.GetString("graphite.address"))
+}
+
+func TestInitBackendInstance(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	b, err := InitBackend("null:a", v)
+	require.NoError(t, err)
+	assert.Equal(t, "null", b.Name())
+
+	for _, name := range []string{"null:", ":a", "nope:a"} {
+		_, err = InitBackend(name, v)
+		assert.Error(t, err, name)
+	}
+}
+
+// reportingBackend is a connecting backend with a report.
+type reportingBackend struct {
+	flakyBackend
+}
+
+func (rb *reportingBackend) WriteReport(w io.Writer) error {
+	_, err := io.WriteString(w, "all good\n")
+	return err
+}
+
+func TestBackendReportThroughWrappers(t *testing.T) {
+	t.Parallel()
+	nb, err := null.NewClient()
+	require.NoError(t, err)
+	wrappers := map[string]func(gostatsd.Backend) gostatsd.Backend{
+		"fallback": func(b gostatsd.Backend) gostatsd.Backend {
+			return NewFallbackBackend([]string{"null", "b"}, []gostatsd.Backend{nb, b})
+		},
+		"hashing": func(b gostatsd.Backend) gostatsd.Backend {
+			hb, err := NewHashingBackend(b, []string{"tag"}, "sha256", 8)
+			require.NoError(t, err)
+			return hb
+		},
+		"internal filter": func(b gostatsd.Backend) gostatsd.Backend { return NewInternalFilterBackend(b, "statsd") },
+		"queued":          func(b gostatsd.Backend) gostatsd.Backend { return NewQueuedBackend("b", b, 1) },
+		"sequenced":       func(b gostatsd.Backend) gostatsd.Backend { return NewSequencedBackend("b", b) },
+	}
+	for name, wrap := range wrappers {
+		var buf bytes.Buffer
+		b := wrap(NewLazyBackend(&reportingBackend{}))
+		require.NoError(t, gostatsd.BackendReport(b, &buf), name)
+		assert.Equal(t, "all good\n", buf.String(), name)
+
+		assert.Equal(t, gostatsd.ErrNoReport, gostatsd.BackendReport(wrap(nb), &buf), name)
+	}
+}
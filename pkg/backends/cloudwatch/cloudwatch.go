@@ -6,7 +6,8 @@ import (
 	"time"
 
 	"github.com/atlassian/gostatsd"
-	log "github.com/sirupsen/logrus"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	"github.com/atlassian/gostatsd/pkg/util"
 
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
@@ -21,6 +22,9 @@ const MAX_DIMENSIONS = 10
 // BackendName is the name of this backend.
 const BackendName = "cloudwatch"
 
+// logger logs through a child of the standard logger for this backend.
+var logger = logging.Backend(BackendName)
+
 // Client is an object that is used to send messages to AWS CloudWatch.
 type Client struct {
 	cloudwatch cloudwatchiface.CloudWatchAPI
@@ -36,7 +40,7 @@ func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 
 	return NewClient(
 		g.GetString("namespace"),
-		gostatsd.DisabledSubMetrics(v),
+		util.DisabledSubMetrics(v),
 	)
 }
 
@@ -77,7 +81,7 @@ func extractDimensions(tags gostatsd.Tags) (dimensions []*cloudwatch.Dimension)
 	// Check that there are not too many dimensions
 	dimensionCount := len(dimensions)
 	if dimensionCount > MAX_DIMENSIONS {
-		log.Warnf("[%s] Too many dimensions (%d) specified, truncating to %d", BackendName, dimensionCount, MAX_DIMENSIONS)
+		logger.Warnf("Too many dimensions (%d) specified, truncating to %d", dimensionCount, MAX_DIMENSIONS)
 		return dimensions[:MAX_DIMENSIONS]
 	}
 
@@ -105,13 +109,13 @@ func (client Client) buildMetricData(metrics *gostatsd.MetricMap) (metricData []
 	}
 
 	prefix = "stats.counter."
-	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+	metrics.EachCounter(func(key, tagsKey string, counter gostatsd.Counter) {
 		addMetricData(key+".count", "Count", float64(counter.Value), counter.Tags)
 		addMetricData(key+".per_second", "Count/Second", counter.PerSecond, counter.Tags)
 	})
 
 	prefix = "stats.timers."
-	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+	metrics.EachTimer(func(key, tagsKey string, timer gostatsd.Timer) {
 		if !disabled.Lower {
 			addMetricData(key+".lower", "Milliseconds", timer.Min, timer.Tags)
 		}
@@ -145,13 +149,13 @@ func (client Client) buildMetricData(metrics *gostatsd.MetricMap) (metricData []
 	})
 
 	prefix = "stats.gauge."
-	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+	metrics.EachGauge(func(key, tagsKey string, gauge gostatsd.Gauge) {
 		addMetricData(key, "None", gauge.Value, gauge.Tags)
 	})
 
 	prefix = "stats.set."
-	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
-		addMetricData(key, "None", float64(len(set.Values)), set.Tags)
+	metrics.EachSet(func(key, tagsKey string, set gostatsd.Set) {
+		addMetricData(key, "None", float64(set.Cardinality()), set.Tags)
 	})
 
 	return metricData
@@ -17,7 +17,9 @@ import (
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
 	stats "github.com/atlassian/gostatsd/pkg/statser"
+	"github.com/atlassian/gostatsd/pkg/util"
 
 	"github.com/cenkalti/backoff"
 	jsoniter "github.com/json-iterator/go"
@@ -42,6 +44,9 @@ const (
 	defaultEnableHttp2 = false
 )
 
+// logger logs through a child of the standard logger for this backend.
+var logger = logging.Backend(BackendName)
+
 var (
 	// defaultMaxRequests is the number of parallel outgoing requests to Datadog.  As this mixes both
 	// CPU (JSON encoding, TLS) and network bound operations, balancing may require some experimentation.
@@ -52,6 +57,9 @@ var (
 		EscapeHTML:  false,
 		SortMapKeys: false,
 	}.Froze()
+
+	// errPostPanicked is the result of a batch whose post panicked.
+	errPostPanicked = fmt.Errorf("[%s] posting metrics panicked", BackendName)
 )
 
 // Client represents a Datadog client.
@@ -60,6 +68,7 @@ type Client struct {
 	batchesRetried uint64 // Accumulated number of batches retried (first send is not a retry)
 	batchesDropped uint64 // Accumulated number of batches aborted (data loss)
 	batchesSent    uint64 // Accumulated number of batches successfully sent
+	transfer       gostatsd.TransferCounter
 
 	apiKey                string
 	apiEndpoint           string
@@ -98,26 +107,27 @@ func (d *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricM
 		// which n goroutines then read from.  Current behavior still spins up many goroutines
 		// and has them all hit the same channel.
 		atomic.AddUint64(&d.batchesCreated, 1)
-		go func() {
+		gostatsd.Go(ctx, "backend_"+BackendName, func() {
 			select {
 			case <-ctx.Done():
 				return
 			case buffer := <-d.metricsBufferSem:
+				// The result is sent even if posting panics, so the flush isn't left waiting for it.
+				err := errPostPanicked
 				defer func() {
 					buffer.Reset()
 					d.metricsBufferSem <- buffer
+					select {
+					case <-ctx.Done():
+					case results <- err:
+					}
 				}()
-				err := d.postMetrics(ctx, buffer, ts)
-
-				select {
-				case <-ctx.Done():
-				case results <- err:
-				}
+				err = d.postMetrics(ctx, buffer, ts)
 			}
-		}()
+		})
 		counter++
 	})
-	go func() {
+	gostatsd.Go(ctx, "backend_"+BackendName, func() {
 		errs := make([]error, 0, counter)
 	loop:
 		for c := 0; c < counter; c++ {
@@ -130,7 +140,7 @@ func (d *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricM
 			}
 		}
 		cb(errs)
-	}()
+	})
 }
 
 func (d *Client) RunMetrics(ctx context.Context, statser stats.Statser) {
@@ -163,13 +173,13 @@ func (d *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*timeSeries
 		cb:               cb,
 	}
 
-	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+	metrics.EachCounter(func(key, tagsKey string, counter gostatsd.Counter) {
 		fl.addMetric(rate, counter.PerSecond, counter.Hostname, counter.Tags, key)
 		fl.addMetricf(gauge, float64(counter.Value), counter.Hostname, counter.Tags, "%s.count", key)
 		fl.maybeFlush()
 	})
 
-	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+	metrics.EachTimer(func(key, tagsKey string, timer gostatsd.Timer) {
 		if !d.disabledSubtypes.Lower {
 			fl.addMetricf(gauge, timer.Min, timer.Hostname, timer.Tags, "%s.lower", key)
 		}
@@ -203,13 +213,13 @@ func (d *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*timeSeries
 		fl.maybeFlush()
 	})
 
-	metrics.Gauges.Each(func(key, tagsKey string, g gostatsd.Gauge) {
+	metrics.EachGauge(func(key, tagsKey string, g gostatsd.Gauge) {
 		fl.addMetric(gauge, g.Value, g.Hostname, g.Tags, key)
 		fl.maybeFlush()
 	})
 
-	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
-		fl.addMetric(gauge, float64(len(set.Values)), set.Hostname, set.Tags, key)
+	metrics.EachSet(func(key, tagsKey string, set gostatsd.Set) {
+		fl.addMetric(gauge, float64(set.Cardinality()), set.Hostname, set.Tags, key)
 		fl.maybeFlush()
 	})
 
@@ -249,6 +259,12 @@ func (d *Client) Name() string {
 	return BackendName
 }
 
+// TransferStats returns the bytes of JSON serialized and the bytes posted to Datadog after compression, and the time
+// taken.
+func (d *Client) TransferStats() (gostatsd.TransferStats, bool) {
+	return d.transfer.Stats(), true
+}
+
 func (d *Client) post(ctx context.Context, buffer *bytes.Buffer, path, typeOfPost string, data interface{}) error {
 	post, err := d.constructPost(ctx, buffer, path, typeOfPost, data)
 	if err != nil {
@@ -270,7 +286,10 @@ func (d *Client) post(ctx context.Context, buffer *bytes.Buffer, path, typeOfPos
 			return fmt.Errorf("[%s] %v", BackendName, err)
 		}
 
-		log.Warnf("[%s] failed to send %s, sleeping for %s: %v", BackendName, typeOfPost, next, err)
+		logger.WithError(err).WithFields(log.Fields{
+			"type":                typeOfPost,
+			logging.FieldDuration: next,
+		}).Warn("Failed to send, retrying")
 
 		timer := time.NewTimer(next)
 		select {
@@ -295,16 +314,22 @@ func (d *Client) constructPost(ctx context.Context, buffer *bytes.Buffer, path,
 		stream.WriteVal(data)
 		return stream.Flush()
 	}
+	start := time.Now()
 	var err error
+	serialized := &gostatsd.CountingWriter{W: buffer}
 	if compressPayload {
-		err = deflate(buffer, marshal)
+		err = deflate(buffer, func(w io.Writer) error {
+			serialized.W = w
+			return marshal(serialized)
+		})
 	} else {
-		err = marshal(buffer)
+		err = marshal(serialized)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("[%s] unable to marshal %s: %v", BackendName, typeOfPost, err)
 	}
 	body := buffer.Bytes()
+	d.transfer.Serialized(serialized.N, time.Since(start))
 
 	return func() error {
 		headers := map[string]string{
@@ -323,15 +348,24 @@ func (d *Client) constructPost(ctx context.Context, buffer *bytes.Buffer, path,
 		for header, v := range headers {
 			req.Header.Set(header, v)
 		}
+		// Every attempt is counted, as a retry sends the payload again.
+		start := time.Now()
 		resp, err := d.client.Do(req)
 		if err != nil {
+			d.transfer.Sent(len(body), time.Since(start))
 			return fmt.Errorf("error POSTing: %s", strings.Replace(err.Error(), d.apiKey, "*****", -1))
 		}
+		defer func() {
+			d.transfer.Sent(len(body), time.Since(start))
+		}()
 		defer resp.Body.Close()
 		body := io.LimitReader(resp.Body, maxResponseSize)
 		if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
 			b, _ := ioutil.ReadAll(body)
-			log.Infof("[%s] failed request status: %d\n%s", BackendName, resp.StatusCode, b)
+			logger.WithFields(log.Fields{
+				"status": resp.StatusCode,
+				"body":   string(b),
+			}).Info("Failed request")
 			return fmt.Errorf("received bad status code %d", resp.StatusCode)
 		}
 		_, _ = io.Copy(ioutil.Discard, body)
@@ -371,7 +405,7 @@ func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 		dd.GetDuration("client_timeout"),
 		dd.GetDuration("max_request_elapsed_time"),
 		v.GetDuration("flush-interval"), // Main viper, not sub-viper
-		gostatsd.DisabledSubMetrics(v),
+		util.DisabledSubMetrics(v),
 	)
 }
 
@@ -396,7 +430,13 @@ func NewClient(apiEndpoint, apiKey, userAgent, network string, metricsPerBatch,
 		return nil, fmt.Errorf("[%s] maxRequestElapsedTime must be positive", BackendName)
 	}
 
-	log.Infof("[%s] maxRequestElapsedTime=%s maxRequests=%d clientTimeout=%s metricsPerBatch=%d compressPayload=%t", BackendName, maxRequestElapsedTime, maxRequests, clientTimeout, metricsPerBatch, compressPayload)
+	logger.WithFields(log.Fields{
+		"max_request_elapsed_time": maxRequestElapsedTime,
+		"max_requests":             maxRequests,
+		"client_timeout":           clientTimeout,
+		"metrics_per_batch":        metricsPerBatch,
+		"compress_payload":         compressPayload,
+	}).Info("Configured backend")
 
 	dialer := &net.Dialer{
 		Timeout:   5 * time.Second,
@@ -81,12 +81,17 @@ func TestSendMetricsInMultipleBatches(t *testing.T) {
 
 func TestSendMetrics(t *testing.T) {
 	t.Parallel()
+	var received, decompressed int64
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
 		data, err := ioutil.ReadAll(r.Body)
 		if !assert.NoError(t, err) {
 			return
 		}
+		atomic.StoreInt64(&received, int64(len(data)))
+		defer func() {
+			atomic.StoreInt64(&decompressed, int64(len(data)))
+		}()
 		enc := r.Header.Get("Content-Encoding")
 		if enc == "deflate" {
 			decompressor, err := zlib.NewReader(bytes.NewReader(data))
@@ -129,6 +134,12 @@ func TestSendMetrics(t *testing.T) {
 	for _, err := range errs {
 		assert.NoError(t, err)
 	}
+
+	stats, ok := cli.TransferStats()
+	assert.True(t, ok)
+	assert.EqualValues(t, atomic.LoadInt64(&decompressed), stats.BytesSerialized)
+	assert.EqualValues(t, atomic.LoadInt64(&received), stats.BytesSent)
+	assert.True(t, stats.BytesSent < stats.BytesSerialized, "the payload is compressed")
 }
 
 // twoCounters returns two counters.
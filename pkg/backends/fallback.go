@@ -0,0 +1,229 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	"github.com/atlassian/gostatsd/pkg/statser"
+)
+
+// FallbackSeparator separates the primary backend from its fallbacks in a name given in --backends, such as
+// "graphite|stdout".
+const FallbackSeparator = "|"
+
+// FallbackBackend sends to a primary backend, and if a flush to it fails, sends the metrics of that flush to each
+// fallback backend in order until one succeeds.
+type FallbackBackend struct {
+	failed  uint64   // Flushes no backend handled, must be read/written only using atomic instructions.
+	handled []uint64 // Flushes handled by each backend, must be read/written only using atomic instructions.
+
+	names    []string // Names of the backends as configured, primary first
+	backends []gostatsd.Backend
+}
+
+// NewFallbackBackend creates a FallbackBackend sending to backends, the primary first followed by the fallbacks in
+// the order they are tried.  names are the configured names of the backends, used in internal metrics and logs.
+func NewFallbackBackend(names []string, backends []gostatsd.Backend) *FallbackBackend {
+	return &FallbackBackend{
+		handled:  make([]uint64, len(backends)),
+		names:    names,
+		backends: backends,
+	}
+}
+
+// Run runs each of the backends which is a gostatsd.RunnableBackend.
+func (fb *FallbackBackend) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range fb.backends {
+		if rb, ok := b.(gostatsd.RunnableBackend); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rb.Run(ctx)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// RunMetrics emits the number of flushes handled by each backend and the number no backend handled, and runs the
+// metrics of each backend which has any.
+func (fb *FallbackBackend) RunMetrics(ctx context.Context, statser statser.Statser) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, b := range fb.backends {
+		if me, ok := b.(metricEmitter); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				me.RunMetrics(ctx, statser)
+			}()
+		}
+	}
+
+	statser = statser.WithTags(gostatsd.Tags{"backend:" + fb.names[0]})
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			for i, name := range fb.names {
+				statser.Gauge("backend.flushes_handled", float64(atomic.LoadUint64(&fb.handled[i])), gostatsd.Tags{"handled_by:" + name})
+			}
+			statser.Gauge("backend.flushes_failed", float64(atomic.LoadUint64(&fb.failed)), nil)
+		}
+	}
+}
+
+// Status returns the status of the primary backend followed by the status of each fallback.
+func (fb *FallbackBackend) Status() string {
+	statuses := make([]string, 0, len(fb.backends))
+	for i, b := range fb.backends {
+		if i == 0 {
+			statuses = append(statuses, gostatsd.BackendStatus(b))
+		} else {
+			statuses = append(statuses, fmt.Sprintf("fallback %s %s", fb.names[i], gostatsd.BackendStatus(b)))
+		}
+	}
+	return strings.Join(statuses, ", ")
+}
+
+// WriteReport writes the report of the first backend of the chain which has one, the primary if it does.
+func (fb *FallbackBackend) WriteReport(w io.Writer) error {
+	for _, b := range fb.backends {
+		if err := gostatsd.BackendReport(b, w); err != gostatsd.ErrNoReport {
+			return err
+		}
+	}
+	return gostatsd.ErrNoReport
+}
+
+// Name returns the name of the primary backend.
+func (fb *FallbackBackend) Name() string {
+	return fb.backends[0].Name()
+}
+
+// SendMetricsAsync sends the metrics to the primary backend, and to each fallback in turn while sending fails.  The
+// callback is called with no errors if any backend succeeded, otherwise with the errors from every backend.
+func (fb *FallbackBackend) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	// The fallbacks are sent to after the primary is done, by which time metrics may have been reset for the next
+	// interval, so they get a copy taken now.
+	var fallback *gostatsd.MetricMap
+	if len(fb.backends) > 1 {
+		fallback = metrics.Copy()
+	}
+	fb.send(ctx, 0, metrics, fallback, nil, cb)
+}
+
+// send sends metrics to the i'th backend, falling back to the next backend with the fallback copy if it fails.
+func (fb *FallbackBackend) send(ctx context.Context, i int, metrics, fallback *gostatsd.MetricMap, errs []error, cb gostatsd.SendCallback) {
+	b := fb.backends[i]
+	snapshot := metrics
+	if !gostatsd.WantsRawTimers(b) && fb.WantsRawTimers() {
+		snapshot = &gostatsd.MetricMap{
+			Counters: metrics.Counters,
+			Timers:   metrics.Timers.WithoutValues(),
+			Gauges:   metrics.Gauges,
+			Sets:     metrics.Sets,
+			Sorted:   metrics.Sorted,
+
+			Interval:        metrics.Interval,
+			NominalInterval: metrics.NominalInterval,
+			Sequence:        metrics.Sequence,
+			Part:            metrics.Part,
+			Late:            metrics.Late,
+		}
+	}
+	b.SendMetricsAsync(ctx, snapshot, func(sendErrs []error) {
+		if !hasError(sendErrs) {
+			atomic.AddUint64(&fb.handled[i], 1)
+			cb(nil)
+			return
+		}
+		errs = append(errs, sendErrs...)
+		if i+1 == len(fb.backends) || ctx.Err() != nil {
+			atomic.AddUint64(&fb.failed, 1)
+			cb(errs)
+			return
+		}
+		logging.Backend(fb.names[i]).WithField(logging.FieldInterval, metrics.Sequence).WithError(fmt.Errorf("%v", sendErrs)).Warnf("Failed to send interval, falling back to %q", fb.names[i+1])
+		fb.send(ctx, i+1, fallback, fallback, errs, cb)
+	})
+}
+
+// SendEvent sends the event to the primary backend, and to each fallback in turn while sending fails.  The error from
+// the last backend is returned if none succeeded.
+func (fb *FallbackBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	var err error
+	for i, b := range fb.backends {
+		if err = b.SendEvent(ctx, e); err == nil {
+			return nil
+		}
+		if i+1 < len(fb.backends) {
+			logging.Backend(fb.names[i]).WithError(err).Warnf("Failed to send event, falling back to %q", fb.names[i+1])
+		}
+	}
+	return err
+}
+
+// WantsRawTimers returns true if any of the backends want the raw timer samples.
+func (fb *FallbackBackend) WantsRawTimers() bool {
+	for _, b := range fb.backends {
+		if gostatsd.WantsRawTimers(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// WantsBackfill returns true if all of the backends want the metrics which arrived late for a past interval, as any
+// of them may be sent them.
+func (fb *FallbackBackend) WantsBackfill() bool {
+	for _, b := range fb.backends {
+		if !gostatsd.WantsBackfill(b) {
+			return false
+		}
+	}
+	return true
+}
+
+// TransferStats returns the total of the data sent by each of the backends which measure it.
+func (fb *FallbackBackend) TransferStats() (gostatsd.TransferStats, bool) {
+	var total gostatsd.TransferStats
+	measured := false
+	for _, b := range fb.backends {
+		if ts, ok := gostatsd.BackendTransferStats(b); ok {
+			total = total.Add(ts)
+			measured = true
+		}
+	}
+	return total, measured
+}
+
+// ValidateMetricName validates name with each of the backends, returning the first error.
+func (fb *FallbackBackend) ValidateMetricName(name string) error {
+	for i, b := range fb.backends {
+		if err := gostatsd.ValidateMetricName(b, name); err != nil {
+			return fmt.Errorf("%s: %v", fb.names[i], err)
+		}
+	}
+	return nil
+}
+
+func hasError(errs []error) bool {
+	for _, err := range errs {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubBackend records the metrics and events sent to it, failing while fail is set.
+type stubBackend struct {
+	name      string
+	fail      bool
+	async     bool // Whether to call the callback from another goroutine
+	rawTimers bool
+	backfill  bool
+
+	mu     sync.Mutex
+	sent   []*gostatsd.MetricMap
+	events int
+}
+
+func (sb *stubBackend) Name() string { return sb.name }
+
+func (sb *stubBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	var errs []error
+	if sb.fail {
+		errs = []error{errors.New("connection refused")}
+	} else {
+		sb.mu.Lock()
+		sb.sent = append(sb.sent, m)
+		sb.mu.Unlock()
+	}
+	if sb.async {
+		go cb(errs)
+	} else {
+		cb(errs)
+	}
+}
+
+func (sb *stubBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	if sb.fail {
+		return errors.New("connection refused")
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.events++
+	return nil
+}
+
+func (sb *stubBackend) WantsRawTimers() bool { return sb.rawTimers }
+
+func (sb *stubBackend) WantsBackfill() bool { return sb.backfill }
+
+func (sb *stubBackend) sentMetrics() []*gostatsd.MetricMap {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.sent
+}
+
+// sendAndWait sends m to b and returns the errors passed to the callback.
+func sendAndWait(b gostatsd.Backend, m *gostatsd.MetricMap) []error {
+	done := make(chan []error, 1)
+	b.SendMetricsAsync(context.Background(), m, func(errs []error) {
+		done <- errs
+	})
+	return <-done
+}
+
+func TestFallbackBackendPrimarySucceeds(t *testing.T) {
+	t.Parallel()
+	primary := &stubBackend{name: "primary"}
+	fallback := &stubBackend{name: "fallback"}
+	fb := NewFallbackBackend([]string{"primary", "fallback"}, []gostatsd.Backend{primary, fallback})
+
+	m := &gostatsd.MetricMap{Counters: gostatsd.Counters{"c": {"": {Value: 1}}}}
+	assert.Empty(t, sendAndWait(fb, m))
+	require.Len(t, primary.sentMetrics(), 1)
+	assert.True(t, primary.sentMetrics()[0] == m)
+	assert.Empty(t, fallback.sentMetrics())
+	assert.EqualValues(t, []uint64{1, 0}, fb.handled)
+	assert.Equal(t, "primary", fb.Name())
+}
+
+func TestFallbackBackendFailingPrimary(t *testing.T) {
+	t.Parallel()
+	primary := &stubBackend{name: "primary", fail: true, async: true, rawTimers: true}
+	failing := &stubBackend{name: "failing", fail: true}
+	fallback := &stubBackend{name: "fallback", async: true}
+	fb := NewFallbackBackend([]string{"primary", "failing", "fallback"}, []gostatsd.Backend{primary, failing, fallback})
+	assert.True(t, fb.WantsRawTimers())
+
+	m := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{"c": {"": {Value: 1}}},
+		Timers:   gostatsd.Timers{"t": {"": {Count: 1, Values: []float64{2}}}},
+	}
+	done := make(chan []error, 1)
+	fb.SendMetricsAsync(context.Background(), m, func(errs []error) {
+		done <- errs
+	})
+	// The fallback gets the metrics as they were when sent, even if they are reset before the primary fails.
+	m.Counters["c"][""] = gostatsd.Counter{}
+	m.Timers["t"][""].Values[0] = 0
+	assert.Empty(t, <-done)
+
+	sent := fallback.sentMetrics()
+	require.Len(t, sent, 1)
+	assert.Equal(t, gostatsd.Counters{"c": {"": {Value: 1}}}, sent[0].Counters)
+	// The fallback doesn't want raw timers.
+	assert.Equal(t, gostatsd.Timers{"t": {"": {Count: 1}}}, sent[0].Timers)
+	assert.EqualValues(t, []uint64{0, 0, 1}, fb.handled)
+	assert.Zero(t, atomic.LoadUint64(&fb.failed))
+
+	require.NoError(t, fb.SendEvent(context.Background(), &gostatsd.Event{}))
+	assert.Equal(t, 1, fallback.events)
+}
+
+func TestFallbackBackendAllFail(t *testing.T) {
+	t.Parallel()
+	primary := &stubBackend{name: "primary", fail: true}
+	fallback := &stubBackend{name: "fallback", fail: true}
+	fb := NewFallbackBackend([]string{"primary", "fallback"}, []gostatsd.Backend{primary, fallback})
+
+	assert.Len(t, sendAndWait(fb, &gostatsd.MetricMap{}), 2)
+	assert.EqualValues(t, []uint64{0, 0}, fb.handled)
+	assert.EqualValues(t, 1, atomic.LoadUint64(&fb.failed))
+	assert.Error(t, fb.SendEvent(context.Background(), &gostatsd.Event{}))
+}
+
+func TestFallbackBackendStatus(t *testing.T) {
+	t.Parallel()
+	lb := NewLazyBackend(&flakyBackend{})
+	fb := NewFallbackBackend([]string{"flaky", "stub"}, []gostatsd.Backend{lb, &stubBackend{name: "stub"}})
+	assert.Equal(t, "initializing, fallback stub ready", fb.Status())
+}
+
+func TestFallbackBackendWantsBackfill(t *testing.T) {
+	t.Parallel()
+	primary := &stubBackend{name: "primary", backfill: true}
+	fallback := &stubBackend{name: "fallback"}
+	// Any of the backends may be sent late metrics, so all of them must backfill.
+	assert.False(t, NewFallbackBackend([]string{"primary", "fallback"}, []gostatsd.Backend{primary, fallback}).WantsBackfill())
+	fallback.backfill = true
+	assert.True(t, NewFallbackBackend([]string{"primary", "fallback"}, []gostatsd.Backend{primary, fallback}).WantsBackfill())
+	assert.True(t, gostatsd.WantsBackfill(NewSequencedBackend("primary", primary)))
+}
+
+// transferStubBackend is a stubBackend which measures the data it sends.
+type transferStubBackend struct {
+	stubBackend
+	stats gostatsd.TransferStats
+}
+
+func (tb *transferStubBackend) TransferStats() (gostatsd.TransferStats, bool) { return tb.stats, true }
+
+func TestFallbackBackendTransferStats(t *testing.T) {
+	t.Parallel()
+	primary := &transferStubBackend{stubBackend: stubBackend{name: "primary"}, stats: gostatsd.TransferStats{BytesSent: 10, WriteTime: 3}}
+	fallback := &transferStubBackend{stubBackend: stubBackend{name: "fallback"}, stats: gostatsd.TransferStats{BytesSent: 5, WriteTime: 1}}
+	unmeasured := &stubBackend{name: "unmeasured"}
+
+	ts, ok := NewFallbackBackend([]string{"primary", "fallback", "unmeasured"}, []gostatsd.Backend{primary, fallback, unmeasured}).TransferStats()
+	assert.True(t, ok)
+	assert.Equal(t, gostatsd.TransferStats{BytesSent: 15, WriteTime: 4}, ts)
+
+	_, ok = NewFallbackBackend([]string{"unmeasured"}, []gostatsd.Backend{unmeasured}).TransferStats()
+	assert.False(t, ok)
+	_, ok = gostatsd.BackendTransferStats(NewSequencedBackend("unmeasured", unmeasured))
+	assert.False(t, ok)
+	ts, ok = gostatsd.BackendTransferStats(NewSequencedBackend("primary", primary))
+	assert.True(t, ok)
+	assert.EqualValues(t, 10, ts.BytesSent)
+}
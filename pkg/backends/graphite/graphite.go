@@ -3,14 +3,19 @@ package graphite
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/backends/sender"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	"github.com/atlassian/gostatsd/pkg/util"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -39,10 +44,20 @@ const (
 	DefaultGlobalSuffix = ""
 	// DefaultLegacyNamespace controls whether legacy namespace should be used by default.
 	DefaultLegacyNamespace = true
+	// DefaultDecimalPlaces is the default number of decimal places floating point values are written with.
+	DefaultDecimalPlaces = 6
+	// DefaultTrimTrailingZeros controls whether trailing zeros are trimmed from floating point values by default.
+	DefaultTrimTrailingZeros = true
 )
 
+// logger logs through a child of the standard logger for this backend.
+var logger = logging.Backend(BackendName)
+
 const (
 	bufSize = 1 * 1024 * 1024
+	// sendChannelSize specifies the size of the buffer of a channel between caller goroutine, producing buffers, and the
+	// goroutine that writes them to the socket.
+	sendChannelSize = 1000
 	// maxConcurrentSends is the number of max concurrent SendMetricsAsync calls that can actually make progress.
 	// More calls will block. The current implementation uses maximum 1 call.
 	maxConcurrentSends = 10
@@ -65,6 +80,9 @@ type Config struct {
 	PrefixSet       *string
 	GlobalSuffix    *string
 	LegacyNamespace *bool
+
+	DecimalPlaces     *int
+	TrimTrailingZeros *bool
 }
 
 // Client is an object that is used to send messages to a Graphite server's TCP interface.
@@ -77,6 +95,9 @@ type Client struct {
 	globalSuffix     string
 	legacyNamespace  bool
 	disabledSubtypes gostatsd.TimerSubtypes
+
+	decimalPlaces     int  // Number of decimal places floating point values are written with
+	trimTrailingZeros bool // Trim trailing zeros, and the decimal point of integral values
 }
 
 func (client *Client) Run(ctx context.Context) {
@@ -85,74 +106,118 @@ func (client *Client) Run(ctx context.Context) {
 
 // SendMetricsAsync flushes the metrics to the Graphite server, preparing payload synchronously but doing the send asynchronously.
 func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
-	buf := client.preparePayload(metrics, time.Now())
-	sink := make(chan *bytes.Buffer, 1)
-	sink <- buf
-	close(sink)
+	sink := make(chan *bytes.Buffer, sendChannelSize)
 	select {
 	case <-ctx.Done():
-		client.sender.PutBuffer(buf)
 		cb([]error{ctx.Err()})
+		return
 	case client.sender.Sink <- sender.Stream{Ctx: ctx, Cb: cb, Buf: sink}:
 	}
+	defer close(sink)
+	client.preparePayload(metrics, time.Now(), func(buf *bytes.Buffer) (*bytes.Buffer, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case sink <- buf:
+			return client.sender.GetBuffer(), nil
+		}
+	})
 }
 
-func (client *Client) preparePayload(metrics *gostatsd.MetricMap, ts time.Time) *bytes.Buffer {
-	buf := client.sender.GetBuffer()
+// preparePayload renders the metrics, passing them to frameFn in frames of at most bufSize bytes.
+func (client *Client) preparePayload(metrics *gostatsd.MetricMap, ts time.Time, frameFn sender.FrameFunc) {
+	start := time.Now()
+	bw := sender.NewBatchWriter(bufSize, false, client.sender.GetBuffer(), frameFn)
+	defer func() {
+		client.sender.PutBuffer(bw.Buffer())
+		client.sender.Transfer.Serialized(int(bw.Stats().Bytes), time.Since(start)-bw.FrameTime())
+	}()
+	line := new(bytes.Buffer)
+	var err error
+	writeLine := func(format string, a ...interface{}) {
+		if err != nil {
+			return
+		}
+		line.Reset()
+		fmt.Fprintf(line, format, a...) // #nosec
+		err = bw.Write(line.Bytes())
+	}
 	now := ts.Unix()
 	if client.legacyNamespace {
-		metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		metrics.EachCounter(func(key, tagsKey string, counter gostatsd.Counter) {
 			k := sk(key)
-			fmt.Fprintf(buf, "stats_counts.%s%s %d %d\n", k, client.globalSuffix, counter.Value, now)                   // #nosec
-			fmt.Fprintf(buf, "%s%s%s %f %d\n", client.counterNamespace, k, client.globalSuffix, counter.PerSecond, now) // #nosec
+			writeLine("stats_counts.%s%s %d %d\n", k, client.globalSuffix, counter.Value, now)
+			writeLine("%s%s%s %s %d\n", client.counterNamespace, k, client.globalSuffix, client.formatFloat(counter.PerSecond), now)
 		})
 	} else {
-		metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		metrics.EachCounter(func(key, tagsKey string, counter gostatsd.Counter) {
 			k := sk(key)
-			fmt.Fprintf(buf, "%s%s.count%s %d %d\n", client.counterNamespace, k, client.globalSuffix, counter.Value, now)    // #nosec
-			fmt.Fprintf(buf, "%s%s.rate%s %f %d\n", client.counterNamespace, k, client.globalSuffix, counter.PerSecond, now) // #nosec
+			writeLine("%s%s.count%s %d %d\n", client.counterNamespace, k, client.globalSuffix, counter.Value, now)
+			writeLine("%s%s.rate%s %s %d\n", client.counterNamespace, k, client.globalSuffix, client.formatFloat(counter.PerSecond), now)
 		})
 	}
-	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+	metrics.EachTimer(func(key, tagsKey string, timer gostatsd.Timer) {
 		k := sk(key)
 		if !client.disabledSubtypes.Lower {
-			fmt.Fprintf(buf, "%s%s.lower%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.Min, now) // #nosec
+			writeLine("%s%s.lower%s %s %d\n", client.timerNamespace, k, client.globalSuffix, client.formatFloat(timer.Min), now)
 		}
 		if !client.disabledSubtypes.Upper {
-			fmt.Fprintf(buf, "%s%s.upper%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.Max, now) // #nosec
+			writeLine("%s%s.upper%s %s %d\n", client.timerNamespace, k, client.globalSuffix, client.formatFloat(timer.Max), now)
 		}
 		if !client.disabledSubtypes.Count {
-			fmt.Fprintf(buf, "%s%s.count%s %d %d\n", client.timerNamespace, k, client.globalSuffix, timer.Count, now) // #nosec
+			writeLine("%s%s.count%s %d %d\n", client.timerNamespace, k, client.globalSuffix, timer.Count, now)
 		}
 		if !client.disabledSubtypes.CountPerSecond {
-			fmt.Fprintf(buf, "%s%s.count_ps%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.PerSecond, now) // #nosec
+			writeLine("%s%s.count_ps%s %s %d\n", client.timerNamespace, k, client.globalSuffix, client.formatFloat(timer.PerSecond), now)
 		}
 		if !client.disabledSubtypes.Mean {
-			fmt.Fprintf(buf, "%s%s.mean%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.Mean, now) // #nosec
+			writeLine("%s%s.mean%s %s %d\n", client.timerNamespace, k, client.globalSuffix, client.formatFloat(timer.Mean), now)
 		}
 		if !client.disabledSubtypes.Median {
-			fmt.Fprintf(buf, "%s%s.median%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.Median, now) // #nosec
+			writeLine("%s%s.median%s %s %d\n", client.timerNamespace, k, client.globalSuffix, client.formatFloat(timer.Median), now)
 		}
 		if !client.disabledSubtypes.StdDev {
-			fmt.Fprintf(buf, "%s%s.std%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.StdDev, now) // #nosec
+			writeLine("%s%s.std%s %s %d\n", client.timerNamespace, k, client.globalSuffix, client.formatFloat(timer.StdDev), now)
 		}
 		if !client.disabledSubtypes.Sum {
-			fmt.Fprintf(buf, "%s%s.sum%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.Sum, now) // #nosec
+			writeLine("%s%s.sum%s %s %d\n", client.timerNamespace, k, client.globalSuffix, client.formatFloat(timer.Sum), now)
 		}
 		if !client.disabledSubtypes.SumSquares {
-			fmt.Fprintf(buf, "%s%s.sum_squares%s %f %d\n", client.timerNamespace, k, client.globalSuffix, timer.SumSquares, now) // #nosec
+			writeLine("%s%s.sum_squares%s %s %d\n", client.timerNamespace, k, client.globalSuffix, client.formatFloat(timer.SumSquares), now)
 		}
 		for _, pct := range timer.Percentiles {
-			fmt.Fprintf(buf, "%s%s.%s%s %f %d\n", client.timerNamespace, k, pct.Str, client.globalSuffix, pct.Float, now) // #nosec
+			writeLine("%s%s.%s%s %s %d\n", client.timerNamespace, k, pct.Str, client.globalSuffix, client.formatFloat(pct.Float), now)
 		}
 	})
-	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
-		fmt.Fprintf(buf, "%s%s%s %f %d\n", client.gaugesNamespace, sk(key), client.globalSuffix, gauge.Value, now) // #nosec
+	metrics.EachGauge(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		writeLine("%s%s%s %s %d\n", client.gaugesNamespace, sk(key), client.globalSuffix, client.formatFloat(gauge.Value), now)
 	})
-	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
-		fmt.Fprintf(buf, "%s%s%s %d %d\n", client.setsNamespace, sk(key), client.globalSuffix, len(set.Values), now) // #nosec
+	metrics.EachSet(func(key, tagsKey string, set gostatsd.Set) {
+		writeLine("%s%s%s %d %d\n", client.setsNamespace, sk(key), client.globalSuffix, set.Cardinality(), now)
 	})
-	return buf
+	_ = bw.Flush() // Send what's left in the buffer, a no-op if the context is done
+}
+
+// formatFloat formats v with the configured number of decimal places, never in scientific notation.  Negative values
+// which round to zero are written as zero.
+func (client *Client) formatFloat(v float64) string {
+	s := strconv.FormatFloat(v, 'f', client.decimalPlaces, 64)
+	if client.trimTrailingZeros && strings.IndexByte(s, '.') >= 0 {
+		s = strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+	}
+	if s[0] == '-' && strings.Trim(s, "-0.") == "" {
+		s = s[1:]
+	}
+	return s
+}
+
+// Connect checks the Graphite server is reachable.
+func (client *Client) Connect(ctx context.Context) error {
+	conn, err := client.sender.ConnFactory()
+	if err != nil {
+		return fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	return conn.Close()
 }
 
 // SendEvent discards events.
@@ -165,6 +230,22 @@ func (client *Client) Name() string {
 	return BackendName
 }
 
+// TransferStats returns the bytes written to the Graphite server and the time taken, which has no compression.
+func (client *Client) TransferStats() (gostatsd.TransferStats, bool) {
+	return client.sender.Transfer.Stats(), true
+}
+
+// ValidateMetricName returns an error if name would be changed when it is written, or has an empty path component.
+func (client *Client) ValidateMetricName(name string) error {
+	if written := string(sk(name)); written != name {
+		return fmt.Errorf("invalid characters, would be written as %q", written)
+	}
+	if name == "" || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || strings.Contains(name, "..") {
+		return errors.New("empty path component")
+	}
+	return nil
+}
+
 // NewClientFromViper constructs a GraphiteClient object by connecting to an address.
 func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 	g := getSubViper(v, "graphite")
@@ -178,6 +259,8 @@ func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 	g.SetDefault("prefix_set", DefaultPrefixSet)
 	g.SetDefault("global_suffix", DefaultGlobalSuffix)
 	g.SetDefault("legacy_namespace", DefaultLegacyNamespace)
+	g.SetDefault("decimal_places", DefaultDecimalPlaces)
+	g.SetDefault("trim_trailing_zeros", DefaultTrimTrailingZeros)
 	return NewClient(&Config{
 		Address:         addr(g.GetString("address")),
 		DialTimeout:     addrD(g.GetDuration("dial_timeout")),
@@ -189,7 +272,10 @@ func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 		PrefixSet:       addr(g.GetString("prefix_set")),
 		GlobalSuffix:    addr(g.GetString("global_suffix")),
 		LegacyNamespace: addrB(g.GetBool("legacy_namespace")),
-	}, gostatsd.DisabledSubMetrics(v))
+
+		DecimalPlaces:     addrI(g.GetInt("decimal_places")),
+		TrimTrailingZeros: addrB(g.GetBool("trim_trailing_zeros")),
+	}, util.DisabledSubMetrics(v))
 }
 
 // NewClient constructs a Graphite backend object.
@@ -206,6 +292,17 @@ func NewClient(config *Config, disabled gostatsd.TimerSubtypes) (*Client, error)
 	if writeTimeout < 0 {
 		return nil, fmt.Errorf("[%s] writeTimeout should be non-negative", BackendName)
 	}
+	decimalPlaces := DefaultDecimalPlaces
+	if config.DecimalPlaces != nil {
+		decimalPlaces = *config.DecimalPlaces
+	}
+	if decimalPlaces < 0 {
+		return nil, fmt.Errorf("[%s] decimalPlaces should be non-negative", BackendName)
+	}
+	trimTrailingZeros := DefaultTrimTrailingZeros
+	if config.TrimTrailingZeros != nil {
+		trimTrailingZeros = *config.TrimTrailingZeros
+	}
 	globalSuffix := getOrDefaultStr(config.GlobalSuffix, DefaultGlobalSuffix)
 	if globalSuffix != "" {
 		globalSuffix = `.` + globalSuffix
@@ -229,9 +326,14 @@ func NewClient(config *Config, disabled gostatsd.TimerSubtypes) (*Client, error)
 		gaugesNamespace = globalPrefix + getOrDefaultPrefix(config.PrefixGauge, DefaultPrefixGauge)
 		setsNamespace = globalPrefix + getOrDefaultPrefix(config.PrefixSet, DefaultPrefixSet)
 	}
-	log.Infof("[%s] address=%s dialTimeout=%s writeTimeout=%s", BackendName, address, dialTimeout, writeTimeout)
+	logger.WithFields(log.Fields{
+		logging.FieldAddress: address,
+		"dial_timeout":       dialTimeout,
+		"write_timeout":      writeTimeout,
+	}).Info("Configured backend")
 	return &Client{
 		sender: sender.Sender{
+			Logger: logger,
 			ConnFactory: func() (net.Conn, error) {
 				return net.DialTimeout("tcp", address, dialTimeout)
 			},
@@ -252,6 +354,9 @@ func NewClient(config *Config, disabled gostatsd.TimerSubtypes) (*Client, error)
 		globalSuffix:     globalSuffix,
 		legacyNamespace:  legacyNamespace,
 		disabledSubtypes: disabled,
+
+		decimalPlaces:     decimalPlaces,
+		trimTrailingZeros: trimTrailingZeros,
 	}, nil
 }
 
@@ -287,6 +392,10 @@ func addr(s string) *string {
 	return &s
 }
 
+func addrI(i int) *int {
+	return &i
+}
+
 func addrB(b bool) *bool {
 	return &b
 }
@@ -1,8 +1,10 @@
 package graphite
 
 import (
+	"bytes"
 	"context"
 	"io"
+	"math"
 	"net"
 	"strconv"
 	"sync"
@@ -29,18 +31,18 @@ func TestPreparePayload(t *testing.T) {
 			// Use defaults
 			},
 			result: []byte("stats_counts.stat1 5 1234\n" +
-				"stats.stat1 1.100000 1234\n" +
-				"stats.timers.t1.lower 0.000000 1234\n" +
-				"stats.timers.t1.upper 0.000000 1234\n" +
+				"stats.stat1 1.1 1234\n" +
+				"stats.timers.t1.lower 0 1234\n" +
+				"stats.timers.t1.upper 0 1234\n" +
 				"stats.timers.t1.count 0 1234\n" +
-				"stats.timers.t1.count_ps 0.000000 1234\n" +
-				"stats.timers.t1.mean 0.000000 1234\n" +
-				"stats.timers.t1.median 0.000000 1234\n" +
-				"stats.timers.t1.std 0.000000 1234\n" +
-				"stats.timers.t1.sum 0.000000 1234\n" +
-				"stats.timers.t1.sum_squares 0.000000 1234\n" +
-				"stats.timers.t1.count_90 90.000000 1234\n" +
-				"stats.gauges.g1 3.000000 1234\n" +
+				"stats.timers.t1.count_ps 0 1234\n" +
+				"stats.timers.t1.mean 0 1234\n" +
+				"stats.timers.t1.median 0 1234\n" +
+				"stats.timers.t1.std 0 1234\n" +
+				"stats.timers.t1.sum 0 1234\n" +
+				"stats.timers.t1.sum_squares 0 1234\n" +
+				"stats.timers.t1.count_90 90 1234\n" +
+				"stats.gauges.g1 3 1234\n" +
 				"stats.sets.users 3 1234\n"),
 		},
 		{
@@ -54,18 +56,18 @@ func TestPreparePayload(t *testing.T) {
 				LegacyNamespace: addrB(true),
 			},
 			result: []byte("stats_counts.stat1.gs 5 1234\n" +
-				"stats.stat1.gs 1.100000 1234\n" +
-				"stats.timers.t1.lower.gs 0.000000 1234\n" +
-				"stats.timers.t1.upper.gs 0.000000 1234\n" +
+				"stats.stat1.gs 1.1 1234\n" +
+				"stats.timers.t1.lower.gs 0 1234\n" +
+				"stats.timers.t1.upper.gs 0 1234\n" +
 				"stats.timers.t1.count.gs 0 1234\n" +
-				"stats.timers.t1.count_ps.gs 0.000000 1234\n" +
-				"stats.timers.t1.mean.gs 0.000000 1234\n" +
-				"stats.timers.t1.median.gs 0.000000 1234\n" +
-				"stats.timers.t1.std.gs 0.000000 1234\n" +
-				"stats.timers.t1.sum.gs 0.000000 1234\n" +
-				"stats.timers.t1.sum_squares.gs 0.000000 1234\n" +
-				"stats.timers.t1.count_90.gs 90.000000 1234\n" +
-				"stats.gauges.g1.gs 3.000000 1234\n" +
+				"stats.timers.t1.count_ps.gs 0 1234\n" +
+				"stats.timers.t1.mean.gs 0 1234\n" +
+				"stats.timers.t1.median.gs 0 1234\n" +
+				"stats.timers.t1.std.gs 0 1234\n" +
+				"stats.timers.t1.sum.gs 0 1234\n" +
+				"stats.timers.t1.sum_squares.gs 0 1234\n" +
+				"stats.timers.t1.count_90.gs 90 1234\n" +
+				"stats.gauges.g1.gs 3 1234\n" +
 				"stats.sets.users.gs 3 1234\n"),
 		},
 		{
@@ -79,18 +81,18 @@ func TestPreparePayload(t *testing.T) {
 				LegacyNamespace: addrB(false),
 			},
 			result: []byte("gp.pc.stat1.count.gs 5 1234\n" +
-				"gp.pc.stat1.rate.gs 1.100000 1234\n" +
-				"gp.pt.t1.lower.gs 0.000000 1234\n" +
-				"gp.pt.t1.upper.gs 0.000000 1234\n" +
+				"gp.pc.stat1.rate.gs 1.1 1234\n" +
+				"gp.pt.t1.lower.gs 0 1234\n" +
+				"gp.pt.t1.upper.gs 0 1234\n" +
 				"gp.pt.t1.count.gs 0 1234\n" +
-				"gp.pt.t1.count_ps.gs 0.000000 1234\n" +
-				"gp.pt.t1.mean.gs 0.000000 1234\n" +
-				"gp.pt.t1.median.gs 0.000000 1234\n" +
-				"gp.pt.t1.std.gs 0.000000 1234\n" +
-				"gp.pt.t1.sum.gs 0.000000 1234\n" +
-				"gp.pt.t1.sum_squares.gs 0.000000 1234\n" +
-				"gp.pt.t1.count_90.gs 90.000000 1234\n" +
-				"gp.pg.g1.gs 3.000000 1234\n" +
+				"gp.pt.t1.count_ps.gs 0 1234\n" +
+				"gp.pt.t1.mean.gs 0 1234\n" +
+				"gp.pt.t1.median.gs 0 1234\n" +
+				"gp.pt.t1.std.gs 0 1234\n" +
+				"gp.pt.t1.sum.gs 0 1234\n" +
+				"gp.pt.t1.sum_squares.gs 0 1234\n" +
+				"gp.pt.t1.count_90.gs 90 1234\n" +
+				"gp.pg.g1.gs 3 1234\n" +
 				"gp.ps.users.gs 3 1234\n"),
 		},
 	}
@@ -100,7 +102,12 @@ func TestPreparePayload(t *testing.T) {
 			t.Parallel()
 			cl, err := NewClient(td.config, gostatsd.TimerSubtypes{})
 			require.NoError(t, err)
-			b := cl.preparePayload(metrics, time.Unix(1234, 0))
+			var b bytes.Buffer
+			cl.preparePayload(metrics, time.Unix(1234, 0), func(frame *bytes.Buffer) (*bytes.Buffer, error) {
+				b.Write(frame.Bytes())
+				frame.Reset()
+				return frame, nil
+			})
 			assert.Equal(t, string(td.result), b.String(), "test %d", i)
 		})
 	}
@@ -153,6 +160,12 @@ func TestSendMetricsAsync(t *testing.T) {
 		}
 	})
 	swg.Wait()
+
+	ts, ok := c.TransferStats()
+	assert.True(t, ok)
+	assert.NotZero(t, ts.BytesSerialized)
+	// There is no compression, so every byte serialized is sent as it is.
+	assert.Equal(t, ts.BytesSerialized, ts.BytesSent)
 }
 
 func metrics() *gostatsd.MetricMap {
@@ -194,3 +207,155 @@ func metrics() *gostatsd.MetricMap {
 		},
 	}
 }
+
+func TestConnect(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	c, err := NewClient(&Config{
+		Address: &addr,
+	}, gostatsd.TimerSubtypes{})
+	require.NoError(t, err)
+	assert.NoError(t, c.Connect(context.Background()))
+
+	require.NoError(t, l.Close())
+	assert.Error(t, c.Connect(context.Background()))
+}
+
+func TestPreparePayloadSorted(t *testing.T) {
+	t.Parallel()
+	metrics := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{},
+		Gauges: gostatsd.Gauges{
+			"c": {"": {Value: 3}},
+			"a": {"": {Value: 1}},
+			"b": {"x": {Value: 2}, "y": {Value: 2}},
+			"d": {"": {Value: 4}},
+		},
+		Timers: gostatsd.Timers{},
+		Sets:   gostatsd.Sets{},
+		Sorted: true,
+	}
+	cl, err := NewClient(&Config{}, gostatsd.TimerSubtypes{})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		var b bytes.Buffer
+		cl.preparePayload(metrics, time.Unix(1234, 0), func(frame *bytes.Buffer) (*bytes.Buffer, error) {
+			b.Write(frame.Bytes())
+			frame.Reset()
+			return frame, nil
+		})
+		expected := "stats.gauges.a 1 1234\n" +
+			"stats.gauges.b 2 1234\n" +
+			"stats.gauges.b 2 1234\n" +
+			"stats.gauges.c 3 1234\n" +
+			"stats.gauges.d 4 1234\n"
+		assert.Equal(t, expected, b.String())
+	}
+}
+
+func TestValidateMetricName(t *testing.T) {
+	t.Parallel()
+	cl, err := NewClient(&Config{}, gostatsd.TimerSubtypes{})
+	require.NoError(t, err)
+	for _, name := range []string{"a", "a.b_c-d", "API.Requests.2xx"} {
+		assert.NoError(t, cl.ValidateMetricName(name), name)
+	}
+	for _, name := range []string{"a b", "a/b", "a;b=c", "latency(ms)", "", ".a", "a.", "a..b"} {
+		assert.Error(t, cl.ValidateMetricName(name), name)
+	}
+	assert.EqualError(t, cl.ValidateMetricName("a b"), `invalid characters, would be written as "a_b"`)
+}
+
+func TestPreparePayloadFormatting(t *testing.T) {
+	t.Parallel()
+	metrics := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{
+			"big": {"": {Value: math.MaxInt64, PerSecond: 1.2e7}},
+		},
+		Timers: gostatsd.Timers{
+			"fast": {"": {Min: 1e-10, Max: 2.5e-7, Percentiles: gostatsd.Percentiles{{Float: 1e-10, Str: "upper_90"}}}},
+		},
+		Gauges: gostatsd.Gauges{
+			"huge":     {"": {Value: 1e20}},
+			"negative": {"": {Value: -1.5}},
+			"noise":    {"": {Value: 0.1 + 0.2}},
+			"tiny":     {"": {Value: -1e-9}},
+		},
+		Sets:   gostatsd.Sets{},
+		Sorted: true,
+	}
+	disabled := gostatsd.TimerSubtypes{Count: true, CountPerSecond: true, Mean: true, Median: true, StdDev: true, Sum: true, SumSquares: true}
+	input := []struct {
+		config *Config
+		result string
+	}{
+		{
+			config: &Config{},
+			result: "stats_counts.big 9223372036854775807 1234\n" +
+				"stats.big 12000000 1234\n" +
+				"stats.timers.fast.lower 0 1234\n" +
+				"stats.timers.fast.upper 0 1234\n" +
+				"stats.timers.fast.upper_90 0 1234\n" +
+				"stats.gauges.huge 100000000000000000000 1234\n" +
+				"stats.gauges.negative -1.5 1234\n" +
+				"stats.gauges.noise 0.3 1234\n" +
+				"stats.gauges.tiny 0 1234\n",
+		},
+		{
+			config: &Config{DecimalPlaces: addrI(10)},
+			result: "stats_counts.big 9223372036854775807 1234\n" +
+				"stats.big 12000000 1234\n" +
+				"stats.timers.fast.lower 0.0000000001 1234\n" +
+				"stats.timers.fast.upper 0.00000025 1234\n" +
+				"stats.timers.fast.upper_90 0.0000000001 1234\n" +
+				"stats.gauges.huge 100000000000000000000 1234\n" +
+				"stats.gauges.negative -1.5 1234\n" +
+				"stats.gauges.noise 0.3 1234\n" +
+				"stats.gauges.tiny -0.000000001 1234\n",
+		},
+		{
+			config: &Config{DecimalPlaces: addrI(2), TrimTrailingZeros: addrB(false)},
+			result: "stats_counts.big 9223372036854775807 1234\n" +
+				"stats.big 12000000.00 1234\n" +
+				"stats.timers.fast.lower 0.00 1234\n" +
+				"stats.timers.fast.upper 0.00 1234\n" +
+				"stats.timers.fast.upper_90 0.00 1234\n" +
+				"stats.gauges.huge 100000000000000000000.00 1234\n" +
+				"stats.gauges.negative -1.50 1234\n" +
+				"stats.gauges.noise 0.30 1234\n" +
+				"stats.gauges.tiny 0.00 1234\n",
+		},
+		{
+			config: &Config{DecimalPlaces: addrI(0)},
+			result: "stats_counts.big 9223372036854775807 1234\n" +
+				"stats.big 12000000 1234\n" +
+				"stats.timers.fast.lower 0 1234\n" +
+				"stats.timers.fast.upper 0 1234\n" +
+				"stats.timers.fast.upper_90 0 1234\n" +
+				"stats.gauges.huge 100000000000000000000 1234\n" +
+				"stats.gauges.negative -2 1234\n" +
+				"stats.gauges.noise 0 1234\n" +
+				"stats.gauges.tiny 0 1234\n",
+		},
+	}
+	for i, td := range input {
+		td := td
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Parallel()
+			cl, err := NewClient(td.config, disabled)
+			require.NoError(t, err)
+			var b bytes.Buffer
+			cl.preparePayload(metrics, time.Unix(1234, 0), func(frame *bytes.Buffer) (*bytes.Buffer, error) {
+				b.Write(frame.Bytes())
+				frame.Reset()
+				return frame, nil
+			})
+			assert.Equal(t, td.result, b.String())
+		})
+	}
+
+	_, err := NewClient(&Config{DecimalPlaces: addrI(-1)}, disabled)
+	assert.Error(t, err)
+}
@@ -0,0 +1,256 @@
+package backends
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// ParamHashNames is the backend setting listing the metric names to hash before sending to the backend.
+	ParamHashNames = "hash-names"
+	// ParamHashKey is the backend setting with the key used to hash metric names.
+	ParamHashKey = "hash-key"
+	// ParamHashLength is the backend setting with the number of hex digits of each hash to keep.
+	ParamHashLength = "hash-length"
+	// DefaultHashLength is the default number of hex digits of each hash to keep.
+	DefaultHashLength = 16
+)
+
+// hashRule hashes the names matching a glob, either entirely or only the dot separated segments at the given indexes.
+type hashRule struct {
+	glob     string
+	segments []int // Indexes of the segments to hash, nil to hash the whole name
+}
+
+// parseHashRule parses a rule of the form <glob> or <glob>:<index>,<index>,...
+func parseHashRule(s string) (hashRule, error) {
+	var r hashRule
+	r.glob = s
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		r.glob = s[:i]
+		for _, index := range strings.Split(s[i+1:], ",") {
+			n, err := strconv.Atoi(index)
+			if err != nil || n < 0 {
+				return hashRule{}, fmt.Errorf("invalid segment index %q in %q", index, s)
+			}
+			r.segments = append(r.segments, n)
+		}
+	}
+	if _, err := path.Match(r.glob, ""); err != nil {
+		return hashRule{}, fmt.Errorf("invalid glob %q: %v", r.glob, err)
+	}
+	return r, nil
+}
+
+// HashingBackend wraps a backend, replacing metric names, or segments of them, which match its rules with a truncated
+// keyed HMAC-SHA256 before sending them.  The same name always hashes to the same value for the same key.  Events
+// are sent unchanged.
+type HashingBackend struct {
+	backend gostatsd.Backend
+	rules   []hashRule
+	key     []byte
+	length  int // Number of hex digits of each hash to keep
+
+	mu    sync.Mutex
+	names map[string]string // The hashed names sent in the last flush, by original name
+}
+
+// NewHashingBackend creates a HashingBackend sending to backend, hashing with key and keeping length hex digits of
+// each hash.  Each rule is a glob matching whole metric names, optionally followed by a colon and a comma separated
+// list of the indexes of the dot separated segments to hash, such as "users.*.logins:1".
+func NewHashingBackend(backend gostatsd.Backend, rules []string, key string, length int) (*HashingBackend, error) {
+	if key == "" {
+		return nil, errors.New("hash key must be set to hash names")
+	}
+	if length <= 0 || length > 2*sha256.Size {
+		return nil, fmt.Errorf("hash length must be between 1 and %d", 2*sha256.Size)
+	}
+	hb := &HashingBackend{
+		backend: backend,
+		key:     []byte(key),
+		length:  length,
+		names:   map[string]string{},
+	}
+	for _, s := range rules {
+		r, err := parseHashRule(s)
+		if err != nil {
+			return nil, err
+		}
+		hb.rules = append(hb.rules, r)
+	}
+	return hb, nil
+}
+
+// WrapHashNames returns b wrapped in a HashingBackend if the section of the named backend has hash-names set,
+// otherwise b unchanged.  The name may be of the form <backend>:<instance>, as for InitBackend.
+func WrapHashNames(name string, b gostatsd.Backend, v *viper.Viper) (gostatsd.Backend, error) {
+	section := backendSection(name, v)
+	rules := section.GetStringSlice(ParamHashNames)
+	if len(rules) == 0 {
+		return b, nil
+	}
+	section.SetDefault(ParamHashLength, DefaultHashLength)
+	hb, err := NewHashingBackend(b, rules, section.GetString(ParamHashKey), section.GetInt(ParamHashLength))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s for backend %q: %v", ParamHashNames, name, err)
+	}
+	return hb, nil
+}
+
+// hash returns the truncated hex HMAC of s.
+func (hb *HashingBackend) hash(s string) string {
+	mac := hmac.New(sha256.New, hb.key)
+	_, _ = mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))[:hb.length]
+}
+
+// hashName returns the name to send for name, looking it up in the names hashed for the last flush first.
+func (hb *HashingBackend) hashName(name string, last, next map[string]string) string {
+	if hashed, ok := next[name]; ok {
+		return hashed
+	}
+	hashed, ok := last[name]
+	if !ok {
+		hashed = name
+		for _, r := range hb.rules {
+			if ok, _ := path.Match(r.glob, name); ok {
+				hashed = hb.apply(r, name)
+				break
+			}
+		}
+	}
+	next[name] = hashed
+	return hashed
+}
+
+// apply returns name hashed by r.  Segment indexes beyond the end of the name are ignored.
+func (hb *HashingBackend) apply(r hashRule, name string) string {
+	if r.segments == nil {
+		return hb.hash(name)
+	}
+	segments := strings.Split(name, ".")
+	for _, i := range r.segments {
+		if i < len(segments) {
+			segments[i] = hb.hash(segments[i])
+		}
+	}
+	return strings.Join(segments, ".")
+}
+
+// hashNames returns a copy of m with the names hashed.  The values of the metrics are shared with m.
+func (hb *HashingBackend) hashNames(m *gostatsd.MetricMap) *gostatsd.MetricMap {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	last := hb.names
+	next := make(map[string]string, len(last))
+	hashed := &gostatsd.MetricMap{
+		Counters: make(gostatsd.Counters, len(m.Counters)),
+		Timers:   make(gostatsd.Timers, len(m.Timers)),
+		Gauges:   make(gostatsd.Gauges, len(m.Gauges)),
+		Sets:     make(gostatsd.Sets, len(m.Sets)),
+		Sorted:   m.Sorted,
+
+		Interval:        m.Interval,
+		NominalInterval: m.NominalInterval,
+		Sequence:        m.Sequence,
+		Part:            m.Part,
+		Late:            m.Late,
+	}
+	for name, tagged := range m.Counters {
+		hashed.Counters[hb.hashName(name, last, next)] = tagged
+	}
+	for name, tagged := range m.Timers {
+		hashed.Timers[hb.hashName(name, last, next)] = tagged
+	}
+	for name, tagged := range m.Gauges {
+		hashed.Gauges[hb.hashName(name, last, next)] = tagged
+	}
+	for name, tagged := range m.Sets {
+		hashed.Sets[hb.hashName(name, last, next)] = tagged
+	}
+	hb.names = next
+	return hashed
+}
+
+// SendMetricsAsync sends the metrics to the backend with the names hashed.
+func (hb *HashingBackend) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	hb.backend.SendMetricsAsync(ctx, hb.hashNames(metrics), cb)
+}
+
+// SendEvent sends the event to the backend unchanged.
+func (hb *HashingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return hb.backend.SendEvent(ctx, e)
+}
+
+// Name returns the name of the wrapped backend.
+func (hb *HashingBackend) Name() string {
+	return hb.backend.Name()
+}
+
+// SaveState returns the state of the wrapped backend, if it is a gostatsd.StatefulBackend.
+func (hb *HashingBackend) SaveState() ([]byte, error) {
+	return gostatsd.SaveBackendState(hb.backend)
+}
+
+// RestoreState restores the state of the wrapped backend, if it is a gostatsd.StatefulBackend.
+func (hb *HashingBackend) RestoreState(state []byte) error {
+	return gostatsd.RestoreBackendState(hb.backend, state)
+}
+
+// ValidateMetricName validates name, before it is hashed, with the wrapped backend.
+func (hb *HashingBackend) ValidateMetricName(name string) error {
+	return gostatsd.ValidateMetricName(hb.backend, name)
+}
+
+// Run runs the wrapped backend, if it is a gostatsd.RunnableBackend.
+func (hb *HashingBackend) Run(ctx context.Context) {
+	if rb, ok := hb.backend.(gostatsd.RunnableBackend); ok {
+		rb.Run(ctx)
+	}
+}
+
+// RunMetrics runs the metrics of the wrapped backend, if it has any.
+func (hb *HashingBackend) RunMetrics(ctx context.Context, statser statser.Statser) {
+	if me, ok := hb.backend.(metricEmitter); ok {
+		me.RunMetrics(ctx, statser)
+	}
+}
+
+// Status returns the status of the wrapped backend.
+func (hb *HashingBackend) Status() string {
+	return gostatsd.BackendStatus(hb.backend)
+}
+
+// WriteReport writes the report of the wrapped backend, if it is a gostatsd.ReportingBackend.
+func (hb *HashingBackend) WriteReport(w io.Writer) error {
+	return gostatsd.BackendReport(hb.backend, w)
+}
+
+// WantsRawTimers returns true if the wrapped backend wants the raw timer samples.
+func (hb *HashingBackend) WantsRawTimers() bool {
+	return gostatsd.WantsRawTimers(hb.backend)
+}
+
+// WantsBackfill returns true if the wrapped backend wants the metrics which arrived late for a past interval.
+func (hb *HashingBackend) WantsBackfill() bool {
+	return gostatsd.WantsBackfill(hb.backend)
+}
+
+// TransferStats returns the lifetime totals of the data the wrapped backend has sent, if it measures them.
+func (hb *HashingBackend) TransferStats() (gostatsd.TransferStats, bool) {
+	return gostatsd.BackendTransferStats(hb.backend)
+}
@@ -0,0 +1,120 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testHash(key, s string, length int) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	_, _ = mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))[:length]
+}
+
+func TestHashingBackend(t *testing.T) {
+	t.Parallel()
+	stub := &stubBackend{name: "stub"}
+	hb, err := NewHashingBackend(stub, []string{"users.*.logins:1", "email.*", "a.*.*.d:0,2,9"}, "secret", 12)
+	require.NoError(t, err)
+
+	m := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{
+			"users.alice.logins": {"": {Value: 1}},
+			"requests":           {"": {Value: 2}},
+		},
+		Timers: gostatsd.Timers{"email.bob@example.com": {"": {Count: 3}}},
+		Gauges: gostatsd.Gauges{"a.b.c.d": {"": {Value: 4}}},
+		Sets:   gostatsd.Sets{},
+	}
+	expected := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{
+			"users." + testHash("secret", "alice", 12) + ".logins": {"": {Value: 1}},
+			"requests": {"": {Value: 2}},
+		},
+		Timers: gostatsd.Timers{testHash("secret", "email.bob@example.com", 12): {"": {Count: 3}}},
+		Gauges: gostatsd.Gauges{testHash("secret", "a", 12) + ".b." + testHash("secret", "c", 12) + ".d": {"": {Value: 4}}},
+		Sets:   gostatsd.Sets{},
+	}
+
+	// The same names hash to the same values every flush.
+	for i := 0; i < 2; i++ {
+		assert.Empty(t, sendAndWait(hb, m))
+		sent := stub.sentMetrics()
+		require.Len(t, sent, i+1)
+		assert.Equal(t, expected, sent[i])
+	}
+	// The original is unchanged.
+	assert.Contains(t, m.Counters, "users.alice.logins")
+	assert.Len(t, hb.names, 4)
+
+	// A different key gives different hashes.
+	other, err := NewHashingBackend(stub, []string{"email.*"}, "other", 12)
+	require.NoError(t, err)
+	assert.NotEqual(t, hb.hash("email.bob@example.com"), other.hash("email.bob@example.com"))
+}
+
+func TestNewHashingBackendInvalid(t *testing.T) {
+	t.Parallel()
+	stub := &stubBackend{name: "stub"}
+	tests := map[string]struct {
+		rules  []string
+		key    string
+		length int
+	}{
+		"no key":        {rules: []string{"a.*"}, length: 16},
+		"zero length":   {rules: []string{"a.*"}, key: "k"},
+		"long length":   {rules: []string{"a.*"}, key: "k", length: 65},
+		"bad glob":      {rules: []string{"a["}, key: "k", length: 16},
+		"bad index":     {rules: []string{"a.*:x"}, key: "k", length: 16},
+		"negative":      {rules: []string{"a.*:-1"}, key: "k", length: 16},
+		"empty segment": {rules: []string{"a.*:"}, key: "k", length: 16},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := NewHashingBackend(stub, test.rules, test.key, test.length)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestWrapHashNames(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+[graphite]
+address='shared:2003'
+
+[graphite.private]
+hash-names=['users.*']
+hash-key='secret'
+`)))
+	stub := &stubBackend{name: "graphite"}
+
+	// Backends without the option are unchanged.
+	b, err := WrapHashNames("graphite", stub, v)
+	require.NoError(t, err)
+	assert.True(t, b == stub)
+
+	b, err = WrapHashNames("graphite:private", stub, v)
+	require.NoError(t, err)
+	hb, ok := b.(*HashingBackend)
+	require.True(t, ok)
+	assert.Equal(t, DefaultHashLength, hb.length)
+	assert.Equal(t, "graphite", hb.Name())
+
+	v.Set("graphite.hash-names", []string{"users.*"})
+	_, err = WrapHashNames("graphite", stub, v)
+	assert.Error(t, err)
+}
@@ -0,0 +1,155 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/spf13/viper"
+)
+
+// ParamInternalMetrics is the backend setting of whether to send gostatsd's own internal metrics to the backend.
+const ParamInternalMetrics = "internal-metrics"
+
+// InternalFilterBackend wraps a backend, leaving out gostatsd's own internal metrics, those named in the internal
+// namespace, before sending to it.  Events are sent unchanged.
+type InternalFilterBackend struct {
+	backend gostatsd.Backend
+	prefix  string // Prefix of the names of internal metrics
+}
+
+// NewInternalFilterBackend creates an InternalFilterBackend sending to backend the metrics which are not in
+// namespace, the namespace of the internal metrics.
+func NewInternalFilterBackend(backend gostatsd.Backend, namespace string) *InternalFilterBackend {
+	return &InternalFilterBackend{
+		backend: backend,
+		prefix:  namespace + ".",
+	}
+}
+
+// WrapInternalMetrics returns b wrapped in an InternalFilterBackend if the section of the named backend has
+// internal-metrics set to false, otherwise b unchanged.  namespace is the namespace of the internal metrics, which
+// must be set to tell them apart from other metrics.  The name may be of the form <backend>:<instance>, as for
+// InitBackend.
+func WrapInternalMetrics(name string, b gostatsd.Backend, v *viper.Viper, namespace string) (gostatsd.Backend, error) {
+	section := backendSection(name, v)
+	section.SetDefault(ParamInternalMetrics, true)
+	if section.GetBool(ParamInternalMetrics) {
+		return b, nil
+	}
+	if namespace == "" {
+		return nil, fmt.Errorf("%s = false for backend %q requires an internal namespace, so internal metrics can be told apart", ParamInternalMetrics, name)
+	}
+	return NewInternalFilterBackend(b, namespace), nil
+}
+
+// withoutInternal returns a copy of m without the internal metrics.  The values of the metrics are shared with m.
+func (ib *InternalFilterBackend) withoutInternal(m *gostatsd.MetricMap) *gostatsd.MetricMap {
+	filtered := &gostatsd.MetricMap{
+		Counters: make(gostatsd.Counters, len(m.Counters)),
+		Timers:   make(gostatsd.Timers, len(m.Timers)),
+		Gauges:   make(gostatsd.Gauges, len(m.Gauges)),
+		Sets:     make(gostatsd.Sets, len(m.Sets)),
+		Sorted:   m.Sorted,
+
+		Interval:        m.Interval,
+		NominalInterval: m.NominalInterval,
+		Sequence:        m.Sequence,
+		Part:            m.Part,
+		Late:            m.Late,
+	}
+	for name, tagged := range m.Counters {
+		if !strings.HasPrefix(name, ib.prefix) {
+			filtered.Counters[name] = tagged
+		}
+	}
+	for name, tagged := range m.Timers {
+		if !strings.HasPrefix(name, ib.prefix) {
+			filtered.Timers[name] = tagged
+		}
+	}
+	for name, tagged := range m.Gauges {
+		if !strings.HasPrefix(name, ib.prefix) {
+			filtered.Gauges[name] = tagged
+		}
+	}
+	for name, tagged := range m.Sets {
+		if !strings.HasPrefix(name, ib.prefix) {
+			filtered.Sets[name] = tagged
+		}
+	}
+	return filtered
+}
+
+// SendMetricsAsync sends the metrics to the backend without the internal metrics.
+func (ib *InternalFilterBackend) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	ib.backend.SendMetricsAsync(ctx, ib.withoutInternal(metrics), cb)
+}
+
+// SendEvent sends the event to the backend unchanged.
+func (ib *InternalFilterBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return ib.backend.SendEvent(ctx, e)
+}
+
+// Name returns the name of the wrapped backend.
+func (ib *InternalFilterBackend) Name() string {
+	return ib.backend.Name()
+}
+
+// SaveState returns the state of the wrapped backend, if it is a gostatsd.StatefulBackend.
+func (ib *InternalFilterBackend) SaveState() ([]byte, error) {
+	return gostatsd.SaveBackendState(ib.backend)
+}
+
+// RestoreState restores the state of the wrapped backend, if it is a gostatsd.StatefulBackend.
+func (ib *InternalFilterBackend) RestoreState(state []byte) error {
+	return gostatsd.RestoreBackendState(ib.backend, state)
+}
+
+// ValidateMetricName validates name with the wrapped backend.
+func (ib *InternalFilterBackend) ValidateMetricName(name string) error {
+	return gostatsd.ValidateMetricName(ib.backend, name)
+}
+
+// WriteReport writes the report of the wrapped backend, if it is a gostatsd.ReportingBackend.
+func (ib *InternalFilterBackend) WriteReport(w io.Writer) error {
+	return gostatsd.BackendReport(ib.backend, w)
+}
+
+// Run runs the wrapped backend, if it is a gostatsd.RunnableBackend.
+func (ib *InternalFilterBackend) Run(ctx context.Context) {
+	if rb, ok := ib.backend.(gostatsd.RunnableBackend); ok {
+		rb.Run(ctx)
+	}
+}
+
+// RunMetrics runs the metrics of the wrapped backend, if it has any.
+func (ib *InternalFilterBackend) RunMetrics(ctx context.Context, statser statser.Statser) {
+	if me, ok := ib.backend.(metricEmitter); ok {
+		me.RunMetrics(ctx, statser)
+	}
+}
+
+// Status returns the status of the wrapped backend.
+func (ib *InternalFilterBackend) Status() string {
+	return gostatsd.BackendStatus(ib.backend)
+}
+
+// WantsRawTimers returns true if the wrapped backend wants the raw timer samples.
+func (ib *InternalFilterBackend) WantsRawTimers() bool {
+	return gostatsd.WantsRawTimers(ib.backend)
+}
+
+// WantsBackfill returns true if the wrapped backend wants the metrics which arrived late for a past interval.
+func (ib *InternalFilterBackend) WantsBackfill() bool {
+	return gostatsd.WantsBackfill(ib.backend)
+}
+
+// TransferStats returns the lifetime totals of the data the wrapped backend has sent, if it measures them.
+func (ib *InternalFilterBackend) TransferStats() (gostatsd.TransferStats, bool) {
+	return gostatsd.BackendTransferStats(ib.backend)
+}
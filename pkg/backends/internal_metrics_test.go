@@ -0,0 +1,70 @@
+package backends
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapInternalMetrics(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(`
+[graphite]
+address='ops:2003'
+
+[datadog]
+internal-metrics=false
+`)))
+	ops := &stubBackend{name: "graphite"}
+	product := &stubBackend{name: "datadog"}
+
+	// Backends without the option receive the internal metrics.
+	opsBackend, err := WrapInternalMetrics("graphite", ops, v, "stats.statsd")
+	require.NoError(t, err)
+	assert.True(t, opsBackend == ops)
+	productBackend, err := WrapInternalMetrics("datadog", product, v, "stats.statsd")
+	require.NoError(t, err)
+	assert.Equal(t, "datadog", productBackend.Name())
+
+	m := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{
+			"stats.requests":              {"": gostatsd.NewCounter(0, 10, "", nil)},
+			"stats.statsd.bad_lines_seen": {"": gostatsd.NewCounter(0, 1, "", nil)},
+		},
+		Gauges: gostatsd.Gauges{
+			"stats.statsd.flusher.total_time": {"": gostatsd.NewGauge(0, 2, "", nil)},
+			"stats.statsdx":                   {"": gostatsd.NewGauge(0, 3, "", nil)},
+		},
+		Sequence: 7,
+	}
+	assert.Empty(t, sendAndWait(opsBackend, m))
+	assert.Empty(t, sendAndWait(productBackend, m))
+
+	require.Len(t, ops.sentMetrics(), 1)
+	assert.True(t, ops.sentMetrics()[0] == m)
+	require.Len(t, product.sentMetrics(), 1)
+	sent := product.sentMetrics()[0]
+	assert.Equal(t, []string{"stats.requests"}, metricNames(sent.Counters))
+	assert.Contains(t, sent.Gauges, "stats.statsdx")
+	assert.NotContains(t, sent.Gauges, "stats.statsd.flusher.total_time")
+	assert.EqualValues(t, 7, sent.Sequence)
+
+	// Without an internal namespace, internal metrics can't be told apart.
+	_, err = WrapInternalMetrics("datadog", product, v, "")
+	assert.Error(t, err)
+}
+
+func metricNames(c gostatsd.Counters) []string {
+	var names []string
+	for name := range c {
+		names = append(names, name)
+	}
+	return names
+}
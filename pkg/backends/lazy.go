@@ -0,0 +1,195 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/cenkalti/backoff"
+)
+
+const (
+	// BackendInitStrict uses backends as soon as they are created.  Any failure creating a backend fails startup.
+	BackendInitStrict = "strict"
+	// BackendInitLazy connects backends in the background after they are created, retrying with backoff until they
+	// connect, and only sends to them once connected.
+	BackendInitLazy = "lazy"
+	// DefaultBackendInit is the default backend initialization mode.
+	DefaultBackendInit = BackendInitStrict
+)
+
+// ErrBackendInitializing is returned when sending to a backend which has not connected yet.
+var ErrBackendInitializing = errors.New("backend is initializing")
+
+// WrapBackend returns the backend to use for b in the given init mode.  In lazy mode, a gostatsd.ConnectingBackend
+// is wrapped in a LazyBackend, otherwise b is returned unchanged.
+func WrapBackend(b gostatsd.Backend, mode string) (gostatsd.Backend, error) {
+	switch mode {
+	case BackendInitStrict:
+		return b, nil
+	case BackendInitLazy:
+		if cb, ok := b.(gostatsd.ConnectingBackend); ok {
+			return NewLazyBackend(cb), nil
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown backend init mode %q", mode)
+	}
+}
+
+// LazyBackend wraps a gostatsd.ConnectingBackend, connecting it in the background when it is run.  Until it has
+// connected, metrics and events sent to it fail with ErrBackendInitializing.
+type LazyBackend struct {
+	ready int32 // Non-zero once connected, must be read/written only using atomic instructions.
+
+	backend         gostatsd.ConnectingBackend
+	initialInterval time.Duration // Initial interval between connection attempts
+
+	mu      sync.Mutex
+	lastErr error // The last error connecting
+}
+
+// NewLazyBackend creates a LazyBackend which connects backend when it is run.
+func NewLazyBackend(backend gostatsd.ConnectingBackend) *LazyBackend {
+	return &LazyBackend{
+		backend:         backend,
+		initialInterval: backoff.DefaultInitialInterval,
+	}
+}
+
+// Run connects the backend, retrying with backoff until it succeeds, then runs the backend if it is a
+// gostatsd.RunnableBackend.
+func (lb *LazyBackend) Run(ctx context.Context) {
+	if !lb.connect(ctx) {
+		return
+	}
+	if rb, ok := lb.backend.(gostatsd.RunnableBackend); ok {
+		rb.Run(ctx)
+	}
+}
+
+// connect connects the backend, returning false if the context is done first.
+func (lb *LazyBackend) connect(ctx context.Context) bool {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = lb.initialInterval
+	b.Reset()
+	b.MaxInterval = time.Minute
+	b.MaxElapsedTime = 0 // Retry forever
+	for {
+		err := lb.backend.Connect(ctx)
+		if err == nil {
+			atomic.StoreInt32(&lb.ready, 1)
+			logging.Backend(lb.backend.Name()).Info("Connected backend")
+			return true
+		}
+		lb.mu.Lock()
+		lb.lastErr = err
+		lb.mu.Unlock()
+
+		next := b.NextBackOff()
+		logging.Backend(lb.backend.Name()).WithError(err).WithField(logging.FieldDuration, next).Warn("Failed to connect backend, retrying")
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// Ready returns true once the backend has connected.
+func (lb *LazyBackend) Ready() bool {
+	return atomic.LoadInt32(&lb.ready) != 0
+}
+
+// WriteReport writes the report of the wrapped backend, if it is a gostatsd.ReportingBackend, whether or not it has
+// connected.
+func (lb *LazyBackend) WriteReport(w io.Writer) error {
+	return gostatsd.BackendReport(lb.backend, w)
+}
+
+// Status returns "ready" once the backend has connected, otherwise "initializing" and the last error connecting.
+func (lb *LazyBackend) Status() string {
+	if lb.Ready() {
+		return "ready"
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.lastErr != nil {
+		return fmt.Sprintf("initializing (%v)", lb.lastErr)
+	}
+	return "initializing"
+}
+
+// Name returns the name of the wrapped backend.
+func (lb *LazyBackend) Name() string {
+	return lb.backend.Name()
+}
+
+// SaveState returns the state of the wrapped backend, if it is a gostatsd.StatefulBackend.
+func (lb *LazyBackend) SaveState() ([]byte, error) {
+	return gostatsd.SaveBackendState(lb.backend)
+}
+
+// RestoreState restores the state of the wrapped backend, if it is a gostatsd.StatefulBackend.
+func (lb *LazyBackend) RestoreState(state []byte) error {
+	return gostatsd.RestoreBackendState(lb.backend, state)
+}
+
+// ValidateMetricName validates name with the wrapped backend, whether or not it has connected.
+func (lb *LazyBackend) ValidateMetricName(name string) error {
+	return gostatsd.ValidateMetricName(lb.backend, name)
+}
+
+// SendMetricsAsync sends the metrics to the backend if it has connected.
+func (lb *LazyBackend) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	if !lb.Ready() {
+		cb([]error{fmt.Errorf("[%s] %v", lb.backend.Name(), ErrBackendInitializing)})
+		return
+	}
+	lb.backend.SendMetricsAsync(ctx, metrics, cb)
+}
+
+// SendEvent sends the event to the backend if it has connected.
+func (lb *LazyBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	if !lb.Ready() {
+		return fmt.Errorf("[%s] %v", lb.backend.Name(), ErrBackendInitializing)
+	}
+	return lb.backend.SendEvent(ctx, e)
+}
+
+// RunMetrics runs the metrics of the wrapped backend, if it has any.
+func (lb *LazyBackend) RunMetrics(ctx context.Context, statser statser.Statser) {
+	if me, ok := lb.backend.(metricEmitter); ok {
+		me.RunMetrics(ctx, statser)
+	}
+}
+
+// metricEmitter is implemented by backends which emit internal metrics.
+type metricEmitter interface {
+	RunMetrics(ctx context.Context, statser statser.Statser)
+}
+
+// WantsRawTimers returns true if the wrapped backend wants the raw timer samples.
+func (lb *LazyBackend) WantsRawTimers() bool {
+	return gostatsd.WantsRawTimers(lb.backend)
+}
+
+// WantsBackfill returns true if the wrapped backend wants the metrics which arrived late for a past interval.
+func (lb *LazyBackend) WantsBackfill() bool {
+	return gostatsd.WantsBackfill(lb.backend)
+}
+
+// TransferStats returns the lifetime totals of the data the wrapped backend has sent, if it measures them.
+func (lb *LazyBackend) TransferStats() (gostatsd.TransferStats, bool) {
+	return gostatsd.BackendTransferStats(lb.backend)
+}
@@ -0,0 +1,161 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/null"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyBackend fails to connect a number of times before succeeding.
+type flakyBackend struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	ran      bool
+	sent     int
+}
+
+func (fb *flakyBackend) Name() string { return "flaky" }
+
+func (fb *flakyBackend) Connect(ctx context.Context) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.attempts++
+	if fb.attempts <= fb.failures {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (fb *flakyBackend) Run(ctx context.Context) {
+	fb.mu.Lock()
+	fb.ran = true
+	fb.mu.Unlock()
+	<-ctx.Done()
+}
+
+func (fb *flakyBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	fb.mu.Lock()
+	fb.sent++
+	fb.mu.Unlock()
+	cb(nil)
+}
+
+func (fb *flakyBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func (fb *flakyBackend) WantsRawTimers() bool { return true }
+
+func sendErrors(b gostatsd.Backend) []error {
+	var errs []error
+	b.SendMetricsAsync(context.Background(), &gostatsd.MetricMap{}, func(e []error) {
+		errs = e
+	})
+	return errs
+}
+
+func TestLazyBackendRetriesUntilConnected(t *testing.T) {
+	t.Parallel()
+	fb := &flakyBackend{failures: 2}
+	lb := NewLazyBackend(fb)
+	lb.initialInterval = time.Millisecond
+
+	assert.Equal(t, "initializing", lb.Status())
+	errs := sendErrors(lb)
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), ErrBackendInitializing.Error())
+	assert.Error(t, lb.SendEvent(context.Background(), &gostatsd.Event{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !lb.Ready() {
+		require.True(t, time.Now().Before(deadline), "timeout")
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, "ready", lb.Status())
+	assert.Empty(t, sendErrors(lb))
+	assert.NoError(t, lb.SendEvent(context.Background(), &gostatsd.Event{}))
+	for {
+		fb.mu.Lock()
+		ran := fb.ran
+		fb.mu.Unlock()
+		if ran {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "timeout")
+		time.Sleep(time.Millisecond)
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	assert.Equal(t, 3, fb.attempts)
+	assert.Equal(t, 1, fb.sent)
+}
+
+func TestLazyBackendStatusShowsError(t *testing.T) {
+	t.Parallel()
+	fb := &flakyBackend{failures: 1000}
+	lb := NewLazyBackend(fb)
+	lb.initialInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.Run(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for lb.Status() == "initializing" {
+		require.True(t, time.Now().Before(deadline), "timeout")
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, "initializing (connection refused)", lb.Status())
+	assert.Equal(t, "initializing (connection refused)", gostatsd.BackendStatus(lb))
+
+	// Run returns when cancelled while waiting to retry, without running the backend
+	cancel()
+	<-done
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	assert.False(t, fb.ran)
+}
+
+func TestLazyBackendForwardsRawTimers(t *testing.T) {
+	t.Parallel()
+	assert.True(t, gostatsd.WantsRawTimers(NewLazyBackend(&flakyBackend{})))
+}
+
+func TestWrapBackend(t *testing.T) {
+	t.Parallel()
+	fb := &flakyBackend{}
+	b, err := WrapBackend(fb, BackendInitStrict)
+	require.NoError(t, err)
+	assert.True(t, b == gostatsd.Backend(fb))
+
+	b, err = WrapBackend(fb, BackendInitLazy)
+	require.NoError(t, err)
+	assert.IsType(t, &LazyBackend{}, b)
+
+	// Backends which don't connect are never wrapped
+	nb, err := null.NewClient()
+	require.NoError(t, err)
+	b, err = WrapBackend(nb, BackendInitLazy)
+	require.NoError(t, err)
+	assert.True(t, b == gostatsd.Backend(nb))
+	assert.Equal(t, "ready", gostatsd.BackendStatus(b))
+
+	_, err = WrapBackend(fb, "eager")
+	assert.Error(t, err)
+}
@@ -15,7 +15,9 @@ import (
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
 	stats "github.com/atlassian/gostatsd/pkg/statser"
+	"github.com/atlassian/gostatsd/pkg/util"
 
 	"github.com/cenkalti/backoff"
 	log "github.com/sirupsen/logrus"
@@ -39,6 +41,9 @@ const (
 	defaultEnableHttp2 = false
 )
 
+// logger logs through a child of the standard logger for this backend.
+var logger = logging.Backend(BackendName)
+
 var (
 	// defaultMaxRequests is the number of parallel outgoing requests to New Relic.  As this mixes both
 	// CPU (JSON encoding, TLS) and network bound operations, balancing may require some experimentation.
@@ -69,6 +74,7 @@ type Client struct {
 	batchesRetried uint64 // Accumulated number of batches retried (first send is not a retry)
 	batchesDropped uint64 // Accumulated number of batches aborted (data loss)
 	batchesSent    uint64 // Accumulated number of batches successfully sent
+	transfer       gostatsd.TransferCounter
 
 	userAgent             string
 	maxRequestElapsedTime time.Duration
@@ -164,22 +170,22 @@ func (n *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*timeSeries
 		cb:               cb,
 	}
 
-	metrics.Gauges.Each(func(key, tagsKey string, g gostatsd.Gauge) {
+	metrics.EachGauge(func(key, tagsKey string, g gostatsd.Gauge) {
 		fl.addMetric(n, "gauge", g.Value, 0, g.Hostname, g.Tags, key, g.Timestamp)
 		fl.maybeFlush()
 	})
 
-	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+	metrics.EachCounter(func(key, tagsKey string, counter gostatsd.Counter) {
 		fl.addMetric(n, "counter", float64(counter.Value), counter.PerSecond, counter.Hostname, counter.Tags, key, counter.Timestamp)
 		fl.maybeFlush()
 	})
 
-	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
-		fl.addMetric(n, "set", float64(len(set.Values)), 0, set.Hostname, set.Tags, key, set.Timestamp)
+	metrics.EachSet(func(key, tagsKey string, set gostatsd.Set) {
+		fl.addMetric(n, "set", float64(set.Cardinality()), 0, set.Hostname, set.Tags, key, set.Timestamp)
 		fl.maybeFlush()
 	})
 
-	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+	metrics.EachTimer(func(key, tagsKey string, timer gostatsd.Timer) {
 		fl.addTimerMetric(n, "timer", timer, tagsKey, key)
 		fl.maybeFlush()
 	})
@@ -197,6 +203,16 @@ func (n *Client) Name() string {
 	return BackendName
 }
 
+// TransferStats returns the bytes of JSON posted to New Relic, which has no compression, and the time taken.
+func (n *Client) TransferStats() (gostatsd.TransferStats, bool) {
+	return n.transfer.Stats(), true
+}
+
+// WantsBackfill returns true, as each metric is sent with its own timestamp.
+func (n *Client) WantsBackfill() bool {
+	return true
+}
+
 func (n *Client) post(ctx context.Context, buffer *bytes.Buffer, data interface{}) error {
 	post, err := n.constructPost(ctx, buffer, data)
 	if err != nil {
@@ -218,7 +234,7 @@ func (n *Client) post(ctx context.Context, buffer *bytes.Buffer, data interface{
 			return fmt.Errorf("[%s] %v", BackendName, err)
 		}
 
-		log.Warnf("[%s] failed to send, sleeping for %s: %v", BackendName, next, err)
+		logger.WithError(err).WithField(logging.FieldDuration, next).Warn("Failed to send, retrying")
 
 		timer := time.NewTimer(next)
 		select {
@@ -234,6 +250,7 @@ func (n *Client) post(ctx context.Context, buffer *bytes.Buffer, data interface{
 
 func (n *Client) constructPost(ctx context.Context, buffer *bytes.Buffer, data interface{}) (func() error /*doPost*/, error) {
 
+	start := time.Now()
 	NRPayload := newInfraPayload()
 	NRPayload.Data = append(NRPayload.Data, data)
 	mJSON, err := json.Marshal(NRPayload)
@@ -241,6 +258,7 @@ func (n *Client) constructPost(ctx context.Context, buffer *bytes.Buffer, data i
 	if err != nil {
 		return nil, fmt.Errorf("[%s] unable to marshal: %v", BackendName, err)
 	}
+	n.transfer.Serialized(len(mJSON), time.Since(start))
 
 	return func() error {
 		headers := map[string]string{
@@ -255,18 +273,24 @@ func (n *Client) constructPost(ctx context.Context, buffer *bytes.Buffer, data i
 		for header, v := range headers {
 			req.Header.Set(header, v)
 		}
+		// Every attempt is counted, as a retry sends the payload again.
+		start := time.Now()
 		resp, err := n.client.Do(req)
 		if err != nil {
+			n.transfer.Sent(len(mJSON), time.Since(start))
 			return fmt.Errorf("error POSTing: %s", err.Error())
 		}
+		defer func() {
+			n.transfer.Sent(len(mJSON), time.Since(start))
+		}()
 		defer resp.Body.Close()
 		body := io.LimitReader(resp.Body, maxResponseSize)
 		if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
 			b, _ := ioutil.ReadAll(body)
-			log.WithFields(log.Fields{
+			logger.WithFields(log.Fields{
 				"status": resp.StatusCode,
-				"body":   b,
-			}).Infof("[%s] failed request", BackendName)
+				"body":   string(b),
+			}).Info("Failed request")
 			return fmt.Errorf("received bad status code %d", resp.StatusCode)
 		}
 		_, _ = io.Copy(ioutil.Discard, body)
@@ -328,7 +352,7 @@ func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 		nr.GetDuration("client-timeout"),
 		nr.GetDuration("max-request-elapsed-time"),
 		v.GetDuration("flush-interval"), // Main viper, not sub-viper
-		gostatsd.DisabledSubMetrics(v),
+		util.DisabledSubMetrics(v),
 	)
 }
 
@@ -349,7 +373,12 @@ func NewClient(address, eventType, flushType, tagPrefix,
 		return nil, fmt.Errorf("[%s] maxRequestElapsedTime must be positive", BackendName)
 	}
 
-	log.Infof("[%s] maxRequestElapsedTime=%s maxRequests=%d clientTimeout=%s metricsPerBatch=%d", BackendName, maxRequestElapsedTime, maxRequests, clientTimeout, metricsPerBatch)
+	logger.WithFields(log.Fields{
+		"max_request_elapsed_time": maxRequestElapsedTime,
+		"max_requests":             maxRequests,
+		"client_timeout":           clientTimeout,
+		"metrics_per_batch":        metricsPerBatch,
+	}).Info("Configured backend")
 
 	dialer := &net.Dialer{
 		Timeout:   5 * time.Second,
@@ -0,0 +1,127 @@
+// Package oauth fetches and caches the OAuth2 access tokens of the backends which send to cloud APIs.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ExpiryMargin is how long before the reported expiry a token is refreshed.
+	ExpiryMargin = 1 * time.Minute
+	// maxResponseSize is the maximum size of a token response we are willing to read.
+	maxResponseSize = 10 * 1024
+)
+
+// TokenSource provides OAuth2 access tokens.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// Seconds is a number of seconds, which some token endpoints, such as Azure AD, encode as a string rather than a
+// JSON number.
+type Seconds int64
+
+func (s *Seconds) UnmarshalJSON(data []byte) error {
+	str := strings.Trim(string(data), `"`)
+	if str == "" {
+		*s = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number of seconds %s", data)
+	}
+	*s = Seconds(v)
+	return nil
+}
+
+// TokenResponse is the response of a token endpoint.
+type TokenResponse struct {
+	AccessToken string  `json:"access_token"`
+	ExpiresIn   Seconds `json:"expires_in"`
+}
+
+// FetchFunc fetches a new access token.
+type FetchFunc func(ctx context.Context, client *http.Client) (*TokenResponse, error)
+
+// CachingTokenSource is a TokenSource which caches a token until shortly before it expires.
+type CachingTokenSource struct {
+	client *http.Client
+	fetch  FetchFunc
+	now    func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewCachingTokenSource returns a CachingTokenSource which fetches tokens with fetch, using client.
+func NewCachingTokenSource(client *http.Client, fetch FetchFunc) *CachingTokenSource {
+	return &CachingTokenSource{
+		client: client,
+		fetch:  fetch,
+		now:    time.Now,
+	}
+}
+
+// Token returns the cached token, fetching a new one if it is about to expire.
+func (ts *CachingTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	now := ts.now()
+	if ts.token != "" && now.Before(ts.expiry) {
+		return ts.token, nil
+	}
+	resp, err := ts.fetch(ctx, ts.client)
+	if err != nil {
+		return "", err
+	}
+	if resp.AccessToken == "" {
+		return "", errors.New("no access token in response")
+	}
+	ts.token = resp.AccessToken
+	ts.expiry = now.Add(time.Duration(resp.ExpiresIn)*time.Second - ExpiryMargin)
+	return ts.token, nil
+}
+
+// PostForm posts form to the token endpoint at tokenURL, and returns the token in its response.
+func PostForm(ctx context.Context, client *http.Client, tokenURL string, form url.Values) (*TokenResponse, error) {
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return Do(client, req.WithContext(ctx))
+}
+
+// Do sends req to a token endpoint, and returns the token in its response.
+func Do(client *http.Client, req *http.Request) (*TokenResponse, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch token, status code %d: %s", resp.StatusCode, body)
+	}
+	var tr TokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return nil, fmt.Errorf("unable to parse token response: %v", err)
+	}
+	return &tr, nil
+}
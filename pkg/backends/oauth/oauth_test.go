@@ -0,0 +1,78 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingTokenSource(t *testing.T) {
+	t.Parallel()
+	fetches := 0
+	ts := NewCachingTokenSource(http.DefaultClient, func(ctx context.Context, client *http.Client) (*TokenResponse, error) {
+		fetches++
+		if fetches == 3 {
+			return &TokenResponse{}, nil
+		}
+		return &TokenResponse{AccessToken: "token" + strconv.Itoa(fetches), ExpiresIn: 3600}, nil
+	})
+	now := time.Unix(1000, 0)
+	ts.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		token, err := ts.Token(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "token1", token)
+	}
+
+	// The token is refreshed ExpiryMargin before it expires.
+	now = now.Add(time.Hour - ExpiryMargin)
+	token, err := ts.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token2", token)
+
+	now = now.Add(time.Hour)
+	_, err = ts.Token(context.Background())
+	assert.EqualError(t, err, "no access token in response")
+	assert.Equal(t, 3, fetches)
+}
+
+func TestSecondsUnmarshal(t *testing.T) {
+	t.Parallel()
+	var tr TokenResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"access_token":"a","expires_in":"3599"}`), &tr))
+	assert.EqualValues(t, 3599, tr.ExpiresIn)
+	require.NoError(t, json.Unmarshal([]byte(`{"access_token":"a","expires_in":60}`), &tr))
+	assert.EqualValues(t, 60, tr.ExpiresIn)
+	assert.Error(t, json.Unmarshal([]byte(`{"expires_in":"soon"}`), &tr))
+}
+
+func TestPostForm(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !assert.NoError(t, r.ParseForm()) {
+			return
+		}
+		if r.PostForm.Get("grant_type") != "client_credentials" {
+			http.Error(w, "bad grant", http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"token","expires_in":3599}`))
+	}))
+	defer srv.Close()
+
+	tr, err := PostForm(context.Background(), http.DefaultClient, srv.URL, url.Values{"grant_type": {"client_credentials"}})
+	require.NoError(t, err)
+	assert.Equal(t, &TokenResponse{AccessToken: "token", ExpiresIn: 3599}, tr)
+
+	_, err = PostForm(context.Background(), http.DefaultClient, srv.URL, url.Values{"grant_type": {"password"}})
+	assert.EqualError(t, err, "unable to fetch token, status code 400: bad grant\n")
+}
@@ -0,0 +1,192 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	"github.com/atlassian/gostatsd/pkg/statser"
+)
+
+// DefaultBackendQueueSize is the default number of flushes queued for each backend, 0 to send flushes synchronously.
+const DefaultBackendQueueSize = 0
+
+// QueuedBackend sends flushes to a backend in the background, so a backend which falls behind doesn't delay the flush
+// to the others.  Each flush is copied into a queue and the callback is called as soon as it is queued.  When the
+// queue is full the oldest queued flush is dropped to make room.
+type QueuedBackend struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	dropped uint64 // Flushes dropped because the queue was full
+	failed  uint64 // Flushes the backend failed to send
+
+	name    string // Name of the backend as configured
+	backend gostatsd.Backend
+	queue   chan *gostatsd.MetricMap
+}
+
+// NewQueuedBackend creates a QueuedBackend which queues up to size flushes for backend.  name is the configured name
+// of the backend, used in internal metrics and logs.
+func NewQueuedBackend(name string, backend gostatsd.Backend, size int) *QueuedBackend {
+	return &QueuedBackend{
+		name:    name,
+		backend: backend,
+		queue:   make(chan *gostatsd.MetricMap, size),
+	}
+}
+
+// Run sends the queued flushes to the backend one at a time, and runs the backend if it is a
+// gostatsd.RunnableBackend.  Flushes still queued when ctx is done are discarded.
+func (qb *QueuedBackend) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	if rb, ok := qb.backend.(gostatsd.RunnableBackend); ok {
+		wg.Add(1)
+		gostatsd.Go(ctx, "backend_"+qb.name, func() {
+			defer wg.Done()
+			rb.Run(ctx)
+		})
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case metrics := <-qb.queue:
+			qb.send(ctx, metrics)
+		}
+	}
+}
+
+// send sends metrics to the backend, waiting until it is done.
+func (qb *QueuedBackend) send(ctx context.Context, metrics *gostatsd.MetricMap) {
+	done := make(chan struct{})
+	qb.backend.SendMetricsAsync(ctx, metrics, func(errs []error) {
+		defer close(done)
+		if !hasError(errs) {
+			return
+		}
+		atomic.AddUint64(&qb.failed, 1)
+		for _, err := range errs {
+			if err != nil && err != context.DeadlineExceeded && err != context.Canceled {
+				logging.Backend(qb.name).WithError(err).WithField(logging.FieldInterval, metrics.Sequence).Error("Sending queued interval failed")
+			}
+		}
+	})
+	<-done
+}
+
+// SendMetricsAsync queues a copy of the metrics, dropping the oldest queued flush if the queue is full, and calls
+// the callback with no errors.  Errors sending to the backend are logged, and counted in backend.queue_failed.
+func (qb *QueuedBackend) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	// The metrics are sent after the flush is done, by which time they may have been reset for the next interval.
+	queued := metrics.Copy()
+	for {
+		select {
+		case qb.queue <- queued:
+			cb(nil)
+			return
+		default:
+		}
+		select {
+		case dropped := <-qb.queue:
+			atomic.AddUint64(&qb.dropped, 1)
+			logging.Backend(qb.name).WithField(logging.FieldInterval, dropped.Sequence).Warn("Backend is falling behind, dropped the oldest queued flush")
+		default:
+		}
+	}
+}
+
+// SendEvent sends the event to the backend.  Events are not queued.
+func (qb *QueuedBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return qb.backend.SendEvent(ctx, e)
+}
+
+// Name returns the name of the wrapped backend.
+func (qb *QueuedBackend) Name() string {
+	return qb.backend.Name()
+}
+
+// QueueDepth returns the number of flushes waiting to be sent.
+func (qb *QueuedBackend) QueueDepth() int {
+	return len(qb.queue)
+}
+
+// Status returns the status of the wrapped backend, followed by the depth of the queue and the number of flushes
+// dropped.
+func (qb *QueuedBackend) Status() string {
+	return fmt.Sprintf("%s, %d of %d flushes queued, %d dropped", gostatsd.BackendStatus(qb.backend), qb.QueueDepth(), cap(qb.queue), atomic.LoadUint64(&qb.dropped))
+}
+
+// WriteReport writes the report of the wrapped backend, if it is a gostatsd.ReportingBackend.
+func (qb *QueuedBackend) WriteReport(w io.Writer) error {
+	return gostatsd.BackendReport(qb.backend, w)
+}
+
+// RunMetrics emits the depth of the queue and the number of flushes dropped and failed at each flush, and runs the
+// metrics of the wrapped backend, if it has any.
+func (qb *QueuedBackend) RunMetrics(ctx context.Context, statser statser.Statser) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	if me, ok := qb.backend.(metricEmitter); ok {
+		wg.Add(1)
+		gostatsd.Go(ctx, "backend_"+qb.name, func() {
+			defer wg.Done()
+			me.RunMetrics(ctx, statser)
+		})
+	}
+
+	statser = statser.WithTags(gostatsd.Tags{"backend:" + qb.name})
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			qb.emit(statser)
+		}
+	}
+}
+
+// emit sends the depth of the queue, and the number of flushes dropped and failed since startup.
+func (qb *QueuedBackend) emit(statser statser.Statser) {
+	statser.Gauge("backend.queue_depth", float64(qb.QueueDepth()), nil)
+	statser.Gauge("backend.queue_dropped", float64(atomic.LoadUint64(&qb.dropped)), nil)
+	statser.Gauge("backend.queue_failed", float64(atomic.LoadUint64(&qb.failed)), nil)
+}
+
+// SaveState returns the state of the wrapped backend, if it is a gostatsd.StatefulBackend.
+func (qb *QueuedBackend) SaveState() ([]byte, error) {
+	return gostatsd.SaveBackendState(qb.backend)
+}
+
+// RestoreState restores the state of the wrapped backend, if it is a gostatsd.StatefulBackend.
+func (qb *QueuedBackend) RestoreState(state []byte) error {
+	return gostatsd.RestoreBackendState(qb.backend, state)
+}
+
+// ValidateMetricName validates name with the wrapped backend.
+func (qb *QueuedBackend) ValidateMetricName(name string) error {
+	return gostatsd.ValidateMetricName(qb.backend, name)
+}
+
+// WantsRawTimers returns true if the wrapped backend wants the raw timer samples.
+func (qb *QueuedBackend) WantsRawTimers() bool {
+	return gostatsd.WantsRawTimers(qb.backend)
+}
+
+// WantsBackfill returns true if the wrapped backend wants the metrics which arrived late for a past interval.
+func (qb *QueuedBackend) WantsBackfill() bool {
+	return gostatsd.WantsBackfill(qb.backend)
+}
+
+// TransferStats returns the lifetime totals of the data the wrapped backend has sent, if it measures them.
+func (qb *QueuedBackend) TransferStats() (gostatsd.TransferStats, bool) {
+	return gostatsd.BackendTransferStats(qb.backend)
+}
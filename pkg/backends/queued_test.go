@@ -0,0 +1,125 @@
+package backends
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingBackend blocks sending each flush until it is released.
+type blockingBackend struct {
+	sending chan *gostatsd.MetricMap
+	release chan struct{}
+}
+
+func (bb *blockingBackend) Name() string { return "blocking" }
+
+func (bb *blockingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	bb.sending <- m
+	<-bb.release
+	cb(nil)
+}
+
+func (bb *blockingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// queueStatser keeps the last value of each gauge by name.
+type queueStatser struct {
+	statser.Statser
+	mu     sync.Mutex
+	gauges map[string]float64
+}
+
+func (qs *queueStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	qs.mu.Lock()
+	qs.gauges[name] = value
+	qs.mu.Unlock()
+}
+
+func gaugeMetrics(value float64) *gostatsd.MetricMap {
+	return &gostatsd.MetricMap{Gauges: gostatsd.Gauges{"g": {"": {Value: value}}}}
+}
+
+func sendMetrics(b gostatsd.Backend, m *gostatsd.MetricMap) []error {
+	var errs []error
+	b.SendMetricsAsync(context.Background(), m, func(e []error) {
+		errs = e
+	})
+	return errs
+}
+
+func TestQueuedBackendFillsQueue(t *testing.T) {
+	t.Parallel()
+	bb := &blockingBackend{sending: make(chan *gostatsd.MetricMap), release: make(chan struct{})}
+	qb := NewQueuedBackend("blocking", bb, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go qb.Run(ctx)
+
+	// The first flush is taken off the queue and blocks in the backend, the next two fill the queue, and the last
+	// two each drop the oldest queued flush.
+	for i := 1; i <= 5; i++ {
+		require.Empty(t, sendMetrics(qb, gaugeMetrics(float64(i))))
+		if i == 1 {
+			select {
+			case m := <-bb.sending:
+				assert.EqualValues(t, 1, m.Gauges["g"][""].Value)
+			case <-time.After(time.Second):
+				t.Fatal("flush was not sent")
+			}
+		}
+	}
+
+	st := &queueStatser{Statser: statser.NewNullStatser(), gauges: map[string]float64{}}
+	qb.emit(st)
+	assert.Equal(t, map[string]float64{
+		"backend.queue_depth":   2,
+		"backend.queue_dropped": 2,
+		"backend.queue_failed":  0,
+	}, st.gauges)
+	assert.Equal(t, "ready, 2 of 2 flushes queued, 2 dropped", qb.Status())
+
+	// The newest flushes are kept, and sent in order.
+	for _, expected := range []float64{4, 5} {
+		bb.release <- struct{}{}
+		select {
+		case m := <-bb.sending:
+			assert.EqualValues(t, expected, m.Gauges["g"][""].Value)
+		case <-time.After(time.Second):
+			t.Fatal("flush was not sent")
+		}
+	}
+	assert.Zero(t, qb.QueueDepth())
+	bb.release <- struct{}{}
+}
+
+func TestQueuedBackendCopiesMetrics(t *testing.T) {
+	t.Parallel()
+	bb := &blockingBackend{sending: make(chan *gostatsd.MetricMap, 1), release: make(chan struct{}, 1)}
+	qb := NewQueuedBackend("blocking", bb, 1)
+
+	metrics := gaugeMetrics(1)
+	require.Empty(t, sendMetrics(qb, metrics))
+	// The aggregator may change the metrics once the flush is done.
+	metrics.Gauges["g"][""] = gostatsd.Gauge{Value: 2}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go qb.Run(ctx)
+	bb.release <- struct{}{}
+	select {
+	case m := <-bb.sending:
+		assert.EqualValues(t, 1, m.Gauges["g"][""].Value)
+	case <-time.After(time.Second):
+		t.Fatal("flush was not sent")
+	}
+}
@@ -0,0 +1,220 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	"github.com/atlassian/gostatsd/pkg/util"
+
+	goredis "github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName = "redis"
+	// DefaultAddress is the default address of the Redis server.
+	DefaultAddress = "localhost:6379"
+	// DefaultKeyPrefix is the default prefix of all keys written.
+	DefaultKeyPrefix = "gostatsd:"
+	// DefaultTTL is the default time after which a key that is no longer written expires.
+	DefaultTTL = 5 * time.Minute
+	// DefaultDialTimeout is the default timeout to connect to the Redis server.
+	DefaultDialTimeout = 5 * time.Second
+	// DefaultWriteTimeout is the default socket write and read timeout.
+	DefaultWriteTimeout = 30 * time.Second
+)
+
+// logger logs through a child of the standard logger for this backend.
+var logger = logging.Backend(BackendName)
+
+// Client writes the current value of each metric to Redis.  Each metric is stored in a hash named
+// <prefix><type>:<name>, with a field for each tag set holding the value from the latest flush.
+type Client struct {
+	client    *goredis.Client
+	keyPrefix string
+	ttl       time.Duration
+
+	disabledSubtypes gostatsd.TimerSubtypes
+}
+
+// NewClientFromViper constructs a Redis backend.
+func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
+	r := getSubViper(v, "redis")
+	r.SetDefault("address", DefaultAddress)
+	r.SetDefault("database", 0)
+	r.SetDefault("key_prefix", DefaultKeyPrefix)
+	r.SetDefault("ttl", DefaultTTL)
+	r.SetDefault("dial_timeout", DefaultDialTimeout)
+	r.SetDefault("write_timeout", DefaultWriteTimeout)
+
+	return NewClient(
+		r.GetString("address"),
+		r.GetString("password"),
+		r.GetInt("database"),
+		r.GetString("key_prefix"),
+		r.GetDuration("ttl"),
+		r.GetDuration("dial_timeout"),
+		r.GetDuration("write_timeout"),
+		util.DisabledSubMetrics(v),
+	)
+}
+
+// NewClient constructs a Redis backend.  A ttl of 0 means keys never expire.
+func NewClient(address, password string, database int, keyPrefix string, ttl, dialTimeout, writeTimeout time.Duration, disabled gostatsd.TimerSubtypes) (*Client, error) {
+	if address == "" {
+		return nil, fmt.Errorf("[%s] address is required", BackendName)
+	}
+	if database < 0 {
+		return nil, fmt.Errorf("[%s] database should be non-negative", BackendName)
+	}
+	if ttl < 0 {
+		return nil, fmt.Errorf("[%s] ttl should be non-negative", BackendName)
+	}
+	if dialTimeout <= 0 {
+		return nil, fmt.Errorf("[%s] dial_timeout should be positive", BackendName)
+	}
+	if writeTimeout < 0 {
+		return nil, fmt.Errorf("[%s] write_timeout should be non-negative", BackendName)
+	}
+	logger.WithFields(log.Fields{
+		logging.FieldAddress: address,
+		"database":           database,
+		"key_prefix":         keyPrefix,
+		"ttl":                ttl,
+	}).Info("Configured backend")
+	return &Client{
+		client: goredis.NewClient(&goredis.Options{
+			Addr:         address,
+			Password:     password,
+			DB:           database,
+			DialTimeout:  dialTimeout,
+			ReadTimeout:  writeTimeout,
+			WriteTimeout: writeTimeout,
+		}),
+		keyPrefix:        keyPrefix,
+		ttl:              ttl,
+		disabledSubtypes: disabled,
+	}, nil
+}
+
+// SendMetricsAsync writes the metrics to Redis in a single pipeline, preparing the values synchronously but doing
+// the write asynchronously.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	hashes := c.processMetrics(metrics)
+	if len(hashes) == 0 {
+		cb(nil)
+		return
+	}
+	go func() {
+		cb([]error{c.write(ctx, hashes)})
+	}()
+}
+
+// write sets the fields of each hash, and refreshes its TTL.
+func (c *Client) write(ctx context.Context, hashes map[string]map[string]interface{}) error {
+	pipe := c.client.WithContext(ctx).Pipeline()
+	defer pipe.Close()
+	for key, fields := range hashes {
+		pipe.HMSet(key, fields)
+		if c.ttl > 0 {
+			pipe.Expire(key, c.ttl)
+		}
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	return nil
+}
+
+// processMetrics returns the fields to set, by key.
+func (c *Client) processMetrics(metrics *gostatsd.MetricMap) map[string]map[string]interface{} {
+	hashes := map[string]map[string]interface{}{}
+	set := func(metricType, name, tagsKey, value string) {
+		key := c.keyPrefix + metricType + ":" + name
+		fields, ok := hashes[key]
+		if !ok {
+			fields = map[string]interface{}{}
+			hashes[key] = fields
+		}
+		fields[tagsKey] = value
+	}
+	setFloat := func(metricType, name, tagsKey string, value float64) {
+		set(metricType, name, tagsKey, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+
+	metrics.EachCounter(func(key, tagsKey string, counter gostatsd.Counter) {
+		set("counter", key+".count", tagsKey, strconv.FormatInt(counter.Value, 10))
+		setFloat("counter", key+".rate", tagsKey, counter.PerSecond)
+	})
+	metrics.EachTimer(func(key, tagsKey string, timer gostatsd.Timer) {
+		if !c.disabledSubtypes.Lower {
+			setFloat("timer", key+".lower", tagsKey, timer.Min)
+		}
+		if !c.disabledSubtypes.Upper {
+			setFloat("timer", key+".upper", tagsKey, timer.Max)
+		}
+		if !c.disabledSubtypes.Count {
+			set("timer", key+".count", tagsKey, strconv.Itoa(timer.Count))
+		}
+		if !c.disabledSubtypes.CountPerSecond {
+			setFloat("timer", key+".count_ps", tagsKey, timer.PerSecond)
+		}
+		if !c.disabledSubtypes.Mean {
+			setFloat("timer", key+".mean", tagsKey, timer.Mean)
+		}
+		if !c.disabledSubtypes.Median {
+			setFloat("timer", key+".median", tagsKey, timer.Median)
+		}
+		if !c.disabledSubtypes.StdDev {
+			setFloat("timer", key+".std", tagsKey, timer.StdDev)
+		}
+		if !c.disabledSubtypes.Sum {
+			setFloat("timer", key+".sum", tagsKey, timer.Sum)
+		}
+		if !c.disabledSubtypes.SumSquares {
+			setFloat("timer", key+".sum_squares", tagsKey, timer.SumSquares)
+		}
+		for _, pct := range timer.Percentiles {
+			setFloat("timer", key+"."+pct.Str, tagsKey, pct.Float)
+		}
+	})
+	metrics.EachGauge(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		setFloat("gauge", key, tagsKey, gauge.Value)
+	})
+	metrics.EachSet(func(key, tagsKey string, set gostatsd.Set) {
+		setFloat("set", key, tagsKey, float64(set.Cardinality()))
+	})
+	return hashes
+}
+
+// Connect checks the Redis server is reachable, and the credentials and database are valid.
+func (c *Client) Connect(ctx context.Context) error {
+	if err := c.client.WithContext(ctx).Ping().Err(); err != nil {
+		return fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	return nil
+}
+
+// SendEvent discards events.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+func getSubViper(v *viper.Viper, key string) *viper.Viper {
+	n := v.Sub(key)
+	if n == nil {
+		n = viper.New()
+	}
+	return n
+}
@@ -0,0 +1,255 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is a Redis server which understands just enough of the protocol to record the commands it is sent.
+type fakeRedis struct {
+	net.Listener
+	mu       sync.Mutex
+	commands [][]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	fr := &fakeRedis{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		cmd, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		fr.mu.Lock()
+		fr.commands = append(fr.commands, cmd)
+		fr.mu.Unlock()
+		reply := "+OK\r\n"
+		if strings.ToUpper(cmd[0]) == "EXPIRE" {
+			reply = ":1\r\n"
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads a command, sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	readLine := func(prefix byte) (int, error) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		if len(line) < 3 || line[0] != prefix {
+			return 0, fmt.Errorf("unexpected line %q", line)
+		}
+		return strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	}
+	n, err := readLine('*')
+	if err != nil {
+		return nil, err
+	}
+	cmd := make([]string, n)
+	for i := range cmd {
+		size, err := readLine('$')
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		cmd[i] = string(buf[:size])
+	}
+	return cmd, nil
+}
+
+// hashes returns the fields set by HMSET, and the TTLs set by EXPIRE, by key.
+func (fr *fakeRedis) hashes() (map[string]map[string]string, map[string]string) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	hashes := map[string]map[string]string{}
+	ttls := map[string]string{}
+	for _, cmd := range fr.commands {
+		switch strings.ToUpper(cmd[0]) {
+		case "HMSET":
+			fields, ok := hashes[cmd[1]]
+			if !ok {
+				fields = map[string]string{}
+				hashes[cmd[1]] = fields
+			}
+			for i := 2; i+1 < len(cmd); i += 2 {
+				fields[cmd[i]] = cmd[i+1]
+			}
+		case "EXPIRE":
+			ttls[cmd[1]] = cmd[2]
+		}
+	}
+	return hashes, ttls
+}
+
+func metricsFixture() *gostatsd.MetricMap {
+	timer := gostatsd.NewTimer(0, []float64{1, 3}, "", nil)
+	timer.Min, timer.Max, timer.Count, timer.PerSecond, timer.Mean = 1, 3, 2, 0.2, 2
+	timer.Percentiles.Set("upper_90", 3)
+	return &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{
+			"requests": map[string]gostatsd.Counter{
+				"":            {Value: 50, PerSecond: 5},
+				"status:500,": {Value: 2, PerSecond: 0.2},
+			},
+		},
+		Timers: gostatsd.Timers{
+			"latency": map[string]gostatsd.Timer{"": timer},
+		},
+		Gauges: gostatsd.Gauges{
+			"queue": map[string]gostatsd.Gauge{"s:host1": {Value: 1.5}},
+		},
+		Sets: gostatsd.Sets{
+			"users": map[string]gostatsd.Set{"": gostatsd.NewSet(0, map[string]struct{}{"a": {}, "b": {}}, "", nil)},
+		},
+	}
+}
+
+func sendMetrics(t *testing.T, c *Client, m *gostatsd.MetricMap) {
+	errCh := make(chan []error, 1)
+	c.SendMetricsAsync(context.Background(), m, func(errs []error) {
+		errCh <- errs
+	})
+	select {
+	case errs := <-errCh:
+		for _, err := range errs {
+			require.NoError(t, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestSendMetrics(t *testing.T) {
+	t.Parallel()
+	fr := newFakeRedis(t)
+	defer fr.Close()
+
+	disabled := gostatsd.TimerSubtypes{Median: true, StdDev: true, Sum: true, SumSquares: true}
+	c, err := NewClient(fr.Addr().String(), "", 0, "test:", 2*time.Minute, time.Second, time.Second, disabled)
+	require.NoError(t, err)
+	sendMetrics(t, c, metricsFixture())
+
+	hashes, ttls := fr.hashes()
+	expected := map[string]map[string]string{
+		"test:counter:requests.count": {"": "50", "status:500,": "2"},
+		"test:counter:requests.rate":  {"": "5", "status:500,": "0.2"},
+		"test:timer:latency.lower":    {"": "1"},
+		"test:timer:latency.upper":    {"": "3"},
+		"test:timer:latency.count":    {"": "2"},
+		"test:timer:latency.count_ps": {"": "0.2"},
+		"test:timer:latency.mean":     {"": "2"},
+		"test:timer:latency.upper_90": {"": "3"},
+		"test:gauge:queue":            {"s:host1": "1.5"},
+		"test:set:users":              {"": "2"},
+	}
+	assert.Equal(t, expected, hashes)
+	for key := range expected {
+		assert.Equal(t, "120", ttls[key], key)
+	}
+	assert.Len(t, ttls, len(expected))
+}
+
+func TestSendMetricsNoTTL(t *testing.T) {
+	t.Parallel()
+	fr := newFakeRedis(t)
+	defer fr.Close()
+
+	c, err := NewClient(fr.Addr().String(), "", 3, DefaultKeyPrefix, 0, time.Second, time.Second, gostatsd.TimerSubtypes{})
+	require.NoError(t, err)
+	sendMetrics(t, c, &gostatsd.MetricMap{
+		Gauges: gostatsd.Gauges{
+			"queue": map[string]gostatsd.Gauge{"": {Value: 7}},
+		},
+	})
+
+	hashes, ttls := fr.hashes()
+	assert.Equal(t, map[string]map[string]string{"gostatsd:gauge:queue": {"": "7"}}, hashes)
+	assert.Empty(t, ttls)
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	assert.Equal(t, []string{"select", "3"}, fr.commands[0])
+}
+
+func TestSendMetricsError(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	c, err := NewClient(address, "", 0, DefaultKeyPrefix, DefaultTTL, time.Second, time.Second, gostatsd.TimerSubtypes{})
+	require.NoError(t, err)
+	errCh := make(chan []error, 1)
+	c.SendMetricsAsync(context.Background(), metricsFixture(), func(errs []error) {
+		errCh <- errs
+	})
+	select {
+	case errs := <-errCh:
+		require.Len(t, errs, 1)
+		assert.Error(t, errs[0])
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestNewClientValidation(t *testing.T) {
+	t.Parallel()
+	_, err := NewClient("", "", 0, DefaultKeyPrefix, DefaultTTL, time.Second, time.Second, gostatsd.TimerSubtypes{})
+	assert.Error(t, err)
+	_, err = NewClient(DefaultAddress, "", -1, DefaultKeyPrefix, DefaultTTL, time.Second, time.Second, gostatsd.TimerSubtypes{})
+	assert.Error(t, err)
+	_, err = NewClient(DefaultAddress, "", 0, DefaultKeyPrefix, -time.Second, time.Second, time.Second, gostatsd.TimerSubtypes{})
+	assert.Error(t, err)
+}
+
+func TestConnect(t *testing.T) {
+	t.Parallel()
+	fr := newFakeRedis(t)
+	c, err := NewClient(fr.Addr().String(), "", 0, DefaultKeyPrefix, DefaultTTL, time.Second, time.Second, gostatsd.TimerSubtypes{})
+	require.NoError(t, err)
+	require.NoError(t, c.Connect(context.Background()))
+	fr.mu.Lock()
+	assert.Equal(t, []string{"ping"}, fr.commands[len(fr.commands)-1])
+	fr.mu.Unlock()
+
+	require.NoError(t, fr.Close())
+	c, err = NewClient(fr.Addr().String(), "", 0, DefaultKeyPrefix, DefaultTTL, time.Second, time.Second, gostatsd.TimerSubtypes{})
+	require.NoError(t, err)
+	assert.Error(t, c.Connect(context.Background()))
+}
@@ -0,0 +1,123 @@
+package sender
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// ErrItemTooLarge is returned by BatchWriter.Write for an item which is larger than the maximum frame size of a
+// datagram sink.
+var ErrItemTooLarge = errors.New("item is larger than the maximum frame size")
+
+// FrameFunc is invoked with each frame accumulated by a BatchWriter.  It returns the buffer to accumulate the next
+// frame in, which may be the same buffer if the frame has been processed and is no longer needed.  If it returns an
+// error, the frame is not considered sent and stays in the BatchWriter's buffer.
+type FrameFunc func(frame *bytes.Buffer) (*bytes.Buffer, error)
+
+// BatchStats counts what a BatchWriter has sent.
+type BatchStats struct {
+	Frames    uint64 // Number of frames sent
+	Bytes     uint64 // Number of bytes in all frames sent
+	Items     uint64 // Number of items in all frames sent
+	Oversized uint64 // Number of items larger than the maximum frame size
+}
+
+// BatchWriter accumulates serialized items in to frames of at most a maximum size, and passes each frame to a
+// FrameFunc.  An item is never split across frames.
+//
+// For a datagram sink, where each frame is sent as a single packet, an item larger than the maximum frame size
+// can't be sent and is dropped.  For a stream sink, the maximum frame size only bounds how much is buffered, so
+// such an item is sent in a frame of its own.
+type BatchWriter struct {
+	maxSize   int
+	datagram  bool
+	frameFn   FrameFunc
+	buf       *bytes.Buffer
+	err       error
+	pending   uint64 // Number of items in buf
+	stats     BatchStats
+	frameTime time.Duration // Time spent in frameFn
+}
+
+// NewBatchWriter creates a BatchWriter which accumulates frames of at most maxSize bytes in buf.
+func NewBatchWriter(maxSize int, datagram bool, buf *bytes.Buffer, frameFn FrameFunc) *BatchWriter {
+	return &BatchWriter{
+		maxSize:  maxSize,
+		datagram: datagram,
+		frameFn:  frameFn,
+		buf:      buf,
+	}
+}
+
+// Write appends an item to the current frame, sending the frame first if the item would not fit.  It returns
+// ErrItemTooLarge if the item was dropped, or the error from the FrameFunc.  Once the FrameFunc has failed, all
+// further writes return the same error.
+func (bw *BatchWriter) Write(item []byte) error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if len(item) > bw.maxSize {
+		bw.stats.Oversized++
+		if bw.datagram {
+			return ErrItemTooLarge
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		bw.append(item)
+		return bw.Flush()
+	}
+	if bw.buf.Len()+len(item) > bw.maxSize {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+	bw.append(item)
+	return nil
+}
+
+func (bw *BatchWriter) append(item []byte) {
+	bw.buf.Write(item) // #nosec
+	bw.pending++
+}
+
+// Flush sends the current frame if it is not empty.
+func (bw *BatchWriter) Flush() error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if bw.buf.Len() == 0 {
+		return nil
+	}
+	size := bw.buf.Len()
+	start := time.Now()
+	buf, err := bw.frameFn(bw.buf)
+	bw.frameTime += time.Since(start)
+	if err != nil {
+		bw.err = err
+		return err
+	}
+	bw.buf = buf
+	bw.stats.Frames++
+	bw.stats.Bytes += uint64(size)
+	bw.stats.Items += bw.pending
+	bw.pending = 0
+	return nil
+}
+
+// Buffer returns the buffer currently owned by the BatchWriter, so it can be released once writing is finished.
+func (bw *BatchWriter) Buffer() *bytes.Buffer {
+	return bw.buf
+}
+
+// Stats returns the counts of what has been sent so far.
+func (bw *BatchWriter) Stats() BatchStats {
+	return bw.stats
+}
+
+// FrameTime returns the time spent in the FrameFunc so far, such as waiting to hand a frame to a sender, which is
+// not time spent serializing.
+func (bw *BatchWriter) FrameTime() time.Duration {
+	return bw.frameTime
+}
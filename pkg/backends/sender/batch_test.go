@@ -0,0 +1,151 @@
+package sender
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// frameRecorder records each frame it is passed, returning a new buffer for the next frame.
+type frameRecorder struct {
+	frames []string
+	err    error
+}
+
+func (fr *frameRecorder) frame(buf *bytes.Buffer) (*bytes.Buffer, error) {
+	if fr.err != nil {
+		return nil, fr.err
+	}
+	fr.frames = append(fr.frames, buf.String())
+	return new(bytes.Buffer), nil
+}
+
+func writeItems(t *testing.T, bw *BatchWriter, items ...string) {
+	for _, item := range items {
+		require.NoError(t, bw.Write([]byte(item)))
+	}
+}
+
+func TestBatchWriterFillsFrames(t *testing.T) {
+	t.Parallel()
+	fr := &frameRecorder{}
+	bw := NewBatchWriter(10, true, new(bytes.Buffer), fr.frame)
+	writeItems(t, bw, "aaa\n", "bbb\n", "ccc\n", "dd\n")
+	assert.Equal(t, []string{"aaa\nbbb\n"}, fr.frames)
+	require.NoError(t, bw.Flush())
+	assert.Equal(t, []string{"aaa\nbbb\n", "ccc\ndd\n"}, fr.frames)
+	assert.Equal(t, BatchStats{Frames: 2, Bytes: 15, Items: 4}, bw.Stats())
+}
+
+func TestBatchWriterItemExactlyAtLimit(t *testing.T) {
+	t.Parallel()
+	fr := &frameRecorder{}
+	bw := NewBatchWriter(10, true, new(bytes.Buffer), fr.frame)
+	writeItems(t, bw, "123456789\n")
+	assert.Empty(t, fr.frames) // A full frame is only sent once the next item doesn't fit
+	writeItems(t, bw, "a\n")
+	assert.Equal(t, []string{"123456789\n"}, fr.frames)
+	require.NoError(t, bw.Flush())
+	assert.Equal(t, []string{"123456789\n", "a\n"}, fr.frames)
+	assert.Equal(t, BatchStats{Frames: 2, Bytes: 12, Items: 2}, bw.Stats())
+}
+
+func TestBatchWriterFrameExactlyAtLimit(t *testing.T) {
+	t.Parallel()
+	fr := &frameRecorder{}
+	bw := NewBatchWriter(10, true, new(bytes.Buffer), fr.frame)
+	writeItems(t, bw, "1234\n", "5678\n", "9\n")
+	assert.Equal(t, []string{"1234\n5678\n"}, fr.frames)
+	require.NoError(t, bw.Flush())
+	assert.Equal(t, []string{"1234\n5678\n", "9\n"}, fr.frames)
+}
+
+func TestBatchWriterDatagramItemTooLarge(t *testing.T) {
+	t.Parallel()
+	fr := &frameRecorder{}
+	bw := NewBatchWriter(10, true, new(bytes.Buffer), fr.frame)
+	writeItems(t, bw, "aaa\n")
+	assert.Equal(t, ErrItemTooLarge, bw.Write([]byte("12345678901\n")))
+	writeItems(t, bw, "bbb\n")
+	require.NoError(t, bw.Flush())
+	assert.Equal(t, []string{"aaa\nbbb\n"}, fr.frames)
+	assert.Equal(t, BatchStats{Frames: 1, Bytes: 8, Items: 2, Oversized: 1}, bw.Stats())
+}
+
+func TestBatchWriterStreamItemTooLarge(t *testing.T) {
+	t.Parallel()
+	fr := &frameRecorder{}
+	bw := NewBatchWriter(10, false, new(bytes.Buffer), fr.frame)
+	writeItems(t, bw, "aaa\n", "12345678901\n", "bbb\n")
+	require.NoError(t, bw.Flush())
+	assert.Equal(t, []string{"aaa\n", "12345678901\n", "bbb\n"}, fr.frames)
+	assert.Equal(t, BatchStats{Frames: 3, Bytes: 20, Items: 3, Oversized: 1}, bw.Stats())
+}
+
+func TestBatchWriterFlushEmpty(t *testing.T) {
+	t.Parallel()
+	fr := &frameRecorder{}
+	bw := NewBatchWriter(10, true, new(bytes.Buffer), fr.frame)
+	require.NoError(t, bw.Flush())
+	assert.Empty(t, fr.frames)
+	assert.Equal(t, BatchStats{}, bw.Stats())
+}
+
+func TestBatchWriterReusesBuffer(t *testing.T) {
+	t.Parallel()
+	var frames []string
+	buf := new(bytes.Buffer)
+	bw := NewBatchWriter(4, true, buf, func(frame *bytes.Buffer) (*bytes.Buffer, error) {
+		frames = append(frames, frame.String())
+		frame.Reset()
+		return frame, nil
+	})
+	writeItems(t, bw, "ab", "cd", "ef")
+	require.NoError(t, bw.Flush())
+	assert.Equal(t, []string{"abcd", "ef"}, frames)
+	assert.True(t, buf == bw.Buffer())
+}
+
+func TestBatchWriterFrameError(t *testing.T) {
+	t.Parallel()
+	expectedErr := errors.New("closed")
+	fr := &frameRecorder{err: expectedErr}
+	buf := new(bytes.Buffer)
+	bw := NewBatchWriter(4, true, buf, fr.frame)
+	writeItems(t, bw, "ab", "cd")
+	assert.Equal(t, expectedErr, bw.Write([]byte("ef")))
+	// The error is sticky, and the unsent frame stays in the writer's buffer.
+	assert.Equal(t, expectedErr, bw.Write([]byte("g")))
+	assert.Equal(t, expectedErr, bw.Flush())
+	assert.True(t, buf == bw.Buffer())
+	assert.Equal(t, "abcd", buf.String())
+	assert.Equal(t, BatchStats{}, bw.Stats())
+}
+
+func TestBatchWriterNeverSplitsItems(t *testing.T) {
+	t.Parallel()
+	fr := &frameRecorder{}
+	bw := NewBatchWriter(50, true, new(bytes.Buffer), fr.frame)
+	var items []string
+	for i := 1; i <= 30; i++ {
+		item := strings.Repeat("x", i%17) + "\n"
+		items = append(items, item)
+		writeItems(t, bw, item)
+	}
+	require.NoError(t, bw.Flush())
+	var joined []string
+	for _, frame := range fr.frames {
+		assert.True(t, len(frame) <= 50)
+		assert.True(t, strings.HasSuffix(frame, "\n"))
+		joined = append(joined, frame)
+	}
+	assert.Equal(t, strings.Join(items, ""), strings.Join(joined, ""))
+	stats := bw.Stats()
+	assert.EqualValues(t, 30, stats.Items)
+	assert.EqualValues(t, len(fr.frames), stats.Frames)
+	assert.EqualValues(t, len(strings.Join(items, "")), stats.Bytes)
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -27,6 +28,16 @@ type Sender struct {
 	Sink         chan Stream
 	BufPool      sync.Pool
 	WriteTimeout time.Duration
+	Transfer     gostatsd.TransferCounter // Counts the bytes written to the connection, and the time taken
+	Logger       log.FieldLogger          // Logs of the sender, a child of the standard logger if nil
+}
+
+// logger returns the logger of the sender.
+func (s *Sender) logger() log.FieldLogger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return logging.Component("sender")
 }
 
 func (s *Sender) Run(ctx context.Context) {
@@ -43,7 +54,7 @@ func (s *Sender) Run(ctx context.Context) {
 	for {
 		w, err := s.ConnFactory()
 		if err != nil {
-			log.Warnf("Failed to connect: %v", err)
+			s.logger().WithError(err).Warn("Failed to connect")
 			// TODO do backoff
 			timer := time.NewTimer(1 * time.Second)
 			for {
@@ -85,7 +96,7 @@ func (s *Sender) Run(ctx context.Context) {
 func (s *Sender) innerRun(ctx context.Context, conn net.Conn, stream *Stream, errs []error) (*Stream, []error, error) {
 	defer func() {
 		if err := conn.Close(); err != nil {
-			log.Warnf("Close failed: %v", err)
+			s.logger().WithError(err).Warn("Close failed")
 		}
 	}()
 	var err error
@@ -103,10 +114,13 @@ loop:
 		for buf := range stream.Buf {
 			if s.WriteTimeout > 0 {
 				if e := conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout)); e != nil {
-					log.Warnf("Failed to set write deadline: %v", e)
+					s.logger().WithError(e).Warn("Failed to set write deadline")
 				}
 			}
-			_, err = conn.Write(buf.Bytes())
+			start := time.Now()
+			var n int
+			n, err = conn.Write(buf.Bytes())
+			s.Transfer.Sent(n, time.Since(start))
 			s.PutBuffer(buf)
 			if err != nil {
 				break loop
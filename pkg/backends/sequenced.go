@@ -0,0 +1,190 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sequenceWindow is the number of flush intervals for which a SequencedBackend remembers the snapshots acknowledged.
+const sequenceWindow = 16
+
+// SequencedBackend sends each snapshot of a flush interval to a backend at most once.  It records the interval
+// sequence number and part of each snapshot the backend acknowledges by sending it successfully, and skips a snapshot
+// which is sent again after it has been acknowledged, such as when the flusher retries a flush which failed in part.
+// Snapshots are remembered for sequenceWindow intervals after the latest acknowledged, and older ones are always sent.
+type SequencedBackend struct {
+	skipped uint64 // Snapshots skipped as already acknowledged, must be read/written only using atomic instructions.
+
+	name    string // Name of the backend as configured
+	backend gostatsd.Backend
+
+	mu    sync.Mutex
+	last  uint64                      // Latest interval with a part acknowledged
+	acked map[uint64]map[int]struct{} // Parts acknowledged of each interval in the window
+}
+
+// NewSequencedBackend creates a SequencedBackend sending to backend.  name is the configured name of the backend, used
+// in internal metrics and logs.
+func NewSequencedBackend(name string, backend gostatsd.Backend) *SequencedBackend {
+	return &SequencedBackend{
+		name:    name,
+		backend: backend,
+		acked:   map[uint64]map[int]struct{}{},
+	}
+}
+
+// acknowledged returns true if the part of the interval has been acknowledged.
+func (sb *SequencedBackend) acknowledged(sequence uint64, part int) bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	_, ok := sb.acked[sequence][part]
+	return ok
+}
+
+// acknowledge records that the part of the interval was sent, and forgets the intervals which have left the window.
+func (sb *SequencedBackend) acknowledge(sequence uint64, part int) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	parts, ok := sb.acked[sequence]
+	if !ok {
+		parts = map[int]struct{}{}
+		sb.acked[sequence] = parts
+	}
+	parts[part] = struct{}{}
+	if sequence <= sb.last {
+		return
+	}
+	sb.last = sequence
+	for s := range sb.acked {
+		if s+sequenceWindow <= sb.last {
+			delete(sb.acked, s)
+		}
+	}
+}
+
+// LastAcknowledged returns the sequence number of the latest interval the backend acknowledged part of, or 0 if none.
+func (sb *SequencedBackend) LastAcknowledged() uint64 {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.last
+}
+
+// SendMetricsAsync sends the metrics to the backend unless they have already been acknowledged, in which case the
+// callback is called with no errors.  Metrics without a sequence number are always sent.
+func (sb *SequencedBackend) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	sequence, part := metrics.Sequence, metrics.Part
+	if sequence == 0 {
+		sb.backend.SendMetricsAsync(ctx, metrics, cb)
+		return
+	}
+	if sb.acknowledged(sequence, part) {
+		atomic.AddUint64(&sb.skipped, 1)
+		logging.Backend(sb.name).WithFields(log.Fields{
+			logging.FieldInterval: sequence,
+			"part":                part,
+		}).Warn("Skipping interval, it was already acknowledged")
+		cb(nil)
+		return
+	}
+	sb.backend.SendMetricsAsync(ctx, metrics, func(errs []error) {
+		if !hasError(errs) {
+			sb.acknowledge(sequence, part)
+		}
+		cb(errs)
+	})
+}
+
+// SendEvent sends the event to the backend.
+func (sb *SequencedBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return sb.backend.SendEvent(ctx, e)
+}
+
+// Name returns the name of the wrapped backend.
+func (sb *SequencedBackend) Name() string {
+	return sb.backend.Name()
+}
+
+// Status returns the status of the wrapped backend, followed by the latest interval acknowledged and the number of
+// snapshots skipped.
+func (sb *SequencedBackend) Status() string {
+	return fmt.Sprintf("%s, interval %d acknowledged, %d resends skipped", gostatsd.BackendStatus(sb.backend), sb.LastAcknowledged(), atomic.LoadUint64(&sb.skipped))
+}
+
+// RunMetrics emits the latest interval acknowledged and the number of snapshots skipped at each flush, and runs the
+// metrics of the wrapped backend, if it has any.
+func (sb *SequencedBackend) RunMetrics(ctx context.Context, statser statser.Statser) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	if me, ok := sb.backend.(metricEmitter); ok {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			me.RunMetrics(ctx, statser)
+		}()
+	}
+
+	statser = statser.WithTags(gostatsd.Tags{"backend:" + sb.name})
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.last_acknowledged_interval", float64(sb.LastAcknowledged()), nil)
+			statser.Gauge("backend.resends_skipped", float64(atomic.LoadUint64(&sb.skipped)), nil)
+		}
+	}
+}
+
+// Run runs the wrapped backend, if it is a gostatsd.RunnableBackend.
+func (sb *SequencedBackend) Run(ctx context.Context) {
+	if rb, ok := sb.backend.(gostatsd.RunnableBackend); ok {
+		rb.Run(ctx)
+	}
+}
+
+// SaveState returns the state of the wrapped backend, if it is a gostatsd.StatefulBackend.
+func (sb *SequencedBackend) SaveState() ([]byte, error) {
+	return gostatsd.SaveBackendState(sb.backend)
+}
+
+// RestoreState restores the state of the wrapped backend, if it is a gostatsd.StatefulBackend.
+func (sb *SequencedBackend) RestoreState(state []byte) error {
+	return gostatsd.RestoreBackendState(sb.backend, state)
+}
+
+// ValidateMetricName validates name with the wrapped backend.
+func (sb *SequencedBackend) ValidateMetricName(name string) error {
+	return gostatsd.ValidateMetricName(sb.backend, name)
+}
+
+// WantsRawTimers returns true if the wrapped backend wants the raw timer samples.
+func (sb *SequencedBackend) WantsRawTimers() bool {
+	return gostatsd.WantsRawTimers(sb.backend)
+}
+
+// WantsBackfill returns true if the wrapped backend wants the metrics which arrived late for a past interval.
+func (sb *SequencedBackend) WantsBackfill() bool {
+	return gostatsd.WantsBackfill(sb.backend)
+}
+
+// TransferStats returns the lifetime totals of the data the wrapped backend has sent, if it measures them.
+func (sb *SequencedBackend) TransferStats() (gostatsd.TransferStats, bool) {
+	return gostatsd.BackendTransferStats(sb.backend)
+}
+
+// WriteReport writes the report of the wrapped backend, if it is a gostatsd.ReportingBackend.
+func (sb *SequencedBackend) WriteReport(w io.Writer) error {
+	return gostatsd.BackendReport(sb.backend, w)
+}
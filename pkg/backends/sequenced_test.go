@@ -0,0 +1,66 @@
+package backends
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sequencedMetrics(sequence uint64, part int) *gostatsd.MetricMap {
+	m := gaugeMetrics(float64(sequence))
+	m.Sequence = sequence
+	m.Part = part
+	return m
+}
+
+func TestSequencedBackendSkipsAcknowledged(t *testing.T) {
+	t.Parallel()
+	stub := &stubBackend{name: "stub"}
+	sb := NewSequencedBackend("stub", stub)
+
+	require.Empty(t, sendAndWait(sb, sequencedMetrics(1, 0)))
+	require.Empty(t, sendAndWait(sb, sequencedMetrics(1, 1)))
+	require.Empty(t, sendAndWait(sb, sequencedMetrics(1, 0)))
+	require.Len(t, stub.sentMetrics(), 2)
+	assert.EqualValues(t, 1, sb.LastAcknowledged())
+	assert.Equal(t, "ready, interval 1 acknowledged, 1 resends skipped", sb.Status())
+}
+
+func TestSequencedBackendResendsFailed(t *testing.T) {
+	t.Parallel()
+	stub := &stubBackend{name: "stub", fail: true}
+	sb := NewSequencedBackend("stub", stub)
+
+	require.NotEmpty(t, sendAndWait(sb, sequencedMetrics(3, 0)))
+	assert.Zero(t, sb.LastAcknowledged())
+
+	stub.fail = false
+	m := sequencedMetrics(3, 0)
+	m.Interval = 42 * time.Second
+	require.Empty(t, sendAndWait(sb, m))
+	sent := stub.sentMetrics()
+	require.Len(t, sent, 1)
+	assert.EqualValues(t, 3, sent[0].Sequence)
+	assert.Equal(t, m.Interval, sent[0].Interval)
+	assert.EqualValues(t, 3, sb.LastAcknowledged())
+}
+
+func TestSequencedBackendWindow(t *testing.T) {
+	t.Parallel()
+	stub := &stubBackend{name: "stub"}
+	sb := NewSequencedBackend("stub", stub)
+
+	// Unsequenced metrics are always sent.
+	require.Empty(t, sendAndWait(sb, gaugeMetrics(1)))
+	require.Empty(t, sendAndWait(sb, gaugeMetrics(1)))
+	require.Empty(t, sendAndWait(sb, sequencedMetrics(1, 0)))
+	require.Empty(t, sendAndWait(sb, sequencedMetrics(1+sequenceWindow, 0)))
+	// Interval 1 has been forgotten, so is sent again.
+	require.Empty(t, sendAndWait(sb, sequencedMetrics(1, 0)))
+	assert.Len(t, stub.sentMetrics(), 5)
+	assert.EqualValues(t, 1+sequenceWindow, sb.LastAcknowledged())
+}
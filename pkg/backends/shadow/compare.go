@@ -0,0 +1,260 @@
+package shadow
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+var (
+	regWhitespace  = regexp.MustCompile(`\s+`)
+	regNonAlphaNum = regexp.MustCompile(`[^a-zA-Z\d_.-]`)
+)
+
+// Naming is the naming scheme of the buckets of the reference statsd, the Graphite namespace of etsy statsd.
+type Naming struct {
+	LegacyNamespace bool   // Counters are stats.<name> and stats_counts.<name>, ignoring the prefixes below
+	GlobalPrefix    string // Prefix of every bucket
+	PrefixCounter   string
+	PrefixTimer     string
+	PrefixGauge     string
+	PrefixSet       string
+	GlobalSuffix    string // Suffix of every bucket
+	SetSuffix       string // Last path component of set buckets, count in etsy statsd, may be ""
+}
+
+// bucket is the value of a bucket computed from our flush.
+type bucket struct {
+	value      float64
+	percentile bool // Computed from a timer percentile or median, compared with the percentile tolerance
+}
+
+// buckets returns the buckets of metrics in the naming scheme n.  Tags are ignored, as etsy statsd has no tags, so the
+// values of counters with the same name are summed, and for other types the last value is kept.
+func (n *Naming) buckets(metrics *gostatsd.MetricMap, disabled gostatsd.TimerSubtypes) map[string]bucket {
+	prefix := func(p string) string {
+		if p == "" {
+			return ""
+		}
+		return p + "."
+	}
+	global := prefix(n.GlobalPrefix)
+	suffix := ""
+	if n.GlobalSuffix != "" {
+		suffix = "." + n.GlobalSuffix
+	}
+	var counterNamespace, timerNamespace, gaugeNamespace, setNamespace string
+	if n.LegacyNamespace {
+		counterNamespace = global
+		timerNamespace = global + "timers."
+		gaugeNamespace = global + "gauges."
+		setNamespace = global + "sets."
+	} else {
+		counterNamespace = global + prefix(n.PrefixCounter)
+		timerNamespace = global + prefix(n.PrefixTimer)
+		gaugeNamespace = global + prefix(n.PrefixGauge)
+		setNamespace = global + prefix(n.PrefixSet)
+	}
+	setSuffix := suffix
+	if n.SetSuffix != "" {
+		setSuffix = "." + n.SetSuffix + suffix
+	}
+
+	b := map[string]bucket{}
+	add := func(name string, value float64) {
+		v := b[name]
+		v.value += value
+		b[name] = v
+	}
+	set := func(name string, value float64, percentile bool) {
+		b[name] = bucket{value: value, percentile: percentile}
+	}
+	metrics.EachCounter(func(key, tagsKey string, counter gostatsd.Counter) {
+		k := bucketKey(key)
+		if n.LegacyNamespace {
+			add("stats_counts."+k+suffix, float64(counter.Value))
+			add(counterNamespace+k+suffix, counter.PerSecond)
+		} else {
+			add(counterNamespace+k+".count"+suffix, float64(counter.Value))
+			add(counterNamespace+k+".rate"+suffix, counter.PerSecond)
+		}
+	})
+	metrics.EachTimer(func(key, tagsKey string, timer gostatsd.Timer) {
+		k := timerNamespace + bucketKey(key) + "."
+		for _, sub := range []struct {
+			name       string
+			value      float64
+			disabled   bool
+			percentile bool
+		}{
+			{"lower", timer.Min, disabled.Lower, false},
+			{"upper", timer.Max, disabled.Upper, false},
+			{"count", float64(timer.Count), disabled.Count, false},
+			{"count_ps", timer.PerSecond, disabled.CountPerSecond, false},
+			{"mean", timer.Mean, disabled.Mean, false},
+			{"median", timer.Median, disabled.Median, true},
+			{"std", timer.StdDev, disabled.StdDev, false},
+			{"sum", timer.Sum, disabled.Sum, false},
+			{"sum_squares", timer.SumSquares, disabled.SumSquares, false},
+		} {
+			if !sub.disabled {
+				set(k+sub.name+suffix, sub.value, sub.percentile)
+			}
+		}
+		for _, pct := range timer.Percentiles {
+			set(k+pct.Str+suffix, pct.Float, true)
+		}
+	})
+	metrics.EachGauge(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		set(gaugeNamespace+bucketKey(key)+suffix, gauge.Value, false)
+	})
+	metrics.EachSet(func(key, tagsKey string, s gostatsd.Set) {
+		set(setNamespace+bucketKey(key)+setSuffix, float64(s.Cardinality()), false)
+	})
+	return b
+}
+
+// bucketKey cleans up a metric name the way etsy statsd does when it writes it to Graphite.
+func bucketKey(s string) string {
+	s = regWhitespace.ReplaceAllLiteralString(s, "_")
+	s = strings.Replace(s, "/", "-", -1)
+	return regNonAlphaNum.ReplaceAllLiteralString(s, "")
+}
+
+// readReference reads buckets in the Graphite plaintext format, <bucket> <value> [<timestamp>] per line.  Blank lines
+// and lines starting with # are skipped.  If a bucket is repeated the last value is kept.
+func readReference(r io.Reader) (map[string]float64, error) {
+	ref := map[string]float64{}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected <bucket> <value> [<timestamp>]", lineNo)
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid value %q", lineNo, fields[1])
+		}
+		ref[fields[0]] = v
+	}
+	return ref, scanner.Err()
+}
+
+// Discrepancy is a bucket which differs between our flush and the reference.
+type Discrepancy struct {
+	Bucket    string
+	Ours      float64
+	Reference float64
+	Missing   bool // In the reference but not our flush
+	Extra     bool // In our flush but not the reference
+}
+
+// RelativeError is the difference between the values relative to the larger of them, or 1 if the bucket is missing
+// from either side.
+func (d *Discrepancy) RelativeError() float64 {
+	if d.Missing || d.Extra {
+		return 1
+	}
+	return relativeError(d.Ours, d.Reference)
+}
+
+// Report is the result of comparing a flush with the reference.
+type Report struct {
+	Time          time.Time // Time of the flush
+	Reference     string    // Name of the reference file
+	ReferenceTime time.Time // Modification time of the reference file
+	Compared      int       // Number of buckets in both the flush and the reference
+	Mismatched    int       // Number of buckets in both whose values differ by more than the tolerance
+	Missing       int       // Number of buckets only in the reference
+	Extra         int       // Number of buckets only in the flush
+	Discrepancies []Discrepancy
+}
+
+// comparer compares buckets, ignoring buckets which match ignore.
+type comparer struct {
+	tolerance           float64 // Maximum relative error of a bucket
+	percentileTolerance float64 // Maximum relative error of a bucket computed from a timer percentile or median
+	ignore              gostatsd.StringMatchList
+}
+
+// compare compares ours with the reference, returning a report with the discrepancies sorted by bucket.
+func (c *comparer) compare(ours map[string]bucket, reference map[string]float64) *Report {
+	r := &Report{}
+	for name, b := range ours {
+		if c.ignore.MatchAny(name) {
+			continue
+		}
+		ref, ok := reference[name]
+		if !ok {
+			r.Extra++
+			r.Discrepancies = append(r.Discrepancies, Discrepancy{Bucket: name, Ours: b.value, Extra: true})
+			continue
+		}
+		r.Compared++
+		tolerance := c.tolerance
+		if b.percentile {
+			tolerance = c.percentileTolerance
+		}
+		if relativeError(b.value, ref) > tolerance {
+			r.Mismatched++
+			r.Discrepancies = append(r.Discrepancies, Discrepancy{Bucket: name, Ours: b.value, Reference: ref})
+		}
+	}
+	for name, ref := range reference {
+		if _, ok := ours[name]; ok || c.ignore.MatchAny(name) {
+			continue
+		}
+		r.Missing++
+		r.Discrepancies = append(r.Discrepancies, Discrepancy{Bucket: name, Reference: ref, Missing: true})
+	}
+	sort.Slice(r.Discrepancies, func(i, j int) bool {
+		return r.Discrepancies[i].Bucket < r.Discrepancies[j].Bucket
+	})
+	return r
+}
+
+// relativeError returns the difference between a and b relative to the larger magnitude of the two, or 0 if both are
+// 0.
+func relativeError(a, b float64) float64 {
+	if a == b {
+		return 0
+	}
+	return math.Abs(a-b) / math.Max(math.Abs(a), math.Abs(b))
+}
+
+// Write writes the report to w as a diff, with a line for each discrepancy starting with ~ if the values differ, - if
+// the bucket is missing from our flush, or + if it is missing from the reference.
+func (r *Report) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	_, _ = fmt.Fprintf(bw, "# flush at %s compared with %s modified at %s\n", r.Time.Format(time.RFC3339), r.Reference, r.ReferenceTime.Format(time.RFC3339))
+	_, _ = fmt.Fprintf(bw, "# %d compared, %d mismatched, %d missing, %d extra\n", r.Compared, r.Mismatched, r.Missing, r.Extra)
+	for i := range r.Discrepancies {
+		d := &r.Discrepancies[i]
+		switch {
+		case d.Missing:
+			_, _ = fmt.Fprintf(bw, "- %s reference=%s\n", d.Bucket, formatValue(d.Reference))
+		case d.Extra:
+			_, _ = fmt.Fprintf(bw, "+ %s ours=%s\n", d.Bucket, formatValue(d.Ours))
+		default:
+			_, _ = fmt.Fprintf(bw, "~ %s ours=%s reference=%s error=%.2f%%\n", d.Bucket, formatValue(d.Ours), formatValue(d.Reference), 100*d.RelativeError())
+		}
+	}
+	// Errors writing to the buffer are returned by Flush.
+	return bw.Flush()
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
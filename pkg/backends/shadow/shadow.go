@@ -0,0 +1,282 @@
+package shadow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	"github.com/atlassian/gostatsd/pkg/statser"
+	"github.com/atlassian/gostatsd/pkg/util"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName = "shadow"
+	// DefaultTolerance is the default maximum relative error of a bucket.
+	DefaultTolerance = 0.001
+	// DefaultPercentileTolerance is the default maximum relative error of a timer percentile or median, which
+	// implementations compute differently.
+	DefaultPercentileTolerance = 0.05
+	// DefaultMaxReferenceAge is the default age after which the reference file is not compared, 0 to always compare.
+	DefaultMaxReferenceAge = time.Duration(0)
+	// DefaultMaxReportedBuckets is the default number of discrepancies emitted as internal metrics each flush.
+	DefaultMaxReportedBuckets = 20
+	// DefaultSetSuffix is the default last path component of set buckets.
+	DefaultSetSuffix = "count"
+)
+
+// logger logs through a child of the standard logger for this backend.
+var logger = logging.Backend(BackendName)
+
+// DefaultIgnore is the default list of buckets which are not compared, the internal metrics of etsy statsd.
+var DefaultIgnore = []string{"statsd.*", "stats.statsd.*", "stats_counts.statsd.*"}
+
+// Config holds the configuration of the shadow backend.
+type Config struct {
+	ReferenceFile       string        // File the reference flush is read from, required
+	ReportFile          string        // File the report of each flush is written to, empty to disable
+	MaxReferenceAge     time.Duration // Age after which the reference file is not compared, 0 to always compare
+	Tolerance           float64
+	PercentileTolerance float64
+	Ignore              []string // Buckets not to compare, a trailing * matches any suffix
+	MaxReportedBuckets  int      // Number of discrepancies emitted as internal metrics each flush
+	Naming              Naming
+}
+
+// Client compares each flush with the flush of a reference statsd, such as etsy statsd, read from a file in the
+// Graphite plaintext format which the reference writes at each of its flushes.  The reference may also be a fixed
+// golden file, to catch regressions in CI.
+type Client struct {
+	referenceFile      string
+	reportFile         string
+	maxReferenceAge    time.Duration
+	maxReportedBuckets int
+	naming             Naming
+	comparer           comparer
+	disabledSubtypes   gostatsd.TimerSubtypes
+	now                func() time.Time // Returns current time. Useful for testing.
+
+	mu      sync.Mutex
+	last    *Report // The most recent report, nil until a flush has been compared
+	skipped uint64  // Flushes not compared because the reference was stale
+}
+
+// NewClientFromViper constructs a shadow backend.
+func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
+	s := getSubViper(v, "shadow")
+	s.SetDefault("max_reference_age", DefaultMaxReferenceAge)
+	s.SetDefault("tolerance", DefaultTolerance)
+	s.SetDefault("percentile_tolerance", DefaultPercentileTolerance)
+	s.SetDefault("ignore", DefaultIgnore)
+	s.SetDefault("max_reported_buckets", DefaultMaxReportedBuckets)
+	s.SetDefault("legacy_namespace", true)
+	s.SetDefault("global_prefix", "stats")
+	s.SetDefault("prefix_counter", "counters")
+	s.SetDefault("prefix_timer", "timers")
+	s.SetDefault("prefix_gauge", "gauges")
+	s.SetDefault("prefix_set", "sets")
+	s.SetDefault("set_suffix", DefaultSetSuffix)
+	return NewClient(&Config{
+		ReferenceFile:       s.GetString("reference_file"),
+		ReportFile:          s.GetString("report_file"),
+		MaxReferenceAge:     s.GetDuration("max_reference_age"),
+		Tolerance:           s.GetFloat64("tolerance"),
+		PercentileTolerance: s.GetFloat64("percentile_tolerance"),
+		Ignore:              s.GetStringSlice("ignore"),
+		MaxReportedBuckets:  s.GetInt("max_reported_buckets"),
+		Naming: Naming{
+			LegacyNamespace: s.GetBool("legacy_namespace"),
+			GlobalPrefix:    s.GetString("global_prefix"),
+			PrefixCounter:   s.GetString("prefix_counter"),
+			PrefixTimer:     s.GetString("prefix_timer"),
+			PrefixGauge:     s.GetString("prefix_gauge"),
+			PrefixSet:       s.GetString("prefix_set"),
+			GlobalSuffix:    s.GetString("global_suffix"),
+			SetSuffix:       s.GetString("set_suffix"),
+		},
+	}, util.DisabledSubMetrics(v))
+}
+
+// NewClient constructs a shadow backend.
+func NewClient(config *Config, disabled gostatsd.TimerSubtypes) (*Client, error) {
+	if config.ReferenceFile == "" {
+		return nil, fmt.Errorf("[%s] reference_file is required", BackendName)
+	}
+	if config.Tolerance < 0 || config.PercentileTolerance < 0 {
+		return nil, fmt.Errorf("[%s] tolerance and percentile_tolerance should be non-negative", BackendName)
+	}
+	if config.MaxReferenceAge < 0 {
+		return nil, fmt.Errorf("[%s] max_reference_age should be non-negative", BackendName)
+	}
+	if config.MaxReportedBuckets < 0 {
+		return nil, fmt.Errorf("[%s] max_reported_buckets should be non-negative", BackendName)
+	}
+	ignore := make(gostatsd.StringMatchList, 0, len(config.Ignore))
+	for _, s := range config.Ignore {
+		ignore = append(ignore, gostatsd.NewStringMatch(s))
+	}
+	logger.WithFields(log.Fields{
+		"reference_file":       config.ReferenceFile,
+		"report_file":          config.ReportFile,
+		"tolerance":            config.Tolerance,
+		"percentile_tolerance": config.PercentileTolerance,
+	}).Info("Configured backend")
+	return &Client{
+		referenceFile:      config.ReferenceFile,
+		reportFile:         config.ReportFile,
+		maxReferenceAge:    config.MaxReferenceAge,
+		maxReportedBuckets: config.MaxReportedBuckets,
+		naming:             config.Naming,
+		comparer: comparer{
+			tolerance:           config.Tolerance,
+			percentileTolerance: config.PercentileTolerance,
+			ignore:              ignore,
+		},
+		disabledSubtypes: disabled,
+		now:              time.Now,
+	}, nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+// SendEvent discards events.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// SendMetricsAsync computes the buckets of the flush synchronously, and compares them with the reference
+// asynchronously.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	ours := c.naming.buckets(metrics, c.disabledSubtypes)
+	now := c.now()
+	go func() {
+		cb([]error{c.compare(ours, now)})
+	}()
+}
+
+// compare compares ours with the reference file, keeping the report and writing it to the report file.
+func (c *Client) compare(ours map[string]bucket, now time.Time) error {
+	f, err := os.Open(c.referenceFile)
+	if err != nil {
+		return fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	if c.maxReferenceAge > 0 && now.Sub(info.ModTime()) > c.maxReferenceAge {
+		c.mu.Lock()
+		c.skipped++
+		c.mu.Unlock()
+		logger.WithField("path", c.referenceFile).Warnf("Not comparing with the reference, last modified at %s", info.ModTime().Format(time.RFC3339))
+		return nil
+	}
+	reference, err := readReference(f)
+	if err != nil {
+		return fmt.Errorf("[%s] failed to read %s: %v", BackendName, c.referenceFile, err)
+	}
+
+	report := c.comparer.compare(ours, reference)
+	report.Time = now
+	report.Reference = c.referenceFile
+	report.ReferenceTime = info.ModTime()
+	c.mu.Lock()
+	c.last = report
+	c.mu.Unlock()
+	if report.Mismatched > 0 || report.Missing > 0 || report.Extra > 0 {
+		logger.Infof("%d of %d buckets mismatched, %d missing, %d extra", report.Mismatched, report.Compared, report.Missing, report.Extra)
+	}
+	if c.reportFile != "" {
+		if err := writeReportFile(c.reportFile, report); err != nil {
+			return fmt.Errorf("[%s] failed to write report: %v", BackendName, err)
+		}
+	}
+	return nil
+}
+
+// writeReportFile writes report to a temporary file which is renamed to path, so readers never see a partial
+// report.
+func writeReportFile(path string, report *Report) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err = report.Write(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// WriteReport writes the report of the most recent comparison to w.
+func (c *Client) WriteReport(w io.Writer) error {
+	c.mu.Lock()
+	report := c.last
+	c.mu.Unlock()
+	if report == nil {
+		return errors.New("no flush has been compared yet")
+	}
+	return report.Write(w)
+}
+
+// RunMetrics emits the result of the most recent comparison at each flush.  The relative error of each mismatched
+// bucket, up to max_reported_buckets of them, is emitted as shadow.bucket_error tagged with the bucket.
+func (c *Client) RunMetrics(ctx context.Context, statser statser.Statser) {
+	statser = statser.WithTags(gostatsd.Tags{"backend:" + BackendName})
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			c.mu.Lock()
+			report, skipped := c.last, c.skipped
+			c.mu.Unlock()
+			statser.Gauge("shadow.flushes_skipped", float64(skipped), nil)
+			if report == nil {
+				continue
+			}
+			statser.Gauge("shadow.buckets_compared", float64(report.Compared), nil)
+			statser.Gauge("shadow.buckets_mismatched", float64(report.Mismatched), nil)
+			statser.Gauge("shadow.buckets_missing", float64(report.Missing), nil)
+			statser.Gauge("shadow.buckets_extra", float64(report.Extra), nil)
+			for i := range report.Discrepancies {
+				if i == c.maxReportedBuckets {
+					break
+				}
+				d := &report.Discrepancies[i]
+				statser.Gauge("shadow.bucket_error", d.RelativeError(), gostatsd.Tags{"bucket:" + d.Bucket})
+			}
+		}
+	}
+}
+
+func getSubViper(v *viper.Viper, key string) *viper.Viper {
+	n := v.Sub(key)
+	if n == nil {
+		n = viper.New()
+	}
+	return n
+}
@@ -0,0 +1,210 @@
+package shadow
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var etsyNaming = Naming{LegacyNamespace: true, GlobalPrefix: "stats", SetSuffix: "count"}
+
+func testMetrics() *gostatsd.MetricMap {
+	timer := gostatsd.Timer{Count: 4, PerSecond: 0.4, Min: 1, Max: 10, Mean: 4, Median: 3, StdDev: 2, Sum: 16, SumSquares: 100}
+	timer.Percentiles.Set("upper_90", 9)
+	return &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{"requests": {
+			"":         {Value: 5, PerSecond: 0.5},
+			"env:prod": {Value: 3, PerSecond: 0.3, Tags: gostatsd.Tags{"env:prod"}},
+		}},
+		Gauges: gostatsd.Gauges{"queue depth": {"": {Value: 7}}},
+		Timers: gostatsd.Timers{"api/latency": {"": timer}},
+		Sets:   gostatsd.Sets{"users": {"": {Values: map[string]struct{}{"a": {}, "b": {}}}}},
+	}
+}
+
+func TestBucketsLegacy(t *testing.T) {
+	t.Parallel()
+	b := etsyNaming.buckets(testMetrics(), gostatsd.TimerSubtypes{StdDev: true})
+	values := map[string]float64{}
+	for name, v := range b {
+		values[name] = v.value
+	}
+	assert.Equal(t, map[string]float64{
+		"stats_counts.requests":                8,
+		"stats.requests":                       0.8,
+		"stats.gauges.queue_depth":             7,
+		"stats.sets.users.count":               2,
+		"stats.timers.api-latency.lower":       1,
+		"stats.timers.api-latency.upper":       10,
+		"stats.timers.api-latency.count":       4,
+		"stats.timers.api-latency.count_ps":    0.4,
+		"stats.timers.api-latency.mean":        4,
+		"stats.timers.api-latency.median":      3,
+		"stats.timers.api-latency.sum":         16,
+		"stats.timers.api-latency.sum_squares": 100,
+		"stats.timers.api-latency.upper_90":    9,
+	}, values)
+	assert.True(t, b["stats.timers.api-latency.upper_90"].percentile)
+	assert.True(t, b["stats.timers.api-latency.median"].percentile)
+	assert.False(t, b["stats.timers.api-latency.mean"].percentile)
+}
+
+func TestBucketsNamespaced(t *testing.T) {
+	t.Parallel()
+	n := Naming{GlobalPrefix: "stats", PrefixCounter: "counters", PrefixTimer: "timers", PrefixGauge: "gauges", PrefixSet: "sets", GlobalSuffix: "host1"}
+	b := n.buckets(testMetrics(), gostatsd.TimerSubtypes{})
+	assert.Contains(t, b, "stats.counters.requests.count.host1")
+	assert.Contains(t, b, "stats.counters.requests.rate.host1")
+	assert.Contains(t, b, "stats.gauges.queue_depth.host1")
+	assert.Contains(t, b, "stats.sets.users.host1")
+	assert.Contains(t, b, "stats.timers.api-latency.upper_90.host1")
+}
+
+func TestReadReference(t *testing.T) {
+	t.Parallel()
+	ref, err := readReference(strings.NewReader("# golden\nstats.a 1.5 1500000000\n\nstats.b -2\nstats.a 3\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"stats.a": 3, "stats.b": -2}, ref)
+
+	_, err = readReference(strings.NewReader("stats.a\n"))
+	assert.EqualError(t, err, "line 1: expected <bucket> <value> [<timestamp>]")
+	_, err = readReference(strings.NewReader("stats.a 1\nstats.b one\n"))
+	assert.EqualError(t, err, `line 2: invalid value "one"`)
+}
+
+func TestCompare(t *testing.T) {
+	t.Parallel()
+	c := comparer{
+		tolerance:           0.01,
+		percentileTolerance: 0.1,
+		ignore:              gostatsd.StringMatchList{gostatsd.NewStringMatch("statsd.*")},
+	}
+	ours := map[string]bucket{
+		"exact":       {value: 10},
+		"close":       {value: 100.5},
+		"far":         {value: 110},
+		"pct_close":   {value: 95, percentile: true},
+		"pct_far":     {value: 80, percentile: true},
+		"zero":        {value: 0},
+		"only_ours":   {value: 1},
+		"statsd.mine": {value: 1},
+	}
+	reference := map[string]float64{
+		"exact":         10,
+		"close":         100,
+		"far":           100,
+		"pct_close":     100,
+		"pct_far":       100,
+		"zero":          0,
+		"only_ref":      2,
+		"statsd.theirs": 5,
+	}
+	r := c.compare(ours, reference)
+	assert.Equal(t, 6, r.Compared)
+	assert.Equal(t, 2, r.Mismatched)
+	assert.Equal(t, 1, r.Missing)
+	assert.Equal(t, 1, r.Extra)
+	assert.Equal(t, []Discrepancy{
+		{Bucket: "far", Ours: 110, Reference: 100},
+		{Bucket: "only_ours", Ours: 1, Extra: true},
+		{Bucket: "only_ref", Reference: 2, Missing: true},
+		{Bucket: "pct_far", Ours: 80, Reference: 100},
+	}, r.Discrepancies)
+
+	var buf bytes.Buffer
+	r.Time = time.Unix(100, 0).UTC()
+	r.Reference = "golden.txt"
+	r.ReferenceTime = time.Unix(50, 0).UTC()
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, `# flush at 1970-01-01T00:01:40Z compared with golden.txt modified at 1970-01-01T00:00:50Z
+# 6 compared, 2 mismatched, 1 missing, 1 extra
+~ far ours=110 reference=100 error=9.09%
++ only_ours ours=1
+- only_ref reference=2
+~ pct_far ours=80 reference=100 error=20.00%
+`, buf.String())
+}
+
+func TestSendMetricsAsync(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "shadow")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	referenceFile := filepath.Join(dir, "reference.txt")
+	reportFile := filepath.Join(dir, "report.txt")
+	require.NoError(t, ioutil.WriteFile(referenceFile, []byte(`stats_counts.requests 8 1500000000
+stats.requests 0.8 1500000000
+stats.gauges.queue_depth 6 1500000000
+stats.sets.users.count 2 1500000000
+stats.statsd.numStats 4 1500000000
+`), 0644))
+
+	c, err := NewClient(&Config{
+		ReferenceFile:       referenceFile,
+		ReportFile:          reportFile,
+		Tolerance:           DefaultTolerance,
+		PercentileTolerance: DefaultPercentileTolerance,
+		Ignore:              append([]string{"stats.timers.*"}, DefaultIgnore...),
+		Naming:              etsyNaming,
+	}, gostatsd.TimerSubtypes{})
+	require.NoError(t, err)
+	c.now = func() time.Time {
+		return time.Unix(100, 0).UTC()
+	}
+	assert.EqualError(t, c.WriteReport(ioutil.Discard), "no flush has been compared yet")
+
+	done := make(chan []error)
+	c.SendMetricsAsync(context.Background(), testMetrics(), func(errs []error) {
+		done <- errs
+	})
+	assert.Equal(t, []error{nil}, <-done)
+
+	var buf bytes.Buffer
+	require.NoError(t, c.WriteReport(&buf))
+	lines := strings.Split(buf.String(), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, "# 4 compared, 1 mismatched, 0 missing, 0 extra", lines[1])
+	assert.Equal(t, "~ stats.gauges.queue_depth ours=7 reference=6 error=14.29%", lines[2])
+	written, err := ioutil.ReadFile(reportFile)
+	require.NoError(t, err)
+	assert.Equal(t, buf.String(), string(written))
+}
+
+func TestSendMetricsAsyncStaleReference(t *testing.T) {
+	t.Parallel()
+	f, err := ioutil.TempFile("", "reference")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	require.NoError(t, f.Close())
+
+	c, err := NewClient(&Config{ReferenceFile: f.Name(), MaxReferenceAge: time.Minute, Naming: etsyNaming}, gostatsd.TimerSubtypes{})
+	require.NoError(t, err)
+	c.now = func() time.Time {
+		return time.Now().Add(time.Hour)
+	}
+	done := make(chan []error)
+	c.SendMetricsAsync(context.Background(), testMetrics(), func(errs []error) {
+		done <- errs
+	})
+	assert.Equal(t, []error{nil}, <-done)
+	assert.EqualValues(t, 1, c.skipped)
+	assert.Nil(t, c.last)
+}
+
+func TestNewClientInvalid(t *testing.T) {
+	t.Parallel()
+	_, err := NewClient(&Config{}, gostatsd.TimerSubtypes{})
+	assert.Error(t, err)
+	_, err = NewClient(&Config{ReferenceFile: "ref", Tolerance: -1}, gostatsd.TimerSubtypes{})
+	assert.Error(t, err)
+}
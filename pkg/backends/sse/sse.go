@@ -0,0 +1,260 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/webhook"
+	"github.com/atlassian/gostatsd/pkg/logging"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName = "sse"
+	// DefaultAddress is the default address to serve events on.
+	DefaultAddress = ":8126"
+	// DefaultPath is the default path of the event stream.
+	DefaultPath = "/events"
+	// DefaultClientBuffer is the default number of flushes queued for a client before it is disconnected.
+	DefaultClientBuffer = 16
+	// DefaultMaxClients is the default number of clients which may be connected at once.
+	DefaultMaxClients = 100
+	// DefaultKeepAlive is the default interval of the comments sent to keep idle connections open.
+	DefaultKeepAlive = 15 * time.Second
+)
+
+// logger logs through a child of the standard logger for this backend.
+var logger = logging.Backend(BackendName)
+
+// Client serves each flush as a Server-Sent Event to every connected client.  The event is the JSON payload of the
+// webhook backend.  A client which falls more than clientBuffer flushes behind is disconnected, so a slow client
+// never blocks a flush, and an EventSource in a browser reconnects by itself.
+type Client struct {
+	transfer gostatsd.TransferCounter // Must be the first field, for the alignment of its 64-bit counters
+
+	// Must be read/written only using atomic instructions.
+	id           uint64 // Id of the last event
+	disconnected uint64 // Clients disconnected for being too slow
+
+	address      string
+	path         string
+	clientBuffer int
+	maxClients   int
+	keepAlive    time.Duration
+	now          func() time.Time // Returns current time. Useful for testing.
+
+	mu      sync.Mutex
+	clients map[*client]struct{}
+}
+
+// client is a single connected client, with the events queued for it.
+type client struct {
+	events chan event
+	slow   chan struct{} // Closed when the client is disconnected for being too slow
+}
+
+// event is a single rendered flush.
+type event struct {
+	id   uint64
+	data []byte
+}
+
+// NewClientFromViper constructs an SSE backend.
+func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
+	s := getSubViper(v, BackendName)
+	s.SetDefault("address", DefaultAddress)
+	s.SetDefault("path", DefaultPath)
+	s.SetDefault("client_buffer", DefaultClientBuffer)
+	s.SetDefault("max_clients", DefaultMaxClients)
+	s.SetDefault("keep_alive", DefaultKeepAlive)
+
+	return NewClient(
+		s.GetString("address"),
+		s.GetString("path"),
+		s.GetInt("client_buffer"),
+		s.GetInt("max_clients"),
+		s.GetDuration("keep_alive"),
+	)
+}
+
+// NewClient constructs an SSE backend, which serves events on path at address once it is run.
+func NewClient(address, path string, clientBuffer, maxClients int, keepAlive time.Duration) (*Client, error) {
+	if address == "" {
+		return nil, fmt.Errorf("[%s] address is required", BackendName)
+	}
+	if path == "" || path[0] != '/' {
+		return nil, fmt.Errorf("[%s] path should start with /", BackendName)
+	}
+	if clientBuffer <= 0 {
+		return nil, fmt.Errorf("[%s] client_buffer should be positive", BackendName)
+	}
+	if maxClients <= 0 {
+		return nil, fmt.Errorf("[%s] max_clients should be positive", BackendName)
+	}
+	if keepAlive <= 0 {
+		return nil, fmt.Errorf("[%s] keep_alive should be positive", BackendName)
+	}
+	logger.WithFields(log.Fields{
+		logging.FieldAddress: address,
+		"path":               path,
+		"client_buffer":      clientBuffer,
+		"max_clients":        maxClients,
+	}).Info("Configured backend")
+	return &Client{
+		address:      address,
+		path:         path,
+		clientBuffer: clientBuffer,
+		maxClients:   maxClients,
+		keepAlive:    keepAlive,
+		now:          time.Now,
+		clients:      map[*client]struct{}{},
+	}, nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+// TransferStats returns the bytes of events written to clients, and the time taken to render them.
+func (c *Client) TransferStats() (gostatsd.TransferStats, bool) {
+	return c.transfer.Stats(), true
+}
+
+// Run serves events until the context is done.
+func (c *Client) Run(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.Handle(c.path, c)
+	server := &http.Server{Addr: c.address, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		// Open event streams never become idle, so are closed rather than waited for.
+		_ = server.Close()
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.WithError(err).WithField(logging.FieldAddress, c.address).Error("Failed to serve events")
+	}
+}
+
+// SendEvent discards events, only metrics are sent to clients.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// SendMetricsAsync renders the flush and queues it for every connected client, without waiting for them.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	start := time.Now()
+	data, err := json.Marshal(webhook.NewPayload(metrics, c.now()))
+	if err != nil {
+		cb([]error{fmt.Errorf("[%s] failed to render event: %v", BackendName, err)})
+		return
+	}
+	c.transfer.Serialized(len(data), time.Since(start))
+	c.broadcast(event{id: atomic.AddUint64(&c.id, 1), data: data})
+	cb(nil)
+}
+
+// broadcast queues e for every connected client, disconnecting those whose queue is full.
+func (c *Client) broadcast(e event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for cl := range c.clients {
+		select {
+		case cl.events <- e:
+		default:
+			delete(c.clients, cl)
+			close(cl.slow)
+			atomic.AddUint64(&c.disconnected, 1)
+			logger.Warnf("Disconnecting a client which is %d flushes behind", c.clientBuffer)
+		}
+	}
+}
+
+// Disconnected returns the number of clients disconnected for being too slow.
+func (c *Client) Disconnected() uint64 {
+	return atomic.LoadUint64(&c.disconnected)
+}
+
+// subscribe registers a new client, or returns nil if there are already maxClients.
+func (c *Client) subscribe() *client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.clients) >= c.maxClients {
+		return nil
+	}
+	cl := &client{
+		events: make(chan event, c.clientBuffer),
+		slow:   make(chan struct{}),
+	}
+	c.clients[cl] = struct{}{}
+	return cl
+}
+
+// unsubscribe removes a client, which may already have been removed for being too slow.
+func (c *Client) unsubscribe(cl *client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.clients, cl)
+}
+
+// ServeHTTP streams events to a client until it disconnects, falls too far behind, or the server is closed.
+func (c *Client) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	cl := c.subscribe()
+	if cl == nil {
+		http.Error(w, "too many clients", http.StatusServiceUnavailable)
+		return
+	}
+	defer c.unsubscribe(cl)
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(c.keepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-cl.slow:
+			return
+		case e := <-cl.events:
+			start := time.Now()
+			var n int
+			n, err = fmt.Fprintf(w, "id: %d\nevent: flush\ndata: %s\n\n", e.id, e.data)
+			c.transfer.Sent(n, time.Since(start))
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func getSubViper(v *viper.Viper, key string) *viper.Viper {
+	n := v.Sub(key)
+	if n == nil {
+		n = viper.New()
+	}
+	return n
+}
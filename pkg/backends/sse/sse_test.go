@@ -0,0 +1,192 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/webhook"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testMetrics(value int64) *gostatsd.MetricMap {
+	return &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{"requests": {"env:prod": {Value: value, PerSecond: 0.5, Tags: gostatsd.Tags{"env:prod"}}}},
+		Gauges:   gostatsd.Gauges{},
+		Timers:   gostatsd.Timers{},
+		Sets:     gostatsd.Sets{},
+	}
+}
+
+// sseEvent is an event read by a fakeClient.
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// fakeClient reads the events of a stream, ignoring comments.
+type fakeClient struct {
+	resp    *http.Response
+	scanner *bufio.Scanner
+}
+
+func subscribe(t *testing.T, url string) *fakeClient {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return &fakeClient{resp: resp, scanner: bufio.NewScanner(resp.Body)}
+}
+
+// next returns the next event, or false if the stream is closed.
+func (fc *fakeClient) next() (sseEvent, bool) {
+	var e sseEvent
+	for fc.scanner.Scan() {
+		line := fc.scanner.Text()
+		switch {
+		case line == "":
+			if e.data != "" {
+				return e, true
+			}
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "id: "):
+			e.id = line[len("id: "):]
+		case strings.HasPrefix(line, "event: "):
+			e.event = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			e.data = line[len("data: "):]
+		}
+	}
+	return e, false
+}
+
+func newTestClient(t *testing.T, clientBuffer, maxClients int) (*Client, *httptest.Server) {
+	c, err := NewClient(DefaultAddress, DefaultPath, clientBuffer, maxClients, 10*time.Millisecond)
+	require.NoError(t, err)
+	c.now = func() time.Time { return time.Unix(100, 0).UTC() }
+	return c, httptest.NewServer(c)
+}
+
+// waitForClients waits until n clients are connected.
+func waitForClients(t *testing.T, c *Client, n int) {
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.clients) == n
+	}, time.Second, time.Millisecond)
+}
+
+func send(c *Client, m *gostatsd.MetricMap) []error {
+	var errs []error
+	c.SendMetricsAsync(context.Background(), m, func(e []error) {
+		errs = e
+	})
+	return errs
+}
+
+func TestSendMetrics(t *testing.T) {
+	t.Parallel()
+	c, server := newTestClient(t, DefaultClientBuffer, DefaultMaxClients)
+	defer server.Close()
+
+	clients := []*fakeClient{subscribe(t, server.URL), subscribe(t, server.URL)}
+	waitForClients(t, c, 2)
+	assert.Empty(t, send(c, testMetrics(5)))
+	assert.Empty(t, send(c, testMetrics(7)))
+
+	for _, fc := range clients {
+		for i, value := range []float64{5, 7} {
+			e, ok := fc.next()
+			require.True(t, ok)
+			assert.Equal(t, "flush", e.event)
+			assert.Equal(t, []string{"1", "2"}[i], e.id)
+			var p webhook.Payload
+			require.NoError(t, json.Unmarshal([]byte(e.data), &p))
+			assert.Equal(t, time.Unix(100, 0).UTC(), p.Timestamp)
+			require.Len(t, p.Metrics, 1)
+			assert.Equal(t, webhook.Metric{Name: "requests", Type: "counter", Tags: gostatsd.Tags{"env:prod"}, Value: value, PerSecond: 0.5}, p.Metrics[0])
+		}
+		fc.resp.Body.Close()
+	}
+	// Clients which disconnect are removed.
+	waitForClients(t, c, 0)
+	assert.Empty(t, send(c, testMetrics(9)))
+	assert.Zero(t, c.Disconnected())
+}
+
+func TestSlowClientDisconnected(t *testing.T) {
+	t.Parallel()
+	c, server := newTestClient(t, DefaultClientBuffer, DefaultMaxClients)
+	defer server.Close()
+
+	// A client which never reads from its queue of 2 events.
+	slow := &client{events: make(chan event, 2), slow: make(chan struct{})}
+	c.mu.Lock()
+	c.clients[slow] = struct{}{}
+	c.mu.Unlock()
+	fc := subscribe(t, server.URL)
+	defer fc.resp.Body.Close()
+	waitForClients(t, c, 2)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			assert.Empty(t, send(c, testMetrics(int64(i))))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("flush blocked by a slow client")
+	}
+
+	// The slow client is disconnected, the other receives every event.
+	_, open := <-slow.slow
+	assert.False(t, open)
+	assert.EqualValues(t, 1, c.Disconnected())
+	for i := 0; i < 5; i++ {
+		_, ok := fc.next()
+		require.True(t, ok)
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	t.Parallel()
+	c, server := newTestClient(t, DefaultClientBuffer, 1)
+	defer server.Close()
+
+	fc := subscribe(t, server.URL)
+	defer fc.resp.Body.Close()
+	waitForClients(t, c, 1)
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestNewClientFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("sse.path", "/stream")
+	b, err := NewClientFromViper(v)
+	require.NoError(t, err)
+	c := b.(*Client)
+	assert.Equal(t, DefaultAddress, c.address)
+	assert.Equal(t, "/stream", c.path)
+	assert.Equal(t, DefaultClientBuffer, c.clientBuffer)
+
+	v.Set("sse.path", "stream")
+	_, err = NewClientFromViper(v)
+	assert.Error(t, err)
+}
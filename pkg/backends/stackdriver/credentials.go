@@ -0,0 +1,190 @@
+package stackdriver
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/atlassian/gostatsd/pkg/backends/oauth"
+)
+
+const (
+	monitoringWriteScope = "https://www.googleapis.com/auth/monitoring.write"
+	defaultTokenURL      = "https://oauth2.googleapis.com/token"
+	defaultMetadataHost  = "metadata.google.internal"
+)
+
+// credentialsFile is the subset of a Google credentials JSON file that is used.
+type credentialsFile struct {
+	Type string `json:"type"`
+
+	// service_account
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// DefaultTokenSource finds credentials the same way as the Google client libraries:
+//  1. A JSON file named by the GOOGLE_APPLICATION_CREDENTIALS environment variable.
+//  2. The application default credentials file written by `gcloud auth application-default login`.
+//  3. The GCE / GKE metadata server.
+func DefaultTokenSource(client *http.Client) (oauth.TokenSource, error) {
+	if filename := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); filename != "" {
+		return NewTokenSourceFromFile(client, filename)
+	}
+	if filename := wellKnownFile(); filename != "" {
+		if _, err := os.Stat(filename); err == nil {
+			return NewTokenSourceFromFile(client, filename)
+		}
+	}
+	return newMetadataTokenSource(client), nil
+}
+
+func wellKnownFile() string {
+	const f = "application_default_credentials.json"
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("APPDATA"); dir != "" {
+			return filepath.Join(dir, "gcloud", f)
+		}
+		return ""
+	}
+	if dir := os.Getenv("HOME"); dir != "" {
+		return filepath.Join(dir, ".config", "gcloud", f)
+	}
+	return ""
+}
+
+// NewTokenSourceFromFile creates a TokenSource from a service account or authorized user JSON file.
+func NewTokenSourceFromFile(client *http.Client, filename string) (oauth.TokenSource, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read credentials: %v", err)
+	}
+	return newTokenSourceFromJSON(client, data)
+}
+
+func newTokenSourceFromJSON(client *http.Client, data []byte) (oauth.TokenSource, error) {
+	var cf credentialsFile
+	if err := json.Unmarshal(data, &cf); err != nil {
+		return nil, fmt.Errorf("unable to parse credentials: %v", err)
+	}
+	var fetch oauth.FetchFunc
+	switch cf.Type {
+	case "service_account":
+		key, err := parsePrivateKey(cf.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		if cf.TokenURI == "" {
+			cf.TokenURI = defaultTokenURL
+		}
+		fetch = func(ctx context.Context, client *http.Client) (*oauth.TokenResponse, error) {
+			assertion, err := signJWT(key, cf.PrivateKeyID, cf.ClientEmail, cf.TokenURI, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			return oauth.PostForm(ctx, client, cf.TokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	case "authorized_user":
+		fetch = func(ctx context.Context, client *http.Client) (*oauth.TokenResponse, error) {
+			return oauth.PostForm(ctx, client, defaultTokenURL, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {cf.ClientID},
+				"client_secret": {cf.ClientSecret},
+				"refresh_token": {cf.RefreshToken},
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported credentials type %q", cf.Type)
+	}
+	return oauth.NewCachingTokenSource(client, fetch), nil
+}
+
+func newMetadataTokenSource(client *http.Client) oauth.TokenSource {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = defaultMetadataHost
+	}
+	tokenURL := "http://" + host + "/computeMetadata/v1/instance/service-accounts/default/token"
+	return oauth.NewCachingTokenSource(client, func(ctx context.Context, client *http.Client) (*oauth.TokenResponse, error) {
+		req, err := http.NewRequest("GET", tokenURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		return oauth.Do(client, req.WithContext(ctx))
+	})
+}
+
+func parsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key is not an RSA key")
+		}
+		return rsaKey, nil
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key: %v", err)
+	}
+	return key, nil
+}
+
+// signJWT creates a signed JWT to exchange for an access token, see
+// https://developers.google.com/identity/protocols/OAuth2ServiceAccount#authorizingrequests
+func signJWT(key *rsa.PrivateKey, keyID, email, audience string, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": keyID,
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   email,
+		"scope": monitoringWriteScope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("unable to sign JWT: %v", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,78 @@
+package stackdriver
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceAccountTokenSource(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var requests uint32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&requests, 1)
+		if !assert.NoError(t, r.ParseForm()) {
+			return
+		}
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.PostForm.Get("grant_type"))
+
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		require.Len(t, parts, 3)
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		require.NoError(t, err)
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], sig))
+
+		claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+		require.NoError(t, err)
+		var claims map[string]interface{}
+		require.NoError(t, json.Unmarshal(claimsJSON, &claims))
+		assert.Equal(t, "sa@my-project.iam.gserviceaccount.com", claims["iss"])
+		assert.Equal(t, monitoringWriteScope, claims["scope"])
+
+		_, _ = w.Write([]byte(`{"access_token":"token123","expires_in":3600}`))
+	}))
+	defer ts.Close()
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	creds, err := json.Marshal(credentialsFile{
+		Type:        "service_account",
+		ClientEmail: "sa@my-project.iam.gserviceaccount.com",
+		PrivateKey:  string(keyPEM),
+		TokenURI:    ts.URL,
+	})
+	require.NoError(t, err)
+
+	tokens, err := newTokenSourceFromJSON(http.DefaultClient, creds)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		token, err := tokens.Token(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "token123", token)
+	}
+	assert.EqualValues(t, 1, atomic.LoadUint32(&requests)) // Token is cached
+}
+
+func TestUnsupportedCredentials(t *testing.T) {
+	t.Parallel()
+	_, err := newTokenSourceFromJSON(http.DefaultClient, []byte(`{"type":"external_account"}`))
+	assert.Error(t, err)
+}
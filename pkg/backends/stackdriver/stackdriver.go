@@ -0,0 +1,563 @@
+package stackdriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/oauth"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	stats "github.com/atlassian/gostatsd/pkg/statser"
+	"github.com/atlassian/gostatsd/pkg/util"
+
+	"github.com/cenkalti/backoff"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName                  = "stackdriver"
+	apiURL                       = "https://monitoring.googleapis.com"
+	defaultMetricPrefix          = "custom.googleapis.com/gostatsd"
+	defaultResourceType          = "global"
+	defaultMaxRequestElapsedTime = 15 * time.Second
+	defaultClientTimeout         = 9 * time.Second
+	// maxSeriesPerBatch is the maximum number of time series the API accepts in a single request.
+	maxSeriesPerBatch = 200
+	// defaultMinWriteInterval is how often the API allows a point to be written to a single time series.
+	defaultMinWriteInterval = 5 * time.Second
+	// cumulativeStartOffset is how long before its first point a cumulative time series starts, as the API rejects
+	// a cumulative point whose start time is not before its end time.
+	cumulativeStartOffset = 1 * time.Millisecond
+	// seriesExpiry is how long the state of a time series is kept after it was last seen.
+	seriesExpiry = 1 * time.Hour
+	// maxResponseSize is the maximum response size we are willing to read.
+	maxResponseSize = 10 * 1024
+)
+
+// logger logs through a child of the standard logger for this backend.
+var logger = logging.Backend(BackendName)
+
+// Client represents a Google Cloud Monitoring (Stackdriver) client.
+type Client struct {
+	batchesCreated uint64 // Accumulated number of batches created
+	batchesRetried uint64 // Accumulated number of batches retried (first send is not a retry)
+	batchesDropped uint64 // Accumulated number of batches aborted (data loss)
+	batchesSent    uint64 // Accumulated number of batches successfully sent
+	pointsSkipped  uint64 // Accumulated number of points not written due to the minimum write interval
+
+	apiEndpoint           string
+	projectID             string
+	metricPrefix          string
+	resource              monitoredResource
+	seriesPerBatch        int
+	minWriteInterval      time.Duration
+	maxRequestElapsedTime time.Duration
+	client                *http.Client
+	tokens                oauth.TokenSource
+	now                   func() time.Time // Returns current time. Useful for testing.
+
+	disabledSubtypes gostatsd.TimerSubtypes
+
+	mu         sync.Mutex
+	series     map[string]*seriesState // State of each time series, keyed by metric type and tags
+	lastPruned time.Time
+}
+
+// seriesState tracks a single time series between flushes.
+type seriesState struct {
+	start     time.Time // Start of the cumulative interval
+	total     int64     // Cumulative value of a counter
+	lastWrite time.Time // The last time a point was written
+	lastSeen  time.Time
+}
+
+type createTimeSeriesRequest struct {
+	TimeSeries []timeSeries `json:"timeSeries"`
+}
+
+type timeSeries struct {
+	Metric     metricDescriptor  `json:"metric"`
+	Resource   monitoredResource `json:"resource"`
+	MetricKind string            `json:"metricKind"`
+	ValueType  string            `json:"valueType"`
+	Points     []point           `json:"points"`
+}
+
+type metricDescriptor struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type monitoredResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type point struct {
+	Interval timeInterval `json:"interval"`
+	Value    typedValue   `json:"value"`
+}
+
+type timeInterval struct {
+	StartTime string `json:"startTime,omitempty"`
+	EndTime   string `json:"endTime"`
+}
+
+type typedValue struct {
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	Int64Value  string   `json:"int64Value,omitempty"` // int64 is encoded as a string in the JSON API
+}
+
+// NewClientFromViper returns a new Stackdriver client.
+func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
+	sd := getSubViper(v, "stackdriver")
+	sd.SetDefault("api_endpoint", apiURL)
+	sd.SetDefault("metric_prefix", defaultMetricPrefix)
+	sd.SetDefault("resource_type", defaultResourceType)
+	sd.SetDefault("series_per_batch", maxSeriesPerBatch)
+	sd.SetDefault("min_write_interval", defaultMinWriteInterval)
+	sd.SetDefault("client_timeout", defaultClientTimeout)
+	sd.SetDefault("max_request_elapsed_time", defaultMaxRequestElapsedTime)
+
+	client := &http.Client{
+		Timeout: sd.GetDuration("client_timeout"),
+	}
+	tokens, err := DefaultTokenSource(client)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", BackendName, err)
+	}
+
+	return NewClient(
+		sd.GetString("api_endpoint"),
+		sd.GetString("project_id"),
+		sd.GetString("metric_prefix"),
+		sd.GetString("resource_type"),
+		sd.GetStringMapString("resource_labels"),
+		sd.GetInt("series_per_batch"),
+		sd.GetDuration("min_write_interval"),
+		sd.GetDuration("max_request_elapsed_time"),
+		client,
+		tokens,
+		util.DisabledSubMetrics(v),
+	)
+}
+
+// NewClient returns a new Stackdriver client.
+func NewClient(apiEndpoint, projectID, metricPrefix, resourceType string, resourceLabels map[string]string, seriesPerBatch int, minWriteInterval, maxRequestElapsedTime time.Duration, client *http.Client, tokens oauth.TokenSource, disabled gostatsd.TimerSubtypes) (*Client, error) {
+	if apiEndpoint == "" {
+		return nil, fmt.Errorf("[%s] api_endpoint is required", BackendName)
+	}
+	if projectID == "" {
+		return nil, fmt.Errorf("[%s] project_id is required", BackendName)
+	}
+	if resourceType == "" {
+		return nil, fmt.Errorf("[%s] resource_type is required", BackendName)
+	}
+	if seriesPerBatch <= 0 || seriesPerBatch > maxSeriesPerBatch {
+		return nil, fmt.Errorf("[%s] series_per_batch must be between 1 and %d", BackendName, maxSeriesPerBatch)
+	}
+	if minWriteInterval < 0 {
+		return nil, fmt.Errorf("[%s] min_write_interval must not be negative", BackendName)
+	}
+	if maxRequestElapsedTime <= 0 {
+		return nil, fmt.Errorf("[%s] max_request_elapsed_time must be positive", BackendName)
+	}
+
+	labels := make(map[string]string, len(resourceLabels)+1)
+	for k, v := range resourceLabels {
+		labels[k] = v
+	}
+	if _, ok := labels["project_id"]; !ok && resourceType == defaultResourceType {
+		labels["project_id"] = projectID
+	}
+
+	logger.WithFields(log.Fields{
+		"project_id":         projectID,
+		"metric_prefix":      metricPrefix,
+		"resource_type":      resourceType,
+		"series_per_batch":   seriesPerBatch,
+		"min_write_interval": minWriteInterval,
+	}).Info("Configured backend")
+
+	return &Client{
+		apiEndpoint:           strings.TrimSuffix(apiEndpoint, "/"),
+		projectID:             projectID,
+		metricPrefix:          strings.TrimSuffix(metricPrefix, "/"),
+		resource:              monitoredResource{Type: resourceType, Labels: labels},
+		seriesPerBatch:        seriesPerBatch,
+		minWriteInterval:      minWriteInterval,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		client:                client,
+		tokens:                tokens,
+		now:                   time.Now,
+		disabledSubtypes:      disabled,
+		series:                map[string]*seriesState{},
+	}, nil
+}
+
+// SendMetricsAsync flushes the metrics to Stackdriver, preparing payload synchronously but doing the send asynchronously.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	series := c.processMetrics(metrics)
+	if len(series) == 0 {
+		cb(nil)
+		return
+	}
+
+	var batches [][]timeSeries
+	for start := 0; start < len(series); start += c.seriesPerBatch {
+		end := start + c.seriesPerBatch
+		if end > len(series) {
+			end = len(series)
+		}
+		batches = append(batches, series[start:end])
+	}
+	atomic.AddUint64(&c.batchesCreated, uint64(len(batches)))
+
+	go func() {
+		errs := make([]error, 0, len(batches))
+		for _, batch := range batches {
+			errs = append(errs, c.post(ctx, batch))
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		cb(errs)
+	}()
+}
+
+// RunMetrics emits internal metrics for the backend until the context is closed.
+func (c *Client) RunMetrics(ctx context.Context, statser stats.Statser) {
+	statser = statser.WithTags(gostatsd.Tags{"backend:" + BackendName})
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.created", float64(atomic.LoadUint64(&c.batchesCreated)), nil)
+			statser.Gauge("backend.retried", float64(atomic.LoadUint64(&c.batchesRetried)), nil)
+			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&c.batchesDropped)), nil)
+			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&c.batchesSent)), nil)
+			statser.Gauge("backend.points_skipped", float64(atomic.LoadUint64(&c.pointsSkipped)), nil)
+		}
+	}
+}
+
+// processMetrics converts metrics to time series.  Counters are cumulative metrics, everything else is a gauge.
+// A time series is only included if the minimum write interval has elapsed since it was last written, as the API
+// rejects points which are written more often.  Counters are accumulated regardless, so no counts are lost.
+func (c *Client) processMetrics(metrics *gostatsd.MetricMap) []timeSeries {
+	now := c.now()
+	endTime := now.UTC().Format(time.RFC3339Nano)
+	var series []timeSeries
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// state returns the state of a time series, and whether a point can be written for it now.
+	state := func(key string) (*seriesState, bool) {
+		s, ok := c.series[key]
+		if !ok {
+			s = &seriesState{start: now.Add(-cumulativeStartOffset)}
+			c.series[key] = s
+		}
+		s.lastSeen = now
+		if !s.lastWrite.IsZero() && now.Sub(s.lastWrite) < c.minWriteInterval {
+			atomic.AddUint64(&c.pointsSkipped, 1)
+			return s, false
+		}
+		s.lastWrite = now
+		return s, true
+	}
+
+	addGauge := func(name, tagsKey string, value float64, hostname string, tags gostatsd.Tags) {
+		metricType := c.metricType(name)
+		if _, ok := state(metricType + "|" + tagsKey); !ok {
+			return
+		}
+		v := value
+		series = append(series, timeSeries{
+			Metric:     metricDescriptor{Type: metricType, Labels: labels(hostname, tags)},
+			Resource:   c.resource,
+			MetricKind: "GAUGE",
+			ValueType:  "DOUBLE",
+			Points: []point{{
+				Interval: timeInterval{EndTime: endTime},
+				Value:    typedValue{DoubleValue: &v},
+			}},
+		})
+	}
+
+	metrics.EachCounter(func(key, tagsKey string, counter gostatsd.Counter) {
+		metricType := c.metricType(key)
+		s, ok := state(metricType + "|" + tagsKey)
+		s.total += counter.Value
+		if !ok {
+			return
+		}
+		series = append(series, timeSeries{
+			Metric:     metricDescriptor{Type: metricType, Labels: labels(counter.Hostname, counter.Tags)},
+			Resource:   c.resource,
+			MetricKind: "CUMULATIVE",
+			ValueType:  "INT64",
+			Points: []point{{
+				Interval: timeInterval{
+					StartTime: s.start.UTC().Format(time.RFC3339Nano),
+					EndTime:   endTime,
+				},
+				Value: typedValue{Int64Value: strconv.FormatInt(s.total, 10)},
+			}},
+		})
+	})
+
+	metrics.EachTimer(func(key, tagsKey string, timer gostatsd.Timer) {
+		add := func(sub string, value float64) {
+			addGauge(key+"."+sub, tagsKey, value, timer.Hostname, timer.Tags)
+		}
+		if !c.disabledSubtypes.Lower {
+			add("lower", timer.Min)
+		}
+		if !c.disabledSubtypes.Upper {
+			add("upper", timer.Max)
+		}
+		if !c.disabledSubtypes.Count {
+			add("count", float64(timer.Count))
+		}
+		if !c.disabledSubtypes.CountPerSecond {
+			add("count_ps", timer.PerSecond)
+		}
+		if !c.disabledSubtypes.Mean {
+			add("mean", timer.Mean)
+		}
+		if !c.disabledSubtypes.Median {
+			add("median", timer.Median)
+		}
+		if !c.disabledSubtypes.StdDev {
+			add("std", timer.StdDev)
+		}
+		if !c.disabledSubtypes.Sum {
+			add("sum", timer.Sum)
+		}
+		if !c.disabledSubtypes.SumSquares {
+			add("sum_squares", timer.SumSquares)
+		}
+		for _, pct := range timer.Percentiles {
+			add(pct.Str, pct.Float)
+		}
+	})
+
+	metrics.EachGauge(func(key, tagsKey string, g gostatsd.Gauge) {
+		addGauge(key, tagsKey, g.Value, g.Hostname, g.Tags)
+	})
+
+	metrics.EachSet(func(key, tagsKey string, set gostatsd.Set) {
+		addGauge(key, tagsKey, float64(set.Cardinality()), set.Hostname, set.Tags)
+	})
+
+	if now.Sub(c.lastPruned) > seriesExpiry/10 {
+		for key, s := range c.series {
+			if now.Sub(s.lastSeen) > seriesExpiry {
+				delete(c.series, key)
+			}
+		}
+		c.lastPruned = now
+	}
+
+	return series
+}
+
+// metricType converts a statsd bucket name to a metric type, with "." used as the path separator.
+func (c *Client) metricType(name string) string {
+	return c.metricPrefix + "/" + strings.Map(func(r rune) rune {
+		switch {
+		case r == '.':
+			return '/'
+		case r == '_' || r == '/' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9'):
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// labels converts tags to metric labels.  Tags without a value are given the value "set".
+func labels(hostname string, tags gostatsd.Tags) map[string]string {
+	if hostname == "" && len(tags) == 0 {
+		return nil
+	}
+	l := make(map[string]string, len(tags)+1)
+	for _, tag := range tags {
+		key, value := tag, "set"
+		if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+			key, value = tag[:idx], tag[idx+1:]
+		}
+		l[labelKey(key)] = value
+	}
+	if hostname != "" {
+		l["host"] = hostname
+	}
+	return l
+}
+
+// labelKey converts a tag key to a valid label key, which must match [a-z][a-z0-9_]*
+func labelKey(key string) string {
+	key = strings.Map(func(r rune) rune {
+		switch {
+		case ('a' <= r && r <= 'z') || ('0' <= r && r <= '9'):
+			return r
+		case 'A' <= r && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '_'
+		}
+	}, key)
+	if key == "" || key[0] < 'a' || key[0] > 'z' {
+		key = "tag_" + key
+	}
+	return key
+}
+
+func (c *Client) post(ctx context.Context, series []timeSeries) error {
+	body, err := json.Marshal(createTimeSeriesRequest{TimeSeries: series})
+	if err != nil {
+		atomic.AddUint64(&c.batchesDropped, 1)
+		return fmt.Errorf("[%s] unable to marshal time series: %v", BackendName, err)
+	}
+	url := fmt.Sprintf("%s/v3/projects/%s/timeSeries", c.apiEndpoint, c.projectID)
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = c.maxRequestElapsedTime
+	for {
+		if err = c.doPost(ctx, url, body); err == nil {
+			atomic.AddUint64(&c.batchesSent, 1)
+			return nil
+		}
+
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			atomic.AddUint64(&c.batchesDropped, 1)
+			return fmt.Errorf("[%s] %v", BackendName, err)
+		}
+
+		logger.WithError(err).WithField(logging.FieldDuration, next).Warn("Failed to send time series, retrying")
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		atomic.AddUint64(&c.batchesRetried, 1)
+	}
+}
+
+func (c *Client) doPost(ctx context.Context, url string, body []byte) error {
+	token, err := c.tokens.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get access token: %v", err)
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error POSTing: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(respBody)
+		logger.WithFields(log.Fields{
+			"status": resp.StatusCode,
+			"body":   string(b),
+		}).Info("Failed request")
+		return fmt.Errorf("received bad status code %d", resp.StatusCode)
+	}
+	_, _ = io.Copy(ioutil.Discard, respBody)
+	return nil
+}
+
+// Connect checks an access token can be obtained.
+func (c *Client) Connect(ctx context.Context) error {
+	if _, err := c.tokens.Token(ctx); err != nil {
+		return fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	return nil
+}
+
+// SendEvent discards events, as Cloud Monitoring has no events API.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+// savedSeries is the state of a cumulative time series saved across a restart.
+type savedSeries struct {
+	Start time.Time `json:"start"`
+	Total int64     `json:"total"`
+}
+
+// SaveState returns the start and total of each cumulative counter, so they continue from the same values after a
+// restart rather than starting again from zero.
+func (c *Client) SaveState() ([]byte, error) {
+	c.mu.Lock()
+	saved := make(map[string]savedSeries, len(c.series))
+	for key, s := range c.series {
+		if s.total != 0 {
+			saved[key] = savedSeries{Start: s.start, Total: s.total}
+		}
+	}
+	c.mu.Unlock()
+	if len(saved) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(saved)
+}
+
+// RestoreState restores the cumulative counters returned by SaveState.
+func (c *Client) RestoreState(state []byte) error {
+	var saved map[string]savedSeries
+	if err := json.Unmarshal(state, &saved); err != nil {
+		return fmt.Errorf("[%s] invalid state: %v", BackendName, err)
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, s := range saved {
+		c.series[key] = &seriesState{start: s.Start, total: s.Total, lastSeen: now}
+	}
+	return nil
+}
+
+func getSubViper(v *viper.Viper, key string) *viper.Viper {
+	n := v.Sub(key)
+	if n == nil {
+		n = viper.New()
+	}
+	return n
+}
@@ -0,0 +1,232 @@
+package stackdriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticTokenSource string
+
+func (s staticTokenSource) Token(ctx context.Context) (string, error) {
+	return string(s), nil
+}
+
+type recordingServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []createTimeSeriesRequest
+}
+
+func newRecordingServer(t *testing.T) *recordingServer {
+	rs := &recordingServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/projects/my-project/timeSeries", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		assert.Equal(t, "Bearer token123", r.Header.Get("Authorization"))
+		var req createTimeSeriesRequest
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&req)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rs.mu.Lock()
+		rs.requests = append(rs.requests, req)
+		rs.mu.Unlock()
+	})
+	rs.Server = httptest.NewServer(mux)
+	return rs
+}
+
+func (rs *recordingServer) series() []timeSeries {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	var series []timeSeries
+	for _, req := range rs.requests {
+		series = append(series, req.TimeSeries...)
+	}
+	return series
+}
+
+func newTestClient(t *testing.T, url string, minWriteInterval time.Duration) *Client {
+	client, err := NewClient(url, "my-project", defaultMetricPrefix, defaultResourceType, nil, maxSeriesPerBatch, minWriteInterval, 1*time.Second, http.DefaultClient, staticTokenSource("token123"), gostatsd.TimerSubtypes{})
+	require.NoError(t, err)
+	return client
+}
+
+func send(t *testing.T, client *Client, mm *gostatsd.MetricMap) {
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+		res <- errs
+	})
+	for _, err := range <-res {
+		assert.NoError(t, err)
+	}
+}
+
+func TestNewClientValidation(t *testing.T) {
+	t.Parallel()
+	_, err := NewClient(apiURL, "", defaultMetricPrefix, defaultResourceType, nil, maxSeriesPerBatch, defaultMinWriteInterval, time.Second, http.DefaultClient, staticTokenSource(""), gostatsd.TimerSubtypes{})
+	assert.Error(t, err)
+	_, err = NewClient(apiURL, "my-project", defaultMetricPrefix, defaultResourceType, nil, maxSeriesPerBatch+1, defaultMinWriteInterval, time.Second, http.DefaultClient, staticTokenSource(""), gostatsd.TimerSubtypes{})
+	assert.Error(t, err)
+}
+
+func TestSendMetrics(t *testing.T) {
+	t.Parallel()
+	rs := newRecordingServer(t)
+	defer rs.Close()
+	client := newTestClient(t, rs.URL, 0)
+
+	mm := newMetricMap()
+	mm.Counters["stat.count"] = map[string]gostatsd.Counter{
+		"env:prod,s:host": gostatsd.NewCounter(gostatsd.Nanotime(time.Now().UnixNano()), 5, "host", gostatsd.Tags{"env:prod", "Canary"}),
+	}
+	mm.Gauges["stat.gauge"] = map[string]gostatsd.Gauge{
+		"": gostatsd.NewGauge(gostatsd.Nanotime(time.Now().UnixNano()), 1.5, "", nil),
+	}
+	timer := gostatsd.NewTimer(gostatsd.Nanotime(time.Now().UnixNano()), []float64{1, 2}, "", nil)
+	timer.Percentiles.Set("count_90", 2)
+	mm.Timers["stat.timer"] = map[string]gostatsd.Timer{"": timer}
+
+	send(t, client, mm)
+
+	byType := map[string]timeSeries{}
+	for _, ts := range rs.series() {
+		byType[ts.Metric.Type] = ts
+	}
+
+	counter := byType["custom.googleapis.com/gostatsd/stat/count"]
+	assert.Equal(t, "CUMULATIVE", counter.MetricKind)
+	assert.Equal(t, "INT64", counter.ValueType)
+	assert.Equal(t, "5", counter.Points[0].Value.Int64Value)
+	startTime, err := time.Parse(time.RFC3339Nano, counter.Points[0].Interval.StartTime)
+	require.NoError(t, err)
+	endTime, err := time.Parse(time.RFC3339Nano, counter.Points[0].Interval.EndTime)
+	require.NoError(t, err)
+	assert.True(t, startTime.Before(endTime), "start time %v is not before end time %v", startTime, endTime)
+	assert.Equal(t, map[string]string{"env": "prod", "canary": "set", "host": "host"}, counter.Metric.Labels)
+	assert.Equal(t, monitoredResource{Type: "global", Labels: map[string]string{"project_id": "my-project"}}, counter.Resource)
+
+	gauge := byType["custom.googleapis.com/gostatsd/stat/gauge"]
+	assert.Equal(t, "GAUGE", gauge.MetricKind)
+	assert.Equal(t, "DOUBLE", gauge.ValueType)
+	require.NotNil(t, gauge.Points[0].Value.DoubleValue)
+	assert.Equal(t, 1.5, *gauge.Points[0].Value.DoubleValue)
+
+	pct := byType["custom.googleapis.com/gostatsd/stat/timer/count_90"]
+	assert.Equal(t, "GAUGE", pct.MetricKind)
+	require.NotNil(t, pct.Points[0].Value.DoubleValue)
+	assert.Equal(t, 2.0, *pct.Points[0].Value.DoubleValue)
+	assert.Contains(t, byType, "custom.googleapis.com/gostatsd/stat/timer/upper")
+}
+
+func TestSendMetricsInBatches(t *testing.T) {
+	t.Parallel()
+	rs := newRecordingServer(t)
+	defer rs.Close()
+	client := newTestClient(t, rs.URL, 0)
+
+	mm := newMetricMap()
+	for i := 0; i < 450; i++ {
+		mm.Gauges[fmt.Sprintf("gauge%d", i)] = map[string]gostatsd.Gauge{
+			"": gostatsd.NewGauge(gostatsd.Nanotime(time.Now().UnixNano()), 1, "", nil),
+		}
+	}
+	send(t, client, mm)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	require.Len(t, rs.requests, 3)
+	assert.Len(t, rs.requests[0].TimeSeries, 200)
+	assert.Len(t, rs.requests[1].TimeSeries, 200)
+	assert.Len(t, rs.requests[2].TimeSeries, 50)
+}
+
+func TestMinWriteInterval(t *testing.T) {
+	t.Parallel()
+	rs := newRecordingServer(t)
+	defer rs.Close()
+	client := newTestClient(t, rs.URL, 5*time.Second)
+	now := time.Unix(1000, 0)
+	client.now = func() time.Time {
+		return now
+	}
+
+	counters := func(value int64) *gostatsd.MetricMap {
+		mm := newMetricMap()
+		mm.Counters["stat"] = map[string]gostatsd.Counter{
+			"": gostatsd.NewCounter(gostatsd.Nanotime(now.UnixNano()), value, "", nil),
+		}
+		return mm
+	}
+
+	send(t, client, counters(1))
+	now = now.Add(2 * time.Second)
+	send(t, client, counters(2)) // Skipped, but still accumulated
+	now = now.Add(3 * time.Second)
+	send(t, client, counters(3))
+
+	series := rs.series()
+	require.Len(t, series, 2)
+	assert.Equal(t, "1", series[0].Points[0].Value.Int64Value)
+	assert.Equal(t, "6", series[1].Points[0].Value.Int64Value)
+	assert.Equal(t, series[0].Points[0].Interval.StartTime, series[1].Points[0].Interval.StartTime)
+	assert.EqualValues(t, 1, client.pointsSkipped)
+}
+
+func TestLabelKey(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "env", labelKey("Env"))
+	assert.Equal(t, "my_key", labelKey("my-key"))
+	assert.Equal(t, "tag_1abc", labelKey("1abc"))
+	assert.Equal(t, "tag_", labelKey(""))
+}
+
+func newMetricMap() *gostatsd.MetricMap {
+	return &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{},
+		Timers:   gostatsd.Timers{},
+		Gauges:   gostatsd.Gauges{},
+		Sets:     gostatsd.Sets{},
+	}
+}
+
+func TestSaveAndRestoreState(t *testing.T) {
+	t.Parallel()
+	rs := newRecordingServer(t)
+	defer rs.Close()
+	client := newTestClient(t, rs.URL, 0)
+
+	state, err := client.SaveState()
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	mm := newMetricMap()
+	mm.Counters["stat"] = map[string]gostatsd.Counter{
+		"": gostatsd.NewCounter(gostatsd.Nanotime(time.Now().UnixNano()), 5, "", nil),
+	}
+	send(t, client, mm)
+	state, err = client.SaveState()
+	require.NoError(t, err)
+
+	// The restored counter continues from the same start and total.
+	restored := newTestClient(t, rs.URL, 0)
+	require.NoError(t, restored.RestoreState(state))
+	send(t, restored, mm)
+	series := rs.series()
+	require.Len(t, series, 2)
+	assert.Equal(t, "10", series[1].Points[0].Value.Int64Value)
+	assert.Equal(t, series[0].Points[0].Interval.StartTime, series[1].Points[0].Interval.StartTime)
+
+	assert.Error(t, restored.RestoreState([]byte("{")))
+}
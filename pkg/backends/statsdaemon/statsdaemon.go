@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/backends/sender"
+	"github.com/atlassian/gostatsd/pkg/logging"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -35,9 +37,13 @@ const (
 	maxConcurrentSends = 10
 )
 
+// logger logs through a child of the standard logger for this backend.
+var logger = logging.Backend(BackendName)
+
 // Client is an object that is used to send messages to a statsd server's UDP or TCP interface.
 type Client struct {
 	packetSize  int
+	stream      bool // The transport is a stream rather than datagrams
 	disableTags bool
 	sender      sender.Sender
 }
@@ -47,6 +53,9 @@ type Client struct {
 // if contents are processed somehow and are no longer needed).
 type overflowHandler func(*bytes.Buffer) (buf *bytes.Buffer, stop bool)
 
+// errStopProcessing is returned by the frame function when the overflowHandler asks to stop.
+var errStopProcessing = errors.New("stop processing")
+
 func (client *Client) Run(ctx context.Context) {
 	client.sender.Run(ctx)
 }
@@ -72,22 +81,25 @@ func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.Me
 }
 
 func (client *Client) processMetrics(metrics *gostatsd.MetricMap, handler overflowHandler) {
-	type stopProcessing struct {
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			if _, ok := r.(stopProcessing); !ok {
-				panic(r)
-			}
+	bw := sender.NewBatchWriter(client.packetSize, !client.stream, client.sender.GetBuffer(), func(frame *bytes.Buffer) (*bytes.Buffer, error) {
+		b, stop := handler(frame)
+		if stop {
+			return nil, errStopProcessing
 		}
-	}()
-	buf := client.sender.GetBuffer()
+		return b, nil
+	})
+	start := time.Now()
 	defer func() {
-		// Have to use a closure because buf pointer might change its value later
-		client.sender.PutBuffer(buf)
+		// The buffer is only released once processing is complete, as the writer may replace it
+		client.sender.PutBuffer(bw.Buffer())
+		client.sender.Transfer.Serialized(int(bw.Stats().Bytes), time.Since(start)-bw.FrameTime())
 	}()
 	line := new(bytes.Buffer)
+	var err error
 	writeLine := func(format, name, tags string, value interface{}) {
+		if err == errStopProcessing {
+			return
+		}
 		line.Reset()
 		if tags == "" || client.disableTags {
 			format += "\n"
@@ -96,43 +108,43 @@ func (client *Client) processMetrics(metrics *gostatsd.MetricMap, handler overfl
 			format += "|#%s\n"
 			fmt.Fprintf(line, format, name, value, tags) // #nosec
 		}
-		// Make sure we don't go over max udp datagram size
-		if buf.Len()+line.Len() > client.packetSize {
-			b, stop := handler(buf)
-			if stop {
-				panic(stopProcessing{})
-			}
-			buf = b
-		}
-		fmt.Fprint(buf, line) // #nosec
+		err = bw.Write(line.Bytes())
 	}
-	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+	metrics.EachCounter(func(key, tagsKey string, counter gostatsd.Counter) {
 		// do not send statsd stats as they will be recalculated on the master instead
 		if !strings.HasPrefix(key, "statsd.") {
 			writeLine("%s:%d|c", key, tagsKey, counter.Value)
 		}
 	})
-	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+	metrics.EachTimer(func(key, tagsKey string, timer gostatsd.Timer) {
 		for _, tr := range timer.Values {
 			writeLine("%s:%f|ms", key, tagsKey, tr)
 		}
 	})
-	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+	metrics.EachGauge(func(key, tagsKey string, gauge gostatsd.Gauge) {
 		writeLine("%s:%f|g", key, tagsKey, gauge.Value)
 	})
-	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
-		for k := range set.Values {
-			writeLine("%s:%s|s", key, tagsKey, k)
-		}
+	metrics.EachSet(func(key, tagsKey string, set gostatsd.Set) {
+		// An approximate set has no members to forward.
+		set.EachMember(func(member string) {
+			writeLine("%s:%s|s", key, tagsKey, member)
+		})
 	})
-	if buf.Len() > 0 {
-		b, stop := handler(buf) // Process what's left in the buffer
-		if !stop {
-			buf = b
-		}
+	_ = bw.Flush() // Process what's left in the buffer, a no-op if the handler asked to stop
+	if oversized := bw.Stats().Oversized; oversized > 0 && !client.stream {
+		logger.Warnf("Dropped %d metrics larger than the maximum packet size of %d bytes", oversized, client.packetSize)
 	}
 }
 
+// Connect checks the statsd server is reachable.  Over UDP this only checks the address can be resolved.
+func (client *Client) Connect(ctx context.Context) error {
+	conn, err := client.sender.ConnFactory()
+	if err != nil {
+		return fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	return conn.Close()
+}
+
 // SendEvent sends events to the statsd master server.
 func (client *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
 	conn, err := client.sender.ConnFactory()
@@ -205,8 +217,13 @@ func NewClient(address string, dialTimeout, writeTimeout time.Duration, disableT
 	if writeTimeout < 0 {
 		return nil, fmt.Errorf("[%s] writeTimeout should be non-negative", BackendName)
 	}
-	log.Infof("[%s] address=%s dialTimeout=%s writeTimeout=%s", BackendName, address, dialTimeout, writeTimeout)
+	logger.WithFields(log.Fields{
+		logging.FieldAddress: address,
+		"dial_timeout":       dialTimeout,
+		"write_timeout":      writeTimeout,
+	}).Info("Configured backend")
 	var packetSize int
+	var stream bool
 	var connFactory func() (net.Conn, error)
 
 	if tlsConfig != nil {
@@ -216,12 +233,14 @@ func NewClient(address string, dialTimeout, writeTimeout time.Duration, disableT
 		}
 
 		packetSize = maxTCPPacketSize
+		stream = true
 		dialer := &net.Dialer{Timeout: dialTimeout}
 		connFactory = func() (net.Conn, error) {
 			return tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
 		}
 	} else if tcpTransport {
 		packetSize = maxTCPPacketSize
+		stream = true
 		connFactory = func() (net.Conn, error) {
 			return net.DialTimeout("tcp", address, dialTimeout)
 		}
@@ -233,8 +252,10 @@ func NewClient(address string, dialTimeout, writeTimeout time.Duration, disableT
 	}
 	return &Client{
 		packetSize:  packetSize,
+		stream:      stream,
 		disableTags: disableTags,
 		sender: sender.Sender{
+			Logger:      logger,
 			ConnFactory: connFactory,
 			Sink:        make(chan sender.Stream, maxConcurrentSends),
 			BufPool: sync.Pool{
@@ -280,6 +301,16 @@ func (client *Client) Name() string {
 	return BackendName
 }
 
+// TransferStats returns the bytes written to the statsd server and the time taken.
+func (client *Client) TransferStats() (gostatsd.TransferStats, bool) {
+	return client.sender.Transfer.Stats(), true
+}
+
+// WantsRawTimers returns true, as each timer sample is forwarded.
+func (client *Client) WantsRawTimers() bool {
+	return true
+}
+
 func getSubViper(v *viper.Viper, key string) *viper.Viper {
 	n := v.Sub(key)
 	if n == nil {
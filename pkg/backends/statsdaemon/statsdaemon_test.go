@@ -14,7 +14,8 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-var longName = strings.Repeat("t", maxUDPPacketSize-5)
+// longName makes a line which exactly fills a UDP packet.
+var longName = strings.Repeat("t", maxUDPPacketSize-len(":5|c|#tag1\n"))
 var m = gostatsd.MetricMap{
 	Counters: gostatsd.Counters{
 		longName: map[string]gostatsd.Counter{
@@ -86,3 +87,36 @@ func TestProcessMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessMetricsDropsOversizedUDP(t *testing.T) {
+	t.Parallel()
+	oversized := gostatsd.MetricMap{
+		Gauges: gostatsd.Gauges{
+			strings.Repeat("t", maxUDPPacketSize): map[string]gostatsd.Gauge{
+				"": gostatsd.NewGauge(gostatsd.Nanotime(time.Now().UnixNano()), 1, "", nil),
+			},
+			"small": map[string]gostatsd.Gauge{
+				"": gostatsd.NewGauge(gostatsd.Nanotime(time.Now().UnixNano()), 2, "", nil),
+			},
+		},
+	}
+
+	c, err := NewClient("localhost:8125", 1*time.Second, 1*time.Second, false, false, nil)
+	require.NoError(t, err)
+	var packets []string
+	c.processMetrics(&oversized, func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
+		packets = append(packets, buf.String())
+		return new(bytes.Buffer), false
+	})
+	assert.Equal(t, []string{"small:2.000000|g\n"}, packets)
+
+	// Over TCP there is no packet size limit, so nothing is dropped
+	c, err = NewClient("localhost:8125", 1*time.Second, 1*time.Second, false, true, nil)
+	require.NoError(t, err)
+	var written int
+	c.processMetrics(&oversized, func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
+		written += strings.Count(buf.String(), "\n")
+		return new(bytes.Buffer), false
+	})
+	assert.Equal(t, 2, written)
+}
@@ -8,14 +8,18 @@ import (
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	"github.com/atlassian/gostatsd/pkg/util"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 // BackendName is the name of this backend.
 const BackendName = "stdout"
 
+// logger logs through a child of the standard logger for this backend.
+var logger = logging.Backend(BackendName)
+
 // Client is an object that is used to send messages to stdout.
 type Client struct {
 	disabledSubtypes gostatsd.TimerSubtypes
@@ -24,7 +28,7 @@ type Client struct {
 // NewClientFromViper constructs a stdout backend.
 func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 	return NewClient(
-		gostatsd.DisabledSubMetrics(v),
+		util.DisabledSubMetrics(v),
 	)
 }
 
@@ -60,7 +64,7 @@ func (client Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.Met
 }
 
 func writePayload(buf *bytes.Buffer) (retErr error) {
-	writer := log.StandardLogger().Writer()
+	writer := logger.Writer()
 	defer func() {
 		if err := writer.Close(); err != nil && retErr == nil {
 			retErr = err
@@ -73,12 +77,12 @@ func writePayload(buf *bytes.Buffer) (retErr error) {
 func preparePayload(metrics *gostatsd.MetricMap, disabled *gostatsd.TimerSubtypes) *bytes.Buffer {
 	buf := new(bytes.Buffer)
 	now := time.Now().Unix()
-	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+	metrics.EachCounter(func(key, tagsKey string, counter gostatsd.Counter) {
 		nk := composeMetricName(key, tagsKey)
 		fmt.Fprintf(buf, "stats.counter.%s.count %d %d\n", nk, counter.Value, now)          // #nosec
 		fmt.Fprintf(buf, "stats.counter.%s.per_second %f %d\n", nk, counter.PerSecond, now) // #nosec
 	})
-	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+	metrics.EachTimer(func(key, tagsKey string, timer gostatsd.Timer) {
 		nk := composeMetricName(key, tagsKey)
 		if !disabled.Lower {
 			fmt.Fprintf(buf, "stats.timers.%s.lower %f %d\n", nk, timer.Min, now) // #nosec
@@ -111,20 +115,20 @@ func preparePayload(metrics *gostatsd.MetricMap, disabled *gostatsd.TimerSubtype
 			fmt.Fprintf(buf, "stats.timers.%s.%s %f %d\n", nk, pct.Str, pct.Float, now) // #nosec
 		}
 	})
-	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+	metrics.EachGauge(func(key, tagsKey string, gauge gostatsd.Gauge) {
 		nk := composeMetricName(key, tagsKey)
 		fmt.Fprintf(buf, "stats.gauge.%s %f %d\n", nk, gauge.Value, now) // #nosec
 	})
-	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+	metrics.EachSet(func(key, tagsKey string, set gostatsd.Set) {
 		nk := composeMetricName(key, tagsKey)
-		fmt.Fprintf(buf, "stats.set.%s %d %d\n", nk, len(set.Values), now) // #nosec
+		fmt.Fprintf(buf, "stats.set.%s %d %d\n", nk, set.Cardinality(), now) // #nosec
 	})
 	return buf
 }
 
 // SendEvent prints events to the stdout.
 func (client Client) SendEvent(ctx context.Context, e *gostatsd.Event) (retErr error) {
-	writer := log.StandardLogger().Writer()
+	writer := logger.Writer()
 	defer func() {
 		if err := writer.Close(); err != nil && retErr == nil {
 			retErr = err
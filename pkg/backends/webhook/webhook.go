@@ -0,0 +1,372 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+
+	"github.com/cenkalti/backoff"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName = "webhook"
+	// DefaultMethod is the default HTTP method of requests.
+	DefaultMethod = "POST"
+	// DefaultContentType is the default Content-Type of requests.
+	DefaultContentType = "application/json"
+	// DefaultBodyTemplate is the default template of the request body, a JSON document of the payload.
+	DefaultBodyTemplate = "{{json .}}"
+	// DefaultClientTimeout is the default timeout of a single request.
+	DefaultClientTimeout = 10 * time.Second
+	// DefaultMaxRequestElapsedTime is the default time to retry a flush for before it is dropped.
+	DefaultMaxRequestElapsedTime = 15 * time.Second
+
+	// maxResponseSize is the maximum response size we are willing to read.
+	maxResponseSize = 10 * 1024
+)
+
+// logger logs through a child of the standard logger for this backend.
+var logger = logging.Backend(BackendName)
+
+// Payload is the data the body template is executed with, once per flush.
+type Payload struct {
+	Timestamp time.Time `json:"timestamp"` // Time of the flush
+	Metrics   []Metric  `json:"metrics"`   // Metrics of every type, counters first, then gauges, timers and sets
+}
+
+// Metric is a single metric in a Payload.
+type Metric struct {
+	Name      string        `json:"name"`
+	Type      string        `json:"type"` // counter, gauge, timer or set
+	Tags      gostatsd.Tags `json:"tags"`
+	Host      string        `json:"host,omitempty"`
+	Value     float64       `json:"value"`                // Counter value, gauge value, timer count or set cardinality
+	PerSecond float64       `json:"per_second,omitempty"` // Counter and timer rate
+	Timer     *Timer        `json:"timer,omitempty"`      // Timers only
+}
+
+// Timer is the statistics of a timer.
+type Timer struct {
+	Min         float64            `json:"min"`
+	Max         float64            `json:"max"`
+	Mean        float64            `json:"mean"`
+	Median      float64            `json:"median"`
+	StdDev      float64            `json:"std_dev"`
+	Sum         float64            `json:"sum"`
+	SumSquares  float64            `json:"sum_squares"`
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
+	Histogram   *ExpHistogram      `json:"exp_histogram,omitempty"` // With histograms set, and timers folded in to histograms
+}
+
+// ExpHistogram is the exponential histogram of a timer, in the layout of an OpenTelemetry exponential histogram data
+// point.  Bucket i of each sign counts the values with an absolute value in (base^i, base^(i+1)], where base is
+// 2^(2^-Scale), and the values of the first bucket are at offset.
+type ExpHistogram struct {
+	Scale     int32              `json:"scale"`
+	ZeroCount uint64             `json:"zero_count"`
+	Positive  ExpHistogramBucket `json:"positive"`
+	Negative  ExpHistogramBucket `json:"negative"`
+	Count     uint64             `json:"count"`
+	Sum       float64            `json:"sum"`
+	Min       float64            `json:"min"`
+	Max       float64            `json:"max"`
+}
+
+// ExpHistogramBucket is the buckets of values of one sign of an ExpHistogram.
+type ExpHistogramBucket struct {
+	Offset       int32    `json:"offset"`
+	BucketCounts []uint64 `json:"bucket_counts"`
+}
+
+// templateFuncs are the functions available to the body template, in addition to the text/template builtins.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Client sends each flush to a webhook, as the body of an HTTP request rendered from a template.
+type Client struct {
+	transfer gostatsd.TransferCounter // Must be the first field, for the alignment of its 64-bit counters
+
+	url                   string
+	method                string
+	headers               http.Header
+	body                  *template.Template
+	maxRequestElapsedTime time.Duration
+	histograms            bool // Export the histograms of timers, which makes this a raw timers backend
+	client                http.Client
+	now                   func() time.Time // Returns current time. Useful for testing.
+}
+
+// NewClientFromViper constructs a webhook backend.
+func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
+	w := getSubViper(v, "webhook")
+	w.SetDefault("method", DefaultMethod)
+	w.SetDefault("content_type", DefaultContentType)
+	w.SetDefault("body_template", DefaultBodyTemplate)
+	w.SetDefault("client_timeout", DefaultClientTimeout)
+	w.SetDefault("max_request_elapsed_time", DefaultMaxRequestElapsedTime)
+	w.SetDefault("histograms", false)
+
+	c, err := NewClient(
+		w.GetString("url"),
+		w.GetString("method"),
+		w.GetString("content_type"),
+		w.GetStringMapString("headers"),
+		w.GetString("body_template"),
+		w.GetDuration("client_timeout"),
+		w.GetDuration("max_request_elapsed_time"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.histograms = w.GetBool("histograms")
+	return c, nil
+}
+
+// NewClient constructs a webhook backend.  headers are added to each request, after the Content-Type, so may
+// replace it.  bodyTemplate is a text/template executed with a Payload.
+func NewClient(url, method, contentType string, headers map[string]string, bodyTemplate string, clientTimeout, maxRequestElapsedTime time.Duration) (*Client, error) {
+	if url == "" {
+		return nil, fmt.Errorf("[%s] url is required", BackendName)
+	}
+	if method == "" {
+		return nil, fmt.Errorf("[%s] method is required", BackendName)
+	}
+	if clientTimeout <= 0 {
+		return nil, fmt.Errorf("[%s] client_timeout should be positive", BackendName)
+	}
+	if maxRequestElapsedTime <= 0 {
+		return nil, fmt.Errorf("[%s] max_request_elapsed_time should be positive", BackendName)
+	}
+	body, err := template.New(BackendName).Funcs(templateFuncs).Parse(bodyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] invalid body_template: %v", BackendName, err)
+	}
+	h := http.Header{}
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	for name, value := range headers {
+		h.Set(name, value)
+	}
+	logger.WithFields(log.Fields{
+		"url":                      url,
+		"method":                   method,
+		"client_timeout":           clientTimeout,
+		"max_request_elapsed_time": maxRequestElapsedTime,
+	}).Info("Configured backend")
+	return &Client{
+		url:                   url,
+		method:                method,
+		headers:               h,
+		body:                  body,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		client:                http.Client{Timeout: clientTimeout},
+		now:                   time.Now,
+	}, nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+// TransferStats returns the bytes of body sent to the webhook, which has no compression, and the time taken.
+func (c *Client) TransferStats() (gostatsd.TransferStats, bool) {
+	return c.transfer.Stats(), true
+}
+
+// WantsRawTimers returns true if the histograms of timers are exported, so they are handed over with the timers.
+func (c *Client) WantsRawTimers() bool {
+	return c.histograms
+}
+
+// SendEvent discards events, only metrics are sent to the webhook.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// SendMetricsAsync renders the body synchronously, and sends it asynchronously.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	start := time.Now()
+	body, err := c.render(metrics)
+	if err != nil {
+		cb([]error{err})
+		return
+	}
+	c.transfer.Serialized(len(body), time.Since(start))
+	go func() {
+		cb([]error{c.send(ctx, body)})
+	}()
+}
+
+// render executes the body template with the payload of metrics.
+func (c *Client) render(metrics *gostatsd.MetricMap) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := c.body.Execute(&buf, NewPayload(metrics, c.now())); err != nil {
+		return nil, fmt.Errorf("[%s] failed to render body: %v", BackendName, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// NewPayload returns the payload of metrics flushed at now.
+func NewPayload(metrics *gostatsd.MetricMap, now time.Time) *Payload {
+	p := &Payload{
+		Timestamp: now,
+		Metrics:   []Metric{},
+	}
+	metrics.EachCounter(func(name, tagsKey string, counter gostatsd.Counter) {
+		p.Metrics = append(p.Metrics, Metric{
+			Name:      name,
+			Type:      "counter",
+			Tags:      counter.Tags,
+			Host:      counter.Hostname,
+			Value:     float64(counter.Value),
+			PerSecond: counter.PerSecond,
+		})
+	})
+	metrics.EachGauge(func(name, tagsKey string, gauge gostatsd.Gauge) {
+		p.Metrics = append(p.Metrics, Metric{
+			Name:  name,
+			Type:  "gauge",
+			Tags:  gauge.Tags,
+			Host:  gauge.Hostname,
+			Value: gauge.Value,
+		})
+	})
+	metrics.EachTimer(func(name, tagsKey string, timer gostatsd.Timer) {
+		t := &Timer{
+			Min:        timer.Min,
+			Max:        timer.Max,
+			Mean:       timer.Mean,
+			Median:     timer.Median,
+			StdDev:     timer.StdDev,
+			Sum:        timer.Sum,
+			SumSquares: timer.SumSquares,
+		}
+		if len(timer.Percentiles) > 0 {
+			t.Percentiles = make(map[string]float64, len(timer.Percentiles))
+			for _, pct := range timer.Percentiles {
+				t.Percentiles[pct.Str] = pct.Float
+			}
+		}
+		if h := timer.Histogram; h != nil && h.Count > 0 {
+			t.Histogram = &ExpHistogram{
+				Scale:     h.Scale,
+				ZeroCount: h.ZeroCount,
+				Positive:  ExpHistogramBucket{Offset: h.Positive.Offset, BucketCounts: append([]uint64{}, h.Positive.Counts...)},
+				Negative:  ExpHistogramBucket{Offset: h.Negative.Offset, BucketCounts: append([]uint64{}, h.Negative.Counts...)},
+				Count:     h.Count,
+				Sum:       h.Sum,
+				Min:       h.Min,
+				Max:       h.Max,
+			}
+		}
+		p.Metrics = append(p.Metrics, Metric{
+			Name:      name,
+			Type:      "timer",
+			Tags:      timer.Tags,
+			Host:      timer.Hostname,
+			Value:     float64(timer.Count),
+			PerSecond: timer.PerSecond,
+			Timer:     t,
+		})
+	})
+	metrics.EachSet(func(name, tagsKey string, set gostatsd.Set) {
+		p.Metrics = append(p.Metrics, Metric{
+			Name:  name,
+			Type:  "set",
+			Tags:  set.Tags,
+			Host:  set.Hostname,
+			Value: float64(set.Cardinality()),
+		})
+	})
+	return p
+}
+
+// send sends body to the webhook, retrying with exponential backoff on network errors and 5xx responses until
+// maxRequestElapsedTime has passed.
+func (c *Client) send(ctx context.Context, body []byte) error {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = c.maxRequestElapsedTime
+	for {
+		retry, err := c.do(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry {
+			return fmt.Errorf("[%s] %v", BackendName, err)
+		}
+
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			return fmt.Errorf("[%s] %v", BackendName, err)
+		}
+		logger.WithError(err).WithField(logging.FieldDuration, next).Warn("Failed to send, retrying")
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// do makes a single request, returning whether a failed request may succeed if it is retried.
+func (c *Client) do(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest(c.method, c.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	// Every attempt is counted, as a retry sends the body again.
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.transfer.Sent(len(body), time.Since(start))
+		return true, fmt.Errorf("error sending request: %v", err)
+	}
+	defer func() {
+		c.transfer.Sent(len(body), time.Since(start))
+	}()
+	defer resp.Body.Close()
+	respBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(respBody)
+		logger.WithFields(log.Fields{
+			"status": resp.StatusCode,
+			"body":   string(b),
+		}).Info("Failed request")
+		return resp.StatusCode >= 500, fmt.Errorf("received bad status code %d", resp.StatusCode)
+	}
+	_, _ = io.Copy(ioutil.Discard, respBody)
+	return false, nil
+}
+
+func getSubViper(v *viper.Viper, key string) *viper.Viper {
+	n := v.Sub(key)
+	if n == nil {
+		n = viper.New()
+	}
+	return n
+}
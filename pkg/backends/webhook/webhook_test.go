@@ -0,0 +1,215 @@
+package webhook
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/exphist"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookServer records the requests it receives, and responds with each status in turn, then 200.
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func newWebhookServer(statuses ...int) *webhookServer {
+	ws := &webhookServer{statuses: statuses}
+	ws.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ws.mu.Lock()
+		ws.requests = append(ws.requests, r)
+		ws.bodies = append(ws.bodies, string(body))
+		status := http.StatusOK
+		if len(ws.statuses) > 0 {
+			status, ws.statuses = ws.statuses[0], ws.statuses[1:]
+		}
+		ws.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	return ws
+}
+
+func testMetrics() *gostatsd.MetricMap {
+	timer := gostatsd.Timer{Count: 2, PerSecond: 0.2, Min: 1, Max: 3, Mean: 2, Median: 2, Sum: 4, SumSquares: 10, Tags: gostatsd.Tags{"env:prod"}}
+	timer.Percentiles.Set("upper_90", 3)
+	return &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{"requests": {"env:prod": {Value: 5, PerSecond: 0.5, Tags: gostatsd.Tags{"env:prod"}, Hostname: "h1"}}},
+		Gauges:   gostatsd.Gauges{"queue": {"": {Value: 1.5}}},
+		Timers:   gostatsd.Timers{"latency": {"env:prod": timer}},
+		Sets:     gostatsd.Sets{},
+		Sorted:   true,
+	}
+}
+
+func send(t *testing.T, c *Client, m *gostatsd.MetricMap) []error {
+	var errs []error
+	done := make(chan struct{})
+	c.SendMetricsAsync(context.Background(), m, func(e []error) {
+		errs = e
+		close(done)
+	})
+	<-done
+	return errs
+}
+
+func TestSendDefaultTemplate(t *testing.T) {
+	t.Parallel()
+	ws := newWebhookServer()
+	defer ws.Close()
+	c, err := NewClient(ws.URL, DefaultMethod, DefaultContentType, nil, DefaultBodyTemplate, time.Second, time.Second)
+	require.NoError(t, err)
+	c.now = func() time.Time {
+		return time.Unix(1000, 0).UTC()
+	}
+
+	assert.Equal(t, []error{nil}, send(t, c, testMetrics()))
+	require.Len(t, ws.requests, 1)
+	assert.Equal(t, "POST", ws.requests[0].Method)
+	assert.Equal(t, "application/json", ws.requests[0].Header.Get("Content-Type"))
+	assert.JSONEq(t, `{
+		"timestamp": "1970-01-01T00:16:40Z",
+		"metrics": [
+			{"name": "requests", "type": "counter", "tags": ["env:prod"], "host": "h1", "value": 5, "per_second": 0.5},
+			{"name": "queue", "type": "gauge", "tags": null, "value": 1.5},
+			{"name": "latency", "type": "timer", "tags": ["env:prod"], "value": 2, "per_second": 0.2, "timer": {
+				"min": 1, "max": 3, "mean": 2, "median": 2, "std_dev": 0, "sum": 4, "sum_squares": 10,
+				"percentiles": {"upper_90": 3}
+			}}
+		]
+	}`, ws.bodies[0])
+}
+
+func TestSendHistograms(t *testing.T) {
+	t.Parallel()
+	ws := newWebhookServer()
+	defer ws.Close()
+	c, err := NewClient(ws.URL, DefaultMethod, DefaultContentType, nil, `{{range .Metrics}}{{with .Timer}}{{json .Histogram}}{{end}}{{end}}`, time.Second, time.Second)
+	require.NoError(t, err)
+	c.histograms = true
+
+	h := exphist.New(0, 10)
+	for _, v := range []float64{1.5, 3, -2, 0} {
+		h.Insert(v)
+	}
+	m := testMetrics()
+	timer := m.Timers["latency"]["env:prod"]
+	timer.Histogram = h
+	m.Timers["latency"]["env:prod"] = timer
+
+	assert.Equal(t, []error{nil}, send(t, c, m))
+	require.Len(t, ws.bodies, 1)
+	assert.JSONEq(t, `{
+		"scale": 0, "zero_count": 1,
+		"positive": {"offset": 0, "bucket_counts": [1, 1]},
+		"negative": {"offset": 0, "bucket_counts": [1]},
+		"count": 4, "sum": 2.5, "min": -2, "max": 3
+	}`, ws.bodies[0])
+}
+
+func TestSendCustomTemplateAndHeaders(t *testing.T) {
+	t.Parallel()
+	ws := newWebhookServer()
+	defer ws.Close()
+	headers := map[string]string{
+		"authorization": "Bearer abc",
+		"content-type":  "text/plain",
+		"X-Source":      "gostatsd",
+	}
+	tmpl := `{{range .Metrics}}{{.Type}} {{.Name}}={{.Value}}{{with .Timer}} p90={{index .Percentiles "upper_90"}}{{end}} {{json .Tags}}
+{{end}}at {{.Timestamp.Unix}}`
+	c, err := NewClient(ws.URL, "PUT", DefaultContentType, headers, tmpl, time.Second, time.Second)
+	require.NoError(t, err)
+	c.now = func() time.Time {
+		return time.Unix(1000, 0)
+	}
+
+	assert.Equal(t, []error{nil}, send(t, c, testMetrics()))
+	require.Len(t, ws.requests, 1)
+	req := ws.requests[0]
+	assert.Equal(t, "PUT", req.Method)
+	assert.Equal(t, "Bearer abc", req.Header.Get("Authorization"))
+	assert.Equal(t, "text/plain", req.Header.Get("Content-Type"))
+	assert.Equal(t, "gostatsd", req.Header.Get("X-Source"))
+	assert.Equal(t, `counter requests=5 ["env:prod"]
+gauge queue=1.5 null
+timer latency=2 p90=3 ["env:prod"]
+at 1000`, ws.bodies[0])
+}
+
+func TestSendRetries(t *testing.T) {
+	t.Parallel()
+	ws := newWebhookServer(http.StatusServiceUnavailable, http.StatusInternalServerError)
+	defer ws.Close()
+	c, err := NewClient(ws.URL, DefaultMethod, DefaultContentType, nil, DefaultBodyTemplate, time.Second, 10*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, []error{nil}, send(t, c, testMetrics()))
+	require.Len(t, ws.bodies, 3)
+	assert.Equal(t, ws.bodies[0], ws.bodies[2])
+}
+
+func TestSendDoesNotRetryClientErrors(t *testing.T) {
+	t.Parallel()
+	ws := newWebhookServer(http.StatusBadRequest)
+	defer ws.Close()
+	c, err := NewClient(ws.URL, DefaultMethod, DefaultContentType, nil, DefaultBodyTemplate, time.Second, 10*time.Second)
+	require.NoError(t, err)
+
+	errs := send(t, c, testMetrics())
+	require.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], "[webhook] received bad status code 400")
+	assert.Len(t, ws.bodies, 1)
+}
+
+func TestRenderError(t *testing.T) {
+	t.Parallel()
+	c, err := NewClient("http://localhost", DefaultMethod, DefaultContentType, nil, `{{.Missing}}`, time.Second, time.Second)
+	require.NoError(t, err)
+	errs := send(t, c, testMetrics())
+	require.Len(t, errs, 1)
+	assert.Error(t, errs[0])
+}
+
+func TestNewClientInvalid(t *testing.T) {
+	t.Parallel()
+	_, err := NewClient("", DefaultMethod, DefaultContentType, nil, DefaultBodyTemplate, time.Second, time.Second)
+	assert.Error(t, err)
+	_, err = NewClient("http://localhost", DefaultMethod, DefaultContentType, nil, "{{", time.Second, time.Second)
+	assert.Error(t, err)
+	_, err = NewClient("http://localhost", DefaultMethod, DefaultContentType, nil, DefaultBodyTemplate, 0, time.Second)
+	assert.Error(t, err)
+}
+
+func TestNewClientFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("webhook.url", "http://localhost/hook")
+	v.Set("webhook.headers", map[string]interface{}{"X-Api-Key": "k"})
+	b, err := NewClientFromViper(v)
+	require.NoError(t, err)
+	c := b.(*Client)
+	assert.Equal(t, "http://localhost/hook", c.url)
+	assert.Equal(t, "POST", c.method)
+	assert.Equal(t, "k", c.headers.Get("X-Api-Key"))
+	assert.Equal(t, "application/json", c.headers.Get("Content-Type"))
+	assert.False(t, c.WantsRawTimers())
+
+	v.Set("webhook.histograms", true)
+	b, err = NewClientFromViper(v)
+	require.NoError(t, err)
+	assert.True(t, gostatsd.WantsRawTimers(b))
+}
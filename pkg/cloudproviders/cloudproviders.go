@@ -5,14 +5,20 @@ import (
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/cloudproviders/aws"
+	"github.com/atlassian/gostatsd/pkg/cloudproviders/k8s"
+	"github.com/atlassian/gostatsd/pkg/logging"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// Factory is a function that returns a CloudProvider.
+type Factory func(v *viper.Viper, logger logrus.FieldLogger) (gostatsd.CloudProvider, error)
+
 // All registered cloud providers.
-var providers = map[string]gostatsd.CloudProviderFactory{
+var providers = map[string]Factory{
 	aws.ProviderName: aws.NewProviderFromViper,
+	k8s.ProviderName: k8s.NewProviderFromViper,
 }
 
 // Get creates an instance of the named provider, or nil if
@@ -29,7 +35,7 @@ func Get(name string, v *viper.Viper, logger logrus.FieldLogger) (gostatsd.Cloud
 // Init creates an instance of the named cloud provider.
 func Init(name string, v *viper.Viper, logger logrus.FieldLogger) (gostatsd.CloudProvider, error) {
 	if name == "" {
-		logrus.Info("No cloud provider specified")
+		logging.ComponentOf(logger, "cloud").Info("No cloud provider specified")
 		return nil, nil
 	}
 
@@ -40,7 +46,7 @@ func Init(name string, v *viper.Viper, logger logrus.FieldLogger) (gostatsd.Clou
 	if provider == nil {
 		return nil, fmt.Errorf("unknown cloud provider %q", name)
 	}
-	logrus.Infof("Initialised cloud provider %q", name)
+	logging.ComponentOf(logger, "cloud").WithField("provider", name).Info("Initialised cloud provider")
 
 	return provider, nil
 }
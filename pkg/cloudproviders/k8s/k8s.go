@@ -0,0 +1,283 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	stats "github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// ProviderName is the name of the Kubernetes cloud provider.
+	ProviderName             = "k8s"
+	defaultKubeletURL        = "http://127.0.0.1:10255/pods"
+	defaultClientTimeout     = 5 * time.Second
+	defaultRefreshInterval   = 30 * time.Second
+	defaultMaxInstancesBatch = 32
+
+	// minMissRefreshInterval is the shortest time between refreshes of the pods caused by looking up an unknown IP,
+	// such as that of a newly started pod.
+	minMissRefreshInterval = time.Second
+)
+
+// Pod is the metadata of a pod, which is added as tags to the metrics and events it sends.
+type Pod struct {
+	Namespace string
+	Name      string
+	NodeName  string
+	IP        gostatsd.IP
+	Labels    map[string]string
+}
+
+// PodLookup returns the pods whose IPs can be looked up, such as the pods running on this node.
+type PodLookup interface {
+	Pods(ctx context.Context) ([]Pod, error)
+}
+
+// Provider is a cloud provider which looks up the Kubernetes pod with a source IP.  The pods are cached, and
+// refreshed at most once per refresh interval, or sooner if an IP isn't found.
+type Provider struct {
+	lookups      uint64 // The cumulative number of IPs looked up
+	lookupsFound uint64 // The cumulative number of IPs which matched a pod
+	refreshes    uint64 // The cumulative number of times the pods were refreshed
+	refreshErrs  uint64 // The cumulative number of errors refreshing the pods
+
+	logger          logrus.FieldLogger
+	lookup          PodLookup
+	refreshInterval time.Duration
+	labels          []string // Pod labels added as tags
+	maxInstances    int
+	now             func() time.Time
+
+	mu        sync.Mutex
+	instances map[gostatsd.IP]*gostatsd.Instance
+	refreshed time.Time
+}
+
+// NewProvider creates a Provider looking up pods with lookup, refreshing them every refreshInterval, and tagging
+// with the values of the given pod labels.
+func NewProvider(logger logrus.FieldLogger, lookup PodLookup, refreshInterval time.Duration, labels []string, maxInstances int) *Provider {
+	return &Provider{
+		logger:          logger,
+		lookup:          lookup,
+		refreshInterval: refreshInterval,
+		labels:          labels,
+		maxInstances:    maxInstances,
+		now:             time.Now,
+	}
+}
+
+// EstimatedTags returns a guess of how many tags are likely to be added by the Provider.
+func (p *Provider) EstimatedTags() int {
+	return 3 + len(p.labels) // namespace, pod and node, and the labels
+}
+
+// RunMetrics emits the lookup and refresh counts on each flush.
+func (p *Provider) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("cloudprovider.k8s.lookups", float64(atomic.LoadUint64(&p.lookups)), nil)
+			statser.Gauge("cloudprovider.k8s.lookups_found", float64(atomic.LoadUint64(&p.lookupsFound)), nil)
+			statser.Gauge("cloudprovider.k8s.refreshes", float64(atomic.LoadUint64(&p.refreshes)), nil)
+			statser.Gauge("cloudprovider.k8s.refresh_errors", float64(atomic.LoadUint64(&p.refreshErrs)), nil)
+		}
+	}
+}
+
+// Instance returns the pod with each IP.
+// ip -> nil pointer if no pod was found.
+// map is returned even in case of errors because it may contain partial data.
+func (p *Provider) Instance(ctx context.Context, IP ...gostatsd.IP) (map[gostatsd.IP]*gostatsd.Instance, error) {
+	atomic.AddUint64(&p.lookups, uint64(len(IP)))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	age := p.now().Sub(p.refreshed)
+	var err error
+	if p.instances == nil || age >= p.refreshInterval || (age >= minMissRefreshInterval && p.anyUnknown(IP)) {
+		err = p.refresh(ctx)
+	}
+
+	instances := make(map[gostatsd.IP]*gostatsd.Instance, len(IP))
+	found := uint64(0)
+	for _, ip := range IP {
+		instance := p.instances[ip]
+		if instance != nil {
+			found++
+		} else {
+			p.logger.WithField("ip", ip).Debug("No pod found")
+		}
+		instances[ip] = instance
+	}
+	atomic.AddUint64(&p.lookupsFound, found)
+	return instances, err
+}
+
+// anyUnknown returns true if any of the IPs is not the IP of a cached pod.  Must be called with mu held.
+func (p *Provider) anyUnknown(IP []gostatsd.IP) bool {
+	for _, ip := range IP {
+		if p.instances[ip] == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh replaces the cached pods, keeping the old ones if the lookup fails.  Must be called with mu held.
+func (p *Provider) refresh(ctx context.Context) error {
+	atomic.AddUint64(&p.refreshes, 1)
+	p.refreshed = p.now()
+	pods, err := p.lookup.Pods(ctx)
+	if err != nil {
+		atomic.AddUint64(&p.refreshErrs, 1)
+		return fmt.Errorf("error listing pods: %v", err)
+	}
+	instances := make(map[gostatsd.IP]*gostatsd.Instance, len(pods))
+	for _, pod := range pods {
+		if pod.IP == gostatsd.UnknownIP {
+			continue
+		}
+		tags := gostatsd.Tags{
+			"kube_namespace:" + pod.Namespace,
+			"kube_pod:" + pod.Name,
+		}
+		if pod.NodeName != "" {
+			tags = append(tags, "kube_node:"+pod.NodeName)
+		}
+		for _, label := range p.labels {
+			if value, ok := pod.Labels[label]; ok {
+				tags = append(tags, gostatsd.NormalizeTagKey(label)+":"+value)
+			}
+		}
+		instances[pod.IP] = &gostatsd.Instance{
+			ID:   pod.Namespace + "/" + pod.Name,
+			Tags: tags,
+		}
+	}
+	p.instances = instances
+	return nil
+}
+
+// MaxInstancesBatch returns maximum number of instances that could be requested via the Instance method.
+func (p *Provider) MaxInstancesBatch() int {
+	return p.maxInstances
+}
+
+// Name returns the name of the provider.
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// SelfIP returns gostatsd.UnknownIP, the node's IP is not known to the provider.
+func (p *Provider) SelfIP() (gostatsd.IP, error) {
+	return gostatsd.UnknownIP, nil
+}
+
+// KubeletLookup lists the pods running on a node from the kubelet's pods endpoint.
+type KubeletLookup struct {
+	URL    string
+	Client *http.Client
+}
+
+// kubeletPodList is the part of the pod list returned by the kubelet which is used.
+type kubeletPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string            `json:"name"`
+			Namespace string            `json:"namespace"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Spec struct {
+			NodeName    string `json:"nodeName"`
+			HostNetwork bool   `json:"hostNetwork"`
+		} `json:"spec"`
+		Status struct {
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// Pods returns the pods running on the node, except those using the host's network, which share the node's IP.
+func (kl *KubeletLookup) Pods(ctx context.Context) ([]Pod, error) {
+	req, err := http.NewRequest(http.MethodGet, kl.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := kl.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from kubelet: %s", resp.Status)
+	}
+	var list kubeletPodList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("error decoding pods: %v", err)
+	}
+	pods := make([]Pod, 0, len(list.Items))
+	for _, item := range list.Items {
+		if item.Spec.HostNetwork || item.Status.PodIP == "" {
+			continue
+		}
+		pods = append(pods, Pod{
+			Namespace: item.Metadata.Namespace,
+			Name:      item.Metadata.Name,
+			NodeName:  item.Spec.NodeName,
+			IP:        gostatsd.IP(item.Status.PodIP),
+			Labels:    item.Metadata.Labels,
+		})
+	}
+	return pods, nil
+}
+
+// NewProviderFromViper returns a new k8s provider looking up pods from the kubelet.
+func NewProviderFromViper(v *viper.Viper, logger logrus.FieldLogger) (gostatsd.CloudProvider, error) {
+	k := getSubViper(v, "k8s")
+	k.SetDefault("kubelet_url", defaultKubeletURL)
+	k.SetDefault("client_timeout", defaultClientTimeout)
+	k.SetDefault("refresh_interval", defaultRefreshInterval)
+	k.SetDefault("max_instances_batch", defaultMaxInstancesBatch)
+	k.SetDefault("labels", []string{})
+	httpTimeout := k.GetDuration("client_timeout")
+	if httpTimeout <= 0 {
+		return nil, errors.New("client timeout must be positive")
+	}
+	refreshInterval := k.GetDuration("refresh_interval")
+	if refreshInterval <= 0 {
+		return nil, errors.New("refresh interval must be positive")
+	}
+	maxInstances := k.GetInt("max_instances_batch")
+	if maxInstances <= 0 {
+		return nil, errors.New("max number of instances per batch must be positive")
+	}
+	lookup := &KubeletLookup{
+		URL:    k.GetString("kubelet_url"),
+		Client: &http.Client{Timeout: httpTimeout},
+	}
+	return NewProvider(logger, lookup, refreshInterval, k.GetStringSlice("labels"), maxInstances), nil
+}
+
+func getSubViper(v *viper.Viper, key string) *viper.Viper {
+	n := v.Sub(key)
+	if n == nil {
+		n = viper.New()
+	}
+	return n
+}
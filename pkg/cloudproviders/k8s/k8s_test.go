@@ -0,0 +1,131 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLookup returns its pods, or err, counting the calls.
+type fakeLookup struct {
+	pods  []Pod
+	err   error
+	calls int
+}
+
+func (fl *fakeLookup) Pods(ctx context.Context) ([]Pod, error) {
+	fl.calls++
+	return fl.pods, fl.err
+}
+
+func newTestProvider(lookup PodLookup, labels ...string) (*Provider, *time.Time) {
+	p := NewProvider(logrus.StandardLogger(), lookup, time.Minute, labels, defaultMaxInstancesBatch)
+	now := time.Unix(1000, 0)
+	p.now = func() time.Time { return now }
+	return p, &now
+}
+
+func TestProviderInstance(t *testing.T) {
+	t.Parallel()
+	lookup := &fakeLookup{pods: []Pod{
+		{Namespace: "ns", Name: "web-1", NodeName: "node-1", IP: "10.0.0.1", Labels: map[string]string{"app": "web", "team": "a"}},
+		{Namespace: "ns", Name: "pending", IP: gostatsd.UnknownIP},
+	}}
+	p, _ := newTestProvider(lookup, "app", "missing")
+
+	instances, err := p.Instance(context.Background(), "10.0.0.1", "10.0.0.2")
+	require.NoError(t, err)
+	assert.Equal(t, map[gostatsd.IP]*gostatsd.Instance{
+		"10.0.0.1": {ID: "ns/web-1", Tags: gostatsd.Tags{"kube_namespace:ns", "kube_pod:web-1", "kube_node:node-1", "app:web"}},
+		"10.0.0.2": nil,
+	}, instances)
+	assert.Equal(t, 1, lookup.calls)
+	assert.Equal(t, 5, p.EstimatedTags())
+}
+
+func TestProviderCachesPods(t *testing.T) {
+	t.Parallel()
+	lookup := &fakeLookup{pods: []Pod{{Namespace: "ns", Name: "a", IP: "10.0.0.1"}}}
+	p, now := newTestProvider(lookup)
+
+	_, err := p.Instance(context.Background(), "10.0.0.1")
+	require.NoError(t, err)
+	_, err = p.Instance(context.Background(), "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, lookup.calls)
+
+	// An unknown IP refreshes the pods, but not more than once a second.
+	lookup.pods = append(lookup.pods, Pod{Namespace: "ns", Name: "b", IP: "10.0.0.2"})
+	instances, err := p.Instance(context.Background(), "10.0.0.2")
+	require.NoError(t, err)
+	assert.Nil(t, instances["10.0.0.2"])
+	assert.Equal(t, 1, lookup.calls)
+	*now = now.Add(time.Second)
+	instances, err = p.Instance(context.Background(), "10.0.0.2")
+	require.NoError(t, err)
+	require.NotNil(t, instances["10.0.0.2"])
+	assert.Equal(t, "ns/b", instances["10.0.0.2"].ID)
+	assert.Equal(t, 2, lookup.calls)
+
+	// Known IPs are refreshed after the refresh interval, keeping the old pods if it fails.
+	lookup.err = errors.New("kubelet unavailable")
+	*now = now.Add(time.Minute)
+	instances, err = p.Instance(context.Background(), "10.0.0.1")
+	assert.Error(t, err)
+	require.NotNil(t, instances["10.0.0.1"])
+	assert.Equal(t, 3, lookup.calls)
+	assert.EqualValues(t, 1, p.refreshErrs)
+}
+
+func TestKubeletLookup(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pods" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"kind":"PodList","items":[
+			{"metadata":{"name":"web-1","namespace":"ns","labels":{"app":"web"}},"spec":{"nodeName":"node-1"},"status":{"podIP":"10.0.0.1"}},
+			{"metadata":{"name":"proxy","namespace":"kube-system"},"spec":{"nodeName":"node-1","hostNetwork":true},"status":{"podIP":"192.168.0.1"}},
+			{"metadata":{"name":"pending","namespace":"ns"},"spec":{},"status":{}}
+		]}`))
+	}))
+	defer srv.Close()
+
+	kl := &KubeletLookup{URL: srv.URL + "/pods", Client: srv.Client()}
+	pods, err := kl.Pods(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []Pod{
+		{Namespace: "ns", Name: "web-1", NodeName: "node-1", IP: "10.0.0.1", Labels: map[string]string{"app": "web"}},
+	}, pods)
+
+	kl.URL = srv.URL + "/missing"
+	_, err = kl.Pods(context.Background())
+	assert.Error(t, err)
+}
+
+func TestNewProviderFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("k8s.labels", []string{"app"})
+	cp, err := NewProviderFromViper(v, logrus.StandardLogger())
+	require.NoError(t, err)
+	p := cp.(*Provider)
+	assert.Equal(t, []string{"app"}, p.labels)
+	assert.Equal(t, defaultRefreshInterval, p.refreshInterval)
+	assert.Equal(t, defaultKubeletURL, p.lookup.(*KubeletLookup).URL)
+
+	v.Set("k8s.refresh_interval", "0s")
+	_, err = NewProviderFromViper(v, logrus.StandardLogger())
+	assert.Error(t, err)
+}
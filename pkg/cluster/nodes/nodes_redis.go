@@ -7,8 +7,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/atlassian/gostatsd/pkg/logging"
+
 	"github.com/go-redis/redis"
-	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -71,7 +72,7 @@ func (rnt *redisNodeTracker) Run(ctx context.Context) {
 			if rnt.nodeid != "" {
 				err := rnt.emitPresence()
 				if err != nil {
-					logrus.Warningf("Failed to check in to cluster")
+					logging.Component("cluster").Warn("Failed to check in to cluster")
 				}
 			}
 		case msg := <-psChan:
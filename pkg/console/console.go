@@ -0,0 +1,328 @@
+// Package console implements a management console for gostatsd.
+//
+// Commands are registered by name, and can be executed through a line based TCP console, or via
+// HTTP at /api/v1/<command>?arg=<arg1>&arg=<arg2>.  Any other query parameters are passed after
+// the arg parameters as <name>=<value> arguments, in order of name.  The TCP console is compatible with
+// the etsy statsd management interface: each command is a single line, and its output is terminated
+// with a line containing END.
+//
+// Each command is either read-only or admin.  Over HTTP, admin commands require the admin token, and
+// are not served at all by a read-only API.
+package console
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// APIPrefix is the path prefix the HTTP API serves commands under.
+const APIPrefix = "/api/v1/"
+
+// ErrUnknownCommand is returned when executing a command which has not been registered.
+var ErrUnknownCommand = errors.New("unknown command")
+
+// Access is who may execute a command over HTTP.
+type Access int
+
+const (
+	// ReadOnly commands only report state, and may be executed by anyone who can reach the API.
+	ReadOnly Access = iota + 1
+	// Admin commands change state, and require the admin token.
+	Admin
+)
+
+// Handler executes a command with the provided arguments, writing any output to w.
+type Handler func(ctx context.Context, args []string, w io.Writer) error
+
+type command struct {
+	access      Access
+	usage       string
+	description string
+	handler     Handler
+}
+
+// Console is a registry of commands.
+type Console struct {
+	// Logger logs errors accepting and serving connections, the standard logger unless it is replaced before
+	// serving.
+	Logger log.FieldLogger
+
+	adminToken string // Required by HTTP requests for admin commands, which are refused if it is empty
+
+	mu       sync.RWMutex
+	commands map[string]command
+}
+
+// New creates a Console with the help command registered.  adminToken must be sent as a bearer token
+// in the Authorization header of HTTP requests for admin commands.  If it is empty, admin commands
+// can only be executed through the TCP console.
+func New(adminToken string) *Console {
+	c := &Console{
+		Logger:     logging.Component("console"),
+		adminToken: adminToken,
+		commands:   map[string]command{},
+	}
+	c.Register("help", ReadOnly, "help", "List the available commands", c.help)
+	return c
+}
+
+// Register adds a command to the Console, replacing any existing command with the same name.
+// access is ReadOnly or Admin, usage is the command line syntax of the command, and description is a
+// single line of help text.  Register panics if access is not valid, so that every command declares it.
+func (c *Console) Register(name string, access Access, usage, description string, handler Handler) {
+	if access != ReadOnly && access != Admin {
+		panic(fmt.Sprintf("console command %q has invalid access %d", name, access))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commands[name] = command{
+		access:      access,
+		usage:       usage,
+		description: description,
+		handler:     handler,
+	}
+}
+
+// Execute runs the named command.
+func (c *Console) Execute(ctx context.Context, name string, args []string, w io.Writer) error {
+	cmd, ok := c.command(name)
+	if !ok {
+		return ErrUnknownCommand
+	}
+	return cmd.handler(ctx, args, w)
+}
+
+func (c *Console) command(name string) (command, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cmd, ok := c.commands[name]
+	return cmd, ok
+}
+
+func (c *Console) help(ctx context.Context, args []string, w io.Writer) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	names := make([]string, 0, len(c.commands))
+	for name := range c.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := c.commands[name]
+		usage := cmd.usage
+		if cmd.access == Admin {
+			usage += " (admin)"
+		}
+		if _, err := fmt.Fprintf(w, "%s\n    %s\n", usage, cmd.description); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serve accepts TCP console connections on l until the context is closed.  l is closed when Serve returns.
+func (c *Console) Serve(ctx context.Context, l net.Listener) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		if err := l.Close(); err != nil {
+			c.Logger.WithError(err).Warn("Error closing console listener")
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			c.Logger.WithError(err).Warn("Error accepting console connection")
+			continue
+		}
+		wg.Add(1)
+		// A command which panics only loses its own connection.
+		gostatsd.Go(ctx, "console_connection", func() {
+			defer wg.Done()
+			c.serveConn(ctx, conn)
+		})
+	}
+}
+
+func (c *Console) serveConn(ctx context.Context, conn net.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	w := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" {
+			return
+		}
+		if err := c.Execute(ctx, fields[0], fields[1:], w); err != nil {
+			_, _ = fmt.Fprintf(w, "ERROR: %v\n", err)
+		}
+		if _, err := w.WriteString("END\n\n"); err != nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// ServeHTTP executes the command named by the request path, with arguments from the arg query parameters.
+// Admin commands require the admin token.
+func (c *Console) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.serveHTTP(w, r, false)
+}
+
+// ReadOnlyHandler returns an http.Handler like Console.ServeHTTP which refuses admin commands.
+func (c *Console) ReadOnlyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.serveHTTP(w, r, true)
+	})
+}
+
+func (c *Console) serveHTTP(w http.ResponseWriter, r *http.Request, readOnly bool) {
+	if !strings.HasPrefix(r.URL.Path, APIPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, APIPrefix)
+	args := queryArgs(r)
+
+	cmd, ok := c.command(name)
+	if !ok {
+		http.Error(w, ErrUnknownCommand.Error(), http.StatusNotFound)
+		return
+	}
+	if cmd.access == Admin {
+		switch {
+		case readOnly:
+			http.Error(w, "admin command, use the admin API", http.StatusForbidden)
+			return
+		case c.adminToken == "":
+			http.Error(w, "admin commands are disabled over HTTP", http.StatusForbidden)
+			return
+		case !c.authorized(r):
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// The output is streamed, so an error can only be reported with a status if nothing has been written.
+	sw := &streamWriter{w: w}
+	if err := cmd.handler(r.Context(), args, sw); err != nil {
+		if !sw.started {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, _ = fmt.Fprintf(sw, "ERROR: %v\n", err)
+	}
+	if !sw.started {
+		sw.start()
+	}
+}
+
+// queryArgs returns the arguments of a command from the query parameters of r: the arg parameters, then each other
+// parameter as <name>=<value>, in order of name.
+func queryArgs(r *http.Request) []string {
+	query := r.URL.Query()
+	args := query["arg"]
+	names := make([]string, 0, len(query))
+	for name := range query {
+		if name != "arg" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range query[name] {
+			args = append(args, name+"="+value)
+		}
+	}
+	return args
+}
+
+// streamWriter writes the output of a command to an HTTP response as it is produced, setting the headers before the
+// first write.
+type streamWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (sw *streamWriter) start() {
+	sw.started = true
+	sw.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	sw.w.WriteHeader(http.StatusOK)
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if !sw.started {
+		sw.start()
+	}
+	return sw.w.Write(p)
+}
+
+// authorized returns true if r has the admin token as a bearer token.
+func (c *Console) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(c.adminToken)) == 1
+}
+
+// ServeAPI serves the HTTP API on l until the context is closed.  If readOnly is true, admin commands are refused.
+func (c *Console) ServeAPI(ctx context.Context, l net.Listener, readOnly bool) {
+	var handler http.Handler = c
+	if readOnly {
+		handler = c.ReadOnlyHandler()
+	}
+	mux := http.NewServeMux()
+	mux.Handle(APIPrefix, handler)
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Close(); err != nil {
+			c.Logger.WithError(err).Warn("Error closing API server")
+		}
+	}()
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		c.Logger.WithError(err).Error("API server failed")
+	}
+}
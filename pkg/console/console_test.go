@@ -0,0 +1,174 @@
+package console
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestConsole() *Console {
+	c := New("secret")
+	c.Register("echo", ReadOnly, "echo <args>", "Echo the arguments", func(ctx context.Context, args []string, w io.Writer) error {
+		_, err := io.WriteString(w, strings.Join(args, " ")+"\n")
+		return err
+	})
+	c.Register("fail", ReadOnly, "fail", "Always fails", func(ctx context.Context, args []string, w io.Writer) error {
+		return errors.New("failed")
+	})
+	return c
+}
+
+func TestExecute(t *testing.T) {
+	t.Parallel()
+	c := newTestConsole()
+
+	var buf strings.Builder
+	require.NoError(t, c.Execute(context.Background(), "echo", []string{"a", "b"}, &buf))
+	assert.Equal(t, "a b\n", buf.String())
+
+	assert.Equal(t, ErrUnknownCommand, c.Execute(context.Background(), "nope", nil, &buf))
+
+	buf.Reset()
+	require.NoError(t, c.Execute(context.Background(), "help", nil, &buf))
+	assert.Equal(t, "echo <args>\n    Echo the arguments\nfail\n    Always fails\nhelp\n    List the available commands\n", buf.String())
+}
+
+func TestServe(t *testing.T) {
+	t.Parallel()
+	c := newTestConsole()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		c.Serve(ctx, l)
+		close(served)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "echo hello world\nfail\nquit\n")
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(bufio.NewReader(conn))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world\nEND\n\nERROR: failed\nEND\n\n", string(out))
+
+	cancel()
+	<-served
+}
+
+func TestServeHTTP(t *testing.T) {
+	t.Parallel()
+	c := newTestConsole()
+	c.Register("partial", ReadOnly, "partial", "Fails after writing output", func(ctx context.Context, args []string, w io.Writer) error {
+		_, _ = io.WriteString(w, "some output\n")
+		return errors.New("failed")
+	})
+
+	tests := []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{url: "/api/v1/echo?arg=a&arg=b", status: http.StatusOK, body: "a b\n"},
+		{url: "/api/v1/echo?limit=5&arg=a&fields=x,y", status: http.StatusOK, body: "a fields=x,y limit=5\n"},
+		{url: "/api/v1/partial", status: http.StatusOK, body: "some output\nERROR: failed\n"},
+		{url: "/api/v1/fail", status: http.StatusBadRequest, body: "failed\n"},
+		{url: "/api/v1/nope", status: http.StatusNotFound, body: "unknown command\n"},
+		{url: "/other", status: http.StatusNotFound, body: "404 page not found\n"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.url, func(t *testing.T) {
+			t.Parallel()
+			rec := httptest.NewRecorder()
+			c.ServeHTTP(rec, httptest.NewRequest("GET", tc.url, nil))
+			assert.Equal(t, tc.status, rec.Code)
+			assert.Equal(t, tc.body, rec.Body.String())
+		})
+	}
+}
+
+func newAdminTestConsole(adminToken string) *Console {
+	c := New(adminToken)
+	c.Register("status", ReadOnly, "status", "Show the status", func(ctx context.Context, args []string, w io.Writer) error {
+		_, err := io.WriteString(w, "ok\n")
+		return err
+	})
+	c.Register("reset", Admin, "reset", "Reset the state", func(ctx context.Context, args []string, w io.Writer) error {
+		_, err := io.WriteString(w, "reset\n")
+		return err
+	})
+	return c
+}
+
+func TestRegisterRequiresAccess(t *testing.T) {
+	t.Parallel()
+	c := New("")
+	assert.Panics(t, func() {
+		c.Register("nope", 0, "nope", "Undeclared access", nil)
+	})
+}
+
+func TestHelpShowsAdminCommands(t *testing.T) {
+	t.Parallel()
+	c := newAdminTestConsole("")
+	var buf strings.Builder
+	require.NoError(t, c.Execute(context.Background(), "help", nil, &buf))
+	assert.Equal(t, "help\n    List the available commands\nreset (admin)\n    Reset the state\nstatus\n    Show the status\n", buf.String())
+}
+
+func TestServeHTTPAccess(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		adminToken string
+		readOnly   bool
+		url        string
+		auth       string
+		status     int
+		body       string
+	}{
+		{name: "read-only command", adminToken: "secret", url: "/api/v1/status", status: http.StatusOK, body: "ok\n"},
+		{name: "admin command", adminToken: "secret", url: "/api/v1/reset", auth: "Bearer secret", status: http.StatusOK, body: "reset\n"},
+		{name: "no token", adminToken: "secret", url: "/api/v1/reset", status: http.StatusUnauthorized, body: "unauthorized\n"},
+		{name: "wrong token", adminToken: "secret", url: "/api/v1/reset", auth: "Bearer guess", status: http.StatusUnauthorized, body: "unauthorized\n"},
+		{name: "basic auth", adminToken: "secret", url: "/api/v1/reset", auth: "Basic secret", status: http.StatusUnauthorized, body: "unauthorized\n"},
+		{name: "admin disabled", adminToken: "", url: "/api/v1/reset", auth: "Bearer ", status: http.StatusForbidden, body: "admin commands are disabled over HTTP\n"},
+		{name: "read-only api", adminToken: "secret", readOnly: true, url: "/api/v1/status", status: http.StatusOK, body: "ok\n"},
+		{name: "admin command on read-only api", adminToken: "secret", readOnly: true, url: "/api/v1/reset", auth: "Bearer secret", status: http.StatusForbidden, body: "admin command, use the admin API\n"},
+		{name: "unknown command on read-only api", adminToken: "secret", readOnly: true, url: "/api/v1/nope", status: http.StatusNotFound, body: "unknown command\n"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			c := newAdminTestConsole(tc.adminToken)
+			var handler http.Handler = c
+			if tc.readOnly {
+				handler = c.ReadOnlyHandler()
+			}
+			req := httptest.NewRequest("GET", tc.url, nil)
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tc.status, rec.Code)
+			assert.Equal(t, tc.body, rec.Body.String())
+		})
+	}
+}
@@ -0,0 +1,393 @@
+// Package exphist implements a base-2 exponential histogram, the sketch of OpenTelemetry exponential histograms.  It
+// estimates quantiles with a bounded relative error in a bounded number of buckets, and histograms of the same values
+// split in any way merge in to exactly the histogram of all of them.
+//
+// At scale s, bucket i holds the values in (base^i, base^(i+1)], where base = 2^(2^-s).  When the values no longer
+// fit in the maximum number of buckets the scale is reduced, which merges each pair of adjacent buckets.
+package exphist
+
+import (
+	"math"
+)
+
+const (
+	// MaxScale is the highest scale, where base is about 1.0000007.
+	MaxScale = 20
+	// MinScale is the lowest scale, where every finite float64 fits in 3 buckets of each sign.
+	MinScale = -10
+	// MinBuckets is the smallest maximum number of buckets of each sign.
+	MinBuckets = 4
+)
+
+// Buckets is a range of buckets of one sign.
+type Buckets struct {
+	Offset int32    // Index of the bucket of the first count
+	Counts []uint64 // Number of values in each bucket, from Offset on
+}
+
+func (b *Buckets) empty() bool {
+	return len(b.Counts) == 0
+}
+
+func (b *Buckets) last() int32 {
+	return b.Offset + int32(len(b.Counts)) - 1
+}
+
+// add adds n values to the bucket at idx, growing the range as needed.
+func (b *Buckets) add(idx int32, n uint64) {
+	switch {
+	case b.empty():
+		b.Offset = idx
+		b.Counts = append(b.Counts[:0], n)
+		return
+	case idx < b.Offset:
+		grown := make([]uint64, int(b.last()-idx)+1)
+		copy(grown[b.Offset-idx:], b.Counts)
+		b.Counts = grown
+		b.Offset = idx
+	case idx > b.last():
+		for i := b.last(); i < idx; i++ {
+			b.Counts = append(b.Counts, 0)
+		}
+	}
+	b.Counts[idx-b.Offset] += n
+}
+
+// downscale merges the buckets for a scale change lower.
+func (b *Buckets) downscale(change uint) {
+	if change == 0 || b.empty() {
+		return
+	}
+	offset := b.Offset >> change
+	merged := make([]uint64, int(b.last()>>change-offset)+1)
+	for i, n := range b.Counts {
+		merged[(b.Offset+int32(i))>>change-offset] += n
+	}
+	b.Offset = offset
+	b.Counts = merged
+}
+
+// Histogram is an exponential histogram.  The zero value is not usable, use New.
+type Histogram struct {
+	Scale      int32   // Current scale of the buckets
+	ZeroCount  uint64  // Number of values which are 0
+	Positive   Buckets // Buckets of the positive values
+	Negative   Buckets // Buckets of the negative values, by their absolute value
+	Count      uint64  // Number of values, including ZeroCount
+	Sum        float64 // Sum of the values
+	SumSquares float64 // Sum of the squares of the values, for the standard deviation
+	Min        float64 // Lowest value, 0 if Count is 0
+	Max        float64 // Highest value, 0 if Count is 0
+
+	initialScale int32
+	maxBuckets   int
+}
+
+// New returns an empty histogram which starts at scale, capped to MaxScale, and keeps at most maxBuckets buckets of
+// each sign, at least MinBuckets.
+func New(scale int32, maxBuckets int) *Histogram {
+	if scale > MaxScale {
+		scale = MaxScale
+	} else if scale < MinScale {
+		scale = MinScale
+	}
+	if maxBuckets < MinBuckets {
+		maxBuckets = MinBuckets
+	}
+	return &Histogram{
+		Scale:        scale,
+		initialScale: scale,
+		maxBuckets:   maxBuckets,
+	}
+}
+
+// MaxBuckets returns the most buckets of each sign the histogram keeps.
+func (h *Histogram) MaxBuckets() int {
+	return h.maxBuckets
+}
+
+// Reset empties the histogram, returning it to the scale it was created with, and keeping its memory.
+func (h *Histogram) Reset() {
+	h.Scale = h.initialScale
+	h.ZeroCount = 0
+	h.Positive = Buckets{Counts: h.Positive.Counts[:0]}
+	h.Negative = Buckets{Counts: h.Negative.Counts[:0]}
+	h.Count = 0
+	h.Sum = 0
+	h.SumSquares = 0
+	h.Min = 0
+	h.Max = 0
+}
+
+// Copy returns a copy of the histogram which shares no memory with it.
+func (h *Histogram) Copy() *Histogram {
+	if h == nil {
+		return nil
+	}
+	c := *h
+	c.Positive.Counts = append([]uint64(nil), h.Positive.Counts...)
+	c.Negative.Counts = append([]uint64(nil), h.Negative.Counts...)
+	return &c
+}
+
+// Insert adds a value to the histogram.  NaN and infinite values are ignored.
+func (h *Histogram) Insert(v float64) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+	h.addStats(1, v, v, v, v*v)
+	if v == 0 {
+		h.ZeroCount++
+		return
+	}
+	b := &h.Positive
+	if v < 0 {
+		b = &h.Negative
+		v = -v
+	}
+	idx := index(v, h.Scale)
+	low, high := idx, idx
+	if !b.empty() {
+		low, high = minInt32(low, b.Offset), maxInt32(high, b.last())
+	}
+	if change := h.scaleChange(low, high); change > 0 {
+		h.downscale(change)
+		idx >>= change
+	}
+	b.add(idx, 1)
+}
+
+// Merge adds the values of o to the histogram.  The result is the histogram of all the values, at the lower of the
+// two scales or lower if they no longer fit in the buckets, exactly as if they had all been inserted in to it.
+func (h *Histogram) Merge(o *Histogram) {
+	if o.Count == 0 {
+		return
+	}
+	h.addStats(o.Count, o.Sum, o.Min, o.Max, o.SumSquares)
+	h.ZeroCount += o.ZeroCount
+
+	scale := h.Scale
+	if o.Scale < scale {
+		scale = o.Scale
+	}
+	var change uint
+	for _, pair := range [][2]*Buckets{{&h.Positive, &o.Positive}, {&h.Negative, &o.Negative}} {
+		low, high, ok := mergedRange(pair[0], h.Scale-scale, pair[1], o.Scale-scale)
+		if ok {
+			if c := scaleChangeFor(low, high, scale, h.maxBuckets); c > change {
+				change = c
+			}
+		}
+	}
+	h.downscale(uint(h.Scale-scale) + change)
+	oChange := uint(o.Scale-scale) + change
+	for _, pair := range [][2]*Buckets{{&h.Positive, &o.Positive}, {&h.Negative, &o.Negative}} {
+		for i, n := range pair[1].Counts {
+			if n > 0 {
+				pair[0].add((pair[1].Offset+int32(i))>>oChange, n)
+			}
+		}
+	}
+}
+
+// mergedRange returns the range of indexes of a and b after downscaling them by aChange and bChange, or false if
+// both are empty.
+func mergedRange(a *Buckets, aChange int32, b *Buckets, bChange int32) (int32, int32, bool) {
+	switch {
+	case a.empty() && b.empty():
+		return 0, 0, false
+	case a.empty():
+		return b.Offset >> uint(bChange), b.last() >> uint(bChange), true
+	case b.empty():
+		return a.Offset >> uint(aChange), a.last() >> uint(aChange), true
+	}
+	return minInt32(a.Offset>>uint(aChange), b.Offset>>uint(bChange)), maxInt32(a.last()>>uint(aChange), b.last()>>uint(bChange)), true
+}
+
+func (h *Histogram) addStats(count uint64, sum, min, max, sumSquares float64) {
+	if h.Count == 0 || min < h.Min {
+		h.Min = min
+	}
+	if h.Count == 0 || max > h.Max {
+		h.Max = max
+	}
+	h.Count += count
+	h.Sum += sum
+	h.SumSquares += sumSquares
+}
+
+// scaleChange returns how much lower the scale must be for buckets low to high to fit.
+func (h *Histogram) scaleChange(low, high int32) uint {
+	return scaleChangeFor(low, high, h.Scale, h.maxBuckets)
+}
+
+func scaleChangeFor(low, high, scale int32, maxBuckets int) uint {
+	var change uint
+	for int64(high)-int64(low) >= int64(maxBuckets) && scale-int32(change) > MinScale {
+		low >>= 1
+		high >>= 1
+		change++
+	}
+	return change
+}
+
+func (h *Histogram) downscale(change uint) {
+	if change == 0 {
+		return
+	}
+	h.Positive.downscale(change)
+	h.Negative.downscale(change)
+	h.Scale -= int32(change)
+}
+
+// index returns the index of the bucket holding v, which must be positive and finite, at scale.
+func index(v float64, scale int32) int32 {
+	frac, exp := math.Frexp(v) // v = frac * 2^exp, with frac in [0.5, 1)
+	if scale <= 0 {
+		// v is in (2^(exp-1), 2^exp], unless it is exactly 2^(exp-1), which is in the bucket below.
+		idx := int32(exp - 1)
+		if frac == 0.5 {
+			idx--
+		}
+		return idx >> uint(-scale)
+	}
+	if frac == 0.5 {
+		return int32(exp-1)<<uint(scale) - 1
+	}
+	idx := int32(math.Ceil(math.Log2(v)*math.Ldexp(1, int(scale)))) - 1
+	// The logarithm may be off by a little at the edge of a bucket.
+	if lowerBound(idx, scale) >= v {
+		idx--
+	} else if lowerBound(idx+1, scale) < v {
+		idx++
+	}
+	return idx
+}
+
+// lowerBound returns the exclusive lower bound of bucket idx at scale.
+func lowerBound(idx, scale int32) float64 {
+	return math.Exp2(math.Ldexp(float64(idx), -int(scale)))
+}
+
+// bucketValue returns the estimate of the values in bucket idx at scale, the harmonic mean of its bounds, which has a
+// relative error of at most (base-1)/(base+1) for any value in the bucket.
+func bucketValue(idx, scale int32) float64 {
+	lower, upper := lowerBound(idx, scale), lowerBound(idx+1, scale)
+	if math.IsInf(upper, 1) {
+		return lower
+	}
+	return 2 * lower * upper / (lower + upper)
+}
+
+// RelativeError returns the largest relative error of the value of a bucket at scale.
+func RelativeError(scale int32) float64 {
+	base := math.Exp2(math.Ldexp(1, -int(scale)))
+	return (base - 1) / (base + 1)
+}
+
+// Each calls f with the estimated value and count of each non-empty bucket in ascending order of value, including
+// the zero bucket.
+func (h *Histogram) Each(f func(value float64, count uint64)) {
+	for i := len(h.Negative.Counts) - 1; i >= 0; i-- {
+		if n := h.Negative.Counts[i]; n > 0 {
+			f(-bucketValue(h.Negative.Offset+int32(i), h.Scale), n)
+		}
+	}
+	if h.ZeroCount > 0 {
+		f(0, h.ZeroCount)
+	}
+	for i, n := range h.Positive.Counts {
+		if n > 0 {
+			f(bucketValue(h.Positive.Offset+int32(i), h.Scale), n)
+		}
+	}
+}
+
+// ValueAtRank returns the estimated value of rank, from 1 for the lowest value to Count for the highest.  The lowest
+// and highest values are exact.
+func (h *Histogram) ValueAtRank(rank uint64) float64 {
+	switch {
+	case h.Count == 0:
+		return 0
+	case rank <= 1:
+		return h.Min
+	case rank >= h.Count:
+		return h.Max
+	}
+	var seen uint64
+	value := h.Max
+	done := false
+	h.Each(func(v float64, n uint64) {
+		if done {
+			return
+		}
+		seen += n
+		if seen >= rank {
+			value = v
+			done = true
+		}
+	})
+	return h.clamp(value)
+}
+
+// Quantile returns the estimated value at quantile q, between 0 and 1, by the nearest rank.
+func (h *Histogram) Quantile(q float64) float64 {
+	return h.ValueAtRank(uint64(math.Ceil(q * float64(h.Count))))
+}
+
+// SumBelowRank returns the estimated sum and sum of squares of the rank lowest values.
+func (h *Histogram) SumBelowRank(rank uint64) (float64, float64) {
+	if rank >= h.Count {
+		return h.Sum, h.SumSquares
+	}
+	var sum, sumSquares float64
+	remaining := rank
+	h.Each(func(v float64, n uint64) {
+		if remaining == 0 {
+			return
+		}
+		if n > remaining {
+			n = remaining
+		}
+		v = h.clamp(v)
+		sum += float64(n) * v
+		sumSquares += float64(n) * v * v
+		remaining -= n
+	})
+	return sum, sumSquares
+}
+
+// CountAtOrBelow returns the estimated number of values at or below x, to the resolution of the buckets.
+func (h *Histogram) CountAtOrBelow(x float64) uint64 {
+	var count uint64
+	h.Each(func(v float64, n uint64) {
+		if h.clamp(v) <= x {
+			count += n
+		}
+	})
+	return count
+}
+
+func (h *Histogram) clamp(v float64) float64 {
+	if v < h.Min {
+		return h.Min
+	}
+	if v > h.Max {
+		return h.Max
+	}
+	return v
+}
+
+func minInt32(a, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt32(a, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,175 @@
+package exphist
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		v     float64
+		scale int32
+		idx   int32
+	}{
+		{1, 0, -1}, // Buckets are exclusive of their lower bound
+		{1.5, 0, 0},
+		{2, 0, 0},
+		{3, 0, 1},
+		{4, 0, 1},
+		{0.25, 0, -3},
+		{4, -1, 0},
+		{5, -1, 1},
+		{1.2, 1, 0},
+		{1.5, 1, 1},
+		{2, 1, 1},
+		{2, 3, 7},
+		{math.SmallestNonzeroFloat64, 0, -1075},
+		{math.MaxFloat64, 0, 1023},
+		{math.MaxFloat64, MinScale, 0},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.idx, index(test.v, test.scale), "%v at scale %d", test.v, test.scale)
+	}
+
+	// Every value is above the lower bound of its bucket and at most the upper bound.
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		v := math.Exp(r.NormFloat64() * 20)
+		for _, scale := range []int32{-3, 0, 4, 8, MaxScale} {
+			idx := index(v, scale)
+			require.True(t, lowerBound(idx, scale) < v && v <= lowerBound(idx+1, scale), "%v at scale %d", v, scale)
+		}
+	}
+}
+
+// distributions are the samples the quantile error is checked on.
+var distributions = map[string]func(r *rand.Rand) float64{
+	"uniform": func(r *rand.Rand) float64 {
+		return 1 + r.Float64()*999
+	},
+	"exponential": func(r *rand.Rand) float64 {
+		return r.ExpFloat64() * 100
+	},
+	"lognormal": func(r *rand.Rand) float64 {
+		return math.Exp(r.NormFloat64()*2 + 3)
+	},
+	"bimodal": func(r *rand.Rand) float64 {
+		if r.Intn(10) == 0 {
+			return 5000 + r.NormFloat64()*100
+		}
+		return 20 + r.NormFloat64()*2
+	},
+	"signed": func(r *rand.Rand) float64 {
+		if r.Intn(20) == 0 {
+			return 0
+		}
+		return r.NormFloat64() * 50
+	},
+}
+
+func TestQuantileError(t *testing.T) {
+	t.Parallel()
+	for name, dist := range distributions {
+		for _, maxBuckets := range []int{20, 160} {
+			r := rand.New(rand.NewSource(42))
+			h := New(MaxScale, maxBuckets)
+			values := make([]float64, 20000)
+			for i := range values {
+				values[i] = dist(r)
+				h.Insert(values[i])
+			}
+			sort.Float64s(values)
+			assert.True(t, len(h.Positive.Counts) <= maxBuckets && len(h.Negative.Counts) <= maxBuckets, name)
+			assert.Equal(t, values[0], h.Min, name)
+			assert.Equal(t, values[len(values)-1], h.Max, name)
+
+			bound := RelativeError(h.Scale)
+			for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+				exact := values[int(math.Ceil(q*float64(len(values))))-1]
+				estimate := h.Quantile(q)
+				assert.InDelta(t, exact, estimate, bound*math.Abs(exact)+1e-9, "%s with %d buckets at %v (scale %d)", name, maxBuckets, q, h.Scale)
+			}
+		}
+	}
+}
+
+func TestMergeIsExact(t *testing.T) {
+	t.Parallel()
+	for name, dist := range distributions {
+		r := rand.New(rand.NewSource(7))
+		all := New(12, 80)
+		windows := make([]*Histogram, 5)
+		for i := range windows {
+			windows[i] = New(12, 80)
+		}
+		// Each window sees a different part of the range, so they are at different scales.
+		for i := 0; i < 5000; i++ {
+			v := dist(r) * float64(1+i%5*i%5)
+			all.Insert(v)
+			windows[i%5].Insert(v)
+		}
+		merged := New(12, 80)
+		for _, w := range windows {
+			merged.Merge(w)
+		}
+		assert.Equal(t, all.Scale, merged.Scale, name)
+		assert.Equal(t, all.ZeroCount, merged.ZeroCount, name)
+		assert.Equal(t, all.Positive, merged.Positive, name)
+		assert.Equal(t, all.Negative, merged.Negative, name)
+		assert.Equal(t, all.Count, merged.Count, name)
+		assert.Equal(t, all.Min, merged.Min, name)
+		assert.Equal(t, all.Max, merged.Max, name)
+		assert.InEpsilon(t, all.SumSquares, merged.SumSquares, 1e-9, name)
+	}
+}
+
+func TestMergeDoesNotChangeOther(t *testing.T) {
+	t.Parallel()
+	a, b := New(8, 10), New(8, 10)
+	a.Insert(1)
+	b.Insert(1000)
+	b.Insert(1001)
+	before := b.Copy()
+	a.Merge(b)
+	assert.Equal(t, before, b)
+	assert.EqualValues(t, 3, a.Count)
+	assert.True(t, a.Scale < 8)
+}
+
+func TestRanks(t *testing.T) {
+	t.Parallel()
+	h := New(MaxScale, 160)
+	for _, v := range []float64{-2, 0, 1, 2, 3, 4} {
+		h.Insert(v)
+	}
+	h.Insert(math.NaN())
+	h.Insert(math.Inf(1))
+	assert.EqualValues(t, 6, h.Count)
+	bound := RelativeError(h.Scale)
+	assert.Equal(t, -2.0, h.ValueAtRank(1))
+	assert.Equal(t, 0.0, h.ValueAtRank(2))
+	assert.InEpsilon(t, 2.0, h.ValueAtRank(4), bound)
+	assert.Equal(t, 4.0, h.ValueAtRank(6))
+
+	// The sums are of the estimated values, so the sum of squares has up to twice the relative error.
+	sum, sumSquares := h.SumBelowRank(3)
+	assert.InDelta(t, -1.0, sum, 3*bound)
+	assert.InDelta(t, 5.0, sumSquares, 2*bound*5)
+	sum, sumSquares = h.SumBelowRank(6)
+	assert.Equal(t, 8.0, sum)
+	assert.Equal(t, 34.0, sumSquares)
+
+	assert.EqualValues(t, 4, h.CountAtOrBelow(2))
+	assert.EqualValues(t, 1, h.CountAtOrBelow(-1))
+
+	h.Reset()
+	assert.Zero(t, h.Count)
+	assert.Equal(t, int32(MaxScale), h.Scale)
+	assert.Zero(t, h.Quantile(0.5))
+}
@@ -0,0 +1,180 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v3.21.12
+// source: aggregator.proto
+
+package grpcapi
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Aggregator_ListMetrics_FullMethodName   = "/gostatsd.api.v1.Aggregator/ListMetrics"
+	Aggregator_StreamFlushes_FullMethodName = "/gostatsd.api.v1.Aggregator/StreamFlushes"
+)
+
+// AggregatorClient is the client API for Aggregator service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AggregatorClient interface {
+	// ListMetrics returns the metrics received so far this flush interval.
+	ListMetrics(ctx context.Context, in *MetricsRequest, opts ...grpc.CallOption) (*Snapshot, error)
+	// StreamFlushes sends the metrics of each flush, once every aggregator has been flushed, until the client
+	// cancels.  A client which falls behind misses flushes rather than delaying them.
+	StreamFlushes(ctx context.Context, in *MetricsRequest, opts ...grpc.CallOption) (Aggregator_StreamFlushesClient, error)
+}
+
+type aggregatorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAggregatorClient(cc grpc.ClientConnInterface) AggregatorClient {
+	return &aggregatorClient{cc}
+}
+
+func (c *aggregatorClient) ListMetrics(ctx context.Context, in *MetricsRequest, opts ...grpc.CallOption) (*Snapshot, error) {
+	out := new(Snapshot)
+	err := c.cc.Invoke(ctx, Aggregator_ListMetrics_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aggregatorClient) StreamFlushes(ctx context.Context, in *MetricsRequest, opts ...grpc.CallOption) (Aggregator_StreamFlushesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Aggregator_ServiceDesc.Streams[0], Aggregator_StreamFlushes_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &aggregatorStreamFlushesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Aggregator_StreamFlushesClient interface {
+	Recv() (*Snapshot, error)
+	grpc.ClientStream
+}
+
+type aggregatorStreamFlushesClient struct {
+	grpc.ClientStream
+}
+
+func (x *aggregatorStreamFlushesClient) Recv() (*Snapshot, error) {
+	m := new(Snapshot)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// AggregatorServer is the server API for Aggregator service.
+// All implementations must embed UnimplementedAggregatorServer
+// for forward compatibility
+type AggregatorServer interface {
+	// ListMetrics returns the metrics received so far this flush interval.
+	ListMetrics(context.Context, *MetricsRequest) (*Snapshot, error)
+	// StreamFlushes sends the metrics of each flush, once every aggregator has been flushed, until the client
+	// cancels.  A client which falls behind misses flushes rather than delaying them.
+	StreamFlushes(*MetricsRequest, Aggregator_StreamFlushesServer) error
+	mustEmbedUnimplementedAggregatorServer()
+}
+
+// UnimplementedAggregatorServer must be embedded to have forward compatible implementations.
+type UnimplementedAggregatorServer struct {
+}
+
+func (UnimplementedAggregatorServer) ListMetrics(context.Context, *MetricsRequest) (*Snapshot, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListMetrics not implemented")
+}
+func (UnimplementedAggregatorServer) StreamFlushes(*MetricsRequest, Aggregator_StreamFlushesServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamFlushes not implemented")
+}
+func (UnimplementedAggregatorServer) mustEmbedUnimplementedAggregatorServer() {}
+
+// UnsafeAggregatorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AggregatorServer will
+// result in compilation errors.
+type UnsafeAggregatorServer interface {
+	mustEmbedUnimplementedAggregatorServer()
+}
+
+func RegisterAggregatorServer(s grpc.ServiceRegistrar, srv AggregatorServer) {
+	s.RegisterService(&Aggregator_ServiceDesc, srv)
+}
+
+func _Aggregator_ListMetrics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MetricsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AggregatorServer).ListMetrics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Aggregator_ListMetrics_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AggregatorServer).ListMetrics(ctx, req.(*MetricsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Aggregator_StreamFlushes_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(MetricsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AggregatorServer).StreamFlushes(m, &aggregatorStreamFlushesServer{stream})
+}
+
+type Aggregator_StreamFlushesServer interface {
+	Send(*Snapshot) error
+	grpc.ServerStream
+}
+
+type aggregatorStreamFlushesServer struct {
+	grpc.ServerStream
+}
+
+func (x *aggregatorStreamFlushesServer) Send(m *Snapshot) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Aggregator_ServiceDesc is the grpc.ServiceDesc for Aggregator service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Aggregator_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gostatsd.api.v1.Aggregator",
+	HandlerType: (*AggregatorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListMetrics",
+			Handler:    _Aggregator_ListMetrics_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamFlushes",
+			Handler:       _Aggregator_StreamFlushes_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "aggregator.proto",
+}
@@ -0,0 +1,4 @@
+// Package grpcapi holds the schema of the read-only gRPC API and the code generated from it.
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative aggregator.proto
@@ -0,0 +1,255 @@
+// Package hdrhist implements an HDR (high dynamic range) histogram, which records values from a lowest to a highest
+// trackable value to a fixed number of significant decimal digits, so the relative error of any value is bounded
+// however wide the range.
+//
+// Values are counted in units of the lowest trackable value.  Bucket b holds the values in [2^b * h, 2^(b+1) * h)
+// units, where h is half the number of sub-buckets, split in to h sub-buckets of 2^b units each, except bucket 0 which
+// also holds the values below h with a sub-bucket per unit.  Only the sub-buckets which hold values take memory.
+package hdrhist
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+)
+
+const (
+	// MinSignificantDigits is the fewest significant decimal digits a histogram can keep.
+	MinSignificantDigits = 1
+	// MaxSignificantDigits is the most significant decimal digits a histogram can keep.
+	MaxSignificantDigits = 5
+)
+
+// Histogram is an HDR histogram.  The zero value is not usable, use New.
+type Histogram struct {
+	Count      uint64  // Number of values
+	Sum        float64 // Sum of the values
+	SumSquares float64 // Sum of the squares of the values, for the standard deviation
+	Min        float64 // Lowest value, 0 if Count is 0
+	Max        float64 // Highest value, 0 if Count is 0
+	Clamped    uint64  // Number of values outside of the trackable range, counted in the lowest or highest bucket
+
+	lowest      float64 // Lowest trackable value, the unit values are counted in
+	highest     int64   // Highest trackable value, in units
+	halfCountLg uint    // log2 of half the number of sub-buckets of each bucket
+	subBuckets  int64   // Number of sub-buckets of each bucket
+	digits      int
+
+	counts map[int32]uint64 // Number of values by index of sub-bucket
+	sorted []int32          // Indexes of counts in ascending order, nil when a new index has been added since
+}
+
+// New returns an empty histogram which records values from lowest to highest, both positive, to digits significant
+// decimal digits, between MinSignificantDigits and MaxSignificantDigits.
+func New(lowest, highest float64, digits int) *Histogram {
+	if digits < MinSignificantDigits {
+		digits = MinSignificantDigits
+	} else if digits > MaxSignificantDigits {
+		digits = MaxSignificantDigits
+	}
+	// A value up to 2 * 10^digits units must have a sub-bucket of its own, for digits of precision past that.
+	singleUnit := 2 * math.Pow10(digits)
+	countLg := uint(math.Ceil(math.Log2(singleUnit)))
+	highestUnits := int64(math.Ceil(highest / lowest))
+	if highestUnits < 2 {
+		highestUnits = 2
+	}
+	return &Histogram{
+		lowest:      lowest,
+		highest:     highestUnits,
+		halfCountLg: countLg - 1,
+		subBuckets:  1 << countLg,
+		digits:      digits,
+		counts:      map[int32]uint64{},
+	}
+}
+
+// SignificantDigits returns the number of significant decimal digits the histogram keeps.
+func (h *Histogram) SignificantDigits() int {
+	return h.digits
+}
+
+// Buckets returns the number of sub-buckets which hold values.
+func (h *Histogram) Buckets() int {
+	return len(h.counts)
+}
+
+// RelativeError returns the largest relative error of a value estimated by a histogram keeping digits significant
+// decimal digits, for values of at least 10^digits times the lowest trackable value.
+func RelativeError(digits int) float64 {
+	return 0.5 * math.Pow10(-digits)
+}
+
+// Reset empties the histogram, keeping its memory.
+func (h *Histogram) Reset() {
+	for idx := range h.counts {
+		delete(h.counts, idx)
+	}
+	h.sorted = h.sorted[:0]
+	h.Count = 0
+	h.Sum = 0
+	h.SumSquares = 0
+	h.Min = 0
+	h.Max = 0
+	h.Clamped = 0
+}
+
+// Copy returns a copy of the histogram which shares no memory with it.
+func (h *Histogram) Copy() *Histogram {
+	if h == nil {
+		return nil
+	}
+	c := *h
+	c.counts = make(map[int32]uint64, len(h.counts))
+	for idx, n := range h.counts {
+		c.counts[idx] = n
+	}
+	c.sorted = nil
+	return &c
+}
+
+// Insert adds a value to the histogram.  NaN and infinite values are ignored.  A value outside of the trackable range
+// is counted in the lowest or highest bucket, but is included as it is in the sum, min and max.
+func (h *Histogram) Insert(v float64) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+	if h.Count == 0 || v < h.Min {
+		h.Min = v
+	}
+	if h.Count == 0 || v > h.Max {
+		h.Max = v
+	}
+	h.Count++
+	h.Sum += v
+	h.SumSquares += v * v
+
+	units := v / h.lowest
+	switch {
+	case units < 0:
+		units = 0
+		h.Clamped++
+	case units > float64(h.highest):
+		units = float64(h.highest)
+		h.Clamped++
+	}
+	idx := h.index(int64(units))
+	if _, ok := h.counts[idx]; !ok {
+		h.sorted = nil
+	}
+	h.counts[idx]++
+}
+
+// index returns the index of the sub-bucket holding units.
+func (h *Histogram) index(units int64) int32 {
+	bucket := 64 - bits.LeadingZeros64(uint64(units|(h.subBuckets-1))) - int(h.halfCountLg+1)
+	sub := units >> uint(bucket)
+	return int32(int64(bucket+1)<<h.halfCountLg + sub - h.subBuckets/2)
+}
+
+// bounds returns the lowest value in units of the sub-bucket at idx, and the number of units it holds.
+func (h *Histogram) bounds(idx int32) (int64, int64) {
+	half := h.subBuckets / 2
+	bucket := int64(idx)>>h.halfCountLg - 1
+	sub := int64(idx)&(half-1) + half
+	if bucket < 0 {
+		sub -= half
+		bucket = 0
+	}
+	return sub << uint(bucket), 1 << uint(bucket)
+}
+
+// bucketValue returns the estimate of the values in the sub-bucket at idx, the middle of its range.
+func (h *Histogram) bucketValue(idx int32) float64 {
+	low, size := h.bounds(idx)
+	return (float64(low) + float64(size)/2) * h.lowest
+}
+
+// Each calls f with the estimated value and count of each non-empty sub-bucket in ascending order of value.
+func (h *Histogram) Each(f func(value float64, count uint64)) {
+	if h.sorted == nil {
+		h.sorted = make([]int32, 0, len(h.counts))
+		for idx := range h.counts {
+			h.sorted = append(h.sorted, idx)
+		}
+		sort.Slice(h.sorted, func(i, j int) bool { return h.sorted[i] < h.sorted[j] })
+	}
+	for _, idx := range h.sorted {
+		f(h.bucketValue(idx), h.counts[idx])
+	}
+}
+
+// ValueAtRank returns the estimated value of rank, from 1 for the lowest value to Count for the highest.  The lowest
+// and highest values are exact.
+func (h *Histogram) ValueAtRank(rank uint64) float64 {
+	switch {
+	case h.Count == 0:
+		return 0
+	case rank <= 1:
+		return h.Min
+	case rank >= h.Count:
+		return h.Max
+	}
+	var seen uint64
+	value := h.Max
+	done := false
+	h.Each(func(v float64, n uint64) {
+		if done {
+			return
+		}
+		seen += n
+		if seen >= rank {
+			value = v
+			done = true
+		}
+	})
+	return h.clamp(value)
+}
+
+// Quantile returns the estimated value at quantile q, between 0 and 1, by the nearest rank.
+func (h *Histogram) Quantile(q float64) float64 {
+	return h.ValueAtRank(uint64(math.Ceil(q * float64(h.Count))))
+}
+
+// SumBelowRank returns the estimated sum and sum of squares of the rank lowest values.
+func (h *Histogram) SumBelowRank(rank uint64) (float64, float64) {
+	if rank >= h.Count {
+		return h.Sum, h.SumSquares
+	}
+	var sum, sumSquares float64
+	remaining := rank
+	h.Each(func(v float64, n uint64) {
+		if remaining == 0 {
+			return
+		}
+		if n > remaining {
+			n = remaining
+		}
+		v = h.clamp(v)
+		sum += float64(n) * v
+		sumSquares += float64(n) * v * v
+		remaining -= n
+	})
+	return sum, sumSquares
+}
+
+// CountAtOrBelow returns the estimated number of values at or below x, to the resolution of the sub-buckets.
+func (h *Histogram) CountAtOrBelow(x float64) uint64 {
+	var count uint64
+	h.Each(func(v float64, n uint64) {
+		if h.clamp(v) <= x {
+			count += n
+		}
+	})
+	return count
+}
+
+func (h *Histogram) clamp(v float64) float64 {
+	if v < h.Min {
+		return h.Min
+	}
+	if v > h.Max {
+		return h.Max
+	}
+	return v
+}
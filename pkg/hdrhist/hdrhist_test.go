@@ -0,0 +1,126 @@
+package hdrhist
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexBounds(t *testing.T) {
+	t.Parallel()
+	for _, digits := range []int{MinSignificantDigits, 2, 3, MaxSignificantDigits} {
+		h := New(1, 1e12, digits)
+		r := rand.New(rand.NewSource(1))
+		previous := int32(-1)
+		// Every value is within the bounds of its sub-bucket, and the indexes never fall as the value rises.
+		for _, units := range []int64{0, 1, 2, h.subBuckets/2 - 1, h.subBuckets / 2, h.subBuckets - 1, h.subBuckets, h.subBuckets + 1, 2*h.subBuckets - 1, 2 * h.subBuckets, 1e12} {
+			idx := h.index(units)
+			low, size := h.bounds(idx)
+			require.True(t, low <= units && units < low+size, "%d at %d digits", units, digits)
+			require.True(t, idx >= previous, "%d at %d digits", units, digits)
+			previous = idx
+		}
+		for i := 0; i < 10000; i++ {
+			units := int64(math.Exp(r.Float64() * 27))
+			low, size := h.bounds(h.index(units))
+			require.True(t, low <= units && units < low+size, "%d at %d digits", units, digits)
+		}
+	}
+}
+
+// distributions are the samples the quantile error is checked on, in milliseconds.
+var distributions = map[string]func(r *rand.Rand) float64{
+	"uniform": func(r *rand.Rand) float64 {
+		return 1 + r.Float64()*999
+	},
+	"exponential": func(r *rand.Rand) float64 {
+		return r.ExpFloat64() * 100
+	},
+	"lognormal": func(r *rand.Rand) float64 {
+		return math.Exp(r.NormFloat64()*2 + 3)
+	},
+	"bimodal": func(r *rand.Rand) float64 {
+		if r.Intn(10) == 0 {
+			return 5000 + r.NormFloat64()*100
+		}
+		return 20 + r.NormFloat64()*2
+	},
+}
+
+func TestQuantileError(t *testing.T) {
+	t.Parallel()
+	const lowest = 0.001
+	for name, dist := range distributions {
+		for _, digits := range []int{2, 3} {
+			r := rand.New(rand.NewSource(42))
+			h := New(lowest, 3600000, digits)
+			values := make([]float64, 20000)
+			for i := range values {
+				values[i] = dist(r)
+				h.Insert(values[i])
+			}
+			sort.Float64s(values)
+			assert.Equal(t, values[0], h.Min, name)
+			assert.Equal(t, values[len(values)-1], h.Max, name)
+			assert.Zero(t, h.Clamped, name)
+
+			// Values too small for the significant digits are within a unit.
+			bound := RelativeError(digits)
+			for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+				exact := values[int(math.Ceil(q*float64(len(values))))-1]
+				estimate := h.Quantile(q)
+				assert.InDelta(t, exact, estimate, bound*math.Abs(exact)+lowest, "%s with %d digits at %v", name, digits, q)
+			}
+		}
+	}
+}
+
+func TestFewerBucketsThanValues(t *testing.T) {
+	t.Parallel()
+	h := New(0.001, 60000, 2)
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 100000; i++ {
+		h.Insert(r.ExpFloat64() * 100)
+	}
+	assert.EqualValues(t, 100000, h.Count)
+	assert.True(t, h.Buckets() < 2000, "%d buckets", h.Buckets())
+}
+
+func TestRanks(t *testing.T) {
+	t.Parallel()
+	h := New(0.01, 100, 3)
+	for _, v := range []float64{-2, 0, 1, 2, 3, 4, 500} {
+		h.Insert(v)
+	}
+	h.Insert(math.NaN())
+	h.Insert(math.Inf(1))
+	assert.EqualValues(t, 7, h.Count)
+	assert.EqualValues(t, 2, h.Clamped, "-2 and 500 are outside of the trackable range")
+	assert.Equal(t, -2.0, h.ValueAtRank(1))
+	assert.InDelta(t, 0.0, h.ValueAtRank(2), 0.01)
+	assert.InEpsilon(t, 2.0, h.ValueAtRank(4), RelativeError(2))
+	assert.Equal(t, 500.0, h.ValueAtRank(7))
+
+	sum, sumSquares := h.SumBelowRank(7)
+	assert.Equal(t, 508.0, sum)
+	assert.Equal(t, 250034.0, sumSquares)
+	// A value below the trackable range is counted in the lowest bucket.
+	sum, _ = h.SumBelowRank(4)
+	assert.InDelta(t, 3.0, sum, 0.05)
+
+	assert.EqualValues(t, 5, h.CountAtOrBelow(3.01))
+	assert.EqualValues(t, 2, h.CountAtOrBelow(0.01))
+	assert.Zero(t, h.CountAtOrBelow(-1))
+
+	c := h.Copy()
+	h.Reset()
+	assert.Zero(t, h.Count)
+	assert.Zero(t, h.Buckets())
+	assert.Zero(t, h.Quantile(0.5))
+	assert.EqualValues(t, 7, c.Count)
+	assert.Equal(t, 500.0, c.Quantile(1))
+}
@@ -0,0 +1,102 @@
+// Package hll implements a HyperLogLog sketch for estimating the cardinality of large sets in fixed memory.
+//
+// See "HyperLogLog: the analysis of a near-optimal cardinality estimation algorithm", Flajolet et al.
+package hll
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// Precision is the number of bits of the hash used to pick a register.  It gives 2^14 registers, using 16KB
+// per sketch, with a standard error of about 0.8%.
+const Precision = 14
+
+const numRegisters = 1 << Precision
+
+// Sketch is a HyperLogLog sketch.  The zero value is not usable, use New.
+type Sketch struct {
+	registers []uint8
+}
+
+// New returns an empty Sketch.
+func New() *Sketch {
+	return &Sketch{
+		registers: make([]uint8, numRegisters),
+	}
+}
+
+// InsertHash adds a well distributed 64 bit hash of a member to the sketch.
+func (s *Sketch) InsertHash(x uint64) {
+	idx := x >> (64 - Precision)
+	// The sentinel bit bounds the rank when the remaining bits are all zero.
+	rank := uint8(bits.LeadingZeros64(x<<Precision|1<<(Precision-1))) + 1
+	if rank > s.registers[idx] {
+		s.registers[idx] = rank
+	}
+}
+
+// InsertInt adds an integer member to the sketch.
+func (s *Sketch) InsertInt(v int64) {
+	s.InsertHash(mix(uint64(v)))
+}
+
+// InsertString adds a string member to the sketch.
+func (s *Sketch) InsertString(v string) {
+	// 64 bit FNV-1a, inlined to avoid allocating a hash.Hash64.
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(v); i++ {
+		h ^= uint64(v[i])
+		h *= 1099511628211
+	}
+	s.InsertHash(mix(h))
+}
+
+// Estimate returns the estimated number of distinct members inserted in to the sketch.
+func (s *Sketch) Estimate() uint64 {
+	const m = float64(numRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	sum := 0.0
+	zeros := 0
+	for _, r := range s.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities.
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// MarshalBinary encodes the sketch as its precision followed by its registers.
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 1+len(s.registers))
+	b[0] = Precision
+	copy(b[1:], s.registers)
+	return b, nil
+}
+
+// UnmarshalBinary replaces the sketch with one encoded by MarshalBinary.
+func (s *Sketch) UnmarshalBinary(b []byte) error {
+	if len(b) != 1+numRegisters || b[0] != Precision {
+		return errors.New("invalid sketch encoding")
+	}
+	s.registers = append(s.registers[:0], b[1:]...)
+	return nil
+}
+
+// mix is the splitmix64 finalizer, it spreads the bits of x over the whole 64 bits.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
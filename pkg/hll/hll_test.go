@@ -0,0 +1,48 @@
+package hll
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimate(t *testing.T) {
+	t.Parallel()
+	for _, n := range []int{0, 1, 100, 10000, 1000000} {
+		n := n
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			t.Parallel()
+			ints, strs := New(), New()
+			for i := 0; i < n; i++ {
+				ints.InsertInt(int64(i))
+				ints.InsertInt(int64(i)) // Duplicates are not counted
+				strs.InsertString("user" + strconv.Itoa(i))
+			}
+			for _, s := range []*Sketch{ints, strs} {
+				estimate := float64(s.Estimate())
+				assert.True(t, math.Abs(estimate-float64(n)) <= 0.03*float64(n)+1, "estimate %v for %d", estimate, n)
+			}
+		})
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	t.Parallel()
+	s := New()
+	for i := 0; i < 1000; i++ {
+		s.InsertInt(int64(i))
+	}
+	b, err := s.MarshalBinary()
+	require.NoError(t, err)
+
+	var restored Sketch
+	require.NoError(t, restored.UnmarshalBinary(b))
+	assert.Equal(t, s.Estimate(), restored.Estimate())
+
+	assert.Error(t, restored.UnmarshalBinary(b[:len(b)-1]))
+	b[0]++
+	assert.Error(t, restored.UnmarshalBinary(b))
+}
@@ -0,0 +1,71 @@
+// Package logging configures the logger of gostatsd, and creates the child loggers each component logs through.
+// Every log entry of a component carries a component field, and entries about an error carry the details as fields
+// rather than formatting them in to the message, so logs can be parsed reliably when they are written as JSON.
+package logging
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of the fields of log entries.
+const (
+	FieldComponent = "component" // Name of the component which logged the entry
+	FieldAddress   = "address"   // Network address of a socket, client or server
+	FieldBucket    = "bucket"    // Name of a metric
+	FieldBackend   = "backend"   // Name of a backend
+	FieldDuration  = "duration"  // Length of time, such as how long to wait before a retry
+	FieldInterval  = "interval"  // Sequence number of a flush
+)
+
+const (
+	// FormatText writes log entries as logfmt style text.
+	FormatText = "text"
+	// FormatJSON writes each log entry as a JSON object.
+	FormatJSON = "json"
+)
+
+// Component returns a child of the standard logger for the named component.
+func Component(name string) *log.Entry {
+	return ComponentOf(log.StandardLogger(), name)
+}
+
+// ComponentOf returns a child of logger for the named component.
+func ComponentOf(logger log.FieldLogger, name string) *log.Entry {
+	return logger.WithField(FieldComponent, name)
+}
+
+// Backend returns a child of the standard logger for the named backend, whose component is backend:<name>.
+func Backend(name string) *log.Entry {
+	return Component("backend:" + name)
+}
+
+// Configure sets the level and format of logger.  level is one of the logrus levels, such as debug or warn, and
+// format is FormatText or FormatJSON.
+func Configure(logger *log.Logger, level, format string) error {
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q, must be one of %s", level, levels())
+	}
+	switch format {
+	case FormatText:
+		logger.SetFormatter(&log.TextFormatter{})
+	case FormatJSON:
+		logger.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format %q, must be %s or %s", format, FormatText, FormatJSON)
+	}
+	logger.SetLevel(l)
+	return nil
+}
+
+// levels returns the names of all levels, from the most to the least verbose.
+func levels() string {
+	names := make([]string, 0, len(log.AllLevels))
+	for i := len(log.AllLevels) - 1; i >= 0; i-- {
+		names = append(names, log.AllLevels[i].String())
+	}
+	return strings.Join(names, ", ")
+}
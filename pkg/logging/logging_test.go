@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigure(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.Out = &buf
+	require.NoError(t, Configure(logger, "warn", FormatJSON))
+	assert.Equal(t, log.WarnLevel, logger.Level)
+
+	entry := ComponentOf(logger, "parser")
+	entry.Info("not logged")
+	entry.WithError(errors.New("boom")).WithField(FieldAddress, "127.0.0.1").Warn("Failed")
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &fields))
+	assert.Equal(t, "parser", fields[FieldComponent])
+	assert.Equal(t, "127.0.0.1", fields[FieldAddress])
+	assert.Equal(t, "boom", fields[log.ErrorKey])
+	assert.Equal(t, "Failed", fields["msg"])
+
+	require.NoError(t, Configure(logger, "debug", FormatText))
+	assert.Equal(t, log.DebugLevel, logger.Level)
+	assert.Error(t, Configure(logger, "loud", FormatText))
+	assert.Error(t, Configure(logger, "info", "xml"))
+}
+
+func TestBackend(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "backend:graphite", Backend("graphite").Data[FieldComponent])
+}
+
+// directLogging matches logging through the package level functions of logrus, which bypass the child loggers.
+var directLogging = regexp.MustCompile(`\b(log|logrus)\.(Trace|Debug|Info|Print|Warn|Warning|Error|Fatal|Panic)(f|ln)?\(|\b(log|logrus)\.(WithField|WithFields|WithError)\(`)
+
+// TestNoDirectLogging checks that everything outside this package logs through a component logger.
+func TestNoDirectLogging(t *testing.T) {
+	t.Parallel()
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	require.NoError(t, err)
+	var found []string
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			switch info.Name() {
+			case ".git", "vendor", "logging":
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			if directLogging.MatchString(scanner.Text()) {
+				rel, _ := filepath.Rel(root, path)
+				found = append(found, rel+":"+strings.TrimSpace(scanner.Text()))
+			}
+		}
+		return scanner.Err()
+	})
+	require.NoError(t, err)
+	assert.Empty(t, found, "log through logging.Component or logging.Backend rather than the standard logger")
+}
@@ -0,0 +1,215 @@
+// Package snappy decodes the snappy framing format, as sent by clients compressing a stream of lines.
+//
+// See https://github.com/google/snappy/blob/master/framing_format.txt and
+// https://github.com/google/snappy/blob/master/format_description.txt for the formats.
+package snappy
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	chunkCompressed   = 0x00
+	chunkUncompressed = 0x01
+	chunkStreamID     = 0xff
+
+	// maxUncompressedChunk is the largest amount of data a chunk may decode to.
+	maxUncompressedChunk = 65536
+	// maxChunk is the largest a compressed chunk may be, including its checksum.
+	maxChunk = 4 + 32 + maxUncompressedChunk + maxUncompressedChunk/6
+
+	// Magic is the first byte of a stream.
+	Magic = chunkStreamID
+)
+
+var (
+	// ErrCorrupt is returned when the stream is not valid.
+	ErrCorrupt = errors.New("snappy: corrupt input")
+	// ErrUnsupported is returned when the stream uses an unskippable chunk type this package doesn't know.
+	ErrUnsupported = errors.New("snappy: unsupported input")
+
+	streamID = []byte("sNaPpY")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Reader decompresses a stream in the snappy framing format.
+type Reader struct {
+	r         io.Reader
+	err       error
+	header    [4]byte
+	chunk     []byte
+	decoded   []byte
+	remaining []byte // Decoded bytes not yet read
+	readID    bool   // Whether the stream identifier has been read
+}
+
+// NewReader returns a Reader decompressing r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:       r,
+		chunk:   make([]byte, maxChunk),
+		decoded: make([]byte, maxUncompressedChunk),
+	}
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.remaining) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.nextChunk()
+	}
+	n := copy(p, r.remaining)
+	r.remaining = r.remaining[n:]
+	return n, nil
+}
+
+// nextChunk reads the next chunk, leaving any data it holds in remaining.
+func (r *Reader) nextChunk() error {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return ErrCorrupt
+		}
+		return err // io.EOF at a chunk boundary is the end of the stream
+	}
+	chunkType := r.header[0]
+	chunkLen := int(r.header[1]) | int(r.header[2])<<8 | int(r.header[3])<<16
+	if !r.readID && chunkType != chunkStreamID {
+		return ErrCorrupt
+	}
+	if chunkLen > len(r.chunk) {
+		if chunkType < 0x80 || chunkType == chunkStreamID {
+			return ErrCorrupt
+		}
+		// A skippable chunk larger than any we would otherwise read.
+		_, err := io.CopyN(ioutil.Discard, r.r, int64(chunkLen))
+		return unexpectedEOF(err)
+	}
+	chunk := r.chunk[:chunkLen]
+	if _, err := io.ReadFull(r.r, chunk); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	switch {
+	case chunkType == chunkStreamID:
+		if string(chunk) != string(streamID) {
+			return ErrCorrupt
+		}
+		r.readID = true
+	case chunkType == chunkCompressed || chunkType == chunkUncompressed:
+		if chunkLen < 4 {
+			return ErrCorrupt
+		}
+		checksum := binary.LittleEndian.Uint32(chunk)
+		data := chunk[4:]
+		if chunkType == chunkCompressed {
+			var err error
+			if data, err = decodeBlock(r.decoded, data); err != nil {
+				return err
+			}
+		} else if len(data) > maxUncompressedChunk {
+			return ErrCorrupt
+		}
+		if maskedCRC(data) != checksum {
+			return ErrCorrupt
+		}
+		r.remaining = data
+	case chunkType < 0x80:
+		return ErrUnsupported
+	default:
+		// Padding and reserved skippable chunks are ignored.
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrCorrupt
+	}
+	return err
+}
+
+// maskedCRC returns the checksum of data as stored in a chunk.
+func maskedCRC(data []byte) uint32 {
+	c := crc32.Checksum(data, crcTable)
+	return (c>>15 | c<<17) + 0xa282ead8
+}
+
+// decodeBlock decodes a snappy compressed block in to dst, which must be large enough to hold a chunk, and returns
+// the decoded bytes.
+func decodeBlock(dst, src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > uint64(len(dst)) {
+		return nil, ErrCorrupt
+	}
+	dst = dst[:length]
+	src = src[n:]
+
+	d := 0
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, size int
+		switch tag & 0x03 {
+		case 0x00: // Literal
+			size = int(tag >> 2)
+			src = src[1:]
+			if size >= 60 {
+				extra := size - 59
+				if len(src) < extra {
+					return nil, ErrCorrupt
+				}
+				size = 0
+				for i := extra - 1; i >= 0; i-- {
+					size = size<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			size++
+			if size > len(dst)-d || size > len(src) {
+				return nil, ErrCorrupt
+			}
+			copy(dst[d:], src[:size])
+			d += size
+			src = src[size:]
+			continue
+		case 0x01: // Copy with a 1 byte offset
+			if len(src) < 2 {
+				return nil, ErrCorrupt
+			}
+			size = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 0x02: // Copy with a 2 byte offset
+			if len(src) < 3 {
+				return nil, ErrCorrupt
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 0x03: // Copy with a 4 byte offset
+			if len(src) < 5 {
+				return nil, ErrCorrupt
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > d || size > len(dst)-d {
+			return nil, ErrCorrupt
+		}
+		// The source and destination may overlap, repeating the last offset bytes, so copy a byte at a time.
+		for end := d + size; d < end; d++ {
+			dst[d] = dst[d-offset]
+		}
+	}
+	if d != len(dst) {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
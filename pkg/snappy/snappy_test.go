@@ -0,0 +1,88 @@
+package snappy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var streamHeader = []byte{chunkStreamID, 6, 0, 0, 's', 'N', 'a', 'P', 'p', 'Y'}
+
+// chunk returns a chunk of chunkType holding the checksum of decoded followed by data.
+func chunk(chunkType byte, decoded, data []byte) []byte {
+	b := []byte{chunkType, 0, 0, 0}
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[4:], maskedCRC(decoded))
+	b = append(b, data...)
+	n := len(b) - 4
+	b[1], b[2], b[3] = byte(n), byte(n>>8), byte(n>>16)
+	return b
+}
+
+func stream(chunks ...[]byte) []byte {
+	return bytes.Join(append([][]byte{streamHeader}, chunks...), nil)
+}
+
+func TestReader(t *testing.T) {
+	t.Parallel()
+	line := []byte("abcd:1|c\n")
+	// "abcd" as a literal, then copies of it with each offset size, then the rest as a literal.
+	compressed := []byte{
+		16,        // Decoded length
+		0x03 << 2, // Literal of 4 bytes
+		'a', 'b', 'c', 'd',
+		0x01 | 0<<2, 4, // Copy 4 bytes from offset 4, "abcd"
+		0x02 | 1<<2, 4, 0, // Copy 2 bytes from offset 4, "ab"
+		0x03 | 1<<2, 4, 0, 0, 0, // Copy 2 bytes from offset 4, "cd"
+		0x03 << 2, // Literal of 4 bytes
+		':', '1', '|', 'c',
+	}
+	expected := []byte("abcdabcdabcd:1|c")
+
+	input := stream(
+		chunk(chunkUncompressed, line, line),
+		[]byte{0xfe, 2, 0, 0, 0, 0}, // Padding
+		chunk(chunkCompressed, expected, compressed),
+		[]byte{0x80, 1, 0, 0, 'x'}, // Skippable
+	)
+	out, err := ioutil.ReadAll(NewReader(bytes.NewReader(input)))
+	require.NoError(t, err)
+	assert.Equal(t, append(line, expected...), out)
+}
+
+func TestReaderLongLiteral(t *testing.T) {
+	t.Parallel()
+	expected := bytes.Repeat([]byte("x"), 300)
+	compressed := append([]byte{0xac, 0x02, 61 << 2, 0x2b, 0x01}, expected...) // Length 300, 2 byte literal length 299
+	out, err := ioutil.ReadAll(NewReader(bytes.NewReader(stream(chunk(chunkCompressed, expected, compressed)))))
+	require.NoError(t, err)
+	assert.Equal(t, expected, out)
+}
+
+func TestReaderCorrupt(t *testing.T) {
+	t.Parallel()
+	line := []byte("a:1|c\n")
+	tests := map[string][]byte{
+		"no stream id":     chunk(chunkUncompressed, line, line),
+		"bad stream id":    []byte{chunkStreamID, 6, 0, 0, 's', 'n', 'a', 'p', 'p', 'y'},
+		"bad checksum":     stream(chunk(chunkUncompressed, []byte("other"), line)),
+		"truncated header": stream([]byte{chunkUncompressed, 1}),
+		"truncated chunk":  stream(chunk(chunkUncompressed, line, line)[:8]),
+		"bad offset":       stream(chunk(chunkCompressed, []byte("aaaa"), []byte{4, 0x01, 1})),
+		"short block":      stream(chunk(chunkCompressed, []byte("a"), []byte{2, 0, 'a'})),
+		"long literal":     stream(chunk(chunkCompressed, []byte("a"), []byte{1, 1 << 2, 'a', 'b'})),
+		"unsupported":      stream([]byte{0x02, 1, 0, 0, 0}),
+	}
+	for name, input := range tests {
+		input := input
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := ioutil.ReadAll(NewReader(bytes.NewReader(input)))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,360 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// AggregateSum adds the values of the matching metrics.
+	AggregateSum = "sum"
+	// AggregateAvg averages the values of the matching metrics.
+	AggregateAvg = "avg"
+	// AggregateMin takes the smallest value of the matching metrics.
+	AggregateMin = "min"
+	// AggregateMax takes the largest value of the matching metrics.
+	AggregateMax = "max"
+)
+
+// fieldPattern matches a named field in the input pattern or output template of an AggregationRule.
+var fieldPattern = regexp.MustCompile(`<([A-Za-z0-9_]+)>`)
+
+// AggregationRule is a rule combining the counters and gauges whose name matches a pattern into one metric at flush
+// time, in the style of carbon-aggregator.  In the input pattern, * matches any part of one dot separated component
+// of the name, and <field> matches a whole component, which is substituted for <field> in the output name.  Matching
+// metrics are combined separately for each set of tags, and counters and gauges are combined separately.
+type AggregationRule struct {
+	Rule          string // Name of the rule in the configuration
+	Output        string // Name of the metric produced, which may contain the fields of Input
+	Method        string // One of AggregateSum, AggregateAvg, AggregateMin or AggregateMax
+	Input         string // Pattern matching the input metric names
+	KeepOriginals bool   // Whether the matching metrics are also sent
+
+	input *regexp.Regexp
+}
+
+// NewAggregationRuleFromViper creates a new AggregationRule named rule given a *viper.Viper
+func NewAggregationRuleFromViper(rule string, v *viper.Viper) (AggregationRule, error) {
+	v.SetDefault("keep-originals", true)
+	return NewAggregationRule(rule, v.GetString("output"), v.GetString("method"), v.GetString("input"), v.GetBool("keep-originals"))
+}
+
+// NewAggregationRule creates a new AggregationRule, validating the method and compiling the input pattern.
+func NewAggregationRule(rule, output, method, input string, keepOriginals bool) (AggregationRule, error) {
+	if output == "" {
+		return AggregationRule{}, fmt.Errorf("no output")
+	}
+	if input == "" {
+		return AggregationRule{}, fmt.Errorf("no input")
+	}
+	switch method {
+	case AggregateSum, AggregateAvg, AggregateMin, AggregateMax:
+	default:
+		return AggregationRule{}, fmt.Errorf("invalid method %q", method)
+	}
+	re, err := compileAggregationInput(input)
+	if err != nil {
+		return AggregationRule{}, err
+	}
+	fields := map[string]bool{}
+	for _, name := range re.SubexpNames() {
+		fields[name] = true
+	}
+	for _, match := range fieldPattern.FindAllStringSubmatch(output, -1) {
+		if !fields[match[1]] {
+			return AggregationRule{}, fmt.Errorf("output field <%s> is not in the input", match[1])
+		}
+	}
+	return AggregationRule{
+		Rule:          rule,
+		Output:        output,
+		Method:        method,
+		Input:         input,
+		KeepOriginals: keepOriginals,
+		input:         re,
+	}, nil
+}
+
+// compileAggregationInput returns a regular expression matching the names matched by the input pattern, with a named
+// group for each field.
+func compileAggregationInput(input string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	seen := map[string]bool{}
+	last := 0
+	for _, loc := range fieldPattern.FindAllStringSubmatchIndex(input, -1) {
+		expr.WriteString(globToRegexp(input[last:loc[0]]))
+		name := input[loc[2]:loc[3]]
+		if seen[name] {
+			return nil, fmt.Errorf("input field <%s> is repeated", name)
+		}
+		seen[name] = true
+		expr.WriteString("(?P<" + name + ">[^.]+)")
+		last = loc[1]
+	}
+	expr.WriteString(globToRegexp(input[last:]))
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid input %q: %v", input, err)
+	}
+	return re, nil
+}
+
+// globToRegexp returns a regular expression matching s, where * matches any part of one component of a name.
+func globToRegexp(s string) string {
+	parts := strings.Split(s, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return strings.Join(parts, "[^.]*")
+}
+
+// String returns a description of the rule, such as "requests: all.requests = sum *.requests".
+func (r *AggregationRule) String() string {
+	s := fmt.Sprintf("%s: %s = %s %s", r.Rule, r.Output, r.Method, r.Input)
+	if !r.KeepOriginals {
+		s += ", originals dropped"
+	}
+	return s
+}
+
+// outputName returns the name of the metric which the metric name is combined into, and false if it doesn't match.
+func (r *AggregationRule) outputName(name string) (string, bool) {
+	match := r.input.FindStringSubmatch(name)
+	if match == nil {
+		return "", false
+	}
+	if !strings.Contains(r.Output, "<") {
+		return r.Output, true
+	}
+	names := r.input.SubexpNames()
+	return fieldPattern.ReplaceAllStringFunc(r.Output, func(field string) string {
+		for i, n := range names {
+			if n == field[1:len(field)-1] {
+				return match[i]
+			}
+		}
+		return field
+	}), true
+}
+
+// AggregationRules combines metrics by name at each flush.
+type AggregationRules struct {
+	rules []AggregationRule
+}
+
+// NewAggregationRules creates an AggregationRules applying rules.
+func NewAggregationRules(rules []AggregationRule) *AggregationRules {
+	return &AggregationRules{
+		rules: rules,
+	}
+}
+
+// NewAggregationRulesFromViper loads the rules listed by the aggregation-rules key, each from an
+// aggregation-rule.<rule name> block.  An invalid or missing rule is an error.
+func NewAggregationRulesFromViper(v *viper.Viper) (*AggregationRules, error) {
+	var rules []AggregationRule
+	for _, rule := range v.GetStringSlice("aggregation-rules") {
+		vRule := v.Sub("aggregation-rule." + rule)
+		if vRule == nil {
+			return nil, fmt.Errorf("aggregation rule doesn't exist: %v", rule)
+		}
+		r, err := NewAggregationRuleFromViper(rule, vRule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregation rule %v: %v", rule, err)
+		}
+		rules = append(rules, r)
+		logging.Component("config").WithField("rule", rule).Info("Loaded aggregation rule")
+	}
+	return NewAggregationRules(rules), nil
+}
+
+// Len returns the number of rules.
+func (ar *AggregationRules) Len() int {
+	return len(ar.rules)
+}
+
+// RulesCommand is a console.Handler which lists the rules.
+func (ar *AggregationRules) RulesCommand(ctx context.Context, args []string, w io.Writer) error {
+	if len(ar.rules) == 0 {
+		_, err := fmt.Fprintln(w, "No aggregation rules")
+		return err
+	}
+	for i := range ar.rules {
+		if _, err := fmt.Fprintln(w, ar.rules[i].String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newFlush returns an aggregationFlush which combines the matching metrics over one flush.
+func (ar *AggregationRules) newFlush() *aggregationFlush {
+	return &aggregationFlush{
+		ar:       ar,
+		counters: map[string]map[string]*aggregate{},
+		gauges:   map[string]map[string]*aggregate{},
+	}
+}
+
+// aggregate is the combination of the values of the metrics with one set of tags matching a rule.
+type aggregate struct {
+	method string
+	sum    float64
+	min    float64
+	max    float64
+	count  int
+
+	timestamp gostatsd.Nanotime // Latest timestamp of the inputs
+	hostname  string
+	tags      gostatsd.Tags
+}
+
+func (a *aggregate) add(value float64, timestamp gostatsd.Nanotime) {
+	if a.count == 0 || value < a.min {
+		a.min = value
+	}
+	if a.count == 0 || value > a.max {
+		a.max = value
+	}
+	a.sum += value
+	a.count++
+	if timestamp > a.timestamp {
+		a.timestamp = timestamp
+	}
+}
+
+// value returns the combined value.
+func (a *aggregate) value() float64 {
+	switch a.method {
+	case AggregateAvg:
+		return a.sum / float64(a.count)
+	case AggregateMin:
+		return a.min
+	case AggregateMax:
+		return a.max
+	default:
+		return a.sum
+	}
+}
+
+// aggregationFlush combines the metrics from the MetricMap of each aggregator, as metrics are spread across them by
+// name.
+type aggregationFlush struct {
+	ar *AggregationRules
+
+	mu       sync.Mutex
+	counters map[string]map[string]*aggregate // Combined counters by output name and tags key
+	gauges   map[string]map[string]*aggregate // Combined gauges by output name and tags key
+}
+
+// add combines the metrics in m matching each rule, and returns m without the metrics matching a rule which drops
+// the originals.  m itself is not modified.  It is safe to call concurrently.
+func (af *aggregationFlush) add(m *gostatsd.MetricMap) *gostatsd.MetricMap {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	dropped := map[string]bool{}
+	for i := range af.ar.rules {
+		rule := &af.ar.rules[i]
+		for name, tagged := range m.Counters {
+			output, ok := rule.outputName(name)
+			if !ok {
+				continue
+			}
+			for tagsKey, c := range tagged {
+				af.aggregate(af.counters, rule, output, tagsKey, c.Hostname, c.Tags).add(float64(c.Value), c.Timestamp)
+			}
+			if !rule.KeepOriginals {
+				dropped[name] = true
+			}
+		}
+		for name, tagged := range m.Gauges {
+			output, ok := rule.outputName(name)
+			if !ok {
+				continue
+			}
+			for tagsKey, g := range tagged {
+				af.aggregate(af.gauges, rule, output, tagsKey, g.Hostname, g.Tags).add(g.Value, g.Timestamp)
+			}
+			if !rule.KeepOriginals {
+				dropped[name] = true
+			}
+		}
+	}
+	if len(dropped) == 0 {
+		return m
+	}
+	kept := *m
+	kept.Counters = gostatsd.Counters{}
+	for name, tagged := range m.Counters {
+		if !dropped[name] {
+			kept.Counters[name] = tagged
+		}
+	}
+	kept.Gauges = gostatsd.Gauges{}
+	for name, tagged := range m.Gauges {
+		if !dropped[name] {
+			kept.Gauges[name] = tagged
+		}
+	}
+	return &kept
+}
+
+// aggregate returns the combination of the metrics with tagsKey into output, creating it if it doesn't exist.
+func (af *aggregationFlush) aggregate(aggregates map[string]map[string]*aggregate, rule *AggregationRule, output, tagsKey, hostname string, tags gostatsd.Tags) *aggregate {
+	tagged, ok := aggregates[output]
+	if !ok {
+		tagged = map[string]*aggregate{}
+		aggregates[output] = tagged
+	}
+	a, ok := tagged[tagsKey]
+	if !ok {
+		a = &aggregate{method: rule.Method, hostname: hostname, tags: tags}
+		tagged[tagsKey] = a
+	}
+	return a
+}
+
+// metrics returns a MetricMap holding the combined counters and gauges.  Combined counters which are not whole
+// numbers, such as an average, are rounded, and their per second rate is computed over interval.
+func (af *aggregationFlush) metrics(interval time.Duration) *gostatsd.MetricMap {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	m := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{},
+		Timers:   gostatsd.Timers{},
+		Gauges:   gostatsd.Gauges{},
+		Sets:     gostatsd.Sets{},
+	}
+	for name, tagged := range af.counters {
+		counters := make(map[string]gostatsd.Counter, len(tagged))
+		for tagsKey, a := range tagged {
+			c := gostatsd.NewCounter(a.timestamp, int64(math.Round(a.value())), a.hostname, a.tags)
+			if interval > 0 {
+				c.PerSecond = float64(c.Value) / interval.Seconds()
+			}
+			counters[tagsKey] = c
+		}
+		m.Counters[name] = counters
+	}
+	for name, tagged := range af.gauges {
+		gauges := make(map[string]gostatsd.Gauge, len(tagged))
+		for tagsKey, a := range tagged {
+			gauges[tagsKey] = gostatsd.NewGauge(a.timestamp, a.value(), a.hostname, a.tags)
+		}
+		m.Gauges[name] = gauges
+	}
+	return m
+}
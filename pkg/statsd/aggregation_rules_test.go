@@ -0,0 +1,167 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAggregationRulesFromViper(t *testing.T) {
+	t.Parallel()
+	v := derivedViper(t, `
+aggregation-rules='requests latency'
+
+[aggregation-rule.requests]
+output='all.requests'
+method='sum'
+input='*.requests'
+
+[aggregation-rule.latency]
+output='<env>.latency.max'
+method='max'
+input='<env>.*.latency'
+keep-originals=false
+`)
+	ar, err := NewAggregationRulesFromViper(v)
+	require.NoError(t, err)
+	require.Equal(t, 2, ar.Len())
+
+	var buf bytes.Buffer
+	require.NoError(t, ar.RulesCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "requests: all.requests = sum *.requests\nlatency: <env>.latency.max = max <env>.*.latency, originals dropped\n", buf.String())
+}
+
+func TestNewAggregationRulesFromViperInvalid(t *testing.T) {
+	t.Parallel()
+	tests := map[string]string{
+		"missing":        `aggregation-rules='missing'`,
+		"no output":      "aggregation-rules='r'\n[aggregation-rule.r]\nmethod='sum'\ninput='a'",
+		"no input":       "aggregation-rules='r'\n[aggregation-rule.r]\noutput='x'\nmethod='sum'",
+		"bad method":     "aggregation-rules='r'\n[aggregation-rule.r]\noutput='x'\nmethod='median'\ninput='a'",
+		"unknown field":  "aggregation-rules='r'\n[aggregation-rule.r]\noutput='<env>.x'\nmethod='sum'\ninput='*.a'",
+		"repeated field": "aggregation-rules='r'\n[aggregation-rule.r]\noutput='<env>.x'\nmethod='sum'\ninput='<env>.<env>'",
+	}
+	for name, config := range tests {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := NewAggregationRulesFromViper(derivedViper(t, config))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAggregationRuleOutputName(t *testing.T) {
+	t.Parallel()
+	rule, err := NewAggregationRule("r", "<env>.applications.<app>.all.requests", AggregateSum, "<env>.applications.<app>.*.requests", true)
+	require.NoError(t, err)
+	output, ok := rule.outputName("prod.applications.web.host-1.requests")
+	assert.True(t, ok)
+	assert.Equal(t, "prod.applications.web.all.requests", output)
+
+	// * and fields only match within one component of the name.
+	_, ok = rule.outputName("prod.applications.web.host.1.requests")
+	assert.False(t, ok)
+	_, ok = rule.outputName("prod.applications.web.host-1.requests.count")
+	assert.False(t, ok)
+}
+
+func TestAggregationRulesSum(t *testing.T) {
+	t.Parallel()
+	rule, err := NewAggregationRule("r", "all.requests", AggregateSum, "*.requests", true)
+	require.NoError(t, err)
+	af := NewAggregationRules([]AggregationRule{rule}).newFlush()
+
+	// Metrics are spread across the aggregators, and combined for each set of tags.
+	m1 := &gostatsd.MetricMap{Counters: gostatsd.Counters{
+		"api.requests": {"env:prod": gostatsd.NewCounter(1, 3, "", gostatsd.Tags{"env:prod"})},
+		"web.requests": {"env:prod": gostatsd.NewCounter(2, 4, "", gostatsd.Tags{"env:prod"})},
+	}}
+	m2 := &gostatsd.MetricMap{Counters: gostatsd.Counters{
+		"db.requests":  {"env:prod": gostatsd.NewCounter(3, 5, "", gostatsd.Tags{"env:prod"}), "env:dev": gostatsd.NewCounter(3, 1, "", gostatsd.Tags{"env:dev"})},
+		"db.responses": {"env:prod": gostatsd.NewCounter(3, 100, "", gostatsd.Tags{"env:prod"})},
+	}}
+	assert.Equal(t, m1, af.add(m1))
+	assert.Equal(t, m2, af.add(m2))
+
+	m := af.metrics(2 * time.Second)
+	require.Len(t, m.Counters["all.requests"], 2)
+	prod := m.Counters["all.requests"]["env:prod"]
+	assert.EqualValues(t, 12, prod.Value)
+	assert.Equal(t, 6.0, prod.PerSecond)
+	assert.EqualValues(t, 3, prod.Timestamp)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, prod.Tags)
+	assert.EqualValues(t, 1, m.Counters["all.requests"]["env:dev"].Value)
+	assert.Empty(t, m.Gauges)
+}
+
+func TestAggregationRulesMethods(t *testing.T) {
+	t.Parallel()
+	for method, expected := range map[string]float64{AggregateSum: 12, AggregateAvg: 4, AggregateMin: 1, AggregateMax: 8} {
+		rule, err := NewAggregationRule("r", "all.load", method, "*.load", true)
+		require.NoError(t, err)
+		af := NewAggregationRules([]AggregationRule{rule}).newFlush()
+		af.add(&gostatsd.MetricMap{Gauges: gostatsd.Gauges{
+			"a.load": {"": gostatsd.NewGauge(1, 1, "", nil)},
+			"b.load": {"": gostatsd.NewGauge(1, 3, "", nil)},
+			"c.load": {"": gostatsd.NewGauge(1, 8, "", nil)},
+		}})
+		assert.Equal(t, expected, af.metrics(time.Second).Gauges["all.load"][""].Value, method)
+	}
+}
+
+func TestAggregationRulesDropOriginals(t *testing.T) {
+	t.Parallel()
+	rule, err := NewAggregationRule("r", "all.requests", AggregateSum, "*.requests", false)
+	require.NoError(t, err)
+	af := NewAggregationRules([]AggregationRule{rule}).newFlush()
+	m := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{
+			"api.requests":  {"": gostatsd.NewCounter(1, 3, "", nil)},
+			"api.responses": {"": gostatsd.NewCounter(1, 3, "", nil)},
+		},
+		Gauges:   gostatsd.Gauges{"api.requests": {"": gostatsd.NewGauge(1, 1, "", nil)}},
+		Sequence: 4,
+	}
+	kept := af.add(m)
+	assert.Equal(t, []string{"api.responses"}, counterNames(kept))
+	assert.Empty(t, kept.Gauges)
+	assert.EqualValues(t, 4, kept.Sequence)
+	// The aggregator's own metrics are not modified.
+	assert.Len(t, m.Counters, 2)
+	assert.Len(t, m.Gauges, 1)
+}
+
+func counterNames(m *gostatsd.MetricMap) []string {
+	var names []string
+	for name := range m.Counters {
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestFlusherAggregationRules(t *testing.T) {
+	t.Parallel()
+	backend := &gaugeBackend{gauges: gostatsd.Gauges{}}
+	rule, err := NewAggregationRule("r", "all.queue", AggregateSum, "*.queue", true)
+	require.NoError(t, err)
+	agg := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+	fl := NewMetricFlusher(0, &singleAggregator{agg: agg}, nil, []gostatsd.Backend{backend}, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+	fl.aggregations = NewAggregationRules([]AggregationRule{rule})
+
+	now := time.Now()
+	agg.Receive(&gostatsd.Metric{Name: "a.queue", Value: 2, Type: gostatsd.GAUGE, Rate: 1}, now)
+	agg.Receive(&gostatsd.Metric{Name: "b.queue", Value: 5, Type: gostatsd.GAUGE, Rate: 1}, now)
+	fl.flushData(context.Background(), time.Second, 0)
+
+	assert.Equal(t, 7.0, backend.gauges["all.queue"][""].Value)
+	assert.Equal(t, 2.0, backend.gauges["a.queue"][""].Value)
+}
@@ -2,179 +2,88 @@ package statsd
 
 import (
 	"context"
-	"math"
-	"sort"
-	"strconv"
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
 	"github.com/atlassian/gostatsd/pkg/statser"
-
-	log "github.com/sirupsen/logrus"
 )
 
-// percentStruct is a cache of percentile names to avoid creating them for each timer.
-type percentStruct struct {
-	count      string
-	mean       string
-	sum        string
-	sumSquares string
-	upper      string
-	lower      string
-}
-
-// MetricAggregator aggregates metrics.
-type MetricAggregator struct {
-	metricsReceived   uint64
-	expiryInterval    time.Duration // How often to expire metrics
-	percentThresholds map[float64]percentStruct
-	now               func() time.Time // Returns current time. Useful for testing.
-	statser           statser.Statser
-	disabledSubtypes  gostatsd.TimerSubtypes
-	gostatsd.MetricMap
-}
-
-// NewMetricAggregator creates a new MetricAggregator object.
-func NewMetricAggregator(percentThresholds []float64, expiryInterval time.Duration, disabled gostatsd.TimerSubtypes) *MetricAggregator {
-	a := MetricAggregator{
-		expiryInterval:    expiryInterval,
-		percentThresholds: make(map[float64]percentStruct, len(percentThresholds)),
-		now:               time.Now,
-		statser:           statser.NewNullStatser(), // Will probably be replaced via RunMetrics
-		MetricMap: gostatsd.MetricMap{
-			Counters: gostatsd.Counters{},
-			Timers:   gostatsd.Timers{},
-			Gauges:   gostatsd.Gauges{},
-			Sets:     gostatsd.Sets{},
-		},
-		disabledSubtypes: disabled,
-	}
-	for _, pct := range percentThresholds {
-		sPct := strconv.Itoa(int(pct))
-		a.percentThresholds[pct] = percentStruct{
-			count:      "count_" + sPct,
-			mean:       "mean_" + sPct,
-			sum:        "sum_" + sPct,
-			sumSquares: "sum_squares_" + sPct,
-			upper:      "upper_" + sPct,
-			lower:      "lower_" + sPct,
-		}
-	}
-	return &a
-}
-
-// round rounds a number to its nearest integer value.
-// poor man's math.Round(x) = math.Floor(x + 0.5).
-func round(v float64) float64 {
-	return math.Floor(v + 0.5)
-}
-
-// Flush prepares the contents of a MetricAggregator for sending via the Sender.
-func (a *MetricAggregator) Flush(flushInterval time.Duration) {
-	a.statser.Gauge("aggregator.metrics_received", float64(a.metricsReceived), nil)
-
-	flushInSeconds := float64(flushInterval) / float64(time.Second)
-
-	a.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
-		counter.PerSecond = float64(counter.Value) / flushInSeconds
-		a.Counters[key][tagsKey] = counter
-	})
-
-	a.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
-		if count := len(timer.Values); count > 0 {
-			sort.Float64s(timer.Values)
-			timer.Min = timer.Values[0]
-			timer.Max = timer.Values[count-1]
-			n := len(timer.Values)
-			count := float64(n)
+const (
+	// PercentileNearestRank computes the upper and lower percentiles of timers as the nearest ranked value.
+	PercentileNearestRank = aggregation.PercentileNearestRank
+	// PercentileLinear computes the upper and lower percentiles of timers by linear interpolation between the
+	// values at the ranks either side of the percentile.
+	PercentileLinear = aggregation.PercentileLinear
+)
 
-			cumulativeValues := make([]float64, n)
-			cumulSumSquaresValues := make([]float64, n)
-			cumulativeValues[0] = timer.Min
-			cumulSumSquaresValues[0] = timer.Min * timer.Min
-			for i := 1; i < n; i++ {
-				cumulativeValues[i] = timer.Values[i] + cumulativeValues[i-1]
-				cumulSumSquaresValues[i] = timer.Values[i]*timer.Values[i] + cumulSumSquaresValues[i-1]
-			}
+const (
+	// TimerAggregationSamples keeps every sample of a timer until it is flushed.
+	TimerAggregationSamples = "samples"
+	// TimerAggregationExpHistogram folds the samples of a timer in to a base-2 exponential histogram, from which
+	// the statistics and percentiles are estimated.
+	TimerAggregationExpHistogram = "exphistogram"
+)
 
-			var sumSquares = timer.Min * timer.Min
-			var mean = timer.Min
-			var sum = timer.Min
-			var thresholdBoundary = timer.Max
+const (
+	// CounterOverflowSaturate keeps counters which would overflow int64 at the largest or smallest value.
+	CounterOverflowSaturate = aggregation.CounterOverflowSaturate
+	// CounterOverflowWrap lets counters which overflow int64 wrap around, as two's complement addition does.
+	CounterOverflowWrap = aggregation.CounterOverflowWrap
+)
 
-			for pct, pctStruct := range a.percentThresholds {
-				numInThreshold := n
-				if n > 1 {
-					numInThreshold = int(round(math.Abs(pct) / 100 * count))
-					if numInThreshold == 0 {
-						continue
-					}
-					if pct > 0 {
-						thresholdBoundary = timer.Values[numInThreshold-1]
-						sum = cumulativeValues[numInThreshold-1]
-						sumSquares = cumulSumSquaresValues[numInThreshold-1]
-					} else {
-						thresholdBoundary = timer.Values[n-numInThreshold]
-						sum = cumulativeValues[n-1] - cumulativeValues[n-numInThreshold-1]
-						sumSquares = cumulSumSquaresValues[n-1] - cumulSumSquaresValues[n-numInThreshold-1]
-					}
-					mean = sum / float64(numInThreshold)
-				}
+// MetricAggregator aggregates metrics with an aggregation.Aggregator, adding the internal metrics, tracing and
+// runtime changes of the server.
+type MetricAggregator struct {
+	*aggregation.Aggregator
 
-				if !a.disabledSubtypes.CountPct {
-					timer.Percentiles.Set(pctStruct.count, float64(numInThreshold))
-				}
-				if !a.disabledSubtypes.MeanPct {
-					timer.Percentiles.Set(pctStruct.mean, mean)
-				}
-				if !a.disabledSubtypes.SumPct {
-					timer.Percentiles.Set(pctStruct.sum, sum)
-				}
-				if !a.disabledSubtypes.SumSquaresPct {
-					timer.Percentiles.Set(pctStruct.sumSquares, sumSquares)
-				}
-				if pct > 0 {
-					if !a.disabledSubtypes.UpperPct {
-						timer.Percentiles.Set(pctStruct.upper, thresholdBoundary)
-					}
-				} else {
-					if !a.disabledSubtypes.LowerPct {
-						timer.Percentiles.Set(pctStruct.lower, thresholdBoundary)
-					}
-				}
-			}
+	now     func() time.Time // Returns current time. Useful for testing.
+	statser statser.Statser
 
-			sum = cumulativeValues[n-1]
-			sumSquares = cumulSumSquaresValues[n-1]
-			mean = sum / count
+	tracer *MetricTracer // Optional tracing of metrics, may be nil
 
-			var sumOfDiffs float64
-			for i := 0; i < n; i++ {
-				sumOfDiffs += (timer.Values[i] - mean) * (timer.Values[i] - mean)
-			}
+	// Percentiles which may be changed while running, applied at the start of a flush.  May be nil.
+	thresholds        *PercentThresholds
+	thresholdsVersion uint64
 
-			mid := int(math.Floor(count / 2))
-			if math.Mod(count, 2) == 0 {
-				timer.Median = (timer.Values[mid-1] + timer.Values[mid]) / 2
-			} else {
-				timer.Median = timer.Values[mid]
-			}
+	pipelineTraces []*gostatsd.PipelineTrace // Traces of metrics applied since the last flush
 
-			timer.Mean = mean
-			timer.StdDev = math.Sqrt(sumOfDiffs / count)
-			timer.Sum = sum
-			timer.SumSquares = sumSquares
+	coldStart *ColdStart // Records when the first metric was received, may be nil
+}
 
-			timer.Count = int(round(timer.SampledCount))
-			timer.PerSecond = timer.SampledCount / flushInSeconds
+// NewMetricAggregator creates a new MetricAggregator which aggregates with opts.  tracer, thresholds and coldStart may
+// be nil.
+func NewMetricAggregator(opts aggregation.Options, tracer *MetricTracer, thresholds *PercentThresholds, coldStart *ColdStart) *MetricAggregator {
+	return &MetricAggregator{
+		Aggregator: aggregation.New(opts),
+		now:        time.Now,
+		statser:    statser.NewNullStatser(), // Will probably be replaced via RunMetrics
+		tracer:     tracer,
+		thresholds: thresholds,
+		coldStart:  coldStart,
+	}
+}
 
-			a.Timers[key][tagsKey] = timer
-		} else {
-			timer.Count = 0
-			timer.SampledCount = 0
-			timer.PerSecond = 0
+// Flush prepares the contents of a MetricAggregator for sending via the Sender.
+func (a *MetricAggregator) Flush(flushInterval time.Duration) {
+	a.statser.Gauge("aggregator.metrics_received", float64(a.MetricsReceived()), nil)
+	a.statser.Gauge("aggregator.counter_overflows", float64(a.CounterOverflows()), nil)
+	a.flushPipelineTraces(time.Now())
+
+	if a.thresholds != nil {
+		if thresholds, version := a.thresholds.Get(); version != a.thresholdsVersion {
+			a.SetPercentThresholds(thresholds)
+			a.thresholdsVersion = version
 		}
-	})
+	}
+
+	a.Aggregator.Flush(flushInterval)
+	if a.LateArrivalWindow > 0 {
+		a.statser.Gauge("aggregator.late_metrics", float64(a.LateMetrics()), nil)
+	}
+	if a.GaugeFlapThreshold > 0 {
+		a.statser.Gauge("aggregator.gauges_debounced", float64(a.GaugesDebounced()), nil)
+	}
 }
 
 func (a *MetricAggregator) RunMetrics(ctx context.Context, statser statser.Statser) {
@@ -185,164 +94,38 @@ func (a *MetricAggregator) Process(f ProcessFunc) {
 	f(&a.MetricMap)
 }
 
-func (a *MetricAggregator) isExpired(now, ts gostatsd.Nanotime) bool {
-	return a.expiryInterval != 0 && time.Duration(now-ts) > a.expiryInterval
-}
-
-func deleteMetric(key, tagsKey string, metrics gostatsd.AggregatedMetrics) {
-	metrics.DeleteChild(key, tagsKey)
-	if !metrics.HasChildren(key) {
-		metrics.Delete(key)
+// ProcessLate calls f with the metrics of each past interval which late metrics were bucketed in to, once they have
+// been flushed.
+func (a *MetricAggregator) ProcessLate(f ProcessFunc) {
+	for _, late := range a.Late() {
+		f(&late.MetricMap)
 	}
 }
 
 // Reset clears the contents of a MetricAggregator.
 func (a *MetricAggregator) Reset() {
-	a.metricsReceived = 0
-	nowNano := gostatsd.Nanotime(a.now().UnixNano())
-
-	a.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
-		if a.isExpired(nowNano, counter.Timestamp) {
-			deleteMetric(key, tagsKey, a.Counters)
-		} else {
-			a.Counters[key][tagsKey] = gostatsd.Counter{
-				Timestamp: counter.Timestamp,
-				Hostname:  counter.Hostname,
-				Tags:      counter.Tags,
-			}
-		}
-	})
-
-	a.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
-		if a.isExpired(nowNano, timer.Timestamp) {
-			deleteMetric(key, tagsKey, a.Timers)
-		} else {
-			a.Timers[key][tagsKey] = gostatsd.Timer{
-				Timestamp: timer.Timestamp,
-				Hostname:  timer.Hostname,
-				Tags:      timer.Tags,
-				Values:    timer.Values[:0],
-			}
-		}
-	})
-
-	a.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
-		if a.isExpired(nowNano, gauge.Timestamp) {
-			deleteMetric(key, tagsKey, a.Gauges)
-		}
-		// No reset for gauges, they keep the last value until expiration
-	})
-
-	a.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
-		if a.isExpired(nowNano, set.Timestamp) {
-			deleteMetric(key, tagsKey, a.Sets)
-		} else {
-			a.Sets[key][tagsKey] = gostatsd.Set{
-				Values:    make(map[string]struct{}),
-				Timestamp: set.Timestamp,
-				Hostname:  set.Hostname,
-				Tags:      set.Tags,
-			}
-		}
-	})
-}
-
-func (a *MetricAggregator) receiveCounter(m *gostatsd.Metric, tagsKey string, now gostatsd.Nanotime) {
-	value := int64(m.Value / m.Rate)
-	v, ok := a.Counters[m.Name]
-	if ok {
-		c, ok := v[tagsKey]
-		if ok {
-			c.Value += value
-			c.Timestamp = now
-		} else {
-			c = gostatsd.NewCounter(now, value, m.Hostname, m.Tags)
-		}
-		v[tagsKey] = c
-	} else {
-		a.Counters[m.Name] = map[string]gostatsd.Counter{
-			tagsKey: gostatsd.NewCounter(now, value, m.Hostname, m.Tags),
-		}
-	}
-}
-
-func (a *MetricAggregator) receiveGauge(m *gostatsd.Metric, tagsKey string, now gostatsd.Nanotime) {
-	// TODO: handle +/-
-	v, ok := a.Gauges[m.Name]
-	if ok {
-		g, ok := v[tagsKey]
-		if ok {
-			g.Value = m.Value
-			g.Timestamp = now
-		} else {
-			g = gostatsd.NewGauge(now, m.Value, m.Hostname, m.Tags)
-		}
-		v[tagsKey] = g
-	} else {
-		a.Gauges[m.Name] = map[string]gostatsd.Gauge{
-			tagsKey: gostatsd.NewGauge(now, m.Value, m.Hostname, m.Tags),
-		}
-	}
+	a.Expire(a.now())
 }
 
-func (a *MetricAggregator) receiveTimer(m *gostatsd.Metric, tagsKey string, now gostatsd.Nanotime) {
-	v, ok := a.Timers[m.Name]
-	if ok {
-		t, ok := v[tagsKey]
-		if ok {
-			t.Values = append(t.Values, m.Value)
-			t.Timestamp = now
-			t.SampledCount += 1.0 / m.Rate
-		} else {
-			t = gostatsd.NewTimer(now, []float64{m.Value}, m.Hostname, m.Tags)
-			t.SampledCount = 1.0 / m.Rate
-		}
-		v[tagsKey] = t
-	} else {
-		t := gostatsd.NewTimer(now, []float64{m.Value}, m.Hostname, m.Tags)
-		t.SampledCount = 1.0 / m.Rate
-
-		a.Timers[m.Name] = map[string]gostatsd.Timer{
-			tagsKey: t,
-		}
+// Receive aggregates an incoming metric.
+func (a *MetricAggregator) Receive(m *gostatsd.Metric, now time.Time) {
+	a.coldStart.Received(now)
+	a.Aggregator.Receive(m, now)
+	if a.tracer.Active() && a.tracer.Matches(m.Name) {
+		a.tracer.TraceAggregated(m, a.AggregatedValue(m))
 	}
-}
-
-func (a *MetricAggregator) receiveSet(m *gostatsd.Metric, tagsKey string, now gostatsd.Nanotime) {
-	v, ok := a.Sets[m.Name]
-	if ok {
-		s, ok := v[tagsKey]
-		if ok {
-			s.Values[m.StringValue] = struct{}{}
-			s.Timestamp = now
-		} else {
-			s = gostatsd.NewSet(now, map[string]struct{}{m.StringValue: {}}, m.Hostname, m.Tags)
-		}
-		v[tagsKey] = s
-	} else {
-		a.Sets[m.Name] = map[string]gostatsd.Set{
-			tagsKey: gostatsd.NewSet(now, map[string]struct{}{m.StringValue: {}}, m.Hostname, m.Tags),
-		}
+	if m.Trace != nil && len(a.pipelineTraces) < maxPipelineTraces {
+		m.Trace.Applied = now
+		a.pipelineTraces = append(a.pipelineTraces, m.Trace)
 	}
+	m.Done()
 }
 
-// Receive aggregates an incoming metric.
-func (a *MetricAggregator) Receive(m *gostatsd.Metric, now time.Time) {
-	a.metricsReceived++
-	tagsKey := m.TagsKey
-	nowNano := gostatsd.Nanotime(now.UnixNano())
-
-	switch m.Type {
-	case gostatsd.COUNTER:
-		a.receiveCounter(m, tagsKey, nowNano)
-	case gostatsd.GAUGE:
-		a.receiveGauge(m, tagsKey, nowNano)
-	case gostatsd.TIMER:
-		a.receiveTimer(m, tagsKey, nowNano)
-	case gostatsd.SET:
-		a.receiveSet(m, tagsKey, nowNano)
-	default:
-		log.Errorf("Unknow metric type %s for %s", m.Type, m.Name)
+// flushPipelineTraces emits the traces of metrics applied since the last flush, which is at flushed.
+func (a *MetricAggregator) flushPipelineTraces(flushed time.Time) {
+	for i, t := range a.pipelineTraces {
+		emitPipelineTrace(a.statser, t, flushed)
+		a.pipelineTraces[i] = nil
 	}
-	m.Done()
+	a.pipelineTraces = a.pipelineTraces[:0]
 }
@@ -2,22 +2,24 @@ package statsd
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ash2k/stager"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
 )
 
 func newFakeAggregator() *MetricAggregator {
-	return NewMetricAggregator(
-		[]float64{90},
-		5*time.Minute,
-		gostatsd.TimerSubtypes{},
-	)
+	return NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
 }
 
 type fakeAggregatorFactory struct{}
@@ -227,7 +229,7 @@ func TestReset(t *testing.T) {
 	pastNano := gostatsd.Nanotime(now.Add(-30 * time.Second).UnixNano())
 
 	actual = newFakeAggregator()
-	actual.expiryInterval = 10 * time.Second
+	actual.ExpiryInterval = 10 * time.Second
 	actual.Counters["some"] = map[string]gostatsd.Counter{
 		"thing":       gostatsd.NewCounter(pastNano, 50, host, nil),
 		"other:thing": gostatsd.NewCounter(pastNano, 90, host, nil),
@@ -241,7 +243,7 @@ func TestReset(t *testing.T) {
 	assrt.Equal(expected.Counters, actual.Counters)
 
 	actual = newFakeAggregator()
-	actual.expiryInterval = 10 * time.Second
+	actual.ExpiryInterval = 10 * time.Second
 	actual.Timers["some"] = map[string]gostatsd.Timer{
 		"thing": gostatsd.NewTimer(pastNano, []float64{50}, host, nil),
 	}
@@ -254,7 +256,7 @@ func TestReset(t *testing.T) {
 	assrt.Equal(expected.Timers, actual.Timers)
 
 	actual = newFakeAggregator()
-	actual.expiryInterval = 10 * time.Second
+	actual.ExpiryInterval = 10 * time.Second
 	actual.Gauges["some"] = map[string]gostatsd.Gauge{
 		"thing":       gostatsd.NewGauge(pastNano, 50, host, nil),
 		"other:thing": gostatsd.NewGauge(pastNano, 90, host, nil),
@@ -268,7 +270,7 @@ func TestReset(t *testing.T) {
 	assrt.Equal(expected.Gauges, actual.Gauges)
 
 	actual = newFakeAggregator()
-	actual.expiryInterval = 10 * time.Second
+	actual.ExpiryInterval = 10 * time.Second
 	actual.Sets["some"] = map[string]gostatsd.Set{
 		"thing": gostatsd.NewSet(pastNano, map[string]struct{}{"user": {}}, host, nil),
 	}
@@ -281,28 +283,10 @@ func TestReset(t *testing.T) {
 	assrt.Equal(expected.Sets, actual.Sets)
 }
 
-func TestIsExpired(t *testing.T) {
-	t.Parallel()
-	assrt := assert.New(t)
-
-	now := gostatsd.Nanotime(time.Now().UnixNano())
-
-	ma := &MetricAggregator{expiryInterval: 0}
-	assrt.Equal(false, ma.isExpired(now, now))
-
-	ma.expiryInterval = 10 * time.Second
-
-	ts := gostatsd.Nanotime(time.Now().Add(-30 * time.Second).UnixNano())
-	assrt.Equal(true, ma.isExpired(now, ts))
-
-	ts = gostatsd.Nanotime(time.Now().Add(-1 * time.Second).UnixNano())
-	assrt.Equal(false, ma.isExpired(now, ts))
-}
-
 func TestDisabledCount(t *testing.T) {
 	t.Parallel()
 	ma := newFakeAggregator()
-	ma.disabledSubtypes.CountPct = true
+	ma.DisabledSubtypes.CountPct = true
 	ma.Receive(&gostatsd.Metric{Name: "x", Value: 1, Type: gostatsd.TIMER}, time.Now())
 	ma.Flush(1 * time.Second)
 	for _, pct := range ma.Timers["x"][""].Percentiles {
@@ -315,7 +299,7 @@ func TestDisabledCount(t *testing.T) {
 func TestDisabledMean(t *testing.T) {
 	t.Parallel()
 	ma := newFakeAggregator()
-	ma.disabledSubtypes.MeanPct = true
+	ma.DisabledSubtypes.MeanPct = true
 	ma.Receive(&gostatsd.Metric{Name: "x", Value: 1, Type: gostatsd.TIMER}, time.Now())
 	ma.Flush(1 * time.Second)
 	for _, pct := range ma.Timers["x"][""].Percentiles {
@@ -328,7 +312,7 @@ func TestDisabledMean(t *testing.T) {
 func TestDisabledSum(t *testing.T) {
 	t.Parallel()
 	ma := newFakeAggregator()
-	ma.disabledSubtypes.SumPct = true
+	ma.DisabledSubtypes.SumPct = true
 	ma.Receive(&gostatsd.Metric{Name: "x", Value: 1, Type: gostatsd.TIMER}, time.Now())
 	ma.Flush(1 * time.Second)
 	for _, pct := range ma.Timers["x"][""].Percentiles {
@@ -341,7 +325,7 @@ func TestDisabledSum(t *testing.T) {
 func TestDisabledSumSquares(t *testing.T) {
 	t.Parallel()
 	ma := newFakeAggregator()
-	ma.disabledSubtypes.SumSquaresPct = true
+	ma.DisabledSubtypes.SumSquaresPct = true
 	ma.Receive(&gostatsd.Metric{Name: "x", Value: 1, Type: gostatsd.TIMER}, time.Now())
 	ma.Flush(1 * time.Second)
 	for _, pct := range ma.Timers["x"][""].Percentiles {
@@ -354,7 +338,7 @@ func TestDisabledSumSquares(t *testing.T) {
 func TestDisabledUpper(t *testing.T) {
 	t.Parallel()
 	ma := newFakeAggregator()
-	ma.disabledSubtypes.UpperPct = true
+	ma.DisabledSubtypes.UpperPct = true
 	ma.Receive(&gostatsd.Metric{Name: "x", Value: 1, Type: gostatsd.TIMER}, time.Now())
 	ma.Flush(1 * time.Second)
 	for _, pct := range ma.Timers["x"][""].Percentiles {
@@ -366,12 +350,8 @@ func TestDisabledUpper(t *testing.T) {
 
 func TestDisabledLower(t *testing.T) {
 	t.Parallel()
-	ma := NewMetricAggregator(
-		[]float64{-90},
-		5*time.Minute,
-		gostatsd.TimerSubtypes{},
-	)
-	ma.disabledSubtypes.LowerPct = true
+	ma := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{-90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+	ma.DisabledSubtypes.LowerPct = true
 	ma.Receive(&gostatsd.Metric{Name: "x", Value: 1, Type: gostatsd.TIMER}, time.Now())
 	ma.Flush(1 * time.Second)
 	for _, pct := range ma.Timers["x"][""].Percentiles {
@@ -401,6 +381,9 @@ func metricsFixtures() []gostatsd.Metric {
 		{Name: "timer_sampling", Value: 50, Type: gostatsd.TIMER, Rate: 0.1},
 		{Name: "counter_sampling", Value: 2, Type: gostatsd.COUNTER, Rate: 0.25},
 		{Name: "counter_sampling", Value: 5, Type: gostatsd.COUNTER, Rate: 0.25},
+		{Name: "gauge_sampling", Value: 5, Type: gostatsd.GAUGE, Rate: 0.5},
+		{Name: "set_sampling", StringValue: "user1", Type: gostatsd.SET, Rate: 0.5},
+		{Name: "set_sampling", StringValue: "user1", Type: gostatsd.SET, Rate: 0.5},
 	}
 	for i, m := range ms {
 		if ms[i].Rate == 0.0 {
@@ -443,6 +426,9 @@ func TestReceive(t *testing.T) {
 			"":            {Value: 3, Timestamp: nowNano},
 			"baz,foo:bar": {Value: 8, Timestamp: nowNano, Tags: gostatsd.Tags{"baz", "foo:bar"}},
 		},
+		"gauge_sampling": map[string]gostatsd.Gauge{
+			"": {Value: 5, Timestamp: nowNano},
+		},
 	}
 	assrt.Equal(expectedGauges, ma.Gauges)
 
@@ -475,6 +461,14 @@ func TestReceive(t *testing.T) {
 				Tags:      gostatsd.Tags{"baz", "foo:bar"},
 			},
 		},
+		"set_sampling": map[string]gostatsd.Set{
+			"": {
+				Values: map[string]struct{}{
+					"user1": {},
+				},
+				Timestamp: nowNano,
+			},
+		},
 	}
 	assrt.Equal(expectedSets, ma.Sets)
 }
@@ -486,6 +480,7 @@ func BenchmarkHotMetric(b *testing.B) {
 		runtime.NumCPU(),
 		10000,
 		&fakeAggregatorFactory{},
+		false,
 	)
 
 	stgr := stager.New()
@@ -554,3 +549,314 @@ func BenchmarkReceives(b *testing.B) {
 		}
 	}
 }
+
+func TestGaugeDebounce(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.GaugeFlapThreshold = 2
+	now := time.Now()
+
+	receive := func(name string, values ...float64) {
+		for _, v := range values {
+			ma.Receive(&gostatsd.Metric{Name: name, Value: v, Type: gostatsd.GAUGE, Rate: 1}, now)
+		}
+	}
+
+	// 3 changes is above the threshold, 2 changes and repeated values are not.
+	receive("flapping", 1, 0, 1, 0)
+	receive("stable", 1, 0, 1)
+	receive("repeated", 5, 5, 5, 5, 5)
+	ma.Flush(1 * time.Second)
+
+	// A flapping gauge is flushed with its last value every interval, and counted.
+	assert.Equal(t, 0.0, ma.Gauges["flapping"][""].Value)
+	assert.Equal(t, 1.0, ma.Gauges["stable"][""].Value)
+	assert.Equal(t, 5.0, ma.Gauges["repeated"][""].Value)
+	assert.Equal(t, 1, ma.GaugesDebounced())
+	ma.Reset()
+
+	receive("flapping", 1, 0, 1, 0, 1)
+	ma.Flush(1 * time.Second)
+	assert.Equal(t, 1.0, ma.Gauges["flapping"][""].Value)
+	assert.Equal(t, 1, ma.GaugesDebounced())
+	ma.Reset()
+
+	receive("flapping", 0, 0)
+	ma.Flush(1 * time.Second)
+	assert.Equal(t, 0.0, ma.Gauges["flapping"][""].Value)
+	assert.Zero(t, ma.GaugesDebounced())
+}
+
+func TestGaugeDebounceFlushesLastValue(t *testing.T) {
+	t.Parallel()
+	gc, err := NewGaugeConflicts([]string{"flapping=max"})
+	require.NoError(t, err)
+	ma := newFakeAggregator()
+	ma.GaugeFlapThreshold = 2
+	ma.GaugeConflicts = gc
+	ma.GaugeMinMax = true
+	now := time.Now()
+
+	// The max and the min and max gauges are only flushed for a gauge which is not flapping.
+	for _, v := range []float64{1, 9, 1, 2} {
+		ma.Receive(&gostatsd.Metric{Name: "flapping", Value: v, Type: gostatsd.GAUGE, Rate: 1}, now)
+	}
+	ma.Flush(1 * time.Second)
+	assert.Equal(t, 2.0, ma.Gauges["flapping"][""].Value)
+	assert.NotContains(t, ma.Gauges, "flapping.max")
+	assert.Equal(t, 1, ma.GaugesDebounced())
+	ma.Reset()
+
+	for _, v := range []float64{9, 3} {
+		ma.Receive(&gostatsd.Metric{Name: "flapping", Value: v, Type: gostatsd.GAUGE, Rate: 1}, now)
+	}
+	ma.Flush(1 * time.Second)
+	assert.Equal(t, 9.0, ma.Gauges["flapping"][""].Value)
+	assert.Equal(t, 9.0, ma.Gauges["flapping.max"][""].Value)
+}
+
+func TestReceiveSetDelimiter(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.SetDelimiter = ","
+	now := time.Now()
+	ma.Receive(&gostatsd.Metric{Name: "users", StringValue: "1,2,,bob", Type: gostatsd.SET, Rate: 0.5}, now)
+	ma.Receive(&gostatsd.Metric{Name: "users", StringValue: "2", Type: gostatsd.SET, Rate: 1}, now)
+
+	set := ma.Sets["users"][""]
+	assert.Equal(t, map[int64]struct{}{1: {}, 2: {}}, set.IntValues)
+	assert.Equal(t, map[string]struct{}{"bob": {}}, set.Values)
+	assert.Equal(t, 3, set.Cardinality())
+}
+
+func TestApproximateSet(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.SetExactLimit = 100
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		ma.Receive(&gostatsd.Metric{Name: "users", StringValue: strconv.Itoa(i), Type: gostatsd.SET, Rate: 1, Tags: gostatsd.Tags{"foo"}, TagsKey: "foo"}, now)
+	}
+	ma.Receive(&gostatsd.Metric{Name: "small", StringValue: "1", Type: gostatsd.SET, Rate: 1}, now)
+
+	ma.Flush(1 * time.Second)
+	set := ma.Sets["users"]["foo"]
+	assert.True(t, set.Approximate())
+	assert.InDelta(t, 1000, set.Cardinality(), 30)
+	assert.Equal(t, gostatsd.Tags{"foo", "approx"}, set.Tags)
+	assert.Empty(t, ma.Sets["small"][""].Tags)
+
+	ma.Reset()
+	set = ma.Sets["users"]["foo"]
+	assert.False(t, set.Approximate())
+	assert.Equal(t, gostatsd.Tags{"foo"}, set.Tags)
+}
+
+func TestCounterGracePeriod(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.ExpiryInterval = 0 // Other metrics never expire
+	ma.CounterGracePeriod = 30 * time.Second
+	start := time.Now()
+	now := start
+	ma.now = func() time.Time { return now }
+
+	ma.Receive(&gostatsd.Metric{Name: "requests", Value: 5, Type: gostatsd.COUNTER, Rate: 1}, start)
+	ma.Receive(&gostatsd.Metric{Name: "latency", Value: 5, Type: gostatsd.TIMER, Rate: 1}, start)
+	ma.Flush(10 * time.Second)
+	assert.EqualValues(t, 5, ma.Counters["requests"][""].Value)
+	ma.Reset()
+
+	// Idle, but within the grace period
+	for _, elapsed := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second} {
+		now = start.Add(elapsed)
+		ma.Flush(10 * time.Second)
+		counter, ok := ma.Counters["requests"][""]
+		if assert.True(t, ok, "counter expired after %s", elapsed) {
+			assert.Zero(t, counter.Value)
+			assert.Zero(t, counter.PerSecond)
+		}
+		ma.Reset()
+	}
+
+	// Past the grace period
+	now = start.Add(40 * time.Second)
+	ma.Flush(10 * time.Second)
+	ma.Reset()
+	assert.NotContains(t, ma.Counters, "requests")
+	assert.Contains(t, ma.Timers, "latency")
+}
+
+func TestTimerPerSecond(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		interval  time.Duration
+		rate      float64
+		perSecond float64
+	}{
+		{interval: time.Second, rate: 1, perSecond: 20},
+		{interval: 10 * time.Second, rate: 1, perSecond: 2},
+		{interval: 500 * time.Millisecond, rate: 1, perSecond: 40},
+		{interval: 10 * time.Second, rate: 0.1, perSecond: 20},
+		{interval: 100 * time.Millisecond, rate: 0.5, perSecond: 400},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(fmt.Sprintf("%s@%v", test.interval, test.rate), func(t *testing.T) {
+			t.Parallel()
+			ma := newFakeAggregator()
+			now := time.Now()
+			for i := 0; i < 20; i++ {
+				ma.Receive(&gostatsd.Metric{Name: "latency", Value: float64(i), Type: gostatsd.TIMER, Rate: test.rate}, now)
+			}
+			ma.Flush(test.interval)
+			timer := ma.Timers["latency"][""]
+			assert.Equal(t, int(math.Floor(20/test.rate+0.5)), timer.Count)
+			assert.InDelta(t, test.perSecond, timer.PerSecond, 1e-9)
+
+			// An idle timer has no rate.
+			ma.Reset()
+			ma.Flush(test.interval)
+			assert.Zero(t, ma.Timers["latency"][""].PerSecond)
+		})
+	}
+}
+
+func TestPercentileInterpolation(t *testing.T) {
+	t.Parallel()
+	thresholds := []float64{30, 50, 90, -10, -40}
+	expected := map[string]map[string]float64{
+		PercentileNearestRank: {"upper_30": 20, "upper_50": 30, "upper_90": 50, "lower_-10": 50, "lower_-40": 40},
+		PercentileLinear:      {"upper_30": 22, "upper_50": 30, "upper_90": 46, "lower_-10": 46, "lower_-40": 34},
+	}
+	for method, values := range expected {
+		method, values := method, values
+		t.Run(method, func(t *testing.T) {
+			t.Parallel()
+			ma := NewMetricAggregator(aggregation.Options{PercentThresholds: thresholds, ExpiryInterval: 5 * time.Minute, LinearPercentiles: method == PercentileLinear}, nil, nil, nil)
+			for _, v := range []float64{30, 10, 50, 20, 40} {
+				ma.Receive(&gostatsd.Metric{Name: "x", Value: v, Rate: 1, Type: gostatsd.TIMER}, time.Now())
+			}
+			ma.Flush(time.Second)
+			actual := map[string]float64{}
+			for _, pct := range ma.Timers["x"][""].Percentiles {
+				if strings.HasPrefix(pct.Str, "upper_") || strings.HasPrefix(pct.Str, "lower_") {
+					actual[pct.Str] = pct.Float
+				}
+			}
+			require.Len(t, actual, len(values))
+			for name, value := range values {
+				assert.InDelta(t, value, actual[name], 1e-9, name)
+			}
+		})
+	}
+}
+
+func TestTimerUnderThresholds(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator(aggregation.Options{ExpiryInterval: 5 * time.Minute, UnderThresholds: []float64{0.5, 150, 200, 1000}}, nil, nil, nil)
+	now := time.Now()
+	for _, v := range []float64{250, 10, 200, 150.5, 199.9, 5000, 20, 200} {
+		ma.Receive(&gostatsd.Metric{Name: "x", Value: v, Rate: 1, Type: gostatsd.TIMER}, now)
+	}
+	ma.Flush(time.Second)
+
+	expected := gostatsd.Percentiles{
+		{Float: 0, Str: "under_0_5"},
+		{Float: 2, Str: "under_150"},
+		{Float: 6, Str: "under_200"},
+		{Float: 7, Str: "under_1000"},
+	}
+	assert.Equal(t, expected, ma.Timers["x"][""].Percentiles)
+
+	// The counts are computed afresh each flush.
+	ma.Reset()
+	ma.Receive(&gostatsd.Metric{Name: "x", Value: 100, Rate: 1, Type: gostatsd.TIMER}, now)
+	ma.Flush(time.Second)
+	expected = gostatsd.Percentiles{
+		{Float: 0, Str: "under_0_5"},
+		{Float: 1, Str: "under_150"},
+		{Float: 1, Str: "under_200"},
+		{Float: 1, Str: "under_1000"},
+	}
+	assert.Equal(t, expected, ma.Timers["x"][""].Percentiles)
+}
+
+func TestMetricTTL(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.CounterGracePeriod = 2 * time.Minute
+	start := time.Now()
+	now := start
+	ma.now = func() time.Time { return now }
+
+	ma.Receive(&gostatsd.Metric{Name: "short", Value: 1, Type: gostatsd.COUNTER, Rate: 1, TTL: 10 * time.Second}, start)
+	ma.Receive(&gostatsd.Metric{Name: "long", Value: 1, Type: gostatsd.GAUGE, Rate: 1, TTL: 10 * time.Second}, start)
+	// The last TTL wins, and a metric without one doesn't reset it.
+	ma.Receive(&gostatsd.Metric{Name: "long", Value: 2, Type: gostatsd.GAUGE, Rate: 1, TTL: time.Hour}, start)
+	ma.Receive(&gostatsd.Metric{Name: "long", Value: 3, Type: gostatsd.GAUGE, Rate: 1}, start)
+	ma.Receive(&gostatsd.Metric{Name: "default", Value: 1, Type: gostatsd.TIMER, Rate: 1}, start)
+	ma.Receive(&gostatsd.Metric{Name: "users", StringValue: "joe", Type: gostatsd.SET, Rate: 1, TTL: 10 * time.Minute}, start)
+
+	// The TTL of a counter overrides its grace period, and survives Reset.
+	now = start.Add(5 * time.Second)
+	ma.Flush(10 * time.Second)
+	ma.Reset()
+	assert.Equal(t, 10*time.Second, ma.Counters["short"][""].TTL)
+	assert.Equal(t, time.Hour, ma.Gauges["long"][""].TTL)
+	assert.Equal(t, 10*time.Minute, ma.Sets["users"][""].TTL)
+
+	now = start.Add(20 * time.Second)
+	ma.Flush(10 * time.Second)
+	ma.Reset()
+	assert.NotContains(t, ma.Counters, "short")
+	assert.Contains(t, ma.Gauges, "long")
+	assert.Contains(t, ma.Timers, "default")
+
+	// Past the expiry interval
+	now = start.Add(6 * time.Minute)
+	ma.Flush(10 * time.Second)
+	ma.Reset()
+	assert.Contains(t, ma.Gauges, "long")
+	assert.NotContains(t, ma.Timers, "default")
+	assert.Contains(t, ma.Sets, "users")
+}
+
+func TestReceiveCounterOverflow(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		policy   string
+		values   []float64
+		rate     float64
+		expected int64
+	}{
+		{CounterOverflowSaturate, []float64{1<<63 - 1024, 1024}, 1, math.MaxInt64},
+		{CounterOverflowSaturate, []float64{1<<63 - 1024, 4096}, 1, math.MaxInt64},
+		{CounterOverflowSaturate, []float64{math.MinInt64, -4096}, 1, math.MinInt64},
+		{CounterOverflowSaturate, []float64{1e19}, 1, math.MaxInt64},
+		{CounterOverflowSaturate, []float64{-1e19}, 1, math.MinInt64},
+		{CounterOverflowSaturate, []float64{1e18}, 0.01, math.MaxInt64},
+		{CounterOverflowWrap, []float64{1<<63 - 1024, 4096}, 1, math.MinInt64 + 3072},
+		{CounterOverflowWrap, []float64{math.MinInt64, -4096}, 1, math.MaxInt64 - 4096 + 1},
+		{CounterOverflowWrap, []float64{1e19}, 1, math.MaxInt64},
+	}
+	for i, test := range tests {
+		ma := newFakeAggregator()
+		ma.WrapCounters = test.policy == CounterOverflowWrap
+		for _, v := range test.values {
+			ma.Receive(&gostatsd.Metric{Name: "c", Value: v, Type: gostatsd.COUNTER, Rate: test.rate}, time.Now())
+		}
+		assert.Equal(t, test.expected, ma.Counters["c"][""].Value, "test %d: %v", i, test)
+		assert.Equal(t, uint64(1), ma.CounterOverflows(), "test %d: %v", i, test)
+	}
+}
+
+func TestReceiveCounterNearOverflow(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.Receive(&gostatsd.Metric{Name: "c", Value: 1<<63 - 4096, Type: gostatsd.COUNTER, Rate: 1}, time.Now())
+	ma.Receive(&gostatsd.Metric{Name: "c", Value: -4096, Type: gostatsd.COUNTER, Rate: 1}, time.Now())
+	ma.Receive(&gostatsd.Metric{Name: "c", Value: 2048, Type: gostatsd.COUNTER, Rate: 1}, time.Now())
+	assert.Equal(t, int64(1<<63-6144), ma.Counters["c"][""].Value)
+	assert.Zero(t, ma.CounterOverflows())
+}
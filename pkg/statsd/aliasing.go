@@ -0,0 +1,112 @@
+package statsd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// CounterPolicyDuplicate sends the full value of a counter to the original metric and each alias.
+	CounterPolicyDuplicate = "duplicate"
+	// CounterPolicySplit divides the value of a counter evenly between the original metric and its aliases.
+	CounterPolicySplit = "split"
+)
+
+type Alias struct {
+	Source        string   // Name to match, or a prefix if it ends with *
+	Aliases       []string // Names to also aggregate the metric under
+	SplitCounters bool     // Divide counter values between the original and the aliases, rather than duplicating them
+}
+
+// NewAliasFromViper creates a new Alias given a *viper.Viper
+func NewAliasFromViper(v *viper.Viper) (Alias, error) {
+	v.SetDefault("aliases", []string{})
+	v.SetDefault("counter-policy", CounterPolicyDuplicate)
+	alias := Alias{
+		Source:  v.GetString("source"),
+		Aliases: v.GetStringSlice("aliases"),
+	}
+	if alias.Source == "" || alias.Source == "*" {
+		return Alias{}, fmt.Errorf("invalid source %q", alias.Source)
+	}
+	if len(alias.Aliases) == 0 {
+		return Alias{}, fmt.Errorf("no aliases for %q", alias.Source)
+	}
+	switch policy := v.GetString("counter-policy"); policy {
+	case CounterPolicyDuplicate:
+	case CounterPolicySplit:
+		alias.SplitCounters = true
+	default:
+		return Alias{}, fmt.Errorf("invalid counter-policy %q", policy)
+	}
+	return alias, nil
+}
+
+// names returns the aliases of name, or nil if it doesn't match the source.  If the source is a prefix match, any
+// alias ending with * has the * replaced with the remainder of name after the prefix.
+func (a *Alias) names(name string) []string {
+	if !strings.HasSuffix(a.Source, "*") {
+		if name != a.Source {
+			return nil
+		}
+		return a.Aliases
+	}
+	prefix := a.Source[:len(a.Source)-1]
+	if !strings.HasPrefix(name, prefix) {
+		return nil
+	}
+	suffix := name[len(prefix):]
+	names := make([]string, 0, len(a.Aliases))
+	for _, alias := range a.Aliases {
+		if strings.HasSuffix(alias, "*") {
+			alias = alias[:len(alias)-1] + suffix
+		}
+		names = append(names, alias)
+	}
+	return names
+}
+
+// aliasMetrics returns a copy of m for each alias of its name, across all rules.  If any matching rule splits
+// counters, the value of a counter is divided between m and the copies, with any remainder kept by m.  m is
+// modified in that case.
+func aliasMetrics(aliases []Alias, m *gostatsd.Metric) []*gostatsd.Metric {
+	var copies []*gostatsd.Metric
+	split := false
+	for i := range aliases {
+		names := aliases[i].names(m.Name)
+		if len(names) == 0 {
+			continue
+		}
+		split = split || aliases[i].SplitCounters
+		for _, name := range names {
+			copies = append(copies, copyMetric(m, name))
+		}
+	}
+	if split && m.Type == gostatsd.COUNTER && len(copies) > 0 {
+		total := int64(m.Value / m.Rate)
+		share := total / int64(len(copies)+1)
+		for _, c := range copies {
+			c.Value = float64(share)
+			c.Rate = 1
+		}
+		m.Value = float64(total - share*int64(len(copies)))
+		m.Rate = 1
+	}
+	return copies
+}
+
+// copyMetric returns a copy of m with the given name, which shares no memory with m and is not returned to a pool.
+func copyMetric(m *gostatsd.Metric, name string) *gostatsd.Metric {
+	c := *m
+	c.Name = name
+	c.Tags = append(gostatsd.Tags(nil), m.Tags...)
+	if len(m.Values) > 0 {
+		c.Values = append([]float64(nil), m.Values...)
+	}
+	c.DoneFunc = nil
+	return &c
+}
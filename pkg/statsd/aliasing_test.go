@@ -0,0 +1,160 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAliasOneToMany(t *testing.T) {
+	t.Parallel()
+	tch := &TagCapturingHandler{}
+	th := NewTagHandler(tch, tch, gostatsd.Tags{"env:prod"}, nil)
+	th.aliases = []Alias{
+		{Source: "old.requests", Aliases: []string{"new.requests", "newer.requests"}},
+	}
+	m := &gostatsd.Metric{
+		Name:     "old.requests",
+		Value:    5,
+		Rate:     0.5,
+		Tags:     gostatsd.Tags{"foo:bar"},
+		Hostname: "baz",
+		Type:     gostatsd.COUNTER,
+	}
+	require.NoError(t, th.DispatchMetric(context.Background(), m))
+
+	require.Len(t, tch.m, 3)
+	for i, name := range []string{"old.requests", "new.requests", "newer.requests"} {
+		assert.Equal(t, name, tch.m[i].Name)
+		assert.Equal(t, 5.0, tch.m[i].Value)
+		assert.Equal(t, 0.5, tch.m[i].Rate)
+		assert.Equal(t, "baz", tch.m[i].Hostname)
+		assertHasAllTags(t, tch.m[i].Tags, "foo:bar", "env:prod")
+	}
+	// Each copy must own its tags, as the aggregator keeps them.
+	tch.m[1].Tags[0] = "changed"
+	assert.NotEqual(t, "changed", tch.m[0].Tags[0])
+	assert.NotEqual(t, "changed", tch.m[2].Tags[0])
+}
+
+func TestAliasSplitCounters(t *testing.T) {
+	t.Parallel()
+	tch := &TagCapturingHandler{}
+	th := NewTagHandler(tch, tch, gostatsd.Tags{}, nil)
+	th.aliases = []Alias{
+		{Source: "old.requests", Aliases: []string{"new.requests", "newer.requests"}, SplitCounters: true},
+	}
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{
+		Name:  "old.requests",
+		Value: 5,
+		Rate:  0.5,
+		Type:  gostatsd.COUNTER,
+	}))
+
+	require.Len(t, tch.m, 3)
+	var total float64
+	for _, m := range tch.m {
+		assert.Equal(t, 1.0, m.Rate)
+		total += m.Value
+	}
+	assert.Equal(t, 10.0, total)
+	assert.Equal(t, 4.0, tch.m[0].Value) // The original keeps the remainder
+	assert.Equal(t, 3.0, tch.m[1].Value)
+	assert.Equal(t, 3.0, tch.m[2].Value)
+}
+
+func TestAliasSplitOnlyAppliesToCounters(t *testing.T) {
+	t.Parallel()
+	tch := &TagCapturingHandler{}
+	th := NewTagHandler(tch, tch, gostatsd.Tags{}, nil)
+	th.aliases = []Alias{
+		{Source: "latency", Aliases: []string{"request.latency"}, SplitCounters: true},
+	}
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{
+		Name:   "latency",
+		Value:  10,
+		Values: []float64{20},
+		Rate:   1,
+		Type:   gostatsd.TIMER,
+	}))
+
+	require.Len(t, tch.m, 2)
+	for _, m := range tch.m {
+		assert.Equal(t, 10.0, m.Value)
+		assert.Equal(t, []float64{20}, m.Values)
+	}
+}
+
+func TestAliasPrefix(t *testing.T) {
+	t.Parallel()
+	tch := &TagCapturingHandler{}
+	th := NewTagHandler(tch, tch, gostatsd.Tags{}, nil)
+	th.aliases = []Alias{
+		{Source: "legacy.*", Aliases: []string{"service.*", "service.all"}},
+		{Source: "legacy.db.queries", Aliases: []string{"db.queries"}},
+	}
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "legacy.db.queries", Type: gostatsd.GAUGE}))
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "other", Type: gostatsd.GAUGE}))
+
+	var names []string
+	for _, m := range tch.m {
+		names = append(names, m.Name)
+	}
+	assert.Equal(t, []string{"legacy.db.queries", "service.db.queries", "service.all", "db.queries", "other"}, names)
+}
+
+func TestAliasAfterFilters(t *testing.T) {
+	t.Parallel()
+	tch := &TagCapturingHandler{}
+	th := NewTagHandler(tch, tch, gostatsd.Tags{}, []Filter{
+		{MatchMetrics: toStringMatch([]string{"old.*"}), DropMetric: true},
+	})
+	th.aliases = []Alias{
+		{Source: "old.requests", Aliases: []string{"new.requests"}},
+	}
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "old.requests", Type: gostatsd.COUNTER}))
+	assert.Empty(t, tch.m)
+}
+
+func TestNewTagHandlerFromViperAliases(t *testing.T) {
+	t.Parallel()
+	var data = []byte(`
+aliases='requests legacy missing bad-policy no-aliases'
+
+[alias.requests]
+source='old.requests'
+aliases='new.requests newer.requests'
+counter-policy='split'
+
+[alias.legacy]
+source='legacy.*'
+aliases=['service.*']
+
+[alias.bad-policy]
+source='x'
+aliases='y'
+counter-policy='halve'
+
+[alias.no-aliases]
+source='x'
+`)
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBuffer(data)))
+
+	nh := &nopHandler{}
+	th := NewTagHandlerFromViper(v, nh, nh, nil)
+
+	expected := []Alias{
+		{Source: "old.requests", Aliases: []string{"new.requests", "newer.requests"}, SplitCounters: true},
+		{Source: "legacy.*", Aliases: []string{"service.*"}},
+	}
+	assert.Equal(t, expected, th.aliases)
+}
@@ -0,0 +1,110 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SourceBlocklist is a list of source addresses and networks whose datagrams are dropped by the receiver.  It is
+// loaded from a file, and reloaded when the process receives SIGHUP.  A nil *SourceBlocklist blocks nothing.
+type SourceBlocklist struct {
+	path   string
+	nets   atomic.Value // []*net.IPNet
+	logger log.FieldLogger
+}
+
+// NewSourceBlocklist loads a SourceBlocklist from the file at path.
+func NewSourceBlocklist(path string, logger log.FieldLogger) (*SourceBlocklist, error) {
+	b := &SourceBlocklist{
+		path:   path,
+		logger: logger,
+	}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload reads the file again, replacing the current list.  The current list is kept if there is an error.
+func (b *SourceBlocklist) Reload() error {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return fmt.Errorf("failed to open source blocklist: %v", err)
+	}
+	defer f.Close()
+	nets, err := ParseSourceBlocklist(f)
+	if err != nil {
+		return fmt.Errorf("failed to read source blocklist %s: %v", b.path, err)
+	}
+	b.nets.Store(nets)
+	b.logger.Infof("Loaded %d entries from source blocklist %s", len(nets), b.path)
+	return nil
+}
+
+// Run reloads the list each time the process receives SIGHUP, until the context is done.
+func (b *SourceBlocklist) Run(ctx context.Context) {
+	runReloadOnSIGHUP(ctx, "source blocklist", b.Reload, b.logger)
+}
+
+// Blocked returns true if ip is in the list.
+func (b *SourceBlocklist) Blocked(ip net.IP) bool {
+	if b == nil || ip == nil {
+		return false
+	}
+	for _, n := range b.nets.Load().([]*net.IPNet) {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSourceBlocklist parses a list with an IP address or CIDR network per line.  Blank lines and anything
+// after a # are ignored.
+func ParseSourceBlocklist(r io.Reader) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		n, err := parseSource(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		nets = append(nets, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nets, nil
+}
+
+// parseSource parses an IP address or CIDR network.
+func parseSource(source string) (*net.IPNet, error) {
+	if strings.IndexByte(source, '/') >= 0 {
+		_, n, err := net.ParseCIDR(source)
+		return n, err
+	}
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", source)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+}
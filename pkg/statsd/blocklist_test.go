@@ -0,0 +1,114 @@
+package statsd
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/pkg/fakesocket"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceBlocklistBlocked(t *testing.T) {
+	t.Parallel()
+	nets, err := ParseSourceBlocklist(strings.NewReader(`
+# Known bad hosts
+10.1.2.3
+192.168.0.0/16 # lab
+2001:db8::1
+fd00::/8
+`))
+	require.NoError(t, err)
+	b := &SourceBlocklist{}
+	b.nets.Store(nets)
+
+	tests := map[string]bool{
+		"10.1.2.3":        true,
+		"10.1.2.4":        false,
+		"::ffff:10.1.2.3": true,
+		"192.168.0.1":     true,
+		"192.168.255.255": true,
+		"192.169.0.1":     false,
+		"2001:db8::1":     true,
+		"2001:db8::2":     false,
+		"fd12::1":         true,
+		"fe80::1":         false,
+	}
+	for ip, expected := range tests {
+		assert.Equal(t, expected, b.Blocked(net.ParseIP(ip)), ip)
+	}
+
+	var none *SourceBlocklist
+	assert.False(t, none.Blocked(net.ParseIP("10.1.2.3")))
+}
+
+func TestParseSourceBlocklistInvalid(t *testing.T) {
+	t.Parallel()
+	for _, list := range []string{"10.1.2", "10.0.0.0/33", "10.0.0.1\nhost.example.com"} {
+		_, err := ParseSourceBlocklist(strings.NewReader(list))
+		assert.Error(t, err, list)
+	}
+}
+
+func TestSourceBlocklistReload(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "blocklist")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blocklist")
+	require.NoError(t, ioutil.WriteFile(path, []byte("10.0.0.1\n"), 0600))
+
+	b, err := NewSourceBlocklist(path, logrus.StandardLogger())
+	require.NoError(t, err)
+	assert.True(t, b.Blocked(net.ParseIP("10.0.0.1")))
+	assert.False(t, b.Blocked(net.ParseIP("10.0.0.2")))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("10.0.0.2\n"), 0600))
+	require.NoError(t, b.Reload())
+	assert.False(t, b.Blocked(net.ParseIP("10.0.0.1")))
+	assert.True(t, b.Blocked(net.ParseIP("10.0.0.2")))
+
+	// A bad list keeps the current one
+	require.NoError(t, ioutil.WriteFile(path, []byte("bad\n"), 0600))
+	assert.Error(t, b.Reload())
+	assert.True(t, b.Blocked(net.ParseIP("10.0.0.2")))
+}
+
+func TestDatagramReceiverBlocklist(t *testing.T) {
+	t.Parallel()
+	nets, err := ParseSourceBlocklist(strings.NewReader(fakesocket.FakeAddr.IP.String() + "/8"))
+	require.NoError(t, err)
+	b := &SourceBlocklist{}
+	b.nets.Store(nets)
+
+	ch := make(chan []*Datagram, 1)
+	mr := NewDatagramReceiver(ch, 2, b, nil, 0)
+	c, done := fakesocket.NewCountedFakePacketConn(10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mr.Receive(ctx, c)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout, failed to read datagrams")
+	}
+	cancel()
+
+	select {
+	case dgs := <-ch:
+		t.Errorf("Unexpected datagrams %v", dgs)
+	default:
+	}
+	assert.NotZero(t, atomic.LoadUint64(&mr.datagramsBlocked))
+}
@@ -0,0 +1,201 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd/pkg/logging"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errCaptureActive   = errors.New("a capture is already active")
+	errCaptureDisabled = errors.New("captures are disabled, set --" + ParamCaptureDir + " to enable them")
+)
+
+// LineCapture tees raw lines whose bucket matches a glob to a new file in its capture directory for a limited time.
+// Only one capture can be active at a time.
+type LineCapture struct {
+	active int32 // Non-zero if a capture is active, must be read/written only using atomic instructions.
+
+	dir      string // Directory the capture files are created in, captures are refused if it is empty
+	maxBytes int64  // Hard cap on the number of bytes captured
+
+	mu      sync.Mutex
+	glob    string
+	path    string
+	file    io.WriteCloser
+	written int64
+	started time.Time
+	until   time.Time
+	timer   *time.Timer
+
+	logger log.FieldLogger
+}
+
+// NewLineCapture creates a LineCapture which writes captures to files in dir, and stops a capture after maxBytes have
+// been written.  Captures are refused if dir is empty.
+func NewLineCapture(dir string, maxBytes int64) *LineCapture {
+	return &LineCapture{
+		dir:      dir,
+		maxBytes: maxBytes,
+		logger:   logging.Component("capture"),
+	}
+}
+
+// Start starts capturing lines whose bucket matches glob to a new file called name in the capture directory, for the
+// duration d.  name must be a plain file name, and the file must not exist, so a capture can't overwrite anything.
+func (lc *LineCapture) Start(glob string, d time.Duration, name string) error {
+	if lc.dir == "" {
+		return errCaptureDisabled
+	}
+	if _, err := path.Match(glob, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %v", glob, err)
+	}
+	if d <= 0 {
+		return fmt.Errorf("invalid duration %v", d)
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || filepath.IsAbs(name) {
+		return fmt.Errorf("invalid capture file name %q, it must be a file name without a directory", name)
+	}
+	filePath := filepath.Join(lc.dir, name)
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.file != nil {
+		return errCaptureActive
+	}
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	lc.glob = glob
+	lc.path = filePath
+	lc.file = f
+	lc.written = 0
+	lc.started = time.Now()
+	until := lc.started.Add(d)
+	lc.until = until
+	lc.timer = time.AfterFunc(d, func() {
+		lc.expire(until)
+	})
+	atomic.StoreInt32(&lc.active, 1)
+	lc.logger.Infof("Started capturing lines matching %q to %s for %v", glob, filePath, d)
+	return nil
+}
+
+// Stop stops the active capture, if any.
+func (lc *LineCapture) Stop(reason string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.stop(reason)
+}
+
+// expire stops the capture which was started to last until the given time, if it has not been stopped and replaced
+// by another since.
+func (lc *LineCapture) expire(until time.Time) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if !lc.until.Equal(until) {
+		return
+	}
+	lc.stop("duration elapsed")
+}
+
+func (lc *LineCapture) stop(reason string) {
+	if lc.file == nil {
+		return
+	}
+	atomic.StoreInt32(&lc.active, 0)
+	lc.timer.Stop()
+	if err := lc.file.Close(); err != nil {
+		lc.logger.WithError(err).WithField("path", lc.path).Warn("Error closing capture file")
+	}
+	lc.file = nil
+	lc.logger.Infof("Stopped capturing lines matching %q to %s after %d bytes: %s", lc.glob, lc.path, lc.written, reason)
+}
+
+// Active returns true if a capture is in progress.  This is the only cost on the hot path when no
+// capture is active.
+func (lc *LineCapture) Active() bool {
+	return atomic.LoadInt32(&lc.active) != 0
+}
+
+// Capture writes line to the capture file if its bucket matches the glob.
+func (lc *LineCapture) Capture(line []byte) {
+	bucket := line
+	if idx := bytes.IndexByte(line, ':'); idx >= 0 {
+		bucket = line[:idx]
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.file == nil {
+		return
+	}
+	if ok, _ := path.Match(lc.glob, string(bucket)); !ok {
+		return
+	}
+	if lc.written+int64(len(line))+1 > lc.maxBytes {
+		lc.stop("byte limit reached")
+		return
+	}
+	n, err := lc.file.Write(append(line[:len(line):len(line)], '\n'))
+	lc.written += int64(n)
+	if err != nil {
+		lc.stop(fmt.Sprintf("write failed: %v", err))
+	}
+}
+
+// Status writes a description of the active capture to w.
+func (lc *LineCapture) Status(w io.Writer) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.file == nil {
+		_, err := io.WriteString(w, "no active capture\n")
+		return err
+	}
+	_, err := fmt.Fprintf(w, "glob: %s\npath: %s\nstarted: %s\nremaining: %v\nbytes: %d/%d\n",
+		lc.glob, lc.path, lc.started.Format(time.RFC3339), time.Until(lc.until).Truncate(time.Second), lc.written, lc.maxBytes)
+	return err
+}
+
+// CaptureCommand is the console command to start a capture, taking the arguments <glob> <seconds> <file>.
+func (lc *LineCapture) CaptureCommand(ctx context.Context, args []string, w io.Writer) error {
+	if len(args) != 3 {
+		return errors.New("usage: capture <glob> <seconds> <file>")
+	}
+	seconds, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return fmt.Errorf("invalid seconds %q: %v", args[1], err)
+	}
+	if err := lc.Start(args[0], time.Duration(seconds*float64(time.Second)), args[2]); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "capture started\n")
+	return err
+}
+
+// StatusCommand is the console command to show the active capture.
+func (lc *LineCapture) StatusCommand(ctx context.Context, args []string, w io.Writer) error {
+	return lc.Status(w)
+}
+
+// StopCommand is the console command to stop the active capture.
+func (lc *LineCapture) StopCommand(ctx context.Context, args []string, w io.Writer) error {
+	lc.Stop("stopped from console")
+	_, err := io.WriteString(w, "capture stopped\n")
+	return err
+}
@@ -0,0 +1,159 @@
+package statsd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCaptureDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "capture")
+	require.NoError(t, err)
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLineCaptureMatchesGlob(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := newCaptureDir(t)
+	defer cleanup()
+	lc := NewLineCapture(dir, 1024)
+	assert.False(t, lc.Active())
+	require.NoError(t, lc.Start("foo.*", time.Minute, "capture.txt"))
+	assert.True(t, lc.Active())
+	assert.Equal(t, errCaptureActive, lc.Start("bar.*", time.Minute, "capture.txt"))
+
+	lc.Capture([]byte("foo.bar:1|c"))
+	lc.Capture([]byte("bar.foo:1|c"))
+	lc.Capture([]byte("foo.baz:2|g|#tag"))
+	lc.Stop("test")
+	assert.False(t, lc.Active())
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "capture.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "foo.bar:1|c\nfoo.baz:2|g|#tag\n", string(data))
+}
+
+func TestLineCaptureByteLimit(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := newCaptureDir(t)
+	defer cleanup()
+	lc := NewLineCapture(dir, 20)
+	require.NoError(t, lc.Start("*", time.Minute, "capture.txt"))
+	lc.Capture([]byte("foo.bar:1|c"))
+	lc.Capture([]byte("foo.bar:1|c"))
+	assert.False(t, lc.Active())
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "capture.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "foo.bar:1|c\n", string(data))
+}
+
+func TestLineCaptureExpires(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := newCaptureDir(t)
+	defer cleanup()
+
+	lc := NewLineCapture(dir, 1024)
+	require.NoError(t, lc.Start("*", 10*time.Millisecond, "capture.txt"))
+	deadline := time.Now().Add(time.Second)
+	for lc.Active() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(t, lc.Active())
+}
+
+func TestLineCaptureStaleExpiry(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := newCaptureDir(t)
+	defer cleanup()
+
+	lc := NewLineCapture(dir, 1024)
+	require.NoError(t, lc.Start("*", time.Minute, "first.txt"))
+	first := lc.until
+	lc.Stop("stopped")
+	require.NoError(t, lc.Start("*", time.Hour, "second.txt"))
+
+	// The timer of the first capture firing late, after it was stopped, leaves the second running.
+	lc.expire(first)
+	assert.True(t, lc.Active())
+	lc.expire(lc.until)
+	assert.False(t, lc.Active())
+}
+
+func TestLineCaptureCommands(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := newCaptureDir(t)
+	defer cleanup()
+	ctx := context.Background()
+	lc := NewLineCapture(dir, 1024)
+
+	var buf strings.Builder
+	assert.Error(t, lc.CaptureCommand(ctx, []string{"foo.*"}, &buf))
+	assert.Error(t, lc.CaptureCommand(ctx, []string{"foo.*", "x", "c"}, &buf))
+	assert.Error(t, lc.CaptureCommand(ctx, []string{"[", "10", "c"}, &buf))
+
+	require.NoError(t, lc.StatusCommand(ctx, nil, &buf))
+	assert.Equal(t, "no active capture\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, lc.CaptureCommand(ctx, []string{"foo.*", "10", "c"}, &buf))
+	require.NoError(t, lc.StatusCommand(ctx, nil, &buf))
+	assert.Contains(t, buf.String(), "capture started\nglob: foo.*\n")
+
+	buf.Reset()
+	require.NoError(t, lc.StopCommand(ctx, nil, &buf))
+	assert.False(t, lc.Active())
+}
+
+func TestLineCaptureConfinedToDir(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := newCaptureDir(t)
+	defer cleanup()
+	existing := filepath.Join(dir, "existing.txt")
+	require.NoError(t, ioutil.WriteFile(existing, []byte("keep"), 0600))
+
+	lc := NewLineCapture("", 1024)
+	assert.Equal(t, errCaptureDisabled, lc.Start("*", time.Minute, "capture.txt"))
+
+	lc = NewLineCapture(dir, 1024)
+	for _, name := range []string{"", ".", "..", "../capture.txt", "/etc/passwd", "a/b", `a\b`} {
+		assert.Error(t, lc.Start("*", time.Minute, name), name)
+	}
+	assert.Error(t, lc.Start("*", time.Minute, "existing.txt"))
+	assert.False(t, lc.Active())
+
+	data, err := ioutil.ReadFile(existing)
+	require.NoError(t, err)
+	assert.Equal(t, "keep", string(data))
+}
+
+func TestParserCapturesRawLines(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := newCaptureDir(t)
+	defer cleanup()
+	lc := NewLineCapture(dir, 1024)
+	require.NoError(t, lc.Start("a/b*", time.Minute, "capture.txt"))
+	dp, ch := newTestParser(false)
+	dp.capture = lc
+
+	// The lexer rewrites "/" in place, the capture must see the raw line.
+	_, _, _, err := dp.handleDatagram(context.Background(), gostatsd.UnknownIP, "", 0, []byte("a/b:1|c\nc:1|c"), time.Time{}, nil)
+	require.NoError(t, err)
+	lc.Stop("test")
+	assert.Len(t, ch.metrics, 2)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "capture.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "a/b:1|c\n", string(data))
+}
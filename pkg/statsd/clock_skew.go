@@ -0,0 +1,272 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+)
+
+const (
+	// ClockSkewOff rejects lines with a client timestamp, as if the field was not supported.
+	ClockSkewOff = "off"
+	// ClockSkewClamp uses the client timestamp of a metric, clamped to the clock skew window around the time it was
+	// received.
+	ClockSkewClamp = "clamp"
+	// ClockSkewShift corrects the client timestamp of a metric by the median skew of its source, then clamps it like
+	// ClockSkewClamp.
+	ClockSkewShift = "shift"
+	// ClockSkewReject uses the client timestamp of a metric, and drops metrics with a timestamp outside the clock skew
+	// window, counting them as bad lines.
+	ClockSkewReject = "reject"
+)
+
+const (
+	// maxSkewSamples is the number of the most recent skews kept for each source to learn its median skew from.
+	maxSkewSamples = 64
+	// maxPendingSkews is the most skews of each source emitted as timers each flush.
+	maxPendingSkews = 16
+	// skewMedianRefresh is how often the median skew of a source is recomputed.
+	skewMedianRefresh = time.Second
+	// minSkewShift is the smallest median skew a timestamp is shifted by, as client timestamps are whole seconds.
+	minSkewShift = time.Second
+)
+
+var errClockSkew = errors.New("timestamp outside clock skew window")
+
+// skewAction is what was done to the timestamp of a metric because of clock skew.
+type skewAction int
+
+const (
+	skewClamped skewAction = iota
+	skewShifted
+	skewRejected
+	numSkewActions
+)
+
+var skewActionNames = [numSkewActions]string{
+	skewClamped:  "clamped",
+	skewShifted:  "shifted",
+	skewRejected: "rejected",
+}
+
+// skewSample is the skew of a metric, and when it was received.
+type skewSample struct {
+	at   time.Time
+	skew time.Duration
+}
+
+// skewSource is the recent skews of the client timestamps of one source.
+type skewSource struct {
+	samples  [maxSkewSamples]skewSample // Ring of the most recent samples
+	count    int                        // Number of samples in the ring
+	next     int                        // Index the next sample is written to
+	lastSeen time.Time
+
+	median   time.Duration
+	medianAt time.Time // When median was computed, zero if it never was
+
+	pending []float64 // Skews in milliseconds since the last flush, at most maxPendingSkews
+}
+
+func (src *skewSource) add(skew time.Duration, at time.Time) {
+	src.samples[src.next] = skewSample{at: at, skew: skew}
+	src.next = (src.next + 1) % maxSkewSamples
+	if src.count < maxSkewSamples {
+		src.count++
+	}
+	src.lastSeen = at
+	if len(src.pending) < maxPendingSkews {
+		src.pending = append(src.pending, float64(skew)/float64(time.Millisecond))
+	}
+}
+
+// medianSkew returns the median of the samples received within learnWindow of now, using scratch to sort them.
+func (src *skewSource) medianSkew(now time.Time, learnWindow time.Duration, scratch []time.Duration) (time.Duration, []time.Duration) {
+	if !src.medianAt.IsZero() && now.Sub(src.medianAt) < skewMedianRefresh {
+		return src.median, scratch
+	}
+	scratch = scratch[:0]
+	for i := 0; i < src.count; i++ {
+		if s := src.samples[i]; now.Sub(s.at) <= learnWindow {
+			scratch = append(scratch, s.skew)
+		}
+	}
+	src.median = 0
+	if len(scratch) > 0 {
+		sort.Slice(scratch, func(i, j int) bool { return scratch[i] < scratch[j] })
+		src.median = scratch[len(scratch)/2]
+	}
+	src.medianAt = now
+	return src.median, scratch
+}
+
+// ClockSkew applies the clock skew policy to metrics with a client timestamp, from the dogstatsd T field.  The skew
+// of a metric is its client timestamp less the time it was received, so a client with a clock which is ahead has a
+// positive skew.  The recent skews of each source are learned over a sliding window, for the shift policy and the
+// clock-skew command.  At most maxSources sources are learned at once, and a source is forgotten once nothing has been
+// received from it for the learn window.  A nil *ClockSkew is not used, as client timestamps are then not accepted.
+type ClockSkew struct {
+	actions   [numSkewActions]uint64 // Must be read/written only using atomic instructions.
+	untracked uint64                 // Must be read/written only using atomic instructions.
+
+	policy      string
+	window      time.Duration
+	learnWindow time.Duration
+	maxSources  int
+
+	mu      sync.Mutex
+	sources map[gostatsd.IP]*skewSource
+	scratch []time.Duration
+}
+
+// NewClockSkew creates a ClockSkew which applies policy to timestamps more than window away from the time their metric
+// was received, learning the skews of up to maxSources sources over learnWindow.
+func NewClockSkew(policy string, window, learnWindow time.Duration, maxSources int) *ClockSkew {
+	return &ClockSkew{
+		policy:      policy,
+		window:      window,
+		learnWindow: learnWindow,
+		maxSources:  maxSources,
+		sources:     map[gostatsd.IP]*skewSource{},
+	}
+}
+
+// apply records the skew of m if it has a client timestamp, and sets its timestamp to the client timestamp as the
+// policy decides.  It returns false if m is rejected.
+func (cs *ClockSkew) apply(m *gostatsd.Metric, ip gostatsd.IP, received time.Time) bool {
+	if m.ClientTimestamp == 0 {
+		return true
+	}
+	if received.IsZero() {
+		received = time.Now()
+	}
+	now := gostatsd.Nanotime(received.UnixNano())
+	median := cs.observe(ip, time.Duration(m.ClientTimestamp-now), received)
+
+	ts := m.ClientTimestamp
+	if cs.policy == ClockSkewShift && (median >= minSkewShift || median <= -minSkewShift) {
+		ts -= gostatsd.Nanotime(median)
+		atomic.AddUint64(&cs.actions[skewShifted], 1)
+	}
+	earliest, latest := now-gostatsd.Nanotime(cs.window), now+gostatsd.Nanotime(cs.window)
+	if ts < earliest || ts > latest {
+		if cs.policy == ClockSkewReject {
+			atomic.AddUint64(&cs.actions[skewRejected], 1)
+			return false
+		}
+		if ts < earliest {
+			ts = earliest
+		} else {
+			ts = latest
+		}
+		atomic.AddUint64(&cs.actions[skewClamped], 1)
+	}
+	m.Timestamp = ts
+	return true
+}
+
+// observe records skew as received from ip at now, and returns the median skew of ip if the policy shifts
+// timestamps.
+func (cs *ClockSkew) observe(ip gostatsd.IP, skew time.Duration, now time.Time) time.Duration {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	src, ok := cs.sources[ip]
+	if !ok {
+		if len(cs.sources) >= cs.maxSources {
+			atomic.AddUint64(&cs.untracked, 1)
+			return 0
+		}
+		src = &skewSource{}
+		cs.sources[ip] = src
+	}
+	src.add(skew, now)
+	if cs.policy != ClockSkewShift {
+		return 0
+	}
+	var median time.Duration
+	median, cs.scratch = src.medianSkew(now, cs.learnWindow, cs.scratch)
+	return median
+}
+
+// expire forgets the sources nothing has been received from for the learn window, and returns the skews received
+// from each remaining source since the last call.
+func (cs *ClockSkew) expire(now time.Time) (int, map[gostatsd.IP][]float64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	pending := map[gostatsd.IP][]float64{}
+	for ip, src := range cs.sources {
+		if now.Sub(src.lastSeen) > cs.learnWindow {
+			delete(cs.sources, ip)
+			continue
+		}
+		if len(src.pending) > 0 {
+			pending[ip] = src.pending
+			src.pending = nil
+		}
+	}
+	return len(cs.sources), pending
+}
+
+// emit expires idle sources, and emits the skews received since the last flush as parser.clock_skew timers tagged with
+// their source, along with counts of the metrics the policy changed or rejected.
+func (cs *ClockSkew) emit(statser statser.Statser) {
+	if cs == nil {
+		return
+	}
+	sources, pending := cs.expire(time.Now())
+	for ip, skews := range pending {
+		tags := gostatsd.Tags{"source:" + string(ip)}
+		for _, skew := range skews {
+			statser.TimingMS("parser.clock_skew", skew, tags)
+		}
+	}
+	statser.Gauge("parser.clock_skew_sources", float64(sources), nil)
+	for action := skewAction(0); action < numSkewActions; action++ {
+		if n := atomic.SwapUint64(&cs.actions[action], 0); n > 0 {
+			statser.Count("parser.clock_skew_metrics", float64(n), gostatsd.Tags{"action:" + skewActionNames[action], "policy:" + cs.policy})
+		}
+	}
+	if n := atomic.SwapUint64(&cs.untracked, 0); n > 0 {
+		statser.Count("parser.clock_skew_untracked", float64(n), nil)
+	}
+}
+
+// ClockSkewCommand is the console command to show the median skew of each source learned over the learn window, the
+// number of samples it is of, and when the source was last seen.
+func (cs *ClockSkew) ClockSkewCommand(ctx context.Context, args []string, w io.Writer) error {
+	type sourceSkew struct {
+		ip       gostatsd.IP
+		median   time.Duration
+		samples  int
+		lastSeen time.Time
+	}
+	now := time.Now()
+	cs.mu.Lock()
+	skews := make([]sourceSkew, 0, len(cs.sources))
+	for ip, src := range cs.sources {
+		var median time.Duration
+		src.medianAt = time.Time{} // Recomputed, so scratch holds the samples it is of
+		median, cs.scratch = src.medianSkew(now, cs.learnWindow, cs.scratch)
+		skews = append(skews, sourceSkew{ip: ip, median: median, samples: len(cs.scratch), lastSeen: src.lastSeen})
+	}
+	cs.mu.Unlock()
+	if len(skews) == 0 {
+		_, err := fmt.Fprintln(w, "no sources")
+		return err
+	}
+	sort.Slice(skews, func(i, j int) bool { return skews[i].ip < skews[j].ip })
+	for _, s := range skews {
+		if _, err := fmt.Fprintf(w, "%s median:%v samples:%d last_seen:%v ago\n", s.ip, s.median, s.samples, now.Sub(s.lastSeen).Truncate(time.Second)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
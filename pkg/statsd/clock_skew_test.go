@@ -0,0 +1,117 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var skewReceived = time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+
+func skewMetric(skew time.Duration) *gostatsd.Metric {
+	return &gostatsd.Metric{Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1, ClientTimestamp: gostatsd.Nanotime(skewReceived.Add(skew).UnixNano())}
+}
+
+func TestClockSkewClamp(t *testing.T) {
+	t.Parallel()
+	cs := NewClockSkew(ClockSkewClamp, time.Minute, 10*time.Minute, 10)
+
+	m := skewMetric(-30 * time.Second)
+	require.True(t, cs.apply(m, fakeIP, skewReceived))
+	assert.Equal(t, m.ClientTimestamp, m.Timestamp)
+
+	m = skewMetric(-time.Hour)
+	require.True(t, cs.apply(m, fakeIP, skewReceived))
+	assert.Equal(t, gostatsd.Nanotime(skewReceived.Add(-time.Minute).UnixNano()), m.Timestamp)
+
+	m = skewMetric(time.Hour)
+	require.True(t, cs.apply(m, fakeIP, skewReceived))
+	assert.Equal(t, gostatsd.Nanotime(skewReceived.Add(time.Minute).UnixNano()), m.Timestamp)
+
+	// A metric without a client timestamp is left alone.
+	m = &gostatsd.Metric{Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1, Timestamp: 5}
+	require.True(t, cs.apply(m, fakeIP, skewReceived))
+	assert.EqualValues(t, 5, m.Timestamp)
+
+	assert.EqualValues(t, 2, atomic.LoadUint64(&cs.actions[skewClamped]))
+	assert.Zero(t, atomic.LoadUint64(&cs.actions[skewShifted]))
+}
+
+func TestClockSkewShift(t *testing.T) {
+	t.Parallel()
+	cs := NewClockSkew(ClockSkewShift, time.Minute, 10*time.Minute, 10)
+	ahead := gostatsd.IP("10.0.0.1")
+	for _, skew := range []time.Duration{2 * time.Minute, 2 * time.Minute, -time.Hour} {
+		require.True(t, cs.apply(skewMetric(skew), ahead, skewReceived))
+	}
+
+	// The median of the skews of the source is 2m, so its timestamps are shifted back by 2m.
+	m := skewMetric(2*time.Minute + 10*time.Second)
+	require.True(t, cs.apply(m, ahead, skewReceived.Add(2*time.Second)))
+	assert.Equal(t, gostatsd.Nanotime(skewReceived.Add(10*time.Second).UnixNano()), m.Timestamp)
+
+	// A source with an accurate clock is not shifted.
+	m = skewMetric(0)
+	require.True(t, cs.apply(m, fakeIP, skewReceived))
+	assert.Equal(t, m.ClientTimestamp, m.Timestamp)
+
+	// Every metric from the source ahead was shifted, as the median is learned from the first sample on.
+	assert.EqualValues(t, 4, atomic.LoadUint64(&cs.actions[skewShifted]))
+}
+
+func TestClockSkewReject(t *testing.T) {
+	t.Parallel()
+	dp, ch := newTestParser(false)
+	dp.clockSkew = NewClockSkew(ClockSkewReject, time.Minute, 10*time.Minute, 10)
+
+	lines := fmt.Sprintf("a:1|c|T%d\nb:1|c|T%d\nc:1|c|T0", skewReceived.Add(-30*time.Second).Unix(), skewReceived.Add(-time.Hour).Unix())
+	metrics, _, badLines, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte(lines), skewReceived, nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, metrics)
+	assert.EqualValues(t, 2, badLines)
+	assert.EqualValues(t, 2, dp.lineErrors.count(parseErrorBadTimestamp))
+	require.Len(t, ch.metrics, 1)
+	assert.Equal(t, "a", ch.metrics[0].Name)
+	assert.Equal(t, gostatsd.Nanotime(skewReceived.Add(-30*time.Second).UnixNano()), ch.metrics[0].Timestamp)
+	assert.EqualValues(t, 1, atomic.LoadUint64(&dp.clockSkew.actions[skewRejected]))
+}
+
+func TestClockSkewSourcesBoundedAndExpired(t *testing.T) {
+	t.Parallel()
+	cs := NewClockSkew(ClockSkewClamp, time.Minute, 10*time.Minute, 2)
+	for i, ip := range []gostatsd.IP{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		received := skewReceived.Add(time.Duration(i) * time.Minute)
+		m := &gostatsd.Metric{Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1, ClientTimestamp: gostatsd.Nanotime(received.Add(time.Duration(i) * time.Second).UnixNano())}
+		require.True(t, cs.apply(m, ip, received))
+	}
+	assert.Len(t, cs.sources, 2)
+	assert.EqualValues(t, 1, atomic.LoadUint64(&cs.untracked))
+
+	sources, pending := cs.expire(skewReceived.Add(10*time.Minute + 30*time.Second))
+	assert.Equal(t, 1, sources)
+	assert.Equal(t, map[gostatsd.IP][]float64{"10.0.0.2": {1000}}, pending)
+
+	// The skews are only reported once.
+	_, pending = cs.expire(skewReceived.Add(10*time.Minute + 30*time.Second))
+	assert.Empty(t, pending)
+}
+
+func TestClockSkewCommand(t *testing.T) {
+	t.Parallel()
+	cs := NewClockSkew(ClockSkewShift, time.Minute, time.Hour, 10)
+	now := time.Now().Truncate(time.Second)
+	m := &gostatsd.Metric{Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1, ClientTimestamp: gostatsd.Nanotime(now.Add(-5 * time.Second).UnixNano())}
+	require.True(t, cs.apply(m, fakeIP, now))
+
+	var buf bytes.Buffer
+	require.NoError(t, cs.ClockSkewCommand(context.Background(), nil, &buf))
+	assert.Regexp(t, `^127\.0\.0\.1 median:-5s samples:1 last_seen:\d+s ago\n$`, buf.String())
+}
@@ -0,0 +1,113 @@
+package statsd
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+const (
+	// ColdStartNone flushes the first, partial, interval after startup like any other.
+	ColdStartNone = "none"
+	// ColdStartSuppress drops the metrics of the first interval after startup rather than sending them.
+	ColdStartSuppress = "suppress"
+	// ColdStartMark sends the first interval after startup with a partial_interval gauge of the fraction of the
+	// interval which was aggregated.
+	ColdStartMark = "mark"
+	// ColdStartScale computes the rates of the first interval after startup over the time which was aggregated,
+	// rather than the whole interval.
+	ColdStartScale = "scale"
+)
+
+// ColdStart handles the first flush after startup, which only aggregates metrics received since startup rather than
+// over a whole flush interval.  The aggregators record when the first metric was received, and the flusher handles
+// the first flush after that according to the mode.  It also announces the start with a started counter in the
+// first flush.  A nil *ColdStart does nothing.
+type ColdStart struct {
+	began int64 // Time the first metric was received, Unix nanoseconds. Must be read/written only using atomic instructions.
+
+	mode     string
+	hostname string
+	tags     gostatsd.Tags
+	tagsKey  string
+
+	startedName string
+	partialName string
+
+	announced bool // The started counter has been sent, only accessed from the flushing goroutine
+	done      bool // The first interval has been flushed, only accessed from the flushing goroutine
+}
+
+// NewColdStart creates a ColdStart handling the first flush according to mode.  The started and partial_interval
+// metrics are named in namespace, with the hostname and tags of internal metrics.
+func NewColdStart(mode, namespace, hostname string, tags gostatsd.Tags) *ColdStart {
+	prefix := ""
+	if namespace != "" {
+		prefix = namespace + "."
+	}
+	return &ColdStart{
+		mode:        mode,
+		hostname:    hostname,
+		tags:        tags,
+		tagsKey:     formatTagsKey(tags, hostname),
+		startedName: prefix + "started",
+		partialName: prefix + "partial_interval",
+	}
+}
+
+// Received records the time a metric was received, if it is the first.  This is the only cost on the hot path.
+func (cs *ColdStart) Received(now time.Time) {
+	if cs == nil || atomic.LoadInt64(&cs.began) != 0 {
+		return
+	}
+	atomic.CompareAndSwapInt64(&cs.began, 0, now.UnixNano())
+}
+
+// firstInterval returns the fraction of the interval ending at thisFlush which was aggregated, if this is the first
+// flush since metrics were first received, otherwise 0.
+func (cs *ColdStart) firstInterval(thisFlush time.Time, interval time.Duration) float64 {
+	if cs == nil || cs.done || cs.mode == ColdStartNone {
+		return 0
+	}
+	began := atomic.LoadInt64(&cs.began)
+	if began == 0 {
+		return 0
+	}
+	cs.done = true
+	fraction := float64(thisFlush.UnixNano()-began) / float64(interval)
+	switch {
+	case fraction > 1:
+		return 1
+	case fraction < 0.001:
+		// Metrics which arrived just before the flush are not enough to scale a rate by.
+		return 0.001
+	}
+	return fraction
+}
+
+// metrics returns the metrics to add to a flush at timestamp, where fraction is the result of firstInterval, or nil
+// if there are none.
+func (cs *ColdStart) metrics(timestamp gostatsd.Nanotime, fraction float64) *gostatsd.MetricMap {
+	if cs == nil || (cs.announced && (fraction == 0 || cs.mode != ColdStartMark)) {
+		return nil
+	}
+	m := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{},
+		Timers:   gostatsd.Timers{},
+		Gauges:   gostatsd.Gauges{},
+		Sets:     gostatsd.Sets{},
+	}
+	if !cs.announced {
+		cs.announced = true
+		m.Counters[cs.startedName] = map[string]gostatsd.Counter{
+			cs.tagsKey: gostatsd.NewCounter(timestamp, 1, cs.hostname, cs.tags),
+		}
+	}
+	if fraction > 0 && cs.mode == ColdStartMark {
+		m.Gauges[cs.partialName] = map[string]gostatsd.Gauge{
+			cs.tagsKey: gostatsd.NewGauge(timestamp, fraction, cs.hostname, cs.tags),
+		}
+	}
+	return m
+}
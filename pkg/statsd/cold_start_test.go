@@ -0,0 +1,139 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mergingBackend merges every map it is sent.
+type mergingBackend struct {
+	mu sync.Mutex
+	m  gostatsd.MetricMap
+}
+
+func newMergingBackend() *mergingBackend {
+	return &mergingBackend{
+		m: gostatsd.MetricMap{
+			Counters: gostatsd.Counters{},
+			Timers:   gostatsd.Timers{},
+			Gauges:   gostatsd.Gauges{},
+			Sets:     gostatsd.Sets{},
+		},
+	}
+}
+
+func (mb *mergingBackend) Name() string {
+	return "merging"
+}
+
+func (mb *mergingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	mb.mu.Lock()
+	mergeMetricMap(&mb.m, m)
+	mb.mu.Unlock()
+	cb(nil)
+}
+
+func (mb *mergingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestColdStartFirstInterval(t *testing.T) {
+	t.Parallel()
+	start := time.Unix(1000, 0)
+	cs := NewColdStart(ColdStartScale, "statsd", "host", nil)
+
+	// Nothing has been received, so the first interval has not started.
+	assert.Zero(t, cs.firstInterval(start, 10*time.Second))
+
+	cs.Received(start.Add(7 * time.Second))
+	cs.Received(start.Add(8 * time.Second))
+	assert.Equal(t, 0.3, cs.firstInterval(start.Add(10*time.Second), 10*time.Second))
+	assert.Zero(t, cs.firstInterval(start.Add(20*time.Second), 10*time.Second))
+
+	cs = NewColdStart(ColdStartScale, "statsd", "host", nil)
+	cs.Received(start)
+	assert.Equal(t, 1.0, cs.firstInterval(start.Add(time.Minute), 10*time.Second))
+
+	cs = NewColdStart(ColdStartNone, "statsd", "host", nil)
+	cs.Received(start)
+	assert.Zero(t, cs.firstInterval(start.Add(5*time.Second), 10*time.Second))
+
+	var nilColdStart *ColdStart
+	nilColdStart.Received(start)
+	assert.Zero(t, nilColdStart.firstInterval(start, 10*time.Second))
+	assert.Nil(t, nilColdStart.metrics(0, 0))
+}
+
+func TestColdStartMetrics(t *testing.T) {
+	t.Parallel()
+	tags := gostatsd.Tags{"env:prod"}
+	tagsKey := formatTagsKey(tags, "host")
+
+	cs := NewColdStart(ColdStartMark, "statsd", "host", tags)
+	m := cs.metrics(1, 0)
+	require.NotNil(t, m)
+	assert.Equal(t, gostatsd.Counters{"statsd.started": {tagsKey: gostatsd.NewCounter(1, 1, "host", tags)}}, m.Counters)
+	assert.Empty(t, m.Gauges)
+
+	m = cs.metrics(2, 0.25)
+	require.NotNil(t, m)
+	assert.Empty(t, m.Counters)
+	assert.Equal(t, gostatsd.Gauges{"statsd.partial_interval": {tagsKey: gostatsd.NewGauge(2, 0.25, "host", tags)}}, m.Gauges)
+	assert.Nil(t, cs.metrics(3, 0))
+
+	cs = NewColdStart(ColdStartScale, "", "host", nil)
+	m = cs.metrics(1, 0.25)
+	require.NotNil(t, m)
+	assert.Contains(t, m.Counters, "started")
+	assert.Empty(t, m.Gauges)
+	assert.Nil(t, cs.metrics(2, 0.5))
+}
+
+func TestFlusherColdStart(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []string{ColdStartSuppress, ColdStartMark, ColdStartScale} {
+		mode := mode
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+			cs := NewColdStart(mode, "statsd", "", nil)
+			agg := NewMetricAggregator(aggregation.Options{ExpiryInterval: 5 * time.Minute}, nil, nil, cs)
+			backend := newMergingBackend()
+			fl := NewMetricFlusher(10*time.Second, &singleAggregator{agg: agg}, nil, []gostatsd.Backend{backend}, "", false, false, nil, nil, cs, statser.NewNullStatser())
+
+			now := time.Now()
+			agg.Receive(&gostatsd.Metric{Name: "c", Value: 50, Type: gostatsd.COUNTER, Rate: 1}, now.Add(-5*time.Second))
+			fl.flushData(context.Background(), 10*time.Second, cs.firstInterval(now, 10*time.Second))
+
+			assert.EqualValues(t, 1, backend.m.Counters["statsd.started"][""].Value)
+			switch mode {
+			case ColdStartSuppress:
+				assert.NotContains(t, backend.m.Counters, "c")
+			case ColdStartMark:
+				assert.EqualValues(t, 50, backend.m.Counters["c"][""].Value)
+				assert.InDelta(t, 5.0, backend.m.Counters["c"][""].PerSecond, 0.1)
+				assert.InDelta(t, 0.5, backend.m.Gauges["statsd.partial_interval"][""].Value, 0.01)
+			case ColdStartScale:
+				assert.EqualValues(t, 50, backend.m.Counters["c"][""].Value)
+				assert.InDelta(t, 10.0, backend.m.Counters["c"][""].PerSecond, 0.1)
+				assert.NotContains(t, backend.m.Gauges, "statsd.partial_interval")
+			}
+
+			// Later flushes are unaffected.
+			backend.m.Counters = gostatsd.Counters{}
+			agg.Receive(&gostatsd.Metric{Name: "c", Value: 50, Type: gostatsd.COUNTER, Rate: 1}, now)
+			fl.flushData(context.Background(), 10*time.Second, cs.firstInterval(now.Add(10*time.Second), 10*time.Second))
+			assert.NotContains(t, backend.m.Counters, "statsd.started")
+			assert.EqualValues(t, 50, backend.m.Counters["c"][""].Value)
+			assert.Equal(t, 5.0, backend.m.Counters["c"][""].PerSecond)
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package statsd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// DefaultDockerSocket is the default path of the Docker Engine API socket.
+const DefaultDockerSocket = "/var/run/docker.sock"
+
+// Labels holding the namespace of a container, in order of preference.
+var namespaceLabels = []string{
+	"io.kubernetes.pod.namespace",
+	"com.docker.stack.namespace",
+}
+
+// DockerResolver looks up containers with the Docker Engine API, over its unix socket.
+type DockerResolver struct {
+	client *http.Client
+}
+
+// NewDockerResolver creates a DockerResolver using the Docker Engine API socket at path.
+func NewDockerResolver(path string) *DockerResolver {
+	var dialer net.Dialer
+	return &DockerResolver{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// dockerContainer is the part of the response of the container inspect API which is used.
+type dockerContainer struct {
+	Name   string
+	Config struct {
+		Image  string
+		Labels map[string]string
+	}
+}
+
+// Resolve returns the container_name, image_name and, if the container has one, container_namespace tags of the
+// container with the ID.
+func (dr *DockerResolver) Resolve(ctx context.Context, id string) (gostatsd.Tags, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://docker/containers/"+url.PathEscape(id)+"/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dr.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var container dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&container); err != nil {
+		return nil, err
+	}
+	tags := gostatsd.Tags{
+		"container_name:" + strings.TrimPrefix(container.Name, "/"),
+		"image_name:" + container.Config.Image,
+	}
+	for _, label := range namespaceLabels {
+		if ns := container.Config.Labels[label]; ns != "" {
+			tags = append(tags, "container_namespace:"+ns)
+			break
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,90 @@
+package statsd
+
+import (
+	"hash/crc32"
+	"net"
+	"sync"
+	"time"
+)
+
+// castagnoliTable is used to hash datagrams, as CRC-32C is hardware accelerated on most platforms.
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// dedupWindow remembers hashes for a window after they are first seen.  Hashes are tracked in a rotating pair of
+// hash sets, so memory is bounded by the number of hashes seen in two windows.
+type dedupWindow struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	rotated  time.Time
+	current  map[uint64]int64 // Time each hash was first seen, in Unix nanoseconds
+	previous map[uint64]int64
+}
+
+func newDedupWindow(window time.Duration) dedupWindow {
+	return dedupWindow{
+		window:   window,
+		current:  map[uint64]int64{},
+		previous: map[uint64]int64{},
+	}
+}
+
+// seen returns true if key was seen less than the window before now.  Otherwise it records key as seen at now.
+func (dw *dedupWindow) seen(key uint64, now time.Time) bool {
+	ts := now.UnixNano()
+	window := int64(dw.window)
+
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if elapsed := now.Sub(dw.rotated); elapsed >= dw.window {
+		if elapsed >= 2*dw.window {
+			clearHashes(dw.current)
+		}
+		clearHashes(dw.previous)
+		dw.current, dw.previous = dw.previous, dw.current
+		dw.rotated = now
+	}
+	if seen, ok := dw.current[key]; ok && ts-seen <= window {
+		return true
+	}
+	if seen, ok := dw.previous[key]; ok && ts-seen <= window {
+		return true
+	}
+	dw.current[key] = ts
+	return false
+}
+
+func clearHashes(m map[uint64]int64) {
+	for k := range m {
+		delete(m, k)
+	}
+}
+
+// DatagramDeduplicator detects datagrams which are exact duplicates of one received from the same source address
+// within a short window, such as those sent by a network device which duplicates packets.
+type DatagramDeduplicator struct {
+	dedupWindow
+}
+
+// NewDatagramDeduplicator creates a DatagramDeduplicator which drops duplicates received within window of the
+// original datagram.
+func NewDatagramDeduplicator(window time.Duration) *DatagramDeduplicator {
+	return &DatagramDeduplicator{
+		dedupWindow: newDedupWindow(window),
+	}
+}
+
+// Duplicate returns true if the same msg was received from addr less than the window before now.  Otherwise it
+// records msg as received at now.
+func (d *DatagramDeduplicator) Duplicate(addr *net.UDPAddr, msg []byte, now time.Time) bool {
+	return d.seen(datagramHash(addr, msg), now)
+}
+
+// datagramHash returns a 64 bit hash of a datagram and its source address, made of two independent CRC-32s.
+func datagramHash(addr *net.UDPAddr, msg []byte) uint64 {
+	port := [2]byte{byte(addr.Port >> 8), byte(addr.Port)}
+	h1 := crc32.Update(crc32.Checksum(addr.IP, castagnoliTable), castagnoliTable, port[:])
+	h1 = crc32.Update(h1, castagnoliTable, msg)
+	h2 := crc32.Update(crc32.ChecksumIEEE(msg), crc32.IEEETable, addr.IP)
+	return uint64(h1)<<32 | uint64(h2)
+}
@@ -0,0 +1,99 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/pkg/fakesocket"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatagramDeduplicator(t *testing.T) {
+	t.Parallel()
+	d := NewDatagramDeduplicator(500 * time.Millisecond)
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	otherHost := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1234}
+	otherPort := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1235}
+	msg := []byte("foo:1|c")
+	start := time.Now()
+
+	assert.False(t, d.Duplicate(addr, msg, start))
+	assert.True(t, d.Duplicate(addr, msg, start.Add(time.Millisecond)))
+	assert.True(t, d.Duplicate(addr, []byte("foo:1|c"), start.Add(499*time.Millisecond)))
+	assert.False(t, d.Duplicate(addr, []byte("foo:2|c"), start.Add(time.Millisecond)))
+	assert.False(t, d.Duplicate(otherHost, msg, start.Add(time.Millisecond)))
+	assert.False(t, d.Duplicate(otherPort, msg, start.Add(time.Millisecond)))
+
+	// The original is in the previous set after the rotation, but is outside the window.
+	assert.False(t, d.Duplicate(addr, msg, start.Add(600*time.Millisecond)))
+	assert.True(t, d.Duplicate(addr, msg, start.Add(700*time.Millisecond)))
+
+	// Both sets are cleared after two idle windows.
+	assert.False(t, d.Duplicate(addr, msg, start.Add(5*time.Second)))
+	assert.Len(t, d.current, 1)
+	assert.Empty(t, d.previous)
+}
+
+func TestDatagramDeduplicatorRepeatedOutsideWindow(t *testing.T) {
+	t.Parallel()
+	d := NewDatagramDeduplicator(500 * time.Millisecond)
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	msg := []byte("heartbeat:1|c")
+	now := time.Now()
+	// A single metric sent every window is never dropped, regardless of when the sets rotate.
+	for i := 0; i < 10; i++ {
+		assert.False(t, d.Duplicate(addr, msg, now), "send %d", i)
+		now = now.Add(501 * time.Millisecond)
+	}
+}
+
+func TestDatagramReceiverDedup(t *testing.T) {
+	t.Parallel()
+	ch := make(chan []*Datagram, 10)
+	mr := NewDatagramReceiver(ch, 2, nil, NewDatagramDeduplicator(time.Hour), 0)
+	// Every read returns the same datagram from the same address.
+	c, done := fakesocket.NewCountedFakePacketConn(10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		mr.Receive(ctx, c)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout, failed to read datagrams")
+	}
+	cancel()
+	<-finished // The counters are final once the receiver has stopped.
+
+	var received int
+	for len(ch) > 0 {
+		received += len(<-ch)
+	}
+	require.Equal(t, 1, received)
+	assert.EqualValues(t, atomic.LoadUint64(&mr.datagramsReceived)-1, atomic.LoadUint64(&mr.datagramsDuplicate))
+}
+
+func BenchmarkDatagramDeduplicator(b *testing.B) {
+	d := NewDatagramDeduplicator(500 * time.Millisecond)
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	msg := bytes.Repeat([]byte("foo.bar.baz:1|c\n"), 90) // A full 1440 byte datagram
+	now := time.Now()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg[0] = byte(i) // Mostly unique datagrams, as duplicates are the exception
+		msg[1] = byte(i >> 8)
+		d.Duplicate(addr, msg, now.Add(time.Duration(i)*time.Microsecond))
+	}
+}
@@ -0,0 +1,260 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// DerivedSum adds the values of all its inputs.
+	DerivedSum = "sum"
+	// DerivedRatio divides the value of its first input by the value of its second.
+	DerivedRatio = "ratio"
+	// DerivedDifference subtracts the value of its second input from the value of its first.
+	DerivedDifference = "difference"
+
+	// DivideByZeroSkip doesn't produce a derived metric when a ratio would divide by zero.
+	DivideByZeroSkip = "skip"
+	// DivideByZeroZero produces a derived metric with the value 0 when a ratio would divide by zero.
+	DivideByZeroZero = "zero"
+)
+
+// DerivedMetric is a rule computing a gauge from the values of other metrics at flush time.  Each input is a glob,
+// and its value is the sum of the values of all counters and gauges whose name matches it, across all tags.  The
+// value of a counter is its count for the flush interval.
+type DerivedMetric struct {
+	Rule         string   // Name of the rule in the configuration
+	Name         string   // Name of the gauge produced
+	Op           string   // One of DerivedSum, DerivedRatio or DerivedDifference
+	Inputs       []string // Globs matching the input metric names
+	DivideByZero string   // One of DivideByZeroSkip or DivideByZeroZero
+}
+
+// NewDerivedMetricFromViper creates a new DerivedMetric named rule given a *viper.Viper
+func NewDerivedMetricFromViper(rule string, v *viper.Viper) (DerivedMetric, error) {
+	v.SetDefault("inputs", []string{})
+	v.SetDefault("divide-by-zero", DivideByZeroSkip)
+	d := DerivedMetric{
+		Rule:         rule,
+		Name:         v.GetString("name"),
+		Op:           v.GetString("op"),
+		Inputs:       v.GetStringSlice("inputs"),
+		DivideByZero: v.GetString("divide-by-zero"),
+	}
+	if d.Name == "" {
+		return DerivedMetric{}, fmt.Errorf("no name")
+	}
+	switch d.Op {
+	case DerivedSum:
+		if len(d.Inputs) == 0 {
+			return DerivedMetric{}, fmt.Errorf("%s needs at least one input", d.Op)
+		}
+	case DerivedRatio, DerivedDifference:
+		if len(d.Inputs) != 2 {
+			return DerivedMetric{}, fmt.Errorf("%s needs exactly two inputs, got %d", d.Op, len(d.Inputs))
+		}
+	default:
+		return DerivedMetric{}, fmt.Errorf("invalid op %q", d.Op)
+	}
+	for _, input := range d.Inputs {
+		if _, err := path.Match(input, ""); err != nil {
+			return DerivedMetric{}, fmt.Errorf("invalid input glob %q: %v", input, err)
+		}
+	}
+	switch d.DivideByZero {
+	case DivideByZeroSkip, DivideByZeroZero:
+	default:
+		return DerivedMetric{}, fmt.Errorf("invalid divide-by-zero %q", d.DivideByZero)
+	}
+	return d, nil
+}
+
+// String returns a description of the rule, such as "error_rate: api.error_rate = ratio(api.errors, api.requests)".
+func (d *DerivedMetric) String() string {
+	s := fmt.Sprintf("%s: %s = %s(%s)", d.Rule, d.Name, d.Op, strings.Join(d.Inputs, ", "))
+	if d.Op == DerivedRatio {
+		s += ", divide-by-zero " + d.DivideByZero
+	}
+	return s
+}
+
+// compute returns the value of the derived metric given the value of each input, and false if it has no value.
+func (d *DerivedMetric) compute(values []float64) (float64, bool) {
+	switch d.Op {
+	case DerivedRatio:
+		if values[1] == 0 {
+			return 0, d.DivideByZero == DivideByZeroZero
+		}
+		return values[0] / values[1], true
+	case DerivedDifference:
+		return values[0] - values[1], true
+	default:
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum, true
+	}
+}
+
+// DerivedMetrics evaluates derived metric rules against each flush.
+type DerivedMetrics struct {
+	rulesSkipped uint64 // Cumulative number of rules skipped due to a missing input, accessed atomically
+
+	rules []DerivedMetric
+}
+
+// NewDerivedMetrics creates a DerivedMetrics evaluating rules.
+func NewDerivedMetrics(rules []DerivedMetric) *DerivedMetrics {
+	return &DerivedMetrics{
+		rules: rules,
+	}
+}
+
+// NewDerivedMetricsFromViper loads the rules listed by the derived-metrics key, each from a derived-metric.<rule
+// name> block.  Unlike filters, an invalid or missing rule is an error, so a typo doesn't silently stop a metric
+// being produced.
+func NewDerivedMetricsFromViper(v *viper.Viper) (*DerivedMetrics, error) {
+	var rules []DerivedMetric
+	for _, rule := range v.GetStringSlice("derived-metrics") {
+		vRule := v.Sub("derived-metric." + rule)
+		if vRule == nil {
+			return nil, fmt.Errorf("derived metric rule doesn't exist: %v", rule)
+		}
+		d, err := NewDerivedMetricFromViper(rule, vRule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid derived metric rule %v: %v", rule, err)
+		}
+		rules = append(rules, d)
+		logging.Component("config").WithField("rule", rule).Info("Loaded derived metric")
+	}
+	return NewDerivedMetrics(rules), nil
+}
+
+// Len returns the number of rules.
+func (dm *DerivedMetrics) Len() int {
+	return len(dm.rules)
+}
+
+// RulesSkipped returns the cumulative number of times a rule was skipped because an input had no matching metric.
+func (dm *DerivedMetrics) RulesSkipped() uint64 {
+	return atomic.LoadUint64(&dm.rulesSkipped)
+}
+
+// RulesCommand is a console.Handler which lists the rules.
+func (dm *DerivedMetrics) RulesCommand(ctx context.Context, args []string, w io.Writer) error {
+	if len(dm.rules) == 0 {
+		_, err := fmt.Fprintln(w, "No derived metrics")
+		return err
+	}
+	for i := range dm.rules {
+		if _, err := fmt.Fprintln(w, dm.rules[i].String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newFlush returns a derivedFlush which accumulates the inputs of the rules over one flush.
+func (dm *DerivedMetrics) newFlush() *derivedFlush {
+	df := &derivedFlush{
+		dm:     dm,
+		values: make([][]float64, len(dm.rules)),
+		found:  make([][]bool, len(dm.rules)),
+	}
+	for i := range dm.rules {
+		df.values[i] = make([]float64, len(dm.rules[i].Inputs))
+		df.found[i] = make([]bool, len(dm.rules[i].Inputs))
+	}
+	return df
+}
+
+// derivedFlush accumulates the inputs of the rules from the MetricMap of each aggregator, as metrics are spread
+// across them by name.
+type derivedFlush struct {
+	dm *DerivedMetrics
+
+	mu     sync.Mutex
+	values [][]float64 // Sum of the values of each input of each rule
+	found  [][]bool    // Whether each input of each rule matched any metric
+}
+
+// add adds the values of the metrics in m matching each input.  It is safe to call concurrently.
+func (df *derivedFlush) add(m *gostatsd.MetricMap) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	for i := range df.dm.rules {
+		for j, input := range df.dm.rules[i].Inputs {
+			df.addInput(i, j, input, m)
+		}
+	}
+}
+
+func (df *derivedFlush) addInput(rule, input int, glob string, m *gostatsd.MetricMap) {
+	addCounters := func(counters map[string]gostatsd.Counter) {
+		for _, c := range counters {
+			df.values[rule][input] += float64(c.Value)
+			df.found[rule][input] = true
+		}
+	}
+	addGauges := func(gauges map[string]gostatsd.Gauge) {
+		for _, g := range gauges {
+			df.values[rule][input] += g.Value
+			df.found[rule][input] = true
+		}
+	}
+	if !strings.ContainsAny(glob, `*?[\`) {
+		addCounters(m.Counters[glob])
+		addGauges(m.Gauges[glob])
+		return
+	}
+	for name, counters := range m.Counters {
+		if ok, _ := path.Match(glob, name); ok {
+			addCounters(counters)
+		}
+	}
+	for name, gauges := range m.Gauges {
+		if ok, _ := path.Match(glob, name); ok {
+			addGauges(gauges)
+		}
+	}
+}
+
+// metrics returns a MetricMap holding a gauge for each rule which has a value.  A rule with an input which matched
+// no metrics is skipped and counted.
+func (df *derivedFlush) metrics(timestamp gostatsd.Nanotime, hostname string) *gostatsd.MetricMap {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	m := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{},
+		Timers:   gostatsd.Timers{},
+		Gauges:   gostatsd.Gauges{},
+		Sets:     gostatsd.Sets{},
+	}
+rules:
+	for i := range df.dm.rules {
+		for _, found := range df.found[i] {
+			if !found {
+				atomic.AddUint64(&df.dm.rulesSkipped, 1)
+				continue rules
+			}
+		}
+		rule := &df.dm.rules[i]
+		if value, ok := rule.compute(df.values[i]); ok {
+			m.Gauges[rule.Name] = map[string]gostatsd.Gauge{
+				"": gostatsd.NewGauge(timestamp, value, hostname, nil),
+			}
+		}
+	}
+	return m
+}
@@ -0,0 +1,128 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func derivedViper(t *testing.T, config string) *viper.Viper {
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(config)))
+	return v
+}
+
+func TestNewDerivedMetricsFromViper(t *testing.T) {
+	t.Parallel()
+	v := derivedViper(t, `
+derived-metrics='error_rate total'
+
+[derived-metric.error_rate]
+name='api.error_rate'
+op='ratio'
+inputs='api.errors api.requests'
+divide-by-zero='zero'
+
+[derived-metric.total]
+name='api.total'
+op='sum'
+inputs=['api.requests.*']
+`)
+	dm, err := NewDerivedMetricsFromViper(v)
+	require.NoError(t, err)
+	expected := []DerivedMetric{
+		{Rule: "error_rate", Name: "api.error_rate", Op: DerivedRatio, Inputs: []string{"api.errors", "api.requests"}, DivideByZero: DivideByZeroZero},
+		{Rule: "total", Name: "api.total", Op: DerivedSum, Inputs: []string{"api.requests.*"}, DivideByZero: DivideByZeroSkip},
+	}
+	assert.Equal(t, expected, dm.rules)
+
+	var buf bytes.Buffer
+	require.NoError(t, dm.RulesCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "error_rate: api.error_rate = ratio(api.errors, api.requests), divide-by-zero zero\ntotal: api.total = sum(api.requests.*)\n", buf.String())
+}
+
+func TestNewDerivedMetricsFromViperInvalid(t *testing.T) {
+	t.Parallel()
+	tests := map[string]string{
+		"missing":      `derived-metrics='missing'`,
+		"no name":      "derived-metrics='r'\n[derived-metric.r]\nop='sum'\ninputs='a'",
+		"bad op":       "derived-metrics='r'\n[derived-metric.r]\nname='x'\nop='product'\ninputs='a b'",
+		"no inputs":    "derived-metrics='r'\n[derived-metric.r]\nname='x'\nop='sum'",
+		"ratio inputs": "derived-metrics='r'\n[derived-metric.r]\nname='x'\nop='ratio'\ninputs='a b c'",
+		"bad glob":     "derived-metrics='r'\n[derived-metric.r]\nname='x'\nop='sum'\ninputs='a['",
+		"bad policy":   "derived-metrics='r'\n[derived-metric.r]\nname='x'\nop='ratio'\ninputs='a b'\ndivide-by-zero='nan'",
+	}
+	for name, config := range tests {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := NewDerivedMetricsFromViper(derivedViper(t, config))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func derivedTestMap(counters map[string]int64, gauges map[string]float64) *gostatsd.MetricMap {
+	m := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{},
+		Gauges:   gostatsd.Gauges{},
+	}
+	for name, value := range counters {
+		m.Counters[name] = map[string]gostatsd.Counter{
+			"a": {Value: value},
+			"b": {Value: value},
+		}
+	}
+	for name, value := range gauges {
+		m.Gauges[name] = map[string]gostatsd.Gauge{"": {Value: value}}
+	}
+	return m
+}
+
+func TestDerivedMetricsFlush(t *testing.T) {
+	t.Parallel()
+	dm := NewDerivedMetrics([]DerivedMetric{
+		{Rule: "rate", Name: "error_rate", Op: DerivedRatio, Inputs: []string{"errors", "requests.*"}, DivideByZero: DivideByZeroSkip},
+		{Rule: "total", Name: "total", Op: DerivedSum, Inputs: []string{"requests.*", "queue"}},
+		{Rule: "diff", Name: "diff", Op: DerivedDifference, Inputs: []string{"requests.a", "errors"}},
+		{Rule: "missing", Name: "missing", Op: DerivedSum, Inputs: []string{"requests.*", "nothing"}},
+	})
+
+	// Metrics are spread across aggregators, so the inputs are summed across all of them.
+	df := dm.newFlush()
+	df.add(derivedTestMap(map[string]int64{"errors": 1, "requests.a": 3}, nil))
+	df.add(derivedTestMap(map[string]int64{"requests.b": 2}, map[string]float64{"queue": 0.5}))
+	m := df.metrics(10, "host")
+
+	expected := gostatsd.Gauges{
+		"error_rate": {"": {Value: 0.2, Timestamp: 10, Hostname: "host"}},
+		"total":      {"": {Value: 10.5, Timestamp: 10, Hostname: "host"}},
+		"diff":       {"": {Value: 4, Timestamp: 10, Hostname: "host"}},
+	}
+	assert.Equal(t, expected, m.Gauges)
+	assert.EqualValues(t, 1, dm.RulesSkipped())
+}
+
+func TestDerivedMetricsDivideByZero(t *testing.T) {
+	t.Parallel()
+	dm := NewDerivedMetrics([]DerivedMetric{
+		{Rule: "skip", Name: "skip", Op: DerivedRatio, Inputs: []string{"errors", "requests"}, DivideByZero: DivideByZeroSkip},
+		{Rule: "zero", Name: "zero", Op: DerivedRatio, Inputs: []string{"errors", "requests"}, DivideByZero: DivideByZeroZero},
+	})
+	df := dm.newFlush()
+	df.add(derivedTestMap(map[string]int64{"errors": 0, "requests": 0}, nil))
+	m := df.metrics(10, "host")
+
+	expected := gostatsd.Gauges{
+		"zero": {"": {Value: 0, Timestamp: 10, Hostname: "host"}},
+	}
+	assert.Equal(t, expected, m.Gauges)
+	assert.Zero(t, dm.RulesSkipped())
+}
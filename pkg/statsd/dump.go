@@ -0,0 +1,248 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/console"
+)
+
+// dumpDefaultLimit is the number of metrics a dump command lists if no limit is given.
+const dumpDefaultLimit = 1000
+
+// dumpRow is a metric listed by a dump command, with only what is needed to write it.
+type dumpRow struct {
+	metricType gostatsd.MetricType
+	name       string
+	tagsKey    string
+	count      int64     // Counter value or set cardinality
+	value      float64   // Gauge value, or timer sampled count
+	min, max   float64   // Timer minimum and maximum
+	sum        float64   // Timer sum
+	samples    []float64 // Timer samples, copied only if they are listed
+}
+
+// dumpOptions are the arguments of a dump command.
+type dumpOptions struct {
+	offset  int
+	limit   int
+	tags    bool
+	value   bool
+	samples bool
+}
+
+// parseDumpOptions parses [<offset> [<limit>]] and offset=, limit= and fields= arguments, where fields is a comma
+// separated list of tags, value and samples.
+func parseDumpOptions(args []string) (dumpOptions, error) {
+	opts := dumpOptions{
+		limit:   dumpDefaultLimit,
+		tags:    true,
+		value:   true,
+		samples: true,
+	}
+	positional := 0
+	for _, arg := range args {
+		key, value := "", arg
+		if i := strings.IndexByte(arg, '='); i >= 0 {
+			key, value = arg[:i], arg[i+1:]
+		} else {
+			switch positional {
+			case 0:
+				key = "offset"
+			case 1:
+				key = "limit"
+			default:
+				return opts, fmt.Errorf("unexpected argument %q", arg)
+			}
+			positional++
+		}
+		switch key {
+		case "offset", "limit":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || (key == "limit" && n == 0) {
+				return opts, fmt.Errorf("invalid %s %q", key, value)
+			}
+			if key == "offset" {
+				opts.offset = n
+			} else {
+				opts.limit = n
+			}
+		case "fields":
+			opts.tags, opts.value, opts.samples = false, false, false
+			for _, field := range strings.Split(value, ",") {
+				switch field {
+				case "tags":
+					opts.tags = true
+				case "value":
+					opts.value = true
+				case "samples":
+					opts.samples = true
+				default:
+					return opts, fmt.Errorf("unknown field %q, expected tags, value or samples", field)
+				}
+			}
+		default:
+			return opts, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return opts, nil
+}
+
+// DumpCommand returns the console command name, which lists the metrics of the given types received so far this
+// interval, a page at a time.  Metrics are listed in order of type, name and tags, so pages of the same snapshot are
+// stable, and each line is written as it is formatted rather than building the whole output.
+func DumpCommand(processer AggregateProcesser, name string, types ...gostatsd.MetricType) console.Handler {
+	return func(ctx context.Context, args []string, w io.Writer) error {
+		opts, err := parseDumpOptions(args)
+		if err != nil {
+			return fmt.Errorf("%v, usage: %s [<offset> [<limit>]] [fields=tags,value,samples]", err, name)
+		}
+
+		var mu sync.Mutex
+		var rows []dumpRow
+		wait := processer.Process(ctx, func(aggrID int, aggr Aggregator) {
+			aggr.Process(func(m *gostatsd.MetricMap) {
+				r := dumpRows(m, types, opts.samples)
+				mu.Lock()
+				rows = append(rows, r...)
+				mu.Unlock()
+			})
+		})
+		wait()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		sort.Slice(rows, func(i, j int) bool {
+			a, b := &rows[i], &rows[j]
+			if a.metricType != b.metricType {
+				return a.metricType < b.metricType
+			}
+			if a.name != b.name {
+				return a.name < b.name
+			}
+			return a.tagsKey < b.tagsKey
+		})
+		page := rows
+		if opts.offset < len(page) {
+			page = page[opts.offset:]
+		} else {
+			page = nil
+		}
+		if len(page) > opts.limit {
+			page = page[:opts.limit]
+		}
+
+		bw := bufio.NewWriter(w)
+		var line []byte
+		for i := range page {
+			line = appendDumpRow(line[:0], &page[i], opts)
+			if _, err := bw.Write(line); err != nil {
+				return err
+			}
+		}
+		if next := opts.offset + len(page); next < len(rows) {
+			_, err = fmt.Fprintf(bw, "# %d more of %d, next page: offset=%d limit=%d\n", len(rows)-next, len(rows), next, opts.limit)
+		} else {
+			_, err = fmt.Fprintf(bw, "# %d metrics\n", len(rows))
+		}
+		if err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+}
+
+// dumpRows returns a row for each metric in m of one of types.
+func dumpRows(m *gostatsd.MetricMap, types []gostatsd.MetricType, samples bool) []dumpRow {
+	var rows []dumpRow
+	for _, t := range types {
+		switch t {
+		case gostatsd.COUNTER:
+			m.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+				rows = append(rows, dumpRow{metricType: t, name: name, tagsKey: tagsKey, count: c.Value})
+			})
+		case gostatsd.GAUGE:
+			m.Gauges.Each(func(name, tagsKey string, g gostatsd.Gauge) {
+				rows = append(rows, dumpRow{metricType: t, name: name, tagsKey: tagsKey, value: g.Value})
+			})
+		case gostatsd.TIMER:
+			m.Timers.Each(func(name, tagsKey string, timer gostatsd.Timer) {
+				row := dumpRow{metricType: t, name: name, tagsKey: tagsKey, value: timer.SampledCount}
+				if h := timer.Histogram; h != nil && h.Count > 0 {
+					row.min, row.max, row.sum = h.Min, h.Max, h.Sum
+				}
+				if h := timer.HDR; h != nil && h.Count > 0 {
+					row.min, row.max, row.sum = h.Min, h.Max, h.Sum
+				}
+				for i, v := range timer.Values {
+					if i == 0 || v < row.min {
+						row.min = v
+					}
+					if i == 0 || v > row.max {
+						row.max = v
+					}
+					row.sum += v
+				}
+				if samples {
+					// The aggregator reuses the samples after it is reset, so they are copied.
+					row.samples = append([]float64(nil), timer.Values...)
+				}
+				rows = append(rows, row)
+			})
+		case gostatsd.SET:
+			m.Sets.Each(func(name, tagsKey string, s gostatsd.Set) {
+				rows = append(rows, dumpRow{metricType: t, name: name, tagsKey: tagsKey, count: int64(s.Cardinality())})
+			})
+		}
+	}
+	return rows
+}
+
+// appendDumpRow appends row to buf as a line of the type, name and the fields in opts.
+func appendDumpRow(buf []byte, row *dumpRow, opts dumpOptions) []byte {
+	buf = append(buf, row.metricType.String()...)
+	buf = append(buf, ' ')
+	buf = append(buf, row.name...)
+	if opts.tags {
+		buf = append(buf, " ["...)
+		buf = append(buf, row.tagsKey...)
+		buf = append(buf, ']')
+	}
+	if opts.value {
+		switch row.metricType {
+		case gostatsd.COUNTER, gostatsd.SET:
+			buf = append(buf, ' ')
+			buf = strconv.AppendInt(buf, row.count, 10)
+		case gostatsd.GAUGE:
+			buf = append(buf, ' ')
+			buf = strconv.AppendFloat(buf, row.value, 'f', -1, 64)
+		case gostatsd.TIMER:
+			buf = append(buf, " count="...)
+			buf = strconv.AppendFloat(buf, row.value, 'f', -1, 64)
+			buf = append(buf, " min="...)
+			buf = strconv.AppendFloat(buf, row.min, 'f', -1, 64)
+			buf = append(buf, " max="...)
+			buf = strconv.AppendFloat(buf, row.max, 'f', -1, 64)
+			buf = append(buf, " sum="...)
+			buf = strconv.AppendFloat(buf, row.sum, 'f', -1, 64)
+		}
+	}
+	if opts.samples && row.metricType == gostatsd.TIMER {
+		buf = append(buf, " samples="...)
+		for i, v := range row.samples {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = strconv.AppendFloat(buf, v, 'f', -1, 64)
+		}
+	}
+	return append(buf, '\n')
+}
@@ -0,0 +1,104 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDumpOptions(t *testing.T) {
+	t.Parallel()
+	opts, err := parseDumpOptions(nil)
+	require.NoError(t, err)
+	assert.Equal(t, dumpOptions{limit: dumpDefaultLimit, tags: true, value: true, samples: true}, opts)
+
+	opts, err = parseDumpOptions([]string{"20", "10", "fields=value"})
+	require.NoError(t, err)
+	assert.Equal(t, dumpOptions{offset: 20, limit: 10, value: true}, opts)
+
+	opts, err = parseDumpOptions([]string{"fields=tags,value", "limit=5", "offset=3"})
+	require.NoError(t, err)
+	assert.Equal(t, dumpOptions{offset: 3, limit: 5, tags: true, value: true}, opts)
+
+	for _, args := range [][]string{{"-1"}, {"0", "0"}, {"x"}, {"1", "2", "3"}, {"fields=name"}, {"sort=name"}} {
+		_, err := parseDumpOptions(args)
+		assert.Error(t, err, "%v", args)
+	}
+}
+
+func TestDumpCommand(t *testing.T) {
+	t.Parallel()
+	agg := newFakeAggregator()
+	now := time.Now()
+	receive := func(m gostatsd.Metric) {
+		m.Rate = 1
+		m.TagsKey = formatTagsKey(m.Tags, m.Hostname)
+		agg.Receive(&m, now)
+	}
+	receive(gostatsd.Metric{Name: "requests", Value: 3, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"env:prod"}})
+	receive(gostatsd.Metric{Name: "errors", Value: 1, Type: gostatsd.COUNTER})
+	receive(gostatsd.Metric{Name: "latency", Value: 20, Type: gostatsd.TIMER})
+	receive(gostatsd.Metric{Name: "latency", Value: 5, Type: gostatsd.TIMER})
+	receive(gostatsd.Metric{Name: "queue", Value: 1.5, Type: gostatsd.GAUGE, Hostname: "h1"})
+	receive(gostatsd.Metric{Name: "users", StringValue: "joe", Type: gostatsd.SET})
+	sa := &singleAggregator{agg: agg}
+
+	var out bytes.Buffer
+	metrics := DumpCommand(sa, "metrics", gostatsd.COUNTER, gostatsd.TIMER, gostatsd.GAUGE, gostatsd.SET)
+	require.NoError(t, metrics(context.Background(), nil, &out))
+	assert.Equal(t, `counter errors [] 1
+counter requests [env:prod] 3
+timer latency [] count=2 min=5 max=20 sum=25 samples=20,5
+gauge queue [,s:h1] 1.5
+set users [] 1
+# 5 metrics
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, metrics(context.Background(), []string{"1", "2", "fields=value"}, &out))
+	assert.Equal(t, `counter requests 3
+timer latency count=2 min=5 max=20 sum=25
+# 2 more of 5, next page: offset=3 limit=2
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, metrics(context.Background(), []string{"offset=10"}, &out))
+	assert.Equal(t, "# 5 metrics\n", out.String())
+
+	out.Reset()
+	counters := DumpCommand(sa, "counters", gostatsd.COUNTER)
+	require.NoError(t, counters(context.Background(), []string{"0", "1", "fields=tags"}, &out))
+	assert.Equal(t, "counter errors []\n# 1 more of 2, next page: offset=1 limit=1\n", out.String())
+
+	assert.EqualError(t, counters(context.Background(), []string{"x"}, &out), `invalid offset "x", usage: counters [<offset> [<limit>]] [fields=tags,value,samples]`)
+}
+
+func TestDumpCommandPagesAreStable(t *testing.T) {
+	t.Parallel()
+	agg := newFakeAggregator()
+	now := time.Now()
+	for i := 0; i < 250; i++ {
+		agg.Receive(&gostatsd.Metric{Name: fmt.Sprintf("c%03d", (i*7)%250), Value: 1, Type: gostatsd.COUNTER, Rate: 1}, now)
+	}
+	counters := DumpCommand(&singleAggregator{agg: agg}, "counters", gostatsd.COUNTER)
+
+	var all bytes.Buffer
+	for offset := 0; offset < 250; offset += 100 {
+		var out bytes.Buffer
+		require.NoError(t, counters(context.Background(), []string{fmt.Sprint(offset), "100", "fields=value"}, &out))
+		lines := bytes.SplitAfter(out.Bytes(), []byte("\n"))
+		all.Write(bytes.Join(lines[:len(lines)-2], nil)) // Without the continuation line
+	}
+	var expected bytes.Buffer
+	for i := 0; i < 250; i++ {
+		fmt.Fprintf(&expected, "counter c%03d 1\n", i)
+	}
+	assert.Equal(t, expected.String(), all.String())
+}
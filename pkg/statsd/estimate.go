@@ -0,0 +1,102 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// timerEstimate is the estimated percentile of the samples received by a timer so far in an interval.
+type timerEstimate struct {
+	tagsKey string
+	samples int
+	value   float64
+}
+
+// percentileEstimator is implemented by aggregators which can estimate a percentile of a timer before it is flushed.
+type percentileEstimator interface {
+	estimatePercentile(name string, pct float64) []timerEstimate
+}
+
+// estimatePercentile returns the percentile pct of the samples received so far this interval by each timer named
+// name, as the next Flush would compute it.  The samples are not changed, and timers with no samples are skipped.
+// The percentile of a timer folded in to a histogram, exponential or HDR, is estimated from the histogram.
+func (a *MetricAggregator) estimatePercentile(name string, pct float64) []timerEstimate {
+	var estimates []timerEstimate
+	for tagsKey, timer := range a.Timers[name] {
+		if h := timer.Histogram; h != nil {
+			if value, ok := a.HistogramPercentileValue(h, pct); ok {
+				estimates = append(estimates, timerEstimate{tagsKey: tagsKey, samples: int(h.Count), value: value})
+			}
+			continue
+		}
+		if h := timer.HDR; h != nil {
+			if value, ok := a.HDRPercentileValue(h, pct); ok {
+				estimates = append(estimates, timerEstimate{tagsKey: tagsKey, samples: int(h.Count), value: value})
+			}
+			continue
+		}
+		if len(timer.Values) == 0 {
+			continue
+		}
+		values := append([]float64(nil), timer.Values...)
+		sort.Float64s(values)
+		if value, ok := a.PercentileValue(values, pct); ok {
+			estimates = append(estimates, timerEstimate{tagsKey: tagsKey, samples: len(values), value: value})
+		}
+	}
+	return estimates
+}
+
+// EstimateCommand returns the console command which estimates a percentile of a timer from the samples each
+// aggregator has received so far this interval.
+func EstimateCommand(processer AggregateProcesser) func(ctx context.Context, args []string, w io.Writer) error {
+	return func(ctx context.Context, args []string, w io.Writer) error {
+		if len(args) != 2 {
+			return errors.New("usage: estimate <timer> <percentile>")
+		}
+		name := args[0]
+		thresholds, err := ParsePercentThresholds(args[1:])
+		if err != nil {
+			return err
+		}
+		pct := thresholds[0]
+		if pct == 0 {
+			return errors.New("percentile must not be 0")
+		}
+
+		var mu sync.Mutex
+		var estimates []timerEstimate
+		wait := processer.Process(ctx, func(aggrID int, aggr Aggregator) {
+			if pe, ok := aggr.(percentileEstimator); ok {
+				e := pe.estimatePercentile(name, pct)
+				mu.Lock()
+				estimates = append(estimates, e...)
+				mu.Unlock()
+			}
+		})
+		wait()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if len(estimates) == 0 {
+			_, err = fmt.Fprintf(w, "No samples for %s this interval\n", name)
+			return err
+		}
+		sort.Slice(estimates, func(i, j int) bool {
+			return estimates[i].tagsKey < estimates[j].tagsKey
+		})
+		label := "p" + strconv.FormatFloat(pct, 'f', -1, 64)
+		for _, e := range estimates {
+			if _, err := fmt.Fprintf(w, "%s [%s] samples:%d %s:%s\n", name, e.tagsKey, e.samples, label, strconv.FormatFloat(e.value, 'f', -1, 64)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,84 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flushedPercentile returns the value of the percentile named pctName which Flush computed for a timer.
+func flushedPercentile(t *testing.T, timer gostatsd.Timer, pctName string) float64 {
+	for _, p := range timer.Percentiles {
+		if p.Str == pctName {
+			return p.Float
+		}
+	}
+	require.Failf(t, "percentile not found", "%s not in %v", pctName, timer.Percentiles)
+	return 0
+}
+
+func TestEstimateMatchesFlush(t *testing.T) {
+	t.Parallel()
+	for _, interpolation := range []string{PercentileNearestRank, PercentileLinear} {
+		interpolation := interpolation
+		t.Run(interpolation, func(t *testing.T) {
+			t.Parallel()
+			agg := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90, -10}, ExpiryInterval: 5 * time.Minute, LinearPercentiles: interpolation == PercentileLinear}, nil, nil, nil)
+			received := []float64{7, 3, 19, 1, 12, 5, 16, 2, 9, 14, 11, 4}
+			for _, v := range received {
+				agg.Receive(&gostatsd.Metric{Name: "t", Value: v, Type: gostatsd.TIMER, Rate: 1, TagsKey: "a:1", Tags: gostatsd.Tags{"a:1"}}, time.Now())
+			}
+			agg.Receive(&gostatsd.Metric{Name: "t", Value: 42, Type: gostatsd.TIMER, Rate: 1, TagsKey: "a:2", Tags: gostatsd.Tags{"a:2"}}, time.Now())
+
+			estimate := EstimateCommand(&singleAggregator{agg: agg})
+			var upper, lower bytes.Buffer
+			require.NoError(t, estimate(context.Background(), []string{"t", "90"}, &upper))
+			require.NoError(t, estimate(context.Background(), []string{"t", "-10"}, &lower))
+			// The samples are left as they were received.
+			assert.Equal(t, received, agg.Timers["t"]["a:1"].Values)
+
+			agg.Flush(time.Second)
+			flushed := agg.Timers["t"]["a:1"]
+			assert.Equal(t, fmt.Sprintf("t [a:1] samples:12 p90:%v\nt [a:2] samples:1 p90:42\n", flushedPercentile(t, flushed, "upper_90")), upper.String())
+			assert.Equal(t, fmt.Sprintf("t [a:1] samples:12 p-10:%v\nt [a:2] samples:1 p-10:42\n", flushedPercentile(t, flushed, "lower_-10")), lower.String())
+		})
+	}
+}
+
+func TestEstimateHistogramMatchesFlush(t *testing.T) {
+	t.Parallel()
+	agg := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+	agg.TimerHistograms = true
+	agg.HistogramScale = 4
+	agg.HistogramMaxBuckets = 20
+	for _, v := range []float64{7, 3, 19, 1, 12, 5, 16, 2, 9, 14, 11, 4} {
+		agg.Receive(&gostatsd.Metric{Name: "t", Value: v, Type: gostatsd.TIMER, Rate: 1}, time.Now())
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, EstimateCommand(&singleAggregator{agg: agg})(context.Background(), []string{"t", "90"}, &buf))
+	agg.Flush(time.Second)
+	assert.Equal(t, fmt.Sprintf("t [] samples:12 p90:%v\n", flushedPercentile(t, agg.Timers["t"][""], "upper_90")), buf.String())
+}
+
+func TestEstimateCommand(t *testing.T) {
+	t.Parallel()
+	agg := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+	estimate := EstimateCommand(&singleAggregator{agg: agg})
+
+	var buf bytes.Buffer
+	require.NoError(t, estimate(context.Background(), []string{"t", "99"}, &buf))
+	assert.Equal(t, "No samples for t this interval\n", buf.String())
+
+	for _, args := range [][]string{{"t"}, {"t", "x"}, {"t", "101"}, {"t", "0"}} {
+		assert.Error(t, estimate(context.Background(), args, &buf), "%v", args)
+	}
+}
@@ -0,0 +1,128 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// FloatSliceValue is a pflag.Value holding a list of numbers, validated as the flag is parsed so a bad value fails
+// before anything starts.  Each use of the flag takes a comma or space separated list, and repeating the flag adds to
+// the list, so --percent-threshold=90,99 and --percent-threshold=90 --percent-threshold=99 are the same.  The first
+// use replaces the default.
+type FloatSliceValue struct {
+	name     string
+	values   []float64
+	validate func(float64) error
+	changed  bool
+}
+
+// NewFloatSliceValue creates a FloatSliceValue for the flag name, holding defaults until the flag is used, and
+// checking each value with validate.
+func NewFloatSliceValue(name string, defaults []float64, validate func(float64) error) *FloatSliceValue {
+	return &FloatSliceValue{
+		name:     name,
+		values:   append([]float64(nil), defaults...),
+		validate: validate,
+	}
+}
+
+// Set parses a comma or space separated list of numbers, and adds them to the list.
+func (fv *FloatSliceValue) Set(s string) error {
+	values, err := parseFloatList(fv.name, strings.FieldsFunc(s, isListSeparator), fv.validate)
+	if err != nil {
+		return err
+	}
+	if !fv.changed {
+		fv.values = nil
+		fv.changed = true
+	}
+	fv.values = append(fv.values, values...)
+	return nil
+}
+
+// String returns the list separated by commas, which Set parses back to the same list.
+func (fv *FloatSliceValue) String() string {
+	s := make([]string, len(fv.values))
+	for i, f := range fv.values {
+		s[i] = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
+
+// Type returns the name of the type shown in the flag usage.
+func (fv *FloatSliceValue) Type() string {
+	return "floats"
+}
+
+// Values returns the list.
+func (fv *FloatSliceValue) Values() []float64 {
+	return fv.values
+}
+
+func isListSeparator(r rune) bool {
+	return r == ',' || r == ' ' || r == '\t' || r == '\n'
+}
+
+// GetFloatSlice returns the list of numbers at key, checking each with validate.  It takes the same forms however
+// the value was set: a list from a config file, of numbers or strings, or a comma or space separated string from a
+// flag or environment variable.  The error names the key and the offending value.
+func GetFloatSlice(v *viper.Viper, key string, validate func(float64) error) ([]float64, error) {
+	switch value := v.Get(key).(type) {
+	case nil:
+		return nil, nil
+	case []float64:
+		return parseFloatList(key, toStringSlice(value), validate)
+	case []interface{}:
+		fields := make([]string, len(value))
+		for i, item := range value {
+			fields[i] = fmt.Sprint(item)
+		}
+		return parseFloatList(key, fields, validate)
+	case []string:
+		var fields []string
+		for _, item := range value {
+			fields = append(fields, strings.FieldsFunc(item, isListSeparator)...)
+		}
+		return parseFloatList(key, fields, validate)
+	default:
+		return parseFloatList(key, strings.FieldsFunc(fmt.Sprint(value), isListSeparator), validate)
+	}
+}
+
+// parseFloatList parses each field as a number and checks it with validate, which may be nil.
+func parseFloatList(name string, fields []string, validate func(float64) error) ([]float64, error) {
+	values := make([]float64, 0, len(fields))
+	for _, field := range fields {
+		f, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %q: not a number", name, field)
+		}
+		if validate != nil {
+			if err := validate(f); err != nil {
+				return nil, fmt.Errorf("invalid %s value %q: %v", name, field, err)
+			}
+		}
+		values = append(values, f)
+	}
+	return values, nil
+}
+
+// ValidatePercentThreshold checks a percentile is between -100 and 100.
+func ValidatePercentThreshold(f float64) error {
+	if math.IsNaN(f) || f < -100 || f > 100 {
+		return fmt.Errorf("percentile should be between -100 and 100")
+	}
+	return nil
+}
+
+// ValidateTimerUnderThreshold checks a timer threshold is a finite number.
+func ValidateTimerUnderThreshold(f float64) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("timer threshold should be a finite number")
+	}
+	return nil
+}
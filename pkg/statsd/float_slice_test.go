@@ -0,0 +1,81 @@
+package statsd
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFlagViper(t *testing.T, args ...string) (*viper.Viper, error) {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	AddFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	v := viper.New()
+	require.NoError(t, v.BindPFlags(fs))
+	return v, nil
+}
+
+func TestFloatSliceFlag(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		args     []string
+		expected []float64
+	}{
+		"default":       {nil, DefaultPercentThreshold},
+		"comma list":    {[]string{"--percent-threshold=90,99"}, []float64{90, 99}},
+		"space list":    {[]string{"--percent-threshold", "90 99"}, []float64{90, 99}},
+		"repeated":      {[]string{"--percent-threshold", "90", "--percent-threshold", "99"}, []float64{90, 99}},
+		"repeated list": {[]string{"--percent-threshold=50,90", "--percent-threshold=-10"}, []float64{50, 90, -10}},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			v, err := newFlagViper(t, test.args...)
+			require.NoError(t, err)
+			pt, err := GetFloatSlice(v, ParamPercentThreshold, ValidatePercentThreshold)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, pt)
+		})
+	}
+}
+
+func TestFloatSliceFlagInvalid(t *testing.T) {
+	t.Parallel()
+	_, err := newFlagViper(t, "--percent-threshold=90,101")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid percent-threshold value "101"`)
+
+	_, err = newFlagViper(t, "--timer-under-thresholds=200,fast")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid timer-under-thresholds value "fast": not a number`)
+}
+
+func TestGetFloatSliceFromConfig(t *testing.T) {
+	t.Parallel()
+	for _, config := range []string{
+		`percent-threshold=[90, 99.5]`,
+		`percent-threshold=["90", "99.5"]`,
+		`percent-threshold="90,99.5"`,
+		`percent-threshold="90 99.5"`,
+	} {
+		pt, err := GetFloatSlice(derivedViper(t, config), ParamPercentThreshold, ValidatePercentThreshold)
+		require.NoError(t, err, config)
+		assert.Equal(t, []float64{90, 99.5}, pt, config)
+	}
+
+	pt, err := GetFloatSlice(viper.New(), ParamTimerUnderThresholds, ValidateTimerUnderThreshold)
+	require.NoError(t, err)
+	assert.Empty(t, pt)
+
+	_, err = GetFloatSlice(derivedViper(t, `percent-threshold=[90, 200]`), ParamPercentThreshold, ValidatePercentThreshold)
+	require.Error(t, err)
+	assert.Equal(t, `invalid percent-threshold value "200": percentile should be between -100 and 100`, err.Error())
+}
@@ -0,0 +1,349 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// historyKey identifies a bucket in a historyInterval.
+type historyKey struct {
+	metricType gostatsd.MetricType
+	name       string
+	tagsKey    string
+}
+
+// historyInterval is the lightweight snapshot of a flush kept by FlushHistory, with a single number per bucket: the
+// value of a counter or gauge, the sampled count of a timer, or the cardinality of a set.
+type historyInterval struct {
+	sequence uint64
+	values   map[historyKey]float64
+}
+
+// FlushHistory keeps a lightweight snapshot of each of the most recent flushes, keyed by the sequence number of the
+// flush, so two intervals can be compared with the diff command.  Late metrics are not included, as they belong to
+// an earlier interval.  A nil *FlushHistory keeps nothing.
+type FlushHistory struct {
+	size int
+
+	mu        sync.Mutex
+	pending   *historyInterval   // The flush being collected
+	intervals []*historyInterval // Oldest first
+}
+
+// NewFlushHistory creates a FlushHistory keeping the last size flushes.
+func NewFlushHistory(size int) *FlushHistory {
+	return &FlushHistory{
+		size: size,
+	}
+}
+
+// begin starts collecting the flush with the sequence number.
+func (fh *FlushHistory) begin(sequence uint64) {
+	if fh == nil {
+		return
+	}
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	fh.pending = &historyInterval{
+		sequence: sequence,
+		values:   map[historyKey]float64{},
+	}
+}
+
+// add records the metrics in m in the flush being collected.  It is safe to call concurrently.
+func (fh *FlushHistory) add(m *gostatsd.MetricMap) {
+	if fh == nil {
+		return
+	}
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if fh.pending == nil {
+		return
+	}
+	values := fh.pending.values
+	m.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+		values[historyKey{gostatsd.COUNTER, name, tagsKey}] += float64(c.Value)
+	})
+	m.Timers.Each(func(name, tagsKey string, t gostatsd.Timer) {
+		values[historyKey{gostatsd.TIMER, name, tagsKey}] += t.SampledCount
+	})
+	m.Gauges.Each(func(name, tagsKey string, g gostatsd.Gauge) {
+		values[historyKey{gostatsd.GAUGE, name, tagsKey}] = g.Value
+	})
+	m.Sets.Each(func(name, tagsKey string, s gostatsd.Set) {
+		values[historyKey{gostatsd.SET, name, tagsKey}] = float64(s.Cardinality())
+	})
+}
+
+// publish adds the collected flush to the history, dropping the oldest flush if it is full.
+func (fh *FlushHistory) publish() {
+	if fh == nil {
+		return
+	}
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if fh.pending == nil {
+		return
+	}
+	if len(fh.intervals) >= fh.size {
+		fh.intervals[0] = nil
+		fh.intervals = fh.intervals[1:]
+	}
+	fh.intervals = append(fh.intervals, fh.pending)
+	fh.pending = nil
+}
+
+// interval returns the flush with the sequence number, and the range of sequence numbers kept if it is not kept.
+func (fh *FlushHistory) interval(sequence uint64) (*historyInterval, error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	for _, hi := range fh.intervals {
+		if hi.sequence == sequence {
+			return hi, nil
+		}
+	}
+	if len(fh.intervals) == 0 {
+		return nil, fmt.Errorf("flush %d is not kept, no flushes kept yet", sequence)
+	}
+	return nil, fmt.Errorf("flush %d is not kept, flushes %d to %d are kept", sequence, fh.intervals[0].sequence, fh.intervals[len(fh.intervals)-1].sequence)
+}
+
+// latest returns the sequence numbers of the two most recent flushes.
+func (fh *FlushHistory) latest() (uint64, uint64, error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if len(fh.intervals) < 2 {
+		return 0, 0, fmt.Errorf("%d flushes kept, at least 2 are needed to compare", len(fh.intervals))
+	}
+	return fh.intervals[len(fh.intervals)-2].sequence, fh.intervals[len(fh.intervals)-1].sequence, nil
+}
+
+// diffOptions are the arguments of the diff command.
+type diffOptions struct {
+	from, to  uint64
+	glob      string
+	threshold float64
+	limit     int
+	latest    bool // Compare the two most recent flushes, as no sequence numbers were given
+}
+
+// parseDiffOptions parses [<from> <to> [<glob>]] and from=, to=, glob=, threshold= and limit= arguments.
+func parseDiffOptions(args []string) (diffOptions, error) {
+	opts := diffOptions{
+		glob:  "*",
+		limit: dumpDefaultLimit,
+	}
+	var haveFrom, haveTo bool
+	positional := 0
+	for _, arg := range args {
+		key, value := "", arg
+		if i := strings.IndexByte(arg, '='); i >= 0 {
+			key, value = arg[:i], arg[i+1:]
+		} else {
+			switch positional {
+			case 0:
+				key = "from"
+			case 1:
+				key = "to"
+			case 2:
+				key = "glob"
+			default:
+				return opts, fmt.Errorf("unexpected argument %q", arg)
+			}
+			positional++
+		}
+		switch key {
+		case "from", "to":
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s %q", key, value)
+			}
+			if key == "from" {
+				opts.from, haveFrom = n, true
+			} else {
+				opts.to, haveTo = n, true
+			}
+		case "glob":
+			if _, err := path.Match(value, ""); err != nil {
+				return opts, fmt.Errorf("invalid glob %q: %v", value, err)
+			}
+			opts.glob = value
+		case "threshold":
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f < 0 || math.IsNaN(f) {
+				return opts, fmt.Errorf("invalid threshold %q", value)
+			}
+			opts.threshold = f
+		case "limit":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return opts, fmt.Errorf("invalid limit %q", value)
+			}
+			opts.limit = n
+		default:
+			return opts, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	if haveFrom != haveTo {
+		return opts, fmt.Errorf("both from and to are required")
+	}
+	opts.latest = !haveFrom
+	return opts, nil
+}
+
+// Kinds of difference of a bucket between two flushes.
+const (
+	diffAppeared    = "appeared"
+	diffDisappeared = "disappeared"
+	diffChanged     = "changed"
+)
+
+// diffRow is a bucket which differs between two flushes.
+type diffRow struct {
+	historyKey
+	kind     string
+	from, to float64
+}
+
+func (r *diffRow) change() float64 {
+	return math.Abs(r.to - r.from)
+}
+
+// diffSummary summarises the differences of the buckets of a type.
+type diffSummary struct {
+	from, to                       int     // Buckets in each flush
+	appeared, disappeared, changed int     // Buckets which differ
+	fromTotal, toTotal             float64 // Total of the values in each flush
+}
+
+// diff returns the buckets matching the options which appeared or disappeared between the flushes, or changed by more
+// than the threshold, sorted by the absolute change, largest first, and a summary for each type.
+func diff(from, to *historyInterval, opts diffOptions) ([]diffRow, [gostatsd.SET + 1]diffSummary) {
+	var rows []diffRow
+	var summaries [gostatsd.SET + 1]diffSummary
+	matches := func(key historyKey) bool {
+		ok, _ := path.Match(opts.glob, key.name)
+		return ok
+	}
+	for key, value := range from.values {
+		if !matches(key) {
+			continue
+		}
+		s := &summaries[key.metricType]
+		s.from++
+		s.fromTotal += value
+		if _, ok := to.values[key]; !ok {
+			s.disappeared++
+			rows = append(rows, diffRow{historyKey: key, kind: diffDisappeared, from: value})
+		}
+	}
+	for key, value := range to.values {
+		if !matches(key) {
+			continue
+		}
+		s := &summaries[key.metricType]
+		s.to++
+		s.toTotal += value
+		fromValue, ok := from.values[key]
+		if !ok {
+			s.appeared++
+			rows = append(rows, diffRow{historyKey: key, kind: diffAppeared, to: value})
+		} else if math.Abs(value-fromValue) > opts.threshold {
+			s.changed++
+			rows = append(rows, diffRow{historyKey: key, kind: diffChanged, from: fromValue, to: value})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := &rows[i], &rows[j]
+		if ca, cb := a.change(), b.change(); ca != cb {
+			return ca > cb
+		}
+		if a.metricType != b.metricType {
+			return a.metricType < b.metricType
+		}
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return a.tagsKey < b.tagsKey
+	})
+	return rows, summaries
+}
+
+// DiffCommand is the console command to compare two kept flushes, taking the arguments [<from> <to> [<glob>]]
+// [threshold=<n>] [limit=<n>], and comparing the two most recent flushes if no sequence numbers are given.  It lists the buckets which appeared, disappeared, or changed by more than the
+// threshold, largest change first, after a summary of each type.
+func (fh *FlushHistory) DiffCommand(ctx context.Context, args []string, w io.Writer) error {
+	if fh == nil {
+		return fmt.Errorf("no flushes kept, see --%s", ParamFlushHistory)
+	}
+	opts, err := parseDiffOptions(args)
+	if err != nil {
+		return fmt.Errorf("%v, usage: diff [<from> <to> [<glob>]] [threshold=<n>] [limit=<n>]", err)
+	}
+	if opts.latest {
+		if opts.from, opts.to, err = fh.latest(); err != nil {
+			return err
+		}
+	}
+	from, err := fh.interval(opts.from)
+	if err != nil {
+		return err
+	}
+	to, err := fh.interval(opts.to)
+	if err != nil {
+		return err
+	}
+	// The kept flushes are never modified once published, so they are compared without the lock.
+	rows, summaries := diff(from, to, opts)
+
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(bw, "# flush %d to %d, buckets matching %s\n", opts.from, opts.to, opts.glob); err != nil {
+		return err
+	}
+	for _, t := range []gostatsd.MetricType{gostatsd.COUNTER, gostatsd.TIMER, gostatsd.GAUGE, gostatsd.SET} {
+		s := &summaries[t]
+		if _, err := fmt.Fprintf(bw, "# %s: %d to %d buckets, %d appeared, %d disappeared, %d changed, total %s to %s (%s)\n",
+			t, s.from, s.to, s.appeared, s.disappeared, s.changed,
+			formatDiffValue(s.fromTotal), formatDiffValue(s.toTotal), formatDiffChange(s.toTotal-s.fromTotal)); err != nil {
+			return err
+		}
+	}
+	page := rows
+	if len(page) > opts.limit {
+		page = page[:opts.limit]
+	}
+	for i := range page {
+		r := &page[i]
+		if _, err := fmt.Fprintf(bw, "%s %s %s [%s] %s -> %s (%s)\n", r.kind, r.metricType, r.name, r.tagsKey,
+			formatDiffValue(r.from), formatDiffValue(r.to), formatDiffChange(r.to-r.from)); err != nil {
+			return err
+		}
+	}
+	if len(rows) > len(page) {
+		if _, err := fmt.Fprintf(bw, "# %d more of %d, see limit=\n", len(rows)-len(page), len(rows)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func formatDiffValue(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatDiffChange(f float64) string {
+	if f >= 0 {
+		return "+" + formatDiffValue(f)
+	}
+	return formatDiffValue(f)
+}
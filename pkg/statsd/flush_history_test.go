@@ -0,0 +1,115 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func addHistoryFlush(fh *FlushHistory, sequence uint64, m *gostatsd.MetricMap) {
+	fh.begin(sequence)
+	fh.add(m)
+	fh.publish()
+}
+
+func TestFlushHistoryDiff(t *testing.T) {
+	t.Parallel()
+	fh := NewFlushHistory(3)
+	addHistoryFlush(fh, 1, &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{
+			"requests": {"env:prod": gostatsd.NewCounter(0, 10, "", gostatsd.Tags{"env:prod"})},
+			"errors":   {"": gostatsd.NewCounter(0, 2, "", nil)},
+		},
+		Timers: gostatsd.Timers{
+			"latency": {"": gostatsd.NewTimer(0, []float64{1, 2}, "", nil)},
+		},
+		Gauges: gostatsd.Gauges{
+			"queue": {"": gostatsd.NewGauge(0, 5, "", nil)},
+		},
+	})
+	addHistoryFlush(fh, 2, &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{
+			"requests": {"env:prod": gostatsd.NewCounter(0, 25, "", gostatsd.Tags{"env:prod"})},
+		},
+		Timers: gostatsd.Timers{
+			"latency":  {"": gostatsd.NewTimer(0, []float64{1, 2}, "", nil)},
+			"db.query": {"": gostatsd.NewTimer(0, []float64{1, 2, 3}, "", nil)},
+		},
+		Gauges: gostatsd.Gauges{
+			"queue": {"": gostatsd.NewGauge(0, 5.5, "", nil)},
+		},
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, fh.DiffCommand(context.Background(), []string{"from=1", "to=2"}, &buf))
+	assert.Equal(t, "# flush 1 to 2, buckets matching *\n"+
+		"# counter: 2 to 1 buckets, 0 appeared, 1 disappeared, 1 changed, total 12 to 25 (+13)\n"+
+		"# timer: 1 to 2 buckets, 1 appeared, 0 disappeared, 0 changed, total 2 to 5 (+3)\n"+
+		"# gauge: 1 to 1 buckets, 0 appeared, 0 disappeared, 1 changed, total 5 to 5.5 (+0.5)\n"+
+		"# set: 0 to 0 buckets, 0 appeared, 0 disappeared, 0 changed, total 0 to 0 (+0)\n"+
+		"changed counter requests [env:prod] 10 -> 25 (+15)\n"+
+		"appeared timer db.query [] 0 -> 3 (+3)\n"+
+		"disappeared counter errors [] 2 -> 0 (-2)\n"+
+		"changed gauge queue [] 5 -> 5.5 (+0.5)\n", buf.String())
+
+	// Positional arguments, a glob and a threshold
+	buf.Reset()
+	require.NoError(t, fh.DiffCommand(context.Background(), []string{"1", "2", "[eqr]*", "threshold=1"}, &buf))
+	assert.Contains(t, buf.String(), "changed counter requests [env:prod] 10 -> 25 (+15)\n")
+	assert.Contains(t, buf.String(), "disappeared counter errors [] 2 -> 0 (-2)\n")
+	assert.Contains(t, buf.String(), "# gauge: 1 to 1 buckets, 0 appeared, 0 disappeared, 0 changed")
+	assert.NotContains(t, buf.String(), "db.query")
+
+	// The last two flushes by default, and limited
+	buf.Reset()
+	require.NoError(t, fh.DiffCommand(context.Background(), []string{"limit=1"}, &buf))
+	assert.Contains(t, buf.String(), "# flush 1 to 2,")
+	assert.Contains(t, buf.String(), "changed counter requests")
+	assert.Contains(t, buf.String(), "# 3 more of 4, see limit=\n")
+
+	assert.Error(t, fh.DiffCommand(context.Background(), []string{"from=1"}, &buf))
+	assert.Error(t, fh.DiffCommand(context.Background(), []string{"1", "x"}, &buf))
+	assert.Error(t, fh.DiffCommand(context.Background(), []string{"1", "2", "["}, &buf))
+	assert.Error(t, fh.DiffCommand(context.Background(), []string{"1", "2", "threshold=-1"}, &buf))
+	assert.Error(t, fh.DiffCommand(context.Background(), []string{"1", "3"}, &buf))
+}
+
+func TestFlushHistoryKeepsRecentFlushes(t *testing.T) {
+	t.Parallel()
+	fh := NewFlushHistory(2)
+	for seq := uint64(1); seq <= 4; seq++ {
+		addHistoryFlush(fh, seq, &gostatsd.MetricMap{})
+	}
+	_, err := fh.interval(2)
+	assert.EqualError(t, err, "flush 2 is not kept, flushes 3 to 4 are kept")
+	_, err = fh.interval(4)
+	assert.NoError(t, err)
+
+	var nilHistory *FlushHistory
+	nilHistory.begin(1)
+	nilHistory.add(&gostatsd.MetricMap{})
+	nilHistory.publish()
+	assert.Error(t, nilHistory.DiffCommand(context.Background(), nil, &bytes.Buffer{}))
+}
+
+func TestFlusherKeepsFlushHistory(t *testing.T) {
+	t.Parallel()
+	sa := &singleAggregator{agg: newGRPCTestAggregator()}
+	fl := NewMetricFlusher(0, sa, nil, []gostatsd.Backend{&sequenceBackend{}}, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+	fl.history = NewFlushHistory(2)
+	fl.flushData(context.Background(), time.Second, 0)
+	fl.flushData(context.Background(), time.Second, 0)
+
+	var buf bytes.Buffer
+	require.NoError(t, fl.history.DiffCommand(context.Background(), nil, &buf))
+	assert.Contains(t, buf.String(), "# flush 1 to 2, buckets matching *\n")
+	assert.Contains(t, buf.String(), "disappeared counter requests [env:prod] 3 -> 0 (-3)\n")
+	assert.Contains(t, buf.String(), "disappeared timer latency [] 2 -> 0 (-2)\n")
+}
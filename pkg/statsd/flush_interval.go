@@ -0,0 +1,124 @@
+package statsd
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
+)
+
+const (
+	// MinFlushInterval is the shortest flush interval allowed without --force-flush-interval.
+	MinFlushInterval = 100 * time.Millisecond
+
+	// baselineMetrics is the number of metrics of each type in the flush timed to estimate the cost of flushing.
+	baselineMetrics = 2500
+	// baselineTimerValues is the number of samples of each timer in the flush timed to estimate the cost of flushing.
+	baselineTimerValues = 10
+	// slowFlushFraction is the fraction of the flush interval which flushes should take less than on average, so that
+	// the aggregators spend most of their time aggregating.
+	slowFlushFraction = 0.5
+	// slowFlushWindow is the number of consecutive flushes whose average duration is compared with the flush interval.
+	slowFlushWindow = 5
+	// baselineCheckInterval is the flush interval below which it is checked against a baseline flush at startup.
+	// Longer intervals are only too short if flushing is orders of magnitude slower than the baseline.
+	baselineCheckInterval = 10 * MinFlushInterval
+)
+
+var (
+	baselineOnce     sync.Once
+	measuredBaseline FlushBaseline
+)
+
+// processFlushBaseline returns the flush baseline of the process, measuring it the first time it is called, so the
+// servers of a process and servers which are restarted don't each measure it.
+func processFlushBaseline() FlushBaseline {
+	baselineOnce.Do(func() {
+		measuredBaseline = MeasureFlushBaseline()
+	})
+	return measuredBaseline
+}
+
+// FlushBaseline is the measured cost of flushing a baseline of 10000 metrics, a quarter of each type.
+type FlushBaseline struct {
+	Aggregation   time.Duration // Time to flush the aggregator, computing the statistics of each metric
+	Serialization time.Duration // Time to serialize the flushed metrics once, as a backend would
+}
+
+// MeasureFlushBaseline aggregates, flushes and serializes a baseline of synthetic metrics, and returns the time taken.
+func MeasureFlushBaseline() FlushBaseline {
+	agg := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+	now := time.Now()
+	for i := 0; i < baselineMetrics; i++ {
+		name := "baseline.metric." + strconv.Itoa(i)
+		tags := gostatsd.Tags{"baseline:" + strconv.Itoa(i%10)}
+		agg.Receive(&gostatsd.Metric{Name: name, Value: float64(i), Type: gostatsd.COUNTER, Rate: 1, Tags: tags}, now)
+		agg.Receive(&gostatsd.Metric{Name: name, Value: float64(i), Type: gostatsd.GAUGE, Rate: 1, Tags: tags}, now)
+		agg.Receive(&gostatsd.Metric{Name: name, StringValue: strconv.Itoa(i), Type: gostatsd.SET, Rate: 1, Tags: tags}, now)
+		for j := 0; j < baselineTimerValues; j++ {
+			agg.Receive(&gostatsd.Metric{Name: name, Value: float64(i + j), Type: gostatsd.TIMER, Rate: 1, Tags: tags}, now)
+		}
+	}
+
+	var b FlushBaseline
+	start := time.Now()
+	agg.Flush(time.Second)
+	b.Aggregation = time.Since(start)
+	start = time.Now()
+	agg.Process(func(m *gostatsd.MetricMap) {
+		serializeBaseline(m)
+	})
+	b.Serialization = time.Since(start)
+	return b
+}
+
+// serializeBaseline writes each metric of m as a line of text, and returns the number of bytes written.
+func serializeBaseline(m *gostatsd.MetricMap) int {
+	buf := make([]byte, 0, 64*1024)
+	n := 0
+	line := func(name string, tags gostatsd.Tags, value float64) {
+		buf = append(buf, name...)
+		buf = append(buf, ';')
+		buf = append(buf, tags.String()...)
+		buf = append(buf, ' ')
+		buf = strconv.AppendFloat(buf, value, 'f', -1, 64)
+		buf = append(buf, '\n')
+		if len(buf) > 32*1024 {
+			n += len(buf)
+			buf = buf[:0]
+		}
+	}
+	m.EachCounter(func(name, _ string, c gostatsd.Counter) {
+		line(name, c.Tags, float64(c.Value))
+		line(name, c.Tags, c.PerSecond)
+	})
+	m.EachGauge(func(name, _ string, g gostatsd.Gauge) {
+		line(name, g.Tags, g.Value)
+	})
+	m.EachTimer(func(name, _ string, t gostatsd.Timer) {
+		for _, v := range []float64{t.Min, t.Max, t.Mean, t.Median, t.StdDev, t.Sum, t.SumSquares, float64(t.Count), t.PerSecond} {
+			line(name, t.Tags, v)
+		}
+		for _, pct := range t.Percentiles {
+			line(name+"."+pct.Str, t.Tags, pct.Float)
+		}
+	})
+	m.EachSet(func(name, _ string, s gostatsd.Set) {
+		line(name, s.Tags, float64(s.Cardinality()))
+	})
+	return n + len(buf)
+}
+
+// SafeFlushInterval returns the shortest flush interval for which a flush of the baseline, serialized once for each
+// of backends, takes at most slowFlushFraction of the interval.
+func (b FlushBaseline) SafeFlushInterval(backends int) time.Duration {
+	flush := b.Aggregation + time.Duration(backends)*b.Serialization
+	return time.Duration(float64(flush) / slowFlushFraction)
+}
+
+func (b FlushBaseline) String() string {
+	return fmt.Sprintf("aggregation=%s serialization=%s", b.Aggregation, b.Serialization)
+}
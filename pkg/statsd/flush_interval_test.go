@@ -0,0 +1,29 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafeFlushInterval(t *testing.T) {
+	t.Parallel()
+	b := FlushBaseline{Aggregation: 20 * time.Millisecond, Serialization: 5 * time.Millisecond}
+	assert.Equal(t, 40*time.Millisecond, b.SafeFlushInterval(0))
+	assert.Equal(t, 70*time.Millisecond, b.SafeFlushInterval(3))
+}
+
+func TestMeasureFlushBaseline(t *testing.T) {
+	t.Parallel()
+	b := MeasureFlushBaseline()
+	assert.True(t, b.Aggregation > 0)
+	assert.True(t, b.Serialization > 0)
+	assert.True(t, b.SafeFlushInterval(2) > b.SafeFlushInterval(1))
+}
+
+func TestProcessFlushBaseline(t *testing.T) {
+	t.Parallel()
+	// The baseline is only measured once per process.
+	assert.Equal(t, processFlushBaseline(), processFlushBaseline())
+}
@@ -0,0 +1,55 @@
+package statsd
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// flushRetry keeps a copy of each snapshot of a flush, and which backends failed to send any of them, so the flush
+// can be sent to them again with the next one.
+type flushRetry struct {
+	mu        sync.Mutex
+	snapshots []*gostatsd.MetricMap
+	failed    map[int]struct{} // Indexes of the backends which failed to send a snapshot
+}
+
+func newFlushRetry() *flushRetry {
+	return &flushRetry{
+		failed: map[int]struct{}{},
+	}
+}
+
+// add keeps a copy of m, as the aggregator may be reset before the flush is retried.
+func (fr *flushRetry) add(m *gostatsd.MetricMap) {
+	c := m.Copy()
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.snapshots = append(fr.snapshots, c)
+}
+
+// fail records that the i'th backend failed to send a snapshot.
+func (fr *flushRetry) fail(i int) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.failed[i] = struct{}{}
+}
+
+// retries returns the snapshots to send again to each backend which failed to send any of them, by index of the
+// backend.  Every snapshot of the flush is sent again, in order of part.
+func (fr *flushRetry) retries() map[int][]*gostatsd.MetricMap {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if len(fr.failed) == 0 {
+		return nil
+	}
+	sort.Slice(fr.snapshots, func(i, j int) bool {
+		return fr.snapshots[i].Part < fr.snapshots[j].Part
+	})
+	retries := make(map[int][]*gostatsd.MetricMap, len(fr.failed))
+	for i := range fr.failed {
+		retries[i] = fr.snapshots
+	}
+	return retries
+}
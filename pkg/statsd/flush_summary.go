@@ -0,0 +1,143 @@
+package statsd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// flushSummary collects the results of a single flush so they can be logged as one line.
+type flushSummary struct {
+	start time.Time
+
+	// Set by the flusher once all backends have completed, not protected by mu.
+	metricsReceived uint64
+	badLines        uint64
+
+	mu       sync.Mutex
+	counters int
+	gauges   int
+	timers   int
+	sets     int
+	backends map[string]*backendFlushResult
+}
+
+// backendFlushResult is the outcome of sending all MetricMaps of a flush to a single backend.
+type backendFlushResult struct {
+	duration time.Duration // Time from the start of the flush until the last send completed
+	metrics  int           // Number of metrics sent, across all MetricMaps
+	errors   int
+	lastErr  error
+}
+
+func newFlushSummary(start time.Time) *flushSummary {
+	return &flushSummary{
+		start:    start,
+		backends: make(map[string]*backendFlushResult),
+	}
+}
+
+func (fs *flushSummary) addMetrics(m *gostatsd.MetricMap) {
+	counters, gauges, timers, sets := 0, 0, 0, 0
+	for _, v := range m.Counters {
+		counters += len(v)
+	}
+	for _, v := range m.Gauges {
+		gauges += len(v)
+	}
+	for _, v := range m.Timers {
+		timers += len(v)
+	}
+	for _, v := range m.Sets {
+		sets += len(v)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.counters += counters
+	fs.gauges += gauges
+	fs.timers += timers
+	fs.sets += sets
+}
+
+// backend returns the result of the named backend, must be called with mu held.
+func (fs *flushSummary) backend(name string) *backendFlushResult {
+	result, ok := fs.backends[name]
+	if !ok {
+		result = &backendFlushResult{}
+		fs.backends[name] = result
+	}
+	return result
+}
+
+// addBackendMetrics records that a MetricMap of n metrics is being sent to the named backend.
+func (fs *flushSummary) addBackendMetrics(name string, n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.backend(name).metrics += n
+}
+
+func (fs *flushSummary) addBackendResult(name string, now time.Time, errs []error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	result := fs.backend(name)
+	if d := now.Sub(fs.start); d > result.duration {
+		result.duration = d
+	}
+	for _, err := range errs {
+		if err != nil {
+			result.errors++
+			result.lastErr = err
+		}
+	}
+}
+
+// failed returns true if any backend failed to send any of the flush.
+func (fs *flushSummary) failed() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, result := range fs.backends {
+		if result.errors > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsSent returns the number of metrics sent to each backend.
+func (fs *flushSummary) metricsSent() map[string]int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	sent := make(map[string]int, len(fs.backends))
+	for name, result := range fs.backends {
+		sent[name] = result.metrics
+	}
+	return sent
+}
+
+// fields returns the summary as structured log fields.
+func (fs *flushSummary) fields(now time.Time) log.Fields {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fields := log.Fields{
+		"counters":         fs.counters,
+		"gauges":           fs.gauges,
+		"timers":           fs.timers,
+		"sets":             fs.sets,
+		"metrics_received": fs.metricsReceived,
+		"bad_lines":        fs.badLines,
+		"duration":         now.Sub(fs.start).String(),
+	}
+	for name, result := range fs.backends {
+		prefix := "backend." + name + "."
+		fields[prefix+"duration"] = result.duration.String()
+		fields[prefix+"errors"] = result.errors
+		if result.lastErr != nil {
+			fields[prefix+"error"] = result.lastErr.Error()
+		}
+	}
+	return fields
+}
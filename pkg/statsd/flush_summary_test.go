@@ -0,0 +1,73 @@
+package statsd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushSummaryFields(t *testing.T) {
+	t.Parallel()
+	start := time.Unix(100, 0)
+	fs := newFlushSummary(start)
+
+	fs.addMetrics(&gostatsd.MetricMap{
+		Counters: gostatsd.Counters{"c": {"": {}, "a:b": {}}},
+		Gauges:   gostatsd.Gauges{"g": {"": {}}},
+		Timers:   gostatsd.Timers{"t1": {"": {}}, "t2": {"": {}}},
+		Sets:     gostatsd.Sets{},
+	})
+	fs.addMetrics(&gostatsd.MetricMap{
+		Counters: gostatsd.Counters{"c2": {"": {}}},
+	})
+	fs.addBackendResult("ok", start.Add(2*time.Second), nil)
+	fs.addBackendResult("ok", start.Add(1*time.Second), []error{nil})
+	fs.addBackendResult("bad", start.Add(3*time.Second), []error{errors.New("boom"), nil})
+	fs.metricsReceived = 10
+	fs.badLines = 2
+
+	expected := map[string]interface{}{
+		"counters":             3,
+		"gauges":               1,
+		"timers":               2,
+		"sets":                 0,
+		"metrics_received":     uint64(10),
+		"bad_lines":            uint64(2),
+		"duration":             "5s",
+		"backend.ok.duration":  "2s",
+		"backend.ok.errors":    0,
+		"backend.bad.duration": "3s",
+		"backend.bad.errors":   1,
+		"backend.bad.error":    "boom",
+	}
+	assert.EqualValues(t, expected, fs.fields(start.Add(5*time.Second)))
+}
+
+type fakeLineCounter struct {
+	metricsReceived, badLines uint64
+}
+
+func (lc *fakeLineCounter) LineCounts() (uint64, uint64) {
+	return lc.metricsReceived, lc.badLines
+}
+
+func TestFlusherLogFlushSummaryDeltas(t *testing.T) {
+	t.Parallel()
+	lc := &fakeLineCounter{metricsReceived: 10, badLines: 1}
+	fl := NewMetricFlusher(0, nil, lc, nil, "host", true, false, nil, nil, nil, nil)
+
+	fs := newFlushSummary(time.Now())
+	fl.logFlushSummary(fs)
+	assert.EqualValues(t, 10, fs.metricsReceived)
+	assert.EqualValues(t, 1, fs.badLines)
+
+	lc.metricsReceived, lc.badLines = 25, 1
+	fs = newFlushSummary(time.Now())
+	fl.logFlushSummary(fs)
+	assert.EqualValues(t, 15, fs.metricsReceived)
+	assert.EqualValues(t, 0, fs.badLines)
+}
@@ -8,11 +8,22 @@ import (
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
 	"github.com/atlassian/gostatsd/pkg/statser"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// lateProcesser is implemented by aggregators which bucket metrics which arrive late in to past intervals.
+type lateProcesser interface {
+	// ProcessLate calls f with the metrics of each past interval, which have Late set.
+	ProcessLate(f ProcessFunc)
+}
+
+// maxFlushIntervalFactor bounds the measured interval between flushes to this many flush intervals.  A longer
+// interval means the clock has jumped, and would produce meaningless rates.
+const maxFlushIntervalFactor = 10
+
 // MetricFlusher periodically flushes metrics from all Aggregators to Senders.
 type MetricFlusher struct {
 	// Counter fields below must be read/written only using atomic instructions.
@@ -23,56 +34,255 @@ type MetricFlusher struct {
 
 	flushInterval      time.Duration // How often to flush metrics to the sender
 	aggregateProcesser AggregateProcesser
+	lineCounter        LineCounter
 	backends           []gostatsd.Backend
 	hostname           string
+	logSummary         bool // Log a summary line after each flush
+	sortMetrics        bool // Send metrics to backends in order of name
+	derived            *DerivedMetrics
+	router             *Router
+	coldStart          *ColdStart
 	statser            statser.Statser
+	warmup             time.Duration     // Delay before the first flush, whose metrics include those received during it
+	journal            *Journal          // Truncated after each flush which every backend sent, may be nil
+	aggregations       *AggregationRules // Combine metrics by name at each flush, may be nil
+	flushes            *FlushSnapshots   // Copies each flush for the gRPC API, may be nil
+	history            *FlushHistory     // Keeps a snapshot of recent flushes for the diff command, may be nil
+	timerRate          bool              // Flush a <timer>.rate gauge for each timer
+	retryFailed        bool              // Send a flush again with the next one to the backends which failed to send it
+	supervisor         *Supervisor       // Recovers from a backend panicking in SendMetricsAsync, may be nil
+	logger             log.FieldLogger
+
+	// Line counts at the previous flush, only accessed from the flushing goroutine.
+	lastMetricsReceived uint64
+	lastBadLines        uint64
+
+	flushOverruns uint64 // Only accessed from the flushing goroutine
+	sequence      uint64 // Sequence number of the latest flush, only accessed from the flushing goroutine
+
+	// Only accessed from the flushing goroutine, and by the workers during a flush.
+	pending *flushRetry                   // Copies of the snapshots of the current flush, nil unless retryFailed
+	retries map[int][]*gostatsd.MetricMap // Snapshots of the previous flush to send again, by index of the backend
+
+	// Only accessed from the flushing goroutine.
+	slowFlushes   uint64          // Warnings about slow flushes
+	recentFlushes []time.Duration // Durations of up to slowFlushWindow recent flushes
+
+	clockJumps uint64           // Only accessed from the flushing goroutine
+	now        func() time.Time // Returns current time. Useful for testing.
 }
 
 // NewMetricFlusher creates a new MetricFlusher with provided configuration.
-func NewMetricFlusher(flushInterval time.Duration, aggregateProcesser AggregateProcesser, backends []gostatsd.Backend, hostname string, statser statser.Statser) *MetricFlusher {
+// lineCounter may be nil, in which case the flush summary will not include received metrics or bad lines.
+// derived may be nil if there are no derived metrics, router may be nil to send every metric to every backend, and
+// coldStart may be nil to flush the first interval after startup like any other.
+func NewMetricFlusher(flushInterval time.Duration, aggregateProcesser AggregateProcesser, lineCounter LineCounter, backends []gostatsd.Backend, hostname string, logSummary, sortMetrics bool, derived *DerivedMetrics, router *Router, coldStart *ColdStart, statser statser.Statser) *MetricFlusher {
 	return &MetricFlusher{
 		flushInterval:      flushInterval,
 		aggregateProcesser: aggregateProcesser,
+		lineCounter:        lineCounter,
 		backends:           backends,
 		hostname:           hostname,
+		logSummary:         logSummary,
+		sortMetrics:        sortMetrics,
+		derived:            derived,
+		router:             router,
+		coldStart:          coldStart,
 		statser:            statser,
+		logger:             logging.Component("flusher"),
+		now:                time.Now,
 	}
 }
 
 // Run runs the MetricFlusher.
 func (f *MetricFlusher) Run(ctx context.Context) {
+	// The ticker runs on the monotonic clock, so flushes are scheduled regardless of changes to the system clock.
+	lastFlush := f.now()
+	if f.warmup > 0 {
+		// Clients may not have connected yet, so the first flush covers the warmup as well as the first interval.
+		f.logger.Infof("Delaying the first flush by a warmup of %s", f.warmup)
+		warmupTimer := time.NewTimer(f.warmup)
+		select {
+		case <-ctx.Done():
+			warmupTimer.Stop()
+			return
+		case <-warmupTimer.C:
+		}
+	}
 	flushTicker := time.NewTicker(f.flushInterval)
 	defer flushTicker.Stop()
 
-	lastFlush := time.Now()
+	expected := f.warmup + f.flushInterval
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case thisFlush := <-flushTicker.C: // Time to flush to the backends
-			flushDelta := thisFlush.Sub(lastFlush)
-			f.flushData(ctx, flushDelta)
-			f.statser.NotifyFlush(flushDelta)
+		case <-flushTicker.C: // Time to flush to the backends
+			thisFlush, flushDelta := f.flushSince(ctx, lastFlush, expected)
 			lastFlush = thisFlush
+			expected = f.flushInterval
+			elapsed := f.now().Sub(thisFlush)
+			if elapsed > f.flushInterval {
+				f.skipOverrunTick(flushTicker, elapsed)
+			}
+			f.checkFlushDuration(elapsed)
+			f.statser.Gauge("flusher.flush_overruns", float64(f.flushOverruns), nil)
+			f.statser.Gauge("flusher.slow_flushes", float64(f.slowFlushes), nil)
+			f.statser.Gauge("flusher.clock_jumps", float64(f.clockJumps), nil)
+			f.statser.NotifyFlush(flushDelta)
 		}
 	}
 }
 
-func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Duration) {
+// flushSince flushes the metrics received since the flush at lastFlush, which was expected to be an interval of
+// expected ago, returning the time of this flush and the interval rates were computed over.  A tick may have been
+// waiting while the previous flush overran, or ticks may have been delayed while the process was descheduled, so the
+// interval is measured from now rather than assumed to be the expected interval.
+func (f *MetricFlusher) flushSince(ctx context.Context, lastFlush time.Time, expected time.Duration) (time.Time, time.Duration) {
+	thisFlush := f.now()
+	flushDelta := f.measureInterval(lastFlush, thisFlush, expected)
+	f.flushData(ctx, flushDelta, f.coldStart.firstInterval(thisFlush, flushDelta))
+	return thisFlush, flushDelta
+}
+
+// measureInterval returns the interval to compute rates over for a flush at thisFlush, after the flush at lastFlush,
+// which was expected to be an interval of expected, usually the flush interval.  Times from time.Now carry a
+// monotonic clock reading which is not affected by changes to the system clock, but a time without one, such as one
+// which has been serialized, may still jump.  A negative interval, or one longer than maxFlushIntervalFactor expected
+// intervals, is counted as a clock jump and replaced by the expected interval.
+func (f *MetricFlusher) measureInterval(lastFlush, thisFlush time.Time, expected time.Duration) time.Duration {
+	interval := thisFlush.Sub(lastFlush)
+	if interval > 0 && interval <= maxFlushIntervalFactor*expected {
+		return interval
+	}
+	f.clockJumps++
+	f.logger.WithField(logging.FieldDuration, interval).Warnf("Measured a flush interval of %s, the clock may have changed, using %s to compute rates", interval, expected)
+	return expected
+}
+
+// skipOverrunTick discards the tick which fired while a flush was running, extending the current interval
+// to the next tick.
+func (f *MetricFlusher) skipOverrunTick(flushTicker *time.Ticker, elapsed time.Duration) {
+	select {
+	case <-flushTicker.C:
+	default:
+	}
+	f.flushOverruns++
+	f.logger.WithField(logging.FieldDuration, elapsed).Warnf("Flush took %s, longer than the flush interval of %s, skipping a flush", elapsed, f.flushInterval)
+}
+
+// checkFlushDuration records the duration of a flush, and warns when the average duration of the last
+// slowFlushWindow flushes is more than slowFlushFraction of the flush interval, as metrics received while flushing may
+// be dropped.  The recent durations are then forgotten, so the warning is repeated at most every slowFlushWindow
+// flushes.
+func (f *MetricFlusher) checkFlushDuration(elapsed time.Duration) {
+	f.recentFlushes = append(f.recentFlushes, elapsed)
+	if len(f.recentFlushes) > slowFlushWindow {
+		f.recentFlushes = f.recentFlushes[1:]
+	}
+	if len(f.recentFlushes) < slowFlushWindow {
+		return
+	}
+	var total time.Duration
+	for _, d := range f.recentFlushes {
+		total += d
+	}
+	average := total / time.Duration(len(f.recentFlushes))
+	fraction := float64(average) / float64(f.flushInterval)
+	if fraction <= slowFlushFraction {
+		return
+	}
+	f.slowFlushes++
+	f.recentFlushes = f.recentFlushes[:0]
+	f.logger.WithFields(log.Fields{
+		logging.FieldDuration: average,
+		"flush_interval":      f.flushInterval,
+		"flushes":             slowFlushWindow,
+	}).Warnf("SLOW FLUSHES: the last %d flushes took %s on average, %.0f%% of the flush interval of %s, metrics may be dropped while flushing, increase --%s", slowFlushWindow, average, 100*fraction, f.flushInterval, ParamFlushInterval)
+}
+
+// flushData flushes the aggregators and sends the metrics to the backends.  partial is the fraction of the interval
+// which was aggregated if this is the first flush after startup, otherwise 0.
+func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Duration, partial float64) {
+	suppress := partial > 0 && f.coldStart.mode == ColdStartSuppress
+	aggrInterval := flushInterval
+	if partial > 0 && f.coldStart.mode == ColdStartScale {
+		aggrInterval = time.Duration(partial * float64(flushInterval))
+	}
+	if partial > 0 {
+		f.logger.Infof("First flush after startup aggregated %.1f%% of the flush interval, cold start mode is %s", 100*partial, f.coldStart.mode)
+	}
+
+	// The journal is marked before the aggregators are flushed, so it can be truncated to before any metric received
+	// during the flush.
+	journalMark, journalMarked := f.journal.mark(ctx)
+	f.sequence++
+	f.flushes.begin()
+	f.history.begin(f.sequence)
+	var parts int64
+	// stamp records the interval and sequence number of the flush in m, which is the next part of the flush.
+	stamp := func(m *gostatsd.MetricMap) {
+		f.setIntervals(m, aggrInterval)
+		m.Sequence = f.sequence
+		m.Part = int(atomic.AddInt64(&parts, 1)) - 1
+	}
 	var sendWg sync.WaitGroup
+	summary := newFlushSummary(time.Now())
 	timerTotal := f.statser.NewTimer("flusher.total_time", nil)
+	f.sendRetries(ctx, &sendWg, summary)
+	if f.retryFailed {
+		f.pending = newFlushRetry()
+	}
+	var derived *derivedFlush
+	if f.derived != nil && f.derived.Len() > 0 {
+		derived = f.derived.newFlush()
+	}
+	var aggregations *aggregationFlush
+	if f.aggregations != nil && f.aggregations.Len() > 0 {
+		aggregations = f.aggregations.newFlush()
+	}
 	processWait := f.aggregateProcesser.Process(ctx, func(workerId int, aggr Aggregator) {
 		// This is in the flusher, but it's an aggregator action, so put it in that space.
 		tags := gostatsd.Tags{fmt.Sprintf("aggregator_id:%d", workerId)}
 
 		timerFlush := f.statser.NewTimer("aggregator.aggregation_time", tags)
-		aggr.Flush(flushInterval)
+		aggr.Flush(aggrInterval)
 		timerFlush.SendGauge()
 
 		timerProcess := f.statser.NewTimer("aggregator.process_time", tags)
 		aggr.Process(func(m *gostatsd.MetricMap) {
-			f.sendMetricsAsync(ctx, &sendWg, m)
+			if suppress {
+				return
+			}
+			stamp(m)
+			if derived != nil {
+				derived.add(m)
+			}
+			if aggregations != nil {
+				m = aggregations.add(m)
+			}
+			var rates *gostatsd.MetricMap
+			if f.timerRate {
+				rates = timerRates(m)
+			}
+			summary.addMetrics(m)
+			f.sendMetricsAsync(ctx, &sendWg, m, summary)
+			if rates != nil {
+				stamp(rates)
+				summary.addMetrics(rates)
+				f.sendMetricsAsync(ctx, &sendWg, rates, summary)
+			}
 		})
+		if late, ok := aggr.(lateProcesser); ok && !suppress {
+			late.ProcessLate(func(m *gostatsd.MetricMap) {
+				// Late metrics keep the length of the past interval they were bucketed in to.
+				interval := m.Interval
+				stamp(m)
+				m.Interval = interval
+				summary.addMetrics(m)
+				f.sendMetricsAsync(ctx, &sendWg, m, summary)
+			})
+		}
 		timerProcess.SendGauge()
 
 		timerReset := f.statser.NewTimer("aggregator.reset_time", tags)
@@ -80,27 +290,225 @@ func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Durati
 		timerReset.SendGauge()
 	})
 	processWait() // Wait for all workers to execute function
+	if derived != nil && !suppress {
+		// Derived metrics need the inputs from every aggregator, so they are sent once all have been processed.
+		m := derived.metrics(gostatsd.Nanotime(time.Now().UnixNano()), f.hostname)
+		stamp(m)
+		summary.addMetrics(m)
+		f.sendMetricsAsync(ctx, &sendWg, m, summary)
+		f.statser.Gauge("flusher.derived_rules_skipped", float64(f.derived.RulesSkipped()), nil)
+	}
+	if aggregations != nil && !suppress {
+		// Like derived metrics, the aggregates combine metrics from every aggregator.
+		m := aggregations.metrics(aggrInterval)
+		stamp(m)
+		summary.addMetrics(m)
+		f.sendMetricsAsync(ctx, &sendWg, m, summary)
+	}
+	if m := f.coldStart.metrics(gostatsd.Nanotime(time.Now().UnixNano()), partial); m != nil {
+		stamp(m)
+		summary.addMetrics(m)
+		f.sendMetricsAsync(ctx, &sendWg, m, summary)
+	}
+	f.flushes.publish(f.sequence, aggrInterval)
+	f.history.publish()
 	sendWg.Wait() // Wait for all backends to finish sending
+	if f.pending != nil {
+		f.retries = f.pending.retries()
+		f.pending = nil
+	}
+	if journalMarked && !summary.failed() {
+		f.journal.truncateTo(ctx, journalMark)
+	}
+	for name, sent := range summary.metricsSent() {
+		f.statser.Gauge("flush.count", float64(sent), gostatsd.Tags{"backend:" + name})
+	}
+	if f.router != nil {
+		f.statser.Gauge("flusher.metrics_unrouted", float64(f.router.MetricsUnrouted()), nil)
+	}
+	if f.flushes != nil {
+		f.statser.Gauge("flusher.grpc_flushes_dropped", float64(f.flushes.Dropped()), nil)
+	}
 	timerTotal.SendGauge()
+
+	if f.logSummary {
+		f.logFlushSummary(summary)
+	}
+}
+
+// setIntervals records the interval the metrics in m were aggregated over, and the configured flush interval, for
+// backends which compute their own rates.
+func (f *MetricFlusher) setIntervals(m *gostatsd.MetricMap, interval time.Duration) {
+	m.Interval = interval
+	m.NominalInterval = f.flushInterval
+}
+
+// sendMetricsAsync sends m to each backend, or the part of m routed to each backend if there is a router, marked to
+// be iterated in order of name if metrics are sorted.  Backends which don't want the raw timer samples get a snapshot
+// with the samples removed, which is built at most once when every backend is sent all of m.  Late metrics are only
+// sent to backends which backfill.
+func (f *MetricFlusher) sendMetricsAsync(ctx context.Context, wg *sync.WaitGroup, m *gostatsd.MetricMap, summary *flushSummary) {
+	if !m.Late {
+		f.flushes.add(m)
+		f.history.add(m)
+	}
+	if f.sortMetrics {
+		sorted := *m
+		sorted.Sorted = true
+		m = &sorted
+	}
+	var failed func(int)
+	if f.pending != nil {
+		f.pending.add(m)
+		failed = f.pending.fail
+	}
+	var parts []*gostatsd.MetricMap
+	if f.router != nil {
+		parts = f.router.partition(m)
+	}
+	var statsOnly *gostatsd.MetricMap
+	for i, backend := range f.backends {
+		if m.Late && !gostatsd.WantsBackfill(backend) {
+			continue
+		}
+		snapshot := m
+		if parts != nil {
+			snapshot = parts[i]
+		}
+		if !gostatsd.WantsRawTimers(backend) {
+			if parts != nil {
+				snapshot = withoutTimerValues(snapshot)
+			} else {
+				if statsOnly == nil {
+					statsOnly = withoutTimerValues(m)
+				}
+				snapshot = statsOnly
+			}
+		}
+		f.sendSnapshot(ctx, wg, i, snapshot, summary, failed)
+	}
 }
 
-func (f *MetricFlusher) sendMetricsAsync(ctx context.Context, wg *sync.WaitGroup, m *gostatsd.MetricMap) {
-	wg.Add(len(f.backends))
-	for _, backend := range f.backends {
-		backend.SendMetricsAsync(ctx, m, func(errs []error) {
+// sendRetries sends every snapshot of the previous flush again to each backend which failed to send any of them.  The
+// snapshots keep their sequence number, part and timestamps, so a backend skips those it has already sent.  A flush
+// is only retried once.
+func (f *MetricFlusher) sendRetries(ctx context.Context, wg *sync.WaitGroup, summary *flushSummary) {
+	for i, snapshots := range f.retries {
+		backend := f.backends[i]
+		f.logger.WithFields(log.Fields{
+			logging.FieldBackend:  backend.Name(),
+			logging.FieldInterval: snapshots[0].Sequence,
+		}).Info("Retrying failed interval")
+		for _, m := range snapshots {
+			if m.Late && !gostatsd.WantsBackfill(backend) {
+				continue
+			}
+			snapshot := m
+			if f.router != nil {
+				snapshot = f.router.partition(m)[i]
+			}
+			if !gostatsd.WantsRawTimers(backend) {
+				snapshot = withoutTimerValues(snapshot)
+			}
+			f.sendSnapshot(ctx, wg, i, snapshot, summary, nil)
+		}
+	}
+	f.retries = nil
+}
+
+// sendSnapshot sends snapshot to the i'th backend, and calls failed with i if sending fails and failed is not nil.
+func (f *MetricFlusher) sendSnapshot(ctx context.Context, wg *sync.WaitGroup, i int, snapshot *gostatsd.MetricMap, summary *flushSummary, failed func(int)) {
+	backend := f.backends[i]
+	name := backend.Name()
+	summary.addBackendMetrics(name, snapshot.Len())
+	wg.Add(1)
+	var once sync.Once
+	done := func(errs []error) {
+		once.Do(func() {
 			defer wg.Done()
-			f.handleSendResult(errs)
+			summary.addBackendResult(name, time.Now(), errs)
+			f.handleSendResult(name, snapshot.Sequence, errs)
+			if failed != nil && hasSendError(errs) {
+				failed(i)
+			}
 		})
 	}
+	// A backend which panics has failed to send, and the flush doesn't wait for its callback.
+	if f.supervisor.recover("backend_"+name, func() { backend.SendMetricsAsync(ctx, snapshot, done) }) {
+		done([]error{fmt.Errorf("backend %s panicked sending metrics", name)})
+	}
+}
+
+// hasSendError returns true if any of errs is not nil.
+func hasSendError(errs []error) bool {
+	for _, err := range errs {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutTimerValues returns a snapshot of m with the raw timer samples removed.
+func withoutTimerValues(m *gostatsd.MetricMap) *gostatsd.MetricMap {
+	return &gostatsd.MetricMap{
+		Counters: m.Counters,
+		Timers:   m.Timers.WithoutValues(),
+		Gauges:   m.Gauges,
+		Sets:     m.Sets,
+		Sorted:   m.Sorted,
+
+		Interval:        m.Interval,
+		NominalInterval: m.NominalInterval,
+		Sequence:        m.Sequence,
+		Part:            m.Part,
+		Late:            m.Late,
+	}
+}
+
+// wantsBackfill returns true if any of the backends want the metrics which arrived late for a past interval.
+func wantsBackfill(backends []gostatsd.Backend) bool {
+	for _, b := range backends {
+		if gostatsd.WantsBackfill(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsRawTimers returns true if any of the backends want the raw timer samples.
+func wantsRawTimers(backends []gostatsd.Backend) bool {
+	for _, b := range backends {
+		if gostatsd.WantsRawTimers(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *MetricFlusher) logFlushSummary(summary *flushSummary) {
+	if f.lineCounter != nil {
+		metricsReceived, badLines := f.lineCounter.LineCounts()
+		summary.metricsReceived = metricsReceived - f.lastMetricsReceived
+		summary.badLines = badLines - f.lastBadLines
+		f.lastMetricsReceived = metricsReceived
+		f.lastBadLines = badLines
+	}
+	f.logger.WithFields(summary.fields(time.Now())).Info("Flushed metrics")
 }
 
-func (f *MetricFlusher) handleSendResult(flushResults []error) {
+// handleSendResult records the time of the latest successful or failed send, and logs the errors sending interval
+// sequence to the named backend.
+func (f *MetricFlusher) handleSendResult(name string, sequence uint64, flushResults []error) {
 	timestampPointer := &f.lastFlush
 	for _, err := range flushResults {
 		if err != nil {
 			timestampPointer = &f.lastFlushError
 			if err != context.DeadlineExceeded && err != context.Canceled {
-				log.Errorf("Sending metrics to backend failed: %v", err)
+				f.logger.WithError(err).WithFields(log.Fields{
+					logging.FieldBackend:  name,
+					logging.FieldInterval: sequence,
+				}).Error("Sending interval to backend failed")
 			}
 		}
 	}
@@ -1,11 +1,24 @@
 package statsd
 
 import (
+	"context"
 	"errors"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
+	"github.com/atlassian/gostatsd/pkg/backends"
+	"github.com/atlassian/gostatsd/pkg/logging"
 	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFlusherHandleSendResultNoErrors(t *testing.T) {
@@ -19,8 +32,8 @@ func TestFlusherHandleSendResultNoErrors(t *testing.T) {
 		errs := errs
 		t.Run(strconv.Itoa(pos), func(t *testing.T) {
 			t.Parallel()
-			fl := NewMetricFlusher(0, nil, nil, "host", statser.NewNullStatser())
-			fl.handleSendResult(errs)
+			fl := NewMetricFlusher(0, nil, nil, nil, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+			fl.handleSendResult("backend", 1, errs)
 
 			if fl.lastFlush == 0 || fl.lastFlushError != 0 {
 				t.Errorf("lastFlush = %d, lastFlushError = %d", fl.lastFlush, fl.lastFlushError)
@@ -41,8 +54,8 @@ func TestFlusherHandleSendResultError(t *testing.T) {
 		errs := errs
 		t.Run(strconv.Itoa(pos), func(t *testing.T) {
 			t.Parallel()
-			fl := NewMetricFlusher(0, nil, nil, "host", statser.NewNullStatser())
-			fl.handleSendResult(errs)
+			fl := NewMetricFlusher(0, nil, nil, nil, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+			fl.handleSendResult("backend", 1, errs)
 
 			if fl.lastFlushError == 0 || fl.lastFlush != 0 {
 				t.Errorf("lastFlush = %d, lastFlushError = %d", fl.lastFlush, fl.lastFlushError)
@@ -50,3 +63,733 @@ func TestFlusherHandleSendResultError(t *testing.T) {
 		})
 	}
 }
+
+// singleAggregator runs the DispatcherProcessFunc against a single Aggregator, synchronously.
+type singleAggregator struct {
+	agg Aggregator
+}
+
+func (sa *singleAggregator) Process(ctx context.Context, fn DispatcherProcessFunc) gostatsd.Wait {
+	fn(0, sa.agg)
+	return func() {}
+}
+
+// timerBackend keeps the timer named "t" it was sent.
+type timerBackend struct {
+	timer gostatsd.Timer
+}
+
+func (tb *timerBackend) Name() string {
+	return "timer"
+}
+
+func (tb *timerBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	tb.timer = m.Timers["t"][""]
+	cb(nil)
+}
+
+func (tb *timerBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+type rawTimerBackend struct {
+	timerBackend
+}
+
+func (rtb *rawTimerBackend) WantsRawTimers() bool {
+	return true
+}
+
+func TestFlusherRawTimers(t *testing.T) {
+	t.Parallel()
+	statsOnly := &timerBackend{}
+	raw := &rawTimerBackend{}
+	backends := []gostatsd.Backend{statsOnly, raw}
+
+	agg := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute, HandOffTimerValues: wantsRawTimers(backends)}, nil, nil, nil)
+	fl := NewMetricFlusher(0, &singleAggregator{agg: agg}, nil, backends, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+
+	now := time.Now()
+	agg.Receive(&gostatsd.Metric{Name: "t", Value: 1, Type: gostatsd.TIMER, Rate: 1}, now)
+	agg.Receive(&gostatsd.Metric{Name: "t", Value: 2, Type: gostatsd.TIMER, Rate: 1}, now)
+	fl.flushData(context.Background(), time.Second, 0)
+
+	assert.Nil(t, statsOnly.timer.Values)
+	assert.Equal(t, 2, statsOnly.timer.Count)
+	rawValues := raw.timer.Values
+	assert.Equal(t, []float64{1, 2}, rawValues)
+
+	// The samples handed to the raw backend are not reused by the aggregator after it resets.
+	agg.Receive(&gostatsd.Metric{Name: "t", Value: 3, Type: gostatsd.TIMER, Rate: 1}, now)
+	assert.Equal(t, []float64{1, 2}, rawValues)
+	assert.Equal(t, []float64{3}, agg.Timers["t"][""].Values)
+}
+
+// flushRecorder records the interval passed to each Flush, and when it was called.
+type flushRecorder struct {
+	*MetricAggregator
+	mu        sync.Mutex
+	intervals []time.Duration
+	times     []time.Time
+}
+
+func (fr *flushRecorder) Flush(flushInterval time.Duration) {
+	fr.mu.Lock()
+	fr.intervals = append(fr.intervals, flushInterval)
+	fr.times = append(fr.times, time.Now())
+	fr.mu.Unlock()
+	fr.MetricAggregator.Flush(flushInterval)
+}
+
+// slowBackend takes delay to send, and records how many sends ran at once and the counter rates it was sent.
+type slowBackend struct {
+	delay       time.Duration
+	inFlight    int32
+	maxInFlight int32
+	mu          sync.Mutex
+	counters    []gostatsd.Counter
+}
+
+func (sb *slowBackend) Name() string {
+	return "slow"
+}
+
+func (sb *slowBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	n := atomic.AddInt32(&sb.inFlight, 1)
+	sb.mu.Lock()
+	if n > sb.maxInFlight {
+		sb.maxInFlight = n
+	}
+	sb.counters = append(sb.counters, m.Counters["c"][""])
+	sb.mu.Unlock()
+	time.Sleep(sb.delay)
+	atomic.AddInt32(&sb.inFlight, -1)
+	cb(nil)
+}
+
+func (sb *slowBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// gaugeStatser keeps the last value of each gauge by name.
+type gaugeStatser struct {
+	statser.Statser
+	mu     sync.Mutex
+	gauges map[string]float64
+}
+
+func (gs *gaugeStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	gs.mu.Lock()
+	gs.gauges[name] = value
+	gs.mu.Unlock()
+}
+
+func TestFlusherOverrun(t *testing.T) {
+	t.Parallel()
+	const flushInterval = 50 * time.Millisecond
+	backend := &slowBackend{delay: 120 * time.Millisecond}
+	agg := &flushRecorder{
+		MetricAggregator: NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil),
+	}
+	agg.Receive(&gostatsd.Metric{Name: "c", Value: 100, Type: gostatsd.COUNTER, Rate: 1}, time.Now())
+	st := &gaugeStatser{Statser: statser.NewNullStatser(), gauges: map[string]float64{}}
+	fl := NewMetricFlusher(flushInterval, &singleAggregator{agg: agg}, nil, []gostatsd.Backend{backend}, "host", false, false, nil, nil, nil, st)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*flushInterval)
+	defer cancel()
+	fl.Run(ctx)
+
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+	assert.EqualValues(t, 1, backend.maxInFlight)
+	if !assert.True(t, len(agg.intervals) >= 3, "%d flushes", len(agg.intervals)) {
+		return
+	}
+	assert.EqualValues(t, len(agg.intervals), st.gauges["flusher.flush_overruns"])
+	for i := 1; i < len(agg.intervals); i++ {
+		// Each interval covers the whole time since the previous flush, including the skipped tick.
+		gap := agg.times[i].Sub(agg.times[i-1])
+		assert.True(t, agg.intervals[i] > backend.delay, "interval %s", agg.intervals[i])
+		assert.InDelta(t, float64(gap), float64(agg.intervals[i]), float64(flushInterval/2), "interval %s, gap %s", agg.intervals[i], gap)
+	}
+	// The first flush counts the received value, and the rate is exact for the interval it was flushed with.
+	assert.EqualValues(t, 100, backend.counters[0].Value)
+	assert.Equal(t, 100/agg.intervals[0].Seconds(), backend.counters[0].PerSecond)
+}
+
+// gaugeBackend keeps the gauges it was sent, across all maps.
+type gaugeBackend struct {
+	mu     sync.Mutex
+	gauges gostatsd.Gauges
+}
+
+func (gb *gaugeBackend) Name() string {
+	return "gauge"
+}
+
+func (gb *gaugeBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	gb.mu.Lock()
+	for name, gauges := range m.Gauges {
+		gb.gauges[name] = gauges
+	}
+	gb.mu.Unlock()
+	cb(nil)
+}
+
+func (gb *gaugeBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestFlusherDerivedMetrics(t *testing.T) {
+	t.Parallel()
+	backend := &gaugeBackend{gauges: gostatsd.Gauges{}}
+	derived := NewDerivedMetrics([]DerivedMetric{
+		{Rule: "rate", Name: "error_rate", Op: DerivedRatio, Inputs: []string{"errors", "requests"}, DivideByZero: DivideByZeroSkip},
+	})
+	agg := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+	fl := NewMetricFlusher(0, &singleAggregator{agg: agg}, nil, []gostatsd.Backend{backend}, "host", false, false, derived, nil, nil, statser.NewNullStatser())
+
+	now := time.Now()
+	agg.Receive(&gostatsd.Metric{Name: "errors", Value: 1, Type: gostatsd.COUNTER, Rate: 1}, now)
+	agg.Receive(&gostatsd.Metric{Name: "requests", Value: 4, Type: gostatsd.COUNTER, Rate: 1}, now)
+	fl.flushData(context.Background(), time.Second, 0)
+
+	assert.Equal(t, 0.25, backend.gauges["error_rate"][""].Value)
+	assert.Equal(t, "host", backend.gauges["error_rate"][""].Hostname)
+}
+
+func TestFlusherTimerRate(t *testing.T) {
+	t.Parallel()
+	for _, interval := range []time.Duration{500 * time.Millisecond, time.Second, 10 * time.Second} {
+		backend := &gaugeBackend{gauges: gostatsd.Gauges{}}
+		agg := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+		fl := NewMetricFlusher(0, &singleAggregator{agg: agg}, nil, []gostatsd.Backend{backend}, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+		fl.timerRate = true
+
+		now := time.Now()
+		for i := 0; i < 20; i++ {
+			agg.Receive(&gostatsd.Metric{Name: "latency", Value: float64(i), Type: gostatsd.TIMER, Rate: 1, Tags: gostatsd.Tags{"a:b"}, TagsKey: "a:b"}, now)
+		}
+		agg.Receive(&gostatsd.Metric{Name: "sampled", Value: 1, Type: gostatsd.TIMER, Rate: 0.25}, now)
+		fl.flushData(context.Background(), interval, 0)
+
+		assert.InDelta(t, 20/interval.Seconds(), backend.gauges["latency.rate"]["a:b"].Value, 1e-9, interval.String())
+		assert.Equal(t, gostatsd.Tags{"a:b"}, backend.gauges["latency.rate"]["a:b"].Tags)
+		assert.InDelta(t, 4/interval.Seconds(), backend.gauges["sampled.rate"][""].Value, 1e-9, interval.String())
+	}
+}
+
+// panickingBackend panics sending metrics, in SendMetricsAsync or in the goroutine it sends from.
+type panickingBackend struct {
+	async bool
+}
+
+func (pb *panickingBackend) Name() string {
+	return "panicking"
+}
+
+func (pb *panickingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	if !pb.async {
+		panic("boom")
+	}
+	gostatsd.Go(ctx, "backend_panicking", func() {
+		defer cb([]error{errors.New("send panicked")})
+		panic("boom")
+	})
+}
+
+func (pb *panickingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestFlusherRecoversBackendPanic(t *testing.T) {
+	t.Parallel()
+	for _, async := range []bool{false, true} {
+		sup := NewSupervisor(0)
+		ctx := gostatsd.WithGoRunner(context.Background(), sup)
+		backend := &gaugeBackend{gauges: gostatsd.Gauges{}}
+		agg := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+		fl := NewMetricFlusher(0, &singleAggregator{agg: agg}, nil, []gostatsd.Backend{&panickingBackend{async: async}, backend}, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+		fl.supervisor = sup
+
+		agg.Receive(&gostatsd.Metric{Name: "g", Value: 3, Type: gostatsd.GAUGE}, time.Now())
+		fl.flushData(ctx, time.Second, 0)
+
+		// The other backend is sent the flush, and the panic is counted under the backend.
+		assert.Equal(t, 3.0, backend.gauges["g"][""].Value)
+		require.Eventually(t, func() bool {
+			sup.mu.Lock()
+			defer sup.mu.Unlock()
+			cs := sup.components["backend_panicking"]
+			return cs != nil && cs.panics == 1
+		}, time.Second, time.Millisecond, "async %t", async)
+		assert.NoError(t, sup.Err())
+		assert.NotZero(t, fl.lastFlushError)
+	}
+}
+
+func TestFlusherMeasureInterval(t *testing.T) {
+	t.Parallel()
+	fl := NewMetricFlusher(time.Second, nil, nil, nil, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+	last := time.Unix(1000, 0)
+	assert.Equal(t, 1500*time.Millisecond, fl.measureInterval(last, last.Add(1500*time.Millisecond), time.Second))
+	// The first flush after a warmup is expected to be longer than the flush interval.
+	assert.Equal(t, 15*time.Second, fl.measureInterval(last, last.Add(15*time.Second), 2*time.Second))
+	assert.Zero(t, fl.clockJumps)
+
+	// Backward and forward jumps are replaced by the flush interval.
+	assert.Equal(t, time.Second, fl.measureInterval(last, last.Add(-time.Hour), time.Second))
+	assert.Equal(t, time.Second, fl.measureInterval(last, last, time.Second))
+	assert.Equal(t, time.Second, fl.measureInterval(last, last.Add(24*time.Hour), time.Second))
+	assert.EqualValues(t, 3, fl.clockJumps)
+}
+
+func TestFlusherSlowFlushes(t *testing.T) {
+	t.Parallel()
+	logger, hook := test.NewNullLogger()
+	fl := NewMetricFlusher(time.Second, nil, nil, nil, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+	fl.logger = logger
+
+	// A single slow flush is averaged with the fast ones around it.
+	for _, d := range []time.Duration{100, 2000, 100, 100, 100, 100} {
+		fl.checkFlushDuration(d * time.Millisecond)
+	}
+	assert.Zero(t, fl.slowFlushes)
+	assert.Empty(t, hook.AllEntries())
+
+	// The average of the last 5 flushes is 520ms, more than half of the interval.
+	for _, d := range []time.Duration{500, 600, 500, 700, 300} {
+		fl.checkFlushDuration(d * time.Millisecond)
+	}
+	assert.EqualValues(t, 1, fl.slowFlushes)
+	require.Len(t, hook.AllEntries(), 1)
+	entry := hook.LastEntry()
+	assert.Equal(t, 520*time.Millisecond, entry.Data[logging.FieldDuration])
+	assert.Contains(t, entry.Message, "52% of the flush interval of 1s")
+
+	// The warning is repeated at most every 5 flushes.
+	for i := 0; i < 4; i++ {
+		fl.checkFlushDuration(900 * time.Millisecond)
+	}
+	assert.EqualValues(t, 1, fl.slowFlushes)
+	fl.checkFlushDuration(900 * time.Millisecond)
+	assert.EqualValues(t, 2, fl.slowFlushes)
+}
+
+// jumpingClock is a wall clock without a monotonic reading, which can be stepped like NTP would.
+type jumpingClock struct {
+	mu     sync.Mutex
+	offset time.Duration
+}
+
+func (jc *jumpingClock) now() time.Time {
+	jc.mu.Lock()
+	defer jc.mu.Unlock()
+	return time.Now().Round(0).Add(jc.offset)
+}
+
+func (jc *jumpingClock) step(d time.Duration) {
+	jc.mu.Lock()
+	jc.offset += d
+	jc.mu.Unlock()
+}
+
+func TestFlusherClockJumps(t *testing.T) {
+	t.Parallel()
+	const flushInterval = 20 * time.Millisecond
+	backend := &slowBackend{}
+	agg := &flushRecorder{
+		MetricAggregator: NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil),
+	}
+	st := &gaugeStatser{Statser: statser.NewNullStatser(), gauges: map[string]float64{}}
+	fl := NewMetricFlusher(flushInterval, &singleAggregator{agg: agg}, nil, []gostatsd.Backend{backend}, "host", false, false, nil, nil, nil, st)
+	clock := &jumpingClock{}
+	fl.now = clock.now
+
+	flushes := func() int {
+		agg.mu.Lock()
+		defer agg.mu.Unlock()
+		return len(agg.intervals)
+	}
+	waitForFlush := func(n int) {
+		for flushes() < n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		fl.Run(ctx)
+		close(done)
+	}()
+	waitForFlush(1)
+	clock.step(-time.Hour)
+	waitForFlush(2)
+	clock.step(24 * time.Hour)
+	waitForFlush(4)
+	cancel()
+	<-done
+
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+	for _, interval := range agg.intervals {
+		assert.True(t, interval > 0 && interval <= maxFlushIntervalFactor*flushInterval, "interval %s", interval)
+	}
+	assert.EqualValues(t, 2, st.gauges["flusher.clock_jumps"])
+}
+
+// sizeBackend counts the metrics it was sent, across all maps.
+type sizeBackend struct {
+	name    string
+	mu      sync.Mutex
+	metrics int
+}
+
+func (sb *sizeBackend) Name() string {
+	return sb.name
+}
+
+func (sb *sizeBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	sb.mu.Lock()
+	m.EachCounter(func(string, string, gostatsd.Counter) { sb.metrics++ })
+	m.EachTimer(func(string, string, gostatsd.Timer) { sb.metrics++ })
+	m.EachGauge(func(string, string, gostatsd.Gauge) { sb.metrics++ })
+	m.EachSet(func(string, string, gostatsd.Set) { sb.metrics++ })
+	sb.mu.Unlock()
+	cb(nil)
+}
+
+func (sb *sizeBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// taggedGaugeStatser keeps the last value of each gauge by name and tags.
+type taggedGaugeStatser struct {
+	statser.Statser
+	mu     sync.Mutex
+	gauges map[string]float64
+}
+
+func (gs *taggedGaugeStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	gs.mu.Lock()
+	gs.gauges[name+"|"+strings.Join(tags, ",")] = value
+	gs.mu.Unlock()
+}
+
+func TestFlusherFlushCount(t *testing.T) {
+	t.Parallel()
+	backends := []gostatsd.Backend{&sizeBackend{name: "first"}, &sizeBackend{name: "second"}}
+	derived := NewDerivedMetrics([]DerivedMetric{
+		{Rule: "rate", Name: "error_rate", Op: DerivedRatio, Inputs: []string{"errors", "requests"}, DivideByZero: DivideByZeroSkip},
+	})
+	agg := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+	st := &taggedGaugeStatser{Statser: statser.NewNullStatser(), gauges: map[string]float64{}}
+	fl := NewMetricFlusher(0, &singleAggregator{agg: agg}, nil, backends, "host", false, false, derived, nil, nil, st)
+
+	now := time.Now()
+	agg.Receive(&gostatsd.Metric{Name: "errors", Value: 1, Type: gostatsd.COUNTER, Rate: 1}, now)
+	agg.Receive(&gostatsd.Metric{Name: "errors", Value: 1, Type: gostatsd.COUNTER, Rate: 1, Tags: gostatsd.Tags{"a:b"}, TagsKey: "a:b"}, now)
+	agg.Receive(&gostatsd.Metric{Name: "requests", Value: 4, Type: gostatsd.COUNTER, Rate: 1}, now)
+	agg.Receive(&gostatsd.Metric{Name: "t", Value: 1, Type: gostatsd.TIMER, Rate: 1}, now)
+	agg.Receive(&gostatsd.Metric{Name: "s", StringValue: "x", Type: gostatsd.SET, Rate: 1}, now)
+	fl.flushData(context.Background(), time.Second, 0)
+
+	// The count covers every map sent in the flush, including the derived metrics.
+	for _, b := range backends {
+		sb := b.(*sizeBackend)
+		assert.Equal(t, 6, sb.metrics, sb.name)
+		assert.EqualValues(t, sb.metrics, st.gauges["flush.count|backend:"+sb.name], sb.name)
+	}
+}
+
+// rateBackend records the rates of the counter "c" and timer "t", and the intervals of each map it was sent.
+type rateBackend struct {
+	mu        sync.Mutex
+	counters  []gostatsd.Counter
+	timers    []gostatsd.Timer
+	intervals []time.Duration
+	nominal   []time.Duration
+}
+
+func (rb *rateBackend) Name() string {
+	return "rate"
+}
+
+func (rb *rateBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	rb.mu.Lock()
+	if c, ok := m.Counters["c"][""]; ok {
+		rb.counters = append(rb.counters, c)
+		rb.intervals = append(rb.intervals, m.Interval)
+		rb.nominal = append(rb.nominal, m.NominalInterval)
+	}
+	if t, ok := m.Timers["t"][""]; ok {
+		rb.timers = append(rb.timers, t)
+	}
+	rb.mu.Unlock()
+	cb(nil)
+}
+
+func (rb *rateBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestFlusherRatesWithLateTicks(t *testing.T) {
+	t.Parallel()
+	const flushInterval = time.Second
+	backend := &rateBackend{}
+	agg := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+	fl := NewMetricFlusher(flushInterval, &singleAggregator{agg: agg}, nil, []gostatsd.Backend{backend}, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+	now := time.Unix(1000, 0)
+	fl.now = func() time.Time { return now }
+
+	// Ticks which are on time, jittered, skipped while descheduled, and fired twice in quick succession.
+	gaps := []time.Duration{
+		flushInterval,
+		1100 * time.Millisecond,
+		900 * time.Millisecond,
+		3 * flushInterval,
+		10 * time.Millisecond,
+		1990 * time.Millisecond,
+		flushInterval,
+	}
+	// Metrics arrive at a steady 100 per second throughout.
+	const perSecond = 100
+	lastFlush := now
+	total := 0
+	for _, gap := range gaps {
+		n := int(perSecond * gap.Seconds())
+		total += n
+		agg.Receive(&gostatsd.Metric{Name: "c", Value: float64(n), Type: gostatsd.COUNTER, Rate: 1}, time.Now())
+		for i := 0; i < n; i++ {
+			agg.Receive(&gostatsd.Metric{Name: "t", Value: 1, Type: gostatsd.TIMER, Rate: 1}, time.Now())
+		}
+		now = now.Add(gap)
+		var interval time.Duration
+		lastFlush, interval = fl.flushSince(context.Background(), lastFlush, flushInterval)
+		assert.Equal(t, gap, interval)
+	}
+
+	require.Len(t, backend.counters, len(gaps))
+	require.Len(t, backend.timers, len(gaps))
+	var counterIntegral, timerIntegral float64
+	for i, gap := range gaps {
+		assert.Equal(t, gap, backend.intervals[i])
+		assert.Equal(t, flushInterval, backend.nominal[i])
+		// The rate is the same in every flush, however late the tick.
+		assert.InDelta(t, perSecond, backend.counters[i].PerSecond, 0.01, "flush %d", i)
+		assert.InDelta(t, perSecond, backend.timers[i].PerSecond, 0.01, "flush %d", i)
+		counterIntegral += backend.counters[i].PerSecond * backend.intervals[i].Seconds()
+		timerIntegral += backend.timers[i].PerSecond * backend.intervals[i].Seconds()
+	}
+	assert.InDelta(t, float64(total), counterIntegral, 1e-6)
+	assert.InDelta(t, float64(total), timerIntegral, 1e-6)
+}
+
+func TestFlusherWarmup(t *testing.T) {
+	t.Parallel()
+	const flushInterval = 20 * time.Millisecond
+	const warmup = 100 * time.Millisecond
+	agg := &flushRecorder{
+		MetricAggregator: NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil),
+	}
+	fl := NewMetricFlusher(flushInterval, &singleAggregator{agg: agg}, nil, []gostatsd.Backend{&slowBackend{}}, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+	fl.warmup = warmup
+
+	flushes := func() int {
+		agg.mu.Lock()
+		defer agg.mu.Unlock()
+		return len(agg.intervals)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		fl.Run(ctx)
+		close(done)
+	}()
+	for flushes() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+	// The first flush is delayed by the warmup, and its rates cover the warmup as well as the first interval.
+	assert.True(t, agg.times[0].Sub(start) >= warmup+flushInterval, "first flush after %s", agg.times[0].Sub(start))
+	assert.True(t, agg.intervals[0] >= warmup+flushInterval, "first interval %s", agg.intervals[0])
+	assert.True(t, agg.intervals[1] < warmup, "second interval %s", agg.intervals[1])
+	assert.Zero(t, fl.clockJumps)
+}
+
+// sequenceBackend keeps the sequence number and part of each flush it was sent.
+type sequenceBackend struct {
+	mu   sync.Mutex
+	sent [][2]uint64
+}
+
+func (sb *sequenceBackend) Name() string {
+	return "sequence"
+}
+
+func (sb *sequenceBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	sb.mu.Lock()
+	sb.sent = append(sb.sent, [2]uint64{m.Sequence, uint64(m.Part)})
+	sb.mu.Unlock()
+	cb(nil)
+}
+
+func (sb *sequenceBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestFlusherSequence(t *testing.T) {
+	t.Parallel()
+	backend := &sequenceBackend{}
+	derived := NewDerivedMetrics([]DerivedMetric{
+		{Rule: "rate", Name: "error_rate", Op: DerivedRatio, Inputs: []string{"errors", "requests"}, DivideByZero: DivideByZeroSkip},
+	})
+	agg := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+	fl := NewMetricFlusher(0, &singleAggregator{agg: agg}, nil, []gostatsd.Backend{backend}, "host", false, false, derived, nil, nil, statser.NewNullStatser())
+
+	fl.flushData(context.Background(), time.Second, 0)
+	fl.flushData(context.Background(), time.Second, 0)
+
+	// Each flush sends the aggregator's snapshot then the derived metrics, numbered by interval and part.
+	assert.Equal(t, [][2]uint64{{1, 0}, {1, 1}, {2, 0}, {2, 1}}, backend.sent)
+}
+
+// flakyBackend keeps the sequence number and part of each flush it was sent, and fails the first send of one part.
+type flakyBackend struct {
+	sequenceBackend
+	failSequence uint64
+	failPart     int
+	failed       bool
+}
+
+func (fb *flakyBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	fb.sequenceBackend.SendMetricsAsync(ctx, m, func(errs []error) {
+		fb.mu.Lock()
+		fail := !fb.failed && m.Sequence == fb.failSequence && m.Part == fb.failPart
+		fb.failed = fb.failed || fail
+		fb.mu.Unlock()
+		if fail {
+			cb([]error{errors.New("send failed")})
+			return
+		}
+		cb(errs)
+	})
+}
+
+func TestFlusherRetriesFailedFlush(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		sequenced bool
+		expected  [][2]uint64
+	}{
+		// Retrying the flush sends the part which was sent successfully twice.
+		{name: "plain", expected: [][2]uint64{{1, 0}, {1, 1}, {1, 0}, {1, 1}, {2, 0}, {2, 1}}},
+		// A SequencedBackend skips the part it has already acknowledged, so only the failed part is sent again.
+		{name: "sequenced", sequenced: true, expected: [][2]uint64{{1, 0}, {1, 1}, {1, 1}, {2, 0}, {2, 1}}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			flaky := &flakyBackend{failSequence: 1, failPart: 1}
+			var backend gostatsd.Backend = flaky
+			if test.sequenced {
+				backend = backends.NewSequencedBackend("flaky", flaky)
+			}
+			derived := NewDerivedMetrics([]DerivedMetric{
+				{Rule: "rate", Name: "error_rate", Op: DerivedRatio, Inputs: []string{"errors", "requests"}, DivideByZero: DivideByZeroSkip},
+			})
+			agg := NewMetricAggregator(aggregation.Options{ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+			fl := NewMetricFlusher(0, &singleAggregator{agg: agg}, nil, []gostatsd.Backend{backend}, "host", false, false, derived, nil, nil, statser.NewNullStatser())
+			fl.retryFailed = true
+
+			fl.flushData(context.Background(), time.Second, 0)
+			fl.flushData(context.Background(), time.Second, 0)
+			fl.flushData(context.Background(), time.Second, 0)
+
+			// The failed flush is sent again before the next flush, which is sent as usual.
+			assert.Equal(t, append(test.expected, [2]uint64{3, 0}, [2]uint64{3, 1}), flaky.sent)
+		})
+	}
+}
+
+// mapBackend keeps a copy of each MetricMap it was sent.
+type mapBackend struct {
+	mu   sync.Mutex
+	sent []*gostatsd.MetricMap
+}
+
+func (mb *mapBackend) Name() string {
+	return "map"
+}
+
+func (mb *mapBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	mb.mu.Lock()
+	mb.sent = append(mb.sent, m.Copy())
+	mb.mu.Unlock()
+	cb(nil)
+}
+
+func (mb *mapBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+type backfillBackend struct {
+	mapBackend
+}
+
+func (bb *backfillBackend) WantsBackfill() bool {
+	return true
+}
+
+func TestFlusherLateArrivals(t *testing.T) {
+	t.Parallel()
+	plain := &mapBackend{}
+	backfill := &backfillBackend{}
+	backends := []gostatsd.Backend{plain, backfill}
+
+	start := time.Unix(1000, 0)
+	at := func(d time.Duration) time.Time {
+		return start.Add(d)
+	}
+	agg := NewMetricAggregator(aggregation.Options{ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+	agg.LateArrivalWindow = 5 * time.Second
+	fl := NewMetricFlusher(0, &singleAggregator{agg: agg}, nil, backends, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+	agg.now = func() time.Time { return start }
+	agg.Reset()
+
+	hits := func(value float64, received time.Time) *gostatsd.Metric {
+		return &gostatsd.Metric{Name: "hits", Value: value, Type: gostatsd.COUNTER, Rate: 1, Timestamp: gostatsd.Nanotime(received.UnixNano())}
+	}
+	agg.Receive(hits(1, at(5*time.Second)), at(5*time.Second))
+	agg.now = func() time.Time { return at(10 * time.Second) }
+	fl.flushData(context.Background(), 10*time.Second, 0)
+
+	// Received just before the flush, but only reached the aggregator after it.
+	late := at(9900 * time.Millisecond)
+	agg.Receive(hits(2, late), at(10100*time.Millisecond))
+	agg.Receive(hits(3, at(11*time.Second)), at(11*time.Second))
+	agg.now = func() time.Time { return at(20 * time.Second) }
+	fl.flushData(context.Background(), 10*time.Second, 0)
+
+	require.Len(t, plain.sent, 2)
+	assert.EqualValues(t, 1, plain.sent[0].Counters["hits"][""].Value)
+	assert.EqualValues(t, 3, plain.sent[1].Counters["hits"][""].Value)
+	assert.False(t, plain.sent[1].Late)
+
+	require.Len(t, backfill.sent, 3)
+	assert.EqualValues(t, 3, backfill.sent[1].Counters["hits"][""].Value)
+	lateMap := backfill.sent[2]
+	assert.True(t, lateMap.Late)
+	assert.Equal(t, 10*time.Second, lateMap.Interval)
+	assert.EqualValues(t, 2, lateMap.Sequence)
+	assert.Equal(t, gostatsd.Counter{Value: 2, PerSecond: 0.2, Timestamp: gostatsd.Nanotime(late.UnixNano())}, lateMap.Counters["hits"][""])
+	assert.EqualValues(t, 1, agg.LateMetrics())
+}
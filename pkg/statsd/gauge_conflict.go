@@ -0,0 +1,81 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
+)
+
+// GaugeConflictRule is the policy of gauges with a name matching a pattern.
+type GaugeConflictRule struct {
+	Match  string
+	Policy string
+
+	match gostatsd.StringMatch
+}
+
+func (r GaugeConflictRule) String() string {
+	return r.Match + "=" + r.Policy
+}
+
+// GaugeConflicts decides which value is flushed for a gauge updated more than once in the flush interval, by the
+// first rule with a pattern matching its name.  Gauges which match no rule are flushed with the last value received.
+// A nil *GaugeConflicts flushes the last value of every gauge.
+type GaugeConflicts struct {
+	rules []GaugeConflictRule
+}
+
+// NewGaugeConflicts creates a GaugeConflicts from rules such as `cluster.size=max`, of a gauge name pattern and a
+// policy, where a trailing * in the pattern matches any suffix.
+func NewGaugeConflicts(rules []string) (*GaugeConflicts, error) {
+	gc := &GaugeConflicts{}
+	for _, rule := range rules {
+		idx := strings.LastIndexByte(rule, '=')
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid gauge conflict rule %q, expected <pattern>=<policy>", rule)
+		}
+		r := GaugeConflictRule{Match: rule[:idx], Policy: rule[idx+1:]}
+		switch r.Policy {
+		case aggregation.GaugeConflictLast, aggregation.GaugeConflictMax, aggregation.GaugeConflictMin, aggregation.GaugeConflictMean, aggregation.GaugeConflictSum:
+		default:
+			return nil, fmt.Errorf("unknown gauge conflict policy %q in rule %q, must be %s, %s, %s, %s or %s", r.Policy, rule,
+				aggregation.GaugeConflictLast, aggregation.GaugeConflictMax, aggregation.GaugeConflictMin, aggregation.GaugeConflictMean, aggregation.GaugeConflictSum)
+		}
+		r.match = gostatsd.NewStringMatch(r.Match)
+		gc.rules = append(gc.rules, r)
+	}
+	return gc, nil
+}
+
+// Policy returns the policy of the gauge name.
+func (gc *GaugeConflicts) Policy(name string) string {
+	if gc != nil {
+		for _, rule := range gc.rules {
+			if rule.match.Match(name) {
+				return rule.Policy
+			}
+		}
+	}
+	return aggregation.GaugeConflictLast
+}
+
+// RulesCommand is the console command to show the gauge conflict rules.
+func (gc *GaugeConflicts) RulesCommand(ctx context.Context, args []string, w io.Writer) error {
+	if gc == nil || len(gc.rules) == 0 {
+		_, err := fmt.Fprintf(w, "No gauge conflict rules, every gauge is flushed with its last value, see --%s\n", ParamGaugeConflict)
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%d rules, the first matching wins, other gauges are flushed with their last value\n", len(gc.rules)); err != nil {
+		return err
+	}
+	for _, rule := range gc.rules {
+		if _, err := fmt.Fprintln(w, rule.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
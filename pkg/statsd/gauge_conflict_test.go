@@ -0,0 +1,77 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewGaugeConflicts(t *testing.T) {
+	t.Parallel()
+	gc, err := NewGaugeConflicts([]string{"cluster.size=max", "queue.*=mean", "queue.depth=sum"})
+	require.NoError(t, err)
+	assert.Equal(t, aggregation.GaugeConflictMax, gc.Policy("cluster.size"))
+	assert.Equal(t, aggregation.GaugeConflictMean, gc.Policy("queue.depth"), "the first matching rule wins")
+	assert.Equal(t, aggregation.GaugeConflictLast, gc.Policy("cluster.nodes"))
+
+	var none *GaugeConflicts
+	assert.Equal(t, aggregation.GaugeConflictLast, none.Policy("cluster.size"))
+
+	for _, rule := range []string{"cluster.size", "=max", "cluster.size=median", "cluster.size="} {
+		_, err := NewGaugeConflicts([]string{rule})
+		assert.Error(t, err, rule)
+	}
+}
+
+func TestGaugeConflictsAggregation(t *testing.T) {
+	t.Parallel()
+	gc, err := NewGaugeConflicts([]string{"max=max", "min=min", "mean=mean", "sum=sum", "last=last"})
+	require.NoError(t, err)
+	ma := NewMetricAggregator(aggregation.Options{ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+	ma.GaugeConflicts = gc
+	now := time.Now()
+
+	for _, name := range []string{"max", "min", "mean", "sum", "last", "other"} {
+		for _, v := range []float64{4, 9, 2} {
+			ma.Receive(&gostatsd.Metric{Name: name, Value: v, Type: gostatsd.GAUGE, Rate: 1}, now)
+		}
+	}
+	ma.Flush(10 * time.Second)
+	for name, expected := range map[string]float64{"max": 9, "min": 2, "mean": 5, "sum": 15, "last": 2, "other": 2} {
+		assert.Equal(t, expected, ma.Gauges[name][""].Value, name)
+	}
+	ma.Reset()
+
+	// The gauge keeps its last value for the next interval, and the policy applies to the values received in it only.
+	assert.Equal(t, 2.0, ma.Gauges["sum"][""].Value)
+	ma.Receive(&gostatsd.Metric{Name: "sum", Value: 3, GaugeDelta: true, Type: gostatsd.GAUGE, Rate: 1}, now)
+	ma.Receive(&gostatsd.Metric{Name: "sum", Value: 1, Type: gostatsd.GAUGE, Rate: 1}, now)
+	value, ok := flushGauge(ma, "sum", 10*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 6.0, value)
+	value, _ = flushGauge(ma, "max", 10*time.Second)
+	assert.Equal(t, 2.0, value, "a gauge not updated in the interval is flushed with its last value")
+}
+
+func TestGaugeConflictsRulesCommand(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	var none *GaugeConflicts
+	require.NoError(t, none.RulesCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "No gauge conflict rules, every gauge is flushed with its last value, see --gauge-conflict\n", buf.String())
+
+	gc, err := NewGaugeConflicts([]string{"cluster.*=max", "queue.depth=mean"})
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, gc.RulesCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "2 rules, the first matching wins, other gauges are flushed with their last value\n"+
+		"cluster.*=max\n"+
+		"queue.depth=mean\n", buf.String())
+}
@@ -0,0 +1,173 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// GaugeDeltasOn changes a gauge by a value with an explicit sign, as statsd does, so `+5` adds 5 and `-5`
+	// subtracts 5.
+	GaugeDeltasOn = "on"
+	// GaugeDeltasOff sets a gauge to a value with an explicit sign, so `+5` sets it to 5 and `-5` sets it to -5.
+	GaugeDeltasOff = "off"
+)
+
+// GaugeDeltaRule is whether signed values of gauges with a name matching the glob are deltas.
+type GaugeDeltaRule struct {
+	Name   string
+	Deltas string
+}
+
+func (r GaugeDeltaRule) String() string {
+	return r.Name + " " + r.Deltas
+}
+
+// GaugeDeltas decides whether a gauge value with an explicit sign, such as `+5` or `-5`, changes the gauge by that
+// amount or sets it, by the first matching rule of a list loaded from a file, and reloaded when the process receives
+// SIGHUP.  A value without a sign always sets the gauge.  Gauges which match no rule are changed, as in statsd.  A nil
+// *GaugeDeltas changes every gauge with a signed value.
+type GaugeDeltas struct {
+	absolute uint64 // Must be read/written only using atomic instructions.
+
+	path   string
+	rules  atomic.Value // []GaugeDeltaRule
+	logger log.FieldLogger
+}
+
+// NewGaugeDeltas loads the gauge delta rules from the file at path.
+func NewGaugeDeltas(path string, logger log.FieldLogger) (*GaugeDeltas, error) {
+	gd := &GaugeDeltas{
+		path:   path,
+		logger: logger,
+	}
+	if err := gd.Reload(); err != nil {
+		return nil, err
+	}
+	return gd, nil
+}
+
+// Reload reads the file again, replacing the current rules.  The current rules are kept if there is an error.
+func (gd *GaugeDeltas) Reload() error {
+	f, err := os.Open(gd.path)
+	if err != nil {
+		return fmt.Errorf("failed to open gauge delta rules: %v", err)
+	}
+	defer f.Close()
+	rules, err := ParseGaugeDeltaRules(f)
+	if err != nil {
+		return fmt.Errorf("failed to read gauge delta rules %s: %v", gd.path, err)
+	}
+	gd.rules.Store(rules)
+	gd.logger.Infof("Loaded %d gauge delta rules from %s", len(rules), gd.path)
+	return nil
+}
+
+// Run reloads the rules each time the process receives SIGHUP, until the context is done.
+func (gd *GaugeDeltas) Run(ctx context.Context) {
+	runReloadOnSIGHUP(ctx, "gauge delta rules", gd.Reload, gd.logger)
+}
+
+// Enabled returns true if a signed value of the gauge named name is a delta.
+func (gd *GaugeDeltas) Enabled(name string) bool {
+	if gd == nil {
+		return true
+	}
+	for _, rule := range gd.rules.Load().([]GaugeDeltaRule) {
+		if ok, _ := path.Match(rule.Name, name); ok {
+			return rule.Deltas == GaugeDeltasOn
+		}
+	}
+	return true
+}
+
+// apply turns a gauge delta into a value which sets the gauge if the rules say its signed values are not deltas.
+func (gd *GaugeDeltas) apply(m *gostatsd.Metric) {
+	if gd == nil || !m.GaugeDelta {
+		return
+	}
+	if !gd.Enabled(m.Name) {
+		atomic.AddUint64(&gd.absolute, 1)
+		m.GaugeDelta = false
+	}
+}
+
+func (gd *GaugeDeltas) emit(statser statser.Statser) {
+	if gd == nil {
+		return
+	}
+	statser.Gauge("parser.gauge_deltas_absolute", float64(atomic.LoadUint64(&gd.absolute)), nil)
+}
+
+// RulesCommand is the console command to show the gauge delta rules.
+func (gd *GaugeDeltas) RulesCommand(ctx context.Context, args []string, w io.Writer) error {
+	if gd == nil {
+		_, err := fmt.Fprintf(w, "No gauge delta rules, every signed gauge value is a delta, see --%s\n", ParamGaugeDeltaRules)
+		return err
+	}
+	rules := gd.rules.Load().([]GaugeDeltaRule)
+	if _, err := fmt.Fprintf(w, "%d rules from %s, %d signed gauge values set rather than added\n", len(rules), gd.path, atomic.LoadUint64(&gd.absolute)); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if _, err := fmt.Fprintln(w, rule.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReloadCommand is the console command to reload the gauge delta rules.
+func (gd *GaugeDeltas) ReloadCommand(ctx context.Context, args []string, w io.Writer) error {
+	if gd == nil {
+		return fmt.Errorf("no gauge delta rules, see --%s", ParamGaugeDeltaRules)
+	}
+	if err := gd.Reload(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "Loaded %d gauge delta rules\n", len(gd.rules.Load().([]GaugeDeltaRule)))
+	return err
+}
+
+// ParseGaugeDeltaRules parses a list with a rule per line, such as `legacy.* off`, of a name glob followed by `on` or
+// `off`.  Blank lines and anything after a # are ignored.
+func ParseGaugeDeltaRules(r io.Reader) ([]GaugeDeltaRule, error) {
+	rules := []GaugeDeltaRule{}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a name glob followed by %s or %s", lineNo, GaugeDeltasOn, GaugeDeltasOff)
+		}
+		rule := GaugeDeltaRule{Name: fields[0], Deltas: fields[1]}
+		if _, err := path.Match(rule.Name, ""); err != nil {
+			return nil, fmt.Errorf("line %d: invalid name glob %q", lineNo, rule.Name)
+		}
+		if rule.Deltas != GaugeDeltasOn && rule.Deltas != GaugeDeltasOff {
+			return nil, fmt.Errorf("line %d: unknown gauge delta setting %q, must be %s or %s", lineNo, rule.Deltas, GaugeDeltasOn, GaugeDeltasOff)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
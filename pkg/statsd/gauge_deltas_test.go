@@ -0,0 +1,120 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGaugeDeltasEnabled(t *testing.T) {
+	t.Parallel()
+	rules, err := ParseGaugeDeltaRules(strings.NewReader(`
+# Legacy client which sends negative gauges as they are
+legacy.special on
+legacy.* off # everyone else is expected to have migrated
+`))
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, "legacy.* off", rules[1].String())
+	gd := &GaugeDeltas{}
+	gd.rules.Store(rules)
+
+	assert.True(t, gd.Enabled("legacy.special"))
+	assert.False(t, gd.Enabled("legacy.temp"))
+	assert.True(t, gd.Enabled("new.temp"))
+
+	var none *GaugeDeltas
+	assert.True(t, none.Enabled("legacy.temp"))
+}
+
+func TestParseGaugeDeltaRulesInvalid(t *testing.T) {
+	t.Parallel()
+	for _, list := range []string{"a.*", "a.* maybe", "[ off", "a.* off extra", "a.* OFF"} {
+		_, err := ParseGaugeDeltaRules(strings.NewReader(list))
+		assert.Error(t, err, list)
+	}
+}
+
+func TestGaugeDeltasReload(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gauge-deltas")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules")
+	require.NoError(t, ioutil.WriteFile(path, []byte("a.* off\n"), 0600))
+
+	gd, err := NewGaugeDeltas(path, logrus.StandardLogger())
+	require.NoError(t, err)
+	assert.False(t, gd.Enabled("a.b"))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("a.* on\n"), 0600))
+	var buf bytes.Buffer
+	require.NoError(t, gd.ReloadCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "Loaded 1 gauge delta rules\n", buf.String())
+	assert.True(t, gd.Enabled("a.b"))
+
+	// Bad rules keep the current ones
+	require.NoError(t, ioutil.WriteFile(path, []byte("a.* bad\n"), 0600))
+	assert.Error(t, gd.Reload())
+	assert.True(t, gd.Enabled("a.b"))
+
+	buf.Reset()
+	require.NoError(t, gd.RulesCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "1 rules from "+path+", 0 signed gauge values set rather than added\na.* on\n", buf.String())
+}
+
+// TestGaugeDeltaModes documents what each mode does with +5, -5 and 5, sent to a gauge which is already 10 and to one
+// which doesn't exist yet.
+func TestGaugeDeltaModes(t *testing.T) {
+	t.Parallel()
+	rules, err := ParseGaugeDeltaRules(strings.NewReader("off.* off\n"))
+	require.NoError(t, err)
+	gd := &GaugeDeltas{}
+	gd.rules.Store(rules)
+
+	tests := []struct {
+		name     string
+		value    string
+		existing float64 // Value of the gauge if it is 10 before the value is received
+		created  float64 // Value of the gauge if it didn't exist before the value is received
+	}{
+		{"on.level", "+5", 15, 5},
+		{"on.level", "-5", 5, -5},
+		{"on.level", "5", 5, 5},
+		{"off.level", "+5", 5, 5},
+		{"off.level", "-5", -5, -5},
+		{"off.level", "5", 5, 5},
+	}
+	for _, test := range tests {
+		for _, preAggregate := range []bool{false, true} {
+			receive := func(datagram string) float64 {
+				ah := &aggregatingHandler{agg: newFakeAggregator(), now: time.Unix(100, 0)}
+				dp := NewDatagramParser(nil, ah, ah, statser.NewNullStatser(), ParserOptions{PreAggregate: preAggregate, PreAggregateGauges: true})
+				dp.gaugeDeltas = gd
+				_, _, _, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte(datagram), time.Time{}, nil)
+				require.NoError(t, err)
+				require.Len(t, ah.agg.Gauges[test.name], 1)
+				for _, g := range ah.agg.Gauges[test.name] {
+					return g.Value
+				}
+				return 0
+			}
+			line := test.name + ":" + test.value + "|g"
+			assert.Equal(t, test.existing, receive(test.name+":10|g\n"+line), "%s after 10, pre-aggregated %t", line, preAggregate)
+			assert.Equal(t, test.created, receive(line), "%s, pre-aggregated %t", line, preAggregate)
+		}
+	}
+	// Each signed value of an off gauge is counted, twice for each pre-aggregation setting.
+	assert.EqualValues(t, 8, gd.absolute)
+}
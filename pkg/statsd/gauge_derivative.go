@@ -0,0 +1,23 @@
+package statsd
+
+import (
+	"github.com/atlassian/gostatsd"
+)
+
+// GaugeDerivative selects gauges with a name matching a pattern to be flushed as their per-second rate of change,
+// such as gauges reporting the total bytes sent by an interface.  A nil *GaugeDerivative selects nothing.
+type GaugeDerivative struct {
+	match gostatsd.StringMatchList
+}
+
+// NewGaugeDerivative creates a GaugeDerivative which selects gauges with a name matching any of match.
+func NewGaugeDerivative(match []string) *GaugeDerivative {
+	return &GaugeDerivative{
+		match: toStringMatch(match),
+	}
+}
+
+// Matches returns true if the gauge name is flushed as its rate of change.
+func (gd *GaugeDerivative) Matches(name string) bool {
+	return gd != nil && gd.match.MatchAny(name)
+}
@@ -0,0 +1,88 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newDerivativeAggregator(gd *GaugeDerivative) *MetricAggregator {
+	ma := NewMetricAggregator(aggregation.Options{ExpiryInterval: 5 * time.Minute}, nil, nil, nil)
+	ma.GaugeDerivative = gd
+	return ma
+}
+
+// flushGauge flushes ma over interval and returns the value flushed for the gauge, if it was flushed.
+func flushGauge(ma *MetricAggregator, name string, interval time.Duration) (float64, bool) {
+	ma.Flush(interval)
+	g, ok := ma.Gauges[name][""]
+	ma.Reset()
+	return g.Value, ok
+}
+
+func TestGaugeDerivativeMatches(t *testing.T) {
+	t.Parallel()
+	gd := NewGaugeDerivative([]string{"net.bytes.*", "disk.reads"})
+	assert.True(t, gd.Matches("net.bytes.sent"))
+	assert.True(t, gd.Matches("disk.reads"))
+	assert.False(t, gd.Matches("disk.reads.merged"))
+	assert.False(t, gd.Matches("memory"))
+
+	var none *GaugeDerivative
+	assert.False(t, none.Matches("disk.reads"))
+}
+
+func TestGaugeDerivativeIncreasing(t *testing.T) {
+	t.Parallel()
+	ma := newDerivativeAggregator(NewGaugeDerivative([]string{"bytes"}))
+	now := time.Now()
+
+	// The first flush has no previous value, so nothing is flushed.
+	ma.Receive(&gostatsd.Metric{Name: "bytes", Value: 100, Type: gostatsd.GAUGE, Rate: 1}, now)
+	ma.Receive(&gostatsd.Metric{Name: "raw", Value: 100, Type: gostatsd.GAUGE, Rate: 1}, now)
+	_, ok := flushGauge(ma, "bytes", 10*time.Second)
+	assert.False(t, ok)
+
+	ma.Receive(&gostatsd.Metric{Name: "bytes", Value: 150, Type: gostatsd.GAUGE, Rate: 1}, now)
+	value, ok := flushGauge(ma, "bytes", 10*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 5.0, value)
+
+	ma.Receive(&gostatsd.Metric{Name: "bytes", Value: 250, Type: gostatsd.GAUGE, Rate: 1}, now)
+	value, _ = flushGauge(ma, "bytes", 20*time.Second)
+	assert.Equal(t, 5.0, value)
+
+	// The gauge keeps its last value between flushes, so an interval without updates has no change.
+	value, ok = flushGauge(ma, "bytes", 10*time.Second)
+	assert.True(t, ok)
+	assert.Zero(t, value)
+	assert.Equal(t, 250.0, ma.Gauges["bytes"][""].Value)
+
+	value, _ = flushGauge(ma, "raw", 10*time.Second)
+	assert.Equal(t, 100.0, value)
+}
+
+func TestGaugeDerivativeReset(t *testing.T) {
+	t.Parallel()
+	ma := newDerivativeAggregator(NewGaugeDerivative([]string{"bytes"}))
+	now := time.Now()
+	for _, v := range []float64{1000, 2000} {
+		ma.Receive(&gostatsd.Metric{Name: "bytes", Value: v, Type: gostatsd.GAUGE, Rate: 1}, now)
+		flushGauge(ma, "bytes", time.Second)
+	}
+
+	// The counter behind the gauge restarted, so the decrease is flushed as 0.
+	ma.Receive(&gostatsd.Metric{Name: "bytes", Value: 10, Type: gostatsd.GAUGE, Rate: 1}, now)
+	value, ok := flushGauge(ma, "bytes", time.Second)
+	assert.True(t, ok)
+	assert.Zero(t, value)
+
+	// The rate is measured from the value after the reset.
+	ma.Receive(&gostatsd.Metric{Name: "bytes", Value: 40, Type: gostatsd.GAUGE, Rate: 1}, now)
+	value, _ = flushGauge(ma, "bytes", time.Second)
+	assert.Equal(t, 30.0, value)
+}
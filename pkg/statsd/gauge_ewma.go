@@ -0,0 +1,31 @@
+package statsd
+
+import (
+	"github.com/atlassian/gostatsd"
+)
+
+// GaugeEWMA smooths gauges with a name matching a pattern into an exponentially weighted moving average.  Each value
+// received is blended into the running value, which is what is flushed.  A nil *GaugeEWMA smooths nothing.
+type GaugeEWMA struct {
+	match gostatsd.StringMatchList
+	decay float64 // Weight of the running value when a value is received, between 0 and 1
+}
+
+// NewGaugeEWMA creates a GaugeEWMA which smooths gauges with a name matching any of match.  Each value received is
+// weighted by 1-decay, and the running value by decay, so a larger decay smooths more.
+func NewGaugeEWMA(match []string, decay float64) *GaugeEWMA {
+	return &GaugeEWMA{
+		match: toStringMatch(match),
+		decay: decay,
+	}
+}
+
+// Matches returns true if the gauge name is smoothed.
+func (ge *GaugeEWMA) Matches(name string) bool {
+	return ge != nil && ge.match.MatchAny(name)
+}
+
+// Blend returns the running value after value is received.
+func (ge *GaugeEWMA) Blend(running, value float64) float64 {
+	return ge.decay*running + (1-ge.decay)*value
+}
@@ -0,0 +1,61 @@
+package statsd
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEWMAAggregator(ge *GaugeEWMA) *MetricAggregator {
+	return NewMetricAggregator(aggregation.Options{ExpiryInterval: 5 * time.Minute, GaugeSmoothing: ge}, nil, nil, nil)
+}
+
+func TestGaugeEWMAMatches(t *testing.T) {
+	t.Parallel()
+	ge := NewGaugeEWMA([]string{"cpu.*", "queue.depth"}, 0.5)
+	assert.True(t, ge.Matches("cpu.user"))
+	assert.True(t, ge.Matches("queue.depth"))
+	assert.False(t, ge.Matches("queue.depth.max"))
+	assert.False(t, ge.Matches("memory"))
+
+	var none *GaugeEWMA
+	assert.False(t, none.Matches("cpu.user"))
+}
+
+func TestGaugeEWMASequence(t *testing.T) {
+	t.Parallel()
+	ma := newEWMAAggregator(NewGaugeEWMA([]string{"smooth"}, 0.75))
+	now := time.Now()
+	expected := []float64{8, 7, 7.25, 6.4375, 5.828125}
+	for i, v := range []float64{8, 4, 8, 4, 4} {
+		ma.Receive(&gostatsd.Metric{Name: "smooth", Value: v, Type: gostatsd.GAUGE, Rate: 1}, now)
+		ma.Receive(&gostatsd.Metric{Name: "raw", Value: v, Type: gostatsd.GAUGE, Rate: 1}, now)
+		assert.Equal(t, expected[i], ma.Gauges["smooth"][""].Value, "update %d", i)
+		assert.Equal(t, v, ma.Gauges["raw"][""].Value, "update %d", i)
+	}
+}
+
+func TestGaugeEWMAConverges(t *testing.T) {
+	t.Parallel()
+	ma := newEWMAAggregator(NewGaugeEWMA([]string{"smooth"}, 0.5))
+	now := time.Now()
+	ma.Receive(&gostatsd.Metric{Name: "smooth", Value: 0, Type: gostatsd.GAUGE, Rate: 1}, now)
+
+	// Each update halves the distance to a constant input.
+	for i := 1; i <= 30; i++ {
+		ma.Receive(&gostatsd.Metric{Name: "smooth", Value: 100, Type: gostatsd.GAUGE, Rate: 1}, now)
+		assert.InDelta(t, 100*(1-math.Pow(0.5, float64(i))), ma.Gauges["smooth"][""].Value, 1e-9, "update %d", i)
+	}
+	assert.InDelta(t, 100, ma.Gauges["smooth"][""].Value, 1e-6)
+
+	// The running value is kept across flushes, like the value of any gauge.
+	ma.Flush(time.Second)
+	ma.Reset()
+	ma.Receive(&gostatsd.Metric{Name: "smooth", Value: 0, Type: gostatsd.GAUGE, Rate: 1}, now)
+	assert.InDelta(t, 50, ma.Gauges["smooth"][""].Value, 1e-6)
+}
@@ -0,0 +1,349 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/grpcapi"
+	"github.com/atlassian/gostatsd/pkg/logging"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// snapshotFilter selects the metrics copied into a grpcapi.Snapshot.
+type snapshotFilter struct {
+	types   [gostatsd.SET + 1]bool
+	glob    string // Empty to match every name
+	samples bool
+}
+
+// newSnapshotFilter returns the snapshotFilter selecting the metrics requested by req.
+func newSnapshotFilter(req *grpcapi.MetricsRequest) (*snapshotFilter, error) {
+	f := &snapshotFilter{
+		glob:    req.GetNameGlob(),
+		samples: req.GetTimerSamples(),
+	}
+	if _, err := path.Match(f.glob, ""); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid glob %q: %v", f.glob, err)
+	}
+	for _, t := range req.GetTypes() {
+		switch t {
+		case grpcapi.MetricType_COUNTER:
+			f.types[gostatsd.COUNTER] = true
+		case grpcapi.MetricType_TIMER:
+			f.types[gostatsd.TIMER] = true
+		case grpcapi.MetricType_GAUGE:
+			f.types[gostatsd.GAUGE] = true
+		case grpcapi.MetricType_SET:
+			f.types[gostatsd.SET] = true
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "invalid metric type %v", t)
+		}
+	}
+	if len(req.GetTypes()) == 0 {
+		for i := range f.types {
+			f.types[i] = true
+		}
+	}
+	return f, nil
+}
+
+func (f *snapshotFilter) matches(name string) bool {
+	if f.glob == "" {
+		return true
+	}
+	ok, _ := path.Match(f.glob, name)
+	return ok
+}
+
+// appendTo copies the metrics in m which match the filter into s.
+func (f *snapshotFilter) appendTo(s *grpcapi.Snapshot, m *gostatsd.MetricMap) {
+	if f.types[gostatsd.COUNTER] {
+		m.Counters.Each(func(name, _ string, c gostatsd.Counter) {
+			if f.matches(name) {
+				s.Counters = append(s.Counters, &grpcapi.Counter{
+					Name:        name,
+					Tags:        c.Tags.Copy(),
+					Hostname:    c.Hostname,
+					TimestampNs: int64(c.Timestamp),
+					Value:       c.Value,
+					PerSecond:   c.PerSecond,
+				})
+			}
+		})
+	}
+	if f.types[gostatsd.TIMER] {
+		m.Timers.Each(func(name, _ string, t gostatsd.Timer) {
+			if !f.matches(name) {
+				return
+			}
+			timer := &grpcapi.Timer{
+				Name:        name,
+				Tags:        t.Tags.Copy(),
+				Hostname:    t.Hostname,
+				TimestampNs: int64(t.Timestamp),
+				Count:       t.SampledCount,
+				PerSecond:   t.PerSecond,
+				Min:         t.Min,
+				Max:         t.Max,
+				Mean:        t.Mean,
+				Median:      t.Median,
+				StdDev:      t.StdDev,
+				Sum:         t.Sum,
+			}
+			for _, pct := range t.Percentiles {
+				timer.Percentiles = append(timer.Percentiles, &grpcapi.Percentile{Name: pct.Str, Value: pct.Float})
+			}
+			if f.samples {
+				timer.Samples = append([]float64(nil), t.Values...)
+			}
+			s.Timers = append(s.Timers, timer)
+		})
+	}
+	if f.types[gostatsd.GAUGE] {
+		m.Gauges.Each(func(name, _ string, g gostatsd.Gauge) {
+			if f.matches(name) {
+				s.Gauges = append(s.Gauges, &grpcapi.Gauge{
+					Name:        name,
+					Tags:        g.Tags.Copy(),
+					Hostname:    g.Hostname,
+					TimestampNs: int64(g.Timestamp),
+					Value:       g.Value,
+				})
+			}
+		})
+	}
+	if f.types[gostatsd.SET] {
+		m.Sets.Each(func(name, _ string, set gostatsd.Set) {
+			if f.matches(name) {
+				s.Sets = append(s.Sets, &grpcapi.Set{
+					Name:        name,
+					Tags:        set.Tags.Copy(),
+					Hostname:    set.Hostname,
+					TimestampNs: int64(set.Timestamp),
+					Cardinality: uint64(set.Cardinality()),
+				})
+			}
+		})
+	}
+}
+
+// snapshotKey orders the metrics of a snapshot by name, then tags and hostname.
+func snapshotKey(name string, tags gostatsd.Tags, hostname string) string {
+	return name + "\x00" + strings.Join(tags, ",") + "\x00" + hostname
+}
+
+// sortSnapshot sorts the metrics of s by name, then tags and hostname.
+func sortSnapshot(s *grpcapi.Snapshot) {
+	sort.Slice(s.Counters, func(i, j int) bool {
+		a, b := s.Counters[i], s.Counters[j]
+		return snapshotKey(a.Name, a.Tags, a.Hostname) < snapshotKey(b.Name, b.Tags, b.Hostname)
+	})
+	sort.Slice(s.Timers, func(i, j int) bool {
+		a, b := s.Timers[i], s.Timers[j]
+		return snapshotKey(a.Name, a.Tags, a.Hostname) < snapshotKey(b.Name, b.Tags, b.Hostname)
+	})
+	sort.Slice(s.Gauges, func(i, j int) bool {
+		a, b := s.Gauges[i], s.Gauges[j]
+		return snapshotKey(a.Name, a.Tags, a.Hostname) < snapshotKey(b.Name, b.Tags, b.Hostname)
+	})
+	sort.Slice(s.Sets, func(i, j int) bool {
+		a, b := s.Sets[i], s.Sets[j]
+		return snapshotKey(a.Name, a.Tags, a.Hostname) < snapshotKey(b.Name, b.Tags, b.Hostname)
+	})
+}
+
+// flushStream is a client streaming flushes, which receives each flush on snapshots.
+type flushStream struct {
+	filter    *snapshotFilter
+	pending   *grpcapi.Snapshot // The flush being collected, only accessed with the FlushSnapshots lock held
+	snapshots chan *grpcapi.Snapshot
+}
+
+// FlushSnapshots copies the metrics of each flush to the clients streaming flushes.  The metrics are copied as each
+// aggregator is flushed, as the aggregator reuses them afterwards, and sent once the whole flush has been collected.
+// A client which has not received the previous flush misses the next one rather than delaying the flusher.  There is
+// no cost to a flush if no client is streaming.
+type FlushSnapshots struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	dropped uint64 // Flushes not sent to a client which had not received the previous one
+	streams int32  // Number of streams collecting the current flush
+
+	mu        sync.Mutex
+	collected map[*flushStream]struct{} // Streams collecting the current flush
+	joining   map[*flushStream]struct{} // Streams which start collecting at the next flush
+}
+
+// NewFlushSnapshots creates a FlushSnapshots with no streams.
+func NewFlushSnapshots() *FlushSnapshots {
+	return &FlushSnapshots{
+		collected: map[*flushStream]struct{}{},
+		joining:   map[*flushStream]struct{}{},
+	}
+}
+
+// subscribe returns a stream which receives each flush from the next one.
+func (fs *FlushSnapshots) subscribe(filter *snapshotFilter) *flushStream {
+	stream := &flushStream{
+		filter:    filter,
+		snapshots: make(chan *grpcapi.Snapshot, 1),
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.joining[stream] = struct{}{}
+	return stream
+}
+
+// unsubscribe stops sending flushes to stream.
+func (fs *FlushSnapshots) unsubscribe(stream *flushStream) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.joining, stream)
+	delete(fs.collected, stream)
+	atomic.StoreInt32(&fs.streams, int32(len(fs.collected)))
+}
+
+// begin starts collecting a flush, including the streams which have subscribed since the previous flush.
+func (fs *FlushSnapshots) begin() {
+	if fs == nil {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for stream := range fs.joining {
+		fs.collected[stream] = struct{}{}
+		delete(fs.joining, stream)
+	}
+	for stream := range fs.collected {
+		stream.pending = &grpcapi.Snapshot{}
+	}
+	atomic.StoreInt32(&fs.streams, int32(len(fs.collected)))
+}
+
+// add copies the metrics in m to each stream collecting the flush.  It is safe to call concurrently.
+func (fs *FlushSnapshots) add(m *gostatsd.MetricMap) {
+	if fs == nil || atomic.LoadInt32(&fs.streams) == 0 {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for stream := range fs.collected {
+		stream.filter.appendTo(stream.pending, m)
+	}
+}
+
+// publish sends the collected flush, which has the sequence number and was aggregated over interval, to each stream.
+func (fs *FlushSnapshots) publish(sequence uint64, interval time.Duration) {
+	if fs == nil || atomic.LoadInt32(&fs.streams) == 0 {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for stream := range fs.collected {
+		s := stream.pending
+		stream.pending = nil
+		s.Sequence = sequence
+		s.IntervalNs = int64(interval)
+		sortSnapshot(s)
+		select {
+		case stream.snapshots <- s:
+		default:
+			atomic.AddUint64(&fs.dropped, 1)
+		}
+	}
+}
+
+// Dropped returns the number of flushes not sent to a client which had not received the previous one.
+func (fs *FlushSnapshots) Dropped() uint64 {
+	return atomic.LoadUint64(&fs.dropped)
+}
+
+// GRPCServer serves the read-only gRPC API, which lists the metrics received so far this interval, and streams the
+// metrics of each flush.
+type GRPCServer struct {
+	grpcapi.UnimplementedAggregatorServer
+
+	processer AggregateProcesser
+	flushes   *FlushSnapshots
+	logger    log.FieldLogger
+}
+
+// NewGRPCServer creates a GRPCServer listing the metrics of the aggregators of processer, and streaming the flushes
+// collected by flushes.
+func NewGRPCServer(processer AggregateProcesser, flushes *FlushSnapshots) *GRPCServer {
+	return &GRPCServer{
+		processer: processer,
+		flushes:   flushes,
+		logger:    logging.Component("grpc"),
+	}
+}
+
+// ListMetrics returns the metrics received so far this interval, from a snapshot of each aggregator.
+func (gs *GRPCServer) ListMetrics(ctx context.Context, req *grpcapi.MetricsRequest) (*grpcapi.Snapshot, error) {
+	filter, err := newSnapshotFilter(req)
+	if err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex
+	s := &grpcapi.Snapshot{}
+	wait := gs.processer.Process(ctx, func(aggrID int, aggr Aggregator) {
+		aggr.Process(func(m *gostatsd.MetricMap) {
+			mu.Lock()
+			defer mu.Unlock()
+			filter.appendTo(s, m)
+		})
+	})
+	wait()
+	if ctx.Err() != nil {
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	sortSnapshot(s)
+	return s, nil
+}
+
+// StreamFlushes sends the metrics of each flush until the client cancels.
+func (gs *GRPCServer) StreamFlushes(req *grpcapi.MetricsRequest, srv grpcapi.Aggregator_StreamFlushesServer) error {
+	filter, err := newSnapshotFilter(req)
+	if err != nil {
+		return err
+	}
+	stream := gs.flushes.subscribe(filter)
+	defer gs.flushes.unsubscribe(stream)
+	ctx := srv.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case s := <-stream.snapshots:
+			if err := srv.Send(s); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Serve serves the API on l until the context is closed.
+func (gs *GRPCServer) Serve(ctx context.Context, l net.Listener) {
+	srv := grpc.NewServer()
+	grpcapi.RegisterAggregatorServer(srv, gs)
+
+	go func() {
+		<-ctx.Done()
+		srv.Stop()
+	}()
+	if err := srv.Serve(l); err != nil && err != grpc.ErrServerStopped {
+		gs.logger.WithError(err).WithField(logging.FieldAddress, l.Addr().String()).Error("gRPC server failed")
+	}
+}
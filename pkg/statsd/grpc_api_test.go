@@ -0,0 +1,164 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/grpcapi"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newGRPCTestClient serves gs over an in-memory connection until the returned function is called.
+func newGRPCTestClient(t *testing.T, gs *GRPCServer) (grpcapi.AggregatorClient, func()) {
+	l := bufconn.Listen(1024 * 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	go gs.Serve(ctx, l)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	return grpcapi.NewAggregatorClient(conn), func() {
+		_ = conn.Close()
+		cancel()
+	}
+}
+
+func newGRPCTestAggregator() *MetricAggregator {
+	agg := newFakeAggregator()
+	now := time.Unix(1500000000, 0)
+	receive := func(m gostatsd.Metric) {
+		m.Rate = 1
+		m.TagsKey = formatTagsKey(m.Tags, m.Hostname)
+		agg.Receive(&m, now)
+	}
+	receive(gostatsd.Metric{Name: "requests", Value: 3, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"env:prod"}})
+	receive(gostatsd.Metric{Name: "errors", Value: 1, Type: gostatsd.COUNTER})
+	receive(gostatsd.Metric{Name: "latency", Value: 20, Type: gostatsd.TIMER})
+	receive(gostatsd.Metric{Name: "latency", Value: 5, Type: gostatsd.TIMER})
+	receive(gostatsd.Metric{Name: "queue", Value: 1.5, Type: gostatsd.GAUGE, Hostname: "h1"})
+	receive(gostatsd.Metric{Name: "users", StringValue: "joe", Type: gostatsd.SET})
+	return agg
+}
+
+func TestGRPCListMetrics(t *testing.T) {
+	t.Parallel()
+	client, stop := newGRPCTestClient(t, NewGRPCServer(&singleAggregator{agg: newGRPCTestAggregator()}, NewFlushSnapshots()))
+	defer stop()
+	ctx := context.Background()
+
+	s, err := client.ListMetrics(ctx, &grpcapi.MetricsRequest{TimerSamples: true})
+	require.NoError(t, err)
+	assert.Zero(t, s.Sequence)
+	require.Len(t, s.Counters, 2)
+	assert.Equal(t, "errors", s.Counters[0].Name)
+	assert.Equal(t, "requests", s.Counters[1].Name)
+	assert.Equal(t, []string{"env:prod"}, s.Counters[1].Tags)
+	assert.EqualValues(t, 3, s.Counters[1].Value)
+	require.Len(t, s.Timers, 1)
+	assert.EqualValues(t, 2, s.Timers[0].Count)
+	assert.Equal(t, []float64{20, 5}, s.Timers[0].Samples)
+	require.Len(t, s.Gauges, 1)
+	assert.Equal(t, "h1", s.Gauges[0].Hostname)
+	assert.Equal(t, 1.5, s.Gauges[0].Value)
+	require.Len(t, s.Sets, 1)
+	assert.EqualValues(t, 1, s.Sets[0].Cardinality)
+
+	s, err = client.ListMetrics(ctx, &grpcapi.MetricsRequest{
+		Types:    []grpcapi.MetricType{grpcapi.MetricType_COUNTER, grpcapi.MetricType_TIMER},
+		NameGlob: "re*",
+	})
+	require.NoError(t, err)
+	require.Len(t, s.Counters, 1)
+	assert.Equal(t, "requests", s.Counters[0].Name)
+	assert.Empty(t, s.Timers)
+	assert.Empty(t, s.Gauges)
+
+	s, err = client.ListMetrics(ctx, &grpcapi.MetricsRequest{Types: []grpcapi.MetricType{grpcapi.MetricType_TIMER}})
+	require.NoError(t, err)
+	require.Len(t, s.Timers, 1)
+	assert.Empty(t, s.Timers[0].Samples)
+
+	_, err = client.ListMetrics(ctx, &grpcapi.MetricsRequest{NameGlob: "["})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.ListMetrics(ctx, &grpcapi.MetricsRequest{Types: []grpcapi.MetricType{grpcapi.MetricType_METRIC_TYPE_UNSPECIFIED}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPCStreamFlushes(t *testing.T) {
+	t.Parallel()
+	sa := &singleAggregator{agg: newGRPCTestAggregator()}
+	flushes := NewFlushSnapshots()
+	client, stop := newGRPCTestClient(t, NewGRPCServer(sa, flushes))
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.StreamFlushes(ctx, &grpcapi.MetricsRequest{Types: []grpcapi.MetricType{grpcapi.MetricType_COUNTER}})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		flushes.mu.Lock()
+		defer flushes.mu.Unlock()
+		return len(flushes.joining) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	fl := NewMetricFlusher(0, sa, nil, []gostatsd.Backend{&sequenceBackend{}}, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+	fl.flushes = flushes
+	fl.flushData(context.Background(), time.Second, 0)
+
+	s, err := stream.Recv()
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, s.Sequence)
+	assert.Equal(t, int64(time.Second), s.IntervalNs)
+	require.Len(t, s.Counters, 2)
+	assert.Equal(t, "errors", s.Counters[0].Name)
+	assert.Equal(t, 1.0, s.Counters[0].PerSecond)
+	assert.Empty(t, s.Timers)
+
+	cancel()
+	require.Eventually(t, func() bool {
+		flushes.mu.Lock()
+		defer flushes.mu.Unlock()
+		return len(flushes.collected) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFlushSnapshotsDropsWhenBehind(t *testing.T) {
+	t.Parallel()
+	flushes := NewFlushSnapshots()
+	filter, err := newSnapshotFilter(&grpcapi.MetricsRequest{})
+	require.NoError(t, err)
+
+	// Streams only collect from the start of the next flush.
+	flushes.add(newGRPCTestAggregator().MetricMap.Copy())
+	stream := flushes.subscribe(filter)
+	flushes.publish(1, time.Second)
+
+	for sequence := uint64(2); sequence <= 3; sequence++ {
+		flushes.begin()
+		flushes.add(newGRPCTestAggregator().MetricMap.Copy())
+		flushes.publish(sequence, time.Second)
+	}
+	// The stream didn't receive the flush numbered 2, so misses 3.
+	s := <-stream.snapshots
+	assert.EqualValues(t, 2, s.Sequence)
+	assert.Len(t, s.Counters, 2)
+	assert.EqualValues(t, 1, flushes.Dropped())
+
+	flushes.unsubscribe(stream)
+	flushes.begin()
+	flushes.publish(4, time.Second)
+	assert.Empty(t, stream.snapshots)
+}
@@ -7,9 +7,9 @@ import (
 	"time"
 
 	"github.com/ash2k/stager/wait"
-	"github.com/sirupsen/logrus"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
 	stats "github.com/atlassian/gostatsd/pkg/statser"
 )
 
@@ -33,30 +33,40 @@ type BackendHandler struct {
 	backends         []gostatsd.Backend
 	concurrentEvents chan struct{}
 
-	numWorkers int
-	workers    []*worker
+	numWorkers  int                   // Number of workers metrics of each type are distributed across
+	workers     []*worker             // Every worker, the workers of each type are consecutive
+	typeOffsets [gostatsd.SET + 1]int // Index of the first worker of each type, all 0 unless types are separated
+	supervisor  *Supervisor           // Restarts workers which panic, may be nil
 }
 
-// NewBackendHandler initialises a new Handler which sends metrics and events to all backends
-func NewBackendHandler(backends []gostatsd.Backend, maxConcurrentEvents uint, numWorkers int, perWorkerBufferSize int, af AggregatorFactory) *BackendHandler {
-	workers := make([]*worker, numWorkers)
+// NewBackendHandler initialises a new Handler which sends metrics and events to all backends.  If separateTypes is
+// true, each metric type has its own numWorkers workers and aggregators, so a burst of one type, such as timers,
+// doesn't delay the aggregation of the others.
+func NewBackendHandler(backends []gostatsd.Backend, maxConcurrentEvents uint, numWorkers int, perWorkerBufferSize int, af AggregatorFactory, separateTypes bool) *BackendHandler {
+	bh := &BackendHandler{
+		backends:         backends,
+		concurrentEvents: make(chan struct{}, maxConcurrentEvents),
+
+		numWorkers: numWorkers,
+	}
+	numGroups := 1
+	if separateTypes {
+		numGroups = int(gostatsd.SET)
+		for t := gostatsd.COUNTER; t <= gostatsd.SET; t++ {
+			bh.typeOffsets[t] = int(t-gostatsd.COUNTER) * numWorkers
+		}
+	}
 
-	for i := 0; i < numWorkers; i++ {
-		workers[i] = &worker{
+	bh.workers = make([]*worker, numGroups*numWorkers)
+	for i := range bh.workers {
+		bh.workers[i] = &worker{
 			aggr:         af.Create(),
 			metricsQueue: make(chan *gostatsd.Metric, perWorkerBufferSize),
 			processChan:  make(chan *processCommand),
 			id:           i,
 		}
 	}
-
-	return &BackendHandler{
-		backends:         backends,
-		concurrentEvents: make(chan struct{}, maxConcurrentEvents),
-
-		numWorkers: numWorkers,
-		workers:    workers,
-	}
+	return bh
 }
 
 // Run runs the BackendHandler workers until the Context is closed.
@@ -69,7 +79,7 @@ func (bh *BackendHandler) Run(ctx context.Context) {
 		wg.Wait() // Wait for all workers to finish
 	}()
 	for _, worker := range bh.workers {
-		wg.Start(worker.work)
+		wg.Start(bh.supervisor.WrapFunc(ctx, "aggregator", worker.work))
 	}
 
 	// Work until asked to stop
@@ -103,6 +113,26 @@ func (bh *BackendHandler) RunMetrics(ctx context.Context, statser stats.Statser)
 	wg.StartWithContext(ctx, csw.Run)
 }
 
+// supervise restarts the workers with sup if they panic.  It must be called before Run.
+func (bh *BackendHandler) supervise(sup *Supervisor) {
+	bh.supervisor = sup
+}
+
+// sampleUtilization adds the queues and the busy time of the workers to ts.  It must be called before Run.
+func (bh *BackendHandler) sampleUtilization(ts *tuningSampler) {
+	if len(bh.workers) == 0 {
+		return
+	}
+	busy := ts.addWorkers("aggregator", len(bh.workers))
+	lens := make([]func() int, len(bh.workers))
+	for i, w := range bh.workers {
+		w := w
+		w.busy = busy
+		lens[i] = func() int { return len(w.metricsQueue) }
+	}
+	ts.addQueues("aggregator", cap(bh.workers[0].metricsQueue), lens...)
+}
+
 // EstimatedTags returns a guess for how many tags to pre-allocate
 func (bh *BackendHandler) EstimatedTags() int {
 	return 0
@@ -111,7 +141,10 @@ func (bh *BackendHandler) EstimatedTags() int {
 // DispatchMetric dispatches metric to a corresponding Aggregator.
 func (bh *BackendHandler) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
 	m.TagsKey = formatTagsKey(m.Tags, m.Hostname)
-	w := bh.workers[m.Bucket(bh.numWorkers)]
+	w := bh.workers[bh.AggregatorID(m)]
+	if m.Trace != nil {
+		m.Trace.Enqueued = time.Now()
+	}
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
@@ -120,22 +153,32 @@ func (bh *BackendHandler) DispatchMetric(ctx context.Context, m *gostatsd.Metric
 	}
 }
 
+// AggregatorID returns the id of the aggregator which receives m, which depends on its name, host and, if types are
+// separated, its type.
+func (bh *BackendHandler) AggregatorID(m *gostatsd.Metric) int {
+	offset := 0
+	if m.Type <= gostatsd.SET {
+		offset = bh.typeOffsets[m.Type]
+	}
+	return offset + m.Bucket(bh.numWorkers)
+}
+
 // Process concurrently executes provided function in goroutines that own Aggregators.
-// DispatcherProcessFunc function may be executed zero or up to numWorkers times. It is executed
-// less than numWorkers times if the context signals "done".
+// DispatcherProcessFunc function may be executed zero or up to once per worker. It is executed
+// less times if the context signals "done".
 func (bh *BackendHandler) Process(ctx context.Context, f DispatcherProcessFunc) gostatsd.Wait {
 	var wg sync.WaitGroup
 	cmd := &processCommand{
 		f:    f,
 		done: wg.Done,
 	}
-	wg.Add(bh.numWorkers)
+	wg.Add(len(bh.workers))
 	cmdSent := 0
 loop:
 	for _, worker := range bh.workers {
 		select {
 		case <-ctx.Done():
-			wg.Add(cmdSent - bh.numWorkers) // Not all commands have been sent, should decrement the WG counter.
+			wg.Add(cmdSent - len(bh.workers)) // Not all commands have been sent, should decrement the WG counter.
 			break loop
 		case worker.processChan <- cmd:
 			cmdSent++
@@ -173,7 +216,7 @@ func (bh *BackendHandler) dispatchEvent(ctx context.Context, backend gostatsd.Ba
 		<-bh.concurrentEvents
 	}()
 	if err := backend.SendEvent(ctx, e); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
-		logrus.Errorf("Sending event to backend failed: %v", err)
+		logging.Backend(backend.Name()).WithError(err).Error("Sending event to backend failed")
 	}
 }
 
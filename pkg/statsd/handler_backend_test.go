@@ -93,14 +93,14 @@ func TestNewBackendHandlerShouldCreateCorrectNumberOfWorkers(t *testing.T) {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	n := r.Intn(5) + 1
 	factory := newTestFactory()
-	h := NewBackendHandler(nil, 0, n, 1, factory)
+	h := NewBackendHandler(nil, 0, n, 1, factory, false)
 	assert.Equal(t, n, len(h.workers))
 	assert.Equal(t, n, factory.numAgrs)
 }
 
 func TestRunShouldReturnWhenContextCancelled(t *testing.T) {
 	t.Parallel()
-	h := NewBackendHandler(nil, 0, 5, 1, newTestFactory())
+	h := NewBackendHandler(nil, 0, 5, 1, newTestFactory(), false)
 	ctx, cancelFunc := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancelFunc()
 	h.Run(ctx)
@@ -111,7 +111,7 @@ func TestDispatchMetricShouldDistributeMetrics(t *testing.T) {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	n := r.Intn(5) + 1
 	factory := newTestFactory()
-	h := NewBackendHandler(nil, 0, n, 10, factory)
+	h := NewBackendHandler(nil, 0, n, 10, factory, false)
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 	var wgFinish wait.Group
@@ -157,7 +157,7 @@ func getTotalInvocations(inv map[int]int) int {
 func BenchmarkBackendHandler(b *testing.B) {
 	rand.Seed(time.Now().UnixNano())
 	factory := newTestFactory()
-	h := NewBackendHandler(nil, 0, runtime.NumCPU(), 10, factory)
+	h := NewBackendHandler(nil, 0, runtime.NumCPU(), 10, factory, false)
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 	var wgFinish wait.Group
@@ -180,3 +180,90 @@ func BenchmarkBackendHandler(b *testing.B) {
 	cancelFunc()    // After all metrics have been dispatched, we signal dispatcher to shut down
 	wgFinish.Wait() // Wait for dispatcher to shutdown
 }
+
+func TestDispatchMetricSeparateTypes(t *testing.T) {
+	t.Parallel()
+	factory := newTestFactory()
+	h := NewBackendHandler(nil, 0, 2, 10, factory, true)
+	assert.Len(t, h.workers, 8)
+	assert.Equal(t, 8, factory.numAgrs)
+
+	for mt := gostatsd.COUNTER; mt <= gostatsd.SET; mt++ {
+		first := int(mt-gostatsd.COUNTER) * 2
+		for i := 0; i < 20; i++ {
+			id := h.AggregatorID(&gostatsd.Metric{Type: mt, Name: fmt.Sprintf("metric.%d", i)})
+			assert.True(t, id == first || id == first+1, "%s metric.%d went to aggregator %d", mt, i, id)
+		}
+	}
+
+	// Without separation the type doesn't matter.
+	h = NewBackendHandler(nil, 0, 2, 10, newTestFactory(), false)
+	assert.Len(t, h.workers, 2)
+	counter := h.AggregatorID(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "metric"})
+	assert.Equal(t, counter, h.AggregatorID(&gostatsd.Metric{Type: gostatsd.TIMER, Name: "metric"}))
+}
+
+// slowTimerAggregator takes timerCost to receive each timer, and signals received when it receives a counter.
+type slowTimerAggregator struct {
+	gostatsd.MetricMap
+	timerCost time.Duration
+	received  chan struct{}
+}
+
+func (a *slowTimerAggregator) Receive(m *gostatsd.Metric, t time.Time) {
+	if m.Type != gostatsd.TIMER {
+		a.received <- struct{}{}
+		return
+	}
+	for start := time.Now(); time.Since(start) < a.timerCost; {
+	}
+}
+
+func (a *slowTimerAggregator) Flush(interval time.Duration) {}
+
+func (a *slowTimerAggregator) Process(f ProcessFunc) {
+	f(&a.MetricMap)
+}
+
+func (a *slowTimerAggregator) Reset() {}
+
+// BenchmarkCounterLatencyUnderTimerFlood measures the time from dispatching a counter to it being received by its
+// aggregator, while other goroutines flood the handler with timers which are expensive to aggregate.
+func BenchmarkCounterLatencyUnderTimerFlood(b *testing.B) {
+	for _, separate := range []bool{false, true} {
+		separate := separate
+		b.Run(fmt.Sprintf("separate_types=%t", separate), func(b *testing.B) {
+			received := make(chan struct{}, 1)
+			factory := AggregatorFactoryFunc(func() Aggregator {
+				return &slowTimerAggregator{timerCost: 20 * time.Microsecond, received: received}
+			})
+			h := NewBackendHandler(nil, 0, 1, 1000, factory, separate)
+			ctx, cancelFunc := context.WithCancel(context.Background())
+			var wg wait.Group
+			wg.StartWithContext(ctx, h.Run)
+			floodCtx, stopFlood := context.WithCancel(ctx)
+			var flood wait.Group
+			for i := 0; i < runtime.NumCPU(); i++ {
+				flood.Start(func() {
+					for floodCtx.Err() == nil {
+						_ = h.DispatchMetric(floodCtx, &gostatsd.Metric{Type: gostatsd.TIMER, Name: "flood", Value: 1})
+					}
+				})
+			}
+			time.Sleep(10 * time.Millisecond) // Let the timers fill the queue
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if err := h.DispatchMetric(ctx, &gostatsd.Metric{Type: gostatsd.COUNTER, Name: "requests", Value: 1}); err != nil {
+					b.Fatal(err)
+				}
+				<-received
+			}
+			b.StopTimer()
+			stopFlood()
+			flood.Wait() // The queues are closed when the handler stops, so nothing may be dispatched after that
+			cancelFunc()
+			wg.Wait()
+		})
+	}
+}
@@ -367,7 +367,7 @@ func (ch *CloudHandler) updateAndDispatchMetrics(ctx context.Context, instance *
 			if err == context.Canceled || err == context.DeadlineExceeded {
 				return
 			}
-			ch.logger.Warnf("Failed to dispatch metric: %v", err)
+			ch.logger.WithError(err).Warn("Failed to dispatch metric")
 		}
 	}
 }
@@ -405,7 +405,7 @@ func (ch *CloudHandler) updateAndDispatchEvents(ctx context.Context, instance *g
 			if err == context.Canceled || err == context.DeadlineExceeded {
 				return
 			}
-			ch.logger.Warnf("Failed to dispatch event: %v", err)
+			ch.logger.WithError(err).Warn("Failed to dispatch event")
 		}
 	}
 }
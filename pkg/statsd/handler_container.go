@@ -0,0 +1,213 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	stats "github.com/atlassian/gostatsd/pkg/statser"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ContainerResolverNone tags metrics with only the container ID sent by the client.
+	ContainerResolverNone = "none"
+	// ContainerResolverDocker also tags metrics with the name, image and namespace of the container, looked up with
+	// the Docker Engine API.
+	ContainerResolverDocker = "docker"
+)
+
+// containerLookupQueueSize is the number of container IDs which may wait to be looked up.
+const containerLookupQueueSize = 1000
+
+// ContainerResolver looks up the metadata of a container.
+type ContainerResolver interface {
+	// Resolve returns the tags describing the container with the ID.
+	Resolve(ctx context.Context, id string) (gostatsd.Tags, error)
+}
+
+// containerEntry is the cached result of looking up a container.
+type containerEntry struct {
+	tags    gostatsd.Tags // nil if the lookup failed
+	expires time.Time
+	pending bool // Set while the container is waiting to be looked up
+}
+
+// ContainerHandler tags metrics with the container ID sent by dogstatsd clients for origin detection, and the
+// metadata of the container if there is a resolver.  Containers are looked up in the background and cached for a
+// TTL, so a metric is never delayed: metrics received before a container is resolved, or from a container which can't
+// be resolved, are tagged with only its ID.  Events are passed through unchanged.
+type ContainerHandler struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	lookupsResolved uint64 // Lookups which succeeded
+	lookupsFailed   uint64 // Lookups which failed
+	lookupsDropped  uint64 // Lookups not made because the queue was full
+
+	resolver ContainerResolver // May be nil to only add the container ID
+	ttl      time.Duration
+	metrics  MetricHandler
+	events   EventHandler
+	now      func() time.Time
+	logger   log.FieldLogger
+
+	lookups chan string
+
+	mu    sync.RWMutex // Protects cache
+	cache map[string]*containerEntry
+}
+
+// NewContainerHandler creates a ContainerHandler looking up containers with resolver, which may be nil, and caching
+// the results for ttl.
+func NewContainerHandler(resolver ContainerResolver, ttl time.Duration, metrics MetricHandler, events EventHandler) *ContainerHandler {
+	return &ContainerHandler{
+		resolver: resolver,
+		ttl:      ttl,
+		metrics:  metrics,
+		events:   events,
+		now:      time.Now,
+		logger:   logging.Component("container"),
+		lookups:  make(chan string, containerLookupQueueSize),
+		cache:    map[string]*containerEntry{},
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (ch *ContainerHandler) EstimatedTags() int {
+	return ch.metrics.EstimatedTags() + 4
+}
+
+// DispatchMetric tags m with its container, if it has one, and passes it on.
+func (ch *ContainerHandler) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
+	if m.ContainerID != "" {
+		m.Tags = append(m.Tags, "container_id:"+m.ContainerID)
+		if ch.resolver != nil {
+			m.Tags = append(m.Tags, ch.containerTags(m.ContainerID)...)
+		}
+	}
+	return ch.metrics.DispatchMetric(ctx, m)
+}
+
+// containerTags returns the cached tags of the container, which are nil if it has not been resolved.  A container
+// which is not cached, or whose entry has expired, is queued to be looked up, and its expired tags are still used
+// until then.
+func (ch *ContainerHandler) containerTags(id string) gostatsd.Tags {
+	now := ch.now()
+	ch.mu.RLock()
+	entry, ok := ch.cache[id]
+	fresh := ok && (entry.pending || now.Before(entry.expires))
+	var tags gostatsd.Tags
+	if ok {
+		tags = entry.tags
+	}
+	ch.mu.RUnlock()
+	if fresh {
+		return tags
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	entry, ok = ch.cache[id]
+	if !ok {
+		entry = &containerEntry{}
+		ch.cache[id] = entry
+	} else if entry.pending || now.Before(entry.expires) {
+		return entry.tags
+	}
+	select {
+	case ch.lookups <- id:
+		entry.pending = true
+	default:
+		atomic.AddUint64(&ch.lookupsDropped, 1)
+	}
+	return entry.tags
+}
+
+// DispatchEvent passes e on.
+func (ch *ContainerHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) error {
+	return ch.events.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (ch *ContainerHandler) WaitForEvents() {
+	ch.events.WaitForEvents()
+}
+
+// Run looks up the queued containers one at a time, and removes the entries of containers which have not been seen
+// for a TTL.  Stops when the context is closed.
+func (ch *ContainerHandler) Run(ctx context.Context) {
+	ticker := time.NewTicker(ch.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-ch.lookups:
+			ch.lookup(ctx, id)
+		case <-ticker.C:
+			ch.evict()
+		}
+	}
+}
+
+// lookup resolves the container with the ID and caches the result.  A container which can't be resolved is cached
+// without tags, so it is not looked up again until its entry expires.
+func (ch *ContainerHandler) lookup(ctx context.Context, id string) {
+	lookupCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	tags, err := ch.resolver.Resolve(lookupCtx, id)
+	if err != nil {
+		atomic.AddUint64(&ch.lookupsFailed, 1)
+		ch.logger.Debugf("Failed to look up container %s: %v", id, err)
+	} else {
+		atomic.AddUint64(&ch.lookupsResolved, 1)
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	entry, ok := ch.cache[id]
+	if !ok {
+		entry = &containerEntry{}
+		ch.cache[id] = entry
+	}
+	entry.pending = false
+	entry.expires = ch.now().Add(ch.ttl)
+	if err == nil {
+		entry.tags = tags
+	}
+}
+
+// evict removes the entries which expired more than a TTL ago, as no metric from the container has been seen since.
+func (ch *ContainerHandler) evict() {
+	cutoff := ch.now().Add(-ch.ttl)
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	for id, entry := range ch.cache {
+		if !entry.pending && entry.expires.Before(cutoff) {
+			delete(ch.cache, id)
+		}
+	}
+}
+
+// RunMetrics attaches a Statser to the ContainerHandler.  Stops when the context is closed.
+func (ch *ContainerHandler) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			ch.mu.RLock()
+			cached := len(ch.cache)
+			ch.mu.RUnlock()
+			statser.Gauge("container.cache_size", float64(cached), nil)
+			statser.Gauge("container.lookups_resolved", float64(atomic.LoadUint64(&ch.lookupsResolved)), nil)
+			statser.Gauge("container.lookups_failed", float64(atomic.LoadUint64(&ch.lookupsFailed)), nil)
+			statser.Gauge("container.lookups_dropped", float64(atomic.LoadUint64(&ch.lookupsDropped)), nil)
+		}
+	}
+}
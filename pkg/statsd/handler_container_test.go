@@ -0,0 +1,129 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver resolves the containers in its map, and fails to resolve any other.
+type fakeResolver map[string]gostatsd.Tags
+
+func (fr fakeResolver) Resolve(ctx context.Context, id string) (gostatsd.Tags, error) {
+	tags, ok := fr[id]
+	if !ok {
+		return nil, errors.New("no such container")
+	}
+	return tags, nil
+}
+
+func containerMetric(id string) *gostatsd.Metric {
+	return &gostatsd.Metric{Name: "m", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"a:1"}, ContainerID: id}
+}
+
+// runLookups makes the queued lookups of ch.
+func runLookups(ch *ContainerHandler) {
+	for {
+		select {
+		case id := <-ch.lookups:
+			ch.lookup(context.Background(), id)
+		default:
+			return
+		}
+	}
+}
+
+func TestContainerHandlerNoResolver(t *testing.T) {
+	t.Parallel()
+	tch := &TagCapturingHandler{}
+	ch := NewContainerHandler(nil, time.Minute, tch, tch)
+	ctx := context.Background()
+
+	require.NoError(t, ch.DispatchMetric(ctx, containerMetric("abc")))
+	require.NoError(t, ch.DispatchMetric(ctx, containerMetric("")))
+	require.Len(t, tch.m, 2)
+	assert.Equal(t, gostatsd.Tags{"a:1", "container_id:abc"}, tch.m[0].Tags)
+	assert.Equal(t, gostatsd.Tags{"a:1"}, tch.m[1].Tags)
+	assert.Empty(t, ch.lookups)
+}
+
+func TestContainerHandlerResolves(t *testing.T) {
+	t.Parallel()
+	tch := &TagCapturingHandler{}
+	resolver := fakeResolver{"abc": {"container_name:web", "image_name:nginx"}}
+	ch := NewContainerHandler(resolver, time.Minute, tch, tch)
+	now := time.Now()
+	ch.now = func() time.Time {
+		return now
+	}
+	ctx := context.Background()
+
+	// Metrics are not delayed until the container is resolved.
+	require.NoError(t, ch.DispatchMetric(ctx, containerMetric("abc")))
+	require.NoError(t, ch.DispatchMetric(ctx, containerMetric("gone")))
+	require.NoError(t, ch.DispatchMetric(ctx, containerMetric("abc")))
+	assert.Len(t, ch.lookups, 2)
+	runLookups(ch)
+	require.NoError(t, ch.DispatchMetric(ctx, containerMetric("abc")))
+	require.NoError(t, ch.DispatchMetric(ctx, containerMetric("gone")))
+
+	require.Len(t, tch.m, 5)
+	assert.Equal(t, gostatsd.Tags{"a:1", "container_id:abc"}, tch.m[0].Tags)
+	assert.Equal(t, gostatsd.Tags{"a:1", "container_id:abc", "container_name:web", "image_name:nginx"}, tch.m[3].Tags)
+	// An unresolvable container passes through with just its ID, and isn't looked up again until it expires.
+	assert.Equal(t, gostatsd.Tags{"a:1", "container_id:gone"}, tch.m[4].Tags)
+	assert.Empty(t, ch.lookups)
+	assert.EqualValues(t, 1, ch.lookupsResolved)
+	assert.EqualValues(t, 1, ch.lookupsFailed)
+
+	// An expired container is looked up again, and its old tags are used until then.
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, ch.DispatchMetric(ctx, containerMetric("abc")))
+	assert.Equal(t, gostatsd.Tags{"a:1", "container_id:abc", "container_name:web", "image_name:nginx"}, tch.m[5].Tags)
+	assert.Len(t, ch.lookups, 1)
+
+	// Containers not seen for a TTL after they expired are evicted.
+	runLookups(ch)
+	now = now.Add(3 * time.Minute)
+	ch.evict()
+	assert.Empty(t, ch.cache)
+}
+
+func TestDockerResolver(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "docker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/containers/abc/json" {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write([]byte(`{"Id":"abc","Name":"/web","Config":{"Image":"nginx:1.15","Labels":{"io.kubernetes.pod.namespace":"prod"}}}`))
+		}))
+	}()
+
+	dr := NewDockerResolver(socket)
+	tags, err := dr.Resolve(context.Background(), "abc")
+	require.NoError(t, err)
+	assert.Equal(t, gostatsd.Tags{"container_name:web", "image_name:nginx:1.15", "container_namespace:prod"}, tags)
+
+	_, err = dr.Resolve(context.Background(), "missing")
+	assert.Error(t, err)
+}
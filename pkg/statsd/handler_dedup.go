@@ -0,0 +1,118 @@
+package statsd
+
+import (
+	"context"
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	stats "github.com/atlassian/gostatsd/pkg/statser"
+)
+
+// MetricDeduplicator drops metrics with a name matching a pattern which are identical to one received within a short
+// window, such as those sent again by a client which retries too eagerly.  Metrics are identical if they have the same
+// name, type, value, sample rate, tags, host and source IP.  Events are passed through unchanged.
+type MetricDeduplicator struct {
+	metricsDuplicate uint64 // accessed atomically
+
+	cumulMetricsDuplicate uint64 // only accessed by RunMetrics
+
+	match   gostatsd.StringMatchList
+	window  dedupWindow
+	metrics MetricHandler
+	events  EventHandler
+	now     func() time.Time
+}
+
+// NewMetricDeduplicator creates a MetricDeduplicator which drops metrics with a name matching any of match, if they
+// are identical to one received within window.
+func NewMetricDeduplicator(window time.Duration, match []string, metrics MetricHandler, events EventHandler) *MetricDeduplicator {
+	return &MetricDeduplicator{
+		match:   toStringMatch(match),
+		window:  newDedupWindow(window),
+		metrics: metrics,
+		events:  events,
+		now:     time.Now,
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (md *MetricDeduplicator) EstimatedTags() int {
+	return md.metrics.EstimatedTags()
+}
+
+// DispatchMetric drops m if it is a duplicate, otherwise passes it on.
+func (md *MetricDeduplicator) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
+	if md.match.MatchAny(m.Name) && md.window.seen(metricHash(m), md.now()) {
+		atomic.AddUint64(&md.metricsDuplicate, 1)
+		m.Done()
+		return nil
+	}
+	return md.metrics.DispatchMetric(ctx, m)
+}
+
+// DispatchEvent passes e on.
+func (md *MetricDeduplicator) DispatchEvent(ctx context.Context, e *gostatsd.Event) error {
+	return md.events.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (md *MetricDeduplicator) WaitForEvents() {
+	md.events.WaitForEvents()
+}
+
+// RunMetrics attaches a Statser to the MetricDeduplicator.  Stops when the context is closed.
+func (md *MetricDeduplicator) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			md.cumulMetricsDuplicate += atomic.SwapUint64(&md.metricsDuplicate, 0)
+			statser.Gauge("dedup.metrics_duplicate", float64(md.cumulMetricsDuplicate), nil)
+		}
+	}
+}
+
+// metricHash returns a 64 bit hash of everything which identifies a submission of m.  Tags are hashed in sorted
+// order, so the same tags sent in a different order are still identical.
+func metricHash(m *gostatsd.Metric) uint64 {
+	h := fnv.New64a()
+	hashString(h, m.Name)
+	hashString(h, m.Type.String())
+	hashFloat(h, m.Value)
+	for _, v := range m.Values {
+		hashFloat(h, v)
+	}
+	hashFloat(h, m.Rate)
+	hashString(h, m.StringValue)
+	tags := make([]string, len(m.Tags))
+	copy(tags, m.Tags)
+	sort.Strings(tags)
+	for _, tag := range tags {
+		hashString(h, tag)
+	}
+	hashString(h, m.Hostname)
+	hashString(h, string(m.SourceIP))
+	return h.Sum64()
+}
+
+// hashString writes s to h, followed by a separator so adjacent strings can't run together.
+func hashString(h hash.Hash64, s string) {
+	_, _ = h.Write([]byte(s))
+	_, _ = h.Write([]byte{0})
+}
+
+func hashFloat(h hash.Hash64, f float64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+	_, _ = h.Write(b[:])
+}
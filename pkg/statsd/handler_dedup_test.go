@@ -0,0 +1,94 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMetricDeduplicator(match ...string) (*MetricDeduplicator, *TagCapturingHandler, *time.Time) {
+	tch := &TagCapturingHandler{}
+	md := NewMetricDeduplicator(500*time.Millisecond, match, tch, tch)
+	now := time.Now()
+	md.now = func() time.Time {
+		return now
+	}
+	return md, tch, &now
+}
+
+func dedupTestMetric() *gostatsd.Metric {
+	return &gostatsd.Metric{
+		Name:     "retry.count",
+		Value:    1,
+		Rate:     1,
+		Tags:     gostatsd.Tags{"a:1", "b:2"},
+		Hostname: "host",
+		SourceIP: "10.0.0.1",
+		Type:     gostatsd.COUNTER,
+	}
+}
+
+func TestMetricDeduplicatorWithinWindow(t *testing.T) {
+	t.Parallel()
+	md, tch, now := newTestMetricDeduplicator("retry.*")
+	ctx := context.Background()
+
+	require.NoError(t, md.DispatchMetric(ctx, dedupTestMetric()))
+	*now = now.Add(100 * time.Millisecond)
+	require.NoError(t, md.DispatchMetric(ctx, dedupTestMetric()))
+	// Tag order doesn't matter.
+	m := dedupTestMetric()
+	m.Tags = gostatsd.Tags{"b:2", "a:1"}
+	require.NoError(t, md.DispatchMetric(ctx, m))
+	assert.Len(t, tch.m, 1)
+	assert.EqualValues(t, 2, md.metricsDuplicate)
+
+	// Anything which differs is not a duplicate.
+	m = dedupTestMetric()
+	m.Value = 2
+	require.NoError(t, md.DispatchMetric(ctx, m))
+	m = dedupTestMetric()
+	m.Type = gostatsd.GAUGE
+	require.NoError(t, md.DispatchMetric(ctx, m))
+	m = dedupTestMetric()
+	m.Tags = gostatsd.Tags{"a:1"}
+	require.NoError(t, md.DispatchMetric(ctx, m))
+	m = dedupTestMetric()
+	m.SourceIP = "10.0.0.2"
+	require.NoError(t, md.DispatchMetric(ctx, m))
+	assert.Len(t, tch.m, 5)
+	assert.EqualValues(t, 2, md.metricsDuplicate)
+}
+
+func TestMetricDeduplicatorAcrossWindow(t *testing.T) {
+	t.Parallel()
+	md, tch, now := newTestMetricDeduplicator("retry.*")
+	ctx := context.Background()
+
+	// The same metric sent every window is never dropped.
+	for i := 0; i < 5; i++ {
+		require.NoError(t, md.DispatchMetric(ctx, dedupTestMetric()))
+		*now = now.Add(501 * time.Millisecond)
+	}
+	assert.Len(t, tch.m, 5)
+	assert.Zero(t, md.metricsDuplicate)
+}
+
+func TestMetricDeduplicatorUnmatched(t *testing.T) {
+	t.Parallel()
+	md, tch, _ := newTestMetricDeduplicator("other.*", "retry.count.exact")
+	ctx := context.Background()
+
+	require.NoError(t, md.DispatchMetric(ctx, dedupTestMetric()))
+	require.NoError(t, md.DispatchMetric(ctx, dedupTestMetric()))
+	require.NoError(t, md.DispatchEvent(ctx, &gostatsd.Event{Title: "e"}))
+	require.NoError(t, md.DispatchEvent(ctx, &gostatsd.Event{Title: "e"}))
+	assert.Len(t, tch.m, 2)
+	assert.Len(t, tch.e, 2)
+	assert.Zero(t, md.metricsDuplicate)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -14,37 +15,67 @@ type TagHandler struct {
 	events        EventHandler
 	tags          gostatsd.Tags // Tags to add to all metrics
 	filters       []Filter
+	aliases       []Alias
+	scalings      []Scaling
+	processors    []Processor // Applied in order to each metric, starting with the built-in filters
 	estimatedTags int
+	rulesFile     *RulesFile // If set, its rules, which start with those above, are applied instead.  May be nil
 }
 
 var present = struct{}{}
 
 func NewTagHandlerFromViper(v *viper.Viper, metrics MetricHandler, events EventHandler, tags gostatsd.Tags) *TagHandler {
-	filterNameList := v.GetStringSlice("filters")
-	var filters []Filter
-	for _, filterName := range filterNameList {
-		vFilter := v.Sub("filter." + filterName)
-		if vFilter == nil {
-			logrus.Warnf("Filter doesn't exist: %v", filterName)
-			continue
-		}
-		filters = append(filters, NewFilterFromViper(vFilter))
-		logrus.Infof("Loaded filter %v", filterName)
+	rules, errs := LoadTagRules(v)
+	for _, err := range errs {
+		logging.Component("config").WithError(err).Warn("Skipping rule")
+	}
+	th := NewTagHandler(metrics, events, tags, rules.Filters)
+	th.aliases = rules.Aliases
+	th.scalings = rules.Scalings
+	if len(rules.Filters)+len(rules.Aliases)+len(rules.Scalings) > 0 {
+		logging.Component("config").Infof("Loaded %s", describeTagRules(rules))
+	}
+	return th
+}
+
+// SetRulesFile loads further rules from a file, applied after the rules the handler was created with, and reloaded
+// by the returned RulesFile.
+func (th *TagHandler) SetRulesFile(path string, logger logrus.FieldLogger) (*RulesFile, error) {
+	rf, err := NewRulesFile(path, th.rules(), logger)
+	if err != nil {
+		return nil, err
 	}
-	return NewTagHandler(metrics, events, tags, filters)
+	th.rulesFile = rf
+	return rf, nil
+}
+
+// rules returns the filters, aliases and scalings currently applied.
+func (th *TagHandler) rules() TagRules {
+	if th.rulesFile != nil {
+		return *th.rulesFile.Rules()
+	}
+	return TagRules{Filters: th.filters, Aliases: th.aliases, Scalings: th.scalings}
 }
 
 // NewTagHandler initialises a new handler which adds unique tags, and sends metrics/events to the next handler based
 // on filter rules.
 func NewTagHandler(metrics MetricHandler, events EventHandler, tags gostatsd.Tags, filters []Filter) *TagHandler {
 	tags = uniqueTags(tags, gostatsd.Tags{}) // de-dupe tags
-	return &TagHandler{
+	th := &TagHandler{
 		metrics:       metrics,
 		events:        events,
 		tags:          tags,
 		filters:       filters,
 		estimatedTags: len(tags) + metrics.EstimatedTags(),
 	}
+	th.processors = []Processor{ProcessorFunc(th.filterAndAddTags)}
+	return th
+}
+
+// AddProcessors appends processors to the pipeline applied to each metric, after the built-in filters and in the
+// order given.
+func (th *TagHandler) AddProcessors(processors ...Processor) {
+	th.processors = append(th.processors, processors...)
 }
 
 // EstimatedTags returns a guess for how many tags to pre-allocate
@@ -52,35 +83,65 @@ func (th *TagHandler) EstimatedTags() int {
 	return th.estimatedTags
 }
 
-// DispatchMetric adds the unique tags from the TagHandler to the metric and passes it to the next stage in the pipeline
+// DispatchMetric applies each processor to the metric, starting with the built-in filters which add the unique tags
+// from the TagHandler, and passes it to the next stage in the pipeline, along with a copy for each alias of its name.
 func (th *TagHandler) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
 	if m.Hostname == "" {
 		m.Hostname = string(m.SourceIP)
 	}
-	if th.uniqueFilterMetricAndAddTags(m) {
+	for _, p := range th.processors {
+		if m = p.Process(m); m == nil {
+			return nil
+		}
+	}
+	aliases := th.rules().Aliases
+	if len(aliases) == 0 {
 		return th.metrics.DispatchMetric(ctx, m)
 	}
+	// The copies must be made before m is dispatched, as it may be returned to a pool once it has been handled.
+	copies := aliasMetrics(aliases, m)
+	if err := th.metrics.DispatchMetric(ctx, m); err != nil {
+		return err
+	}
+	for _, c := range copies {
+		if err := th.metrics.DispatchMetric(ctx, c); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// filterAndAddTags is the built-in processor, which returns m with the static tags added, the filters applied and
+// its value scaled, or nil to drop it.
+func (th *TagHandler) filterAndAddTags(m *gostatsd.Metric) *gostatsd.Metric {
+	rules := th.rules()
+	if !th.uniqueFilterMetricAndAddTags(rules.Filters, m) {
+		return nil
+	}
+	if len(rules.Scalings) > 0 {
+		scaleMetric(rules.Scalings, m)
+	}
+	return m
+}
+
 // uniqueFilterMetricAndAddTags will perform 3 tasks:
 // - Add static tags configured to the metric
 // - De-duplicate tags
-// - Perform rule based filtering
+// - Perform rule based filtering with filters
 //
 // Everything is done in one function for efficiency, as the steps listed above are interrelated, and this is on the
 // hot code path.
 //
 // Returns true if the metric should be processed further, or false to drop it.
-func (th *TagHandler) uniqueFilterMetricAndAddTags(m *gostatsd.Metric) bool {
-	if len(th.filters) == 0 {
+func (th *TagHandler) uniqueFilterMetricAndAddTags(filters []Filter, m *gostatsd.Metric) bool {
+	if len(filters) == 0 {
 		m.Tags = uniqueTags(m.Tags, th.tags)
 		return true
 	}
 
 	dropTags := map[string]struct{}{}
 
-	for _, filter := range th.filters {
+	for _, filter := range filters {
 		if len(filter.MatchMetrics) > 0 && !filter.MatchMetrics.MatchAny(m.Name) { // returns false if nothing present
 			// name doesn't match an include, stop
 			continue
@@ -562,3 +562,44 @@ func BenchmarkTagEventHandlerAddsDuplicateTagsLarge(b *testing.B) {
 		th.DispatchEvent(context.Background(), e)
 	}
 }
+
+func TestProcessorsAppliedInOrder(t *testing.T) {
+	t.Parallel()
+	tch := &TagCapturingHandler{}
+	th := NewTagHandler(tch, tch, gostatsd.Tags{"env:prod"}, []Filter{
+		{MatchMetrics: toStringMatch([]string{"secret.*"}), DropMetric: true},
+	})
+	var seen []string
+	team := ProcessorFunc(func(m *gostatsd.Metric) *gostatsd.Metric {
+		seen = append(seen, "team:"+m.Name)
+		if strings.HasPrefix(m.Name, "billing.") {
+			m.Tags = append(m.Tags, "team:payments")
+		}
+		return m
+	})
+	rename := ProcessorFunc(func(m *gostatsd.Metric) *gostatsd.Metric {
+		seen = append(seen, "rename:"+m.Name)
+		if m.Name == "debug.noise" {
+			return nil
+		}
+		m.Name = strings.Replace(m.Name, "billing.", "payments.", 1)
+		return m
+	})
+	th.AddProcessors(team, rename)
+
+	for _, name := range []string{"billing.invoices", "secret.key", "debug.noise", "api.requests"} {
+		assert.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: name}))
+	}
+
+	// The built-in filters run first, so a dropped metric reaches neither processor, and each processor sees the
+	// metric as left by the one before.
+	assert.Equal(t, []string{
+		"team:billing.invoices", "rename:billing.invoices",
+		"team:debug.noise", "rename:debug.noise",
+		"team:api.requests", "rename:api.requests",
+	}, seen)
+	assert.Equal(t, []*gostatsd.Metric{
+		{Name: "payments.invoices", Tags: gostatsd.Tags{"env:prod", "team:payments"}},
+		{Name: "api.requests", Tags: gostatsd.Tags{"env:prod"}},
+	}, tch.m)
+}
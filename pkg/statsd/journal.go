@@ -0,0 +1,445 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	stats "github.com/atlassian/gostatsd/pkg/statser"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// The journal file starts with the magic string, followed by records.  Each record is the length of the payload as a
+// uvarint, the payload, and the CRC32 of the payload as 4 bytes big endian.  The payload is a metric in the state
+// file encoding.  Records are only ever appended, so a crash can only leave a partially written record at the end.
+const (
+	journalMagic         = "GSDJRNL1"
+	maxJournalRecordSize = 1 << 20 // Longest record accepted, to catch garbage early
+)
+
+// journalOp is a request to the journal's writing goroutine.
+type journalOp struct {
+	truncate bool  // Remove the records before offset, rather than return the size of the journal
+	offset   int64 // Bytes of records to remove if truncate is set
+	result   chan int64
+}
+
+// Journal appends metrics with a name matching a pattern to a file as they are received, so that they can be
+// replayed in to the aggregators if the server crashes before they are flushed.  The file is truncated after each
+// flush which all backends sent successfully.  Events are passed through unchanged.
+//
+// Records are written by a separate goroutine from a bounded queue, so a slow disk never delays the metrics, and
+// records are dropped if the queue is full.  They are batched, and synced to disk every syncInterval, so a crash of
+// the host, rather than the process, loses up to syncInterval of records.  The journal is marked at the start of each
+// flush, and truncated to the mark once it has been sent, so a metric received while a flush is in progress may be
+// both flushed and left in the journal, and replayed again after a crash.  A metric still queued for its aggregator
+// when the flush starts may be removed before it is flushed, which is rare unless the aggregators are overloaded.
+type Journal struct {
+	recordsWritten uint64 // accessed atomically
+	recordsDropped uint64 // accessed atomically
+	writeErrors    uint64 // accessed atomically
+
+	path         string
+	match        gostatsd.StringMatchList
+	syncInterval time.Duration
+	records      chan []byte
+	ops          chan journalOp
+	metrics      MetricHandler
+	events       EventHandler
+	logLimiter   *rate.Limiter
+	logger       log.FieldLogger
+
+	// Only accessed by the writing goroutine, or before it starts and after it stops.
+	file      *os.File
+	w         *bufio.Writer
+	size      int64  // Bytes of records in the journal, including those buffered in w
+	dirty     bool   // Records have been written since the file was last synced
+	recovered []byte // Records found in the file on startup, which have not been replayed
+}
+
+// NewJournal opens the journal at path, creating it if it doesn't exist, which records metrics with a name matching
+// any of match in a queue of up to queueSize records, synced every syncInterval.  Records left in the journal are
+// kept to be replayed, after any corrupt records at the end of it are removed.
+func NewJournal(path string, match []string, syncInterval time.Duration, queueSize int, metrics MetricHandler, events EventHandler, logger log.FieldLogger) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		path:         path,
+		match:        toStringMatch(match),
+		syncInterval: syncInterval,
+		records:      make(chan []byte, queueSize),
+		ops:          make(chan journalOp),
+		metrics:      metrics,
+		events:       events,
+		// Allow a burst of logs, then at most one a second.
+		logLimiter: rate.NewLimiter(1, 10),
+		logger:     logger,
+		file:       file,
+		w:          bufio.NewWriter(file),
+	}
+	if err := j.recover(); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to read journal %s: %v", path, err)
+	}
+	return j, nil
+}
+
+// recover reads the records left in the journal, removing any corrupt records at the end, and positions the file to
+// append to it.
+func (j *Journal) recover() error {
+	data, err := ioutil.ReadAll(j.file)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		_, err := j.file.Write([]byte(journalMagic))
+		return err
+	}
+	if len(data) < len(journalMagic) || string(data[:len(journalMagic)]) != journalMagic {
+		return fmt.Errorf("not a journal file")
+	}
+	records := data[len(journalMagic):]
+	n, count := scanJournal(records)
+	if n < len(records) {
+		j.logger.WithField("path", j.path).Warnf("Skipping %d bytes of corrupt records at the end of the journal", len(records)-n)
+		if err := j.file.Truncate(int64(len(journalMagic) + n)); err != nil {
+			return err
+		}
+	}
+	if _, err := j.file.Seek(int64(len(journalMagic)+n), 0); err != nil {
+		return err
+	}
+	j.recovered = records[:n]
+	j.size = int64(n)
+	if count > 0 {
+		j.logger.Infof("Found %d metrics in journal %s", count, j.path)
+	}
+	return nil
+}
+
+// scanJournal returns the length of the valid records at the start of records, and how many there are.
+func scanJournal(records []byte) (n, count int) {
+	for n < len(records) {
+		length, k := binary.Uvarint(records[n:])
+		if k <= 0 || length > maxJournalRecordSize || uint64(len(records)-n-k) < length+4 {
+			return n, count
+		}
+		payload := records[n+k : n+k+int(length)]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(records[n+k+int(length):]) {
+			return n, count
+		}
+		n += k + int(length) + 4
+		count++
+	}
+	return n, count
+}
+
+// encodeJournalRecord returns the record of m.
+func encodeJournalRecord(m *gostatsd.Metric) []byte {
+	var p stateEncoder
+	p.string(m.Name)
+	p.uvarint(uint64(m.Type))
+	p.float(m.Value)
+	p.uvarint(uint64(len(m.Values)))
+	for _, v := range m.Values {
+		p.float(v)
+	}
+	p.float(m.Rate)
+	p.tags(m.Tags)
+	p.string(m.StringValue)
+	p.string(m.Hostname)
+	p.string(string(m.SourceIP))
+	p.varint(int64(m.TTL))
+	if m.GaugeDelta {
+		// Only written when set, so records written before it was added still decode.
+		p.uvarint(1)
+	}
+
+	var e stateEncoder
+	e.bytes(p.buf)
+	binary.BigEndian.PutUint32(e.tmp[:4], crc32.ChecksumIEEE(p.buf))
+	e.buf = append(e.buf, e.tmp[:4]...)
+	return e.buf
+}
+
+// decodeJournalRecords calls f with the metric of each record in records, which must have been checked by
+// scanJournal.
+func decodeJournalRecords(records []byte, f func(m *gostatsd.Metric) error) error {
+	d := stateDecoder{buf: records}
+	for len(d.buf) > 0 {
+		payload := stateDecoder{buf: d.bytes()}
+		if d.err != nil || len(d.buf) < 4 {
+			return errStateTruncated
+		}
+		d.buf = d.buf[4:] // Checksum
+		m := &gostatsd.Metric{
+			Name:  payload.string(),
+			Type:  gostatsd.MetricType(payload.uvarint()),
+			Value: payload.float(),
+		}
+		if n := payload.count(); n > 0 {
+			m.Values = make([]float64, 0, n)
+			for i := 0; i < n && payload.err == nil; i++ {
+				m.Values = append(m.Values, payload.float())
+			}
+		}
+		m.Rate = payload.float()
+		m.Tags = payload.tags()
+		m.StringValue = payload.string()
+		m.Hostname = payload.string()
+		m.SourceIP = gostatsd.IP(payload.string())
+		m.TTL = time.Duration(payload.varint())
+		if len(payload.buf) > 0 {
+			m.GaugeDelta = payload.uvarint() == 1
+		}
+		if payload.err != nil {
+			return payload.err
+		}
+		if err := f(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replay passes the metrics left in the journal when it was opened to the next handler.  They stay in the journal
+// until they are flushed.
+func (j *Journal) Replay(ctx context.Context) error {
+	count := 0
+	err := decodeJournalRecords(j.recovered, func(m *gostatsd.Metric) error {
+		count++
+		return j.metrics.DispatchMetric(ctx, m)
+	})
+	j.recovered = nil
+	if err != nil {
+		return fmt.Errorf("failed to replay journal %s: %v", j.path, err)
+	}
+	if count > 0 {
+		j.logger.Infof("Replayed %d metrics from journal %s", count, j.path)
+	}
+	return nil
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (j *Journal) EstimatedTags() int {
+	return j.metrics.EstimatedTags()
+}
+
+// DispatchMetric queues a record of m to be written if its name matches, and passes it on.
+func (j *Journal) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
+	if j.match.MatchAny(m.Name) {
+		// The record is encoded now, as m may be reused once it has been passed on.
+		select {
+		case j.records <- encodeJournalRecord(m):
+		default:
+			atomic.AddUint64(&j.recordsDropped, 1)
+			if j.logLimiter.Allow() {
+				j.logger.WithField(logging.FieldBucket, m.Name).Warn("Journal queue is full, metric was not journaled")
+			}
+		}
+	}
+	return j.metrics.DispatchMetric(ctx, m)
+}
+
+// DispatchEvent passes e on.
+func (j *Journal) DispatchEvent(ctx context.Context, e *gostatsd.Event) error {
+	return j.events.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (j *Journal) WaitForEvents() {
+	j.events.WaitForEvents()
+}
+
+// Run writes the queued records until ctx is done, syncing them every syncInterval, and once more before it returns.
+func (j *Journal) Run(ctx context.Context) {
+	syncTicker := time.NewTicker(j.syncInterval)
+	defer syncTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			j.drain()
+			j.sync()
+			return
+		case record := <-j.records:
+			j.append(record)
+		case op := <-j.ops:
+			if op.truncate {
+				j.truncate(op.offset)
+			} else {
+				// Records queued before the mark are counted in it, as their metrics may be in this flush.
+				j.drain()
+			}
+			op.result <- j.size
+		case <-syncTicker.C:
+			j.sync()
+		}
+	}
+}
+
+// drain writes the records which are queued.
+func (j *Journal) drain() {
+	for i := len(j.records); i > 0; i-- {
+		j.append(<-j.records)
+	}
+}
+
+func (j *Journal) append(record []byte) {
+	if _, err := j.w.Write(record); err != nil {
+		j.writeError("write to", err)
+		return
+	}
+	j.size += int64(len(record))
+	j.dirty = true
+	atomic.AddUint64(&j.recordsWritten, 1)
+}
+
+func (j *Journal) sync() {
+	if !j.dirty {
+		return
+	}
+	if err := j.w.Flush(); err != nil {
+		j.writeError("write to", err)
+		return
+	}
+	if err := j.file.Sync(); err != nil {
+		j.writeError("sync", err)
+		return
+	}
+	j.dirty = false
+}
+
+// truncate removes the first offset bytes of records from the journal.  Records after offset are copied to a new
+// file, which replaces the journal.
+func (j *Journal) truncate(offset int64) {
+	if err := j.w.Flush(); err != nil {
+		j.writeError("write to", err)
+		return
+	}
+	if offset >= j.size {
+		if err := j.file.Truncate(int64(len(journalMagic))); err != nil {
+			j.writeError("truncate", err)
+			return
+		}
+		if _, err := j.file.Seek(int64(len(journalMagic)), 0); err != nil {
+			j.writeError("truncate", err)
+			return
+		}
+		j.size = 0
+		j.dirty = true
+		return
+	}
+	if offset <= 0 {
+		return
+	}
+	tail := make([]byte, len(journalMagic)+int(j.size-offset))
+	copy(tail, journalMagic)
+	if _, err := j.file.ReadAt(tail[len(journalMagic):], int64(len(journalMagic))+offset); err != nil {
+		j.writeError("read", err)
+		return
+	}
+	file, err := writeJournalFile(j.path, tail)
+	if err != nil {
+		j.writeError("truncate", err)
+		return
+	}
+	_ = j.file.Close()
+	j.file = file
+	j.w.Reset(file)
+	j.size -= offset
+	j.dirty = false
+}
+
+// writeJournalFile replaces the file at path with data, returning it open to append to.
+func writeJournalFile(path string, data []byte) (*os.File, error) {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (j *Journal) writeError(action string, err error) {
+	atomic.AddUint64(&j.writeErrors, 1)
+	if j.logLimiter.Allow() {
+		j.logger.WithError(err).WithField("path", j.path).Errorf("Failed to %s journal", action)
+	}
+}
+
+// mark returns the size of the journal, including every record queued before it was called, to truncate it to once
+// the metrics received so far are flushed.  It returns false if j is nil, or ctx is done.
+func (j *Journal) mark(ctx context.Context) (int64, bool) {
+	if j == nil {
+		return 0, false
+	}
+	return j.do(ctx, journalOp{})
+}
+
+// truncateTo removes the records before the offset returned by mark, once their metrics have been flushed.
+func (j *Journal) truncateTo(ctx context.Context, offset int64) {
+	_, _ = j.do(ctx, journalOp{truncate: true, offset: offset})
+}
+
+func (j *Journal) do(ctx context.Context, op journalOp) (int64, bool) {
+	op.result = make(chan int64, 1)
+	select {
+	case <-ctx.Done():
+		return 0, false
+	case j.ops <- op:
+	}
+	select {
+	case <-ctx.Done():
+		return 0, false
+	case size := <-op.result:
+		return size, true
+	}
+}
+
+// Clear removes every record from the journal, such as when its metrics have been saved to the state file.  It must
+// only be called once Run has returned.
+func (j *Journal) Clear() {
+	j.truncate(j.size)
+	j.sync()
+}
+
+// RunMetrics attaches a Statser to the Journal.  Stops when the context is closed.
+func (j *Journal) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("journal.records_written", float64(atomic.LoadUint64(&j.recordsWritten)), nil)
+			statser.Gauge("journal.records_dropped", float64(atomic.LoadUint64(&j.recordsDropped)), nil)
+			statser.Gauge("journal.write_errors", float64(atomic.LoadUint64(&j.writeErrors)), nil)
+		}
+	}
+}
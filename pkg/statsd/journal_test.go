@@ -0,0 +1,242 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestJournal(t *testing.T, path string, next *TagCapturingHandler) *Journal {
+	j, err := NewJournal(path, []string{"revenue.*"}, time.Hour, 100, next, next, logrus.StandardLogger())
+	require.NoError(t, err)
+	return j
+}
+
+func journalDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	return dir, func() { _ = os.RemoveAll(dir) }
+}
+
+// runJournal runs j until the returned function is called, which waits for it to stop.
+func runJournal(j *Journal) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		j.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := journalDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "journal")
+	ctx := context.Background()
+
+	next := &TagCapturingHandler{}
+	j := newTestJournal(t, path, next)
+	stop := runJournal(j)
+	revenue := &gostatsd.Metric{Name: "revenue.orders", Value: 3, Rate: 0.5, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"shop:au"}, Hostname: "web1", SourceIP: "10.0.0.1"}
+	timer := &gostatsd.Metric{Name: "revenue.checkout", Value: 1, Values: []float64{2, 3}, Rate: 1, Type: gostatsd.TIMER, TTL: time.Minute}
+	require.NoError(t, j.DispatchMetric(ctx, revenue))
+	require.NoError(t, j.DispatchMetric(ctx, &gostatsd.Metric{Name: "api.requests", Value: 1, Rate: 1, Type: gostatsd.COUNTER}))
+	require.NoError(t, j.DispatchMetric(ctx, timer))
+	// Every metric is passed on, whether or not it is journaled.
+	assert.Len(t, next.m, 3)
+	// The process crashes without a flush.
+	stop()
+	require.NoError(t, j.file.Close())
+
+	replayed := &TagCapturingHandler{}
+	j = newTestJournal(t, path, replayed)
+	defer j.file.Close()
+	require.NoError(t, j.Replay(ctx))
+	assert.Equal(t, []*gostatsd.Metric{revenue, timer}, replayed.m)
+}
+
+func TestJournalRecordGaugeDelta(t *testing.T) {
+	t.Parallel()
+	var decoded []*gostatsd.Metric
+	records := append(encodeJournalRecord(&gostatsd.Metric{Name: "revenue.level", Value: -5, Rate: 1, Type: gostatsd.GAUGE, GaugeDelta: true}),
+		encodeJournalRecord(&gostatsd.Metric{Name: "revenue.level", Value: 5, Rate: 1, Type: gostatsd.GAUGE})...)
+	require.NoError(t, decodeJournalRecords(records, func(m *gostatsd.Metric) error {
+		decoded = append(decoded, m)
+		return nil
+	}))
+	require.Len(t, decoded, 2)
+	assert.True(t, decoded[0].GaugeDelta)
+	assert.Equal(t, -5.0, decoded[0].Value)
+	assert.False(t, decoded[1].GaugeDelta)
+}
+
+func TestJournalTruncate(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := journalDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "journal")
+	ctx := context.Background()
+
+	j := newTestJournal(t, path, &TagCapturingHandler{})
+	stop := runJournal(j)
+	require.NoError(t, j.DispatchMetric(ctx, &gostatsd.Metric{Name: "revenue.flushed", Rate: 1}))
+	mark, ok := j.mark(ctx)
+	require.True(t, ok)
+	require.NoError(t, j.DispatchMetric(ctx, &gostatsd.Metric{Name: "revenue.pending", Rate: 1}))
+	j.truncateTo(ctx, mark)
+	require.NoError(t, j.DispatchMetric(ctx, &gostatsd.Metric{Name: "revenue.later", Rate: 1}))
+	stop()
+	require.NoError(t, j.file.Close())
+
+	replayed := &TagCapturingHandler{}
+	j = newTestJournal(t, path, replayed)
+	require.NoError(t, j.Replay(ctx))
+	require.Len(t, replayed.m, 2)
+	assert.Equal(t, "revenue.pending", replayed.m[0].Name)
+	assert.Equal(t, "revenue.later", replayed.m[1].Name)
+
+	// Truncating to the end leaves an empty journal, which is still appended to.
+	stop = runJournal(j)
+	mark, ok = j.mark(ctx)
+	require.True(t, ok)
+	j.truncateTo(ctx, mark)
+	require.NoError(t, j.DispatchMetric(ctx, &gostatsd.Metric{Name: "revenue.last", Rate: 1}))
+	stop()
+	require.NoError(t, j.file.Close())
+
+	replayed = &TagCapturingHandler{}
+	j = newTestJournal(t, path, replayed)
+	defer j.file.Close()
+	require.NoError(t, j.Replay(ctx))
+	require.Len(t, replayed.m, 1)
+	assert.Equal(t, "revenue.last", replayed.m[0].Name)
+}
+
+func TestJournalSkipsCorruptRecords(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := journalDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "journal")
+	ctx := context.Background()
+
+	good := encodeJournalRecord(&gostatsd.Metric{Name: "revenue.good", Rate: 1})
+	bad := encodeJournalRecord(&gostatsd.Metric{Name: "revenue.bad", Rate: 1})
+	bad[len(bad)-1] ^= 0xff // Checksum
+	partial := encodeJournalRecord(&gostatsd.Metric{Name: "revenue.partial", Rate: 1})
+	for _, tail := range [][]byte{bad, partial[:len(partial)-3]} {
+		data := append([]byte(journalMagic), good...)
+		data = append(data, tail...)
+		require.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+		replayed := &TagCapturingHandler{}
+		j := newTestJournal(t, path, replayed)
+		require.NoError(t, j.Replay(ctx))
+		require.Len(t, replayed.m, 1)
+		assert.Equal(t, "revenue.good", replayed.m[0].Name)
+
+		// The corrupt record is removed, so records are appended after the good one.
+		stop := runJournal(j)
+		require.NoError(t, j.DispatchMetric(ctx, &gostatsd.Metric{Name: "revenue.next", Rate: 1}))
+		stop()
+		require.NoError(t, j.file.Close())
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		n, count := scanJournal(data[len(journalMagic):])
+		assert.Equal(t, len(data)-len(journalMagic), n)
+		assert.Equal(t, 2, count)
+	}
+}
+
+func TestJournalRejectsOtherFiles(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := journalDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "journal")
+	require.NoError(t, ioutil.WriteFile(path, []byte("important data"), 0600))
+
+	_, err := NewJournal(path, []string{"*"}, time.Second, 1, &nopHandler{}, &nopHandler{}, logrus.StandardLogger())
+	assert.EqualError(t, err, "failed to read journal "+path+": not a journal file")
+}
+
+func TestJournalQueueFullDoesNotBlock(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := journalDir(t)
+	defer cleanup()
+
+	next := &TagCapturingHandler{}
+	j, err := NewJournal(filepath.Join(dir, "journal"), []string{"revenue.*"}, time.Second, 1, next, next, logrus.StandardLogger())
+	require.NoError(t, err)
+	defer j.file.Close()
+	// Nothing writes the queue, so it fills up.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, j.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "revenue.orders", Rate: 1}))
+	}
+	assert.Len(t, next.m, 3)
+	assert.EqualValues(t, 2, j.recordsDropped)
+}
+
+// failingBackend fails to send every flush.
+type failingBackend struct{}
+
+func (failingBackend) Name() string {
+	return "failing"
+}
+
+func (failingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	cb([]error{errors.New("boom")})
+}
+
+func (failingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestFlusherTruncatesJournal(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := journalDir(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name     string
+		backends []gostatsd.Backend
+		replayed int
+	}{
+		{name: "sent", backends: []gostatsd.Backend{&timerBackend{}}, replayed: 0},
+		{name: "failed", backends: []gostatsd.Backend{&timerBackend{}, failingBackend{}}, replayed: 1},
+	} {
+		path := filepath.Join(dir, tc.name)
+		agg := newFakeAggregator()
+		j, err := NewJournal(path, []string{"revenue.*"}, time.Hour, 100, &nopHandler{}, &nopHandler{}, logrus.StandardLogger())
+		require.NoError(t, err)
+		stop := runJournal(j)
+		require.NoError(t, j.DispatchMetric(ctx, &gostatsd.Metric{Name: "revenue.orders", Value: 1, Rate: 1, Type: gostatsd.COUNTER}))
+
+		fl := NewMetricFlusher(time.Second, &singleAggregator{agg: agg}, nil, tc.backends, "host", false, false, nil, nil, nil, statser.NewNullStatser())
+		fl.journal = j
+		fl.flushData(ctx, time.Second, 0)
+		stop()
+		require.NoError(t, j.file.Close())
+
+		replayed := &TagCapturingHandler{}
+		j = newTestJournal(t, path, replayed)
+		require.NoError(t, j.Replay(ctx))
+		assert.Len(t, replayed.m, tc.replayed, tc.name)
+		require.NoError(t, j.file.Close())
+	}
+}
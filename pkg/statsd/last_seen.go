@@ -0,0 +1,194 @@
+package statsd
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+)
+
+// sourcesDefaultN is the number of sources the sources command lists if no number is given.
+const sourcesDefaultN = 50
+
+// seenSource is when one source last sent a datagram.
+type seenSource struct {
+	ip        gostatsd.IP
+	lastSeen  time.Time
+	datagrams uint64 // Datagrams received since the source was first seen
+	silent    bool   // Set once the source has been reported as silent, until it sends again
+}
+
+// LastSeen tracks when each source last sent a datagram, so a client which stops sending can be spotted.  At most
+// maxSources sources are tracked, the least recently seen being evicted to make room for a new one, and a source is
+// forgotten once nothing has been received from it for expiry.  A source which is silent for longer than
+// silentThreshold is reported once, until it sends again.  A nil *LastSeen tracks nothing.
+type LastSeen struct {
+	evicted uint64 // Must be read/written only using atomic instructions.
+
+	maxSources      int
+	expiry          time.Duration
+	silentThreshold time.Duration    // 0 to not report silent sources
+	now             func() time.Time // Returns current time. Useful for testing.
+
+	mu      sync.Mutex
+	sources map[gostatsd.IP]*list.Element
+	order   *list.List // Of *seenSource, the most recently seen first
+}
+
+// NewLastSeen creates a LastSeen which tracks up to maxSources sources, forgetting those silent for expiry, and
+// reporting those silent for silentThreshold if it is not 0.
+func NewLastSeen(maxSources int, expiry, silentThreshold time.Duration) *LastSeen {
+	return &LastSeen{
+		maxSources:      maxSources,
+		expiry:          expiry,
+		silentThreshold: silentThreshold,
+		now:             time.Now,
+		sources:         map[gostatsd.IP]*list.Element{},
+		order:           list.New(),
+	}
+}
+
+// seenBatch records the sources of a batch of datagrams, taking the lock once for the whole batch.
+func (ls *LastSeen) seenBatch(dgs []*Datagram) {
+	var now time.Time
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, dg := range dgs {
+		at := dg.Received
+		if at.IsZero() {
+			if now.IsZero() {
+				now = ls.now()
+			}
+			at = now
+		}
+		ls.seen(dg.IP, at)
+	}
+}
+
+// seen records that a datagram was received from ip at the time given.  Must be called with mu held.
+func (ls *LastSeen) seen(ip gostatsd.IP, at time.Time) {
+	if e, ok := ls.sources[ip]; ok {
+		src := e.Value.(*seenSource)
+		if at.After(src.lastSeen) {
+			src.lastSeen = at
+		}
+		src.datagrams++
+		src.silent = false
+		ls.order.MoveToFront(e)
+		return
+	}
+	if len(ls.sources) >= ls.maxSources {
+		oldest := ls.order.Back()
+		delete(ls.sources, oldest.Value.(*seenSource).ip)
+		ls.order.Remove(oldest)
+		atomic.AddUint64(&ls.evicted, 1)
+	}
+	ls.sources[ip] = ls.order.PushFront(&seenSource{ip: ip, lastSeen: at, datagrams: 1})
+}
+
+// expire forgets the sources silent for longer than the expiry, and returns the number of sources remaining, the
+// number of them silent for longer than the silent threshold, and those which became silent since the last call.
+func (ls *LastSeen) expire(now time.Time) (tracked, silent int, newlySilent []gostatsd.IP) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for e := ls.order.Back(); e != nil; {
+		src := e.Value.(*seenSource)
+		if now.Sub(src.lastSeen) <= ls.expiry {
+			break
+		}
+		prev := e.Prev()
+		delete(ls.sources, src.ip)
+		ls.order.Remove(e)
+		e = prev
+	}
+	if ls.silentThreshold > 0 {
+		for e := ls.order.Back(); e != nil; e = e.Prev() {
+			src := e.Value.(*seenSource)
+			if now.Sub(src.lastSeen) <= ls.silentThreshold {
+				break
+			}
+			silent++
+			if !src.silent {
+				src.silent = true
+				newlySilent = append(newlySilent, src.ip)
+			}
+		}
+	}
+	return len(ls.sources), silent, newlySilent
+}
+
+// emit expires sources, and emits the number of sources tracked and evicted.  If a silent threshold is set it also
+// emits the number of silent sources, and counts parser.source_silent tagged with each source which became silent.
+func (ls *LastSeen) emit(statser statser.Statser) {
+	if ls == nil {
+		return
+	}
+	tracked, silent, newlySilent := ls.expire(ls.now())
+	statser.Gauge("parser.sources_tracked", float64(tracked), nil)
+	if n := atomic.SwapUint64(&ls.evicted, 0); n > 0 {
+		statser.Count("parser.sources_evicted", float64(n), nil)
+	}
+	if ls.silentThreshold > 0 {
+		statser.Gauge("parser.sources_silent", float64(silent), nil)
+		for _, ip := range newlySilent {
+			statser.Count("parser.source_silent", 1, gostatsd.Tags{"source:" + string(ip)})
+		}
+	}
+}
+
+// SourcesCommand is the console command to list the sources which have been silent the longest, with how long they
+// have been silent for and how many datagrams they have sent.
+func (ls *LastSeen) SourcesCommand(ctx context.Context, args []string, w io.Writer) error {
+	n := sourcesDefaultN
+	switch len(args) {
+	case 0:
+	case 1:
+		var err error
+		n, err = strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid number %q, usage: sources [<n>]", args[0])
+		}
+	default:
+		return errors.New("usage: sources [<n>]")
+	}
+
+	now := ls.now()
+	ls.mu.Lock()
+	total := len(ls.sources)
+	if n > total {
+		n = total
+	}
+	sources := make([]seenSource, 0, n)
+	for e := ls.order.Back(); e != nil && len(sources) < n; e = e.Prev() {
+		sources = append(sources, *e.Value.(*seenSource))
+	}
+	ls.mu.Unlock()
+
+	if total == 0 {
+		_, err := fmt.Fprintln(w, "no sources")
+		return err
+	}
+	for _, src := range sources {
+		silence := now.Sub(src.lastSeen)
+		if silence < 0 {
+			silence = 0
+		}
+		marker := ""
+		if ls.silentThreshold > 0 && silence > ls.silentThreshold {
+			marker = " SILENT"
+		}
+		if _, err := fmt.Fprintf(w, "%s silent_for:%v datagrams:%d%s\n", src.ip, silence.Truncate(time.Second), src.datagrams, marker); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d of %d sources, silent the longest first\n", len(sources), total)
+	return err
+}
@@ -0,0 +1,101 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var seenStart = time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+
+func seenDatagrams(at time.Time, ips ...gostatsd.IP) []*Datagram {
+	dgs := make([]*Datagram, 0, len(ips))
+	for _, ip := range ips {
+		dgs = append(dgs, &Datagram{IP: ip, Received: at})
+	}
+	return dgs
+}
+
+func TestLastSeenTracking(t *testing.T) {
+	t.Parallel()
+	ls := NewLastSeen(10, time.Hour, 5*time.Minute)
+	ls.now = func() time.Time { return seenStart.Add(7 * time.Minute) }
+	ls.seenBatch(seenDatagrams(seenStart, "10.0.0.1", "10.0.0.2", "10.0.0.1"))
+	ls.seenBatch(seenDatagrams(seenStart.Add(3*time.Minute), "10.0.0.2"))
+	ls.seenBatch([]*Datagram{{IP: "10.0.0.3"}}) // A datagram without a receive time was received now
+
+	var buf bytes.Buffer
+	require.NoError(t, ls.SourcesCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "10.0.0.1 silent_for:7m0s datagrams:2 SILENT\n"+
+		"10.0.0.2 silent_for:4m0s datagrams:2\n"+
+		"10.0.0.3 silent_for:0s datagrams:1\n"+
+		"3 of 3 sources, silent the longest first\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, ls.SourcesCommand(context.Background(), []string{"1"}, &buf))
+	assert.Equal(t, "10.0.0.1 silent_for:7m0s datagrams:2 SILENT\n1 of 3 sources, silent the longest first\n", buf.String())
+	assert.Error(t, ls.SourcesCommand(context.Background(), []string{"0"}, &buf))
+	assert.Error(t, ls.SourcesCommand(context.Background(), []string{"1", "2"}, &buf))
+}
+
+func TestLastSeenSilent(t *testing.T) {
+	t.Parallel()
+	ls := NewLastSeen(10, time.Hour, 5*time.Minute)
+	ls.seenBatch(seenDatagrams(seenStart, "10.0.0.1", "10.0.0.2"))
+
+	tracked, silent, newlySilent := ls.expire(seenStart.Add(4 * time.Minute))
+	assert.Equal(t, 2, tracked)
+	assert.Zero(t, silent)
+	assert.Empty(t, newlySilent)
+
+	ls.seenBatch(seenDatagrams(seenStart.Add(4*time.Minute), "10.0.0.2"))
+	tracked, silent, newlySilent = ls.expire(seenStart.Add(6 * time.Minute))
+	assert.Equal(t, 2, tracked)
+	assert.Equal(t, 1, silent)
+	assert.Equal(t, []gostatsd.IP{"10.0.0.1"}, newlySilent)
+
+	// A silent source is only reported once, until it sends again.
+	_, silent, newlySilent = ls.expire(seenStart.Add(7 * time.Minute))
+	assert.Equal(t, 1, silent)
+	assert.Empty(t, newlySilent)
+	ls.seenBatch(seenDatagrams(seenStart.Add(7*time.Minute), "10.0.0.1"))
+	_, _, newlySilent = ls.expire(seenStart.Add(13 * time.Minute))
+	assert.Equal(t, []gostatsd.IP{"10.0.0.2", "10.0.0.1"}, newlySilent)
+}
+
+func TestLastSeenEviction(t *testing.T) {
+	t.Parallel()
+	ls := NewLastSeen(2, time.Hour, 0)
+	ls.seenBatch(seenDatagrams(seenStart, "10.0.0.1"))
+	ls.seenBatch(seenDatagrams(seenStart.Add(time.Minute), "10.0.0.2"))
+	ls.seenBatch(seenDatagrams(seenStart.Add(2*time.Minute), "10.0.0.1"))
+
+	// The least recently seen source is evicted for a new one.
+	ls.seenBatch(seenDatagrams(seenStart.Add(3*time.Minute), "10.0.0.3"))
+	assert.Len(t, ls.sources, 2)
+	assert.Contains(t, ls.sources, gostatsd.IP("10.0.0.1"))
+	assert.Contains(t, ls.sources, gostatsd.IP("10.0.0.3"))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&ls.evicted))
+
+	// Sources silent for longer than the expiry are forgotten, and silent sources aren't reported without a threshold.
+	tracked, silent, newlySilent := ls.expire(seenStart.Add(time.Hour + 150*time.Second))
+	assert.Equal(t, 1, tracked)
+	assert.Zero(t, silent)
+	assert.Empty(t, newlySilent)
+	assert.Contains(t, ls.sources, gostatsd.IP("10.0.0.3"))
+	assert.Equal(t, 1, ls.order.Len())
+
+	tracked, _, _ = ls.expire(seenStart.Add(2 * time.Hour))
+	assert.Zero(t, tracked)
+
+	var buf bytes.Buffer
+	require.NoError(t, ls.SourcesCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "no sources\n", buf.String())
+}
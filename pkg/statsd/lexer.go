@@ -5,6 +5,7 @@ import (
 	"errors"
 	"math"
 	"strconv"
+	"time"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/pool"
@@ -23,6 +24,21 @@ type lexer struct {
 	namespace     string
 	err           error
 	sampling      float64
+	maxTTL        time.Duration // Maximum TTL of a metric, 0 if the TTL extension is disabled
+
+	stripContainerID bool // Discard the container ID field of dogstatsd rather than setting it on the metric
+
+	nameWhitespace string // Handling of whitespace in the name, one of the NameWhitespace* values, empty for underscore
+	nameHasSpace   bool   // Set if whitespace was left in the name for lexKey to handle
+
+	clientTimestamps bool // Accept the timestamp field of dogstatsd, such as T1656581400
+
+	listenerType gostatsd.MetricType // Type of metric expected by the listener, 0 for any type
+	typePolicy   string              // What to do with a metric not of listenerType, one of the TypedPort* values
+	typeMismatch bool                // Set if the metric was not of listenerType
+
+	unknownTypePolicy string // What to do with a metric of an unknown type, one of the UnknownType* values
+	unknownType       bool   // Set if the metric was of an unknown type
 
 	metricPool *pool.MetricPool
 }
@@ -34,15 +50,32 @@ var (
 	errMissingKeySep         = errors.New("missing key separator")
 	errEmptyKey              = errors.New("key zero len")
 	errMissingValueSep       = errors.New("missing value separator")
+	errMissingType           = errors.New("missing type")
 	errInvalidType           = errors.New("invalid type")
+	errUnknownType           = errors.New("unknown type")
+	errInvalidValue          = errors.New("invalid value")
+	errInvalidSampleRate     = errors.New("invalid sample rate")
+	errInvalidTags           = errors.New("invalid tags")
+	errInvalidTTL            = errors.New("invalid ttl")
+	errInvalidContainerID    = errors.New("invalid container id")
+	errInvalidTimestamp      = errors.New("invalid timestamp")
+	errWrongType             = errors.New("wrong type for listener")
 	errInvalidFormat         = errors.New("invalid format")
 	errInvalidSamplingOrTags = errors.New("invalid sampling or tags")
 	errInvalidAttributes     = errors.New("invalid event attributes")
 	errOverflow              = errors.New("overflow")
 	errNotEnoughData         = errors.New("not enough data")
+	errEmptyLine             = errors.New("empty line")
 	errNaN                   = errors.New("invalid value NaN")
 )
 
+var ttlPrefix = []byte("tl:")
+
+var containerIDPrefix = []byte("c:")
+
+// maxClientTimestamp is the latest client timestamp in seconds which can be held as a gostatsd.Nanotime.
+const maxClientTimestamp = math.MaxInt64 / uint64(time.Second)
+
 var escapedNewline = []byte("\\n")
 var newline = []byte("\n")
 
@@ -76,16 +109,30 @@ func (l *lexer) run(input []byte, namespace string) (*gostatsd.Metric, *gostatsd
 		return nil, nil, l.err
 	}
 	if l.m != nil {
+		if l.listenerType != 0 && l.m.Type != l.listenerType {
+			l.typeMismatch = true
+			switch l.typePolicy {
+			case TypedPortDrop:
+				return nil, nil, errWrongType
+			case TypedPortAccept:
+			default:
+				l.m.Type = l.listenerType
+			}
+		}
 		l.m.Rate = l.sampling
 		if l.m.Type != gostatsd.SET {
 			v, err := strconv.ParseFloat(l.m.StringValue, 64)
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, errInvalidValue
 			}
 			if math.IsNaN(v) {
 				return nil, nil, errNaN
 			}
 			l.m.Value = v
+			if l.m.Type == gostatsd.GAUGE {
+				// As in statsd, a signed gauge value is a change to the gauge.
+				l.m.GaugeDelta = l.m.StringValue[0] == '+' || l.m.StringValue[0] == '-'
+			}
 			l.m.StringValue = ""
 		}
 		l.m.Tags = l.tags
@@ -103,7 +150,7 @@ func lexSpecial(l *lexer) stateFn {
 	case '_':
 		return lexDatadogSpecial
 	case eof:
-		l.err = errInvalidType
+		l.err = errEmptyLine
 		return nil
 	default:
 		l.pos--
@@ -121,7 +168,12 @@ func lexKeySep(l *lexer) stateFn {
 		case '/':
 			l.input[l.pos-1] = '-'
 		case ' ', '\t':
-			l.input[l.pos-1] = '_'
+			if l.nameWhitespace == "" || l.nameWhitespace == NameWhitespaceUnderscore {
+				l.input[l.pos-1] = '_'
+			} else {
+				l.input[l.pos-1] = ' '
+				l.nameHasSpace = true
+			}
 		case ':':
 			return lexKey
 		case eof:
@@ -159,7 +211,8 @@ func lexDatadogSpecial(l *lexer) stateFn {
 }
 
 func lexEventBody(l *lexer) stateFn {
-	if l.len-l.pos < l.eventTitleLen+1+l.eventTextLen {
+	// Summed as 64 bits, as lengths near the maximum would wrap around as 32 bits and pass the check.
+	if uint64(l.len-l.pos) < uint64(l.eventTitleLen)+1+uint64(l.eventTextLen) {
 		l.err = errNotEnoughData
 		return nil
 	}
@@ -320,11 +373,15 @@ func lexUntil(stop byte, handler func(*lexer, []byte) stateFn) stateFn {
 
 // lex the key.
 func lexKey(l *lexer) stateFn {
-	if l.start == l.pos-1 {
+	name := l.input[l.start : l.pos-1]
+	if l.nameHasSpace {
+		name = normalizeNameWhitespace(name, l.nameWhitespace)
+	}
+	if len(name) == 0 {
 		l.err = errEmptyKey
 		return nil
 	}
-	l.m.Name = string(l.input[l.start : l.pos-1])
+	l.m.Name = string(name)
 	if l.namespace != "" {
 		l.m.Name = l.namespace + "." + l.m.Name
 	}
@@ -332,6 +389,31 @@ func lexKey(l *lexer) stateFn {
 	return lexValueSep
 }
 
+// normalizeNameWhitespace trims the spaces of name according to policy, one of the NameWhitespace* values other than
+// NameWhitespaceUnderscore, and replaces the remaining spaces with underscores.  name is modified in place.
+func normalizeNameWhitespace(name []byte, policy string) []byte {
+	if policy == NameWhitespaceTrimTrailing {
+		name = bytes.TrimRight(name, " ")
+	} else {
+		name = bytes.Trim(name, " ")
+	}
+	out := name[:0]
+	space := false
+	for _, b := range name {
+		if b == ' ' {
+			if space && policy == NameWhitespaceCollapse {
+				continue
+			}
+			space = true
+			b = '_'
+		} else {
+			space = false
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
 // lex until we find the pipe separator between value and modifier.
 func lexValueSep(l *lexer) stateFn {
 	for {
@@ -357,6 +439,9 @@ func lexValue(l *lexer) stateFn {
 func lexType(l *lexer) stateFn {
 	b := l.next()
 	switch b {
+	case eof:
+		l.err = errMissingType
+		return nil
 	case 'c':
 		l.m.Type = gostatsd.COUNTER
 		l.start = l.pos
@@ -367,8 +452,7 @@ func lexType(l *lexer) stateFn {
 		return lexTypeSep
 	case 'm':
 		if b := l.next(); b != 's' {
-			l.err = errInvalidType
-			return nil
+			return lexUnknownType
 		}
 		l.start = l.pos
 		l.m.Type = gostatsd.TIMER
@@ -382,9 +466,26 @@ func lexType(l *lexer) stateFn {
 		l.start = l.pos
 		return lexTypeSep
 	default:
-		l.err = errInvalidType
-		return nil
+		return lexUnknownType
+	}
+}
 
+// lex an unknown type, which is an error unless the unknown type policy treats it as a counter.
+func lexUnknownType(l *lexer) stateFn {
+	l.unknownType = true
+	if l.unknownTypePolicy != UnknownTypeCounter {
+		l.err = errUnknownType
+		return nil
+	}
+	l.m.Type = gostatsd.COUNTER
+	for {
+		switch l.next() {
+		case eof:
+			return nil
+		case '|':
+			l.start = l.pos
+			return lexSampleRateOrTags
+		}
 	}
 }
 
@@ -398,8 +499,7 @@ func lexTypeSep(l *lexer) stateFn {
 		l.start = l.pos
 		return lexSampleRateOrTags
 	}
-	l.err = errInvalidType
-	return nil
+	return lexUnknownType
 }
 
 // lex the sample rate or the tags.
@@ -419,6 +519,19 @@ func lexSampleRateOrTags(l *lexer) stateFn {
 		}
 	case '#':
 		return lexTags
+	case 'c':
+		return lexContainerID
+	case 'T':
+		if l.clientTimestamps {
+			return lexClientTimestamp
+		}
+		l.err = errInvalidSamplingOrTags
+		return nil
+	case 't':
+		if l.maxTTL != 0 {
+			return lexTTL
+		}
+		fallthrough
 	default:
 		l.err = errInvalidSamplingOrTags
 		return nil
@@ -428,20 +541,126 @@ func lexSampleRateOrTags(l *lexer) stateFn {
 // lex the sample rate.
 func lexSampleRate(l *lexer) stateFn {
 	v, err := strconv.ParseFloat(string(l.input[l.start:l.pos-1]), 64)
-	if err != nil {
-		l.err = err
+	// A rate of 0 or less would scale sampled values to infinity.
+	if err != nil || !(v > 0) {
+		l.err = errInvalidSampleRate
 		return nil
 	}
 	l.sampling = v
 	if l.pos >= l.len {
 		return nil
 	}
-	return lexAssert('#', lexTags)
+	switch l.next() {
+	case '#':
+		return lexTags
+	case 'c':
+		return lexContainerID
+	case 'T':
+		if l.clientTimestamps {
+			return lexClientTimestamp
+		}
+	case 't':
+		if l.maxTTL != 0 {
+			return lexTTL
+		}
+	}
+	l.err = errInvalidTags
+	return nil
+}
+
+// lex the container ID of dogstatsd, such as c:<id>, used for origin detection.
+func lexContainerID(l *lexer) stateFn {
+	return lexAssert(':', lexUntil('|', func(l *lexer, data []byte) stateFn {
+		if len(data) == 0 {
+			l.err = errInvalidContainerID
+			return nil
+		}
+		if !l.stripContainerID {
+			l.m.ContainerID = string(data)
+		}
+		switch l.next() {
+		case eof:
+			return nil
+		case '|':
+			return lexSampleRateOrTags
+		}
+		l.err = errInvalidContainerID
+		return nil
+	}))
+}
+
+// lex the TTL in seconds, such as ttl:30.  It is capped at maxTTL.
+func lexTTL(l *lexer) stateFn {
+	if !bytes.HasPrefix(l.input[l.pos:], ttlPrefix) {
+		l.err = errInvalidTTL
+		return nil
+	}
+	l.pos += uint32(len(ttlPrefix))
+	return lexUint(func(l *lexer, value uint64) stateFn {
+		if value == 0 {
+			l.err = errInvalidTTL
+			return nil
+		}
+		if value > uint64(l.maxTTL/time.Second) {
+			l.m.TTL = l.maxTTL
+		} else {
+			l.m.TTL = time.Duration(value) * time.Second
+		}
+		switch l.next() {
+		case eof:
+			return nil
+		case '|':
+			return lexSampleRateOrTags
+		}
+		l.err = errInvalidTTL
+		return nil
+	})
+}
+
+// lex the client timestamp in seconds since the epoch, such as T1656581400, which dogstatsd clients send for metrics
+// they did not measure just now.
+func lexClientTimestamp(l *lexer) stateFn {
+	if l.pos >= l.len || l.input[l.pos] < '0' || l.input[l.pos] > '9' {
+		l.err = errInvalidTimestamp
+		return nil
+	}
+	return lexUint(func(l *lexer, value uint64) stateFn {
+		if value == 0 || value > maxClientTimestamp {
+			l.err = errInvalidTimestamp
+			return nil
+		}
+		l.m.ClientTimestamp = gostatsd.Nanotime(value * uint64(time.Second))
+		switch l.next() {
+		case eof:
+			return nil
+		case '|':
+			return lexSampleRateOrTags
+		}
+		l.err = errInvalidTimestamp
+		return nil
+	})
+}
+
+// isClientTimestampField returns true if data starts with a client timestamp field, such as T1656581400.
+func isClientTimestampField(data []byte) bool {
+	return len(data) > 1 && data[0] == 'T' && '0' <= data[1] && data[1] <= '9'
 }
 
 // lex the tags.
 func lexTags(l *lexer) stateFn {
 	return lexUntil(',', func(l *lexer, data []byte) stateFn {
+		if l.m != nil {
+			// With the TTL extension enabled a pipe ends the tags of a metric, so a TTL may follow them.  A pipe
+			// followed by a container ID always does, as does one followed by a client timestamp if they are accepted.
+			if p := bytes.IndexByte(data, '|'); p != -1 && (l.maxTTL != 0 || bytes.HasPrefix(data[p+1:], containerIDPrefix) ||
+				(l.clientTimestamps && isClientTimestampField(data[p+1:]))) {
+				if p > 0 {
+					l.tags = append(l.tags, string(data[:p]))
+				}
+				l.pos -= uint32(len(data) - p - 1) // consume pipe
+				return lexSampleRateOrTags
+			}
+		}
 		if len(data) > 0 {
 			l.tags = append(l.tags, string(data))
 		}
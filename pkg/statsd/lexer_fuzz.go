@@ -4,17 +4,32 @@ package statsd
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/atlassian/gostatsd/pkg/pool"
 )
 
+var fuzzMetricPool = pool.NewMetricPool(0)
+
+// Fuzz lexes data as a line with the default settings, and again with the TTL extension enabled and lines of unknown
+// types counted, which reach more of the lexer.
 func Fuzz(data []byte) int {
-	l := lexer{}
-	metric, event, err := l.run(data, "")
-	if err != nil {
-		return 0
-	}
-	if (metric != nil && event == nil) || (metric == nil && event != nil) {
-		return 1
+	result := 0
+	for _, l := range []lexer{
+		{metricPool: fuzzMetricPool},
+		{metricPool: fuzzMetricPool, maxTTL: time.Minute, unknownTypePolicy: UnknownTypeCounter},
+	} {
+		// The lexer modifies the line in place.
+		metric, event, err := l.run(append([]byte(nil), data...), "")
+		if err != nil {
+			continue
+		}
+		if (metric != nil && event == nil) || (metric == nil && event != nil) {
+			result = 1
+			continue
+		}
+		// Either both are nil or both are not nil
+		panic(fmt.Errorf("metric: %+v\nevent: %+v", metric, event))
 	}
-	// Either both are nil or both are not nil
-	panic(fmt.Errorf("metric: %+v\nevent: %+v", metric, event))
+	return result
 }
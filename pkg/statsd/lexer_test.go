@@ -1,7 +1,10 @@
 package statsd
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/pool"
@@ -22,6 +25,8 @@ func TestMetricsLexer(t *testing.T) {
 		"smp.rte:5|c|@0.1|#foo:bar,baz": {Name: "smp.rte", Value: 5, Type: gostatsd.COUNTER, Rate: 0.1, Tags: gostatsd.Tags{"foo:bar", "baz"}},
 		"smp.rte:5|c|#foo:bar,baz":      {Name: "smp.rte", Value: 5, Type: gostatsd.COUNTER, Rate: 1.0, Tags: gostatsd.Tags{"foo:bar", "baz"}},
 		"uniq.usr:joe|s":                {Name: "uniq.usr", StringValue: "joe", Type: gostatsd.SET, Rate: 1.0},
+		"name:5|g|@0.5":                 {Name: "name", Value: 5, Type: gostatsd.GAUGE, Rate: 0.5},
+		"name:user1|s|@0.5":             {Name: "name", StringValue: "user1", Type: gostatsd.SET, Rate: 0.5},
 		"fooBarBaz:2|c":                 {Name: "fooBarBaz", Value: 2, Type: gostatsd.COUNTER, Rate: 1.0},
 		"smp.rte:5|c|#Foo:Bar,baz":      {Name: "smp.rte", Value: 5, Type: gostatsd.COUNTER, Rate: 1.0, Tags: gostatsd.Tags{"Foo:Bar", "baz"}},
 		"smp.gge:1|g|#Foo:Bar":          {Name: "smp.gge", Value: 1, Type: gostatsd.GAUGE, Rate: 1.0, Tags: gostatsd.Tags{"Foo:Bar"}},
@@ -111,22 +116,24 @@ func TestEventsLexer(t *testing.T) {
 func TestInvalidEventsLexer(t *testing.T) {
 	t.Parallel()
 	failing := map[string]error{
-		"_x{1,1}:a|b": errInvalidType,
-		"_e{2,1}:a|b": errNotEnoughData,
-		"_e{1,2}:a|b": errNotEnoughData,
-		"_e{2,2}:a|b": errNotEnoughData,
-		"_e{1,1}:ab":  errNotEnoughData,
-		"_e{1,1}ab":   errInvalidFormat,
-		"_e{1,1}a:b":  errInvalidFormat,
-		"_e{1,1}:a:b": errInvalidFormat,
-		"_e{,1}:a|b":  errInvalidFormat,
-		"_e{1,}:a|b":  errInvalidFormat,
-		"_e{1}:a|b":   errInvalidFormat,
-		"_e{}:a|b":    errInvalidFormat,
-		"_e1,2}:a|b":  errInvalidFormat,
-		"_e:a|b":      errInvalidFormat,
+		"_x{1,1}:a|b":                        errInvalidType,
+		"_e{2,1}:a|b":                        errNotEnoughData,
+		"_e{1,2}:a|b":                        errNotEnoughData,
+		"_e{2,2}:a|b":                        errNotEnoughData,
+		"_e{1,1}:ab":                         errNotEnoughData,
+		"_e{1,1}ab":                          errInvalidFormat,
+		"_e{1,1}a:b":                         errInvalidFormat,
+		"_e{1,1}:a:b":                        errInvalidFormat,
+		"_e{,1}:a|b":                         errInvalidFormat,
+		"_e{1,}:a|b":                         errInvalidFormat,
+		"_e{1}:a|b":                          errInvalidFormat,
+		"_e{}:a|b":                           errInvalidFormat,
+		"_e1,2}:a|b":                         errInvalidFormat,
+		"_e:a|b":                             errInvalidFormat,
 		"_e{999999999999999999999999,1}:a|b": errOverflow,
 		"_e{1,999999999999999999999999}:a|b": errOverflow,
+		"_e{1,4294967294}:a|":                errNotEnoughData,
+		"_e{2,4294967295}:ab|x":              errNotEnoughData,
 	}
 	for input, expectedErr := range failing {
 		input := input
@@ -171,7 +178,7 @@ func benchmarkLexer(dp *DatagramParser, input string, b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		r, _, _ = dp.parseLine(slice)
+		r, _, _ = dp.parseLine(slice, 0)
 		r.Done()
 	}
 	parselineBlackhole = r
@@ -207,3 +214,291 @@ func BenchmarkParseCounterWithDefaultTagsAndTags(b *testing.B) {
 func BenchmarkParseCounterWithDefaultTagsAndTagsAndNameSpace(b *testing.B) {
 	benchmarkLexer(&DatagramParser{namespace: "stats"}, "foo.bar.baz:2|c|#foo:bar,baz", b)
 }
+
+func TestMetricsLexerTTL(t *testing.T) {
+	t.Parallel()
+	tests := map[string]gostatsd.Metric{
+		"a:1|c|ttl:30":                {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, TTL: 30 * time.Second},
+		"a:1|g|@0.5|ttl:30":           {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 0.5, TTL: 30 * time.Second},
+		"a:1|ms|ttl:30|@0.5|#foo,bar": {Name: "a", Value: 1, Type: gostatsd.TIMER, Rate: 0.5, TTL: 30 * time.Second, Tags: gostatsd.Tags{"foo", "bar"}},
+		"a:1|c|#foo,bar|ttl:30":       {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, TTL: 30 * time.Second, Tags: gostatsd.Tags{"foo", "bar"}},
+		"a:1|c|#foo|ttl:30|@0.5":      {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 0.5, TTL: 30 * time.Second, Tags: gostatsd.Tags{"foo"}},
+		"a:joe|s|#|ttl:30":            {Name: "a", StringValue: "joe", Type: gostatsd.SET, Rate: 1.0, TTL: 30 * time.Second},
+		// Capped at the maximum
+		"a:1|c|ttl:7200":        {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, TTL: time.Hour},
+		"a:1|c|ttl:99999999999": {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, TTL: time.Hour},
+	}
+	for input, expected := range tests {
+		input := input
+		expected := expected
+		t.Run(input, func(t *testing.T) {
+			t.Parallel()
+			l := lexer{
+				metricPool: pool.NewMetricPool(0),
+				maxTTL:     time.Hour,
+			}
+			result, _, err := l.run([]byte(input), "")
+			require.NoError(t, err)
+			result.DoneFunc = nil
+			assert.Equal(t, &expected, result)
+		})
+	}
+}
+
+func TestInvalidMetricsLexerTTL(t *testing.T) {
+	t.Parallel()
+	failing := map[string]error{
+		"a:1|c|ttl:0":                    errInvalidTTL,
+		"a:1|c|ttl:30s":                  errInvalidTTL,
+		"a:1|c|tl:30":                    errInvalidTTL,
+		"a:1|c|ttl:":                     errInvalidFormat,
+		"a:1|c|@0.5|ttl:-1":              errInvalidFormat,
+		"a:1|c|ttl:99999999999999999999": errOverflow,
+	}
+	for input, expectedErr := range failing {
+		input := input
+		expectedErr := expectedErr
+		t.Run(input, func(t *testing.T) {
+			t.Parallel()
+			l := lexer{
+				metricPool: pool.NewMetricPool(0),
+				maxTTL:     time.Hour,
+			}
+			_, _, err := l.run([]byte(input), "")
+			assert.Equal(t, expectedErr, err)
+		})
+	}
+
+	// The extension is disabled by default.
+	for _, input := range []string{"a:1|c|ttl:30", "a:1|c|@0.5|ttl:30"} {
+		_, _, err := parseLine([]byte(input), "")
+		assert.Error(t, err, input)
+	}
+	m, _, err := parseLine([]byte("a:1|c|#foo|ttl:30"), "")
+	require.NoError(t, err)
+	assert.Equal(t, gostatsd.Tags{"foo|ttl:30"}, m.Tags)
+	assert.Zero(t, m.TTL)
+}
+
+func TestMetricsLexerTypedListener(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		policy       string
+		input        string
+		expectedType gostatsd.MetricType
+		expectedErr  error
+		mismatch     bool
+	}{
+		"coerce":     {policy: TypedPortCoerce, input: "a:1|c", expectedType: gostatsd.GAUGE, mismatch: true},
+		"default":    {input: "a:1|ms", expectedType: gostatsd.GAUGE, mismatch: true},
+		"drop":       {policy: TypedPortDrop, input: "a:1|c", expectedErr: errWrongType, mismatch: true},
+		"accept":     {policy: TypedPortAccept, input: "a:1|c", expectedType: gostatsd.COUNTER, mismatch: true},
+		"matching":   {policy: TypedPortDrop, input: "a:1|g", expectedType: gostatsd.GAUGE},
+		"coerce set": {policy: TypedPortCoerce, input: "a:joe|s", expectedErr: errInvalidValue, mismatch: true},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			l := lexer{
+				metricPool:   pool.NewMetricPool(0),
+				listenerType: gostatsd.GAUGE,
+				typePolicy:   test.policy,
+			}
+			m, _, err := l.run([]byte(test.input), "")
+			assert.Equal(t, test.mismatch, l.typeMismatch)
+			if test.expectedErr != nil {
+				assert.Equal(t, test.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedType, m.Type)
+			assert.EqualValues(t, 1, m.Value)
+		})
+	}
+}
+
+func TestMetricsLexerUnknownType(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		policy       string
+		input        string
+		expectedErr  error
+		expectedTags gostatsd.Tags
+		expectedRate float64
+	}{
+		"drop":             {policy: UnknownTypeDrop, input: "a:1|x", expectedErr: errUnknownType},
+		"log":              {policy: UnknownTypeLog, input: "a:1|x", expectedErr: errUnknownType},
+		"counter":          {policy: UnknownTypeCounter, input: "a:1|x", expectedRate: 1},
+		"counter typo":     {policy: UnknownTypeCounter, input: "a:1|cc|@0.5", expectedRate: 0.5},
+		"counter ms typo":  {policy: UnknownTypeCounter, input: "a:1|mx|#foo", expectedRate: 1, expectedTags: gostatsd.Tags{"foo"}},
+		"counter new type": {policy: UnknownTypeCounter, input: "a:1|dist|@0.1|#foo", expectedRate: 0.1, expectedTags: gostatsd.Tags{"foo"}},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			l := lexer{
+				metricPool:        pool.NewMetricPool(0),
+				unknownTypePolicy: test.policy,
+			}
+			m, _, err := l.run([]byte(test.input), "")
+			assert.True(t, l.unknownType)
+			if test.expectedErr != nil {
+				assert.Equal(t, test.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, gostatsd.COUNTER, m.Type)
+			assert.EqualValues(t, 1, m.Value)
+			assert.Equal(t, test.expectedRate, m.Rate)
+			assert.Equal(t, test.expectedTags, m.Tags)
+		})
+	}
+}
+
+func TestMetricsLexerContainerID(t *testing.T) {
+	t.Parallel()
+	tests := map[string]gostatsd.Metric{
+		"a:1|c|c:abc123":              {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, ContainerID: "abc123"},
+		"a:1|g|@0.5|c:abc123":         {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 0.5, ContainerID: "abc123"},
+		"a:1|c|#foo:bar,baz|c:abc123": {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, Tags: gostatsd.Tags{"foo:bar", "baz"}, ContainerID: "abc123"},
+		"a:1|ms|c:abc123|@0.1|#foo":   {Name: "a", Value: 1, Type: gostatsd.TIMER, Rate: 0.1, Tags: gostatsd.Tags{"foo"}, ContainerID: "abc123"},
+		"a:joe|s|@0.5|#foo|c:abc123":  {Name: "a", StringValue: "joe", Type: gostatsd.SET, Rate: 0.5, Tags: gostatsd.Tags{"foo"}, ContainerID: "abc123"},
+		"a:1|c|#foo|bar,baz":          {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, Tags: gostatsd.Tags{"foo|bar", "baz"}},
+	}
+	compareMetric(t, tests, "")
+
+	for _, input := range []string{"a:1|c|c:", "a:1|c|c:abc|", "a:1|c|cabc"} {
+		_, _, err := parseLine([]byte(input), "")
+		assert.Error(t, err, input)
+	}
+
+	// The field is still parsed when it is stripped, but not kept.
+	l := lexer{
+		metricPool:       pool.NewMetricPool(0),
+		stripContainerID: true,
+	}
+	m, _, err := l.run([]byte("a:1|c|#foo|c:abc123"), "")
+	require.NoError(t, err)
+	assert.Empty(t, m.ContainerID)
+	assert.Equal(t, gostatsd.Tags{"foo"}, m.Tags)
+}
+
+func TestMetricsLexerGaugeDelta(t *testing.T) {
+	t.Parallel()
+	tests := map[string]gostatsd.Metric{
+		"a:+5|g":  {Name: "a", Value: 5, Type: gostatsd.GAUGE, Rate: 1.0, GaugeDelta: true},
+		"a:-5|g":  {Name: "a", Value: -5, Type: gostatsd.GAUGE, Rate: 1.0, GaugeDelta: true},
+		"a:5|g":   {Name: "a", Value: 5, Type: gostatsd.GAUGE, Rate: 1.0},
+		"a:-0|g":  {Name: "a", Value: 0, Type: gostatsd.GAUGE, Rate: 1.0, GaugeDelta: true},
+		"a:-5|c":  {Name: "a", Value: -5, Type: gostatsd.COUNTER, Rate: 1.0},
+		"a:-5|ms": {Name: "a", Value: -5, Type: gostatsd.TIMER, Rate: 1.0},
+	}
+	compareMetric(t, tests, "")
+}
+
+func TestLexerFuzzCorpus(t *testing.T) {
+	t.Parallel()
+	files, err := filepath.Glob("../../test_fixtures/lexer_fuzz/corpus/*")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	for _, file := range files {
+		file := file
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			t.Parallel()
+			data, err := ioutil.ReadFile(file)
+			require.NoError(t, err)
+			for _, l := range []lexer{
+				{metricPool: pool.NewMetricPool(0)},
+				{metricPool: pool.NewMetricPool(0), maxTTL: time.Minute, unknownTypePolicy: UnknownTypeCounter},
+			} {
+				l := l
+				var m *gostatsd.Metric
+				var e *gostatsd.Event
+				require.NotPanics(t, func() {
+					// The lexer modifies the line in place.
+					m, e, err = l.run(append([]byte(nil), data...), "")
+				})
+				if err == nil {
+					assert.True(t, (m == nil) != (e == nil), "metric: %+v, event: %+v", m, e)
+				} else {
+					assert.Nil(t, m)
+					assert.Nil(t, e)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsLexerClientTimestamp(t *testing.T) {
+	t.Parallel()
+	ts := gostatsd.Nanotime(1656581400 * time.Second)
+	tests := map[string]gostatsd.Metric{
+		"a:1|c|T1656581400":               {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, ClientTimestamp: ts},
+		"a:1|g|@0.5|T1656581400":          {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 0.5, ClientTimestamp: ts},
+		"a:1|c|#foo:bar,baz|T1656581400":  {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, Tags: gostatsd.Tags{"foo:bar", "baz"}, ClientTimestamp: ts},
+		"a:1|ms|T1656581400|@0.1|#foo":    {Name: "a", Value: 1, Type: gostatsd.TIMER, Rate: 0.1, Tags: gostatsd.Tags{"foo"}, ClientTimestamp: ts},
+		"a:1|c|#foo|T1656581400|c:abc123": {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, Tags: gostatsd.Tags{"foo"}, ContainerID: "abc123", ClientTimestamp: ts},
+		"a:1|c|#foo|Tbar":                 {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, Tags: gostatsd.Tags{"foo|Tbar"}},
+	}
+	for input, expected := range tests {
+		l := lexer{
+			metricPool:       pool.NewMetricPool(0),
+			clientTimestamps: true,
+		}
+		m, _, err := l.run([]byte(input), "")
+		require.NoError(t, err, input)
+		assert.Equal(t, expected.Name, m.Name, input)
+		assert.Equal(t, expected.Rate, m.Rate, input)
+		assert.Equal(t, expected.Tags, m.Tags, input)
+		assert.Equal(t, expected.ContainerID, m.ContainerID, input)
+		assert.Equal(t, expected.ClientTimestamp, m.ClientTimestamp, input)
+	}
+
+	for _, input := range []string{"a:1|c|T", "a:1|c|T0", "a:1|c|T12x", "a:1|c|T99999999999999"} {
+		l := lexer{
+			metricPool:       pool.NewMetricPool(0),
+			clientTimestamps: true,
+		}
+		_, _, err := l.run([]byte(input), "")
+		assert.Equal(t, errInvalidTimestamp, err, input)
+	}
+
+	// The field is not accepted unless client timestamps are.
+	_, _, err := parseLine([]byte("a:1|c|T1656581400"), "")
+	assert.Error(t, err)
+}
+
+func TestMetricsLexerNameWhitespace(t *testing.T) {
+	t.Parallel()
+	inputs := []string{"a.b :1|c", "a.b\t:1|c", " a.b:1|c", "\ta b  :1|c", "a \t b:1|c", " a  b\t c :1|c"}
+	tests := map[string][]string{
+		"":                         {"a.b_", "a.b_", "_a.b", "_a_b__", "a___b", "_a__b__c_"},
+		NameWhitespaceUnderscore:   {"a.b_", "a.b_", "_a.b", "_a_b__", "a___b", "_a__b__c_"},
+		NameWhitespaceTrimTrailing: {"a.b", "a.b", "_a.b", "_a_b", "a___b", "_a__b__c"},
+		NameWhitespaceTrim:         {"a.b", "a.b", "a.b", "a_b", "a___b", "a__b__c"},
+		NameWhitespaceCollapse:     {"a.b", "a.b", "a.b", "a_b", "a_b", "a_b_c"},
+	}
+	for policy, expected := range tests {
+		for i, input := range inputs {
+			l := lexer{
+				metricPool:     pool.NewMetricPool(0),
+				nameWhitespace: policy,
+			}
+			m, _, err := l.run([]byte(input), "ns")
+			require.NoError(t, err, "%s %q", policy, input)
+			assert.Equal(t, "ns."+expected[i], m.Name, "%s %q", policy, input)
+		}
+	}
+
+	// A name of only whitespace is empty once trimmed.
+	for _, policy := range []string{NameWhitespaceTrimTrailing, NameWhitespaceTrim, NameWhitespaceCollapse} {
+		l := lexer{
+			metricPool:     pool.NewMetricPool(0),
+			nameWhitespace: policy,
+		}
+		_, _, err := l.run([]byte(" \t:1|c"), "")
+		assert.Equal(t, errEmptyKey, err, policy)
+	}
+}
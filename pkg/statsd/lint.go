@@ -0,0 +1,205 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/console"
+	"github.com/atlassian/gostatsd/pkg/logging"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lintRuleSets are the naming rules which can be checked without configuring a backend which has them.
+var lintRuleSets = map[string]func(name string) error{
+	"prometheus": validatePrometheusName,
+}
+
+// validatePrometheusName returns an error if name is not a valid Prometheus metric name.
+func validatePrometheusName(name string) error {
+	if name == "" {
+		return errors.New("empty name")
+	}
+	for i, r := range name {
+		switch {
+		case r == '_' || r == ':' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return fmt.Errorf("invalid character %q at offset %d", r, i)
+		}
+	}
+	return nil
+}
+
+// lintTarget is a set of naming rules, from a backend or a rule set.
+type lintTarget struct {
+	name     string
+	validate func(name string) error
+}
+
+// lintViolation is a metric name which is invalid for a target.
+type lintViolation struct {
+	target string
+	name   string
+	err    error
+}
+
+func (v lintViolation) String() string {
+	return fmt.Sprintf("%s: %q: %v", v.target, v.name, v.err)
+}
+
+// NameLinter checks metric names against the naming rules of backends, without sending them anywhere.
+type NameLinter struct {
+	targets []lintTarget
+
+	mu       sync.Mutex
+	reported map[string]struct{} // Violations already logged, by target and name
+
+	logger log.FieldLogger
+}
+
+// NewNameLinter creates a NameLinter which checks names against the rules of each backend which has them, and each
+// of the named rule sets.
+func NewNameLinter(backends []gostatsd.Backend, ruleSets []string) (*NameLinter, error) {
+	nl := &NameLinter{
+		reported: map[string]struct{}{},
+		logger:   logging.Component("lint"),
+	}
+	for _, b := range backends {
+		if _, ok := b.(gostatsd.NameValidatingBackend); ok {
+			b := b
+			nl.targets = append(nl.targets, lintTarget{
+				name: b.Name(),
+				validate: func(name string) error {
+					return gostatsd.ValidateMetricName(b, name)
+				},
+			})
+		}
+	}
+	for _, ruleSet := range ruleSets {
+		validate, ok := lintRuleSets[ruleSet]
+		if !ok {
+			return nil, fmt.Errorf("unknown lint rules %q", ruleSet)
+		}
+		nl.targets = append(nl.targets, lintTarget{name: ruleSet, validate: validate})
+	}
+	return nl, nil
+}
+
+// lint returns the names which are invalid for each target, in the order of the targets and then of names.
+func (nl *NameLinter) lint(names []string) []lintViolation {
+	var violations []lintViolation
+	for _, t := range nl.targets {
+		for _, name := range names {
+			if err := t.validate(name); err != nil {
+				violations = append(violations, lintViolation{target: t.name, name: name, err: err})
+			}
+		}
+	}
+	return violations
+}
+
+// logViolations logs the names in m which are invalid for each target, once per target and name.
+func (nl *NameLinter) logViolations(m *gostatsd.MetricMap) {
+	names := map[string]struct{}{}
+	addMetricNames(names, m)
+	for _, v := range nl.lint(sortedNames(names)) {
+		key := v.target + "\x00" + v.name
+		nl.mu.Lock()
+		_, reported := nl.reported[key]
+		nl.reported[key] = struct{}{}
+		nl.mu.Unlock()
+		if !reported {
+			nl.logger.WithError(v.err).WithFields(log.Fields{
+				logging.FieldBucket: v.name,
+				"target":            v.target,
+			}).Warn("Metric name is invalid")
+		}
+	}
+}
+
+// LintCommand returns the console command which lists the names of metrics received this interval which are invalid
+// for a backend or rule set.
+func (nl *NameLinter) LintCommand(processer AggregateProcesser) console.Handler {
+	return func(ctx context.Context, args []string, w io.Writer) error {
+		if len(nl.targets) == 0 {
+			_, err := io.WriteString(w, "No naming rules to check, see --lint-rules\n")
+			return err
+		}
+
+		var mu sync.Mutex
+		names := map[string]struct{}{}
+		wait := processer.Process(ctx, func(aggrID int, aggr Aggregator) {
+			aggr.Process(func(m *gostatsd.MetricMap) {
+				mu.Lock()
+				addMetricNames(names, m)
+				mu.Unlock()
+			})
+		})
+		wait()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		violations := nl.lint(sortedNames(names))
+		if len(violations) == 0 {
+			_, err := fmt.Fprintf(w, "No invalid names in %d metrics\n", len(names))
+			return err
+		}
+		for _, v := range violations {
+			if _, err := fmt.Fprintln(w, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addMetricNames adds the name of each metric in m to names.
+func addMetricNames(names map[string]struct{}, m *gostatsd.MetricMap) {
+	for name := range m.Counters {
+		names[name] = struct{}{}
+	}
+	for name := range m.Timers {
+		names[name] = struct{}{}
+	}
+	for name := range m.Gauges {
+		names[name] = struct{}{}
+	}
+	for name := range m.Sets {
+		names[name] = struct{}{}
+	}
+}
+
+func sortedNames(names map[string]struct{}) []string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// lintBackend is used in place of the configured backends in lint mode.  It logs the names of metrics which are
+// invalid for a backend, and sends nothing.
+type lintBackend struct {
+	linter *NameLinter
+}
+
+func (lb *lintBackend) Name() string {
+	return "lint"
+}
+
+func (lb *lintBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	lb.linter.logViolations(m)
+	cb(nil)
+}
+
+func (lb *lintBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
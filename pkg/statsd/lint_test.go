@@ -0,0 +1,119 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dotsBackend is a gostatsd.NameValidatingBackend which only allows letters and dots in names.
+type dotsBackend struct{}
+
+func (db *dotsBackend) Name() string {
+	return "dots"
+}
+
+func (db *dotsBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	cb(nil)
+}
+
+func (db *dotsBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func (db *dotsBackend) ValidateMetricName(name string) error {
+	if strings.Trim(name, "abcdefghijklmnopqrstuvwxyz.") != "" {
+		return errors.New("not letters and dots")
+	}
+	return nil
+}
+
+func TestValidatePrometheusName(t *testing.T) {
+	t.Parallel()
+	for _, name := range []string{"a", "http_requests_total", "job:requests:rate5m", "_x", "A1"} {
+		assert.NoError(t, validatePrometheusName(name), name)
+	}
+	for _, name := range []string{"", "api.requests", "1xx", "a-b", "a b", "café"} {
+		assert.Error(t, validatePrometheusName(name), name)
+	}
+	assert.EqualError(t, validatePrometheusName("api.requests"), `invalid character '.' at offset 3`)
+}
+
+func TestNewNameLinter(t *testing.T) {
+	t.Parallel()
+	nl, err := NewNameLinter([]gostatsd.Backend{&timerBackend{}, &dotsBackend{}}, []string{"prometheus"})
+	require.NoError(t, err)
+	require.Len(t, nl.targets, 2)
+	assert.Equal(t, "dots", nl.targets[0].name)
+	assert.Equal(t, "prometheus", nl.targets[1].name)
+
+	_, err = NewNameLinter(nil, []string{"carbon"})
+	assert.Error(t, err)
+}
+
+func TestLintCommand(t *testing.T) {
+	t.Parallel()
+	agg := newFakeAggregator()
+	now := time.Now()
+	agg.Receive(&gostatsd.Metric{Name: "api.requests", Value: 1, Type: gostatsd.COUNTER, Rate: 1}, now)
+	agg.Receive(&gostatsd.Metric{Name: "queue_depth", Value: 1, Type: gostatsd.GAUGE, Rate: 1}, now)
+	agg.Receive(&gostatsd.Metric{Name: "latency ms", Value: 1, Type: gostatsd.TIMER, Rate: 1}, now)
+
+	nl, err := NewNameLinter([]gostatsd.Backend{&dotsBackend{}}, []string{"prometheus"})
+	require.NoError(t, err)
+	var out bytes.Buffer
+	require.NoError(t, nl.LintCommand(&singleAggregator{agg: agg})(context.Background(), nil, &out))
+	assert.Equal(t, `dots: "latency ms": not letters and dots
+dots: "queue_depth": not letters and dots
+prometheus: "api.requests": invalid character '.' at offset 3
+prometheus: "latency ms": invalid character ' ' at offset 7
+`, out.String())
+
+	nl, err = NewNameLinter(nil, nil)
+	require.NoError(t, err)
+	out.Reset()
+	require.NoError(t, nl.LintCommand(&singleAggregator{agg: agg})(context.Background(), nil, &out))
+	assert.Equal(t, "No naming rules to check, see --lint-rules\n", out.String())
+}
+
+func TestLintBackend(t *testing.T) {
+	t.Parallel()
+	hook := test.NewGlobal()
+	nl, err := NewNameLinter(nil, []string{"prometheus"})
+	require.NoError(t, err)
+	lb := &lintBackend{linter: nl}
+	m := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{"lint.backend.test": {"": {Value: 1}}, "lint_backend_test": {"": {Value: 1}}},
+		Timers:   gostatsd.Timers{},
+		Gauges:   gostatsd.Gauges{},
+		Sets:     gostatsd.Sets{},
+	}
+
+	// Each invalid name is only logged the first time it is seen.
+	for i := 0; i < 2; i++ {
+		var errs []error
+		lb.SendMetricsAsync(context.Background(), m, func(e []error) {
+			errs = e
+		})
+		assert.Empty(t, errs)
+	}
+	var logged []string
+	for _, entry := range hook.AllEntries() {
+		if name, ok := entry.Data[logging.FieldBucket].(string); ok && strings.Contains(name, "lint") {
+			logged = append(logged, fmt.Sprintf("%s %q for %s: %v", entry.Message, name, entry.Data["target"], entry.Data[logrus.ErrorKey]))
+		}
+	}
+	assert.Equal(t, []string{`Metric name is invalid "lint.backend.test" for prometheus: invalid character '.' at offset 4`}, logged)
+}
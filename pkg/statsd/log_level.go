@@ -0,0 +1,117 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd/pkg/logging"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LogLevel changes the level of logging at runtime, optionally reverting to the previous level after a time so that
+// verbose logging is not left on by accident.
+type LogLevel struct {
+	get    func() log.Level
+	set    func(log.Level)
+	logger log.FieldLogger
+
+	mu       sync.Mutex
+	previous log.Level // Level to revert to when the timer fires
+	until    time.Time
+	timer    *time.Timer
+}
+
+// NewLogLevel creates a LogLevel which reads and changes the level using get and set, such as log.GetLevel and
+// log.SetLevel for the standard logger.
+func NewLogLevel(get func() log.Level, set func(log.Level)) *LogLevel {
+	return &LogLevel{
+		get:    get,
+		set:    set,
+		logger: logging.Component("console"),
+	}
+}
+
+// Set changes the level of logging.  If d is positive the level reverts after d to the level before any timed
+// change, otherwise the change is permanent and replaces any pending revert.
+func (ll *LogLevel) Set(level log.Level, d time.Duration) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	if ll.timer != nil {
+		ll.timer.Stop()
+		ll.timer = nil
+	} else {
+		ll.previous = ll.get()
+	}
+	ll.logger.Infof("Setting log level to %s", level)
+	ll.set(level)
+	if d <= 0 {
+		return
+	}
+	until := time.Now().Add(d)
+	ll.until = until
+	ll.timer = time.AfterFunc(d, func() {
+		ll.revert(until)
+	})
+}
+
+// revert restores the previous level for the change which was made to last until the given time, if it has not
+// been replaced.
+func (ll *LogLevel) revert(until time.Time) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	if ll.timer == nil || !ll.until.Equal(until) {
+		return
+	}
+	ll.timer = nil
+	ll.set(ll.previous)
+	ll.logger.Infof("Reverted log level to %s", ll.previous)
+}
+
+// Status writes the current level, and when it reverts, to w.
+func (ll *LogLevel) Status(w io.Writer) error {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	if ll.timer == nil {
+		_, err := fmt.Fprintf(w, "%s\n", ll.get())
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s, reverting to %s in %v\n", ll.get(), ll.previous, time.Until(ll.until).Truncate(time.Second))
+	return err
+}
+
+// SetCommand is the console command to change the level, taking the arguments <level> [<seconds>].
+func (ll *LogLevel) SetCommand(ctx context.Context, args []string, w io.Writer) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: set-log-level <level> [<seconds>]")
+	}
+	level, err := log.ParseLevel(args[0])
+	if err != nil {
+		return err
+	}
+	var d time.Duration
+	if len(args) == 2 {
+		seconds, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("invalid seconds %q", args[1])
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+	ll.Set(level, d)
+	if d > 0 {
+		_, err = fmt.Fprintf(w, "log level set to %s for %v\n", level, d)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "log level set to %s\n", level)
+	return err
+}
+
+// GetCommand is the console command to show the level.
+func (ll *LogLevel) GetCommand(ctx context.Context, args []string, w io.Writer) error {
+	return ll.Status(w)
+}
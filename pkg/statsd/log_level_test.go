@@ -0,0 +1,81 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLevel is a log level which can be read and changed concurrently.
+type fakeLevel struct {
+	mu    sync.Mutex
+	level log.Level
+}
+
+func (fl *fakeLevel) get() log.Level {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	return fl.level
+}
+
+func (fl *fakeLevel) set(level log.Level) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	fl.level = level
+}
+
+func TestLogLevelSetCommand(t *testing.T) {
+	t.Parallel()
+	fl := &fakeLevel{level: log.InfoLevel}
+	ll := NewLogLevel(fl.get, fl.set)
+	var out bytes.Buffer
+
+	require.NoError(t, ll.SetCommand(context.Background(), []string{"debug"}, &out))
+	assert.Equal(t, log.DebugLevel, fl.get())
+	assert.Equal(t, "log level set to debug\n", out.String())
+
+	out.Reset()
+	require.NoError(t, ll.GetCommand(context.Background(), nil, &out))
+	assert.Equal(t, "debug\n", out.String())
+
+	require.NoError(t, ll.SetCommand(context.Background(), []string{"info"}, &out))
+	assert.Equal(t, log.InfoLevel, fl.get())
+
+	assert.Error(t, ll.SetCommand(context.Background(), nil, &out))
+	assert.Error(t, ll.SetCommand(context.Background(), []string{"loud"}, &out))
+	assert.Error(t, ll.SetCommand(context.Background(), []string{"debug", "0"}, &out))
+	assert.Equal(t, log.InfoLevel, fl.get())
+}
+
+func TestLogLevelReverts(t *testing.T) {
+	t.Parallel()
+	fl := &fakeLevel{level: log.WarnLevel}
+	ll := NewLogLevel(fl.get, fl.set)
+
+	ll.Set(log.DebugLevel, 50*time.Millisecond)
+	assert.Equal(t, log.DebugLevel, fl.get())
+	var out bytes.Buffer
+	require.NoError(t, ll.Status(&out))
+	assert.Contains(t, out.String(), "debug, reverting to warning in ")
+
+	// A second timed change extends the first, and still reverts to the level before either.
+	ll.Set(log.InfoLevel, 50*time.Millisecond)
+	assert.Equal(t, log.InfoLevel, fl.get())
+	deadline := time.Now().Add(time.Second)
+	for fl.get() != log.WarnLevel && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, log.WarnLevel, fl.get())
+
+	// A permanent change cancels the revert.
+	ll.Set(log.DebugLevel, 10*time.Millisecond)
+	ll.Set(log.ErrorLevel, 0)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, log.ErrorLevel, fl.get())
+}
@@ -0,0 +1,269 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"unsafe"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/console"
+	"github.com/atlassian/gostatsd/pkg/hll"
+)
+
+const (
+	// memTopBuckets is the number of buckets with the largest estimated footprint listed by the memstats command.
+	memTopBuckets = 20
+
+	// Approximate overheads of the structures holding the metrics, used by the memory estimate.
+	memMapEntryOverhead = 32 // Bytes per entry of a map, beyond the key and value, including unused bucket space
+	memStringHeader     = int(unsafe.Sizeof(""))
+	memIntMember        = 8
+)
+
+var memTypeOverhead = [gostatsd.SET + 1]int{
+	gostatsd.COUNTER: int(unsafe.Sizeof(gostatsd.Counter{})),
+	gostatsd.TIMER:   int(unsafe.Sizeof(gostatsd.Timer{})),
+	gostatsd.GAUGE:   int(unsafe.Sizeof(gostatsd.Gauge{})),
+	gostatsd.SET:     int(unsafe.Sizeof(gostatsd.Set{})),
+}
+
+// memTypeEstimate is the estimated memory used by the metrics of one type.
+type memTypeEstimate struct {
+	buckets  int // Every bucket, a metric name
+	series   int // Every series, a name and tag set
+	sampled  int // Series in the sampled buckets
+	keyBytes int // Bytes of the names and tags keys of the sampled series
+	bytes    int // Total estimated bytes of the sampled series
+	values   int // Bytes of timer samples and histogram buckets or set members of the sampled series, included in bytes
+}
+
+// memBucket is the estimated memory used by a sampled bucket.
+type memBucket struct {
+	metricType gostatsd.MetricType
+	name       string
+	series     int
+	bytes      int
+}
+
+// memEstimate is the estimated memory used by the metrics in one or more aggregators.
+type memEstimate struct {
+	fraction float64
+	types    [gostatsd.SET + 1]memTypeEstimate
+	top      []memBucket // The buckets with the largest footprint, largest first
+}
+
+// sampled returns true if the bucket name is in the sample.  The sample is chosen by a hash of the name, so the same
+// buckets are sampled by every aggregator and on every run.
+func (e *memEstimate) sampled(name string) bool {
+	if e.fraction >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return float64(h.Sum32()) < e.fraction*math.MaxUint32
+}
+
+// add estimates the memory used by the metrics in m.
+func (e *memEstimate) add(m *gostatsd.MetricMap) {
+	var buckets []memBucket
+	addBucket := func(metricType gostatsd.MetricType, name string, series int, bytesOf func(f func(tagsKey string, bytes, values int))) {
+		te := &e.types[metricType]
+		te.buckets++
+		te.series += series
+		if !e.sampled(name) {
+			return
+		}
+		b := memBucket{metricType: metricType, name: name, series: series, bytes: len(name) + memStringHeader + memMapEntryOverhead}
+		te.keyBytes += series * len(name)
+		bytesOf(func(tagsKey string, bytes, values int) {
+			te.sampled++
+			te.keyBytes += len(tagsKey)
+			te.values += values
+			b.bytes += len(tagsKey) + memStringHeader + memMapEntryOverhead + memTypeOverhead[metricType] + bytes + values
+		})
+		te.bytes += b.bytes
+		buckets = append(buckets, b)
+	}
+	for name, tagged := range m.Counters {
+		addBucket(gostatsd.COUNTER, name, len(tagged), func(f func(string, int, int)) {
+			for tagsKey, c := range tagged {
+				f(tagsKey, memTagsBytes(c.Tags, c.Hostname), 0)
+			}
+		})
+	}
+	for name, tagged := range m.Timers {
+		addBucket(gostatsd.TIMER, name, len(tagged), func(f func(string, int, int)) {
+			for tagsKey, t := range tagged {
+				pct := 0
+				for _, p := range t.Percentiles {
+					pct += int(unsafe.Sizeof(p)) + len(p.Str)
+				}
+				values := 8 * cap(t.Values)
+				if h := t.Histogram; h != nil {
+					values += 8 * (cap(h.Positive.Counts) + cap(h.Negative.Counts))
+				}
+				if h := t.HDR; h != nil {
+					// A map entry of an int32 index and uint64 count, with the overhead of the map.
+					values += 24 * h.Buckets()
+				}
+				f(tagsKey, memTagsBytes(t.Tags, t.Hostname)+pct, values)
+			}
+		})
+	}
+	for name, tagged := range m.Gauges {
+		addBucket(gostatsd.GAUGE, name, len(tagged), func(f func(string, int, int)) {
+			for tagsKey, g := range tagged {
+				f(tagsKey, memTagsBytes(g.Tags, g.Hostname), 0)
+			}
+		})
+	}
+	for name, tagged := range m.Sets {
+		addBucket(gostatsd.SET, name, len(tagged), func(f func(string, int, int)) {
+			for tagsKey, s := range tagged {
+				members := len(s.IntValues) * (memIntMember + memMapEntryOverhead)
+				for member := range s.Values {
+					members += len(member) + memStringHeader + memMapEntryOverhead
+				}
+				if s.Sketch != nil {
+					members += 1 << hll.Precision
+				}
+				f(tagsKey, memTagsBytes(s.Tags, s.Hostname), members)
+			}
+		})
+	}
+	e.top = topMemBuckets(append(e.top, buckets...))
+}
+
+// merge adds the estimate of other to e.
+func (e *memEstimate) merge(other *memEstimate) {
+	for t := range e.types {
+		te, ote := &e.types[t], &other.types[t]
+		te.buckets += ote.buckets
+		te.series += ote.series
+		te.sampled += ote.sampled
+		te.keyBytes += ote.keyBytes
+		te.bytes += ote.bytes
+		te.values += ote.values
+	}
+	e.top = topMemBuckets(append(e.top, other.top...))
+}
+
+// topMemBuckets returns the memTopBuckets buckets with the largest footprint, largest first.
+func topMemBuckets(buckets []memBucket) []memBucket {
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].bytes != buckets[j].bytes {
+			return buckets[i].bytes > buckets[j].bytes
+		}
+		if buckets[i].name != buckets[j].name {
+			return buckets[i].name < buckets[j].name
+		}
+		return buckets[i].metricType < buckets[j].metricType
+	})
+	if len(buckets) > memTopBuckets {
+		buckets = buckets[:memTopBuckets]
+	}
+	return buckets
+}
+
+func memTagsBytes(tags gostatsd.Tags, hostname string) int {
+	n := len(hostname)
+	for _, tag := range tags {
+		n += memStringHeader + len(tag)
+	}
+	return n
+}
+
+// scale returns n sampled values scaled up to the whole keyspace.
+func (e *memEstimate) scale(n int) int {
+	if e.fraction >= 1 {
+		return n
+	}
+	return int(float64(n) / e.fraction)
+}
+
+// write writes the estimate and the runtime memory statistics to w.
+func (e *memEstimate) write(w io.Writer, ms *runtime.MemStats) {
+	_, _ = fmt.Fprintf(w, "Estimated aggregator memory, from %g%% of buckets:\n", 100*e.fraction)
+	_, _ = fmt.Fprintf(w, "%-8s %10s %10s %14s %12s %14s\n", "type", "buckets", "series", "bytes", "avg key", "values bytes")
+	total := 0
+	for t := gostatsd.COUNTER; t <= gostatsd.SET; t++ {
+		te := &e.types[t]
+		avgKey := 0
+		if te.sampled > 0 {
+			avgKey = te.keyBytes / te.sampled
+		}
+		bytes := e.scale(te.bytes)
+		total += bytes
+		_, _ = fmt.Fprintf(w, "%-8s %10d %10d %14d %12d %14d\n", t, te.buckets, te.series, bytes, avgKey, e.scale(te.values))
+	}
+	_, _ = fmt.Fprintf(w, "%-8s %10s %10s %14d\n", "total", "", "", total)
+	_, _ = fmt.Fprintf(w, "Top %d sampled buckets by estimated bytes:\n", memTopBuckets)
+	for _, b := range e.top {
+		_, _ = fmt.Fprintf(w, "%14d %-8s %s (%d series)\n", b.bytes, b.metricType, b.name, b.series)
+	}
+	_, _ = fmt.Fprintln(w, "Runtime memory:")
+	for _, v := range []struct {
+		name  string
+		value uint64
+	}{
+		{"heap_alloc", ms.HeapAlloc},
+		{"heap_inuse", ms.HeapInuse},
+		{"heap_objects", ms.HeapObjects},
+		{"sys", ms.Sys},
+		{"num_gc", uint64(ms.NumGC)},
+	} {
+		_, _ = fmt.Fprintf(w, "%-14s %d\n", v.name, v.value)
+	}
+}
+
+// MemStatsCommand returns the console command which estimates the memory used by the metrics received so far this
+// interval, by type and for the largest buckets, alongside the runtime memory statistics.  Only a fraction of the
+// buckets, chosen by a hash of their name, are walked if one is given, and the estimate is scaled up from them.
+func MemStatsCommand(processer AggregateProcesser) console.Handler {
+	return func(ctx context.Context, args []string, w io.Writer) error {
+		fraction := 1.0
+		switch len(args) {
+		case 0:
+		case 1:
+			var err error
+			fraction, err = strconv.ParseFloat(args[0], 64)
+			if err != nil || fraction <= 0 || fraction > 1 {
+				return fmt.Errorf("invalid fraction %q, must be more than 0 and at most 1, usage: memstats [<fraction>]", args[0])
+			}
+		default:
+			return errors.New("usage: memstats [<fraction>]")
+		}
+
+		var mu sync.Mutex
+		estimate := &memEstimate{fraction: fraction}
+		wait := processer.Process(ctx, func(aggrID int, aggr Aggregator) {
+			aggr.Process(func(m *gostatsd.MetricMap) {
+				e := &memEstimate{fraction: fraction}
+				e.add(m)
+				mu.Lock()
+				estimate.merge(e)
+				mu.Unlock()
+			})
+		})
+		wait()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		bw := bufio.NewWriter(w)
+		estimate.write(bw, &ms)
+		// Errors writing to the buffer are returned by Flush.
+		return bw.Flush()
+	}
+}
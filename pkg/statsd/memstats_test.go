@@ -0,0 +1,113 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemEstimate(t *testing.T) {
+	t.Parallel()
+	m := &gostatsd.MetricMap{Counters: gostatsd.Counters{}, Timers: gostatsd.Timers{}, Gauges: gostatsd.Gauges{}, Sets: gostatsd.Sets{}}
+	m.Counters["c"] = map[string]gostatsd.Counter{
+		"a:b": {Tags: gostatsd.Tags{"a:b"}},
+	}
+	m.Timers["t"] = map[string]gostatsd.Timer{
+		"": {Values: make([]float64, 2, 4)},
+	}
+	members := map[string]struct{}{}
+	for i := 0; i < 10; i++ {
+		members[fmt.Sprintf("user%d", i)] = struct{}{}
+	}
+	m.Sets["s"] = map[string]gostatsd.Set{
+		"": {Values: members},
+	}
+	e := &memEstimate{fraction: 1}
+	e.add(m)
+
+	bucket := 1 + memStringHeader + memMapEntryOverhead
+	counter := &e.types[gostatsd.COUNTER]
+	assert.Equal(t, memTypeEstimate{buckets: 1, series: 1, sampled: 1, keyBytes: 4,
+		bytes: bucket + 3 + memStringHeader + memMapEntryOverhead + memTypeOverhead[gostatsd.COUNTER] + memStringHeader + 3}, *counter)
+	timer := &e.types[gostatsd.TIMER]
+	assert.Equal(t, 32, timer.values)
+	assert.Equal(t, bucket+memStringHeader+memMapEntryOverhead+memTypeOverhead[gostatsd.TIMER]+32, timer.bytes)
+	set := &e.types[gostatsd.SET]
+	assert.Equal(t, 10*(5+memStringHeader+memMapEntryOverhead), set.values)
+	assert.Zero(t, e.types[gostatsd.GAUGE])
+
+	require.Len(t, e.top, 3)
+	assert.Equal(t, "s", e.top[0].name)
+	assert.Equal(t, set.bytes, e.top[0].bytes)
+}
+
+func TestMemEstimateSampling(t *testing.T) {
+	t.Parallel()
+	m := &gostatsd.MetricMap{Counters: gostatsd.Counters{}, Timers: gostatsd.Timers{}, Gauges: gostatsd.Gauges{}, Sets: gostatsd.Sets{}}
+	for i := 0; i < 1000; i++ {
+		m.Gauges[fmt.Sprintf("gauge.%d", i)] = map[string]gostatsd.Gauge{"": {}}
+	}
+	all := &memEstimate{fraction: 1}
+	all.add(m)
+	half := &memEstimate{fraction: 0.5}
+	half.add(m)
+
+	// Every bucket is counted, but only those sampled are walked.
+	gauges := &half.types[gostatsd.GAUGE]
+	assert.Equal(t, 1000, gauges.buckets)
+	assert.Equal(t, 1000, gauges.series)
+	assert.InDelta(t, 500, gauges.sampled, 100)
+	assert.InEpsilon(t, all.types[gostatsd.GAUGE].bytes, half.scale(gauges.bytes), 0.2)
+
+	// The same buckets are sampled each time.
+	again := &memEstimate{fraction: 0.5}
+	again.add(m)
+	assert.Equal(t, half.types, again.types)
+}
+
+func TestMemStatsCommand(t *testing.T) {
+	t.Parallel()
+	agg := newFakeAggregator()
+	now := time.Now()
+	receive := func(m gostatsd.Metric) {
+		m.Rate = 1
+		m.TagsKey = formatTagsKey(m.Tags, m.Hostname)
+		agg.Receive(&m, now)
+	}
+	for i := 0; i < 30; i++ {
+		receive(gostatsd.Metric{Name: fmt.Sprintf("requests.%d", i), Value: 1, Type: gostatsd.COUNTER})
+	}
+	receive(gostatsd.Metric{Name: "latency", Value: 5, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"env:prod"}})
+	for i := 0; i < 10; i++ {
+		receive(gostatsd.Metric{Name: "users", StringValue: fmt.Sprintf("user%d", i), Type: gostatsd.SET})
+	}
+	memstats := MemStatsCommand(&singleAggregator{agg: agg})
+
+	var out bytes.Buffer
+	require.NoError(t, memstats(context.Background(), nil, &out))
+	lines := strings.Split(out.String(), "\n")
+	assert.Equal(t, "Estimated aggregator memory, from 100% of buckets:", lines[0])
+	assert.Regexp(t, `^counter +30 +30 +\d+ +\d+ +0$`, lines[2])
+	assert.Regexp(t, `^timer +1 +1 +\d+ +\d+ +\d+$`, lines[3])
+	assert.Regexp(t, `^gauge +0 +0 +0 +0 +0$`, lines[4])
+	assert.Equal(t, "Top 20 sampled buckets by estimated bytes:", lines[7])
+	assert.Regexp(t, `^ +\d+ set +users \(1 series\)$`, lines[8])
+	assert.Contains(t, out.String(), "Runtime memory:\nheap_alloc ")
+	assert.Len(t, lines, 8+memTopBuckets+1+5+1)
+
+	out.Reset()
+	require.NoError(t, memstats(context.Background(), []string{"0.25"}, &out))
+	assert.True(t, strings.HasPrefix(out.String(), "Estimated aggregator memory, from 25% of buckets:\n"))
+
+	for _, args := range [][]string{{"0"}, {"2"}, {"x"}, {"0.5", "1"}} {
+		assert.Error(t, memstats(context.Background(), args, &bytes.Buffer{}), "%v", args)
+	}
+}
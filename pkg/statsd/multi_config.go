@@ -0,0 +1,56 @@
+package statsd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/viper"
+)
+
+// ReadMultiConfig reads the configuration file at path, which has a section of settings for each server run in the
+// process, such as [east] and [west].  It returns the names of the sections, sorted, and a viper for each with the
+// settings of its section over the settings of v, which are shared by every server.  Blocks such as [west.graphite]
+// are merged with the shared block of the same name, setting by setting.
+func ReadMultiConfig(v *viper.Viper, path string) ([]string, []*viper.Viper, error) {
+	mv := viper.New()
+	mv.SetConfigFile(path)
+	if err := mv.ReadInConfig(); err != nil {
+		return nil, nil, err
+	}
+	sections := mv.AllSettings()
+	names := make([]string, 0, len(sections))
+	for name, section := range sections {
+		if _, ok := section.(map[string]interface{}); !ok {
+			return nil, nil, fmt.Errorf("%s: %q is not a section of server settings", path, name)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("%s: no server sections", path)
+	}
+	sort.Strings(names)
+	vipers := make([]*viper.Viper, len(names))
+	for i, name := range names {
+		settings := v.AllSettings()
+		mergeSettings(settings, sections[name].(map[string]interface{}))
+		sv := viper.New()
+		if err := sv.MergeConfigMap(settings); err != nil {
+			return nil, nil, fmt.Errorf("%s: section %q: %v", path, name, err)
+		}
+		vipers[i] = sv
+	}
+	return names, vipers, nil
+}
+
+// mergeSettings sets the settings of src in dst, merging blocks present in both.
+func mergeSettings(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcBlock, srcOK := value.(map[string]interface{})
+		dstBlock, dstOK := dst[key].(map[string]interface{})
+		if srcOK && dstOK {
+			mergeSettings(dstBlock, srcBlock)
+			continue
+		}
+		dst[key] = value
+	}
+}
@@ -0,0 +1,86 @@
+package statsd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeMultiConfig(t *testing.T, config string) (string, func()) {
+	dir, err := ioutil.TempDir("", "multi")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "servers.toml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestReadMultiConfig(t *testing.T) {
+	t.Parallel()
+	path, cleanup := writeMultiConfig(t, `
+[west]
+metrics-addr=':8126'
+namespace='west'
+
+[west.graphite]
+address='graphite-west:2003'
+
+[east]
+metrics-addr=':8125'
+`)
+	defer cleanup()
+	v := derivedViper(t, `
+namespace='shared'
+flush-interval='10s'
+
+[graphite]
+address='graphite:2003'
+mode='tags'
+`)
+
+	names, vipers, err := ReadMultiConfig(v, path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"east", "west"}, names)
+	require.Len(t, vipers, 2)
+
+	east, west := vipers[0], vipers[1]
+	assert.Equal(t, ":8125", east.GetString(ParamMetricsAddr))
+	assert.Equal(t, "shared", east.GetString(ParamNamespace))
+	assert.Equal(t, 10*time.Second, east.GetDuration(ParamFlushInterval))
+	assert.Equal(t, "graphite:2003", east.Sub("graphite").GetString("address"))
+
+	assert.Equal(t, ":8126", west.GetString(ParamMetricsAddr))
+	assert.Equal(t, "west", west.GetString(ParamNamespace))
+	assert.Equal(t, 10*time.Second, west.GetDuration(ParamFlushInterval))
+	assert.Equal(t, "graphite-west:2003", west.Sub("graphite").GetString("address"))
+	assert.Equal(t, "tags", west.Sub("graphite").GetString("mode"))
+
+	// The shared settings are not changed by the sections
+	assert.Equal(t, "shared", v.GetString(ParamNamespace))
+	assert.Equal(t, "graphite:2003", v.Sub("graphite").GetString("address"))
+}
+
+func TestReadMultiConfigErrors(t *testing.T) {
+	t.Parallel()
+	path, cleanup := writeMultiConfig(t, `
+namespace='shared'
+
+[east]
+metrics-addr=':8125'
+`)
+	defer cleanup()
+	_, _, err := ReadMultiConfig(derivedViper(t, ``), path)
+	assert.EqualError(t, err, path+`: "namespace" is not a section of server settings`)
+
+	empty, cleanupEmpty := writeMultiConfig(t, ``)
+	defer cleanupEmpty()
+	_, _, err = ReadMultiConfig(derivedViper(t, ``), empty)
+	assert.EqualError(t, err, empty+": no server sections")
+
+	_, _, err = ReadMultiConfig(derivedViper(t, ``), filepath.Join(filepath.Dir(path), "missing.toml"))
+	assert.Error(t, err)
+}
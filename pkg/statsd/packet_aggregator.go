@@ -0,0 +1,115 @@
+package statsd
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// packetAggregator combines identical metrics from a single datagram, so that a burst of lines such as
+// fifty `hits:1|c` is dispatched as a single metric.  Counters are summed, gauges keep the last value
+// plus any deltas after it, and timer values are collected in Metric.Values.  Sets are passed through unchanged.
+//
+// The result of aggregating the combined metrics is identical to aggregating each line on its own.
+type packetAggregator struct {
+	metrics []*gostatsd.Metric          // Metrics to dispatch, in the order they were first seen
+	index   map[string]*gostatsd.Metric // Metrics which can be combined, by key
+	key     []byte                      // Buffer for building keys
+}
+
+var packetAggregatorPool = sync.Pool{
+	New: func() interface{} {
+		return &packetAggregator{
+			index: map[string]*gostatsd.Metric{},
+		}
+	},
+}
+
+func getPacketAggregator() *packetAggregator {
+	return packetAggregatorPool.Get().(*packetAggregator)
+}
+
+// release resets the packetAggregator and returns it to the pool.  Metrics must have been dispatched first.
+func (pa *packetAggregator) release() {
+	for i := range pa.metrics {
+		pa.metrics[i] = nil
+	}
+	pa.metrics = pa.metrics[:0]
+	for k := range pa.index {
+		delete(pa.index, k)
+	}
+	packetAggregatorPool.Put(pa)
+}
+
+// add adds a metric, combining it with an identical metric already seen if possible.  Gauges are only
+// combined if combineGauges is true, as keeping only the last value hides how often a gauge changed.
+func (pa *packetAggregator) add(m *gostatsd.Metric, combineGauges bool) {
+	switch m.Type {
+	case gostatsd.COUNTER, gostatsd.TIMER:
+	case gostatsd.GAUGE:
+		if !combineGauges {
+			pa.metrics = append(pa.metrics, m)
+			return
+		}
+	default:
+		pa.metrics = append(pa.metrics, m)
+		return
+	}
+
+	pa.key = appendMetricKey(pa.key[:0], m)
+	existing, ok := pa.index[string(pa.key)]
+	if !ok {
+		if m.Type == gostatsd.COUNTER {
+			// The aggregator truncates each sampled counter value, so do the same before summing.
+			m.Value = float64(int64(m.Value / m.Rate))
+			m.Rate = 1
+		}
+		pa.index[string(pa.key)] = m
+		pa.metrics = append(pa.metrics, m)
+		return
+	}
+
+	switch m.Type {
+	case gostatsd.COUNTER:
+		existing.Value += float64(int64(m.Value / m.Rate))
+	case gostatsd.GAUGE:
+		if m.GaugeDelta {
+			existing.Value += m.Value
+		} else {
+			existing.Value = m.Value
+			existing.GaugeDelta = false
+		}
+	case gostatsd.TIMER:
+		existing.Values = append(existing.Values, m.Value)
+		existing.Values = append(existing.Values, m.Values...)
+	}
+	m.Done()
+}
+
+// appendMetricKey appends a key identifying the series of m to buf.  Metrics are only combined if they have the same
+// client timestamp and TTL, as there is only one of each in the combined metric, and timers only if they have the same
+// sample rate, as it applies to all of their values.
+func appendMetricKey(buf []byte, m *gostatsd.Metric) []byte {
+	buf = append(buf, byte(m.Type))
+	buf = append(buf, m.Name...)
+	buf = append(buf, 0)
+	buf = append(buf, m.Hostname...)
+	buf = append(buf, 0)
+	buf = append(buf, m.SourceIP...)
+	buf = append(buf, 0)
+	buf = append(buf, m.ContainerID...)
+	for _, tag := range m.Tags {
+		buf = append(buf, 0)
+		buf = append(buf, tag...)
+	}
+	buf = append(buf, 0)
+	buf = strconv.AppendInt(buf, int64(m.ClientTimestamp), 10)
+	buf = append(buf, 0)
+	buf = strconv.AppendInt(buf, int64(m.TTL), 10)
+	if m.Type == gostatsd.TIMER {
+		buf = append(buf, 0)
+		buf = strconv.AppendFloat(buf, m.Rate, 'g', -1, 64)
+	}
+	return buf
+}
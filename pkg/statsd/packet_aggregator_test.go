@@ -0,0 +1,119 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// aggregatingHandler feeds metrics straight in to a MetricAggregator, which returns them to the pool.
+type aggregatingHandler struct {
+	agg *MetricAggregator
+	now time.Time
+}
+
+func (ah *aggregatingHandler) EstimatedTags() int {
+	return 0
+}
+
+func (ah *aggregatingHandler) DispatchMetric(ctx context.Context, m *gostatsd.Metric) error {
+	m.TagsKey = formatTagsKey(m.Tags, m.Hostname)
+	ah.agg.Receive(m, ah.now)
+	return nil
+}
+
+func (ah *aggregatingHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func (ah *aggregatingHandler) WaitForEvents() {
+}
+
+func TestPacketAggregationFlushOutput(t *testing.T) {
+	t.Parallel()
+	datagrams := []string{
+		"hits:1|c\nhits:1|c\nhits:1|c\nhits:2|c|#foo:bar\nhits:1|c|#foo:bar\nhits:1|c",
+		"sampled:1|c|@0.3\nsampled:1|c|@0.3\nsampled:1.5|c\nsampled:1.5|c\nsampled:1|c|@0.1",
+		"temp:10|g\ntemp:12|g\ntemp:11|g\ntemp:5|g|#foo:bar",
+		"level:+5|g\nlevel:-2|g\nlevel:10|g\nlevel:+1|g\nlevel:-3|g|#foo:bar\nlevel:+4|g|#foo:bar",
+		"lat:10|ms\nlat:20|ms\nlat:15|ms|@0.5\nlat:30|ms\nlat:40|ms|@0.5\nlat:1|ms|#foo:bar",
+		"users:a|s\nusers:b|s\nusers:a|s|@0.5",
+		"hits:1|c|#host:a\nhits:1|c|#host:b\nhits:1|c|#host:a\nlat:1|h|#host:a\nlat:2|h|#host:b",
+		"bad line\nhits:1|c\n_e{1,1}:a|b\nhits:1|c",
+	}
+
+	flush := func(ignoreHost, preAggregate bool) *MetricAggregator {
+		ah := &aggregatingHandler{agg: newFakeAggregator(), now: time.Unix(100, 0)}
+		dp := NewDatagramParser(nil, ah, ah, statser.NewNullStatser(), ParserOptions{IgnoreHost: ignoreHost, PreAggregate: preAggregate, PreAggregateGauges: true})
+		for _, dg := range datagrams {
+			_, _, _, err := dp.handleDatagram(context.Background(), fakeIP, "listener:a", 0, []byte(dg), time.Time{}, nil)
+			require.NoError(t, err)
+		}
+		ah.agg.Flush(10 * time.Second)
+		return ah.agg
+	}
+
+	for _, ignoreHost := range []bool{false, true} {
+		expected := flush(ignoreHost, false)
+		actual := flush(ignoreHost, true)
+		assert.Equal(t, expected.Counters, actual.Counters)
+		assert.Equal(t, expected.Timers, actual.Timers)
+		assert.Equal(t, expected.Gauges, actual.Gauges)
+		assert.Equal(t, expected.Sets, actual.Sets)
+		assert.NotEmpty(t, actual.Counters)
+		assert.True(t, actual.MetricsReceived() < expected.MetricsReceived())
+	}
+}
+
+func TestPacketAggregationCombines(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	dp := NewDatagramParser(nil, ch, ch, statser.NewNullStatser(), ParserOptions{PreAggregate: true})
+
+	m, _, _, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte("hits:1|c\nhits:2|c\nlat:1|ms\nlat:2|ms\ntemp:1|g\ntemp:2|g\nusers:a|s\nusers:a|s"), time.Time{}, nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 8, m)
+
+	expected := []gostatsd.Metric{
+		{Name: "hits", Value: 3, Rate: 1, SourceIP: fakeIP, Type: gostatsd.COUNTER},
+		{Name: "lat", Value: 1, Values: []float64{2}, Rate: 1, SourceIP: fakeIP, Type: gostatsd.TIMER},
+		{Name: "temp", Value: 1, Rate: 1, SourceIP: fakeIP, Type: gostatsd.GAUGE},
+		{Name: "temp", Value: 2, Rate: 1, SourceIP: fakeIP, Type: gostatsd.GAUGE},
+		{Name: "users", StringValue: "a", Rate: 1, SourceIP: fakeIP, Type: gostatsd.SET},
+		{Name: "users", StringValue: "a", Rate: 1, SourceIP: fakeIP, Type: gostatsd.SET},
+	}
+	for i := range ch.metrics {
+		ch.metrics[i].Tags = nil
+	}
+	assert.Equal(t, expected, ch.metrics)
+}
+
+func TestPacketAggregationKeepsClientTimestamps(t *testing.T) {
+	t.Parallel()
+	dp, ch := newTestParser(false)
+	dp.preAggregate = true
+	dp.clockSkew = NewClockSkew(ClockSkewClamp, time.Minute, 10*time.Minute, 10)
+
+	first := skewReceived.Add(-40 * time.Second)
+	second := skewReceived.Add(-20 * time.Second)
+	lines := fmt.Sprintf("a:1|c|T%d\na:2|c|T%d\na:4|c|T%d\nb:1|c|#ttl:30s\nb:1|c|#ttl:1m", first.Unix(), second.Unix(), second.Unix())
+	m, _, _, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte(lines), skewReceived, nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, m)
+
+	// Metrics with different client timestamps or TTLs are different metrics, and keep their own.
+	require.Len(t, ch.metrics, 4)
+	assert.Equal(t, gostatsd.Nanotime(first.UnixNano()), ch.metrics[0].Timestamp)
+	assert.Equal(t, 1.0, ch.metrics[0].Value)
+	assert.Equal(t, gostatsd.Nanotime(second.UnixNano()), ch.metrics[1].Timestamp)
+	assert.Equal(t, 6.0, ch.metrics[1].Value)
+	assert.Equal(t, 30*time.Second, ch.metrics[2].TTL)
+	assert.Equal(t, time.Minute, ch.metrics[3].TTL)
+}
@@ -0,0 +1,111 @@
+package statsd
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	stats "github.com/atlassian/gostatsd/pkg/statser"
+)
+
+// parseErrorClass is a broad category of the reason a line failed to parse.
+type parseErrorClass int
+
+const (
+	parseErrorMalformed parseErrorClass = iota
+	parseErrorMissingType
+	parseErrorUnknownType
+	parseErrorBadValue
+	parseErrorBadSampleRate
+	parseErrorBadTags
+	parseErrorBadTTL
+	parseErrorBadTimestamp
+	parseErrorWrongType
+	numParseErrorClasses
+)
+
+var parseErrorClassNames = [numParseErrorClasses]string{
+	parseErrorMalformed:     "malformed",
+	parseErrorMissingType:   "missing_type",
+	parseErrorUnknownType:   "unknown_type",
+	parseErrorBadValue:      "bad_value",
+	parseErrorBadSampleRate: "bad_sample_rate",
+	parseErrorBadTags:       "bad_tags",
+	parseErrorBadTTL:        "bad_ttl",
+	parseErrorBadTimestamp:  "bad_timestamp",
+	parseErrorWrongType:     "wrong_type",
+}
+
+func (c parseErrorClass) String() string {
+	return parseErrorClassNames[c]
+}
+
+// classifyParseError returns the class of an error returned by the lexer.
+func classifyParseError(err error) parseErrorClass {
+	switch err {
+	case errMissingValueSep, errMissingType:
+		return parseErrorMissingType
+	case errInvalidType, errUnknownType:
+		return parseErrorUnknownType
+	case errInvalidValue, errNaN:
+		return parseErrorBadValue
+	case errInvalidSampleRate, errSampledCounter:
+		return parseErrorBadSampleRate
+	case errInvalidTags, errTagLimit:
+		return parseErrorBadTags
+	case errInvalidTTL:
+		return parseErrorBadTTL
+	case errInvalidTimestamp, errClockSkew:
+		return parseErrorBadTimestamp
+	case errWrongType:
+		return parseErrorWrongType
+	default:
+		return parseErrorMalformed
+	}
+}
+
+// parseErrorCounters keeps a count of bad lines per error class, along with the source of the most recent one.
+type parseErrorCounters struct {
+	counts [numParseErrorClasses]uint64 // Must be read/written only using atomic instructions.
+
+	mu         sync.Mutex
+	lastSource [numParseErrorClasses]gostatsd.IP
+}
+
+func (pec *parseErrorCounters) add(err error, ip gostatsd.IP) {
+	class := classifyParseError(err)
+	atomic.AddUint64(&pec.counts[class], 1)
+	pec.mu.Lock()
+	pec.lastSource[class] = ip
+	pec.mu.Unlock()
+}
+
+// count returns the number of bad lines seen for class.
+func (pec *parseErrorCounters) count(class parseErrorClass) uint64 {
+	return atomic.LoadUint64(&pec.counts[class])
+}
+
+func (pec *parseErrorCounters) emit(statser stats.Statser) {
+	for class := parseErrorClass(0); class < numParseErrorClasses; class++ {
+		statser.Gauge("parser.bad_lines_by_error", float64(pec.count(class)), gostatsd.Tags{"error:" + class.String()})
+	}
+}
+
+// write writes the number of bad lines and the most recent source for each error class to w.
+func (pec *parseErrorCounters) write(w io.Writer) error {
+	pec.mu.Lock()
+	lastSource := pec.lastSource
+	pec.mu.Unlock()
+	for class := parseErrorClass(0); class < numParseErrorClasses; class++ {
+		source := lastSource[class]
+		if source == "" {
+			source = "-"
+		}
+		if _, err := fmt.Fprintf(w, "%s: %d (last from %s)\n", class, pec.count(class), source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseErrorClasses(t *testing.T) {
+	t.Parallel()
+	tests := map[string]parseErrorClass{
+		"foo:1":                parseErrorMissingType,
+		"foo:1|":               parseErrorMissingType,
+		"foo:1|q":              parseErrorUnknownType,
+		"foo:1|cx":             parseErrorUnknownType,
+		"_x{1,1}:a|b":          parseErrorUnknownType,
+		"foo:abc|c":            parseErrorBadValue,
+		"foo:NaN|g":            parseErrorBadValue,
+		"foo:1|c|@abc":         parseErrorBadSampleRate,
+		"foo:1|c|@0":           parseErrorBadSampleRate,
+		"foo:1|c|@-1":          parseErrorBadSampleRate,
+		"foo:1|c|@0.5|foo:bar": parseErrorBadTags,
+		"foo:1|c|ttl:0":        parseErrorBadTTL,
+		"foo:1|c|ttl:5x":       parseErrorBadTTL,
+		"foo:1|c|tll:5":        parseErrorBadTTL,
+		"foo":                  parseErrorMalformed,
+		":1|c":                 parseErrorMalformed,
+		"_e{5,1}:a|b":          parseErrorMalformed,
+		"_e{1,4294967294}:a|":  parseErrorMalformed,
+		"\n":                   parseErrorMalformed,
+	}
+	for line, expected := range tests {
+		line := line
+		expected := expected
+		t.Run(line, func(t *testing.T) {
+			t.Parallel()
+			dp, ch := newTestParser(false)
+			_, _, badLines, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte(line), time.Time{}, nil)
+			require.NoError(t, err)
+			assert.EqualValues(t, 1, badLines)
+			assert.Empty(t, ch.metrics)
+			for class := parseErrorClass(0); class < numParseErrorClasses; class++ {
+				if class == expected {
+					assert.EqualValues(t, 1, dp.lineErrors.count(class), class.String())
+				} else {
+					assert.Zero(t, dp.lineErrors.count(class), class.String())
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrorsCommand(t *testing.T) {
+	t.Parallel()
+	dp, _ := newTestParser(false)
+	_, _, _, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte("foo:1|q\nfoo:1|q\nfoo:1|c|@x\nfoo:1|c"), time.Time{}, nil)
+	require.NoError(t, err)
+	_, _, _, err = dp.handleDatagram(context.Background(), gostatsd.IP("10.0.0.1"), "", 0, []byte("foo:1|q"), time.Time{}, nil)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, dp.ParseErrorsCommand(context.Background(), nil, &buf))
+	expected := "malformed: 0 (last from -)\n" +
+		"missing_type: 0 (last from -)\n" +
+		"unknown_type: 3 (last from 10.0.0.1)\n" +
+		"bad_value: 0 (last from -)\n" +
+		"bad_sample_rate: 1 (last from 127.0.0.1)\n" +
+		"bad_tags: 0 (last from -)\n" +
+		"bad_ttl: 0 (last from -)\n" +
+		"bad_timestamp: 0 (last from -)\n" +
+		"wrong_type: 0 (last from -)\n"
+	assert.Equal(t, expected, buf.String())
+}
@@ -3,11 +3,14 @@ package statsd
 import (
 	"bytes"
 	"context"
+	"io"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
 	"github.com/atlassian/gostatsd/pkg/pool"
 	"github.com/atlassian/gostatsd/pkg/statser"
 
@@ -15,6 +18,31 @@ import (
 	"golang.org/x/time/rate"
 )
 
+// ttlTagPrefix is the prefix of the reserved tag a client may use to set the TTL of a metric, such as ttl:30s.
+const ttlTagPrefix = "ttl:"
+
+const (
+	// UnknownTypeDrop drops metrics of an unknown type, counting them as bad lines.
+	UnknownTypeDrop = "drop"
+	// UnknownTypeCounter treats metrics of an unknown type as counters.
+	UnknownTypeCounter = "counter"
+	// UnknownTypeLog drops metrics of an unknown type like UnknownTypeDrop, and logs the raw line as a warning.
+	UnknownTypeLog = "log"
+)
+
+const (
+	// NameWhitespaceUnderscore replaces every space or tab in a metric name with an underscore.
+	NameWhitespaceUnderscore = "underscore"
+	// NameWhitespaceTrimTrailing removes trailing whitespace from a metric name, and replaces the rest with underscores.
+	NameWhitespaceTrimTrailing = "trim-trailing"
+	// NameWhitespaceTrim removes leading and trailing whitespace from a metric name, and replaces the rest with
+	// underscores.
+	NameWhitespaceTrim = "trim"
+	// NameWhitespaceCollapse removes leading and trailing whitespace from a metric name, and replaces each run of
+	// internal whitespace with a single underscore.
+	NameWhitespaceCollapse = "collapse"
+)
+
 // DatagramParser receives datagrams and parses them into Metrics/Events
 // For each Metric/Event it calls Handler.HandleMetric/Event()
 type DatagramParser struct {
@@ -24,6 +52,10 @@ type DatagramParser struct {
 	badLines        uint64
 	metricsReceived uint64
 	eventsReceived  uint64
+	staleDatagrams  uint64
+	typeMismatches  [gostatsd.SET + 1]uint64 // Metrics not of the type of their listener, by listener type
+	unknownTypes    uint64                   // Metrics of an unknown type, whatever the unknown type policy
+	lineErrors      parseErrorCounters       // Must be after the 64-bit fields, as it holds 64-bit counters.
 
 	ignoreHost bool
 	metrics    MetricHandler
@@ -35,27 +67,144 @@ type DatagramParser struct {
 
 	badLineLimiter *rate.Limiter
 
+	maxQueueAge time.Duration // Datagrams queued for longer than this are discarded, 0 to disable
+	queuePolicy string        // Receive queue policy, used to tag dropped datagrams
+
+	capture *LineCapture  // Optional capture of raw lines, may be nil
+	tracer  *MetricTracer // Optional tracing of metrics, may be nil
+
+	preAggregate       bool // Combine identical metrics within a datagram before dispatching them
+	preAggregateGauges bool // Also combine gauges, keeping the last value
+
+	maxMetricTTL time.Duration // Maximum TTL a client may set on a metric, 0 to disable the TTL extension
+
+	typedPortPolicy string // What to do with metrics not of the type of their listener, one of the TypedPort* values
+
+	tagLimits *TagLimits // Optional normalization and limits of the tags of metrics, may be nil
+
+	unknownTypePolicy string // What to do with metrics of an unknown type, one of the UnknownType* values
+
+	sampleRates *SampleRates // Handling of the sample rate of counters, may be nil to scale every counter
+
+	redactor *Redactor // Redaction of sensitive names and tag values, may be nil
+
+	stripContainerID bool // Discard the container ID field of dogstatsd
+
+	nameWhitespace string // Handling of whitespace in metric names, one of the NameWhitespace* values
+
+	recent *RecentLines // Optional buffer of recent raw lines, may be nil
+
+	gaugeDeltas *GaugeDeltas // Whether signed gauge values are deltas, may be nil for all of them to be
+
+	clockSkew *ClockSkew // Handling of client timestamps, nil if they are not accepted
+
+	lastSeen *LastSeen // Tracking of when each source last sent a datagram, may be nil
+
+	busy *busyTracker // Time spent parsing, may be nil
+
+	logger log.FieldLogger
+
 	in <-chan []*Datagram // Input chan of datagram batches to parse
 }
 
-// NewDatagramParser initialises a new DatagramParser.
-func NewDatagramParser(in <-chan []*Datagram, ns string, ignoreHost bool, estimatedTags int, metrics MetricHandler, events EventHandler, statser statser.Statser, badLineLimiter *rate.Limiter) *DatagramParser {
-	return &DatagramParser{
+// ParserOptions configures a DatagramParser.  The zero value of each option leaves it disabled, or uses its default.
+type ParserOptions struct {
+	Namespace     string // Namespace to prefix all metrics
+	IgnoreHost    bool
+	EstimatedTags int // Tags to pre-allocate for each metric, as well as those the metric handler estimates
+
+	BadLineLimiter *rate.Limiter // Limits how often bad lines are logged, nil to never log them
+
+	QueuePolicy string        // Receive queue policy, used to tag dropped datagrams, ReceiveQueueDropNewest if empty
+	MaxQueueAge time.Duration // Datagrams queued for longer than this are discarded, 0 to disable
+
+	Capture *LineCapture  // Capture of raw lines, may be nil
+	Tracer  *MetricTracer // Tracing of metrics, may be nil
+	Recent  *RecentLines  // Buffer of recent raw lines, may be nil
+
+	PreAggregate       bool // Combine identical metrics within a datagram before dispatching them
+	PreAggregateGauges bool // Also combine gauges, keeping the last value
+
+	MaxMetricTTL time.Duration // Maximum TTL a client may set on a metric, 0 to disable the TTL extension
+
+	TypedPortPolicy   string // One of the TypedPort* values, DefaultTypedPortPolicy if empty
+	UnknownTypePolicy string // One of the UnknownType* values, DefaultUnknownTypePolicy if empty
+	NameWhitespace    string // One of the NameWhitespace* values, DefaultNameWhitespace if empty
+	StripContainerID  bool   // Discard the container ID field of dogstatsd
+
+	TagLimits   *TagLimits   // Normalization and limits of the tags of metrics, may be nil
+	SampleRates *SampleRates // Handling of the sample rate of counters, may be nil to scale every counter
+	Redactor    *Redactor    // Redaction of sensitive names and tag values, may be nil
+	GaugeDeltas *GaugeDeltas // Whether signed gauge values are deltas, may be nil for all of them to be
+	ClockSkew   *ClockSkew   // Handling of client timestamps, nil if they are not accepted
+	LastSeen    *LastSeen    // Tracking of when each source last sent a datagram, may be nil
+
+	Logger log.FieldLogger // Logs of the parser, a child of the standard logger if nil
+}
+
+// NewDatagramParser initialises a new DatagramParser, which parses the datagrams from in and dispatches the metrics
+// and events to their handlers.
+func NewDatagramParser(in <-chan []*Datagram, metrics MetricHandler, events EventHandler, statser statser.Statser, opts ParserOptions) *DatagramParser {
+	dp := &DatagramParser{
 		in:             in,
-		ignoreHost:     ignoreHost,
+		ignoreHost:     opts.IgnoreHost,
 		metrics:        metrics,
 		events:         events,
-		namespace:      ns,
+		namespace:      opts.Namespace,
 		statser:        statser,
-		metricPool:     pool.NewMetricPool(estimatedTags + metrics.EstimatedTags()),
-		badLineLimiter: badLineLimiter,
+		metricPool:     pool.NewMetricPool(opts.EstimatedTags + metrics.EstimatedTags()),
+		badLineLimiter: opts.BadLineLimiter,
+		queuePolicy:    opts.QueuePolicy,
+		maxQueueAge:    opts.MaxQueueAge,
+		capture:        opts.Capture,
+		tracer:         opts.Tracer,
+		recent:         opts.Recent,
+
+		preAggregate:       opts.PreAggregate,
+		preAggregateGauges: opts.PreAggregateGauges,
+
+		maxMetricTTL: opts.MaxMetricTTL,
+
+		typedPortPolicy:   opts.TypedPortPolicy,
+		unknownTypePolicy: opts.UnknownTypePolicy,
+		nameWhitespace:    opts.NameWhitespace,
+		stripContainerID:  opts.StripContainerID,
+
+		tagLimits:   opts.TagLimits,
+		sampleRates: opts.SampleRates,
+		redactor:    opts.Redactor,
+		gaugeDeltas: opts.GaugeDeltas,
+		clockSkew:   opts.ClockSkew,
+		lastSeen:    opts.LastSeen,
+
+		logger: opts.Logger,
+	}
+	if dp.badLineLimiter == nil {
+		dp.badLineLimiter = &rate.Limiter{}
+	}
+	if dp.queuePolicy == "" {
+		dp.queuePolicy = ReceiveQueueDropNewest
+	}
+	if dp.typedPortPolicy == "" {
+		dp.typedPortPolicy = DefaultTypedPortPolicy
+	}
+	if dp.unknownTypePolicy == "" {
+		dp.unknownTypePolicy = DefaultUnknownTypePolicy
+	}
+	if dp.nameWhitespace == "" {
+		dp.nameWhitespace = DefaultNameWhitespace
 	}
+	if dp.logger == nil {
+		dp.logger = logging.Component("parser")
+	}
+	return dp
 }
 
 func (dp *DatagramParser) RunMetrics(ctx context.Context) {
 	flushed, unregister := dp.statser.RegisterFlush()
 	defer unregister()
 
+	staleTags := gostatsd.Tags{"policy:" + dp.queuePolicy, "reason:stale"}
 	for {
 		select {
 		case <-ctx.Done():
@@ -64,25 +213,64 @@ func (dp *DatagramParser) RunMetrics(ctx context.Context) {
 			dp.statser.Gauge("parser.metrics_received", float64(atomic.LoadUint64(&dp.metricsReceived)), nil)
 			dp.statser.Gauge("parser.events_received", float64(atomic.LoadUint64(&dp.eventsReceived)), nil)
 			dp.statser.Gauge("parser.bad_lines_seen", float64(atomic.LoadUint64(&dp.badLines)), nil)
+			dp.lineErrors.emit(dp.statser)
+			dp.redactor.emit(dp.statser)
+			for t := gostatsd.COUNTER; t <= gostatsd.SET; t++ {
+				if mismatches := atomic.LoadUint64(&dp.typeMismatches[t]); mismatches > 0 {
+					tags := gostatsd.Tags{"listener_type:" + t.String(), "policy:" + dp.typedPortPolicy}
+					dp.statser.Gauge("parser.type_mismatches", float64(mismatches), tags)
+				}
+			}
+			if unknownTypes := atomic.LoadUint64(&dp.unknownTypes); unknownTypes > 0 {
+				dp.statser.Gauge("parser.unknown_types", float64(unknownTypes), gostatsd.Tags{"policy:" + dp.unknownTypePolicy})
+			}
+			if dp.tagLimits != nil {
+				dp.tagLimits.emit(dp.statser)
+			}
+			dp.sampleRates.emit(dp.statser)
+			dp.gaugeDeltas.emit(dp.statser)
+			dp.clockSkew.emit(dp.statser)
+			dp.lastSeen.emit(dp.statser)
+			if dp.maxQueueAge > 0 {
+				dp.statser.Gauge("receiver.datagrams_dropped", float64(atomic.LoadUint64(&dp.staleDatagrams)), staleTags)
+			}
 		}
 	}
 }
 
+// LineCounts returns the number of metrics and bad lines parsed since startup.
+func (dp *DatagramParser) LineCounts() (metricsReceived, badLines uint64) {
+	return atomic.LoadUint64(&dp.metricsReceived), atomic.LoadUint64(&dp.badLines)
+}
+
 func (dp *DatagramParser) Run(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case dgs := <-dp.in:
-			accumM, accumE, accumB := uint64(0), uint64(0), uint64(0)
+			accumM, accumE, accumB, accumS := uint64(0), uint64(0), uint64(0), uint64(0)
+			var now time.Time
+			if dp.maxQueueAge > 0 || dp.busy != nil {
+				now = time.Now()
+			}
+			// Stale datagrams are still recorded, as their source was not silent.
+			if dp.lastSeen != nil {
+				dp.lastSeen.seenBatch(dgs)
+			}
 			for _, dg := range dgs {
-				m, e, b, err := dp.handleDatagram(ctx, dg.IP, dg.Msg)
+				if dp.maxQueueAge > 0 && now.Sub(dg.Received) > dp.maxQueueAge {
+					dg.DoneFunc()
+					accumS++
+					continue
+				}
+				m, e, b, err := dp.handleDatagram(ctx, dg.IP, dg.ListenerTag, dg.ListenerType, dg.Msg, dg.Received, dg.Trace)
 				dg.DoneFunc()
 				if err != nil {
 					if err == context.Canceled || err == context.DeadlineExceeded {
 						return
 					}
-					log.Warnf("Failed to handle datagram: %v", err)
+					dp.logger.WithError(err).Warn("Failed to handle datagram")
 				}
 				accumM += m
 				accumE += e
@@ -91,22 +279,46 @@ func (dp *DatagramParser) Run(ctx context.Context) {
 			atomic.AddUint64(&dp.metricsReceived, accumM)
 			atomic.AddUint64(&dp.eventsReceived, accumE)
 			atomic.AddUint64(&dp.badLines, accumB)
+			if accumS > 0 {
+				atomic.AddUint64(&dp.staleDatagrams, accumS)
+			}
+			if dp.busy != nil {
+				dp.busy.add(time.Since(now))
+			}
 		}
 	}
 }
 
+// ParseErrorsCommand is the console command to show the number of bad lines per error class.
+func (dp *DatagramParser) ParseErrorsCommand(ctx context.Context, args []string, w io.Writer) error {
+	return dp.lineErrors.write(w)
+}
+
 // logBadLineRateLimited will log a line which failed to decode, if the current rate limit has not been exceeded.
 func (dp *DatagramParser) logBadLineRateLimited(line []byte, ip gostatsd.IP, err error) {
 	if dp.badLineLimiter.Allow() {
-		log.Infof("Error parsing line %q from %s: %v", line, ip, err)
+		dp.logger.WithError(err).WithFields(log.Fields{
+			"line":               string(line),
+			logging.FieldAddress: ip,
+		}).Info("Error parsing line")
 	}
 }
 
 // handleDatagram handles the contents of a datagram and calls Handler.DispatchMetric()
 // for each line that successfully parses into a types.Metric and Handler.DispatchEvent() for each event.
-func (dp *DatagramParser) handleDatagram(ctx context.Context, ip gostatsd.IP, msg []byte) (metricCount, eventCount, badLineCount uint64, err error) {
+// listenerTag is added to each metric and event if it is not empty, and metrics not of listenerType are handled per
+// the typed port policy if it is not 0.  The tags of metrics are normalized and limited if tag limits are set, before
+// listenerTag is added.  If pre-aggregation is enabled, identical metrics are combined and
+// dispatched after the whole datagram has been parsed.  If the datagram is traced, trace is passed on with the
+// first metric.
+func (dp *DatagramParser) handleDatagram(ctx context.Context, ip gostatsd.IP, listenerTag string, listenerType gostatsd.MetricType, msg []byte, received time.Time, trace *gostatsd.PipelineTrace) (metricCount, eventCount, badLineCount uint64, err error) {
 	var numMetrics, numEvents, numBad uint64
 	var exitError error
+	var pa *packetAggregator
+	if dp.preAggregate {
+		pa = getPacketAggregator()
+		defer pa.release()
+	}
 	for {
 		idx := bytes.IndexByte(msg, '\n')
 		var line []byte
@@ -121,16 +333,51 @@ func (dp *DatagramParser) handleDatagram(ctx context.Context, ip gostatsd.IP, ms
 			line = msg[:idx]
 			msg = msg[idx+1:]
 		}
-		metric, event, err := dp.parseLine(line)
+		// Must be done before parsing, as the lexer modifies the line in place.
+		if dp.capture != nil && dp.capture.Active() {
+			dp.capture.Capture(line)
+		}
+		if dp.recent != nil {
+			dp.recent.Add(line, ip)
+		}
+		var rawLine string
+		tracing := dp.tracer.Active()
+		if tracing || dp.unknownTypePolicy == UnknownTypeLog {
+			rawLine = string(line)
+		}
+		metric, event, err := dp.parseLine(line, listenerType)
 		if err != nil {
-			// logging as debug to avoid spamming logs when a bad actor sends
-			// badly formatted messages
-			dp.logBadLineRateLimited(line, ip, err)
+			if err == errUnknownType && dp.unknownTypePolicy == UnknownTypeLog {
+				dp.logger.WithFields(log.Fields{
+					"line":               rawLine,
+					logging.FieldAddress: ip,
+				}).Warn("Dropping line of unknown type")
+			} else {
+				// logging as debug to avoid spamming logs when a bad actor sends
+				// badly formatted messages
+				dp.logBadLineRateLimited(line, ip, err)
+			}
+			dp.lineErrors.add(err, ip)
 			numBad++
 			continue
 		}
 		if metric != nil {
-			numMetrics++
+			if !received.IsZero() {
+				metric.Timestamp = gostatsd.Nanotime(received.UnixNano())
+			}
+			// Redacted before anything else, so a sensitive name is not logged or dispatched.  A dropped metric is
+			// returned to the pool.
+			if !dp.redactor.apply(metric, ip) {
+				metric.Done()
+				continue
+			}
+			if dp.clockSkew != nil && !dp.clockSkew.apply(metric, ip, received) {
+				metric.Done()
+				dp.logBadLineRateLimited(line, ip, errClockSkew)
+				dp.lineErrors.add(errClockSkew, ip)
+				numBad++
+				continue
+			}
 			if dp.ignoreHost {
 				for idx, tag := range metric.Tags {
 					if strings.HasPrefix(tag, "host:") {
@@ -146,33 +393,137 @@ func (dp *DatagramParser) handleDatagram(ctx context.Context, ip gostatsd.IP, ms
 			} else {
 				metric.SourceIP = ip
 			}
+			if dp.maxMetricTTL != 0 {
+				dp.applyTTLTag(metric)
+			}
+			if !dp.sampleRates.apply(metric, ip) {
+				metric.Done()
+				dp.logBadLineRateLimited(line, ip, errSampledCounter)
+				dp.lineErrors.add(errSampledCounter, ip)
+				numBad++
+				continue
+			}
+			dp.gaugeDeltas.apply(metric)
+			if dp.tagLimits != nil {
+				var ok bool
+				if metric.Tags, ok = dp.tagLimits.apply(metric.Tags); !ok {
+					metric.Done()
+					dp.logBadLineRateLimited(line, ip, errTagLimit)
+					dp.lineErrors.add(errTagLimit, ip)
+					numBad++
+					continue
+				}
+			}
+			numMetrics++
+			if listenerTag != "" {
+				metric.Tags = append(metric.Tags, listenerTag)
+			}
+			if tracing && dp.tracer.Matches(metric.Name) {
+				dp.tracer.TraceParsed(rawLine, metric, ip)
+			}
+			if trace != nil {
+				trace.Parsed = time.Now()
+				metric.Trace = trace
+				trace = nil
+			}
+			if pa != nil {
+				pa.add(metric, dp.preAggregateGauges)
+				continue
+			}
 			err = dp.metrics.DispatchMetric(ctx, metric)
 		} else if event != nil {
 			numEvents++
 			event.SourceIP = ip // Always keep the source ip for events
+			if listenerTag != "" {
+				event.Tags = append(event.Tags, listenerTag)
+			}
 			if event.DateHappened == 0 {
 				event.DateHappened = time.Now().Unix()
 			}
 			err = dp.events.DispatchEvent(ctx, event)
 		} else {
 			// Should never happen.
-			log.Panic("Both event and metric are nil")
+			dp.logger.Panic("Both event and metric are nil")
 		}
 		if err != nil {
 			if err == context.Canceled || err == context.DeadlineExceeded {
 				exitError = err
 				break
 			}
-			log.Warnf("Error dispatching metric/event %q from %s: %v", line, ip, err)
+			dp.logger.WithError(err).WithFields(log.Fields{
+				"line":               string(line),
+				logging.FieldAddress: ip,
+			}).Warn("Error dispatching metric/event")
+		}
+	}
+	if pa != nil && exitError == nil {
+		for _, metric := range pa.metrics {
+			if err := dp.metrics.DispatchMetric(ctx, metric); err != nil {
+				if err == context.Canceled || err == context.DeadlineExceeded {
+					exitError = err
+					break
+				}
+				dp.logger.WithError(err).WithFields(log.Fields{
+					logging.FieldBucket:  metric.Name,
+					logging.FieldAddress: ip,
+				}).Warn("Error dispatching metric")
+			}
 		}
 	}
 	return numMetrics, numEvents, numBad, exitError
 }
 
-// parseLine with lexer idpl.
-func (dp *DatagramParser) parseLine(line []byte) (*gostatsd.Metric, *gostatsd.Event, error) {
+// parseLine parses a line received on a listener expecting metrics of listenerType, or any type if it is 0.
+func (dp *DatagramParser) parseLine(line []byte, listenerType gostatsd.MetricType) (*gostatsd.Metric, *gostatsd.Event, error) {
 	l := lexer{
-		metricPool: dp.metricPool,
+		metricPool:   dp.metricPool,
+		maxTTL:       dp.maxMetricTTL,
+		listenerType: listenerType,
+		typePolicy:   dp.typedPortPolicy,
+
+		unknownTypePolicy: dp.unknownTypePolicy,
+		stripContainerID:  dp.stripContainerID,
+		clientTimestamps:  dp.clockSkew != nil,
+		nameWhitespace:    dp.nameWhitespace,
+	}
+	m, e, err := l.run(line, dp.namespace)
+	if l.typeMismatch {
+		atomic.AddUint64(&dp.typeMismatches[listenerType], 1)
+	}
+	if l.unknownType {
+		atomic.AddUint64(&dp.unknownTypes, 1)
+	}
+	return m, e, err
+}
+
+// applyTTLTag removes the reserved ttl tag from m, and sets the TTL of m to its value, capped at the maximum TTL.  The
+// value is a duration such as 30s, or a number of seconds as for |ttl:<seconds>.  An invalid value is ignored, leaving
+// the TTL set by the line, if any.
+func (dp *DatagramParser) applyTTLTag(m *gostatsd.Metric) {
+	for idx, tag := range m.Tags {
+		if !strings.HasPrefix(tag, ttlTagPrefix) {
+			continue
+		}
+		if ttl, ok := parseTTLTag(tag[len(ttlTagPrefix):]); ok {
+			if ttl > dp.maxMetricTTL {
+				ttl = dp.maxMetricTTL
+			}
+			m.TTL = ttl
+		}
+		if len(m.Tags) > 1 {
+			m.Tags = append(m.Tags[:idx], m.Tags[idx+1:]...)
+		} else {
+			m.Tags = nil
+		}
+		return
+	}
+}
+
+// parseTTLTag parses the value of a ttl tag, returning false if it is not a positive duration.
+func parseTTLTag(value string) (time.Duration, bool) {
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, seconds > 0
 	}
-	return l.run(line, dp.namespace)
+	ttl, err := time.ParseDuration(value)
+	return ttl, err == nil && ttl > 0
 }
@@ -3,13 +3,16 @@ package statsd
 import (
 	"context"
 	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
 	"github.com/atlassian/gostatsd/pkg/statser"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"golang.org/x/time/rate"
 )
 
 type metricAndEvent struct {
@@ -21,7 +24,7 @@ const fakeIP = gostatsd.IP("127.0.0.1")
 
 func newTestParser(ignoreHost bool) (*DatagramParser, *countingHandler) {
 	ch := &countingHandler{}
-	return NewDatagramParser(nil, "", ignoreHost, 0, ch, ch, statser.NewNullStatser(), rate.NewLimiter(0, 0)), ch
+	return NewDatagramParser(nil, ch, ch, statser.NewNullStatser(), ParserOptions{IgnoreHost: ignoreHost, MaxMetricTTL: DefaultMaxMetricTTL}), ch
 }
 
 func TestParseEmptyDatagram(t *testing.T) {
@@ -36,7 +39,7 @@ func TestParseEmptyDatagram(t *testing.T) {
 		t.Run(strconv.Itoa(pos), func(t *testing.T) {
 			t.Parallel()
 			mr, ch := newTestParser(false)
-			_, _, _, err := mr.handleDatagram(context.Background(), gostatsd.UnknownIP, inp)
+			_, _, _, err := mr.handleDatagram(context.Background(), gostatsd.UnknownIP, "", 0, inp, time.Time{}, nil)
 			require.NoError(t, err)
 			assert.Zero(t, len(ch.events), ch.events)
 			assert.Zero(t, len(ch.metrics), ch.metrics)
@@ -94,7 +97,7 @@ func TestParseDatagram(t *testing.T) {
 		t.Run(datagram, func(t *testing.T) {
 			t.Parallel()
 			mr, ch := newTestParser(false)
-			_, _, _, err := mr.handleDatagram(context.Background(), fakeIP, []byte(datagram))
+			_, _, _, err := mr.handleDatagram(context.Background(), fakeIP, "", 0, []byte(datagram), time.Time{}, nil)
 			assert.NoError(t, err)
 			for i, e := range ch.events {
 				if e.DateHappened <= 0 {
@@ -163,7 +166,7 @@ func TestParseDatagramIgnoreHost(t *testing.T) {
 		t.Run(datagram, func(t *testing.T) {
 			t.Parallel()
 			mr, ch := newTestParser(true)
-			_, _, _, err := mr.handleDatagram(context.Background(), fakeIP, []byte(datagram))
+			_, _, _, err := mr.handleDatagram(context.Background(), fakeIP, "", 0, []byte(datagram), time.Time{}, nil)
 			assert.NoError(t, err)
 			for i, e := range ch.events {
 				if e.DateHappened <= 0 {
@@ -176,3 +179,172 @@ func TestParseDatagramIgnoreHost(t *testing.T) {
 		})
 	}
 }
+
+func TestParserDiscardsStaleDatagrams(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	in := make(chan []*Datagram)
+	dp := NewDatagramParser(in, ch, ch, statser.NewNullStatser(), ParserOptions{QueuePolicy: ReceiveQueueDropOldest, MaxQueueAge: time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dp.Run(ctx)
+
+	done := make(chan struct{}, 2)
+	in <- []*Datagram{
+		{Msg: []byte("stale:1|c"), Received: time.Now().Add(-time.Minute), DoneFunc: func() { done <- struct{}{} }},
+		{Msg: []byte("fresh:1|c"), Received: time.Now(), DoneFunc: func() { done <- struct{}{} }},
+	}
+	<-done
+	<-done
+	// Send an empty batch so the counters of the first one have been updated once it's accepted.
+	in <- nil
+	cancel()
+
+	assert.EqualValues(t, 1, atomic.LoadUint64(&dp.staleDatagrams))
+	require.Len(t, ch.metrics, 1)
+	assert.Equal(t, "fresh", ch.metrics[0].Name)
+}
+
+func TestParseDatagramReceiveTime(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	dp := NewDatagramParser(nil, ch, ch, statser.NewNullStatser(), ParserOptions{PreAggregate: true, PreAggregateGauges: true})
+
+	received := time.Unix(1000, 500)
+	_, _, _, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte("a:1|c\na:2|c\nb:1|ms"), received, nil)
+	require.NoError(t, err)
+	require.Len(t, ch.metrics, 2)
+	for _, m := range ch.metrics {
+		assert.Equal(t, gostatsd.Nanotime(received.UnixNano()), m.Timestamp, m.Name)
+	}
+
+	// Metrics from a source which doesn't record when they were received have no timestamp.
+	_, _, _, err = dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte("c:1|c"), time.Time{}, nil)
+	require.NoError(t, err)
+	require.Len(t, ch.metrics, 3)
+	assert.Zero(t, ch.metrics[2].Timestamp)
+}
+
+func TestParseDatagramTypedListener(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	dp := NewDatagramParser(nil, ch, ch, statser.NewNullStatser(), ParserOptions{TypedPortPolicy: TypedPortDrop})
+
+	metrics, _, badLines, err := dp.handleDatagram(context.Background(), fakeIP, "", gostatsd.TIMER, []byte("a:1|ms\nb:2|c\nc:3|g"), time.Time{}, nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, metrics)
+	assert.EqualValues(t, 2, badLines)
+	require.Len(t, ch.metrics, 1)
+	assert.Equal(t, "a", ch.metrics[0].Name)
+	assert.EqualValues(t, 2, atomic.LoadUint64(&dp.typeMismatches[gostatsd.TIMER]))
+	assert.EqualValues(t, 2, atomic.LoadUint64(&dp.lineErrors.counts[parseErrorWrongType]))
+
+	// Untyped listeners accept any type.
+	metrics, _, _, err = dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte("b:2|c"), time.Time{}, nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, metrics)
+	assert.EqualValues(t, 2, atomic.LoadUint64(&dp.typeMismatches[gostatsd.TIMER]))
+}
+
+func TestParseDatagramUnknownType(t *testing.T) {
+	t.Parallel()
+	hook := test.NewGlobal()
+	for _, policy := range []string{UnknownTypeDrop, UnknownTypeCounter, UnknownTypeLog} {
+		ch := &countingHandler{}
+		dp := NewDatagramParser(nil, ch, ch, statser.NewNullStatser(), ParserOptions{UnknownTypePolicy: policy})
+
+		metrics, _, badLines, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte("a:1|c\nunknown.type:2|cc"), time.Time{}, nil)
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, atomic.LoadUint64(&dp.unknownTypes), policy, nil)
+		if policy == UnknownTypeCounter {
+			assert.EqualValues(t, 2, metrics)
+			assert.Zero(t, badLines)
+			require.Len(t, ch.metrics, 2)
+			assert.Equal(t, "unknown.type", ch.metrics[1].Name)
+			assert.Equal(t, gostatsd.COUNTER, ch.metrics[1].Type)
+			continue
+		}
+		assert.EqualValues(t, 1, metrics, policy, nil)
+		assert.EqualValues(t, 1, badLines, policy, nil)
+		assert.Len(t, ch.metrics, 1, policy, nil)
+		assert.EqualValues(t, 1, atomic.LoadUint64(&dp.lineErrors.counts[parseErrorUnknownType]), policy, nil)
+	}
+
+	var logged []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Data["line"] == "unknown.type:2|cc" {
+			logged = append(logged, entry.Message+" from "+string(entry.Data[logging.FieldAddress].(gostatsd.IP)))
+		}
+	}
+	// The raw line is only logged as a warning with the log policy, as the bad line limiter allows no logging.
+	assert.Equal(t, []string{"Dropping line of unknown type from 127.0.0.1"}, logged)
+}
+
+func TestParseDatagramTTLTag(t *testing.T) {
+	t.Parallel()
+	input := map[string]gostatsd.Metric{
+		"f:2|c|#ttl:30s":           {Name: "f", Value: 2, Type: gostatsd.COUNTER, Rate: 1, TTL: 30 * time.Second},
+		"f:2|c|#a,ttl:90,b":        {Name: "f", Value: 2, Type: gostatsd.COUNTER, Rate: 1, TTL: 90 * time.Second, Tags: gostatsd.Tags{"a", "b"}},
+		"f:2|g|#ttl:48h":           {Name: "f", Value: 2, Type: gostatsd.GAUGE, Rate: 1, TTL: DefaultMaxMetricTTL},
+		"f:2|g|#ttl:soon":          {Name: "f", Value: 2, Type: gostatsd.GAUGE, Rate: 1},
+		"f:2|g|#ttl:-5s,a":         {Name: "f", Value: 2, Type: gostatsd.GAUGE, Rate: 1, Tags: gostatsd.Tags{"a"}},
+		"f:2|g|#ttl:0|ttl:20":      {Name: "f", Value: 2, Type: gostatsd.GAUGE, Rate: 1, TTL: 20 * time.Second},
+		"f:2|g|#ttl:1m|ttl:20":     {Name: "f", Value: 2, Type: gostatsd.GAUGE, Rate: 1, TTL: time.Minute},
+		"f:joe|s|#x:ttl:1m,ttl:2m": {Name: "f", StringValue: "joe", Type: gostatsd.SET, Rate: 1, TTL: 2 * time.Minute, Tags: gostatsd.Tags{"x:ttl:1m"}},
+	}
+	for datagram, expected := range input {
+		datagram := datagram
+		expected := expected
+		t.Run(datagram, func(t *testing.T) {
+			t.Parallel()
+			mr, ch := newTestParser(true)
+			_, _, badLines, err := mr.handleDatagram(context.Background(), fakeIP, "", 0, []byte(datagram), time.Time{}, nil)
+			require.NoError(t, err)
+			assert.Zero(t, badLines)
+			assert.Equal(t, []gostatsd.Metric{expected}, ch.metrics)
+		})
+	}
+
+	// With the TTL extension disabled the tag is an ordinary tag.
+	ch := &countingHandler{}
+	dp := NewDatagramParser(nil, ch, ch, statser.NewNullStatser(), ParserOptions{IgnoreHost: true})
+	_, _, _, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte("f:2|c|#ttl:30s"), time.Time{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []gostatsd.Metric{{Name: "f", Value: 2, Type: gostatsd.COUNTER, Rate: 1, Tags: gostatsd.Tags{"ttl:30s"}}}, ch.metrics)
+}
+
+func TestTTLTagExpiry(t *testing.T) {
+	t.Parallel()
+	mr, ch := newTestParser(true)
+	_, _, _, err := mr.handleDatagram(context.Background(), fakeIP, "", 0, []byte("short:1|g|#ttl:10s\nlong:1|g"), time.Time{}, nil)
+	require.NoError(t, err)
+
+	ma := newFakeAggregator()
+	start := time.Now()
+	now := start
+	ma.now = func() time.Time { return now }
+	for i := range ch.metrics {
+		ma.Receive(&ch.metrics[i], start)
+	}
+
+	// The metric with a short TTL expires, while the other is kept until the expiry interval.
+	now = start.Add(20 * time.Second)
+	ma.Flush(10 * time.Second)
+	ma.Reset()
+	assert.NotContains(t, ma.Gauges, "short")
+	assert.Contains(t, ma.Gauges, "long")
+}
+
+func TestParseDatagramPipelineTrace(t *testing.T) {
+	t.Parallel()
+	mr, ch := newTestParser(false)
+	trace := &gostatsd.PipelineTrace{Read: time.Now()}
+	_, _, _, err := mr.handleDatagram(context.Background(), fakeIP, "", 0, []byte("_e{1,1}:a|b\nf:1|c\ng:1|c"), time.Time{}, trace)
+	require.NoError(t, err)
+	require.Len(t, ch.metrics, 2)
+	// The trace is passed on with the first metric only.
+	assert.True(t, ch.metrics[0].Trace == trace)
+	assert.Nil(t, ch.metrics[1].Trace)
+	assert.False(t, trace.Parsed.Before(trace.Read))
+}
@@ -0,0 +1,51 @@
+package statsd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// Peaks selects counters and gauges with a name matching a pattern to also be flushed with their highest and lowest
+// values over long windows, such as the most concurrent sessions today.  A nil *Peaks selects nothing.
+type Peaks struct {
+	match gostatsd.StringMatchList
+}
+
+// NewPeaks creates a Peaks which selects counters and gauges with a name matching any of match.
+func NewPeaks(match []string) *Peaks {
+	return &Peaks{
+		match: toStringMatch(match),
+	}
+}
+
+// Matches returns true if the metric name has its peaks flushed.
+func (p *Peaks) Matches(name string) bool {
+	return p != nil && p.match.MatchAny(name)
+}
+
+// ParsePeakWindows parses a list of windows to track peaks over, such as `1h 24h`, where each item may also be a
+// comma separated list.  Each window must be a whole number of seconds, and appear once.
+func ParsePeakWindows(values []string) ([]time.Duration, error) {
+	var windows []time.Duration
+	seen := map[time.Duration]bool{}
+	for _, value := range values {
+		for _, field := range strings.FieldsFunc(value, isListSeparator) {
+			window, err := time.ParseDuration(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s value %q: %v", ParamPeakWindows, field, err)
+			}
+			if window <= 0 || window%time.Second != 0 {
+				return nil, fmt.Errorf("invalid %s value %q: must be a positive whole number of seconds", ParamPeakWindows, field)
+			}
+			if seen[window] {
+				return nil, fmt.Errorf("invalid %s value %q: repeated", ParamPeakWindows, field)
+			}
+			seen[window] = true
+			windows = append(windows, window)
+		}
+	}
+	return windows, nil
+}
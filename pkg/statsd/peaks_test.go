@@ -0,0 +1,36 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeaksMatches(t *testing.T) {
+	t.Parallel()
+	p := NewPeaks([]string{"sessions.*", "logins"})
+	assert.True(t, p.Matches("sessions.web"))
+	assert.True(t, p.Matches("logins"))
+	assert.False(t, p.Matches("logins.failed"))
+
+	var nilPeaks *Peaks
+	assert.False(t, nilPeaks.Matches("sessions.web"))
+}
+
+func TestParsePeakWindows(t *testing.T) {
+	t.Parallel()
+	windows, err := ParsePeakWindows([]string{"1h,24h", "30m"})
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{time.Hour, 24 * time.Hour, 30 * time.Minute}, windows)
+
+	windows, err = ParsePeakWindows(nil)
+	require.NoError(t, err)
+	assert.Empty(t, windows)
+
+	for _, invalid := range []string{"1x", "0s", "-1h", "1500ms", "1h 60m"} {
+		_, err := ParsePeakWindows([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
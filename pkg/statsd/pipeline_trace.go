@@ -0,0 +1,30 @@
+package statsd
+
+import (
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+)
+
+// maxPipelineTraces is the maximum number of traces an aggregator holds until the next flush, further traces are
+// discarded.
+const maxPipelineTraces = 1000
+
+// emitPipelineTrace emits the time t spent in each stage of the pipeline, until it was included in the flush at
+// flushed.  Stages which were not recorded are skipped.
+func emitPipelineTrace(s statser.Statser, t *gostatsd.PipelineTrace, flushed time.Time) {
+	emitPipelineStage(s, "pipeline.parse_us", t.Read, t.Parsed)
+	emitPipelineStage(s, "pipeline.dispatch_us", t.Parsed, t.Enqueued)
+	emitPipelineStage(s, "pipeline.queue_us", t.Enqueued, t.Applied)
+	emitPipelineStage(s, "pipeline.flush_wait_us", t.Applied, flushed)
+	emitPipelineStage(s, "pipeline.total_us", t.Read, flushed)
+}
+
+// emitPipelineStage emits the time between from and to in microseconds, unless either is the zero time.
+func emitPipelineStage(s statser.Statser, name string, from, to time.Time) {
+	if from.IsZero() || to.IsZero() {
+		return
+	}
+	s.TimingMS(name, float64(to.Sub(from))/float64(time.Microsecond), nil)
+}
@@ -0,0 +1,81 @@
+package statsd
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// timingStatser keeps the values of each timer by name.
+type timingStatser struct {
+	statser.Statser
+	mu      sync.Mutex
+	timings map[string][]float64
+}
+
+func newTimingStatser() *timingStatser {
+	return &timingStatser{Statser: statser.NewNullStatser(), timings: map[string][]float64{}}
+}
+
+func (ts *timingStatser) TimingMS(name string, ms float64, tags gostatsd.Tags) {
+	ts.mu.Lock()
+	ts.timings[name] = append(ts.timings[name], ms)
+	ts.mu.Unlock()
+}
+
+func TestEmitPipelineTrace(t *testing.T) {
+	t.Parallel()
+	read := time.Unix(1000, 0)
+	trace := &gostatsd.PipelineTrace{
+		Read:     read,
+		Parsed:   read.Add(10 * time.Microsecond),
+		Enqueued: read.Add(15 * time.Microsecond),
+		Applied:  read.Add(115 * time.Microsecond),
+	}
+	ts := newTimingStatser()
+	emitPipelineTrace(ts, trace, read.Add(time.Second))
+	assert.Equal(t, map[string][]float64{
+		"pipeline.parse_us":      {10},
+		"pipeline.dispatch_us":   {5},
+		"pipeline.queue_us":      {100},
+		"pipeline.flush_wait_us": {999885},
+		"pipeline.total_us":      {1000000},
+	}, ts.timings)
+
+	// Stages which were not recorded are skipped.
+	trace.Enqueued = time.Time{}
+	ts = newTimingStatser()
+	emitPipelineTrace(ts, trace, read.Add(time.Second))
+	assert.Len(t, ts.timings, 3)
+	assert.NotContains(t, ts.timings, "pipeline.dispatch_us")
+	assert.NotContains(t, ts.timings, "pipeline.queue_us")
+}
+
+func TestAggregatorPipelineTrace(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ts := newTimingStatser()
+	ma.statser = ts
+
+	now := time.Now()
+	trace := &gostatsd.PipelineTrace{Read: now, Parsed: now, Enqueued: now}
+	ma.Receive(&gostatsd.Metric{Name: "traced", Value: 1, Type: gostatsd.COUNTER, Rate: 1, Trace: trace}, now)
+	ma.Receive(&gostatsd.Metric{Name: "untraced", Value: 1, Type: gostatsd.COUNTER, Rate: 1}, now)
+	assert.Equal(t, now, trace.Applied)
+
+	ma.Flush(time.Second)
+	for _, name := range []string{"pipeline.parse_us", "pipeline.dispatch_us", "pipeline.queue_us", "pipeline.flush_wait_us", "pipeline.total_us"} {
+		require.Len(t, ts.timings[name], 1, name)
+	}
+
+	// Each trace is emitted once.
+	ma.Reset()
+	ma.Flush(time.Second)
+	assert.Len(t, ts.timings["pipeline.total_us"], 1)
+}
@@ -0,0 +1,102 @@
+package statsd
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	stats "github.com/atlassian/gostatsd/pkg/statser"
+)
+
+const (
+	// ReceiveQueueDropNewest blocks the receivers when the parsers can't keep up, leaving the kernel to drop
+	// the newest datagrams once the socket buffer is full.
+	ReceiveQueueDropNewest = "drop-newest"
+	// ReceiveQueueDropOldest buffers datagram batches in a ring buffer, discarding the oldest batch when full.
+	ReceiveQueueDropOldest = "drop-oldest"
+)
+
+// DatagramRing is a bounded queue of datagram batches between the receivers and the parsers.  When the
+// ring is full, the oldest batch is discarded to make room for the newest one, as it is the most stale.
+type DatagramRing struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	datagramsDropped uint64
+
+	buf   [][]*Datagram
+	head  int // Index of the oldest batch in buf
+	count int // Number of batches in buf
+
+	in  chan []*Datagram   // Input chan of datagram batches from the receivers
+	out chan<- []*Datagram // Output chan of datagram batches to the parsers
+}
+
+// NewDatagramRing initialises a new DatagramRing holding up to size batches.
+func NewDatagramRing(out chan<- []*Datagram, size int) *DatagramRing {
+	if size < 1 {
+		size = 1
+	}
+	return &DatagramRing{
+		buf: make([][]*Datagram, size),
+		in:  make(chan []*Datagram),
+		out: out,
+	}
+}
+
+// In returns the chan which receivers should send datagram batches to.
+func (dr *DatagramRing) In() chan<- []*Datagram {
+	return dr.in
+}
+
+// Run moves batches from the receivers to the parsers until the context is closed.
+func (dr *DatagramRing) Run(ctx context.Context) {
+	for {
+		var out chan<- []*Datagram
+		var next []*Datagram
+		if dr.count > 0 {
+			out = dr.out
+			next = dr.buf[dr.head]
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case dgs := <-dr.in:
+			dr.push(dgs)
+		case out <- next:
+			dr.buf[dr.head] = nil
+			dr.head = (dr.head + 1) % len(dr.buf)
+			dr.count--
+		}
+	}
+}
+
+func (dr *DatagramRing) push(dgs []*Datagram) {
+	if dr.count == len(dr.buf) {
+		oldest := dr.buf[dr.head]
+		for _, dg := range oldest {
+			dg.DoneFunc()
+		}
+		atomic.AddUint64(&dr.datagramsDropped, uint64(len(oldest)))
+		dr.head = (dr.head + 1) % len(dr.buf)
+		dr.count--
+	}
+	dr.buf[(dr.head+dr.count)%len(dr.buf)] = dgs
+	dr.count++
+}
+
+// RunMetrics emits the number of dropped datagrams on each flush.  Stops when the context is closed.
+func (dr *DatagramRing) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	tags := gostatsd.Tags{"policy:" + ReceiveQueueDropOldest, "reason:queue_full"}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("receiver.datagrams_dropped", float64(atomic.LoadUint64(&dr.datagramsDropped)), tags)
+		}
+	}
+}
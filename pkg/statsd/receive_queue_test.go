@@ -0,0 +1,66 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBatch(msg string, done *int) []*Datagram {
+	return []*Datagram{{
+		Msg:      []byte(msg),
+		Received: time.Now(),
+		DoneFunc: func() { *done++ },
+	}}
+}
+
+func TestDatagramRingDropsOldest(t *testing.T) {
+	t.Parallel()
+	out := make(chan []*Datagram)
+	ring := NewDatagramRing(out, 2)
+
+	done := 0
+	ring.push(newTestBatch("a", &done))
+	ring.push(newTestBatch("b", &done))
+	ring.push(newTestBatch("c", &done))
+
+	assert.Equal(t, 1, done)
+	assert.EqualValues(t, 1, ring.datagramsDropped)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ring.Run(ctx)
+
+	for _, expected := range []string{"b", "c"} {
+		select {
+		case dgs := <-out:
+			require.Len(t, dgs, 1)
+			assert.Equal(t, expected, string(dgs[0].Msg))
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s", expected)
+		}
+	}
+}
+
+func TestDatagramRingPassesThrough(t *testing.T) {
+	t.Parallel()
+	out := make(chan []*Datagram)
+	ring := NewDatagramRing(out, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ring.Run(ctx)
+
+	done := 0
+	ring.In() <- newTestBatch("a", &done)
+	select {
+	case dgs := <-out:
+		assert.Equal(t, "a", string(dgs[0].Msg))
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	assert.Zero(t, done)
+}
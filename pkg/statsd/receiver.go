@@ -2,11 +2,15 @@ package statsd
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/fakesocket"
+	"github.com/atlassian/gostatsd/pkg/logging"
 	"github.com/atlassian/gostatsd/pkg/pool"
 	stats "github.com/atlassian/gostatsd/pkg/statser"
 
@@ -17,28 +21,66 @@ import (
 // In practice it is highly unlikely but still possible to get packets bigger than usual MTU of 1500.
 const packetSizeUDP = 0xffff
 
+const (
+	// TypedPortCoerce changes the type of metrics received on a typed port to the type of the port.
+	TypedPortCoerce = "coerce"
+	// TypedPortDrop drops metrics received on a typed port which are not of the type of the port.
+	TypedPortDrop = "drop"
+	// TypedPortAccept keeps metrics received on a typed port which are not of the type of the port unchanged.
+	TypedPortAccept = "accept"
+)
+
+// listenerCounters counts the datagrams received on a listener.
+type listenerCounters struct {
+	datagramsReceived uint64 // Must be read/written only using atomic instructions.
+
+	tags gostatsd.Tags // Tags identifying the listener in internal metrics
+}
+
 // DatagramReceiver receives datagrams on its PacketConn and passes them off to be parsed
 type DatagramReceiver struct {
 	// Counter fields below must be read/written only using atomic instructions.
 	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
 	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
-	datagramsReceived      uint64
-	batchesRead            uint64
-	cumulDatagramsReceived uint64
+	datagramsReceived       uint64
+	batchesRead             uint64
+	cumulDatagramsReceived  uint64
+	datagramsBlocked        uint64
+	cumulDatagramsBlocked   uint64
+	datagramsDuplicate      uint64
+	cumulDatagramsDuplicate uint64
 
 	bufPool *pool.DatagramBufferPool
 
 	receiveBatchSize int // The number of datagrams to read in each batch
 
+	blocklist *SourceBlocklist      // Datagrams from these sources are dropped, may be nil
+	dedup     *DatagramDeduplicator // Duplicate datagrams are dropped, may be nil
+
+	mu        sync.Mutex
+	listeners map[string]*listenerCounters // By listener address
+
+	pipelineTraceRate int // One in this many datagrams is traced through the pipeline, 0 to disable
+
+	logger log.FieldLogger
+
 	out chan<- []*Datagram // Output chan of read datagram batches
 }
 
-// NewDatagramReceiver initialises a new DatagramReceiver.
-func NewDatagramReceiver(out chan<- []*Datagram, receiveBatchSize int) *DatagramReceiver {
+// NewDatagramReceiver initialises a new DatagramReceiver.  blocklist and dedup may be nil.  One in pipelineTraceRate
+// datagrams read by each reader is traced through the pipeline, or none if it is 0.
+func NewDatagramReceiver(out chan<- []*Datagram, receiveBatchSize int, blocklist *SourceBlocklist, dedup *DatagramDeduplicator, pipelineTraceRate int) *DatagramReceiver {
 	return &DatagramReceiver{
 		out:              out,
 		receiveBatchSize: receiveBatchSize,
+		blocklist:        blocklist,
+		dedup:            dedup,
 		bufPool:          pool.NewDatagramBufferPool(packetSizeUDP),
+		listeners:        map[string]*listenerCounters{},
+
+		pipelineTraceRate: pipelineTraceRate,
+
+		logger: logging.Component("receiver"),
 	}
 }
 
@@ -54,6 +96,8 @@ func (dr *DatagramReceiver) RunMetrics(ctx context.Context, statser stats.Statse
 			datagramsReceived := atomic.SwapUint64(&dr.datagramsReceived, 0)
 			batchesRead := atomic.SwapUint64(&dr.batchesRead, 0)
 			dr.cumulDatagramsReceived += datagramsReceived
+			dr.cumulDatagramsBlocked += atomic.SwapUint64(&dr.datagramsBlocked, 0)
+			dr.cumulDatagramsDuplicate += atomic.SwapUint64(&dr.datagramsDuplicate, 0)
 			var avgDatagramsInBatch float64
 			if batchesRead == 0 {
 				avgDatagramsInBatch = 0
@@ -62,12 +106,36 @@ func (dr *DatagramReceiver) RunMetrics(ctx context.Context, statser stats.Statse
 			}
 			statser.Gauge("receiver.datagrams_received", float64(dr.cumulDatagramsReceived), nil)
 			statser.Gauge("receiver.avg_datagrams_in_batch", avgDatagramsInBatch, nil)
+			statser.Gauge("receiver.datagrams_blocked", float64(dr.cumulDatagramsBlocked), nil)
+			if dr.dedup != nil {
+				statser.Gauge("receiver.datagrams_duplicate", float64(dr.cumulDatagramsDuplicate), nil)
+			}
+			dr.mu.Lock()
+			for _, lc := range dr.listeners {
+				statser.Gauge("receiver.listener_datagrams_received", float64(atomic.LoadUint64(&lc.datagramsReceived)), lc.tags)
+			}
+			dr.mu.Unlock()
 		}
 	}
 }
 
 // Receive accepts incoming datagrams on c, and passes them off to be parsed
 func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
+	dr.ReceiveListener(ctx, c, "")
+}
+
+// ReceiveListener accepts incoming datagrams on c, and passes them off to be parsed with listenerTag
+// added to every metric and event.  listenerTag may be empty.
+func (dr *DatagramReceiver) ReceiveListener(ctx context.Context, c net.PacketConn, listenerTag string) {
+	dr.ReceiveTypedListener(ctx, c, "", listenerTag, 0)
+}
+
+// ReceiveTypedListener accepts incoming datagrams on c, which listens on addr, and passes them off to be parsed
+// with listenerTag added to every metric and event, and metrics not of listenerType handled per the typed port
+// policy.  listenerTag may be empty, and listenerType may be 0 to accept any type.  Datagrams are counted per addr
+// unless it is empty.
+func (dr *DatagramReceiver) ReceiveTypedListener(ctx context.Context, c net.PacketConn, addr, listenerTag string, listenerType gostatsd.MetricType) {
+	counters := dr.listenerCounters(addr, listenerType)
 	br := NewBatchReader(c)
 	messages := make([]Message, dr.receiveBatchSize)
 	retBuffers := make([]*[][]byte, dr.receiveBatchSize)
@@ -76,6 +144,8 @@ func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
 		retBuffers[i] = dr.bufPool.Get()
 		messages[i].Buffers = *retBuffers[i]
 	}
+	traceRate := dr.pipelineTraceRate
+	untilTrace := traceRate // Datagrams to read before the next one is traced
 	for {
 
 		datagramCount, err := br.ReadBatch(messages)
@@ -86,33 +156,68 @@ func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
 			default:
 			}
 			if err != fakesocket.ErrClosedConnection {
-				log.Warnf("Error reading from socket: %v", err)
+				dr.logger.WithError(err).WithField(logging.FieldAddress, c.LocalAddr().String()).Warn("Error reading from socket")
 			}
 			continue
 		}
 
 		atomic.AddUint64(&dr.datagramsReceived, uint64(datagramCount))
 		atomic.AddUint64(&dr.batchesRead, 1)
+		if counters != nil {
+			atomic.AddUint64(&counters.datagramsReceived, uint64(datagramCount))
+		}
 
-		dgs := make([]*Datagram, datagramCount)
+		now := time.Now()
+		dgs := make([]*Datagram, 0, datagramCount)
+		blocked, duplicates := 0, 0
 		for i := 0; i < datagramCount; i++ {
 			addr := messages[i].Addr
+			if dr.isBlocked(addr) {
+				// The buffer is left in place to be read in to again.
+				blocked++
+				continue
+			}
 			nbytes := messages[i].N
 			buf := messages[i].Buffers[0][:nbytes]
+			if dr.isDuplicate(addr, buf, now) {
+				duplicates++
+				continue
+			}
 
 			retBuf := retBuffers[i]
 			doneFn := func() {
 				dr.bufPool.Put(retBuf)
 			}
 
-			dgs[i] = &Datagram{
-				IP:       getIP(addr),
-				Msg:      buf,
-				DoneFunc: doneFn,
+			dg := &Datagram{
+				IP:          dr.getIP(addr),
+				Msg:         buf,
+				Received:    now,
+				ListenerTag: listenerTag,
+				DoneFunc:    doneFn,
+
+				ListenerType: listenerType,
+			}
+			if traceRate != 0 {
+				untilTrace--
+				if untilTrace == 0 {
+					untilTrace = traceRate
+					dg.Trace = &gostatsd.PipelineTrace{Read: now}
+				}
 			}
+			dgs = append(dgs, dg)
 			retBuffers[i] = dr.bufPool.Get()
 			messages[i].Buffers = *retBuffers[i]
 		}
+		if blocked > 0 {
+			atomic.AddUint64(&dr.datagramsBlocked, uint64(blocked))
+		}
+		if duplicates > 0 {
+			atomic.AddUint64(&dr.datagramsDuplicate, uint64(duplicates))
+		}
+		if len(dgs) == 0 {
+			continue
+		}
 		select {
 		case dr.out <- dgs:
 			// success
@@ -122,10 +227,45 @@ func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
 	}
 }
 
-func getIP(addr net.Addr) gostatsd.IP {
+// listenerCounters returns the counters of the listener on addr, shared by every reader of it, or nil if addr is
+// empty.
+func (dr *DatagramReceiver) listenerCounters(addr string, listenerType gostatsd.MetricType) *listenerCounters {
+	if addr == "" {
+		return nil
+	}
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	lc := dr.listeners[addr]
+	if lc == nil {
+		lc = &listenerCounters{tags: gostatsd.Tags{"listener:" + addr}}
+		if listenerType != 0 {
+			lc.tags = append(lc.tags, "listener_type:"+listenerType.String())
+		}
+		dr.listeners[addr] = lc
+	}
+	return lc
+}
+
+func (dr *DatagramReceiver) isBlocked(addr net.Addr) bool {
+	if dr.blocklist == nil {
+		return false
+	}
+	a, ok := addr.(*net.UDPAddr)
+	return ok && dr.blocklist.Blocked(a.IP)
+}
+
+func (dr *DatagramReceiver) isDuplicate(addr net.Addr, msg []byte, now time.Time) bool {
+	if dr.dedup == nil {
+		return false
+	}
+	a, ok := addr.(*net.UDPAddr)
+	return ok && dr.dedup.Duplicate(a, msg, now)
+}
+
+func (dr *DatagramReceiver) getIP(addr net.Addr) gostatsd.IP {
 	if a, ok := addr.(*net.UDPAddr); ok {
 		return gostatsd.IP(a.IP.String())
 	}
-	log.Errorf("Cannot get source address %q of type %T", addr, addr)
+	dr.logger.WithField(logging.FieldAddress, fmt.Sprint(addr)).Errorf("Cannot get source address of type %T", addr)
 	return gostatsd.UnknownIP
 }
@@ -4,9 +4,11 @@ import (
 	"context"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/fakesocket"
 	"github.com/magiconair/properties/assert"
 	"github.com/stretchr/testify/require"
@@ -19,7 +21,7 @@ func BenchmarkReceive(b *testing.B) {
 	//
 	// ... so this is pretty arbitrary.
 	ch := make(chan []*Datagram, 5000)
-	mr := NewDatagramReceiver(ch, DefaultReceiveBatchSize)
+	mr := NewDatagramReceiver(ch, DefaultReceiveBatchSize, nil, nil, 0)
 	c, done := fakesocket.NewCountedFakePacketConn(uint64(b.N))
 
 	var wg sync.WaitGroup
@@ -65,7 +67,7 @@ func BenchmarkReceive(b *testing.B) {
 
 func TestDatagramReceiver_Receive(t *testing.T) {
 	ch := make(chan []*Datagram, 1)
-	mr := NewDatagramReceiver(ch, 2)
+	mr := NewDatagramReceiver(ch, 2, nil, nil, 0)
 	c := fakesocket.NewFakePacketConn()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -87,3 +89,57 @@ func TestDatagramReceiver_Receive(t *testing.T) {
 	assert.Equal(t, string(dg.IP), fakesocket.FakeAddr.IP.String())
 	assert.Equal(t, dg.Msg, fakesocket.FakeMetric)
 }
+
+func TestDatagramReceiver_ReceiveTypedListener(t *testing.T) {
+	ch := make(chan []*Datagram, 1)
+	mr := NewDatagramReceiver(ch, 2, nil, nil, 0)
+	c := fakesocket.NewFakePacketConn()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go mr.ReceiveTypedListener(ctx, c, "127.0.0.1:8126", "", gostatsd.COUNTER)
+
+	var dgs []*Datagram
+	select {
+	case dgs = <-ch:
+	case <-time.After(time.Second):
+		t.Errorf("Timeout, failed to read datagram")
+	}
+
+	cancel()
+
+	require.Len(t, dgs, 1)
+	assert.Equal(t, dgs[0].ListenerType, gostatsd.COUNTER)
+
+	lc := mr.listenerCounters("127.0.0.1:8126", gostatsd.COUNTER)
+	assert.Equal(t, lc.tags, gostatsd.Tags{"listener:127.0.0.1:8126", "listener_type:counter"})
+	require.True(t, atomic.LoadUint64(&lc.datagramsReceived) >= 1)
+	require.Nil(t, mr.listenerCounters("", 0))
+}
+
+func TestDatagramReceiver_PipelineTrace(t *testing.T) {
+	ch := make(chan []*Datagram, 1)
+	mr := NewDatagramReceiver(ch, 1, nil, nil, 2)
+	c := fakesocket.NewFakePacketConn()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go mr.Receive(ctx, c)
+
+	var traced []bool
+	for len(traced) < 4 {
+		select {
+		case dgs := <-ch:
+			for _, dg := range dgs {
+				traced = append(traced, dg.Trace != nil)
+				if dg.Trace != nil {
+					require.Equal(t, dg.Received, dg.Trace.Read)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout, failed to read datagram")
+		}
+	}
+	require.Equal(t, []bool{false, true, false, true}, traced[:4])
+}
@@ -0,0 +1,174 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// DefaultRecentLines is the default number of matching lines returned by the recent command.
+const DefaultRecentLines = 100
+
+// recentLineOverhead is the approximate memory used by a buffered line in addition to the line and its source.
+const recentLineOverhead = 64
+
+// recentLine is a raw line held by RecentLines.
+type recentLine struct {
+	line     []byte
+	source   gostatsd.IP
+	received time.Time
+	every    uint64 // The line was one of every this many lines offered
+}
+
+func (rl *recentLine) size() int64 {
+	return int64(len(rl.line)+len(rl.source)) + recentLineOverhead
+}
+
+// RecentLines holds the most recent raw lines received, with their source and the time they were received, in a ring
+// buffer using at most maxBytes.  When more bytes are offered each second than the buffer holds, only one of every so
+// many lines is kept, so the buffer always covers at least the last second or so of traffic rather than a burst from
+// one client.
+type RecentLines struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	offered      uint64 // Lines offered
+	offeredBytes uint64 // Bytes offered since the sampling rate was last adjusted
+	every        uint64 // Keep one of every this many lines offered
+
+	maxBytes int64
+	now      func() time.Time
+
+	mu       sync.Mutex
+	entries  []recentLine // Oldest first, from head
+	head     int
+	bytes    int64
+	adjusted time.Time // When the sampling rate was last adjusted
+}
+
+// NewRecentLines creates a RecentLines using at most maxBytes.
+func NewRecentLines(maxBytes int64) *RecentLines {
+	return &RecentLines{
+		every:    1,
+		maxBytes: maxBytes,
+		now:      time.Now,
+	}
+}
+
+// Add buffers a copy of line, received from source, if it is sampled.  It is safe to call concurrently.
+func (rl *RecentLines) Add(line []byte, source gostatsd.IP) {
+	atomic.AddUint64(&rl.offeredBytes, uint64(len(line)))
+	n := atomic.AddUint64(&rl.offered, 1)
+	every := atomic.LoadUint64(&rl.every)
+	if n%every != 0 {
+		return
+	}
+	entry := recentLine{
+		line:   append([]byte(nil), line...),
+		source: source,
+		every:  every,
+	}
+	if entry.size() > rl.maxBytes {
+		return
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	entry.received = rl.now()
+	rl.adjustSampling(entry.received)
+	for rl.bytes+entry.size() > rl.maxBytes {
+		rl.bytes -= rl.entries[rl.head].size()
+		rl.entries[rl.head] = recentLine{}
+		rl.head++
+	}
+	if rl.head > len(rl.entries)/2 {
+		rl.entries = append(rl.entries[:0], rl.entries[rl.head:]...)
+		rl.head = 0
+	}
+	rl.entries = append(rl.entries, entry)
+	rl.bytes += entry.size()
+}
+
+// adjustSampling sets the sampling rate, at most once a second, to keep one line in however many the buffer would
+// have to hold to keep a second of traffic.  Must be called with the lock held.
+func (rl *RecentLines) adjustSampling(now time.Time) {
+	elapsed := now.Sub(rl.adjusted)
+	if elapsed < time.Second {
+		return
+	}
+	perSecond := float64(atomic.SwapUint64(&rl.offeredBytes, 0))
+	if !rl.adjusted.IsZero() {
+		perSecond /= elapsed.Seconds()
+	}
+	rl.adjusted = now
+	every := uint64(1)
+	if budget := float64(rl.maxBytes); perSecond > budget {
+		every = uint64(perSecond/budget) + 1
+	}
+	atomic.StoreUint64(&rl.every, every)
+}
+
+// matching returns up to n of the most recent lines whose bucket matches glob, oldest first.
+func (rl *RecentLines) matching(glob string, n int) ([]recentLine, error) {
+	if _, err := path.Match(glob, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %v", glob, err)
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	var matched []recentLine
+	for i := len(rl.entries) - 1; i >= rl.head && len(matched) < n; i-- {
+		bucket := rl.entries[i].line
+		if idx := bytes.IndexByte(bucket, ':'); idx >= 0 {
+			bucket = bucket[:idx]
+		}
+		if ok, _ := path.Match(glob, string(bucket)); ok {
+			matched = append(matched, rl.entries[i])
+		}
+	}
+	for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+		matched[i], matched[j] = matched[j], matched[i]
+	}
+	return matched, nil
+}
+
+// RecentCommand is the console command to show recent lines, taking the arguments <glob> [<n>].
+func (rl *RecentLines) RecentCommand(ctx context.Context, args []string, w io.Writer) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: recent <glob> [<n>]")
+	}
+	n := DefaultRecentLines
+	if len(args) == 2 {
+		var err error
+		n, err = strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid number of lines %q", args[1])
+		}
+	}
+	matched, err := rl.matching(args[0], n)
+	if err != nil {
+		return err
+	}
+	rl.mu.Lock()
+	buffered, used := len(rl.entries)-rl.head, rl.bytes
+	rl.mu.Unlock()
+	if _, err := fmt.Fprintf(w, "# %d lines buffered using %d/%d bytes, sampling 1 in %d\n",
+		buffered, used, rl.maxBytes, atomic.LoadUint64(&rl.every)); err != nil {
+		return err
+	}
+	for _, entry := range matched {
+		if _, err := fmt.Fprintf(w, "%s %s 1/%d %s\n",
+			entry.received.Format(time.RFC3339Nano), entry.source, entry.every, entry.line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
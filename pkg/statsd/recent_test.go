@@ -0,0 +1,108 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecentLinesMatchesGlob(t *testing.T) {
+	t.Parallel()
+	rl := NewRecentLines(1024)
+	received := time.Unix(1500000000, 0).UTC()
+	rl.now = func() time.Time { return received }
+
+	rl.Add([]byte("foo.bar:1|c"), "127.0.0.1")
+	rl.Add([]byte("bar.foo:1|c"), "127.0.0.2")
+	rl.Add([]byte("foo.baz:2|g|#tag"), "127.0.0.3")
+
+	var buf bytes.Buffer
+	require.NoError(t, rl.RecentCommand(context.Background(), []string{"foo.*"}, &buf))
+	assert.Equal(t, "# 3 lines buffered using 257/1024 bytes, sampling 1 in 1\n"+
+		"2017-07-14T02:40:00Z 127.0.0.1 1/1 foo.bar:1|c\n"+
+		"2017-07-14T02:40:00Z 127.0.0.3 1/1 foo.baz:2|g|#tag\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, rl.RecentCommand(context.Background(), []string{"*", "1"}, &buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[1], "foo.baz:2|g|#tag")
+
+	assert.Error(t, rl.RecentCommand(context.Background(), nil, &buf))
+	assert.Error(t, rl.RecentCommand(context.Background(), []string{"*", "0"}, &buf))
+	assert.Error(t, rl.RecentCommand(context.Background(), []string{"["}, &buf))
+}
+
+func TestRecentLinesCopiesLine(t *testing.T) {
+	t.Parallel()
+	rl := NewRecentLines(1024)
+	line := []byte("foo.bar:1|c")
+	rl.Add(line, "127.0.0.1")
+	copy(line, "xxx")
+
+	matched, err := rl.matching("*", 10)
+	require.NoError(t, err)
+	require.Len(t, matched, 1)
+	assert.Equal(t, "foo.bar:1|c", string(matched[0].line))
+}
+
+func TestRecentLinesMemoryCap(t *testing.T) {
+	t.Parallel()
+	line := []byte("foo.bar:1|c")
+	entrySize := int64(len(line)) + recentLineOverhead
+	rl := NewRecentLines(3 * entrySize)
+
+	for i := 0; i < 10; i++ {
+		rl.Add(line, "")
+		assert.True(t, rl.bytes <= rl.maxBytes)
+	}
+	matched, err := rl.matching("*", 10)
+	require.NoError(t, err)
+	assert.Len(t, matched, 3)
+
+	// A line which could never fit is not kept.
+	NewRecentLines(10).Add(line, "")
+}
+
+func TestRecentLinesSamples(t *testing.T) {
+	t.Parallel()
+	line := []byte("foo.bar:1|c")
+	rl := NewRecentLines(100)
+	now := time.Unix(1500000000, 0)
+	rl.now = func() time.Time { return now }
+
+	// 1100 bytes in the first second is 11 times what the buffer holds.
+	for i := 0; i < 100; i++ {
+		rl.Add(line, "")
+	}
+	now = now.Add(time.Second)
+	rl.Add(line, "")
+	assert.EqualValues(t, 12, rl.every)
+
+	matched, err := rl.matching("*", 10)
+	require.NoError(t, err)
+	require.Len(t, matched, 1)
+
+	// Lines are then only kept one in every 12.
+	offered := rl.offered
+	for i := 0; i < 24; i++ {
+		rl.Add(line, "")
+	}
+	assert.EqualValues(t, offered+24, rl.offered)
+	matched, err = rl.matching("*", 10)
+	require.NoError(t, err)
+	require.Len(t, matched, 1)
+	assert.EqualValues(t, 12, matched[0].every)
+
+	// And return to keeping every line once traffic drops, when the next sampled line is kept.
+	now = now.Add(10 * time.Second)
+	for i := 0; i < 12; i++ {
+		rl.Add(line, "")
+	}
+	assert.EqualValues(t, 1, rl.every)
+}
@@ -0,0 +1,231 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// RedactReplace replaces the part of a name or tag value matching a redaction rule with the placeholder.
+	RedactReplace = "replace"
+	// RedactDrop drops metrics whose name or a tag value matches a redaction rule.
+	RedactDrop = "drop"
+
+	// DefaultRedactPlaceholder is the default text which replaces the part of a name or tag value which matched.
+	DefaultRedactPlaceholder = "REDACTED"
+)
+
+// RedactRule is a pattern which must not leave the process in the name or a tag value of a metric.
+type RedactRule struct {
+	Name        string
+	Pattern     string
+	Action      string // One of the Redact* values
+	Placeholder string // Replaces the match if Action is RedactReplace
+}
+
+// redactRule is a compiled RedactRule.
+type redactRule struct {
+	matched uint64 // Metrics which matched, must be read/written only using atomic instructions.
+
+	RedactRule
+	re *regexp.Regexp
+	// literal is a string every match contains, which is checked before the regular expression, or empty if there
+	// is none.
+	literal string
+}
+
+// matches returns true if the rule matches s.
+func (r *redactRule) matches(s string) bool {
+	if r.literal != "" && !strings.Contains(s, r.literal) {
+		return false
+	}
+	return r.re.MatchString(s)
+}
+
+// Redactor drops metrics, or replaces the part of their name and tag values, which match patterns that must not leave
+// the process, such as email addresses.  A nil *Redactor redacts nothing.
+type Redactor struct {
+	rules      []*redactRule
+	logLimiter *rate.Limiter
+	logger     log.FieldLogger
+}
+
+// NewRedactorFromViper returns a Redactor for the rules listed in the redactions key, each defined in its own
+// redaction.<name> block, or nil if there are none.
+func NewRedactorFromViper(v *viper.Viper, logger log.FieldLogger) (*Redactor, error) {
+	var rules []RedactRule
+	for _, name := range v.GetStringSlice("redactions") {
+		vRule := v.Sub("redaction." + name)
+		if vRule == nil {
+			return nil, fmt.Errorf("redaction rule doesn't exist: %v", name)
+		}
+		vRule.SetDefault("action", RedactReplace)
+		vRule.SetDefault("placeholder", DefaultRedactPlaceholder)
+		rules = append(rules, RedactRule{
+			Name:        name,
+			Pattern:     vRule.GetString("pattern"),
+			Action:      vRule.GetString("action"),
+			Placeholder: vRule.GetString("placeholder"),
+		})
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	return NewRedactor(rules, logger)
+}
+
+// NewRedactor compiles the rules, which are tried in order, logging the metrics they match to logger.
+func NewRedactor(rules []RedactRule, logger log.FieldLogger) (*Redactor, error) {
+	r := &Redactor{
+		// Allow a burst of logs, then at most one a second.
+		logLimiter: rate.NewLimiter(1, 10),
+		logger:     logger,
+	}
+	for _, rule := range rules {
+		if rule.Pattern == "" {
+			return nil, fmt.Errorf("redaction rule %s has no pattern", rule.Name)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for redaction rule %s: %v", rule.Name, err)
+		}
+		switch rule.Action {
+		case RedactReplace, RedactDrop:
+		default:
+			return nil, fmt.Errorf("invalid action %q for redaction rule %s, must be %s or %s", rule.Action, rule.Name, RedactReplace, RedactDrop)
+		}
+		r.rules = append(r.rules, &redactRule{
+			RedactRule: rule,
+			re:         re,
+			literal:    requiredLiteral(rule.Pattern),
+		})
+		r.logger.Infof("Loaded redaction rule %s", rule.Name)
+	}
+	return r, nil
+}
+
+// apply redacts the name and tag values of m, returning false if it is to be dropped.
+func (r *Redactor) apply(m *gostatsd.Metric, ip gostatsd.IP) bool {
+	if r == nil {
+		return true
+	}
+	for _, rule := range r.rules {
+		matched := false
+		if rule.matches(m.Name) {
+			matched = true
+			if rule.Action == RedactReplace {
+				m.Name = rule.re.ReplaceAllLiteralString(m.Name, rule.Placeholder)
+			}
+		}
+		for i, tag := range m.Tags {
+			value := tag[strings.IndexByte(tag, ':')+1:]
+			if !rule.matches(value) {
+				continue
+			}
+			matched = true
+			if rule.Action == RedactReplace {
+				m.Tags[i] = tag[:len(tag)-len(value)] + rule.re.ReplaceAllLiteralString(value, rule.Placeholder)
+			}
+		}
+		if !matched {
+			continue
+		}
+		atomic.AddUint64(&rule.matched, 1)
+		if rule.Action == RedactDrop {
+			r.logRateLimited(rule, "Dropped", m, ip)
+			return false
+		}
+		r.logRateLimited(rule, "Redacted", m, ip)
+	}
+	return true
+}
+
+// logRateLimited logs that m matched rule, with every rule applied to its name so it is not logged.
+func (r *Redactor) logRateLimited(rule *redactRule, action string, m *gostatsd.Metric, ip gostatsd.IP) {
+	if !r.logLimiter.Allow() {
+		return
+	}
+	name := m.Name
+	for _, rule := range r.rules {
+		if rule.matches(name) {
+			name = rule.re.ReplaceAllLiteralString(name, DefaultRedactPlaceholder)
+		}
+	}
+	r.logger.WithFields(log.Fields{
+		logging.FieldBucket:  name,
+		logging.FieldAddress: ip,
+		"rule":               rule.Name,
+	}).Warnf("%s metric matching redaction rule", action)
+}
+
+func (r *Redactor) emit(statser statser.Statser) {
+	if r == nil {
+		return
+	}
+	for _, rule := range r.rules {
+		statser.Gauge("parser.redacted", float64(atomic.LoadUint64(&rule.matched)), gostatsd.Tags{"rule:" + rule.Name, "action:" + rule.Action})
+	}
+}
+
+// RulesCommand is the console command to show the redaction rules.  The patterns are shown, as they are not
+// sensitive themselves.
+func (r *Redactor) RulesCommand(ctx context.Context, args []string, w io.Writer) error {
+	if r == nil {
+		_, err := fmt.Fprintln(w, "No redaction rules")
+		return err
+	}
+	for _, rule := range r.rules {
+		if _, err := fmt.Fprintf(w, "%s: %s %q, %d matched\n", rule.Name, rule.Action, rule.Pattern, atomic.LoadUint64(&rule.matched)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requiredLiteral returns the longest literal string which every match of pattern contains, or an empty string if
+// there is none, such as when the pattern is case insensitive.
+func requiredLiteral(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	return longestLiteral(re.Simplify())
+}
+
+func longestLiteral(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return ""
+		}
+		return string(re.Rune)
+	case syntax.OpCapture, syntax.OpPlus:
+		return longestLiteral(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return longestLiteral(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		longest := ""
+		for _, sub := range re.Sub {
+			if literal := longestLiteral(sub); len(literal) > len(longest) {
+				longest = literal
+			}
+		}
+		return longest
+	}
+	return ""
+}
@@ -0,0 +1,142 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const emailPattern = `[a-z0-9_%+-]+@[a-z0-9-]+\.[a-z]+`
+
+func TestRequiredLiteral(t *testing.T) {
+	t.Parallel()
+	tests := map[string]string{
+		emailPattern:           "@",
+		`user\.[0-9]+\.token`:  ".token",
+		`secret`:               "secret",
+		`(?i)secret`:           "",
+		`(password|passwd)`:    "passw",
+		`(cat|dog)`:            "",
+		`x?apikey`:             "apikey",
+		`(key_[a-f0-9]{32})+`:  "key_",
+		`[0-9]{3}-[0-9]{2}-.*`: "-",
+		`^ssn\.[0-9]+$`:        "ssn.",
+		`a*`:                   "",
+	}
+	for pattern, expected := range tests {
+		assert.Equal(t, expected, requiredLiteral(pattern), pattern)
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	t.Parallel()
+	r, err := NewRedactor([]RedactRule{
+		{Name: "tokens", Pattern: `token_[a-f0-9]+`, Action: RedactDrop},
+		{Name: "emails", Pattern: emailPattern, Action: RedactReplace, Placeholder: "EMAIL"},
+	}, logrus.StandardLogger())
+	require.NoError(t, err)
+
+	m := &gostatsd.Metric{Name: "signup.joe@example.com.count", Tags: gostatsd.Tags{"user:ann@example.com", "env:prod", "bob@example.com"}}
+	assert.True(t, r.apply(m, fakeIP))
+	assert.Equal(t, "signup.EMAIL.count", m.Name)
+	assert.Equal(t, gostatsd.Tags{"user:EMAIL", "env:prod", "EMAIL"}, m.Tags)
+
+	m = &gostatsd.Metric{Name: "api.requests", Tags: gostatsd.Tags{"session:token_abc123"}}
+	assert.False(t, r.apply(m, fakeIP))
+
+	m = &gostatsd.Metric{Name: "api.requests", Tags: gostatsd.Tags{"env:prod"}}
+	assert.True(t, r.apply(m, fakeIP))
+	assert.Equal(t, "api.requests", m.Name)
+
+	assert.EqualValues(t, 1, atomic.LoadUint64(&r.rules[0].matched))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&r.rules[1].matched))
+
+	var nilRedactor *Redactor
+	assert.True(t, nilRedactor.apply(m, fakeIP))
+}
+
+func TestRedactorLogIsRedacted(t *testing.T) {
+	t.Parallel()
+	hook := test.NewGlobal()
+	r, err := NewRedactor([]RedactRule{
+		{Name: "secret-hosts", Pattern: `internal-[a-z]+`, Action: RedactDrop},
+		{Name: "emails", Pattern: emailPattern, Action: RedactReplace, Placeholder: "EMAIL"},
+	}, logrus.StandardLogger())
+	require.NoError(t, err)
+	assert.False(t, r.apply(&gostatsd.Metric{Name: "internal-db.jane@example.com.queries"}, fakeIP))
+
+	var logged []string
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, "Dropped") {
+			logged = append(logged, fmt.Sprintf("%s %s %s %s", entry.Message, entry.Data[logging.FieldBucket], entry.Data[logging.FieldAddress], entry.Data["rule"]))
+		}
+	}
+	assert.Equal(t, []string{"Dropped metric matching redaction rule REDACTED.REDACTED.queries 127.0.0.1 secret-hosts"}, logged)
+}
+
+func TestNewRedactorFromViper(t *testing.T) {
+	t.Parallel()
+	v := derivedViper(t, `
+redactions='emails tokens'
+
+[redaction.emails]
+pattern='[a-z]+@[a-z]+\.com'
+
+[redaction.tokens]
+pattern='token_[0-9]+'
+action='drop'
+`)
+	r, err := NewRedactorFromViper(v, logrus.StandardLogger())
+	require.NoError(t, err)
+	require.Len(t, r.rules, 2)
+	assert.Equal(t, RedactRule{Name: "emails", Pattern: `[a-z]+@[a-z]+\.com`, Action: RedactReplace, Placeholder: DefaultRedactPlaceholder}, r.rules[0].RedactRule)
+	assert.Equal(t, ".com", r.rules[0].literal)
+	assert.Equal(t, RedactDrop, r.rules[1].Action)
+
+	r, err = NewRedactorFromViper(derivedViper(t, ``), logrus.StandardLogger())
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	tests := map[string]string{
+		"missing block":  "redactions='x'",
+		"no pattern":     "redactions='x'\n[redaction.x]\naction='drop'",
+		"bad pattern":    "redactions='x'\n[redaction.x]\npattern='('",
+		"unknown action": "redactions='x'\n[redaction.x]\npattern='a'\naction='hash'",
+	}
+	for name, config := range tests {
+		_, err := NewRedactorFromViper(derivedViper(t, config), logrus.StandardLogger())
+		assert.Error(t, err, name)
+	}
+}
+
+func TestParseDatagramRedaction(t *testing.T) {
+	t.Parallel()
+	r, err := NewRedactor([]RedactRule{
+		{Name: "tokens", Pattern: `token_[0-9]+`, Action: RedactDrop},
+		{Name: "users", Pattern: `user_[0-9]+`, Action: RedactReplace, Placeholder: DefaultRedactPlaceholder},
+		{Name: "emails", Pattern: emailPattern, Action: RedactReplace, Placeholder: DefaultRedactPlaceholder},
+	}, logrus.StandardLogger())
+	require.NoError(t, err)
+	ch := &countingHandler{}
+	dp := NewDatagramParser(nil, ch, ch, statser.NewNullStatser(), ParserOptions{Redactor: r})
+
+	metrics, _, badLines, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte("a:1|c\nlogin.user_42:1|c|#user:ann@example.com\nsession.token_123:1|c"), time.Time{}, nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, metrics)
+	assert.Zero(t, badLines)
+	require.Len(t, ch.metrics, 2)
+	assert.Equal(t, "login.REDACTED", ch.metrics[1].Name)
+	assert.Equal(t, gostatsd.Tags{"user:REDACTED"}, ch.metrics[1].Tags)
+}
@@ -0,0 +1,28 @@
+package statsd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runReloadOnSIGHUP calls reload each time the process receives SIGHUP, until the context is done.  If reload fails
+// the error is logged, and the previous name is kept.
+func runReloadOnSIGHUP(ctx context.Context, name string, reload func() error, logger log.FieldLogger) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+			if err := reload(); err != nil {
+				logger.WithError(err).Warnf("Keeping the previous %s", name)
+			}
+		}
+	}
+}
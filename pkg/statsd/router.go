@@ -0,0 +1,197 @@
+package statsd
+
+import (
+	"fmt"
+	"path"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+
+	"github.com/spf13/viper"
+)
+
+// Route sends metrics matching it to a set of backends.  A metric matches if its name matches any of the Match
+// globs, and any of its tags matches any of the Tags globs.  An empty list matches any metric.
+type Route struct {
+	Name     string   // Name of the route in the configuration
+	Match    []string // Globs matching metric names
+	Tags     []string // Globs matching tags
+	Backends []string // Names of the backends to send to, as given in --backends
+
+	backends []int // Index of each backend
+}
+
+// NewRouteFromViper creates a new Route named name given a *viper.Viper
+func NewRouteFromViper(name string, v *viper.Viper) (Route, error) {
+	v.SetDefault("match", []string{})
+	v.SetDefault("tags", []string{})
+	v.SetDefault("backends", []string{})
+	r := Route{
+		Name:     name,
+		Match:    v.GetStringSlice("match"),
+		Tags:     v.GetStringSlice("tags"),
+		Backends: v.GetStringSlice("backends"),
+	}
+	if len(r.Match) == 0 && len(r.Tags) == 0 {
+		return Route{}, fmt.Errorf("no match or tags")
+	}
+	for _, glob := range append(append([]string{}, r.Match...), r.Tags...) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return Route{}, fmt.Errorf("invalid glob %q: %v", glob, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *Route) matches(name string, tags gostatsd.Tags) bool {
+	return (len(r.Match) == 0 || matchAnyGlob(r.Match, name)) && (len(r.Tags) == 0 || matchAnyTag(r.Tags, tags))
+}
+
+func matchAnyGlob(globs []string, s string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAnyTag(globs []string, tags gostatsd.Tags) bool {
+	for _, tag := range tags {
+		if matchAnyGlob(globs, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Router partitions the metrics of each flush between the backends.  Each metric is sent to the backends of the first
+// route it matches, or the default route if it matches none.
+type Router struct {
+	metricsUnrouted uint64 // Cumulative number of metrics which matched no route, accessed atomically
+
+	routes       []Route
+	defaultRoute []int // Index of each backend of the default route
+	numBackends  int
+}
+
+// NewRouterFromViper loads the routes listed by the routes key, each from a route.<route name> block, and the
+// default route from the default-route key.  Each backend is named as in backendNames, which is in the same order
+// as the backends the flusher sends to.  It returns nil if there are no routes, in which case every metric is sent
+// to every backend.  Unlike filters, an invalid or missing route is an error, so metrics are never silently
+// misrouted.
+func NewRouterFromViper(v *viper.Viper, backendNames []string) (*Router, error) {
+	routeNames := v.GetStringSlice("routes")
+	if len(routeNames) == 0 {
+		return nil, nil
+	}
+	index := func(names []string) ([]int, error) {
+		indexes := make([]int, 0, len(names))
+	names:
+		for _, name := range names {
+			for i, backendName := range backendNames {
+				if name == backendName {
+					indexes = append(indexes, i)
+					continue names
+				}
+			}
+			return nil, fmt.Errorf("unknown backend %q", name)
+		}
+		return indexes, nil
+	}
+	r := &Router{
+		numBackends: len(backendNames),
+	}
+	for _, routeName := range routeNames {
+		vRoute := v.Sub("route." + routeName)
+		if vRoute == nil {
+			return nil, fmt.Errorf("route doesn't exist: %v", routeName)
+		}
+		route, err := NewRouteFromViper(routeName, vRoute)
+		if err == nil {
+			route.backends, err = index(route.Backends)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %v: %v", routeName, err)
+		}
+		r.routes = append(r.routes, route)
+		logging.Component("config").WithField("route", routeName).Info("Loaded route")
+	}
+	defaultRoute, err := index(v.GetStringSlice("default-route"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid default-route: %v", err)
+	}
+	r.defaultRoute = defaultRoute
+	return r, nil
+}
+
+// MetricsUnrouted returns the cumulative number of metrics which matched no route.
+func (r *Router) MetricsUnrouted() uint64 {
+	return atomic.LoadUint64(&r.metricsUnrouted)
+}
+
+// backends returns the index of each backend a metric should be sent to.
+func (r *Router) backends(name string, tags gostatsd.Tags) []int {
+	for i := range r.routes {
+		if r.routes[i].matches(name, tags) {
+			return r.routes[i].backends
+		}
+	}
+	atomic.AddUint64(&r.metricsUnrouted, 1)
+	return r.defaultRoute
+}
+
+// partition returns a MetricMap for each backend, holding the metrics in m routed to it.  The metrics themselves
+// are shared with m.  It is safe to call concurrently.
+func (r *Router) partition(m *gostatsd.MetricMap) []*gostatsd.MetricMap {
+	parts := make([]*gostatsd.MetricMap, r.numBackends)
+	for i := range parts {
+		parts[i] = &gostatsd.MetricMap{
+			Counters: gostatsd.Counters{},
+			Timers:   gostatsd.Timers{},
+			Gauges:   gostatsd.Gauges{},
+			Sets:     gostatsd.Sets{},
+			Sorted:   m.Sorted,
+
+			Interval:        m.Interval,
+			NominalInterval: m.NominalInterval,
+			Sequence:        m.Sequence,
+			Part:            m.Part,
+			Late:            m.Late,
+		}
+	}
+	m.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+		for _, i := range r.backends(name, c.Tags) {
+			if parts[i].Counters[name] == nil {
+				parts[i].Counters[name] = map[string]gostatsd.Counter{}
+			}
+			parts[i].Counters[name][tagsKey] = c
+		}
+	})
+	m.Timers.Each(func(name, tagsKey string, t gostatsd.Timer) {
+		for _, i := range r.backends(name, t.Tags) {
+			if parts[i].Timers[name] == nil {
+				parts[i].Timers[name] = map[string]gostatsd.Timer{}
+			}
+			parts[i].Timers[name][tagsKey] = t
+		}
+	})
+	m.Gauges.Each(func(name, tagsKey string, g gostatsd.Gauge) {
+		for _, i := range r.backends(name, g.Tags) {
+			if parts[i].Gauges[name] == nil {
+				parts[i].Gauges[name] = map[string]gostatsd.Gauge{}
+			}
+			parts[i].Gauges[name][tagsKey] = g
+		}
+	})
+	m.Sets.Each(func(name, tagsKey string, s gostatsd.Set) {
+		for _, i := range r.backends(name, s.Tags) {
+			if parts[i].Sets[name] == nil {
+				parts[i].Sets[name] = map[string]gostatsd.Set{}
+			}
+			parts[i].Sets[name][tagsKey] = s
+		}
+	})
+	return parts
+}
@@ -0,0 +1,148 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const routerTestConfig = `
+routes='teamA teamB infra'
+default-route='graphite:shared'
+
+[route.teamA]
+match='teamA.*'
+backends='graphite:a'
+
+[route.teamB]
+match='teamB.*'
+tags='tenant:teamB'
+backends='graphite:b'
+
+[route.infra]
+match='infra.*'
+backends='graphite:a graphite:b'
+`
+
+func routerViper(t *testing.T, config string) *viper.Viper {
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(config)))
+	return v
+}
+
+func TestNewRouterFromViper(t *testing.T) {
+	t.Parallel()
+	r, err := NewRouterFromViper(routerViper(t, routerTestConfig), []string{"graphite:a", "graphite:b", "graphite:shared"})
+	require.NoError(t, err)
+	expected := []Route{
+		{Name: "teamA", Match: []string{"teamA.*"}, Tags: []string{}, Backends: []string{"graphite:a"}, backends: []int{0}},
+		{Name: "teamB", Match: []string{"teamB.*"}, Tags: []string{"tenant:teamB"}, Backends: []string{"graphite:b"}, backends: []int{1}},
+		{Name: "infra", Match: []string{"infra.*"}, Tags: []string{}, Backends: []string{"graphite:a", "graphite:b"}, backends: []int{0, 1}},
+	}
+	assert.Equal(t, expected, r.routes)
+	assert.Equal(t, []int{2}, r.defaultRoute)
+
+	r, err = NewRouterFromViper(viper.New(), []string{"graphite"})
+	require.NoError(t, err)
+	assert.Nil(t, r)
+}
+
+func TestNewRouterFromViperInvalid(t *testing.T) {
+	t.Parallel()
+	backendNames := []string{"graphite:a", "graphite:b"}
+	tests := map[string]string{
+		"missing":         `routes='nope'`,
+		"no match":        "routes='r'\n[route.r]\nbackends='graphite:a'",
+		"bad glob":        "routes='r'\n[route.r]\nmatch='a['\nbackends='graphite:a'",
+		"unknown backend": "routes='r'\n[route.r]\nmatch='a.*'\nbackends='graphite:c'",
+		"unknown default": "routes='r'\ndefault-route='graphite:c'\n[route.r]\nmatch='a.*'\nbackends='graphite:a'",
+	}
+	for name, config := range tests {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := NewRouterFromViper(routerViper(t, config), backendNames)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRouterPartition(t *testing.T) {
+	t.Parallel()
+	r, err := NewRouterFromViper(routerViper(t, routerTestConfig), []string{"graphite:a", "graphite:b", "graphite:shared"})
+	require.NoError(t, err)
+
+	m := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{
+			"teamA.requests": {"": {Value: 1}},
+			"teamB.requests": {
+				"tenant:teamB": {Value: 2, Tags: gostatsd.Tags{"tenant:teamB"}},
+				"tenant:other": {Value: 3, Tags: gostatsd.Tags{"tenant:other"}},
+			},
+		},
+		Timers: gostatsd.Timers{
+			"infra.latency": {"": {Count: 4}},
+		},
+		Gauges: gostatsd.Gauges{
+			"other.gauge": {"": {Value: 5}},
+		},
+		Sets: gostatsd.Sets{},
+	}
+	parts := r.partition(m)
+	require.Len(t, parts, 3)
+
+	a, b, shared := parts[0], parts[1], parts[2]
+	assert.Equal(t, gostatsd.Counters{"teamA.requests": {"": {Value: 1}}}, a.Counters)
+	assert.Equal(t, gostatsd.Timers{"infra.latency": {"": {Count: 4}}}, a.Timers)
+	assert.Empty(t, a.Gauges)
+	assert.Equal(t, gostatsd.Counters{"teamB.requests": {"tenant:teamB": {Value: 2, Tags: gostatsd.Tags{"tenant:teamB"}}}}, b.Counters)
+	assert.Equal(t, gostatsd.Timers{"infra.latency": {"": {Count: 4}}}, b.Timers)
+	assert.Empty(t, b.Gauges)
+	// Metrics matching no route, including those matching a route's name but not its tags, go to the default route.
+	assert.Equal(t, gostatsd.Counters{"teamB.requests": {"tenant:other": {Value: 3, Tags: gostatsd.Tags{"tenant:other"}}}}, shared.Counters)
+	assert.Empty(t, shared.Timers)
+	assert.Equal(t, gostatsd.Gauges{"other.gauge": {"": {Value: 5}}}, shared.Gauges)
+	assert.EqualValues(t, 2, r.MetricsUnrouted())
+}
+
+func TestRouterNoDefaultRoute(t *testing.T) {
+	t.Parallel()
+	r, err := NewRouterFromViper(routerViper(t, "routes='r'\n[route.r]\nmatch='a.*'\nbackends='graphite'"), []string{"graphite"})
+	require.NoError(t, err)
+
+	parts := r.partition(&gostatsd.MetricMap{
+		Counters: gostatsd.Counters{"a.b": {"": {Value: 1}}, "c.d": {"": {Value: 2}}},
+	})
+	require.Len(t, parts, 1)
+	assert.Equal(t, gostatsd.Counters{"a.b": {"": {Value: 1}}}, parts[0].Counters)
+	assert.EqualValues(t, 1, r.MetricsUnrouted())
+}
+
+func TestFlusherRouting(t *testing.T) {
+	t.Parallel()
+	statsOnly := &timerBackend{}
+	raw := &rawTimerBackend{}
+	backends := []gostatsd.Backend{statsOnly, raw}
+	r, err := NewRouterFromViper(routerViper(t, "routes='r'\n[route.r]\nmatch='t'\nbackends='raw'"), []string{"stats", "raw"})
+	require.NoError(t, err)
+
+	agg := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute, HandOffTimerValues: true}, nil, nil, nil)
+	fl := NewMetricFlusher(0, &singleAggregator{agg: agg}, nil, backends, "host", false, false, nil, r, nil, statser.NewNullStatser())
+
+	agg.Receive(&gostatsd.Metric{Name: "t", Value: 1, Type: gostatsd.TIMER, Rate: 1}, time.Now())
+	fl.flushData(context.Background(), time.Second, 0)
+
+	assert.Zero(t, statsOnly.timer.Count)
+	assert.Equal(t, 1, raw.timer.Count)
+	assert.Equal(t, []float64{1}, raw.timer.Values)
+}
@@ -0,0 +1,149 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// TagRules is the filter, alias and scaling rules applied to each metric by a TagHandler.
+type TagRules struct {
+	Filters  []Filter
+	Aliases  []Alias
+	Scalings []Scaling
+}
+
+// LoadTagRules loads the rules named by the filters, aliases and scalings lists of v, from the filter.<name>,
+// alias.<name> and scaling.<name> sections.  It returns the rules which are valid, and an error for each which is
+// missing or invalid.
+func LoadTagRules(v *viper.Viper) (TagRules, []error) {
+	var rules TagRules
+	var errs []error
+	for _, filterName := range v.GetStringSlice("filters") {
+		vFilter := v.Sub("filter." + filterName)
+		if vFilter == nil {
+			errs = append(errs, fmt.Errorf("filter doesn't exist: %v", filterName))
+			continue
+		}
+		rules.Filters = append(rules.Filters, NewFilterFromViper(vFilter))
+	}
+	for _, aliasName := range v.GetStringSlice("aliases") {
+		vAlias := v.Sub("alias." + aliasName)
+		if vAlias == nil {
+			errs = append(errs, fmt.Errorf("alias doesn't exist: %v", aliasName))
+			continue
+		}
+		alias, err := NewAliasFromViper(vAlias)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid alias %v: %v", aliasName, err))
+			continue
+		}
+		rules.Aliases = append(rules.Aliases, alias)
+	}
+	for _, scalingName := range v.GetStringSlice("scalings") {
+		vScaling := v.Sub("scaling." + scalingName)
+		if vScaling == nil {
+			errs = append(errs, fmt.Errorf("scaling doesn't exist: %v", scalingName))
+			continue
+		}
+		scaling, err := NewScalingFromViper(vScaling)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid scaling %v: %v", scalingName, err))
+			continue
+		}
+		rules.Scalings = append(rules.Scalings, scaling)
+	}
+	return rules, errs
+}
+
+// RulesFile holds filter, alias and scaling rules loaded from a file separate from the main config, in the same
+// format as it, and reloaded when the process receives SIGHUP.  The rules of the file are applied after those of the
+// main config.  A file with any missing or invalid rule is not loaded at all.
+type RulesFile struct {
+	path   string
+	main   TagRules     // Rules of the main config
+	rules  atomic.Value // *TagRules, the rules of the main config followed by those of the file
+	file   atomic.Value // TagRules, the rules of the file alone
+	logger log.FieldLogger
+}
+
+// NewRulesFile loads the rules from the file at path, which has the format of its extension, such as .toml or .yaml,
+// to apply after the rules of the main config.
+func NewRulesFile(path string, main TagRules, logger log.FieldLogger) (*RulesFile, error) {
+	rf := &RulesFile{
+		path:   path,
+		main:   main,
+		logger: logger,
+	}
+	if err := rf.Reload(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// Reload reads the file again, replacing the current rules.  The current rules are kept if there is an error.
+func (rf *RulesFile) Reload() error {
+	v := viper.New()
+	v.SetConfigFile(rf.path)
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("failed to read rules %s: %v", rf.path, err)
+	}
+	file, errs := LoadTagRules(v)
+	if len(errs) > 0 {
+		msgs := make([]string, 0, len(errs))
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return fmt.Errorf("invalid rules in %s: %s", rf.path, strings.Join(msgs, ", "))
+	}
+	rf.rules.Store(&TagRules{
+		Filters:  append(append([]Filter(nil), rf.main.Filters...), file.Filters...),
+		Aliases:  append(append([]Alias(nil), rf.main.Aliases...), file.Aliases...),
+		Scalings: append(append([]Scaling(nil), rf.main.Scalings...), file.Scalings...),
+	})
+	rf.file.Store(file)
+	rf.logger.Infof("Loaded %s from %s", describeTagRules(file), rf.path)
+	return nil
+}
+
+// Run reloads the rules each time the process receives SIGHUP, until the context is done.
+func (rf *RulesFile) Run(ctx context.Context) {
+	runReloadOnSIGHUP(ctx, "rules", rf.Reload, rf.logger)
+}
+
+// Rules returns the rules of the main config followed by those of the file.
+func (rf *RulesFile) Rules() *TagRules {
+	return rf.rules.Load().(*TagRules)
+}
+
+// RulesCommand is the console command to show the number of rules loaded from the file.
+func (rf *RulesFile) RulesCommand(ctx context.Context, args []string, w io.Writer) error {
+	if rf == nil {
+		_, err := fmt.Fprintf(w, "No rules file, see --%s\n", ParamRulesFile)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s from %s\n", describeTagRules(rf.file.Load().(TagRules)), rf.path)
+	return err
+}
+
+// ReloadCommand is the console command to reload the rules file.
+func (rf *RulesFile) ReloadCommand(ctx context.Context, args []string, w io.Writer) error {
+	if rf == nil {
+		return fmt.Errorf("no rules file, see --%s", ParamRulesFile)
+	}
+	if err := rf.Reload(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "Loaded %s\n", describeTagRules(rf.file.Load().(TagRules)))
+	return err
+}
+
+// describeTagRules returns the number of each kind of rule.
+func describeTagRules(rules TagRules) string {
+	return fmt.Sprintf("%d filters, %d aliases and %d scalings", len(rules.Filters), len(rules.Aliases), len(rules.Scalings))
+}
@@ -0,0 +1,123 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dispatchNames dispatches a counter named name with the tag noisy:1 through th, and returns the names and tags of the
+// metrics which come out of it.
+func dispatchNames(t *testing.T, th *TagHandler, tch *TagCapturingHandler, name string) []string {
+	tch.m = nil
+	m := &gostatsd.Metric{Name: name, Value: 10, Rate: 1, Tags: gostatsd.Tags{"noisy:1"}, Type: gostatsd.COUNTER}
+	require.NoError(t, th.DispatchMetric(context.Background(), m))
+	var names []string
+	for _, m := range tch.m {
+		names = append(names, m.Name+" "+m.Tags.String())
+	}
+	return names
+}
+
+func TestRulesFileReload(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "rules-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.toml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+filters = ['drop-old']
+aliases = ['rename']
+
+[filter.drop-old]
+match-metrics = ['old.*']
+drop-metric = true
+
+[alias.rename]
+source = 'a.*'
+aliases = ['b.*']
+`), 0600))
+
+	tch := &TagCapturingHandler{}
+	th := NewTagHandler(tch, tch, gostatsd.Tags{}, []Filter{
+		{DropTags: toStringMatch([]string{"noisy:*"})},
+	})
+	rf, err := th.SetRulesFile(path, logrus.StandardLogger())
+	require.NoError(t, err)
+
+	// The rules of the file apply after those the handler was created with.
+	assert.Empty(t, dispatchNames(t, th, tch, "old.x"))
+	assert.Equal(t, []string{"a.x ", "b.x "}, dispatchNames(t, th, tch, "a.x"))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+scalings = ['kb']
+
+[scaling.kb]
+match-metrics = ['a.*']
+divide = 10
+`), 0600))
+	var buf bytes.Buffer
+	require.NoError(t, rf.ReloadCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "Loaded 0 filters, 0 aliases and 1 scalings\n", buf.String())
+	assert.Equal(t, []string{"old.x "}, dispatchNames(t, th, tch, "old.x"))
+	assert.Equal(t, []string{"a.x "}, dispatchNames(t, th, tch, "a.x"))
+	assert.Equal(t, 1.0, tch.m[0].Value)
+
+	buf.Reset()
+	require.NoError(t, rf.RulesCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "0 filters, 0 aliases and 1 scalings from "+path+"\n", buf.String())
+}
+
+func TestRulesFileReloadInvalid(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "rules-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.toml")
+	valid := []byte(`
+filters = ['drop-old']
+
+[filter.drop-old]
+match-metrics = ['old.*']
+drop-metric = true
+`)
+	require.NoError(t, ioutil.WriteFile(path, valid, 0600))
+
+	tch := &TagCapturingHandler{}
+	th := NewTagHandler(tch, tch, gostatsd.Tags{}, nil)
+	rf, err := th.SetRulesFile(path, logrus.StandardLogger())
+	require.NoError(t, err)
+
+	for name, rules := range map[string]string{
+		"missing section": "filters = ['drop-old', 'missing']\n[filter.drop-old]\nmatch-metrics = ['old.*']\n",
+		"invalid alias":   "aliases = ['empty']\n[alias.empty]\nsource = 'a'\n",
+		"invalid scaling": "scalings = ['zero']\n[scaling.zero]\nmatch-metrics = ['a']\nmultiply = 0\n",
+		"bad syntax":      "filters = [\n",
+	} {
+		require.NoError(t, ioutil.WriteFile(path, []byte(rules), 0600))
+		assert.Error(t, rf.Reload(), name)
+		// The previous rules are kept.
+		assert.Empty(t, dispatchNames(t, th, tch, "old.x"), name)
+		assert.Equal(t, []string{"a noisy:1"}, dispatchNames(t, th, tch, "a"), name)
+	}
+
+	require.NoError(t, os.Remove(path))
+	assert.Error(t, rf.Reload())
+	assert.Empty(t, dispatchNames(t, th, tch, "old.x"))
+
+	// A file which is invalid at startup is an error.
+	_, err = NewRulesFile(filepath.Join(dir, "missing.toml"), TagRules{}, logrus.StandardLogger())
+	assert.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "rules"), valid, 0600))
+	_, err = NewRulesFile(filepath.Join(dir, "rules"), TagRules{}, logrus.StandardLogger())
+	assert.Error(t, err)
+}
@@ -0,0 +1,236 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SampleRateScale scales the value of a sampled counter by 1/rate, as is standard.
+	SampleRateScale = "scale"
+	// SampleRateIgnore uses the value of a sampled counter as it is, for clients which have already scaled it.
+	SampleRateIgnore = "ignore"
+	// SampleRateReject drops sampled counters, counting them as bad_sample_rate parse errors.
+	SampleRateReject = "reject"
+)
+
+var errSampledCounter = errors.New("sampled counter rejected")
+
+// SampleRateRule is the handling of the sample rate of counters matching both the name glob and the source network,
+// either of which may be empty to match any name or source.
+type SampleRateRule struct {
+	Name     string
+	Source   *net.IPNet
+	Handling string
+}
+
+func (r SampleRateRule) String() string {
+	var fields []string
+	if r.Source != nil {
+		fields = append(fields, "source:"+r.Source.String())
+	}
+	if r.Name != "" {
+		fields = append(fields, "name:"+r.Name)
+	}
+	return strings.Join(append(fields, r.Handling), " ")
+}
+
+// matches returns true if the rule applies to a metric named name from ip, which is nil if the source is unknown.
+func (r SampleRateRule) matches(name string, ip net.IP) bool {
+	if r.Source != nil && (ip == nil || !r.Source.Contains(ip)) {
+		return false
+	}
+	if r.Name != "" {
+		if ok, _ := path.Match(r.Name, name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// SampleRates decides how the sample rate of each counter is handled, by the first matching rule of a list loaded
+// from a file, and reloaded when the process receives SIGHUP.  Counters which match no rule are scaled.  A nil
+// *SampleRates scales every counter.
+type SampleRates struct {
+	ignored  uint64 // Must be read/written only using atomic instructions.
+	rejected uint64 // Must be read/written only using atomic instructions.
+
+	path   string
+	rules  atomic.Value // []SampleRateRule
+	logger log.FieldLogger
+}
+
+// NewSampleRates loads the sample rate rules from the file at path.
+func NewSampleRates(path string, logger log.FieldLogger) (*SampleRates, error) {
+	sr := &SampleRates{
+		path:   path,
+		logger: logger,
+	}
+	if err := sr.Reload(); err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// Reload reads the file again, replacing the current rules.  The current rules are kept if there is an error.
+func (sr *SampleRates) Reload() error {
+	f, err := os.Open(sr.path)
+	if err != nil {
+		return fmt.Errorf("failed to open sample rate rules: %v", err)
+	}
+	defer f.Close()
+	rules, err := ParseSampleRateRules(f)
+	if err != nil {
+		return fmt.Errorf("failed to read sample rate rules %s: %v", sr.path, err)
+	}
+	sr.rules.Store(rules)
+	sr.logger.Infof("Loaded %d sample rate rules from %s", len(rules), sr.path)
+	return nil
+}
+
+// Run reloads the rules each time the process receives SIGHUP, until the context is done.
+func (sr *SampleRates) Run(ctx context.Context) {
+	runReloadOnSIGHUP(ctx, "sample rate rules", sr.Reload, sr.logger)
+}
+
+// Handling returns the handling of the sample rate of a counter named name received from ip, one of the
+// SampleRate* values.
+func (sr *SampleRates) Handling(name string, ip gostatsd.IP) string {
+	if sr == nil {
+		return SampleRateScale
+	}
+	var sourceIP net.IP
+	parsed := false
+	for _, rule := range sr.rules.Load().([]SampleRateRule) {
+		if rule.Source != nil && !parsed {
+			sourceIP = net.ParseIP(string(ip))
+			parsed = true
+		}
+		if rule.matches(name, sourceIP) {
+			return rule.Handling
+		}
+	}
+	return SampleRateScale
+}
+
+// apply applies the handling of the sample rate to a counter received from ip, returning false if it is rejected.
+func (sr *SampleRates) apply(m *gostatsd.Metric, ip gostatsd.IP) bool {
+	if sr == nil || m.Type != gostatsd.COUNTER || m.Rate == 1 {
+		return true
+	}
+	switch sr.Handling(m.Name, ip) {
+	case SampleRateIgnore:
+		atomic.AddUint64(&sr.ignored, 1)
+		m.Rate = 1
+	case SampleRateReject:
+		atomic.AddUint64(&sr.rejected, 1)
+		return false
+	}
+	return true
+}
+
+func (sr *SampleRates) emit(statser statser.Statser) {
+	if sr == nil {
+		return
+	}
+	statser.Gauge("parser.sample_rates_ignored", float64(atomic.LoadUint64(&sr.ignored)), nil)
+	statser.Gauge("parser.sample_rates_rejected", float64(atomic.LoadUint64(&sr.rejected)), nil)
+}
+
+// RulesCommand is the console command to show the sample rate rules.
+func (sr *SampleRates) RulesCommand(ctx context.Context, args []string, w io.Writer) error {
+	if sr == nil {
+		_, err := fmt.Fprintf(w, "No sample rate rules, every sampled counter is scaled, see --%s\n", ParamSampleRateRules)
+		return err
+	}
+	rules := sr.rules.Load().([]SampleRateRule)
+	if _, err := fmt.Fprintf(w, "%d rules from %s, %d sampled counters ignored, %d rejected\n", len(rules), sr.path, atomic.LoadUint64(&sr.ignored), atomic.LoadUint64(&sr.rejected)); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if _, err := fmt.Fprintln(w, rule.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReloadCommand is the console command to reload the sample rate rules.
+func (sr *SampleRates) ReloadCommand(ctx context.Context, args []string, w io.Writer) error {
+	if sr == nil {
+		return fmt.Errorf("no sample rate rules, see --%s", ParamSampleRateRules)
+	}
+	if err := sr.Reload(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "Loaded %d sample rate rules\n", len(sr.rules.Load().([]SampleRateRule)))
+	return err
+}
+
+// ParseSampleRateRules parses a list with a rule per line, such as `source:10.0.0.0/8 name:legacy.* ignore`.  Each
+// rule has an optional source IP address or CIDR network and an optional name glob, followed by the handling.  Blank
+// lines and anything after a # are ignored.
+func ParseSampleRateRules(r io.Reader) ([]SampleRateRule, error) {
+	rules := []SampleRateRule{}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		rule, err := parseSampleRateRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func parseSampleRateRule(fields []string) (SampleRateRule, error) {
+	var rule SampleRateRule
+	switch handling := fields[len(fields)-1]; handling {
+	case SampleRateScale, SampleRateIgnore, SampleRateReject:
+		rule.Handling = handling
+	default:
+		return rule, fmt.Errorf("unknown sample rate handling %q, must be %s, %s or %s", handling, SampleRateScale, SampleRateIgnore, SampleRateReject)
+	}
+	for _, field := range fields[:len(fields)-1] {
+		switch {
+		case strings.HasPrefix(field, "name:") && rule.Name == "":
+			rule.Name = field[len("name:"):]
+			if _, err := path.Match(rule.Name, ""); err != nil || rule.Name == "" {
+				return rule, fmt.Errorf("invalid name glob %q", rule.Name)
+			}
+		case strings.HasPrefix(field, "source:") && rule.Source == nil:
+			source, err := parseSource(field[len("source:"):])
+			if err != nil {
+				return rule, err
+			}
+			rule.Source = source
+		default:
+			return rule, fmt.Errorf("unexpected %q, expected a single name:<glob> and source:<address>", field)
+		}
+	}
+	return rule, nil
+}
@@ -0,0 +1,115 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampleRatesHandling(t *testing.T) {
+	t.Parallel()
+	rules, err := ParseSampleRateRules(strings.NewReader(`
+# Legacy client which scales its counters itself
+source:10.1.0.0/16 name:legacy.* ignore
+source:10.1.0.0/16 scale
+name:legacy.* reject # everyone else is expected to have migrated
+name:old.* ignore
+`))
+	require.NoError(t, err)
+	require.Len(t, rules, 4)
+	assert.Equal(t, "source:10.1.0.0/16 name:legacy.* ignore", rules[0].String())
+	sr := &SampleRates{}
+	sr.rules.Store(rules)
+
+	tests := []struct {
+		name     string
+		ip       gostatsd.IP
+		expected string
+	}{
+		{"legacy.hits", "10.1.2.3", SampleRateIgnore},
+		{"legacy.hits", "10.2.0.1", SampleRateReject},
+		{"legacy.hits", gostatsd.UnknownIP, SampleRateReject},
+		{"old.hits", "10.1.2.3", SampleRateScale},
+		{"old.hits", "10.2.0.1", SampleRateIgnore},
+		{"new.hits", "10.2.0.1", SampleRateScale},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, sr.Handling(test.name, test.ip), "%s from %s", test.name, test.ip)
+	}
+
+	var none *SampleRates
+	assert.Equal(t, SampleRateScale, none.Handling("legacy.hits", "10.1.2.3"))
+}
+
+func TestParseSampleRateRulesInvalid(t *testing.T) {
+	t.Parallel()
+	for _, list := range []string{"name:a.*", "name:a.* skip", "source:10.1.2 ignore", "name:[ ignore", "name:a name:b ignore", "a.* ignore"} {
+		_, err := ParseSampleRateRules(strings.NewReader(list))
+		assert.Error(t, err, list)
+	}
+}
+
+func TestSampleRatesReload(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "sample-rates")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules")
+	require.NoError(t, ioutil.WriteFile(path, []byte("name:a.* ignore\n"), 0600))
+
+	sr, err := NewSampleRates(path, logrus.StandardLogger())
+	require.NoError(t, err)
+	assert.Equal(t, SampleRateIgnore, sr.Handling("a.b", gostatsd.UnknownIP))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("name:a.* reject\n"), 0600))
+	var buf bytes.Buffer
+	require.NoError(t, sr.ReloadCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "Loaded 1 sample rate rules\n", buf.String())
+	assert.Equal(t, SampleRateReject, sr.Handling("a.b", gostatsd.UnknownIP))
+
+	// Bad rules keep the current ones
+	require.NoError(t, ioutil.WriteFile(path, []byte("name:a.* bad\n"), 0600))
+	assert.Error(t, sr.Reload())
+	assert.Equal(t, SampleRateReject, sr.Handling("a.b", gostatsd.UnknownIP))
+
+	buf.Reset()
+	require.NoError(t, sr.RulesCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "1 rules from "+path+", 0 sampled counters ignored, 0 rejected\nname:a.* reject\n", buf.String())
+}
+
+func TestParseDatagramSampleRates(t *testing.T) {
+	t.Parallel()
+	rules, err := ParseSampleRateRules(strings.NewReader("name:scaled.* ignore\nname:bad.* reject\n"))
+	require.NoError(t, err)
+	sr := &SampleRates{}
+	sr.rules.Store(rules)
+	ch := &countingHandler{}
+	dp := NewDatagramParser(nil, ch, ch, statser.NewNullStatser(), ParserOptions{SampleRates: sr})
+
+	metrics, _, badLines, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte("scaled.hits:10|c|@0.1\nbad.hits:1|c|@0.5\nbad.hits:1|c\nother.hits:1|c|@0.5\nscaled.time:1|ms|@0.5"), time.Time{}, nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, metrics)
+	assert.EqualValues(t, 1, badLines)
+	require.Len(t, ch.metrics, 4)
+	rates := map[string]float64{}
+	for _, m := range ch.metrics {
+		rates[m.Name] = m.Rate
+	}
+	// Only sampled counters are affected.
+	assert.Equal(t, map[string]float64{"scaled.hits": 1, "bad.hits": 1, "other.hits": 0.5, "scaled.time": 0.5}, rates)
+	assert.EqualValues(t, 1, dp.lineErrors.counts[parseErrorBadSampleRate])
+	assert.EqualValues(t, 1, sr.ignored)
+	assert.EqualValues(t, 1, sr.rejected)
+}
@@ -0,0 +1,66 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+)
+
+// Scaling multiplies the values of counters and gauges whose name matches by a factor, such as reporting bytes as
+// kilobytes.  Timers and sets are not scaled.
+type Scaling struct {
+	MatchMetrics   gostatsd.StringMatchList // Name must match
+	ExcludeMetrics gostatsd.StringMatchList // Name must not match
+	Factor         float64                  // Multiplied with the value
+}
+
+// NewScalingFromViper creates a new Scaling given a *viper.Viper.  Exactly one of multiply and divide must be set, to
+// a non-zero factor.
+func NewScalingFromViper(v *viper.Viper) (Scaling, error) {
+	v.SetDefault("match-metrics", []string{})
+	v.SetDefault("exclude-metrics", []string{})
+	scaling := Scaling{
+		MatchMetrics:   toStringMatch(v.GetStringSlice("match-metrics")),
+		ExcludeMetrics: toStringMatch(v.GetStringSlice("exclude-metrics")),
+	}
+	if len(scaling.MatchMetrics) == 0 {
+		return Scaling{}, fmt.Errorf("no match-metrics")
+	}
+	switch {
+	case v.IsSet("multiply") && v.IsSet("divide"):
+		return Scaling{}, fmt.Errorf("both multiply and divide are set")
+	case v.IsSet("multiply"):
+		scaling.Factor = v.GetFloat64("multiply")
+	case v.IsSet("divide"):
+		if divisor := v.GetFloat64("divide"); divisor != 0 {
+			scaling.Factor = 1 / divisor
+		}
+	default:
+		return Scaling{}, fmt.Errorf("neither multiply nor divide is set")
+	}
+	if scaling.Factor == 0 || math.IsInf(scaling.Factor, 0) || math.IsNaN(scaling.Factor) {
+		return Scaling{}, fmt.Errorf("invalid factor")
+	}
+	return scaling, nil
+}
+
+// matches returns true if the scaling applies to a metric named name.
+func (s *Scaling) matches(name string) bool {
+	return s.MatchMetrics.MatchAny(name) && !s.ExcludeMetrics.MatchAny(name)
+}
+
+// scaleMetric multiplies the value of m by the factor of the first scaling matching it, if it is a counter or gauge.
+func scaleMetric(scalings []Scaling, m *gostatsd.Metric) {
+	if m.Type != gostatsd.COUNTER && m.Type != gostatsd.GAUGE {
+		return
+	}
+	for i := range scalings {
+		if scalings[i].matches(m.Name) {
+			m.Value *= scalings[i].Factor
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScalingUp(t *testing.T) {
+	t.Parallel()
+	tch := &TagCapturingHandler{}
+	th := NewTagHandler(tch, tch, gostatsd.Tags{}, nil)
+	th.scalings = []Scaling{
+		{MatchMetrics: toStringMatch([]string{"disk.kb.*"}), Factor: 1024},
+	}
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "disk.kb.written", Value: 2, Rate: 0.5, Type: gostatsd.COUNTER}))
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "disk.kb.free", Value: 1.5, Rate: 1, Type: gostatsd.GAUGE}))
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "disk.ops", Value: 3, Rate: 1, Type: gostatsd.COUNTER}))
+
+	require.Len(t, tch.m, 3)
+	assert.Equal(t, 2048.0, tch.m[0].Value)
+	assert.Equal(t, 0.5, tch.m[0].Rate)
+	assert.Equal(t, 1536.0, tch.m[1].Value)
+	assert.Equal(t, 3.0, tch.m[2].Value)
+}
+
+func TestScalingDown(t *testing.T) {
+	t.Parallel()
+	tch := &TagCapturingHandler{}
+	th := NewTagHandler(tch, tch, gostatsd.Tags{}, nil)
+	th.scalings = []Scaling{
+		{MatchMetrics: toStringMatch([]string{"net.bytes.*"}), ExcludeMetrics: toStringMatch([]string{"net.bytes.raw"}), Factor: 1.0 / 1024},
+		{MatchMetrics: toStringMatch([]string{"net.*"}), Factor: 1.0 / 1000},
+	}
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "net.bytes.in", Value: 2048, Rate: 1, Type: gostatsd.COUNTER}))
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "net.bytes.raw", Value: 2000, Rate: 1, Type: gostatsd.GAUGE}))
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "net.bytes.queued", Value: -512, Rate: 1, Type: gostatsd.GAUGE, GaugeDelta: true}))
+
+	require.Len(t, tch.m, 3)
+	assert.Equal(t, 2.0, tch.m[0].Value) // Only the first matching scaling applies
+	assert.Equal(t, 2.0, tch.m[1].Value) // Excluded from the first, so scaled by the second
+	assert.Equal(t, -0.5, tch.m[2].Value)
+	assert.True(t, tch.m[2].GaugeDelta)
+}
+
+func TestScalingOnlyAppliesToCountersAndGauges(t *testing.T) {
+	t.Parallel()
+	tch := &TagCapturingHandler{}
+	th := NewTagHandler(tch, tch, gostatsd.Tags{}, nil)
+	th.scalings = []Scaling{
+		{MatchMetrics: toStringMatch([]string{"*"}), Factor: 10},
+	}
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "latency", Value: 2, Values: []float64{2}, Rate: 1, Type: gostatsd.TIMER}))
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "users", StringValue: "5", Rate: 1, Type: gostatsd.SET}))
+
+	require.Len(t, tch.m, 2)
+	assert.Equal(t, 2.0, tch.m[0].Value)
+	assert.Equal(t, []float64{2}, tch.m[0].Values)
+	assert.Equal(t, "5", tch.m[1].StringValue)
+}
+
+func TestScalingAfterFiltersAndBeforeAliases(t *testing.T) {
+	t.Parallel()
+	tch := &TagCapturingHandler{}
+	th := NewTagHandler(tch, tch, gostatsd.Tags{}, []Filter{
+		{MatchMetrics: toStringMatch([]string{"dropped"}), DropMetric: true},
+	})
+	th.scalings = []Scaling{
+		{MatchMetrics: toStringMatch([]string{"old.bytes", "dropped"}), Factor: 0.5},
+	}
+	th.aliases = []Alias{
+		{Source: "old.bytes", Aliases: []string{"new.bytes"}},
+	}
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "dropped", Value: 4, Rate: 1, Type: gostatsd.COUNTER}))
+	require.NoError(t, th.DispatchMetric(context.Background(), &gostatsd.Metric{Name: "old.bytes", Value: 4, Rate: 1, Type: gostatsd.COUNTER}))
+
+	require.Len(t, tch.m, 2)
+	assert.Equal(t, "old.bytes", tch.m[0].Name)
+	assert.Equal(t, 2.0, tch.m[0].Value)
+	assert.Equal(t, "new.bytes", tch.m[1].Name)
+	assert.Equal(t, 2.0, tch.m[1].Value)
+}
+
+func TestNewTagHandlerFromViperScalings(t *testing.T) {
+	t.Parallel()
+	var data = []byte(`
+scalings='kilobytes milliseconds missing both neither zero no-match'
+
+[scaling.kilobytes]
+match-metrics='net.bytes.*'
+exclude-metrics='net.bytes.raw'
+divide=1024
+
+[scaling.milliseconds]
+match-metrics=['job.seconds']
+multiply=1000
+
+[scaling.both]
+match-metrics='x'
+multiply=2
+divide=2
+
+[scaling.neither]
+match-metrics='x'
+
+[scaling.zero]
+match-metrics='x'
+divide=0
+
+[scaling.no-match]
+multiply=2
+`)
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBuffer(data)))
+
+	nh := &nopHandler{}
+	th := NewTagHandlerFromViper(v, nh, nh, nil)
+
+	expected := []Scaling{
+		{MatchMetrics: toStringMatch([]string{"net.bytes.*"}), ExcludeMetrics: toStringMatch([]string{"net.bytes.raw"}), Factor: 1.0 / 1024},
+		{MatchMetrics: toStringMatch([]string{"job.seconds"}), ExcludeMetrics: toStringMatch([]string{}), Factor: 1000},
+	}
+	assert.Equal(t, expected, th.scalings)
+}
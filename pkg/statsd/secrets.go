@@ -0,0 +1,133 @@
+package statsd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// secretRef matches a reference to a secret in a configuration value, such as ${env:DD_API_KEY} or
+// ${file:/run/secrets/key}.
+var secretRef = regexp.MustCompile(`\$\{(\w+):([^}]*)\}`)
+
+// ResolveSecrets replaces references to secrets in the configuration values of v with the secrets, so they don't have
+// to be written in the configuration file.  A value of ${env:NAME} is replaced by the environment variable NAME, and
+// ${file:PATH} by the contents of the file at PATH without trailing newlines.  References may be part of a longer
+// value, and are resolved in nested blocks and lists.  It fails if a referenced secret doesn't exist.
+func ResolveSecrets(v *viper.Viper) error {
+	tops := map[string]struct{}{}
+	for _, key := range v.AllKeys() {
+		tops[strings.SplitN(key, ".", 2)[0]] = struct{}{}
+	}
+	keys := make([]string, 0, len(tops))
+	for key := range tops {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// Blocks are resolved and set as a whole, as setting a single key in a block would hide the rest of it from
+		// v.Sub.
+		value, changed, err := resolveSecrets(key, v.Get(key))
+		if err != nil {
+			return err
+		}
+		if changed {
+			v.Set(key, value)
+		}
+	}
+	return nil
+}
+
+// resolveSecrets returns value with every reference to a secret resolved, and whether there were any.  key is the
+// configuration key of value, for errors.
+func resolveSecrets(key string, value interface{}) (interface{}, bool, error) {
+	switch value := value.(type) {
+	case string:
+		return resolveSecretRefs(key, value)
+	case []string:
+		resolved := make([]string, len(value))
+		changed := false
+		for i, s := range value {
+			r, c, err := resolveSecretRefs(fmt.Sprintf("%s[%d]", key, i), s)
+			if err != nil {
+				return nil, false, err
+			}
+			resolved[i] = r.(string)
+			changed = changed || c
+		}
+		return resolved, changed, nil
+	case []interface{}:
+		resolved := make([]interface{}, len(value))
+		changed := false
+		for i, item := range value {
+			r, c, err := resolveSecrets(fmt.Sprintf("%s[%d]", key, i), item)
+			if err != nil {
+				return nil, false, err
+			}
+			resolved[i] = r
+			changed = changed || c
+		}
+		return resolved, changed, nil
+	case map[string]interface{}:
+		resolved := make(map[string]interface{}, len(value))
+		changed := false
+		for k, item := range value {
+			r, c, err := resolveSecrets(key+"."+k, item)
+			if err != nil {
+				return nil, false, err
+			}
+			resolved[k] = r
+			changed = changed || c
+		}
+		return resolved, changed, nil
+	}
+	return value, false, nil
+}
+
+func resolveSecretRefs(key, value string) (interface{}, bool, error) {
+	if !strings.Contains(value, "${") {
+		return value, false, nil
+	}
+	var err error
+	resolved := secretRef.ReplaceAllStringFunc(value, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		match := secretRef.FindStringSubmatch(ref)
+		var secret string
+		secret, err = resolveSecret(match[1], match[2])
+		if err != nil {
+			// The error doesn't include the value, only the reference, in case it is partly secret itself.
+			err = fmt.Errorf("can't resolve secret %s in %s: %v", ref, key, err)
+		}
+		return secret
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return resolved, resolved != value, nil
+}
+
+// resolveSecret returns the secret named by ref from source.
+func resolveSecret(source, ref string) (string, error) {
+	switch source {
+	case "env":
+		secret, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", ref)
+		}
+		return secret, nil
+	case "file":
+		b, err := ioutil.ReadFile(ref)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	return "", fmt.Errorf("unknown secret source %q, must be env or file", source)
+}
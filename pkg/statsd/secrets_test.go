@@ -0,0 +1,81 @@
+package statsd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSecretsEnv(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, os.Setenv("GOSTATSD_TEST_SECRET_ENV", "s3cret"))
+	defer os.Unsetenv("GOSTATSD_TEST_SECRET_ENV")
+	v := derivedViper(t, `
+backends='datadog'
+default-tags=['env:prod', 'token:${env:GOSTATSD_TEST_SECRET_ENV}']
+
+[datadog]
+api_key='${env:GOSTATSD_TEST_SECRET_ENV}'
+api_endpoint='https://example.com/${env:GOSTATSD_TEST_SECRET_ENV}/v1'
+timeout='5s'
+`)
+	require.NoError(t, ResolveSecrets(v))
+
+	assert.Equal(t, "s3cret", v.GetString("datadog.api_key"))
+	assert.Equal(t, []string{"env:prod", "token:s3cret"}, v.GetStringSlice("default-tags"))
+	dd := v.Sub("datadog")
+	require.NotNil(t, dd)
+	assert.Equal(t, "s3cret", dd.GetString("api_key"))
+	assert.Equal(t, "https://example.com/s3cret/v1", dd.GetString("api_endpoint"))
+	// Values without secrets are left alone.
+	assert.Equal(t, "5s", dd.GetString("timeout"))
+	assert.Equal(t, "datadog", v.GetString("backends"))
+}
+
+func TestResolveSecretsFile(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+	require.NoError(t, ioutil.WriteFile(path, []byte("filesecret\n"), 0600))
+
+	v := derivedViper(t, `
+[graphite]
+hash-key='${file:`+path+`}'
+`)
+	require.NoError(t, ResolveSecrets(v))
+	assert.Equal(t, "filesecret", v.Sub("graphite").GetString("hash-key"))
+}
+
+func TestResolveSecretsMissing(t *testing.T) {
+	t.Parallel()
+	for name, tc := range map[string]struct {
+		config string
+		err    string
+	}{
+		"env": {
+			config: "[datadog]\napi_key='${env:GOSTATSD_TEST_SECRET_MISSING}'",
+			err:    "can't resolve secret ${env:GOSTATSD_TEST_SECRET_MISSING} in datadog.api_key: environment variable GOSTATSD_TEST_SECRET_MISSING is not set",
+		},
+		"file": {
+			config: "[datadog]\napi_key='${file:/nonexistent/gostatsd/key}'",
+			err:    "can't resolve secret ${file:/nonexistent/gostatsd/key} in datadog.api_key: open /nonexistent/gostatsd/key: no such file or directory",
+		},
+		"source": {
+			config: "api_key='${vault:secret/key}'",
+			err:    `can't resolve secret ${vault:secret/key} in api_key: unknown secret source "vault", must be env or file`,
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			v := derivedViper(t, tc.config)
+			assert.EqualError(t, ResolveSecrets(v), tc.err)
+		})
+	}
+}
@@ -0,0 +1,542 @@
+package statsd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/hll"
+	"github.com/atlassian/gostatsd/pkg/logging"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The state file starts with a header of the magic string, the format version, the time it was written, and a
+// checksum of the header.  It is followed by sections, each of a name, the length of the payload, the payload, and a
+// checksum of the name and payload.  Readers skip sections they don't know, so sections can be added without
+// changing the version.  The last section is stateSectionEnd, so that a truncated file is detected.
+const (
+	stateMagic      = "GSDSTATE"
+	stateVersion    = 1
+	stateHeaderSize = len(stateMagic) + 2 + 8 + 4
+
+	stateSectionAggregator    = "aggregator" // The metrics of one aggregator
+	stateSectionBackendPrefix = "backend/"   // Followed by the name of the backend, the state of a StatefulBackend
+	stateSectionEnd           = "end"        // The end of the file, with an empty payload
+	maxStateSectionName       = 255          // Longest section name accepted, to catch garbage early
+)
+
+var errStateTruncated = errors.New("state file is truncated")
+
+// stateSection is a named section of a state file.
+type stateSection struct {
+	name    string
+	payload []byte
+}
+
+// stateEncoder appends values to a buffer in the state file encoding.  Integers are varints, floats are 8 bytes
+// big endian, and strings and byte slices are prefixed by their length.
+type stateEncoder struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (e *stateEncoder) uvarint(x uint64) {
+	n := binary.PutUvarint(e.tmp[:], x)
+	e.buf = append(e.buf, e.tmp[:n]...)
+}
+
+func (e *stateEncoder) varint(x int64) {
+	n := binary.PutVarint(e.tmp[:], x)
+	e.buf = append(e.buf, e.tmp[:n]...)
+}
+
+func (e *stateEncoder) float(f float64) {
+	binary.BigEndian.PutUint64(e.tmp[:8], math.Float64bits(f))
+	e.buf = append(e.buf, e.tmp[:8]...)
+}
+
+func (e *stateEncoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *stateEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *stateEncoder) tags(tags gostatsd.Tags) {
+	e.uvarint(uint64(len(tags)))
+	for _, tag := range tags {
+		e.string(tag)
+	}
+}
+
+// common encodes the fields shared by every metric type.
+func (e *stateEncoder) common(timestamp gostatsd.Nanotime, hostname string, tags gostatsd.Tags, ttl time.Duration) {
+	e.varint(int64(timestamp))
+	e.string(hostname)
+	e.tags(tags)
+	e.varint(int64(ttl))
+}
+
+// metricMap encodes the counters, timers, gauges and sets of m.  Values which are computed by Flush are not
+// included, so m must be encoded before it is flushed.
+func (e *stateEncoder) metricMap(m *gostatsd.MetricMap) {
+	e.uvarint(uint64(countMetrics(m.Counters)))
+	m.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+		e.string(name)
+		e.string(tagsKey)
+		e.varint(c.Value)
+		e.common(c.Timestamp, c.Hostname, c.Tags, c.TTL)
+	})
+	e.uvarint(uint64(countMetrics(m.Timers)))
+	m.Timers.Each(func(name, tagsKey string, t gostatsd.Timer) {
+		e.string(name)
+		e.string(tagsKey)
+		e.float(t.SampledCount)
+		e.uvarint(uint64(len(t.Values)))
+		for _, v := range t.Values {
+			e.float(v)
+		}
+		e.common(t.Timestamp, t.Hostname, t.Tags, t.TTL)
+	})
+	e.uvarint(uint64(countMetrics(m.Gauges)))
+	m.Gauges.Each(func(name, tagsKey string, g gostatsd.Gauge) {
+		e.string(name)
+		e.string(tagsKey)
+		e.float(g.Value)
+		e.common(g.Timestamp, g.Hostname, g.Tags, g.TTL)
+	})
+	e.uvarint(uint64(countMetrics(m.Sets)))
+	m.Sets.Each(func(name, tagsKey string, s gostatsd.Set) {
+		e.string(name)
+		e.string(tagsKey)
+		var sketch []byte
+		if s.Sketch != nil {
+			sketch, _ = s.Sketch.MarshalBinary()
+		}
+		e.bytes(sketch)
+		e.uvarint(uint64(len(s.Values)))
+		for v := range s.Values {
+			e.string(v)
+		}
+		e.uvarint(uint64(len(s.IntValues)))
+		for v := range s.IntValues {
+			e.varint(v)
+		}
+		e.common(s.Timestamp, s.Hostname, s.Tags, s.TTL)
+	})
+}
+
+// countMetrics returns the number of metrics in a collection, by name then tags.
+func countMetrics(m interface{}) int {
+	n := 0
+	switch m := m.(type) {
+	case gostatsd.Counters:
+		for _, tagged := range m {
+			n += len(tagged)
+		}
+	case gostatsd.Timers:
+		for _, tagged := range m {
+			n += len(tagged)
+		}
+	case gostatsd.Gauges:
+		for _, tagged := range m {
+			n += len(tagged)
+		}
+	case gostatsd.Sets:
+		for _, tagged := range m {
+			n += len(tagged)
+		}
+	}
+	return n
+}
+
+// stateDecoder reads values encoded by stateEncoder.  After the first error every value is zero, and err is set.
+type stateDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *stateDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errStateTruncated
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+func (d *stateDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errStateTruncated
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+func (d *stateDecoder) float() float64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) < 8 {
+		d.err = errStateTruncated
+		return 0
+	}
+	f := math.Float64frombits(binary.BigEndian.Uint64(d.buf))
+	d.buf = d.buf[8:]
+	return f
+}
+
+func (d *stateDecoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = errStateTruncated
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *stateDecoder) string() string {
+	return string(d.bytes())
+}
+
+// count reads the number of elements which follow.  Every element takes at least one byte, so a count larger than
+// the remaining bytes is an error rather than a huge allocation.
+func (d *stateDecoder) count() int {
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(d.buf)) {
+		d.err = errStateTruncated
+		return 0
+	}
+	return int(n)
+}
+
+func (d *stateDecoder) tags() gostatsd.Tags {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	tags := make(gostatsd.Tags, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		tags = append(tags, d.string())
+	}
+	return tags
+}
+
+func (d *stateDecoder) common() (timestamp gostatsd.Nanotime, hostname string, tags gostatsd.Tags, ttl time.Duration) {
+	timestamp = gostatsd.Nanotime(d.varint())
+	hostname = d.string()
+	tags = d.tags()
+	ttl = time.Duration(d.varint())
+	return
+}
+
+// metricMap decodes a MetricMap encoded by stateEncoder.metricMap.
+func (d *stateDecoder) metricMap() (*gostatsd.MetricMap, error) {
+	m := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{},
+		Timers:   gostatsd.Timers{},
+		Gauges:   gostatsd.Gauges{},
+		Sets:     gostatsd.Sets{},
+	}
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		name, tagsKey := d.string(), d.string()
+		c := gostatsd.Counter{Value: d.varint()}
+		c.Timestamp, c.Hostname, c.Tags, c.TTL = d.common()
+		if m.Counters[name] == nil {
+			m.Counters[name] = map[string]gostatsd.Counter{}
+		}
+		m.Counters[name][tagsKey] = c
+	}
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		name, tagsKey := d.string(), d.string()
+		t := gostatsd.Timer{SampledCount: d.float()}
+		if numValues := d.count(); numValues > 0 {
+			t.Values = make([]float64, 0, numValues)
+			for j := 0; j < numValues && d.err == nil; j++ {
+				t.Values = append(t.Values, d.float())
+			}
+		}
+		t.Timestamp, t.Hostname, t.Tags, t.TTL = d.common()
+		if m.Timers[name] == nil {
+			m.Timers[name] = map[string]gostatsd.Timer{}
+		}
+		m.Timers[name][tagsKey] = t
+	}
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		name, tagsKey := d.string(), d.string()
+		g := gostatsd.Gauge{Value: d.float()}
+		g.Timestamp, g.Hostname, g.Tags, g.TTL = d.common()
+		if m.Gauges[name] == nil {
+			m.Gauges[name] = map[string]gostatsd.Gauge{}
+		}
+		m.Gauges[name][tagsKey] = g
+	}
+	for i, n := 0, d.count(); i < n && d.err == nil; i++ {
+		name, tagsKey := d.string(), d.string()
+		var s gostatsd.Set
+		if sketch := d.bytes(); len(sketch) > 0 {
+			s.Sketch = &hll.Sketch{}
+			if err := s.Sketch.UnmarshalBinary(sketch); err != nil {
+				return nil, err
+			}
+		}
+		if numValues := d.count(); numValues > 0 {
+			s.Values = make(map[string]struct{}, numValues)
+			for j := 0; j < numValues && d.err == nil; j++ {
+				s.Values[d.string()] = struct{}{}
+			}
+		}
+		if numValues := d.count(); numValues > 0 {
+			s.IntValues = make(map[int64]struct{}, numValues)
+			for j := 0; j < numValues && d.err == nil; j++ {
+				s.IntValues[d.varint()] = struct{}{}
+			}
+		}
+		s.Timestamp, s.Hostname, s.Tags, s.TTL = d.common()
+		if m.Sets[name] == nil {
+			m.Sets[name] = map[string]gostatsd.Set{}
+		}
+		m.Sets[name][tagsKey] = s
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return m, nil
+}
+
+// writeStateFile writes the sections to path, replacing any existing file only once it has been written in full.
+func writeStateFile(path string, written time.Time, sections []stateSection) error {
+	var e stateEncoder
+	e.buf = append(e.buf, stateMagic...)
+	e.buf = append(e.buf, make([]byte, stateHeaderSize-len(stateMagic))...)
+	binary.BigEndian.PutUint16(e.buf[len(stateMagic):], stateVersion)
+	binary.BigEndian.PutUint64(e.buf[len(stateMagic)+2:], uint64(written.UnixNano()))
+	binary.BigEndian.PutUint32(e.buf[stateHeaderSize-4:], crc32.Checksum(e.buf[:stateHeaderSize-4], castagnoliTable))
+
+	sections = append(sections, stateSection{name: stateSectionEnd})
+	for _, section := range sections {
+		start := len(e.buf)
+		e.string(section.name)
+		e.bytes(section.payload)
+		binary.BigEndian.PutUint32(e.tmp[:4], crc32.Checksum(e.buf[start:], castagnoliTable))
+		e.buf = append(e.buf, e.tmp[:4]...)
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, e.buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// savedState is the state read from a state file.
+type savedState struct {
+	written  time.Time
+	metrics  []*gostatsd.MetricMap // The metrics of each aggregator when the file was written
+	backends map[string][]byte     // The state of each StatefulBackend, by name
+	skipped  []string              // The names of the sections which were not understood
+}
+
+// readStateFile reads a state file written by writeStateFile, which must have been written no more than maxAge
+// before now.
+func readStateFile(path string, now time.Time, maxAge time.Duration) (*savedState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < stateHeaderSize {
+		return nil, errStateTruncated
+	}
+	if string(data[:len(stateMagic)]) != stateMagic {
+		return nil, errors.New("not a state file")
+	}
+	if crc32.Checksum(data[:stateHeaderSize-4], castagnoliTable) != binary.BigEndian.Uint32(data[stateHeaderSize-4:]) {
+		return nil, errors.New("state file header checksum mismatch")
+	}
+	if version := binary.BigEndian.Uint16(data[len(stateMagic):]); version > stateVersion {
+		return nil, fmt.Errorf("unsupported state file version %d", version)
+	}
+	state := &savedState{
+		written:  time.Unix(0, int64(binary.BigEndian.Uint64(data[len(stateMagic)+2:]))),
+		backends: map[string][]byte{},
+	}
+	if age := now.Sub(state.written); age > maxAge {
+		return nil, fmt.Errorf("state file is stale, written %v ago", age.Round(time.Second))
+	}
+
+	d := stateDecoder{buf: data[stateHeaderSize:]}
+	for {
+		start := d.buf
+		name := d.bytes()
+		if d.err == nil && len(name) > maxStateSectionName {
+			return nil, errors.New("state file section name too long")
+		}
+		payload := d.bytes()
+		if d.err != nil {
+			return nil, d.err
+		}
+		if len(d.buf) < 4 {
+			return nil, errStateTruncated
+		}
+		checked := start[:len(start)-len(d.buf)]
+		if crc32.Checksum(checked, castagnoliTable) != binary.BigEndian.Uint32(d.buf) {
+			return nil, fmt.Errorf("state file checksum mismatch in section %q", name)
+		}
+		d.buf = d.buf[4:]
+
+		switch sectionName := string(name); {
+		case sectionName == stateSectionEnd:
+			return state, nil
+		case sectionName == stateSectionAggregator:
+			pd := stateDecoder{buf: payload}
+			m, err := pd.metricMap()
+			if err != nil {
+				return nil, fmt.Errorf("invalid state file section %q: %v", sectionName, err)
+			}
+			state.metrics = append(state.metrics, m)
+		case strings.HasPrefix(sectionName, stateSectionBackendPrefix):
+			state.backends[strings.TrimPrefix(sectionName, stateSectionBackendPrefix)] = payload
+		default:
+			state.skipped = append(state.skipped, sectionName)
+		}
+	}
+}
+
+// saveState writes the metrics of every aggregator, and the state of every gostatsd.StatefulBackend, to path.  The
+// names are the names of the backends, as used to restore them.  Backends whose state can't be saved are logged to
+// logger.
+func saveState(ctx context.Context, path string, now time.Time, processer AggregateProcesser, backends []gostatsd.Backend, names []string, logger log.FieldLogger) error {
+	var mu sync.Mutex
+	var sections []stateSection
+	wait := processer.Process(ctx, func(aggrID int, aggr Aggregator) {
+		aggr.Process(func(m *gostatsd.MetricMap) {
+			var e stateEncoder
+			e.metricMap(m)
+			mu.Lock()
+			sections = append(sections, stateSection{name: stateSectionAggregator, payload: e.buf})
+			mu.Unlock()
+		})
+	})
+	wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for i, b := range backends {
+		state, err := gostatsd.SaveBackendState(b)
+		if err != nil {
+			logger.WithError(err).WithField(logging.FieldBackend, names[i]).Warn("Failed to save the state of backend")
+			continue
+		}
+		if state != nil {
+			sections = append(sections, stateSection{name: stateSectionBackendPrefix + names[i], payload: state})
+		}
+	}
+	return writeStateFile(path, now, sections)
+}
+
+// loadState reads the state file at path and removes it, so the same state is never restored twice.  A missing,
+// stale or corrupt file is logged to logger and ignored, returning nil.
+func loadState(path string, now time.Time, maxAge time.Duration, logger log.FieldLogger) *savedState {
+	state, err := readStateFile(path, now, maxAge)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if e := os.Remove(path); e != nil && !os.IsNotExist(e) {
+		logger.WithError(e).WithField("path", path).Warn("Failed to remove state file")
+	}
+	if err != nil {
+		logger.WithError(err).WithField("path", path).Warn("Ignoring state file")
+		return nil
+	}
+	if len(state.skipped) > 0 {
+		logger.Infof("Skipped unknown sections of state file %s: %s", path, strings.Join(state.skipped, ", "))
+	}
+	return state
+}
+
+// restoreBackends restores the state of each gostatsd.StatefulBackend which was saved under the same name, logging
+// those which fail to logger.
+func (s *savedState) restoreBackends(backends []gostatsd.Backend, names []string, logger log.FieldLogger) {
+	for i, b := range backends {
+		if state, ok := s.backends[names[i]]; ok {
+			if err := gostatsd.RestoreBackendState(b, state); err != nil {
+				logger.WithError(err).WithField(logging.FieldBackend, names[i]).Warn("Failed to restore the state of backend")
+			}
+		}
+	}
+}
+
+// restoreAggregators adds the saved metrics to the aggregator which receives metrics of the same type, name and
+// host, unless it already has the metric.  aggregatorID returns the id of the aggregator run by processer which
+// receives a metric, which may differ from when the state was saved.
+func (s *savedState) restoreAggregators(ctx context.Context, processer AggregateProcesser, aggregatorID func(*gostatsd.Metric) int) {
+	owns := func(aggrID int, metricType gostatsd.MetricType, name, hostname string) bool {
+		return aggregatorID(&gostatsd.Metric{Type: metricType, Name: name, Hostname: hostname}) == aggrID
+	}
+	wait := processer.Process(ctx, func(aggrID int, aggr Aggregator) {
+		aggr.Process(func(m *gostatsd.MetricMap) {
+			for _, saved := range s.metrics {
+				saved.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+					if _, ok := m.Counters[name][tagsKey]; !ok && owns(aggrID, gostatsd.COUNTER, name, c.Hostname) {
+						if m.Counters[name] == nil {
+							m.Counters[name] = map[string]gostatsd.Counter{}
+						}
+						m.Counters[name][tagsKey] = c
+					}
+				})
+				saved.Timers.Each(func(name, tagsKey string, t gostatsd.Timer) {
+					if _, ok := m.Timers[name][tagsKey]; !ok && owns(aggrID, gostatsd.TIMER, name, t.Hostname) {
+						if m.Timers[name] == nil {
+							m.Timers[name] = map[string]gostatsd.Timer{}
+						}
+						m.Timers[name][tagsKey] = t
+					}
+				})
+				saved.Gauges.Each(func(name, tagsKey string, g gostatsd.Gauge) {
+					if _, ok := m.Gauges[name][tagsKey]; !ok && owns(aggrID, gostatsd.GAUGE, name, g.Hostname) {
+						if m.Gauges[name] == nil {
+							m.Gauges[name] = map[string]gostatsd.Gauge{}
+						}
+						m.Gauges[name][tagsKey] = g
+					}
+				})
+				saved.Sets.Each(func(name, tagsKey string, set gostatsd.Set) {
+					if _, ok := m.Sets[name][tagsKey]; !ok && owns(aggrID, gostatsd.SET, name, set.Hostname) {
+						if m.Sets[name] == nil {
+							m.Sets[name] = map[string]gostatsd.Set{}
+						}
+						m.Sets[name][tagsKey] = set
+					}
+				})
+			}
+		})
+	})
+	wait()
+}
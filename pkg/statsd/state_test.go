@@ -0,0 +1,239 @@
+package statsd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// multiAggregator is an AggregateProcesser over several aggregators, run synchronously.
+type multiAggregator []Aggregator
+
+func (ma multiAggregator) Process(ctx context.Context, fn DispatcherProcessFunc) gostatsd.Wait {
+	for i, agg := range ma {
+		fn(i, agg)
+	}
+	return func() {}
+}
+
+// statefulBackend is a gostatsd.StatefulBackend which saves and restores state.
+type statefulBackend struct {
+	state []byte
+}
+
+func (sb *statefulBackend) Name() string {
+	return "stateful"
+}
+
+func (sb *statefulBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	cb(nil)
+}
+
+func (sb *statefulBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func (sb *statefulBackend) SaveState() ([]byte, error) {
+	return sb.state, nil
+}
+
+func (sb *statefulBackend) RestoreState(state []byte) error {
+	sb.state = state
+	return nil
+}
+
+func newStateAggregator() *MetricAggregator {
+	return NewMetricAggregator(aggregation.Options{ExpiryInterval: 5 * time.Minute, SetExactLimit: 3}, nil, nil, nil)
+}
+
+func tempStateFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "state")
+	require.NoError(t, err)
+	return filepath.Join(dir, "state"), func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestSaveAndRestoreState(t *testing.T) {
+	t.Parallel()
+	path, cleanup := tempStateFile(t)
+	defer cleanup()
+
+	agg := newStateAggregator()
+	now := time.Unix(1000, 0)
+	receive := func(m gostatsd.Metric) {
+		m.TagsKey = formatTagsKey(m.Tags, m.Hostname)
+		agg.Receive(&m, now)
+	}
+	receive(gostatsd.Metric{Name: "c", Value: 3, Type: gostatsd.COUNTER, Rate: 0.5, Tags: gostatsd.Tags{"a:1"}, Hostname: "h1"})
+	receive(gostatsd.Metric{Name: "c", Value: 1, Type: gostatsd.COUNTER, Rate: 1, Hostname: "h2", TTL: time.Minute})
+	receive(gostatsd.Metric{Name: "t", Value: 10, Type: gostatsd.TIMER, Rate: 1})
+	receive(gostatsd.Metric{Name: "t", Value: 20, Type: gostatsd.TIMER, Rate: 0.1})
+	receive(gostatsd.Metric{Name: "g", Value: 1.5, Type: gostatsd.GAUGE, Rate: 1})
+	receive(gostatsd.Metric{Name: "s", StringValue: "joe", Type: gostatsd.SET, Rate: 1})
+	receive(gostatsd.Metric{Name: "s", StringValue: "42", Type: gostatsd.SET, Rate: 1})
+	for _, member := range []string{"1", "2", "3", "4"} {
+		receive(gostatsd.Metric{Name: "approx", StringValue: member, Type: gostatsd.SET, Rate: 1})
+	}
+	require.True(t, agg.Sets["approx"][""].Approximate())
+
+	backend := &statefulBackend{state: []byte("totals")}
+	backends := []gostatsd.Backend{backend, &timerBackend{}}
+	names := []string{"stateful", "timer"}
+	require.NoError(t, saveState(context.Background(), path, now, &singleAggregator{agg: agg}, backends, names, logrus.StandardLogger()))
+
+	state := loadState(path, now.Add(time.Minute), time.Hour, logrus.StandardLogger())
+	require.NotNil(t, state)
+	assert.Equal(t, now, state.written)
+	assert.Empty(t, state.skipped)
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "state file should be removed once loaded")
+
+	backend.state = nil
+	state.restoreBackends(backends, names, logrus.StandardLogger())
+	assert.Equal(t, []byte("totals"), backend.state)
+
+	// The metrics are split between the aggregators which would have received them.
+	restored := multiAggregator{newStateAggregator(), newStateAggregator(), newStateAggregator()}
+	state.restoreAggregators(context.Background(), restored, func(m *gostatsd.Metric) int {
+		return m.Bucket(len(restored))
+	})
+	merged := newStateAggregator()
+	for i, a := range restored {
+		a.Process(func(m *gostatsd.MetricMap) {
+			m.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+				assert.Equal(t, i, (&gostatsd.Metric{Name: name, Hostname: c.Hostname}).Bucket(len(restored)))
+			})
+			mergeMetricMap(&merged.MetricMap, m)
+		})
+	}
+	assert.Equal(t, agg.Counters, merged.Counters)
+	assert.Equal(t, agg.Timers, merged.Timers)
+	assert.Equal(t, agg.Gauges, merged.Gauges)
+	assert.Equal(t, agg.Sets, merged.Sets)
+}
+
+// mergeMetricMap adds the metrics of src to dst.
+func mergeMetricMap(dst, src *gostatsd.MetricMap) {
+	src.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+		if dst.Counters[name] == nil {
+			dst.Counters[name] = map[string]gostatsd.Counter{}
+		}
+		dst.Counters[name][tagsKey] = c
+	})
+	src.Timers.Each(func(name, tagsKey string, t gostatsd.Timer) {
+		if dst.Timers[name] == nil {
+			dst.Timers[name] = map[string]gostatsd.Timer{}
+		}
+		dst.Timers[name][tagsKey] = t
+	})
+	src.Gauges.Each(func(name, tagsKey string, g gostatsd.Gauge) {
+		if dst.Gauges[name] == nil {
+			dst.Gauges[name] = map[string]gostatsd.Gauge{}
+		}
+		dst.Gauges[name][tagsKey] = g
+	})
+	src.Sets.Each(func(name, tagsKey string, s gostatsd.Set) {
+		if dst.Sets[name] == nil {
+			dst.Sets[name] = map[string]gostatsd.Set{}
+		}
+		dst.Sets[name][tagsKey] = s
+	})
+}
+
+func TestRestoreStateKeepsExistingMetrics(t *testing.T) {
+	t.Parallel()
+	saved := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{},
+		Timers:   gostatsd.Timers{},
+		Gauges:   gostatsd.Gauges{"g": {"": {Value: 1}, "a:1": {Value: 2}}},
+		Sets:     gostatsd.Sets{},
+	}
+	agg := newStateAggregator()
+	agg.Gauges["g"] = map[string]gostatsd.Gauge{"": {Value: 5}}
+
+	state := &savedState{metrics: []*gostatsd.MetricMap{saved}}
+	state.restoreAggregators(context.Background(), &singleAggregator{agg: agg}, func(*gostatsd.Metric) int {
+		return 0
+	})
+	assert.Equal(t, gostatsd.Gauges{"g": {"": {Value: 5}, "a:1": {Value: 2}}}, agg.Gauges)
+}
+
+func TestReadStateFile(t *testing.T) {
+	t.Parallel()
+	path, cleanup := tempStateFile(t)
+	defer cleanup()
+	written := time.Unix(1000, 0)
+
+	var e stateEncoder
+	e.metricMap(&gostatsd.MetricMap{Gauges: gostatsd.Gauges{"g": {"": {Value: 1}}}})
+	sections := []stateSection{
+		{name: stateSectionAggregator, payload: e.buf},
+		{name: "future", payload: []byte("unknown")},
+		{name: stateSectionBackendPrefix + "stackdriver", payload: []byte("{}")},
+	}
+	require.NoError(t, writeStateFile(path, written, sections))
+	valid, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	// Unknown sections are skipped.
+	state, err := readStateFile(path, written, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, state.metrics, 1)
+	assert.Equal(t, 1.0, state.metrics[0].Gauges["g"][""].Value)
+	assert.Equal(t, []string{"future"}, state.skipped)
+	assert.Equal(t, map[string][]byte{"stackdriver": []byte("{}")}, state.backends)
+
+	_, err = readStateFile(path, written.Add(2*time.Minute), time.Minute)
+	assert.Error(t, err, "stale")
+
+	invalid := map[string][]byte{
+		"truncated":        valid[:len(valid)-3],
+		"no end section":   valid[:len(valid)-len(stateSectionEnd)-6],
+		"short header":     valid[:10],
+		"not a state file": append([]byte("NOTSTATE"), valid[len(stateMagic):]...),
+	}
+	corrupt := append([]byte(nil), valid...)
+	corrupt[len(corrupt)-20] ^= 0xff
+	invalid["corrupt section"] = corrupt
+	corrupt = append([]byte(nil), valid...)
+	corrupt[len(stateMagic)+5] ^= 0xff
+	invalid["corrupt header"] = corrupt
+	for name, data := range invalid {
+		require.NoError(t, ioutil.WriteFile(path, data, 0600))
+		_, err := readStateFile(path, written, time.Minute)
+		assert.Error(t, err, name)
+	}
+
+	// A newer version is not understood.
+	require.NoError(t, writeStateFile(path, written, nil))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[len(stateMagic)+1]++
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+	_, err = readStateFile(path, written, time.Minute)
+	assert.Error(t, err)
+}
+
+func TestLoadStateIgnoresInvalidFiles(t *testing.T) {
+	t.Parallel()
+	path, cleanup := tempStateFile(t)
+	defer cleanup()
+
+	assert.Nil(t, loadState(path, time.Now(), time.Minute, logrus.StandardLogger()))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("garbage"), 0600))
+	assert.Nil(t, loadState(path, time.Now(), time.Minute, logrus.StandardLogger()))
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "invalid state file should be removed")
+}
@@ -2,13 +2,22 @@ package statsd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
+	"github.com/atlassian/gostatsd/pkg/console"
+	"github.com/atlassian/gostatsd/pkg/exphist"
+	"github.com/atlassian/gostatsd/pkg/hdrhist"
+	"github.com/atlassian/gostatsd/pkg/logging"
 	stats "github.com/atlassian/gostatsd/pkg/statser"
 
 	"github.com/ash2k/stager"
@@ -22,17 +31,23 @@ import (
 // the statsd server. These can either be set via command line or directly.
 type Server struct {
 	Backends                  []gostatsd.Backend
+	BackendNames              []string
 	CloudProvider             gostatsd.CloudProvider
 	Limiter                   *rate.Limiter
 	InternalTags              gostatsd.Tags
 	InternalNamespace         string
+	InternalPrefix            string // If not empty, the namespace of internal metrics, replacing Namespace and InternalNamespace
 	DefaultTags               gostatsd.Tags
 	ExpiryInterval            time.Duration
 	FlushInterval             time.Duration
+	ForceFlushInterval        bool // Allow a flush interval shorter than MinFlushInterval
 	MaxReaders                int
 	MaxParsers                int
 	MaxWorkers                int
+	SeparateTypeWorkers       bool
 	MaxQueueSize              int
+	AutoTune                  bool
+	ExpectedPacketsPerSecond  int
 	MaxConcurrentEvents       int
 	MaxEventQueueSize         int
 	EstimatedTags             int
@@ -40,25 +55,156 @@ type Server struct {
 	Namespace                 string
 	StatserType               string
 	PercentThreshold          []float64
+	TimerUnderThresholds      []float64
+	PercentileInterpolation   string
+	CounterOverflow           string
+	ColdStart                 string
+	FlushWarmup               time.Duration
+	GaugeEWMAMatch            []string
+	GaugeEWMADecay            float64
+	GaugeDerivativeMatch      []string
+	GaugeMinMax               bool
+	GaugeConflict             []string
+	PeakMatch                 []string
+	PeakWindows               []time.Duration
 	IgnoreHost                bool
 	ConnPerReader             bool
 	HeartbeatEnabled          bool
 	HeartbeatTags             gostatsd.Tags
+	BuildInfoTags             gostatsd.Tags
 	ReceiveBatchSize          int
 	DisabledSubTypes          gostatsd.TimerSubtypes
 	BadLineRateLimitPerSecond rate.Limit
+	LogFlushSummary           bool
+	SortMetrics               bool
+	TimerRate                 bool
+	RetryFailedFlushes        bool
+	GaugeFlapThreshold        int
+	ReceiveQueuePolicy        string
+	ReceiveQueueSize          int
+	ReceiveQueueMaxAge        time.Duration
+	ConsoleAddr               string
+	APIAddr                   string
+	AdminAPIAddr              string
+	AdminAPIToken             string
+	CaptureDir                string
+	CaptureMaxBytes           int64
+	TagListener               bool
+	DisablePacketAggregation  bool
+	MaxMetricTTL              time.Duration
+	DisableMetricTTL          bool
+	TCPMetricsAddr            string
+	HTTPMetricsAddr           string
+	MaxDecompressionRatio     float64
+	MaxTCPConns               int
+	TCPIdleTimeout            time.Duration
+	SetDelimiter              string
+	SetExactLimit             int
+	CounterGracePeriod        time.Duration
+	SourceBlocklist           string
+	SampleRateRules           string
+	GaugeDeltaRules           string
+	RulesFile                 string
+	MaxComponentRestarts      int
+	DedupWindow               time.Duration
+	MetricDedupWindow         time.Duration
+	MetricDedupMatch          []string
+	TraceMetrics              string
+	TraceMetricsDuration      time.Duration
+	MetricsAddrCounters       string
+	MetricsAddrGauges         string
+	MetricsAddrTimers         string
+	MetricsAddrSets           string
+	TypedPortPolicy           string
+	UnknownTypePolicy         string
+	NameWhitespace            string // Handling of whitespace in metric names, one of the NameWhitespace* values
+	MaxTags                   int
+	MaxTagKeyLength           int
+	MaxTagValueLength         int
+	TagLimitPolicy            string
+	NormalizeTags             bool
+	StateFile                 string
+	StateMaxAge               time.Duration
+	JournalFile               string
+	JournalMatch              []string
+	JournalSyncInterval       time.Duration
+	JournalQueueSize          int
+	PipelineTraceRate         int
+	Lint                      bool
+	LintRules                 []string
+	ContainerResolver         string
+	DockerSocket              string
+	ContainerCacheTTL         time.Duration
+	StripContainerID          bool
+	RecentLinesMaxBytes       int64
+	GRPCAddr                  string
+	LateArrivalWindow         time.Duration
+	FlushHistory              int
+	ClockSkewPolicy           string
+	ClockSkewWindow           time.Duration
+	ClockSkewLearnWindow      time.Duration
+	ClockSkewMaxSources       int
+	LastSeenMaxSources        int           // Maximum number of sources tracked by when they last sent, 0 to disable
+	LastSeenExpiry            time.Duration // Forget a source which has been silent this long
+	SilentSourceThreshold     time.Duration // Report a source which has been silent this long, 0 to disable
+	TimerAggregation          string
+	ExpHistogramScale         int
+	ExpHistogramMaxBuckets    int
+	HDRMatch                  []string
+	HDRSignificantDigits      int
+	HDRMaxValue               float64
+	Processors                []Processor // Applied to each metric after the built-in filters, for embedders to add stages
 	CacheOptions
-	Viper *viper.Viper
+	Viper    *viper.Viper
+	Logger   log.FieldLogger // Logs of the server and its components, the standard logger if nil
+	Registry *stats.Registry // Records the internal metrics as well, to be served in the Prometheus format, may be nil
 }
 
 // Run runs the server until context signals done.
 func (s *Server) Run(ctx context.Context) error {
-	return s.RunWithCustomSocket(ctx, socketFactory(s.MetricsAddr, s.ConnPerReader))
+	var listeners []MetricListener
+	for _, typed := range []struct {
+		addrs      string
+		metricType gostatsd.MetricType
+	}{
+		{s.MetricsAddr, 0},
+		{s.MetricsAddrCounters, gostatsd.COUNTER},
+		{s.MetricsAddrGauges, gostatsd.GAUGE},
+		{s.MetricsAddrTimers, gostatsd.TIMER},
+		{s.MetricsAddrSets, gostatsd.SET},
+	} {
+		for _, addr := range splitMetricsAddr(typed.addrs) {
+			listeners = append(listeners, MetricListener{
+				Addr:          addr,
+				SocketFactory: socketFactory(addr, s.ConnPerReader),
+				Type:          typed.metricType,
+			})
+		}
+	}
+	return s.RunWithCustomSockets(ctx, listeners)
 }
 
 // SocketFactory is an indirection layer over net.ListenPacket() to allow for different implementations.
 type SocketFactory func() (net.PacketConn, error)
 
+// MetricListener is an address to receive metrics on.
+type MetricListener struct {
+	Addr          string // The address, used to tag metrics when TagListener is set
+	SocketFactory SocketFactory
+	Type          gostatsd.MetricType // The type of the metrics received, 0 for any type
+}
+
+// splitMetricsAddr splits a comma separated list of addresses.
+func splitMetricsAddr(metricsAddr string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(metricsAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
 func socketFactory(metricsAddr string, connPerReader bool) SocketFactory {
 	if connPerReader {
 		// go-reuseport requires explicitly representing the unspecified address
@@ -82,32 +228,356 @@ func socketFactory(metricsAddr string, connPerReader bool) SocketFactory {
 // RunWithCustomSocket runs the server until context signals done.
 // Listening socket is created using sf.
 func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) error {
+	return s.RunWithCustomSockets(ctx, []MetricListener{{Addr: s.MetricsAddr, SocketFactory: sf}})
+}
+
+// Validate checks the configuration of the server, without starting anything.  RunWithCustomSockets validates the
+// configuration first, so it need only be called to check a configuration without running the server.
+func (s *Server) Validate() error {
+	switch s.ReceiveQueuePolicy {
+	case "", ReceiveQueueDropNewest, ReceiveQueueDropOldest:
+	default:
+		return fmt.Errorf("unknown receive queue policy %q", s.ReceiveQueuePolicy)
+	}
+	switch s.TypedPortPolicy {
+	case "", TypedPortCoerce, TypedPortDrop, TypedPortAccept:
+	default:
+		return fmt.Errorf("unknown typed port policy %q", s.TypedPortPolicy)
+	}
+	switch s.UnknownTypePolicy {
+	case "", UnknownTypeDrop, UnknownTypeCounter, UnknownTypeLog:
+	default:
+		return fmt.Errorf("invalid unknown type policy %q", s.UnknownTypePolicy)
+	}
+	switch s.NameWhitespace {
+	case "", NameWhitespaceUnderscore, NameWhitespaceTrimTrailing, NameWhitespaceTrim, NameWhitespaceCollapse:
+	default:
+		return fmt.Errorf("invalid name whitespace policy %q", s.NameWhitespace)
+	}
+	switch s.TagLimitPolicy {
+	case "", TagLimitTruncate, TagLimitReject:
+	default:
+		return fmt.Errorf("unknown tag limit policy %q", s.TagLimitPolicy)
+	}
+	if s.MaxTags < 0 || s.MaxTagKeyLength < 0 || s.MaxTagValueLength < 0 {
+		return errors.New("tag limits must not be negative")
+	}
+	switch s.PercentileInterpolation {
+	case "", PercentileNearestRank, PercentileLinear:
+	default:
+		return fmt.Errorf("unknown percentile interpolation %q", s.PercentileInterpolation)
+	}
+	switch s.CounterOverflow {
+	case "", CounterOverflowSaturate, CounterOverflowWrap:
+	default:
+		return fmt.Errorf("unknown counter overflow policy %q", s.CounterOverflow)
+	}
+	switch s.ColdStart {
+	case "", ColdStartNone, ColdStartSuppress, ColdStartMark, ColdStartScale:
+	default:
+		return fmt.Errorf("unknown cold start mode %q", s.ColdStart)
+	}
+	if s.RecentLinesMaxBytes < 0 {
+		return fmt.Errorf("recent lines max bytes %d must not be negative", s.RecentLinesMaxBytes)
+	}
+	if s.FlushHistory < 0 {
+		return fmt.Errorf("flush history %d must not be negative", s.FlushHistory)
+	}
+	switch s.ClockSkewPolicy {
+	case "", ClockSkewOff:
+	case ClockSkewClamp, ClockSkewShift, ClockSkewReject:
+		if s.ClockSkewWindow <= 0 {
+			return fmt.Errorf("clock skew window %v must be positive", s.ClockSkewWindow)
+		}
+		if s.ClockSkewLearnWindow <= 0 {
+			return fmt.Errorf("clock skew learn window %v must be positive", s.ClockSkewLearnWindow)
+		}
+		if s.ClockSkewMaxSources <= 0 {
+			return fmt.Errorf("clock skew max sources %d must be positive", s.ClockSkewMaxSources)
+		}
+	default:
+		return fmt.Errorf("unknown clock skew policy %q", s.ClockSkewPolicy)
+	}
+	if s.LastSeenMaxSources < 0 {
+		return fmt.Errorf("last seen max sources %d must not be negative", s.LastSeenMaxSources)
+	}
+	if s.LastSeenMaxSources > 0 {
+		if s.LastSeenExpiry <= 0 {
+			return fmt.Errorf("last seen expiry %v must be positive", s.LastSeenExpiry)
+		}
+		if s.SilentSourceThreshold < 0 || s.SilentSourceThreshold >= s.LastSeenExpiry {
+			return fmt.Errorf("silent source threshold %v must not be negative, and must be less than the last seen expiry %v", s.SilentSourceThreshold, s.LastSeenExpiry)
+		}
+	}
+	switch s.TimerAggregation {
+	case "", TimerAggregationSamples:
+	case TimerAggregationExpHistogram:
+		if s.ExpHistogramScale < exphist.MinScale || s.ExpHistogramScale > exphist.MaxScale {
+			return fmt.Errorf("exponential histogram scale %d must be between %d and %d", s.ExpHistogramScale, exphist.MinScale, exphist.MaxScale)
+		}
+		if s.ExpHistogramMaxBuckets < exphist.MinBuckets {
+			return fmt.Errorf("exponential histogram max buckets %d must be at least %d", s.ExpHistogramMaxBuckets, exphist.MinBuckets)
+		}
+	default:
+		return fmt.Errorf("unknown timer aggregation %q", s.TimerAggregation)
+	}
+	if len(s.HDRMatch) > 0 {
+		if s.HDRSignificantDigits < hdrhist.MinSignificantDigits || s.HDRSignificantDigits > hdrhist.MaxSignificantDigits {
+			return fmt.Errorf("HDR significant digits %d must be between %d and %d", s.HDRSignificantDigits, hdrhist.MinSignificantDigits, hdrhist.MaxSignificantDigits)
+		}
+		if s.HDRMaxValue < 2*HDRLowestValue {
+			return fmt.Errorf("HDR max value %v must be at least %v", s.HDRMaxValue, 2*HDRLowestValue)
+		}
+	}
+	if s.LateArrivalWindow < 0 {
+		return fmt.Errorf("late arrival window %v must not be negative", s.LateArrivalWindow)
+	}
+	if s.LateArrivalWindow > 0 && !s.Lint && !wantsBackfill(s.Backends) {
+		return errors.New("the late arrival window requires a backend which backfills, such as newrelic")
+	}
+	switch s.ContainerResolver {
+	case "", ContainerResolverNone:
+	case ContainerResolverDocker:
+		if s.ContainerCacheTTL <= 0 {
+			return fmt.Errorf("container cache ttl %v must be positive", s.ContainerCacheTTL)
+		}
+	default:
+		return fmt.Errorf("unknown container resolver %q", s.ContainerResolver)
+	}
+	if s.GaugeEWMADecay < 0 || s.GaugeEWMADecay >= 1 {
+		return fmt.Errorf("gauge EWMA decay %v must be at least 0 and less than 1", s.GaugeEWMADecay)
+	}
+	if len(s.PeakMatch) > 0 && len(s.PeakWindows) == 0 {
+		return errors.New("peak tracking requires at least one peak window")
+	}
+	for _, window := range s.PeakWindows {
+		if len(s.PeakMatch) > 0 && window < s.FlushInterval {
+			return fmt.Errorf("peak window %v must not be shorter than the flush interval %v", window, s.FlushInterval)
+		}
+	}
+	if s.MaxTCPConns < 0 {
+		return fmt.Errorf("negative max tcp conns %d", s.MaxTCPConns)
+	}
+	if s.TCPIdleTimeout < 0 {
+		return fmt.Errorf("negative tcp idle timeout %v", s.TCPIdleTimeout)
+	}
+	if s.MaxDecompressionRatio < 0 {
+		return fmt.Errorf("negative max decompression ratio %v", s.MaxDecompressionRatio)
+	}
+	if s.MaxMetricTTL < 0 {
+		return fmt.Errorf("negative max metric ttl %v", s.MaxMetricTTL)
+	}
+	if s.AdminAPIAddr != "" && s.AdminAPIToken == "" {
+		return errors.New("the admin API requires an admin API token")
+	}
+	if s.PipelineTraceRate < 0 {
+		return fmt.Errorf("negative pipeline trace rate %d", s.PipelineTraceRate)
+	}
+	if s.MetricDedupWindow > 0 && len(s.MetricDedupMatch) == 0 {
+		return errors.New("metric deduplication requires at least one metric name pattern to match")
+	}
+	if s.ExpectedPacketsPerSecond < 0 {
+		return fmt.Errorf("negative expected packets per second %d", s.ExpectedPacketsPerSecond)
+	}
+	if s.FlushInterval <= 0 {
+		return fmt.Errorf("flush interval %v must be positive", s.FlushInterval)
+	}
+	if s.FlushInterval < MinFlushInterval && !s.ForceFlushInterval {
+		return fmt.Errorf("flush interval %v is shorter than %v, which may leave too little time to aggregate between flushes, set --%s to use it anyway", s.FlushInterval, MinFlushInterval, ParamForceFlushInterval)
+	}
+	if s.FlushWarmup < 0 {
+		return fmt.Errorf("negative flush warmup %v", s.FlushWarmup)
+	}
+	if s.MaxComponentRestarts < 0 {
+		return fmt.Errorf("negative max component restarts %d", s.MaxComponentRestarts)
+	}
+	if s.JournalFile != "" {
+		if len(s.JournalMatch) == 0 {
+			return errors.New("the journal requires at least one metric name pattern to match")
+		}
+		if s.JournalSyncInterval <= 0 {
+			return fmt.Errorf("journal sync interval %v must be positive", s.JournalSyncInterval)
+		}
+		if s.JournalQueueSize <= 0 {
+			return fmt.Errorf("journal queue size %d must be positive", s.JournalQueueSize)
+		}
+	}
+	if _, err := NewGaugeConflicts(s.GaugeConflict); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RunWithCustomSockets runs the server until context signals done.
+// Listening sockets are created using the SocketFactory of each listener.
+func (s *Server) RunWithCustomSockets(ctx context.Context, listeners []MetricListener) error {
+	if len(listeners) == 0 {
+		return errors.New("no metrics address to listen on")
+	}
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	tuning := s.tuning()
+	if s.AutoTune {
+		tuning = AutoTune(runtime.GOMAXPROCS(0), s.ExpectedPacketsPerSecond)
+		s.applyTuning(tuning)
+	}
+	logger := s.logger()
+	logger.Infof("Tuning: %s", tuning)
+	derived, err := NewDerivedMetricsFromViper(s.Viper)
+	if err != nil {
+		return err
+	}
+	aggregations, err := NewAggregationRulesFromViper(s.Viper)
+	if err != nil {
+		return err
+	}
+	router, err := NewRouterFromViper(s.Viper, s.backendNames())
+	if err != nil {
+		return err
+	}
+	redactor, err := NewRedactorFromViper(s.Viper, logging.ComponentOf(logger, "redactor"))
+	if err != nil {
+		return err
+	}
+	linter, err := NewNameLinter(s.Backends, s.LintRules)
+	if err != nil {
+		return err
+	}
+	linter.logger = logging.ComponentOf(logger, "lint")
+	backends := s.Backends
+	if s.Lint {
+		// Nothing is sent in lint mode, the names of metrics are only checked against the naming rules.
+		logger.Info("Running in lint mode, metrics and events will not be sent to backends")
+		backends = []gostatsd.Backend{&lintBackend{linter: linter}}
+		router = nil
+	}
+
+	if s.FlushInterval < baselineCheckInterval {
+		baseline := processFlushBaseline()
+		if safe := baseline.SafeFlushInterval(len(backends)); s.FlushInterval < safe {
+			logger.WithFields(log.Fields{
+				"flush_interval":      s.FlushInterval,
+				"safe_flush_interval": safe,
+				"backends":            len(backends),
+				"baseline":            baseline.String(),
+			}).Warn("Flush interval is shorter than the estimated safe interval from a baseline flush, metrics may be dropped while flushing")
+		}
+	}
+
+	var state *savedState
+	if s.StateFile != "" {
+		state = loadState(s.StateFile, time.Now(), s.StateMaxAge, logging.ComponentOf(logger, "state"))
+		if state != nil {
+			state.restoreBackends(s.Backends, s.backendNames(), logging.ComponentOf(logger, "state"))
+		}
+	}
+
+	// Every long-lived goroutine which processes metrics is supervised, and restarted if it panics.
+	sup := NewSupervisor(s.MaxComponentRestarts)
+	sup.logger = logging.ComponentOf(logger, "supervisor")
+	// The short-lived goroutines of the backends and the console are run by the supervisor too, through the context.
+	ctx = gostatsd.WithGoRunner(ctx, sup)
 	stgr := stager.New()
 	defer stgr.Shutdown()
 	// 0. Start runnable backends
 	stage := stgr.NextStage()
-	for _, b := range s.Backends {
+	for _, b := range backends {
 		if b, ok := b.(gostatsd.RunnableBackend); ok {
-			stage.StartWithContext(b.Run)
+			stage.StartWithContext(sup.Wrap("backend_"+b.Name(), b.Run))
 		}
 	}
 
+	tracer := NewMetricTracer(logging.ComponentOf(logger, "tracer"))
+	defer tracer.Stop("shutting down")
+	if s.TraceMetrics != "" {
+		if err := tracer.Start(s.TraceMetrics, s.TraceMetricsDuration); err != nil {
+			return err
+		}
+	}
+
+	thresholds := NewPercentThresholds(s.PercentThreshold)
+
+	var gaugeConflicts *GaugeConflicts
+	if len(s.GaugeConflict) > 0 {
+		var err error
+		if gaugeConflicts, err = NewGaugeConflicts(s.GaugeConflict); err != nil {
+			return err
+		}
+	}
+
+	hostname := getHost(logger)
+	namespace := InternalMetricsPrefix(s.Namespace, s.InternalNamespace, s.InternalPrefix)
+	var coldStart *ColdStart
+	if s.ColdStart != "" && s.ColdStart != ColdStartNone {
+		coldStart = NewColdStart(s.ColdStart, namespace, hostname, s.InternalTags)
+	}
+
 	// 1. Start the backend handler
 	factory := agrFactory{
-		percentThresholds: s.PercentThreshold,
-		expiryInterval:    s.ExpiryInterval,
-		disabledSubtypes:  s.DisabledSubTypes,
+		opts:       s.aggregationOptions(wantsRawTimers(backends), gaugeConflicts, logging.ComponentOf(logger, "aggregator")),
+		tracer:     tracer,
+		thresholds: thresholds,
+		coldStart:  coldStart,
 	}
 
-	backendHandler := NewBackendHandler(s.Backends, uint(s.MaxConcurrentEvents), s.MaxWorkers, s.MaxQueueSize, &factory)
+	backendHandler := NewBackendHandler(backends, uint(s.MaxConcurrentEvents), s.MaxWorkers, s.MaxQueueSize, &factory, s.SeparateTypeWorkers)
 	metrics := MetricHandler(backendHandler)
 	events := EventHandler(backendHandler)
 
+	sampler := &tuningSampler{}
+	backendHandler.sampleUtilization(sampler)
+	backendHandler.supervise(sup)
+
 	stage = stgr.NextStage()
 	stage.StartWithContext(backendHandler.Run)
+	stage.StartWithContext(sampler.Run)
+	var journal *Journal
+	if s.StateFile != "" {
+		if state != nil {
+			state.restoreAggregators(ctx, backendHandler, backendHandler.AggregatorID)
+			logger.Infof("Restored state written at %v from %s", state.written, s.StateFile)
+		}
+		// Every later stage has stopped by the time this one is, so nothing is received after the state is saved.
+		stage = stgr.NextStage()
+		stage.StartWithContext(func(ctx context.Context) {
+			<-ctx.Done()
+			stateLogger := logging.ComponentOf(logger, "state")
+			if err := saveState(context.Background(), s.StateFile, time.Now(), backendHandler, s.Backends, s.backendNames(), stateLogger); err != nil {
+				stateLogger.WithError(err).WithField("path", s.StateFile).Warn("Failed to save state")
+			} else if journal != nil {
+				// The journaled metrics are in the state file, so replaying them as well would count them twice.
+				journal.Clear()
+			}
+		})
+	}
+	if s.JournalFile != "" {
+		var err error
+		journal, err = NewJournal(s.JournalFile, s.JournalMatch, s.JournalSyncInterval, s.JournalQueueSize, metrics, events, logging.ComponentOf(logger, "journal"))
+		if err != nil {
+			return err
+		}
+		if err := journal.Replay(ctx); err != nil {
+			return err
+		}
+		metrics = journal
+		events = journal
+		// The journal stops before the state is saved, so it can be cleared once it has been.
+		stage = stgr.NextStage()
+		stage.StartWithContext(journal.Run)
+	}
 
 	// 2. Start the tag processor
 	th := NewTagHandlerFromViper(s.Viper, metrics, events, s.DefaultTags)
+	th.AddProcessors(s.Processors...)
+	var rulesFile *RulesFile
+	if s.RulesFile != "" {
+		var err error
+		rulesFile, err = th.SetRulesFile(s.RulesFile, logging.ComponentOf(logger, "config"))
+		if err != nil {
+			return err
+		}
+	}
 	metrics = th
 	events = th
 
@@ -115,50 +585,47 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 	ip := gostatsd.UnknownIP
 	var cloudHandler *CloudHandler
 	if s.CloudProvider != nil {
-		cloudHandler = NewCloudHandler(s.CloudProvider, metrics, events, log.StandardLogger(), s.Limiter, &s.CacheOptions)
+		cloudHandler = NewCloudHandler(s.CloudProvider, metrics, events, logging.ComponentOf(logger, "cloud"), s.Limiter, &s.CacheOptions)
 		metrics = cloudHandler
 		events = cloudHandler
 		stage = stgr.NextStage()
-		stage.StartWithContext(cloudHandler.Run)
+		stage.StartWithContext(sup.Wrap("cloud_handler", cloudHandler.Run))
 		selfIP, err := s.CloudProvider.SelfIP()
 		if err != nil {
-			log.Warnf("Failed to get self ip: %v", err)
+			logger.WithError(err).Warn("Failed to get self ip")
 		} else {
 			ip = selfIP
 		}
 	}
 
 	// 4. Create the statser
-	hostname := getHost()
-	namespace := s.Namespace
-	if s.InternalNamespace != "" {
-		if namespace != "" {
-			namespace = namespace + "." + s.InternalNamespace
-		} else {
-			namespace = s.InternalNamespace
-		}
-	}
-
 	bufferSize := 1000 // Estimating this is hard, and tends to cause loss under adverse conditions
 	var statser stats.Statser
 	switch s.StatserType {
 	case StatserNull:
 		statser = stats.NewNullStatser()
 	case StatserLogging:
-		statser = stats.NewLoggingStatser(s.InternalTags, log.NewEntry(log.New()))
+		statser = stats.NewLoggingStatser(s.InternalTags, logging.ComponentOf(logger, "statser"))
 	default:
 		internalStatser := stats.NewInternalStatser(bufferSize, s.InternalTags, namespace, hostname, metrics, events)
 		stage = stgr.NextStage()
 		stage.StartWithContext(internalStatser.Run)
 		statser = internalStatser
 	}
+	if s.Registry != nil {
+		statser = stats.NewRegistryStatser(s.Registry, statser)
+	}
 
 	// 5. Attach the statser to anything that needs it
 	stage = stgr.NextStage()
 	stage.StartWithContext(func(ctx context.Context) {
 		backendHandler.RunMetrics(ctx, statser)
 	})
-	for _, backend := range s.Backends {
+	transfers := newTransferMetrics(backends)
+	stage.StartWithContext(func(ctx context.Context) {
+		transfers.RunMetrics(ctx, statser)
+	})
+	for _, backend := range backends {
 		if metricEmitter, ok := backend.(MetricEmitter); ok {
 			stage.StartWithContext(func(ctx context.Context) {
 				metricEmitter.RunMetrics(ctx, statser)
@@ -170,13 +637,24 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 			cloudHandler.RunMetrics(ctx, statser)
 		})
 	}
+	stage.StartWithContext(func(ctx context.Context) {
+		sup.RunMetrics(ctx, statser)
+	})
+	if journal != nil {
+		stage.StartWithContext(func(ctx context.Context) {
+			journal.RunMetrics(ctx, statser)
+		})
+	}
 
-	// 6. Start the heartbeat
+	// 6. Start the heartbeat and build info
 	if s.HeartbeatEnabled {
 		hb := stats.NewHeartBeater(statser, "heartbeat", s.HeartbeatTags)
 		stage = stgr.NextStage()
 		stage.StartWithContext(hb.Run)
 	}
+	bi := stats.NewBuildInfo(statser, s.BuildInfoTags)
+	stage = stgr.NextStage()
+	stage.StartWithContext(bi.Run)
 
 	// 7. Start the Parser
 	// Open receiver <-> parser chan
@@ -186,53 +664,486 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 		limiter = rate.NewLimiter(s.BadLineRateLimitPerSecond, 1)
 	}
 
-	parser := NewDatagramParser(datagrams, s.Namespace, s.IgnoreHost, s.EstimatedTags, metrics, events, statser, limiter)
+	queuePolicy := s.ReceiveQueuePolicy
+	if queuePolicy == "" {
+		queuePolicy = ReceiveQueueDropNewest
+	}
+	capture := NewLineCapture(s.CaptureDir, s.CaptureMaxBytes)
+	capture.logger = logging.ComponentOf(logger, "capture")
+	defer capture.Stop("shutting down")
+	var metricDedup *MetricDeduplicator
+	if s.MetricDedupWindow > 0 {
+		metricDedup = NewMetricDeduplicator(s.MetricDedupWindow, s.MetricDedupMatch, metrics, events)
+		metrics = metricDedup
+		events = metricDedup
+	}
+	var containerHandler *ContainerHandler
+	if !s.StripContainerID {
+		var resolver ContainerResolver
+		if s.ContainerResolver == ContainerResolverDocker {
+			resolver = NewDockerResolver(s.DockerSocket)
+		}
+		containerHandler = NewContainerHandler(resolver, s.ContainerCacheTTL, metrics, events)
+		containerHandler.logger = logging.ComponentOf(logger, "container")
+		metrics = containerHandler
+		events = containerHandler
+	}
+	parserOpts := ParserOptions{
+		Namespace:      s.Namespace,
+		IgnoreHost:     s.IgnoreHost,
+		EstimatedTags:  s.EstimatedTags,
+		BadLineLimiter: limiter,
+		QueuePolicy:    queuePolicy,
+		MaxQueueAge:    s.ReceiveQueueMaxAge,
+		Capture:        capture,
+		Tracer:         tracer,
+		PreAggregate:   !s.DisablePacketAggregation,
+		// Gauges are only combined when the aggregator only keeps their last value.
+		PreAggregateGauges: s.GaugeFlapThreshold == 0 && len(s.GaugeEWMAMatch) == 0 && !s.GaugeMinMax && len(s.GaugeConflict) == 0 && len(s.PeakMatch) == 0,
+		MaxMetricTTL:       s.MaxMetricTTL,
+		TypedPortPolicy:    s.TypedPortPolicy,
+		UnknownTypePolicy:  s.UnknownTypePolicy,
+		NameWhitespace:     s.NameWhitespace,
+		StripContainerID:   s.StripContainerID,
+		Redactor:           redactor,
+		Logger:             logging.ComponentOf(logger, "parser"),
+	}
+	if s.DisableMetricTTL {
+		parserOpts.MaxMetricTTL = 0
+	}
+	if s.MaxTags > 0 || s.MaxTagKeyLength > 0 || s.MaxTagValueLength > 0 || s.NormalizeTags {
+		parserOpts.TagLimits = NewTagLimits(s.MaxTags, s.MaxTagKeyLength, s.MaxTagValueLength, s.TagLimitPolicy, s.NormalizeTags)
+	}
+	if s.SampleRateRules != "" {
+		var err error
+		parserOpts.SampleRates, err = NewSampleRates(s.SampleRateRules, logging.ComponentOf(logger, "parser"))
+		if err != nil {
+			return err
+		}
+	}
+	if s.GaugeDeltaRules != "" {
+		var err error
+		parserOpts.GaugeDeltas, err = NewGaugeDeltas(s.GaugeDeltaRules, logging.ComponentOf(logger, "parser"))
+		if err != nil {
+			return err
+		}
+	}
+	if s.ClockSkewPolicy != "" && s.ClockSkewPolicy != ClockSkewOff {
+		parserOpts.ClockSkew = NewClockSkew(s.ClockSkewPolicy, s.ClockSkewWindow, s.ClockSkewLearnWindow, s.ClockSkewMaxSources)
+	}
+	if s.LastSeenMaxSources > 0 {
+		parserOpts.LastSeen = NewLastSeen(s.LastSeenMaxSources, s.LastSeenExpiry, s.SilentSourceThreshold)
+	}
+	if s.RecentLinesMaxBytes > 0 {
+		parserOpts.Recent = NewRecentLines(s.RecentLinesMaxBytes)
+	}
+	parser := NewDatagramParser(datagrams, metrics, events, statser, parserOpts)
+	parser.busy = sampler.addWorkers("parser", s.MaxParsers)
+	sampleRates, recent := parserOpts.SampleRates, parserOpts.Recent
 	stage = stgr.NextStage()
 	stage.StartWithContext(parser.RunMetrics)
+	if sampleRates != nil {
+		stage.StartWithContext(sampleRates.Run)
+	}
+	if parser.gaugeDeltas != nil {
+		stage.StartWithContext(parser.gaugeDeltas.Run)
+	}
+	if rulesFile != nil {
+		stage.StartWithContext(rulesFile.Run)
+	}
+	if metricDedup != nil {
+		stage.StartWithContext(func(ctx context.Context) {
+			metricDedup.RunMetrics(ctx, statser)
+		})
+	}
+	if containerHandler != nil && containerHandler.resolver != nil {
+		stage.StartWithContext(containerHandler.Run)
+		stage.StartWithContext(func(ctx context.Context) {
+			containerHandler.RunMetrics(ctx, statser)
+		})
+	}
 	for r := 0; r < s.MaxParsers; r++ {
-		stage.StartWithContext(parser.Run)
+		stage.StartWithContext(sup.Wrap("parser", parser.Run))
 	}
 
 	// 8. Start the Receiver
-	receiver := NewDatagramReceiver(datagrams, s.ReceiveBatchSize)
+	received := chan<- []*Datagram(datagrams)
+	if queuePolicy == ReceiveQueueDropOldest {
+		ring := NewDatagramRing(datagrams, s.ReceiveQueueSize)
+		received = ring.In()
+		stage = stgr.NextStage()
+		stage.StartWithContext(sup.Wrap("receive_queue", ring.Run))
+		stage.StartWithContext(func(ctx context.Context) {
+			ring.RunMetrics(ctx, statser)
+		})
+	}
+	var blocklist *SourceBlocklist
+	if s.SourceBlocklist != "" {
+		var err error
+		blocklist, err = NewSourceBlocklist(s.SourceBlocklist, logging.ComponentOf(logger, "receiver"))
+		if err != nil {
+			return err
+		}
+	}
+	var dedup *DatagramDeduplicator
+	if s.DedupWindow > 0 {
+		dedup = NewDatagramDeduplicator(s.DedupWindow)
+	}
+	receiver := NewDatagramReceiver(received, s.ReceiveBatchSize, blocklist, dedup, s.PipelineTraceRate)
+	receiver.logger = logging.ComponentOf(logger, "receiver")
 	stage = stgr.NextStage()
+	if blocklist != nil {
+		stage.StartWithContext(blocklist.Run)
+	}
 	stage.StartWithContext(func(ctx context.Context) {
 		receiver.RunMetrics(ctx, statser)
 	})
-	for r := 0; r < s.MaxReaders; r++ {
-		// Open socket
-		c, err := sf()
-		if err != nil {
-			return err
+	for _, listener := range listeners {
+		listenerTag := ""
+		if s.TagListener {
+			listenerTag = "listener:" + listener.Addr
 		}
-		defer func(c net.PacketConn) {
-			// This makes receivers error out and stop
-			if e := c.Close(); e != nil {
-				log.Warnf("Error closing socket: %v", e)
+		for r := 0; r < s.MaxReaders; r++ {
+			// Open socket
+			c, err := listener.SocketFactory()
+			if err != nil {
+				return err
 			}
-		}(c)
+			defer func(c net.PacketConn) {
+				// This makes receivers error out and stop
+				if e := c.Close(); e != nil {
+					logger.WithError(e).WithField(logging.FieldAddress, c.LocalAddr().String()).Warn("Error closing socket")
+				}
+			}(c)
 
+			stage.StartWithContext(sup.Wrap("receiver", func(ctx context.Context) {
+				receiver.ReceiveTypedListener(ctx, c, listener.Addr, listenerTag, listener.Type)
+			}))
+		}
+	}
+	var streamReceiver *StreamReceiver
+	if s.TCPMetricsAddr != "" || s.HTTPMetricsAddr != "" {
+		streamReceiver = NewStreamReceiver(received, s.MaxDecompressionRatio, blocklist)
+		streamReceiver.maxTCPConns = s.MaxTCPConns
+		streamReceiver.tcpIdleTimeout = s.TCPIdleTimeout
+		streamReceiver.logger = logging.ComponentOf(logger, "receiver")
 		stage.StartWithContext(func(ctx context.Context) {
-			receiver.Receive(ctx, c)
+			streamReceiver.RunMetrics(ctx, statser)
 		})
 	}
+	if s.TCPMetricsAddr != "" {
+		l, err := net.Listen("tcp", s.TCPMetricsAddr)
+		if err != nil {
+			return err
+		}
+		listenerTag := ""
+		if s.TagListener {
+			listenerTag = "listener:tcp://" + s.TCPMetricsAddr
+		}
+		next := relistener(l)
+		stage.StartWithContext(sup.Wrap("tcp_receiver", func(ctx context.Context) {
+			streamReceiver.ReceiveTCP(ctx, next(), listenerTag)
+		}))
+	}
+	if s.HTTPMetricsAddr != "" {
+		l, err := net.Listen("tcp", s.HTTPMetricsAddr)
+		if err != nil {
+			return err
+		}
+		listenerTag := ""
+		if s.TagListener {
+			listenerTag = "listener:http://" + s.HTTPMetricsAddr
+		}
+		next := relistener(l)
+		stage.StartWithContext(sup.Wrap("http_receiver", func(ctx context.Context) {
+			streamReceiver.ReceiveHTTP(ctx, next(), listenerTag)
+		}))
+	}
 
 	// 9. Start the Flusher
-	flusher := NewMetricFlusher(s.FlushInterval, backendHandler, s.Backends, hostname, statser)
+	flusher := NewMetricFlusher(s.FlushInterval, backendHandler, parser, backends, hostname, s.LogFlushSummary, s.SortMetrics, derived, router, coldStart, statser)
+	flusher.warmup = s.FlushWarmup
+	flusher.logger = logging.ComponentOf(logger, "flusher")
+	flusher.journal = journal
+	flusher.aggregations = aggregations
+	flusher.supervisor = sup
+	flusher.timerRate = s.TimerRate
+	flusher.retryFailed = s.RetryFailedFlushes
+	var flushes *FlushSnapshots
+	if s.GRPCAddr != "" {
+		flushes = NewFlushSnapshots()
+		flusher.flushes = flushes
+	}
+	var history *FlushHistory
+	if s.FlushHistory > 0 {
+		history = NewFlushHistory(s.FlushHistory)
+		flusher.history = history
+	}
 	stage = stgr.NextStage()
-	stage.StartWithContext(flusher.Run)
+	stage.StartWithContext(sup.Wrap("flusher", flusher.Run))
+
+	// 10. Start the console and the gRPC API
+	if s.ConsoleAddr != "" || s.APIAddr != "" || s.AdminAPIAddr != "" {
+		cons := console.New(s.AdminAPIToken)
+		cons.Logger = logging.ComponentOf(logger, "console")
+		cons.Register("capture", console.Admin, "capture <glob> <seconds> <file>", "Write raw lines whose bucket matches glob to a new file in the capture directory for a number of seconds", capture.CaptureCommand)
+		cons.Register("capture-status", console.ReadOnly, "capture-status", "Show the active capture", capture.StatusCommand)
+		cons.Register("capture-stop", console.Admin, "capture-stop", "Stop the active capture", capture.StopCommand)
+		if recent != nil {
+			cons.Register("recent", console.ReadOnly, "recent <glob> [<n>]", "Show the most recent raw lines whose bucket matches glob", recent.RecentCommand)
+		}
+		cons.Register("trace", console.Admin, "trace <glob> <seconds>", "Log each stage of processing for metrics whose name matches glob for a number of seconds", tracer.TraceCommand)
+		cons.Register("trace-status", console.ReadOnly, "trace-status", "Show the active trace", tracer.StatusCommand)
+		cons.Register("trace-stop", console.Admin, "trace-stop", "Stop the active trace", tracer.StopCommand)
+		cons.Register("set-thresholds", console.Admin, "set-thresholds <percentile>[,<percentile>...]", "Replace the percentiles computed for timers, from the next flush", thresholds.SetCommand)
+		cons.Register("get-thresholds", console.ReadOnly, "get-thresholds", "Show the percentiles computed for timers", thresholds.GetCommand)
+		cons.Register("estimate", console.ReadOnly, "estimate <timer> <percentile>", "Estimate a percentile of a timer from the samples received so far this interval", EstimateCommand(backendHandler))
+		cons.Register("counters", console.ReadOnly, "counters [<offset> [<limit>]] [fields=<fields>]", "List the counters received this interval, a page at a time", DumpCommand(backendHandler, "counters", gostatsd.COUNTER))
+		cons.Register("gauges", console.ReadOnly, "gauges [<offset> [<limit>]] [fields=<fields>]", "List the gauges, a page at a time", DumpCommand(backendHandler, "gauges", gostatsd.GAUGE))
+		cons.Register("timers", console.ReadOnly, "timers [<offset> [<limit>]] [fields=<fields>]", "List the timers received this interval, a page at a time", DumpCommand(backendHandler, "timers", gostatsd.TIMER))
+		cons.Register("sets", console.ReadOnly, "sets [<offset> [<limit>]] [fields=<fields>]", "List the sets received this interval, a page at a time", DumpCommand(backendHandler, "sets", gostatsd.SET))
+		cons.Register("metrics", console.ReadOnly, "metrics [<offset> [<limit>]] [fields=<fields>]", "List every metric, a page at a time", DumpCommand(backendHandler, "metrics", gostatsd.COUNTER, gostatsd.TIMER, gostatsd.GAUGE, gostatsd.SET))
+		cons.Register("diff", console.ReadOnly, "diff [<from> <to> [<glob>]] [threshold=<n>] [limit=<n>]", "Compare two recent flushes by sequence number, or the last two, listing the buckets which appeared, disappeared or changed the most", history.DiffCommand)
+		cons.Register("top", console.ReadOnly, "top [<n>]", "List the prefixes with the most series and the longest names received this interval", TopCommand(backendHandler))
+		cons.Register("memstats", console.ReadOnly, "memstats [<fraction>]", "Estimate the memory used by the metrics received this interval, from a fraction of the buckets", MemStatsCommand(backendHandler))
+		cons.Register("redactions", console.ReadOnly, "redactions", "Show the redaction rules and how many metrics each matched", redactor.RulesCommand)
+		cons.Register("derived-metrics", console.ReadOnly, "derived-metrics", "Show the derived metric rules", derived.RulesCommand)
+		cons.Register("aggregation-rules", console.ReadOnly, "aggregation-rules", "Show the aggregation rules", aggregations.RulesCommand)
+		cons.Register("backends", console.ReadOnly, "backends", "Show the status of each backend", backendsCommand(backends))
+		cons.Register("report", console.ReadOnly, "report <backend>", "Show the most recent report of a backend, such as the differences found by the shadow backend", reportCommand(backends, s.backendNames()))
+		cons.Register("lint", console.ReadOnly, "lint", "List the names of metrics received this interval which are invalid for a backend", linter.LintCommand(backendHandler))
+		base := baseLogger(logger)
+		logLevel := NewLogLevel(base.GetLevel, base.SetLevel)
+		logLevel.logger = logging.ComponentOf(logger, "console")
+		cons.Register("set-log-level", console.Admin, "set-log-level <level> [<seconds>]", "Change the log level, reverting after a number of seconds if given", logLevel.SetCommand)
+		cons.Register("get-log-level", console.ReadOnly, "get-log-level", "Show the log level", logLevel.GetCommand)
+		cons.Register("tuning", console.ReadOnly, "tuning", "Show the number of workers and size of queues of each stage, and how busy they are", tuningCommand(tuning, sampler))
+		cons.Register("sample-rate-rules", console.ReadOnly, "sample-rate-rules", "Show the rules for handling the sample rate of counters", sampleRates.RulesCommand)
+		cons.Register("reload-sample-rate-rules", console.Admin, "reload-sample-rate-rules", "Reload the rules for handling the sample rate of counters from their file", sampleRates.ReloadCommand)
+		cons.Register("gauge-delta-rules", console.ReadOnly, "gauge-delta-rules", "Show the rules for whether signed gauge values are deltas", parser.gaugeDeltas.RulesCommand)
+		cons.Register("reload-gauge-delta-rules", console.Admin, "reload-gauge-delta-rules", "Reload the rules for whether signed gauge values are deltas from their file", parser.gaugeDeltas.ReloadCommand)
+		cons.Register("gauge-conflict-rules", console.ReadOnly, "gauge-conflict-rules", "Show the rules for which value is flushed for gauges updated more than once in the interval", gaugeConflicts.RulesCommand)
+		cons.Register("rules", console.ReadOnly, "rules", "Show the number of filters, aliases and scalings loaded from the rules file", rulesFile.RulesCommand)
+		cons.Register("reload-rules", console.Admin, "reload-rules", "Reload the filters, aliases and scalings of the rules file", rulesFile.ReloadCommand)
+		cons.Register("health", console.ReadOnly, "health", "Show the status of each component, failing if any has failed", sup.HealthCommand)
+		cons.Register("parse-errors", console.ReadOnly, "parse-errors", "Show the number of lines which failed to parse, by error class", parser.ParseErrorsCommand)
+		if parser.clockSkew != nil {
+			cons.Register("clock-skew", console.ReadOnly, "clock-skew", "Show the median clock skew learned for each source of client timestamps", parser.clockSkew.ClockSkewCommand)
+		}
+		if parser.lastSeen != nil {
+			cons.Register("sources", console.ReadOnly, "sources [<n>]", "List the sources which have been silent the longest, with how long they have been silent for", parser.lastSeen.SourcesCommand)
+		}
+		if streamReceiver != nil {
+			cons.Register("streams", console.ReadOnly, "streams", "Show the active TCP and HTTP streams", streamReceiver.StreamsCommand)
+			cons.Register("connections", console.ReadOnly, "connections", "Show the totals of the TCP and HTTP connections", streamReceiver.ConnectionsCommand)
+		}
+
+		stage = stgr.NextStage()
+		if s.ConsoleAddr != "" {
+			l, err := net.Listen("tcp", s.ConsoleAddr)
+			if err != nil {
+				return err
+			}
+			next := relistener(l)
+			stage.StartWithContext(sup.Wrap("console", func(ctx context.Context) {
+				cons.Serve(ctx, next())
+			}))
+		}
+		if s.APIAddr != "" {
+			l, err := net.Listen("tcp", s.APIAddr)
+			if err != nil {
+				return err
+			}
+			// Admin commands are only served on the admin address if there is one.
+			readOnly := s.AdminAPIAddr != ""
+			next := relistener(l)
+			stage.StartWithContext(sup.Wrap("api", func(ctx context.Context) {
+				cons.ServeAPI(ctx, next(), readOnly)
+			}))
+		}
+		if s.AdminAPIAddr != "" {
+			l, err := net.Listen("tcp", s.AdminAPIAddr)
+			if err != nil {
+				return err
+			}
+			next := relistener(l)
+			stage.StartWithContext(sup.Wrap("admin_api", func(ctx context.Context) {
+				cons.ServeAPI(ctx, next(), false)
+			}))
+		}
+	}
+
+	if s.GRPCAddr != "" {
+		l, err := net.Listen("tcp", s.GRPCAddr)
+		if err != nil {
+			return err
+		}
+		grpcServer := NewGRPCServer(backendHandler, flushes)
+		grpcServer.logger = logging.ComponentOf(logger, "grpc")
+		next := relistener(l)
+		stage.StartWithContext(sup.Wrap("grpc", func(ctx context.Context) {
+			grpcServer.Serve(ctx, next())
+		}))
+	}
 
-	// 10. Send events on start and on stop
+	// 11. Send events on start and on stop
 	// TODO: Push these in to statser
-	defer sendStopEvent(events, ip, hostname)
-	sendStartEvent(ctx, events, ip, hostname)
+	defer sendStopEvent(events, ip, hostname, logger)
+	sendStartEvent(ctx, events, ip, hostname, logger)
+
+	// 12. Listen until done, or until a component fails
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-sup.Failed():
+		return sup.Err()
+	}
+}
+
+// logger returns the logger of the server, the standard logger if none is set.
+func (s *Server) logger() log.FieldLogger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return log.StandardLogger()
+}
+
+// baseLogger returns the logrus.Logger that logger writes to, whose level is changed by the log level commands.
+func baseLogger(logger log.FieldLogger) *log.Logger {
+	switch l := logger.(type) {
+	case *log.Logger:
+		return l
+	case *log.Entry:
+		return l.Logger
+	}
+	return log.StandardLogger()
+}
 
-	// 11. Listen until done
-	<-ctx.Done()
-	return ctx.Err()
+// aggregationOptions returns the options of the aggregators.  handOffTimerValues is true if a backend wants the raw
+// timer values, and gaugeConflicts may be nil to flush the last value of each gauge.
+func (s *Server) aggregationOptions(handOffTimerValues bool, gaugeConflicts *GaugeConflicts, logger log.FieldLogger) aggregation.Options {
+	opts := aggregation.Options{
+		PercentThresholds:  s.PercentThreshold,
+		ExpiryInterval:     s.ExpiryInterval,
+		DisabledSubtypes:   s.DisabledSubTypes,
+		GaugeFlapThreshold: s.GaugeFlapThreshold,
+		SetDelimiter:       s.SetDelimiter,
+		SetExactLimit:      s.SetExactLimit,
+		HandOffTimerValues: handOffTimerValues,
+		CounterGracePeriod: s.CounterGracePeriod,
+		LinearPercentiles:  s.PercentileInterpolation == PercentileLinear,
+		UnderThresholds:    s.TimerUnderThresholds,
+		WrapCounters:       s.CounterOverflow == CounterOverflowWrap,
+		LateArrivalWindow:  s.LateArrivalWindow,
+		GaugeMinMax:        s.GaugeMinMax,
+		Logger:             logger,
+	}
+	// The matchers are only set when they are configured, as a nil pointer in an interface isn't nil.
+	if gaugeConflicts != nil {
+		opts.GaugeConflicts = gaugeConflicts
+	}
+	if s.TimerAggregation == TimerAggregationExpHistogram {
+		opts.TimerHistograms = true
+		opts.HistogramScale = int32(s.ExpHistogramScale)
+		opts.HistogramMaxBuckets = s.ExpHistogramMaxBuckets
+	}
+	if len(s.HDRMatch) > 0 {
+		opts.HDRTimers = NewTimerHDR(s.HDRMatch)
+		opts.HDRSignificantDigits = s.HDRSignificantDigits
+		opts.HDRLowestValue = HDRLowestValue
+		opts.HDRHighestValue = s.HDRMaxValue
+	}
+	if len(s.GaugeEWMAMatch) > 0 {
+		opts.GaugeSmoothing = NewGaugeEWMA(s.GaugeEWMAMatch, s.GaugeEWMADecay)
+	}
+	if len(s.GaugeDerivativeMatch) > 0 {
+		opts.GaugeDerivative = NewGaugeDerivative(s.GaugeDerivativeMatch)
+	}
+	if len(s.PeakMatch) > 0 {
+		opts.Peaks = NewPeaks(s.PeakMatch)
+		opts.PeakWindows = s.PeakWindows
+	}
+	return opts
+}
+
+// backendNames returns the name of each backend, as used by routes.
+func (s *Server) backendNames() []string {
+	if s.BackendNames != nil {
+		return s.BackendNames
+	}
+	names := make([]string, len(s.Backends))
+	for i, b := range s.Backends {
+		if b != nil {
+			names[i] = b.Name()
+		}
+	}
+	return names
+}
+
+// InternalMetricsNamespace returns the namespace the internal metrics are named in, the internal namespace within
+// the namespace of every metric.
+func InternalMetricsNamespace(namespace, internalNamespace string) string {
+	if internalNamespace == "" {
+		return namespace
+	}
+	if namespace == "" {
+		return internalNamespace
+	}
+	return namespace + "." + internalNamespace
+}
+
+// InternalMetricsPrefix returns the namespace the internal metrics are named in.  If internalPrefix is not empty it
+// is used as it is, without a trailing dot, independent of the namespace of every other metric.  Otherwise it is the
+// namespace from InternalMetricsNamespace.
+func InternalMetricsPrefix(namespace, internalNamespace, internalPrefix string) string {
+	if prefix := strings.TrimSuffix(internalPrefix, "."); prefix != "" {
+		return prefix
+	}
+	return InternalMetricsNamespace(namespace, internalNamespace)
+}
+
+// backendsCommand returns the console command to show the status of each backend, and the data sent by those which
+// measure it.
+func backendsCommand(backends []gostatsd.Backend) console.Handler {
+	return func(ctx context.Context, args []string, w io.Writer) error {
+		for _, b := range backends {
+			if b == nil {
+				continue
+			}
+			line := fmt.Sprintf("%s: %s", b.Name(), gostatsd.BackendStatus(b))
+			if ts, ok := gostatsd.BackendTransferStats(b); ok {
+				line += fmt.Sprintf(", %d bytes serialized in %v, %d bytes sent in %v",
+					ts.BytesSerialized, ts.SerializeTime, ts.BytesSent, ts.WriteTime)
+			}
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// reportCommand returns the console command to show the report of the backend given by name.
+func reportCommand(backends []gostatsd.Backend, names []string) console.Handler {
+	return func(ctx context.Context, args []string, w io.Writer) error {
+		if len(args) != 1 {
+			return errors.New("usage: report <backend>")
+		}
+		for i, b := range backends {
+			if b == nil || i >= len(names) || names[i] != args[0] {
+				continue
+			}
+			err := gostatsd.BackendReport(b, w)
+			if err == gostatsd.ErrNoReport {
+				return fmt.Errorf("backend %q has no report", args[0])
+			}
+			return err
+		}
+		return fmt.Errorf("unknown backend %q", args[0])
+	}
 }
 
-func sendStartEvent(ctx context.Context, events EventHandler, selfIP gostatsd.IP, hostname string) {
+func sendStartEvent(ctx context.Context, events EventHandler, selfIP gostatsd.IP, hostname string, logger log.FieldLogger) {
 	err := events.DispatchEvent(ctx, &gostatsd.Event{
 		Title:        "Gostatsd started",
 		Text:         "Gostatsd started",
@@ -242,11 +1153,11 @@ func sendStartEvent(ctx context.Context, events EventHandler, selfIP gostatsd.IP
 		Priority:     gostatsd.PriLow,
 	})
 	if unexpectedErr(err) {
-		log.Warnf("Failed to send start event: %v", err)
+		logger.WithError(err).Warn("Failed to send start event")
 	}
 }
 
-func sendStopEvent(events EventHandler, selfIP gostatsd.IP, hostname string) {
+func sendStopEvent(events EventHandler, selfIP gostatsd.IP, hostname string, logger log.FieldLogger) {
 	ctx, cancelFunc := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancelFunc()
 	err := events.DispatchEvent(ctx, &gostatsd.Event{
@@ -258,28 +1169,29 @@ func sendStopEvent(events EventHandler, selfIP gostatsd.IP, hostname string) {
 		Priority:     gostatsd.PriLow,
 	})
 	if unexpectedErr(err) {
-		log.Warnf("Failed to send stop event: %v", err)
+		logger.WithError(err).Warn("Failed to send stop event")
 	}
 	events.WaitForEvents()
 }
 
-func getHost() string {
+func getHost(logger log.FieldLogger) string {
 	host, err := os.Hostname()
 	if err != nil {
-		log.Warnf("Cannot get hostname: %v", err)
+		logger.WithError(err).Warn("Cannot get hostname")
 		return ""
 	}
 	return host
 }
 
 type agrFactory struct {
-	percentThresholds []float64
-	expiryInterval    time.Duration
-	disabledSubtypes  gostatsd.TimerSubtypes
+	opts       aggregation.Options
+	tracer     *MetricTracer
+	thresholds *PercentThresholds
+	coldStart  *ColdStart
 }
 
 func (af *agrFactory) Create() Aggregator {
-	return NewMetricAggregator(af.percentThresholds, af.expiryInterval, af.disabledSubtypes)
+	return NewMetricAggregator(af.opts, af.tracer, af.thresholds, af.coldStart)
 }
 
 func toStringSlice(fs []float64) []string {
@@ -82,6 +82,164 @@ const (
 	DefaultStatserType = StatserInternal
 	// DefaultBadLinesPerMinute is the default number of bad lines to allow to log per minute
 	DefaultBadLinesPerMinute = 0
+	// DefaultLogFlushSummary is the default for whether to log a summary line after each flush
+	DefaultLogFlushSummary = false
+	// DefaultGaugeFlapThreshold is the default number of gauge value changes per flush before it is debounced, 0 is disabled
+	DefaultGaugeFlapThreshold = 0
+	// DefaultReceiveQueuePolicy is the default policy when the parsers can't keep up with the receivers
+	DefaultReceiveQueuePolicy = ReceiveQueueDropNewest
+	// DefaultReceiveQueueSize is the default number of datagram batches buffered by the drop-oldest policy
+	DefaultReceiveQueueSize = 100
+	// DefaultReceiveQueueMaxAge is the default age after which queued datagrams are discarded, 0 is disabled
+	DefaultReceiveQueueMaxAge = time.Duration(0)
+	// DefaultConsoleAddr is the default address for the TCP console, empty to disable
+	DefaultConsoleAddr = ""
+	// DefaultAPIAddr is the default address for the HTTP API, empty to disable
+	DefaultAPIAddr = ""
+	// DefaultAdminAPIAddr is the default address for the admin HTTP API, empty to serve admin commands on the API address
+	DefaultAdminAPIAddr = ""
+	// DefaultCaptureDir is the default directory capture files are written to, empty to disable captures
+	DefaultCaptureDir = ""
+	// DefaultCaptureMaxBytes is the default maximum number of bytes written by a capture
+	DefaultCaptureMaxBytes = 10 * 1024 * 1024
+	// DefaultSeparateTypeWorkers is the default for whether each metric type has its own workers
+	DefaultSeparateTypeWorkers = false
+	// DefaultAutoTune is the default for whether to choose the number of workers and size of queues automatically
+	DefaultAutoTune = false
+	// DefaultExpectedPacketsPerSecond is the default expected rate of packets used by auto-tuning, 0 if unknown
+	DefaultExpectedPacketsPerSecond = 0
+	// DefaultDisablePacketAggregation is the default for whether to disable combining identical metrics within a datagram
+	DefaultDisablePacketAggregation = false
+	// DefaultSetDelimiter is the default delimiter to split set values in to multiple members, empty is disabled
+	DefaultSetDelimiter = ""
+	// DefaultSetExactLimit is the default number of set members above which the cardinality is estimated, 0 is disabled
+	DefaultSetExactLimit = 0
+	// DefaultCounterGracePeriod is the default time idle counters are flushed as zero before expiring, 0 to use the expiry interval
+	DefaultCounterGracePeriod = time.Duration(0)
+	// DefaultSourceBlocklist is the default path of the file listing source addresses to drop datagrams from, empty to disable
+	DefaultSourceBlocklist = ""
+	// DefaultSampleRateRules is the default path of the file of rules for handling the sample rate of counters, empty to scale every counter
+	DefaultSampleRateRules = ""
+	// DefaultGaugeDeltaRules is the default path of the file of rules for whether signed gauge values are deltas, empty for all of them to be
+	DefaultGaugeDeltaRules = ""
+	// DefaultRulesFile is the default path of the file of filter, alias and scaling rules applied after those of the config, empty for none
+	DefaultRulesFile = ""
+	// DefaultMaxComponentRestarts is the default number of times in a row a component is restarted after a panic before the server shuts down
+	DefaultMaxComponentRestarts = 5
+	// DefaultTraceMetrics is the default glob of metric names to trace at startup, empty to disable
+	DefaultTraceMetrics = ""
+	// DefaultTraceMetricsDuration is the default time after which a trace started at startup stops
+	DefaultTraceMetricsDuration = 10 * time.Minute
+	// DefaultDedupWindow is the default window in which duplicate datagrams are dropped, 0 is disabled
+	DefaultDedupWindow = time.Duration(0)
+	// DefaultMetricDedupWindow is the default window in which duplicate metrics are dropped, 0 is disabled
+	DefaultMetricDedupWindow = time.Duration(0)
+	// DefaultPercentileInterpolation is the default method of computing timer percentiles
+	DefaultPercentileInterpolation = PercentileNearestRank
+	// DefaultCounterOverflow is the default handling of counters which overflow int64
+	DefaultCounterOverflow = CounterOverflowSaturate
+	// DefaultColdStart is the default handling of the first flush after startup
+	DefaultColdStart = ColdStartNone
+	// DefaultFlushWarmup is the default delay before the first flush after startup, 0 to flush after one flush interval
+	DefaultFlushWarmup = time.Duration(0)
+	// DefaultGaugeEWMADecay is the default weight of the running value of smoothed gauges
+	DefaultGaugeEWMADecay = 0.8
+	// DefaultGaugeMinMax is the default of whether to also flush the lowest and highest value of each gauge in the interval
+	DefaultGaugeMinMax = false
+	// DefaultPeakWindows is the default list of windows to track the peaks of counters and gauges over
+	DefaultPeakWindows = "24h"
+	// DefaultSortMetrics is the default for whether metrics are sent to backends in order of name
+	DefaultSortMetrics = false
+	// DefaultRetryFailedFlushes is the default for whether a flush is sent again to the backends which failed to send it
+	DefaultRetryFailedFlushes = false
+	// DefaultTimerRate is the default for whether a <timer>.rate gauge is flushed for each timer
+	DefaultTimerRate = false
+	// DefaultTagListener is the default for whether to tag metrics with the address they were received on
+	DefaultTagListener = false
+	// DefaultMaxMetricTTL is the default maximum TTL a client may set on a metric
+	DefaultMaxMetricTTL = 1 * time.Hour
+	// DefaultDisableMetricTTL is the default for whether to disable the metric TTL extension
+	DefaultDisableMetricTTL = false
+	// DefaultTCPMetricsAddr is the default address on which to receive metrics over TCP, empty to disable
+	DefaultTCPMetricsAddr = ""
+	// DefaultHTTPMetricsAddr is the default address on which to receive metrics over HTTP, empty to disable
+	DefaultHTTPMetricsAddr = ""
+	// DefaultMaxDecompressionRatio is the default maximum expansion ratio of compressed streams
+	DefaultMaxDecompressionRatio = 100.0
+	// DefaultMaxTCPConns is the default maximum number of TCP connections open at once, 0 for no limit
+	DefaultMaxTCPConns = 0
+	// DefaultTCPIdleTimeout is the default time after which a TCP connection which sends nothing is closed, 0 to disable
+	DefaultTCPIdleTimeout = time.Duration(0)
+	// DefaultTypedPortPolicy is the default handling of metrics of the wrong type received on a typed port
+	DefaultTypedPortPolicy = TypedPortCoerce
+	// DefaultUnknownTypePolicy is the default handling of metrics of an unknown type
+	DefaultUnknownTypePolicy = UnknownTypeDrop
+	// DefaultNameWhitespace is the default handling of whitespace in metric names
+	DefaultNameWhitespace = NameWhitespaceTrimTrailing
+	// DefaultMaxTags is the default maximum number of tags per metric, 0 for no limit
+	DefaultMaxTags = 0
+	// DefaultMaxTagKeyLength is the default maximum length of the key of a tag, 0 for no limit
+	DefaultMaxTagKeyLength = 0
+	// DefaultMaxTagValueLength is the default maximum length of the value of a tag, 0 for no limit
+	DefaultMaxTagValueLength = 0
+	// DefaultTagLimitPolicy is the default handling of metrics which exceed a tag limit
+	DefaultTagLimitPolicy = TagLimitTruncate
+	// DefaultNormalizeTags is the default for whether to lowercase the keys of tags and sort them
+	DefaultNormalizeTags = false
+	// DefaultStateFile is the default file to save the aggregation state to on shutdown, empty to disable
+	DefaultStateFile = ""
+	// DefaultStateMaxAge is the default maximum age of a state file which is restored on startup
+	DefaultStateMaxAge = 5 * time.Minute
+	// DefaultJournalFile is the default file to journal metrics to until they are flushed, empty to disable
+	DefaultJournalFile = ""
+	// DefaultJournalSyncInterval is the default interval at which journaled metrics are synced to disk
+	DefaultJournalSyncInterval = 1 * time.Second
+	// DefaultJournalQueueSize is the default number of metrics queued to be journaled before they are dropped
+	DefaultJournalQueueSize = 10000
+	// DefaultPipelineTraceRate is the default rate of datagrams traced through the pipeline, 0 to disable
+	DefaultPipelineTraceRate = 0
+	// DefaultLint is the default of whether to check metric names against the naming rules instead of sending them
+	DefaultLint = false
+	// DefaultContainerResolver is the default way of looking up the containers which sent metrics
+	DefaultContainerResolver = ContainerResolverNone
+	// DefaultContainerCacheTTL is the default time the metadata of a container is cached for
+	DefaultContainerCacheTTL = 5 * time.Minute
+	// DefaultStripContainerID is the default of whether to discard the container ID field of dogstatsd
+	DefaultStripContainerID = false
+	// DefaultRecentLinesMaxBytes is the default memory used to keep recent raw lines, 0 to disable
+	DefaultRecentLinesMaxBytes = 0
+	// DefaultGRPCAddr is the default address for the read-only gRPC API, empty to disable
+	DefaultGRPCAddr = ""
+	// DefaultLateArrivalWindow is the default of how long after the end of their interval late counters and timers are bucketed in to it, 0 to disable
+	DefaultLateArrivalWindow = time.Duration(0)
+	// DefaultFlushHistory is the default number of flushes kept for the diff command, 0 to disable
+	DefaultFlushHistory = 0
+	// DefaultClockSkewPolicy is the default handling of client timestamps, off to not accept them
+	DefaultClockSkewPolicy = ClockSkewOff
+	// DefaultClockSkewWindow is the default of how far a client timestamp may be from the time its metric was received
+	DefaultClockSkewWindow = time.Minute
+	// DefaultClockSkewLearnWindow is the default window the clock skew of each source is learned over
+	DefaultClockSkewLearnWindow = 10 * time.Minute
+	// DefaultClockSkewMaxSources is the default maximum number of sources the clock skew is learned for
+	DefaultClockSkewMaxSources = 10000
+	// DefaultLastSeenMaxSources is the default maximum number of sources tracked by when they last sent
+	DefaultLastSeenMaxSources = 10000
+	// DefaultLastSeenExpiry is the default of how long a silent source is tracked for
+	DefaultLastSeenExpiry = 24 * time.Hour
+	// DefaultSilentSourceThreshold is the default silence after which a source is reported, 0 to not report them
+	DefaultSilentSourceThreshold = time.Duration(0)
+	// DefaultTimerAggregation is the default of how timer samples are aggregated
+	DefaultTimerAggregation = TimerAggregationSamples
+	// DefaultExpHistogramScale is the default scale exponential histograms start at, before they are downscaled to fit
+	DefaultExpHistogramScale = 8
+	// DefaultExpHistogramMaxBuckets is the default maximum number of buckets of each sign of an exponential histogram
+	DefaultExpHistogramMaxBuckets = 160
+	// DefaultHDRSignificantDigits is the default number of significant decimal digits of the HDR histograms of timers
+	DefaultHDRSignificantDigits = 3
+	// DefaultHDRMaxValue is the default highest value the HDR histograms of timers track, an hour in milliseconds
+	DefaultHDRMaxValue = 3600000.0
+	// DefaultForceFlushInterval is the default of whether a flush interval shorter than MinFlushInterval is allowed
+	DefaultForceFlushInterval = false
 )
 
 const (
@@ -99,6 +257,8 @@ const (
 	ParamInternalTags = "internal-tags"
 	// ParamInternalNamespace is the name of parameter with the namespace for internal metrics.
 	ParamInternalNamespace = "internal-namespace"
+	// ParamInternalPrefix is the name of parameter with the namespace of internal metrics, independent of the namespace of other metrics.
+	ParamInternalPrefix = "internal-prefix"
 	// ParamExpiryInterval is the name of parameter with expiry interval for metrics.
 	ParamExpiryInterval = "expiry-interval"
 	// ParamFlushInterval is the name of parameter with metrics flush interval.
@@ -111,6 +271,12 @@ const (
 	ParamMaxParsers = "max-parsers"
 	// ParamMaxWorkers is the name of parameter with number of goroutines that aggregate metrics.
 	ParamMaxWorkers = "max-workers"
+	// ParamSeparateTypeWorkers is the name of parameter with whether each metric type has its own workers.
+	ParamSeparateTypeWorkers = "separate-type-workers"
+	// ParamAutoTune is the name of parameter with whether to choose the number of workers and size of queues automatically.
+	ParamAutoTune = "auto-tune"
+	// ParamExpectedPacketsPerSecond is the name of parameter with the expected rate of packets used by auto-tuning.
+	ParamExpectedPacketsPerSecond = "expected-packets-per-second"
 	// ParamMaxQueueSize is the name of parameter with maximum number of buffered metrics per worker.
 	ParamMaxQueueSize = "max-queue-size"
 	// ParamMaxConcurrentEvents is the name of parameter with maximum number of events sent concurrently.
@@ -141,17 +307,205 @@ const (
 	ParamConnPerReader = "conn-per-reader"
 	// ParamBadLineRateLimitPerMinute is the name of the parameter indicating how many bad lines can be logged per minute
 	ParamBadLinesPerMinute = "bad-lines-per-minute"
+	// ParamLogFlushSummary is the name of the parameter indicating whether to log a summary line after each flush
+	ParamLogFlushSummary = "log-flush-summary"
+	// ParamGaugeFlapThreshold is the name of the parameter with the number of gauge value changes per flush before it is debounced
+	ParamGaugeFlapThreshold = "gauge-flap-threshold"
+	// ParamReceiveQueuePolicy is the name of the parameter with the policy when the parsers can't keep up with the receivers
+	ParamReceiveQueuePolicy = "receive-queue-policy"
+	// ParamReceiveQueueSize is the name of the parameter with the number of datagram batches buffered by the drop-oldest policy
+	ParamReceiveQueueSize = "receive-queue-size"
+	// ParamReceiveQueueMaxAge is the name of the parameter with the age after which queued datagrams are discarded
+	ParamReceiveQueueMaxAge = "receive-queue-max-age"
+	// ParamConsoleAddr is the name of the parameter with the address for the TCP console
+	ParamConsoleAddr = "console-addr"
+	// ParamAPIAddr is the name of the parameter with the address for the HTTP API
+	ParamAPIAddr = "api-addr"
+	// ParamAdminAPIAddr is the name of the parameter with the address for the admin HTTP API
+	ParamAdminAPIAddr = "admin-api-addr"
+	// ParamAdminAPIToken is the name of the parameter with the bearer token required for admin commands over HTTP
+	ParamAdminAPIToken = "admin-api-token"
+	// ParamCaptureDir is the name of the parameter with the directory capture files are written to
+	ParamCaptureDir = "capture-dir"
+	// ParamCaptureMaxBytes is the name of the parameter with the maximum number of bytes written by a capture
+	ParamCaptureMaxBytes = "capture-max-bytes"
+	// ParamDisablePacketAggregation is the name of the parameter indicating whether to disable combining identical metrics within a datagram
+	ParamDisablePacketAggregation = "disable-packet-aggregation"
+	// ParamSetDelimiter is the name of the parameter with the delimiter to split set values in to multiple members
+	ParamSetDelimiter = "set-delimiter"
+	// ParamSetExactLimit is the name of the parameter with the number of set members above which the cardinality is estimated
+	ParamSetExactLimit = "set-exact-limit"
+	// ParamCounterGracePeriod is the name of the parameter with the time idle counters are flushed as zero before expiring
+	ParamCounterGracePeriod = "counter-grace-period"
+	// ParamSourceBlocklist is the name of the parameter with the path of the file listing source addresses to drop datagrams from
+	ParamSourceBlocklist = "source-blocklist"
+	// ParamSampleRateRules is the name of the parameter with the path of the file of rules for handling the sample rate of counters
+	ParamSampleRateRules = "sample-rate-rules"
+	// ParamGaugeDeltaRules is the name of the parameter with the path of the file of rules for whether signed gauge values are deltas
+	ParamGaugeDeltaRules = "gauge-delta-rules"
+	// ParamRulesFile is the name of the parameter with the path of the file of filter, alias and scaling rules applied after those of the config
+	ParamRulesFile = "rules-file"
+	// ParamMaxComponentRestarts is the name of the parameter with the number of times in a row a component is restarted after a panic
+	ParamMaxComponentRestarts = "max-component-restarts"
+	// ParamTraceMetrics is the name of the parameter with the glob of metric names to trace at startup
+	ParamTraceMetrics = "trace-metrics"
+	// ParamTraceMetricsDuration is the name of the parameter with the time after which a trace started at startup stops
+	ParamTraceMetricsDuration = "trace-metrics-duration"
+	// ParamDedupWindow is the name of the parameter with the window in which duplicate datagrams are dropped
+	ParamDedupWindow = "dedup-window"
+	// ParamMetricDedupWindow is the name of the parameter with the window in which duplicate metrics are dropped
+	ParamMetricDedupWindow = "metric-dedup-window"
+	// ParamMetricDedupMatch is the name of the parameter with the metric name patterns which are deduplicated
+	ParamMetricDedupMatch = "metric-dedup-match"
+	// ParamPercentileInterpolation is the name of the parameter with the method of computing timer percentiles
+	ParamPercentileInterpolation = "percentile-interpolation"
+	// ParamCounterOverflow is the name of the parameter with the handling of counters which overflow int64
+	ParamCounterOverflow = "counter-overflow"
+	// ParamColdStart is the name of the parameter with the handling of the first flush after startup
+	ParamColdStart = "cold-start"
+	// ParamFlushWarmup is the name of the parameter with the delay before the first flush after startup
+	ParamFlushWarmup = "flush-warmup"
+	// ParamGaugeEWMAMatch is the name of the parameter with the gauge name patterns which are smoothed
+	ParamGaugeEWMAMatch = "gauge-ewma-match"
+	// ParamGaugeEWMADecay is the name of the parameter with the weight of the running value of smoothed gauges
+	ParamGaugeEWMADecay = "gauge-ewma-decay"
+	// ParamGaugeDerivativeMatch is the name of the parameter with the gauge name patterns flushed as their rate of change
+	ParamGaugeDerivativeMatch = "gauge-derivative-match"
+	// ParamGaugeMinMax is the name of the parameter with whether to also flush the lowest and highest value of each gauge in the interval
+	ParamGaugeMinMax = "gauge-min-max"
+	// ParamGaugeConflict is the name of the parameter with the rules for which value is flushed for gauges updated more than once in the interval
+	ParamGaugeConflict = "gauge-conflict"
+	// ParamPeakMatch is the name of the parameter with the counter and gauge name patterns which have their peaks flushed
+	ParamPeakMatch = "peak-match"
+	// ParamPeakWindows is the name of the parameter with the windows to track the peaks of counters and gauges over
+	ParamPeakWindows = "peak-windows"
+	// ParamSortMetrics is the name of the parameter enabling sending metrics to backends in order of name
+	ParamSortMetrics = "sort-metrics"
+	// ParamRetryFailedFlushes is the name of the parameter enabling a flush to be sent again to the backends which
+	// failed to send it
+	ParamRetryFailedFlushes = "retry-failed-flushes"
+	// ParamTimerRate is the name of the parameter enabling a <timer>.rate gauge for each timer
+	ParamTimerRate = "timer-rate"
+	// ParamTimerUnderThresholds is the name of the parameter with the thresholds to count timer values at or under
+	ParamTimerUnderThresholds = "timer-under-thresholds"
+	// ParamTagListener is the name of the parameter indicating whether to tag metrics with the address they were received on
+	ParamTagListener = "tag-listener"
+	// ParamMaxMetricTTL is the name of the parameter with the maximum TTL a client may set on a metric
+	ParamMaxMetricTTL = "max-metric-ttl"
+	// ParamDisableMetricTTL is the name of the parameter indicating whether to disable the metric TTL extension
+	ParamDisableMetricTTL = "disable-metric-ttl"
+	// ParamTCPMetricsAddr is the name of the parameter with the address on which to receive metrics over TCP
+	ParamTCPMetricsAddr = "tcp-metrics-addr"
+	// ParamHTTPMetricsAddr is the name of the parameter with the address on which to receive metrics over HTTP
+	ParamHTTPMetricsAddr = "http-metrics-addr"
+	// ParamMaxDecompressionRatio is the name of the parameter with the maximum expansion ratio of compressed streams
+	ParamMaxDecompressionRatio = "max-decompression-ratio"
+	// ParamMaxTCPConns is the name of the parameter with the maximum number of TCP connections open at once
+	ParamMaxTCPConns = "max-tcp-conns"
+	// ParamTCPIdleTimeout is the name of the parameter with the time after which an idle TCP connection is closed
+	ParamTCPIdleTimeout = "tcp-idle-timeout"
+	// ParamMetricsAddrCounters is the name of the parameter with the addresses on which to listen for counters
+	ParamMetricsAddrCounters = "metrics-addr-counters"
+	// ParamMetricsAddrGauges is the name of the parameter with the addresses on which to listen for gauges
+	ParamMetricsAddrGauges = "metrics-addr-gauges"
+	// ParamMetricsAddrTimers is the name of the parameter with the addresses on which to listen for timers
+	ParamMetricsAddrTimers = "metrics-addr-timers"
+	// ParamMetricsAddrSets is the name of the parameter with the addresses on which to listen for sets
+	ParamMetricsAddrSets = "metrics-addr-sets"
+	// ParamTypedPortPolicy is the name of the parameter with the handling of metrics of the wrong type received on a typed port
+	ParamTypedPortPolicy = "typed-port-policy"
+	// ParamUnknownTypePolicy is the name of the parameter with the handling of metrics of an unknown type
+	ParamUnknownTypePolicy = "unknown-type-policy"
+	// ParamNameWhitespace is the name of the parameter with the handling of whitespace in metric names
+	ParamNameWhitespace = "name-whitespace"
+	// ParamMaxTags is the name of the parameter with the maximum number of tags per metric
+	ParamMaxTags = "max-tags"
+	// ParamMaxTagKeyLength is the name of the parameter with the maximum length of the key of a tag
+	ParamMaxTagKeyLength = "max-tag-key-length"
+	// ParamMaxTagValueLength is the name of the parameter with the maximum length of the value of a tag
+	ParamMaxTagValueLength = "max-tag-value-length"
+	// ParamTagLimitPolicy is the name of the parameter with the handling of metrics which exceed a tag limit
+	ParamTagLimitPolicy = "tag-limit-policy"
+	// ParamNormalizeTags is the name of the parameter with whether to lowercase the keys of tags and sort them
+	ParamNormalizeTags = "normalize-tags"
+	// ParamStateFile is the name of the parameter with the file to save the aggregation state to on shutdown
+	ParamStateFile = "state-file"
+	// ParamStateMaxAge is the name of the parameter with the maximum age of a state file which is restored on startup
+	ParamStateMaxAge = "state-max-age"
+	// ParamJournalFile is the name of the parameter with the file to journal metrics to until they are flushed
+	ParamJournalFile = "journal-file"
+	// ParamJournalMatch is the name of the parameter with the metric name patterns which are journaled
+	ParamJournalMatch = "journal-match"
+	// ParamJournalSyncInterval is the name of the parameter with the interval at which the journal is synced to disk
+	ParamJournalSyncInterval = "journal-sync-interval"
+	// ParamJournalQueueSize is the name of the parameter with the number of metrics queued to be journaled
+	ParamJournalQueueSize = "journal-queue-size"
+	// ParamPipelineTraceRate is the name of the parameter with the rate of datagrams traced through the pipeline
+	ParamPipelineTraceRate = "pipeline-trace-rate"
+	// ParamLint is the name of the parameter with whether to check metric names against the naming rules instead of sending them
+	ParamLint = "lint"
+	// ParamLintRules is the name of the parameter with the naming rules to check metric names against, as well as those of the backends
+	ParamLintRules = "lint-rules"
+	// ParamContainerResolver is the name of the parameter with the way of looking up the containers which sent metrics
+	ParamContainerResolver = "container-resolver"
+	// ParamDockerSocket is the name of the parameter with the path of the Docker Engine API socket
+	ParamDockerSocket = "docker-socket"
+	// ParamContainerCacheTTL is the name of the parameter with the time the metadata of a container is cached for
+	ParamContainerCacheTTL = "container-cache-ttl"
+	// ParamStripContainerID is the name of the parameter with whether to discard the container ID field of dogstatsd
+	ParamStripContainerID = "strip-container-id"
+	// ParamRecentLinesMaxBytes is the name of the parameter with the memory used to keep recent raw lines
+	ParamRecentLinesMaxBytes = "recent-lines-max-bytes"
+	// ParamGRPCAddr is the name of the parameter with the address for the read-only gRPC API
+	ParamGRPCAddr = "grpc-addr"
+	// ParamLateArrivalWindow is the name of the parameter with how long after the end of their interval late counters and timers are bucketed in to it
+	ParamLateArrivalWindow = "late-arrival-window"
+	// ParamFlushHistory is the name of the parameter with the number of flushes kept for the diff command
+	ParamFlushHistory = "flush-history"
+	// ParamClockSkewPolicy is the name of the parameter with the handling of client timestamps
+	ParamClockSkewPolicy = "clock-skew-policy"
+	// ParamClockSkewWindow is the name of the parameter with how far a client timestamp may be from the time its metric was received
+	ParamClockSkewWindow = "clock-skew-window"
+	// ParamClockSkewLearnWindow is the name of the parameter with the window the clock skew of each source is learned over
+	ParamClockSkewLearnWindow = "clock-skew-learn-window"
+	// ParamClockSkewMaxSources is the name of the parameter with the maximum number of sources the clock skew is learned for
+	ParamClockSkewMaxSources = "clock-skew-max-sources"
+	// ParamLastSeenMaxSources is the name of the parameter with the maximum number of sources tracked by when they last sent
+	ParamLastSeenMaxSources = "last-seen-max-sources"
+	// ParamLastSeenExpiry is the name of the parameter with how long a silent source is tracked for
+	ParamLastSeenExpiry = "last-seen-expiry"
+	// ParamSilentSourceThreshold is the name of the parameter with the silence after which a source is reported
+	ParamSilentSourceThreshold = "silent-source-threshold"
+	// ParamTimerAggregation is the name of the parameter with how timer samples are aggregated
+	ParamTimerAggregation = "timer-aggregation"
+	// ParamExpHistogramScale is the name of the parameter with the scale exponential histograms start at
+	ParamExpHistogramScale = "exphistogram-scale"
+	// ParamExpHistogramMaxBuckets is the name of the parameter with the maximum number of buckets of each sign of an exponential histogram
+	ParamExpHistogramMaxBuckets = "exphistogram-max-buckets"
+	// ParamHDRMatch is the name of the parameter with the timer name patterns recorded in an HDR histogram
+	ParamHDRMatch = "hdr-match"
+	// ParamHDRSignificantDigits is the name of the parameter with the number of significant decimal digits of the HDR histograms of timers
+	ParamHDRSignificantDigits = "hdr-significant-digits"
+	// ParamHDRMaxValue is the name of the parameter with the highest value the HDR histograms of timers track
+	ParamHDRMaxValue = "hdr-max-value"
+	// ParamForceFlushInterval is the name of the parameter which allows a flush interval shorter than MinFlushInterval
+	ParamForceFlushInterval = "force-flush-interval"
 )
 
 // AddFlags adds flags to the specified FlagSet.
 func AddFlags(fs *pflag.FlagSet) {
 	fs.String(ParamCloudProvider, "", "If set, use the cloud provider to retrieve metadata about the sender")
 	fs.Duration(ParamExpiryInterval, DefaultExpiryInterval, "After how long do we expire metrics (0 to disable)")
+	fs.Duration(ParamCounterGracePeriod, DefaultCounterGracePeriod, "Flush idle counters as zero for this long before expiring them (0 to use the expiry interval)")
 	fs.Duration(ParamFlushInterval, DefaultFlushInterval, "How often to flush metrics to the backends")
+	fs.Bool(ParamForceFlushInterval, DefaultForceFlushInterval, "Allow a flush interval shorter than 100ms, which may leave too little time to aggregate between flushes")
 	fs.Bool(ParamIgnoreHost, DefaultIgnoreHost, "Ignore the source for populating the hostname field of metrics")
 	fs.Int(ParamMaxReaders, DefaultMaxReaders, "Maximum number of socket readers")
 	fs.Int(ParamMaxParsers, DefaultMaxParsers, "Maximum number of workers to parse datagrams into metrics")
 	fs.Int(ParamMaxWorkers, DefaultMaxWorkers, "Maximum number of workers to process metrics")
+	fs.Bool(ParamSeparateTypeWorkers, DefaultSeparateTypeWorkers, "Aggregate each metric type with its own max-workers workers, so a burst of one type doesn't delay the others")
+	fs.Bool(ParamAutoTune, DefaultAutoTune, "Choose max-readers, max-parsers, max-workers, max-queue-size, receive-batch-size and receive-queue-size from GOMAXPROCS and expected-packets-per-second, overriding their values")
+	fs.Int(ParamExpectedPacketsPerSecond, DefaultExpectedPacketsPerSecond, "Expected number of packets received per second, used by auto-tune (0 if unknown)")
 	fs.Int(ParamMaxQueueSize, DefaultMaxQueueSize, "Maximum number of buffered metrics per worker")
 	fs.Int(ParamMaxConcurrentEvents, DefaultMaxConcurrentEvents, "Maximum number of events sent concurrently")
 	fs.Int(ParamEstimatedTags, DefaultEstimatedTags, "Estimated number of expected tags on an individual metric submitted externally")
@@ -159,7 +513,28 @@ func AddFlags(fs *pflag.FlagSet) {
 	fs.Duration(ParamCacheEvictAfterIdlePeriod, DefaultCacheEvictAfterIdlePeriod, "Idle cloud cache eviction period")
 	fs.Duration(ParamCacheTTL, DefaultCacheTTL, "Cloud cache TTL for successful lookups")
 	fs.Duration(ParamCacheNegativeTTL, DefaultCacheNegativeTTL, "Cloud cache TTL for failed lookups")
-	fs.String(ParamMetricsAddr, DefaultMetricsAddr, "Address on which to listen for metrics")
+	fs.String(ParamMetricsAddr, DefaultMetricsAddr, "Comma separated list of addresses on which to listen for metrics")
+	fs.String(ParamMetricsAddrCounters, "", "Comma separated list of addresses on which to listen for counters only")
+	fs.String(ParamMetricsAddrGauges, "", "Comma separated list of addresses on which to listen for gauges only")
+	fs.String(ParamMetricsAddrTimers, "", "Comma separated list of addresses on which to listen for timers only")
+	fs.String(ParamMetricsAddrSets, "", "Comma separated list of addresses on which to listen for sets only")
+	fs.String(ParamTypedPortPolicy, DefaultTypedPortPolicy, "Handling of metrics of the wrong type received on a typed address, one of coerce, drop or accept")
+	fs.String(ParamUnknownTypePolicy, DefaultUnknownTypePolicy, "Handling of metrics of an unknown type, one of drop, counter or log")
+	fs.String(ParamNameWhitespace, DefaultNameWhitespace, "Handling of spaces and tabs in metric names, one of underscore (replace each with _), trim-trailing, trim (also leading) or collapse (also turn each internal run in to a single _)")
+	fs.Int(ParamMaxTags, DefaultMaxTags, "Maximum number of tags per received metric (0 for no limit)")
+	fs.Int(ParamMaxTagKeyLength, DefaultMaxTagKeyLength, "Maximum length of the key of a tag, the part before the first colon (0 for no limit)")
+	fs.Int(ParamMaxTagValueLength, DefaultMaxTagValueLength, "Maximum length of the value of a tag, the part after the first colon (0 for no limit)")
+	fs.String(ParamTagLimitPolicy, DefaultTagLimitPolicy, "Handling of metrics which exceed a tag limit, one of truncate or reject")
+	fs.Bool(ParamNormalizeTags, DefaultNormalizeTags, "Lowercase the keys of the tags of received metrics and sort them, before tag limits are applied")
+	fs.String(ParamSourceBlocklist, DefaultSourceBlocklist, "File listing source IP addresses or CIDR networks to drop datagrams from, reloaded on SIGHUP")
+	fs.String(ParamSampleRateRules, DefaultSampleRateRules, "File of rules to scale, ignore or reject the sample rate of counters by name or source, reloaded on SIGHUP")
+	fs.String(ParamGaugeDeltaRules, DefaultGaugeDeltaRules, "File of rules turning off, by name, the change of gauges by signed values such as +5 or -5, reloaded on SIGHUP")
+	fs.String(ParamRulesFile, DefaultRulesFile, "File of filters, aliases and scalings in the format of the config file, applied after those of the config, reloaded on SIGHUP")
+	fs.Int(ParamMaxComponentRestarts, DefaultMaxComponentRestarts, "Number of times in a row a component is restarted after a panic before the server shuts down")
+	fs.Duration(ParamDedupWindow, DefaultDedupWindow, "Drop datagrams identical to one received from the same source address within this window (0 to disable)")
+	fs.Duration(ParamMetricDedupWindow, DefaultMetricDedupWindow, "Drop metrics matching metric-dedup-match which are identical to one received within this window (0 to disable)")
+	fs.String(ParamMetricDedupMatch, "", "Space separated list of metric name patterns to deduplicate, a trailing * matches any suffix")
+	fs.Bool(ParamTagListener, DefaultTagListener, "Tag metrics and events with the address they were received on")
 	fs.String(ParamNamespace, "", "Namespace all metrics")
 	fs.String(ParamBackends, strings.Join(DefaultBackends, " "), "Space separated list of backends")
 	fs.Int(ParamMaxCloudRequests, DefaultMaxCloudRequests, "Maximum number of cloud provider requests per second")
@@ -167,11 +542,80 @@ func AddFlags(fs *pflag.FlagSet) {
 	fs.String(ParamDefaultTags, strings.Join(DefaultTags, " "), "Space separated list of tags to add to all metrics")
 	fs.String(ParamInternalTags, strings.Join(DefaultInternalTags, " "), "Space separated list of tags to add to internal metrics")
 	fs.String(ParamInternalNamespace, DefaultInternalNamespace, "Namespace for internal metrics, may be \"\"")
+	fs.String(ParamInternalPrefix, "", "Namespace for internal metrics independent of --namespace, replacing --namespace and --internal-namespace for them if set")
 	fs.String(ParamStatserType, DefaultStatserType, "Statser type to be used for sending metrics")
-	fs.String(ParamPercentThreshold, strings.Join(toStringSlice(DefaultPercentThreshold), " "), "Space separated list of percentiles")
+	fs.Var(NewFloatSliceValue(ParamPercentThreshold, DefaultPercentThreshold, ValidatePercentThreshold), ParamPercentThreshold, "Comma or space separated list of percentiles between -100 and 100, may be repeated")
+	fs.String(ParamPercentileInterpolation, DefaultPercentileInterpolation, "Method of computing timer percentiles, one of nearest-rank or linear")
+	fs.String(ParamCounterOverflow, DefaultCounterOverflow, "Handling of counters which overflow int64, one of saturate or wrap")
+	fs.String(ParamColdStart, DefaultColdStart, "Handling of the partial first flush after startup, one of none, suppress, mark or scale")
+	fs.Duration(ParamFlushWarmup, DefaultFlushWarmup, "Delay the first flush after startup by this long, including the metrics received meanwhile in it")
+	fs.Var(NewFloatSliceValue(ParamTimerUnderThresholds, nil, ValidateTimerUnderThreshold), ParamTimerUnderThresholds, "Comma or space separated list of thresholds, each emitted as under_<threshold> with the number of timer values at or under it, may be repeated")
 	fs.Bool(ParamHeartbeatEnabled, DefaultHeartbeatEnabled, "Enables heartbeat")
 	fs.Int(ParamReceiveBatchSize, DefaultReceiveBatchSize, "The number of datagrams to read in each receive batch")
 	fs.Bool(ParamConnPerReader, DefaultConnPerReader, "Create a separate connection per reader (requires system support for reusing addresses)")
+	fs.Bool(ParamDisablePacketAggregation, DefaultDisablePacketAggregation, "Disable combining identical metrics within a datagram before they are aggregated")
+	fs.Duration(ParamMaxMetricTTL, DefaultMaxMetricTTL, "Maximum TTL a client may set on a metric with |ttl:<seconds>, larger TTLs are capped to this (0 to disable the extension)")
+	fs.Bool(ParamDisableMetricTTL, DefaultDisableMetricTTL, "Disable the |ttl:<seconds> extension, rejecting lines which use it")
+	fs.String(ParamTCPMetricsAddr, DefaultTCPMetricsAddr, "Address on which to receive newline delimited metrics over TCP, optionally gzip or snappy compressed, empty to disable")
+	fs.String(ParamHTTPMetricsAddr, DefaultHTTPMetricsAddr, "Address on which to receive newline delimited metrics in HTTP POST bodies, optionally gzip or snappy compressed, empty to disable")
+	fs.Float64(ParamMaxDecompressionRatio, DefaultMaxDecompressionRatio, "Close compressed TCP and HTTP streams which decompress to more than this many times their size (0 to disable)")
+	fs.Int(ParamMaxTCPConns, DefaultMaxTCPConns, "Close TCP connections accepted on --tcp-metrics-addr while this many are open (0 for no limit)")
+	fs.Duration(ParamTCPIdleTimeout, DefaultTCPIdleTimeout, "Close TCP connections on --tcp-metrics-addr which send nothing for this long (0 to disable)")
+	fs.String(ParamStateFile, DefaultStateFile, "Save metrics which have not been flushed and backend state to this file on shutdown, and restore them on startup, empty to disable")
+	fs.Duration(ParamStateMaxAge, DefaultStateMaxAge, "Ignore a state file written longer ago than this")
+	fs.String(ParamJournalFile, DefaultJournalFile, "Journal metrics matching journal-match to this file until they are flushed, and replay them on startup, empty to disable")
+	fs.String(ParamJournalMatch, "", "Space separated list of metric name patterns to journal, a trailing * matches any suffix")
+	fs.Duration(ParamJournalSyncInterval, DefaultJournalSyncInterval, "How often journaled metrics are synced to disk")
+	fs.Int(ParamJournalQueueSize, DefaultJournalQueueSize, "Number of metrics queued to be journaled, further metrics are not journaled while the queue is full")
+	fs.Int(ParamPipelineTraceRate, DefaultPipelineTraceRate, "Trace one in this many UDP datagrams through the pipeline, emitting the time spent in each stage as internal timers (0 to disable)")
+	fs.Bool(ParamLint, DefaultLint, "Log the names of metrics which are invalid for a backend instead of sending metrics and events to the backends")
+	fs.String(ParamLintRules, "", "Space separated list of naming rules to check metric names against as well as those of the backends, from: prometheus")
+	fs.String(ParamContainerResolver, DefaultContainerResolver, "How to look up the containers which sent metrics with a dogstatsd container ID, to tag them with the container's name, image and namespace: none or docker")
+	fs.String(ParamDockerSocket, DefaultDockerSocket, "Path of the Docker Engine API socket, for the docker container resolver")
+	fs.Duration(ParamContainerCacheTTL, DefaultContainerCacheTTL, "How long the metadata of a container is cached for")
+	fs.Bool(ParamStripContainerID, DefaultStripContainerID, "Discard the dogstatsd container ID field of metrics rather than tagging them with it")
+	fs.Int64(ParamRecentLinesMaxBytes, DefaultRecentLinesMaxBytes, "Memory used to keep the most recent raw lines for the recent command, 0 to disable")
+	fs.String(ParamGRPCAddr, DefaultGRPCAddr, "Address on which to serve the read-only gRPC API, empty to disable")
+	fs.Int(ParamFlushHistory, DefaultFlushHistory, "Number of recent flushes to keep a snapshot of, for the diff command, 0 to disable")
+	fs.String(ParamClockSkewPolicy, DefaultClockSkewPolicy, "Handling of the dogstatsd client timestamp field, one of off (reject lines with it), clamp, shift or reject")
+	fs.Duration(ParamClockSkewWindow, DefaultClockSkewWindow, "How far a client timestamp may be from the time its metric was received before it is clamped or rejected")
+	fs.Duration(ParamClockSkewLearnWindow, DefaultClockSkewLearnWindow, "Window the clock skew of each source is learned over, and after which an idle source is forgotten")
+	fs.Int(ParamClockSkewMaxSources, DefaultClockSkewMaxSources, "Maximum number of sources the clock skew is learned for")
+	fs.Int(ParamLastSeenMaxSources, DefaultLastSeenMaxSources, "Maximum number of sources tracked by when they last sent a datagram, for the sources command, the least recently seen being evicted (0 to disable)")
+	fs.Duration(ParamLastSeenExpiry, DefaultLastSeenExpiry, "Forget a source which has not sent anything for this long")
+	fs.Duration(ParamSilentSourceThreshold, DefaultSilentSourceThreshold, "Count parser.source_silent, tagged with the source, when a known source has not sent anything for this long (0 to disable)")
+	fs.String(ParamTimerAggregation, DefaultTimerAggregation, "How timer samples are aggregated, one of samples or exphistogram")
+	fs.Int(ParamExpHistogramScale, DefaultExpHistogramScale, "Scale exponential histograms of timers start at, the base of their buckets being 2^(2^-scale)")
+	fs.Int(ParamExpHistogramMaxBuckets, DefaultExpHistogramMaxBuckets, "Maximum number of buckets of each sign of an exponential histogram, which is downscaled to fit")
+	fs.String(ParamHDRMatch, "", "Space separated list of timer name patterns to record in an HDR histogram rather than keep the samples of, a trailing * matches any suffix")
+	fs.Int(ParamHDRSignificantDigits, DefaultHDRSignificantDigits, "Number of significant decimal digits of the HDR histograms of timers, from 1 to 5")
+	fs.Float64(ParamHDRMaxValue, DefaultHDRMaxValue, "Highest value the HDR histograms of timers track, higher values are counted as this value")
+	fs.Duration(ParamLateArrivalWindow, DefaultLateArrivalWindow, "Send counters and timers which reach the aggregator up to this long after their interval was flushed to backends which backfill, stamped in that interval (0 to disable)")
+	fs.Bool(ParamLogFlushSummary, DefaultLogFlushSummary, "Log a summary line at INFO level after each flush")
+	fs.Bool(ParamSortMetrics, DefaultSortMetrics, "Send metrics to backends in order of name, then tags, so the output of each flush is reproducible")
+	fs.Bool(ParamRetryFailedFlushes, DefaultRetryFailedFlushes, "Send a flush again with the next one to the backends which failed to send it, keeping a copy of every flush until the next")
+	fs.Bool(ParamTimerRate, DefaultTimerRate, "Also flush a <timer>.rate gauge for each timer, with the number of timings per second in the interval")
+	fs.String(ParamReceiveQueuePolicy, DefaultReceiveQueuePolicy, "Policy when the parsers can't keep up, one of drop-newest or drop-oldest")
+	fs.Int(ParamReceiveQueueSize, DefaultReceiveQueueSize, "Number of datagram batches buffered with the drop-oldest receive queue policy")
+	fs.Duration(ParamReceiveQueueMaxAge, DefaultReceiveQueueMaxAge, "Discard received datagrams which have been queued for longer than this (0 to disable)")
+	fs.String(ParamConsoleAddr, DefaultConsoleAddr, "Address on which to listen for TCP console connections, empty to disable")
+	fs.String(ParamAPIAddr, DefaultAPIAddr, "Address on which to listen for HTTP API requests, empty to disable.  Only read-only commands are served if --admin-api-addr is set")
+	fs.String(ParamAdminAPIAddr, DefaultAdminAPIAddr, "Address on which to listen for HTTP API requests for all commands including admin commands, empty to serve them on --api-addr")
+	fs.String(ParamAdminAPIToken, "", "Bearer token required for admin commands over HTTP, which are refused if it is empty")
+	fs.String(ParamTraceMetrics, DefaultTraceMetrics, "Log each stage of processing for metrics whose name matches this glob, empty to disable")
+	fs.Duration(ParamTraceMetricsDuration, DefaultTraceMetricsDuration, "Stop tracing metrics after this long")
+	fs.String(ParamCaptureDir, DefaultCaptureDir, "Directory the capture console command writes its files to, empty to disable captures")
+	fs.Int64(ParamCaptureMaxBytes, DefaultCaptureMaxBytes, "Maximum number of bytes written by a capture before it is stopped")
+	fs.String(ParamSetDelimiter, DefaultSetDelimiter, "Split set values in to multiple members on this delimiter, empty to disable")
+	fs.Int(ParamSetExactLimit, DefaultSetExactLimit, "Estimate the cardinality of sets with more members than this using HyperLogLog (0 to disable)")
+	fs.Int(ParamGaugeFlapThreshold, DefaultGaugeFlapThreshold, "Flush only the last value of gauges which change value more than this many times in a flush interval (0 to disable)")
+	fs.String(ParamGaugeEWMAMatch, "", "Space separated list of gauge name patterns to smooth into a moving average, a trailing * matches any suffix")
+	fs.Float64(ParamGaugeEWMADecay, DefaultGaugeEWMADecay, "Weight of the running value of smoothed gauges when a value is received, at least 0 and less than 1")
+	fs.String(ParamGaugeDerivativeMatch, "", "Space separated list of gauge name patterns to flush as their per-second rate of change, a trailing * matches any suffix")
+	fs.Bool(ParamGaugeMinMax, DefaultGaugeMinMax, "Also flush <gauge>.min and <gauge>.max, the lowest and highest value of each gauge updated in the interval")
+	fs.String(ParamGaugeConflict, "", "Space separated list of <pattern>=<policy> rules for which value is flushed for gauges updated more than once in the interval, the policy being last, max, min, mean or sum, a trailing * matches any suffix")
+	fs.String(ParamPeakMatch, "", "Space separated list of counter and gauge name patterns to also flush as <name>.peak_<window> and <name>.trough_<window>, a trailing * matches any suffix")
+	fs.String(ParamPeakWindows, DefaultPeakWindows, "Space separated list of windows, aligned to the wall clock, to track the peaks of counters and gauges over")
 }
 
 func minInt(a, b int) int {
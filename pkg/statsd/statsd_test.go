@@ -1,9 +1,14 @@
 package statsd
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"math/rand"
+	"net"
 	"runtime"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -11,7 +16,10 @@ import (
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/fakesocket"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
 )
 
@@ -75,6 +83,174 @@ func TestStatsdThroughput(t *testing.T) {
 		memStatsFinish.GCCPUFraction)
 }
 
+func TestStatsdMultipleListeners(t *testing.T) {
+	t.Parallel()
+	backend := &recordingBackend{names: map[string]gostatsd.Tags{}}
+	s := Server{
+		Backends:         []gostatsd.Backend{backend},
+		DefaultTags:      DefaultTags,
+		ExpiryInterval:   DefaultExpiryInterval,
+		FlushInterval:    10 * time.Millisecond,
+		MaxReaders:       1,
+		MaxParsers:       1,
+		MaxWorkers:       1,
+		MaxQueueSize:     DefaultMaxQueueSize,
+		EstimatedTags:    DefaultEstimatedTags,
+		PercentThreshold: DefaultPercentThreshold,
+		ReceiveBatchSize: DefaultReceiveBatchSize,
+		StatserType:      StatserNull,
+		TagListener:      true,
+		Viper:            viper.New(),
+	}
+	// Flushes this often would be refused outside of tests.
+	s.ForceFlushInterval = true
+
+	var listeners []MetricListener
+	for _, name := range []string{"first", "second"} {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners = append(listeners, MetricListener{
+			Addr: name,
+			SocketFactory: func() (net.PacketConn, error) {
+				return c, nil
+			},
+		})
+		conn, err := net.Dial("udp", c.LocalAddr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte(name + ":1|c"))
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	go func() {
+		for ctx.Err() == nil {
+			if backend.count() == 2 {
+				cancelFunc()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	err := s.RunWithCustomSockets(ctx, listeners)
+	require.Equal(t, context.Canceled, err)
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	assert.Equal(t, map[string]gostatsd.Tags{
+		"first":  {"listener:first"},
+		"second": {"listener:second"},
+	}, backend.names)
+}
+
+func TestStatsdMultipleServers(t *testing.T) {
+	t.Parallel()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+
+	names := []string{"east", "west"}
+	servers := make([]*Server, len(names))
+	backends := make([]*recordingBackend, len(names))
+	logs := make([]*bytes.Buffer, len(names))
+	listeners := make([][]MetricListener, len(names))
+	for i, name := range names {
+		backends[i] = &recordingBackend{names: map[string]gostatsd.Tags{}}
+		logs[i] = &bytes.Buffer{}
+		logger := logrus.New()
+		logger.Out = logs[i]
+		servers[i] = &Server{
+			Backends:         []gostatsd.Backend{backends[i]},
+			DefaultTags:      DefaultTags,
+			ExpiryInterval:   DefaultExpiryInterval,
+			FlushInterval:    10 * time.Millisecond,
+			MaxReaders:       1,
+			MaxParsers:       1,
+			MaxWorkers:       1,
+			MaxQueueSize:     DefaultMaxQueueSize,
+			EstimatedTags:    DefaultEstimatedTags,
+			PercentThreshold: DefaultPercentThreshold,
+			ReceiveBatchSize: DefaultReceiveBatchSize,
+			Namespace:        name,
+			StatserType:      StatserNull,
+			Viper:            viper.New(),
+			Logger:           logger.WithField("server", name),
+		}
+		servers[i].ForceFlushInterval = true
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[i] = []MetricListener{{
+			Addr: c.LocalAddr().String(),
+			SocketFactory: func() (net.PacketConn, error) {
+				return c, nil
+			},
+		}}
+		conn, err := net.Dial("udp", c.LocalAddr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("requests:1|c"))
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers))
+	for i := range servers {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = servers[i].RunWithCustomSockets(ctx, listeners[i])
+		}()
+	}
+	for ctx.Err() == nil && (backends[0].count() == 0 || backends[1].count() == 0) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, ctx.Err())
+	cancelFunc()
+	wg.Wait()
+
+	for i, name := range names {
+		assert.Equal(t, context.Canceled, errs[i], name)
+		backends[i].mu.Lock()
+		assert.Contains(t, backends[i].names, name+".requests", name)
+		assert.Len(t, backends[i].names, 1, name)
+		backends[i].mu.Unlock()
+		// Each server logs through its own logger
+		assert.Contains(t, logs[i].String(), "server="+name)
+		assert.NotContains(t, logs[i].String(), "server="+names[1-i])
+	}
+}
+
+// recordingBackend records the tags of each counter it receives.
+type recordingBackend struct {
+	mu    sync.Mutex
+	names map[string]gostatsd.Tags
+}
+
+func (rb *recordingBackend) Name() string {
+	return "recordingBackend"
+}
+
+func (rb *recordingBackend) count() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return len(rb.names)
+}
+
+func (rb *recordingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	rb.mu.Lock()
+	m.Counters.Each(func(name, tagset string, c gostatsd.Counter) {
+		if c.Value > 0 {
+			rb.names[name] = c.Tags
+		}
+	})
+	rb.mu.Unlock()
+	callback(nil)
+}
+
+func (rb *recordingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
 type countingBackend struct {
 	metrics uint64
 	events  uint64
@@ -134,3 +310,194 @@ func (fp *fakeProvider) Instance(ctx context.Context, ips ...gostatsd.IP) (map[g
 func (fp *fakeProvider) SelfIP() (gostatsd.IP, error) {
 	return gostatsd.UnknownIP, nil
 }
+
+func TestSplitMetricsAddr(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, []string{":8125"}, splitMetricsAddr(":8125"))
+	assert.Equal(t, []string{":8125", "127.0.0.1:8126"}, splitMetricsAddr(":8125, 127.0.0.1:8126,"))
+	assert.Empty(t, splitMetricsAddr(""))
+}
+
+type initializingBackend struct {
+	timerBackend
+}
+
+func (ib *initializingBackend) Status() string {
+	return "initializing"
+}
+
+func TestBackendsCommand(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	cmd := backendsCommand([]gostatsd.Backend{&timerBackend{}, nil, &initializingBackend{}})
+	require.NoError(t, cmd(context.Background(), nil, &buf))
+	assert.Equal(t, "timer: ready\ntimer: initializing\n", buf.String())
+}
+
+func TestBackendsCommandTransferStats(t *testing.T) {
+	t.Parallel()
+	tb := &transferBackend{}
+	tb.transfer.Serialized(2048, 3*time.Millisecond)
+	tb.transfer.Sent(512, 20*time.Millisecond)
+	var buf bytes.Buffer
+	cmd := backendsCommand([]gostatsd.Backend{tb})
+	require.NoError(t, cmd(context.Background(), nil, &buf))
+	assert.Equal(t, "timer: ready, 2048 bytes serialized in 3ms, 512 bytes sent in 20ms\n", buf.String())
+}
+
+type reportingBackend struct {
+	timerBackend
+}
+
+func (rb *reportingBackend) WriteReport(w io.Writer) error {
+	_, err := io.WriteString(w, "all good\n")
+	return err
+}
+
+func TestReportCommand(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	cmd := reportCommand([]gostatsd.Backend{&timerBackend{}, nil, &reportingBackend{}}, []string{"timer", "", "shadow"})
+	require.NoError(t, cmd(context.Background(), []string{"shadow"}, &buf))
+	assert.Equal(t, "all good\n", buf.String())
+	assert.EqualError(t, cmd(context.Background(), []string{"timer"}, &buf), `backend "timer" has no report`)
+	assert.EqualError(t, cmd(context.Background(), []string{"graphite"}, &buf), `unknown backend "graphite"`)
+	assert.Error(t, cmd(context.Background(), nil, &buf))
+}
+
+func TestInternalMetricsNamespace(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "stats.statsd", InternalMetricsNamespace("stats", "statsd"))
+	assert.Equal(t, "statsd", InternalMetricsNamespace("", "statsd"))
+	assert.Equal(t, "stats", InternalMetricsNamespace("stats", ""))
+}
+
+func TestInternalMetricsPrefix(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "gostatsd", InternalMetricsPrefix("stats", "statsd", "gostatsd"))
+	assert.Equal(t, "gostatsd", InternalMetricsPrefix("", "", "gostatsd."))
+	assert.Equal(t, "stats.statsd", InternalMetricsPrefix("stats", "statsd", ""))
+}
+
+// namesBackend records the names of the counters and gauges flushed to it.
+type namesBackend struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+func (nb *namesBackend) Name() string {
+	return "namesBackend"
+}
+
+func (nb *namesBackend) has(name string) bool {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+	return nb.names[name]
+}
+
+func (nb *namesBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	nb.mu.Lock()
+	m.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+		nb.names[name] = true
+	})
+	m.Gauges.Each(func(name, tagsKey string, g gostatsd.Gauge) {
+		nb.names[name] = true
+	})
+	nb.mu.Unlock()
+	callback(nil)
+}
+
+func (nb *namesBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestStatsdInternalPrefix(t *testing.T) {
+	t.Parallel()
+	backend := &namesBackend{names: map[string]bool{}}
+	s := Server{
+		Backends:          []gostatsd.Backend{backend},
+		Namespace:         "data",
+		InternalNamespace: DefaultInternalNamespace,
+		InternalPrefix:    "gostatsd",
+		ExpiryInterval:    DefaultExpiryInterval,
+		FlushInterval:     10 * time.Millisecond,
+		MaxReaders:        1,
+		MaxParsers:        1,
+		MaxWorkers:        1,
+		MaxQueueSize:      DefaultMaxQueueSize,
+		EstimatedTags:     DefaultEstimatedTags,
+		PercentThreshold:  DefaultPercentThreshold,
+		ReceiveBatchSize:  DefaultReceiveBatchSize,
+		Viper:             viper.New(),
+	}
+	// Flushes this often would be refused outside of tests.
+	s.ForceFlushInterval = true
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listeners := []MetricListener{{
+		SocketFactory: func() (net.PacketConn, error) {
+			return c, nil
+		},
+	}}
+	conn, err := net.Dial("udp", c.LocalAddr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hits:1|c"))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	go func() {
+		for ctx.Err() == nil {
+			if backend.has("data.hits") && backend.has("gostatsd.aggregator.metrics_received") {
+				cancelFunc()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	err = s.RunWithCustomSockets(ctx, listeners)
+	require.Equal(t, context.Canceled, err)
+
+	// The data metrics are in the data namespace, and the internal metrics under the internal prefix only.
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	for name := range backend.names {
+		if name != "data.hits" {
+			assert.True(t, strings.HasPrefix(name, "gostatsd."), name)
+		}
+	}
+}
+
+func TestServerAggregationOptions(t *testing.T) {
+	t.Parallel()
+	s := &Server{
+		PercentThreshold:        []float64{90},
+		PercentileInterpolation: PercentileLinear,
+		CounterOverflow:         CounterOverflowWrap,
+		GaugeDerivativeMatch:    []string{"bytes.*"},
+	}
+	opts := s.aggregationOptions(true, nil, nil)
+	assert.Equal(t, []float64{90}, opts.PercentThresholds)
+	assert.True(t, opts.HandOffTimerValues)
+	assert.True(t, opts.LinearPercentiles)
+	assert.True(t, opts.WrapCounters)
+	assert.NotNil(t, opts.GaugeDerivative)
+	// Matchers which aren't configured are nil interfaces, so the aggregator doesn't use them.
+	assert.True(t, opts.GaugeSmoothing == nil)
+	assert.True(t, opts.GaugeConflicts == nil)
+	assert.True(t, opts.Peaks == nil)
+	assert.True(t, opts.HDRTimers == nil)
+}
+
+func TestServerValidate(t *testing.T) {
+	t.Parallel()
+	s := &Server{FlushInterval: DefaultFlushInterval}
+	assert.NoError(t, s.Validate())
+	s.GaugeConflict = []string{"cluster.size=median"}
+	assert.Error(t, s.Validate())
+	s.FlushHistory = -1
+	assert.EqualError(t, s.Validate(), "flush history -1 must not be negative")
+	s.ReceiveQueuePolicy = "drop-all"
+	assert.EqualError(t, s.Validate(), `unknown receive queue policy "drop-all"`)
+}
@@ -0,0 +1,588 @@
+package statsd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	"github.com/atlassian/gostatsd/pkg/snappy"
+	stats "github.com/atlassian/gostatsd/pkg/statser"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Compression of a stream of lines.
+const (
+	CompressionNone   = "none"
+	CompressionGzip   = "gzip"
+	CompressionSnappy = "snappy"
+)
+
+const (
+	compressionNone = iota
+	compressionGzip
+	compressionSnappy
+	numCompressions
+)
+
+var compressionNames = [numCompressions]string{
+	compressionNone:   CompressionNone,
+	compressionGzip:   CompressionGzip,
+	compressionSnappy: CompressionSnappy,
+}
+
+// Transport of a stream.
+const (
+	transportTCP = iota
+	transportHTTP
+	numTransports
+)
+
+var transportNames = [numTransports]string{
+	transportTCP:  "tcp",
+	transportHTTP: "http",
+}
+
+// gzipMagic is the first byte of a gzip stream.
+const gzipMagic = 0x1f
+
+// streamBufferSize is the size of the buffer each stream is read in to, and so the longest line accepted.
+const streamBufferSize = packetSizeUDP
+
+var (
+	errLineTooLong      = errors.New("line too long")
+	errExpansionTooHigh = errors.New("decompressed data exceeds the maximum expansion ratio")
+)
+
+// streamCounters holds the cumulative counters for all streams with one compression.
+// Must be read/written only using atomic instructions.
+type streamCounters struct {
+	streams           uint64
+	bytesReceived     uint64
+	bytesDecompressed uint64
+	errors            uint64
+}
+
+// connCounters holds the cumulative counters for all connections of one transport.
+// Must be read/written only using atomic instructions.
+type connCounters struct {
+	accepted  uint64 // Connections accepted, including those closed straight away
+	bytesRead uint64 // Bytes read from connections, before decompression and including HTTP headers
+	errors    uint64 // Errors accepting or reading from connections, other than being idle or closed by the receiver
+	active    int64  // Connections currently open
+}
+
+// stream is a TCP connection or HTTP request being received.
+type stream struct {
+	bytesReceived     uint64 // Must be read/written only using atomic instructions.
+	bytesDecompressed uint64 // Must be read/written only using atomic instructions.
+
+	transport   string
+	remote      string
+	compression int
+	started     time.Time
+}
+
+// StreamReceiver receives newline delimited lines over TCP connections and in the body of HTTP requests, which may
+// be compressed with gzip or snappy.  Streams are decompressed as they are read and passed off to be parsed in
+// chunks of complete lines, in the same way as datagrams, so memory use is bounded regardless of their length.
+type StreamReceiver struct {
+	counters [numCompressions]streamCounters // Must be first to guarantee 64-bit alignment.
+	conns    [numTransports]connCounters     // Must be next to guarantee 64-bit alignment.
+
+	// Fields below must be read/written only using atomic instructions.
+	tcpConns           int64  // TCP connections currently open
+	tcpConnsRejected   uint64 // TCP connections closed as soon as they were accepted, as maxTCPConns were open
+	tcpConnsIdleClosed uint64 // TCP connections closed after sending nothing for tcpIdleTimeout
+
+	maxExpansionRatio float64          // Compressed streams which expand more than this are closed, 0 to disable
+	maxTCPConns       int              // TCP connections accepted while this many are open are closed, 0 for no limit
+	tcpIdleTimeout    time.Duration    // TCP connections which send nothing for this long are closed, 0 to disable
+	blocklist         *SourceBlocklist // Streams from these sources are rejected, may be nil
+	bufPool           sync.Pool        // Buffers of streamBufferSize
+	logger            log.FieldLogger
+
+	mu      sync.Mutex
+	streams map[*stream]struct{} // Active streams
+
+	out chan<- []*Datagram // Output chan of read chunks of lines
+}
+
+// NewStreamReceiver initialises a new StreamReceiver.  blocklist may be nil.
+func NewStreamReceiver(out chan<- []*Datagram, maxExpansionRatio float64, blocklist *SourceBlocklist) *StreamReceiver {
+	return &StreamReceiver{
+		out:               out,
+		maxExpansionRatio: maxExpansionRatio,
+		blocklist:         blocklist,
+		bufPool: sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, streamBufferSize)
+				return &b
+			},
+		},
+		streams: map[*stream]struct{}{},
+		logger:  logging.Component("receiver"),
+	}
+}
+
+func (sr *StreamReceiver) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			sr.mu.Lock()
+			active := len(sr.streams)
+			sr.mu.Unlock()
+			statser.Gauge("receiver.streams_active", float64(active), nil)
+			statser.Gauge("receiver.tcp_conns_active", float64(atomic.LoadInt64(&sr.tcpConns)), nil)
+			statser.Gauge("receiver.tcp_conns_rejected", float64(atomic.LoadUint64(&sr.tcpConnsRejected)), nil)
+			statser.Gauge("receiver.tcp_conns_idle_closed", float64(atomic.LoadUint64(&sr.tcpConnsIdleClosed)), nil)
+			for t := range sr.conns {
+				conns := &sr.conns[t]
+				tags := gostatsd.Tags{"transport:" + transportNames[t]}
+				statser.Gauge("receiver.conns_active", float64(atomic.LoadInt64(&conns.active)), tags)
+				statser.Gauge("receiver.conns_accepted", float64(atomic.LoadUint64(&conns.accepted)), tags)
+				statser.Gauge("receiver.conn_bytes_read", float64(atomic.LoadUint64(&conns.bytesRead)), tags)
+				statser.Gauge("receiver.conn_errors", float64(atomic.LoadUint64(&conns.errors)), tags)
+			}
+			for c := range sr.counters {
+				counters := &sr.counters[c]
+				tags := gostatsd.Tags{"compression:" + compressionNames[c]}
+				statser.Gauge("receiver.streams", float64(atomic.LoadUint64(&counters.streams)), tags)
+				statser.Gauge("receiver.stream_bytes_received", float64(atomic.LoadUint64(&counters.bytesReceived)), tags)
+				statser.Gauge("receiver.stream_bytes_decompressed", float64(atomic.LoadUint64(&counters.bytesDecompressed)), tags)
+				statser.Gauge("receiver.stream_errors", float64(atomic.LoadUint64(&counters.errors)), tags)
+			}
+		}
+	}
+}
+
+// ReceiveTCP accepts TCP connections on l until the context is closed, and receives lines from each with
+// listenerTag added to every metric and event.  listenerTag may be empty.  A connection is compressed if its first
+// byte is the first byte of a gzip stream or a snappy framed stream, neither of which can start a line.  A connection
+// accepted while maxTCPConns are open is closed straight away, and one which sends nothing for tcpIdleTimeout is
+// closed, so a flood of connections can't exhaust file descriptors.  l is closed when ReceiveTCP returns.
+func (sr *StreamReceiver) ReceiveTCP(ctx context.Context, l net.Listener, listenerTag string) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		if err := l.Close(); err != nil {
+			sr.logger.WithError(err).WithField(logging.FieldAddress, l.Addr().String()).Warn("Error closing TCP listener")
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			atomic.AddUint64(&sr.conns[transportTCP].errors, 1)
+			sr.logger.WithError(err).WithField(logging.FieldAddress, l.Addr().String()).Warn("Error accepting TCP connection")
+			continue
+		}
+		conn = sr.countConn(conn, transportTCP)
+		if sr.maxTCPConns > 0 && atomic.LoadInt64(&sr.tcpConns) >= int64(sr.maxTCPConns) {
+			atomic.AddUint64(&sr.tcpConnsRejected, 1)
+			sr.logger.WithField(logging.FieldAddress, conn.RemoteAddr().String()).Debugf("Rejecting TCP connection, %d connections are open", sr.maxTCPConns)
+			conn.Close()
+			continue
+		}
+		// Only this goroutine adds connections, so the limit can't be exceeded.
+		atomic.AddInt64(&sr.tcpConns, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer atomic.AddInt64(&sr.tcpConns, -1)
+			sr.receiveConn(ctx, conn, listenerTag)
+		}()
+	}
+}
+
+func (sr *StreamReceiver) receiveConn(ctx context.Context, conn net.Conn, listenerTag string) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	var ip net.IP
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = a.IP
+	}
+	if sr.isBlocked(ip) {
+		return
+	}
+
+	var r io.Reader = conn
+	if sr.tcpIdleTimeout > 0 {
+		r = &idleConn{Conn: conn, timeout: sr.tcpIdleTimeout}
+	}
+	br := bufio.NewReader(r)
+	first, err := br.Peek(1)
+	if err != nil {
+		sr.countIdleClosed(conn, err)
+		return // Closed without sending anything
+	}
+	compression := compressionNone
+	switch first[0] {
+	case gzipMagic:
+		compression = compressionGzip
+	case snappy.Magic:
+		compression = compressionSnappy
+	}
+	err = sr.receive(ctx, "tcp", conn.RemoteAddr().String(), compression, br, getStreamIP(ip), listenerTag)
+	if sr.countIdleClosed(conn, err) {
+		return
+	}
+	if err != nil && ctx.Err() == nil {
+		sr.logger.WithError(err).WithField(logging.FieldAddress, conn.RemoteAddr().String()).Info("Error receiving from TCP connection")
+	}
+}
+
+// countIdleClosed counts the connection as closed for being idle if err is a timeout, and returns whether it was.
+func (sr *StreamReceiver) countIdleClosed(conn net.Conn, err error) bool {
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		return false
+	}
+	atomic.AddUint64(&sr.tcpConnsIdleClosed, 1)
+	sr.logger.WithFields(log.Fields{
+		logging.FieldAddress:  conn.RemoteAddr().String(),
+		logging.FieldDuration: sr.tcpIdleTimeout,
+	}).Debug("Closing idle TCP connection")
+	return true
+}
+
+// idleConn is a net.Conn whose reads fail if nothing is received for timeout.  Time spent between reads, such as
+// while waiting for lines to be parsed, doesn't count.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+// ReceiveHTTP serves HTTP requests on l until the context is closed, receiving lines from the body of each POST
+// request with listenerTag added to every metric and event.  listenerTag may be empty.  The body may be compressed
+// as given by the Content-Encoding header, which is one of identity, gzip or snappy.
+func (sr *StreamReceiver) ReceiveHTTP(ctx context.Context, l net.Listener, listenerTag string) {
+	srv := &http.Server{Handler: sr.httpHandler(listenerTag)}
+	l = &countingListener{Listener: l, sr: sr, done: ctx.Done()}
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Close(); err != nil {
+			sr.logger.WithError(err).WithField(logging.FieldAddress, l.Addr().String()).Warn("Error closing HTTP receiver")
+		}
+	}()
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		sr.logger.WithError(err).WithField(logging.FieldAddress, l.Addr().String()).Error("HTTP receiver failed")
+	}
+}
+
+func (sr *StreamReceiver) httpHandler(listenerTag string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var compression int
+		switch r.Header.Get("Content-Encoding") {
+		case "", "identity":
+			compression = compressionNone
+		case "gzip":
+			compression = compressionGzip
+		case "snappy", "x-snappy-framed":
+			compression = compressionSnappy
+		default:
+			http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if sr.isBlocked(ip) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		switch err := sr.receive(r.Context(), "http", r.RemoteAddr, compression, r.Body, getStreamIP(ip), listenerTag); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errLineTooLong, errExpansionTooHigh:
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+func (sr *StreamReceiver) isBlocked(ip net.IP) bool {
+	return sr.blocklist != nil && ip != nil && sr.blocklist.Blocked(ip)
+}
+
+func getStreamIP(ip net.IP) gostatsd.IP {
+	if ip == nil {
+		return gostatsd.UnknownIP
+	}
+	return gostatsd.IP(ip.String())
+}
+
+// receive reads lines from r, which is compressed with compression, until it ends.
+func (sr *StreamReceiver) receive(ctx context.Context, transport, remote string, compression int, r io.Reader, ip gostatsd.IP, listenerTag string) error {
+	s := &stream{
+		transport:   transport,
+		remote:      remote,
+		compression: compression,
+		started:     time.Now(),
+	}
+	sr.mu.Lock()
+	sr.streams[s] = struct{}{}
+	sr.mu.Unlock()
+	defer func() {
+		sr.mu.Lock()
+		delete(sr.streams, s)
+		sr.mu.Unlock()
+	}()
+
+	counters := &sr.counters[compression]
+	atomic.AddUint64(&counters.streams, 1)
+	err := sr.receiveLines(ctx, s, counters, r, ip, listenerTag)
+	if err != nil && err != context.Canceled {
+		atomic.AddUint64(&counters.errors, 1)
+	}
+	return err
+}
+
+func (sr *StreamReceiver) receiveLines(ctx context.Context, s *stream, counters *streamCounters, r io.Reader, ip gostatsd.IP, listenerTag string) error {
+	received := &countingReader{r: r, stream: &s.bytesReceived, total: &counters.bytesReceived}
+	lines := io.Reader(received)
+	switch s.compression {
+	case compressionGzip:
+		zr, err := gzip.NewReader(received)
+		if err != nil {
+			return err
+		}
+		lines = zr
+	case compressionSnappy:
+		lines = snappy.NewReader(received)
+	}
+	checkExpansion := s.compression != compressionNone && sr.maxExpansionRatio > 0
+
+	buf := sr.bufPool.Get().(*[]byte)
+	defer func() {
+		if buf != nil {
+			sr.bufPool.Put(buf)
+		}
+	}()
+	n := 0
+	for {
+		read, err := lines.Read((*buf)[n:])
+		if read > 0 {
+			n += read
+			decompressed := atomic.AddUint64(&s.bytesDecompressed, uint64(read))
+			atomic.AddUint64(&counters.bytesDecompressed, uint64(read))
+			if checkExpansion && float64(decompressed) > sr.maxExpansionRatio*float64(atomic.LoadUint64(&s.bytesReceived)) {
+				return errExpansionTooHigh
+			}
+		}
+		end := n
+		if err != io.EOF {
+			// Only complete lines are passed on, the remainder is kept for the next read.
+			end = bytes.LastIndexByte((*buf)[:n], '\n') + 1
+			if end == 0 && err == nil {
+				if n == len(*buf) {
+					return errLineTooLong
+				}
+				continue
+			}
+		}
+		if end > 0 {
+			next := sr.bufPool.Get().(*[]byte)
+			n = copy(*next, (*buf)[end:n])
+			if err := sr.dispatch(ctx, buf, end, ip, listenerTag); err != nil {
+				sr.bufPool.Put(next)
+				return err
+			}
+			buf = next
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dispatch passes the first n bytes of buf off to be parsed.  buf is returned to the pool once they are parsed.
+func (sr *StreamReceiver) dispatch(ctx context.Context, buf *[]byte, n int, ip gostatsd.IP, listenerTag string) error {
+	dg := &Datagram{
+		IP:          ip,
+		Msg:         (*buf)[:n],
+		Received:    time.Now(),
+		ListenerTag: listenerTag,
+		DoneFunc: func() {
+			sr.bufPool.Put(buf)
+		},
+	}
+	select {
+	case sr.out <- []*Datagram{dg}:
+		return nil
+	case <-ctx.Done():
+		sr.bufPool.Put(buf)
+		return ctx.Err()
+	}
+}
+
+// StreamsCommand is the console command to show the active streams.
+func (sr *StreamReceiver) StreamsCommand(ctx context.Context, args []string, w io.Writer) error {
+	sr.mu.Lock()
+	streams := make([]*stream, 0, len(sr.streams))
+	for s := range sr.streams {
+		streams = append(streams, s)
+	}
+	sr.mu.Unlock()
+
+	if len(streams) == 0 {
+		_, err := fmt.Fprintln(w, "No active streams")
+		return err
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].started.Before(streams[j].started)
+	})
+	now := time.Now()
+	for _, s := range streams {
+		_, err := fmt.Fprintf(w, "%s %s compression:%s bytes_received:%d bytes_decompressed:%d age:%v\n",
+			s.transport, s.remote, compressionNames[s.compression], atomic.LoadUint64(&s.bytesReceived),
+			atomic.LoadUint64(&s.bytesDecompressed), now.Sub(s.started).Truncate(time.Second))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnectionsCommand is the console command to show the totals of the TCP and HTTP connections.
+func (sr *StreamReceiver) ConnectionsCommand(ctx context.Context, args []string, w io.Writer) error {
+	for t := range sr.conns {
+		conns := &sr.conns[t]
+		_, err := fmt.Fprintf(w, "%s active:%d accepted:%d bytes_read:%d errors:%d", transportNames[t],
+			atomic.LoadInt64(&conns.active), atomic.LoadUint64(&conns.accepted), atomic.LoadUint64(&conns.bytesRead),
+			atomic.LoadUint64(&conns.errors))
+		if err == nil && t == transportTCP {
+			_, err = fmt.Fprintf(w, " rejected:%d idle_closed:%d", atomic.LoadUint64(&sr.tcpConnsRejected),
+				atomic.LoadUint64(&sr.tcpConnsIdleClosed))
+		}
+		if err == nil {
+			_, err = fmt.Fprintln(w)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countConn counts conn as an accepted connection of transport, and returns it wrapped to count what is read from it
+// and when it is closed.
+func (sr *StreamReceiver) countConn(conn net.Conn, transport int) net.Conn {
+	counters := &sr.conns[transport]
+	atomic.AddUint64(&counters.accepted, 1)
+	atomic.AddInt64(&counters.active, 1)
+	return &countingConn{Conn: conn, counters: counters}
+}
+
+// countingConn is a net.Conn counting the bytes read from it, read errors and when it is closed.
+type countingConn struct {
+	net.Conn
+	counters *connCounters
+	closed   int32 // Set once Close is called.  Must be read/written only using atomic instructions.
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.counters.bytesRead, uint64(n))
+	if err != nil && err != io.EOF && atomic.LoadInt32(&c.closed) == 0 {
+		// Timeouts are idle connections, counted separately.
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			atomic.AddUint64(&c.counters.errors, 1)
+		}
+	}
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.counters.active, -1)
+	}
+	return c.Conn.Close()
+}
+
+// countingListener is a net.Listener counting the connections it accepts for the HTTP receiver.
+type countingListener struct {
+	net.Listener
+	sr   *StreamReceiver
+	done <-chan struct{} // Closed when the listener is being closed, so errors are expected
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		select {
+		case <-l.done:
+		default:
+			atomic.AddUint64(&l.sr.conns[transportHTTP].errors, 1)
+		}
+		return nil, err
+	}
+	return l.sr.countConn(conn, transportHTTP), nil
+}
+
+// countingReader counts the bytes read from r in both stream and total.
+type countingReader struct {
+	r      io.Reader
+	stream *uint64
+	total  *uint64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddUint64(cr.stream, uint64(n))
+	atomic.AddUint64(cr.total, uint64(n))
+	return n, err
+}
@@ -0,0 +1,344 @@
+package statsd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const streamTestLines = "a:1|c\nb:2|g\nc:3|ms\n"
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+// snappyFramed returns data in the snappy framing format, as a single uncompressed chunk.
+func snappyFramed(data []byte) []byte {
+	c := crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+	b := []byte{0xff, 6, 0, 0, 's', 'N', 'a', 'P', 'p', 'Y'}
+	n := len(data) + 4
+	b = append(b, 0x01, byte(n), byte(n>>8), byte(n>>16), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], (c>>15|c<<17)+0xa282ead8)
+	return append(b, data...)
+}
+
+// readDatagrams returns the contents of the datagrams received on out, until no more arrive for a short time.
+func readDatagrams(out <-chan []*Datagram) (string, []*Datagram) {
+	var received []byte
+	var all []*Datagram
+	for {
+		select {
+		case dgs := <-out:
+			for _, dg := range dgs {
+				received = append(received, dg.Msg...)
+				all = append(all, dg)
+				dg.DoneFunc()
+			}
+		case <-time.After(200 * time.Millisecond):
+			return string(received), all
+		}
+	}
+}
+
+func TestStreamReceiverTCP(t *testing.T) {
+	t.Parallel()
+	tests := map[string]func(*testing.T) []byte{
+		CompressionNone:   func(*testing.T) []byte { return []byte(streamTestLines) },
+		CompressionGzip:   func(t *testing.T) []byte { return gzipped(t, []byte(streamTestLines)) },
+		CompressionSnappy: func(*testing.T) []byte { return snappyFramed([]byte(streamTestLines)) },
+	}
+	for compression, payload := range tests {
+		compression := compression
+		payload := payload
+		t.Run(compression, func(t *testing.T) {
+			t.Parallel()
+			out := make(chan []*Datagram, 100)
+			sr := NewStreamReceiver(out, DefaultMaxDecompressionRatio, nil)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go sr.ReceiveTCP(ctx, l, "listener:test")
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			data := payload(t)
+			// Split writes must not split lines.
+			_, err = conn.Write(data[:len(data)/2])
+			require.NoError(t, err)
+			time.Sleep(50 * time.Millisecond)
+			_, err = conn.Write(data[len(data)/2:])
+			require.NoError(t, err)
+			require.NoError(t, conn.Close())
+
+			received, dgs := readDatagrams(out)
+			assert.Equal(t, streamTestLines, received)
+			for _, dg := range dgs {
+				assert.Equal(t, gostatsd.IP("127.0.0.1"), dg.IP)
+				assert.Equal(t, "listener:test", dg.ListenerTag)
+				assert.True(t, strings.HasSuffix(string(dg.Msg), "\n"))
+			}
+
+			counters := &sr.counters[compressionIndex(compression)]
+			assert.EqualValues(t, 1, atomic.LoadUint64(&counters.streams))
+			assert.EqualValues(t, len(data), atomic.LoadUint64(&counters.bytesReceived))
+			assert.EqualValues(t, len(streamTestLines), atomic.LoadUint64(&counters.bytesDecompressed))
+			assert.Zero(t, atomic.LoadUint64(&counters.errors))
+		})
+	}
+}
+
+func compressionIndex(name string) int {
+	for i, n := range compressionNames {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestStreamReceiverUnterminatedLine(t *testing.T) {
+	t.Parallel()
+	out := make(chan []*Datagram, 100)
+	sr := NewStreamReceiver(out, 0, nil)
+	require.NoError(t, sr.receive(context.Background(), "test", "remote", compressionNone, strings.NewReader("a:1|c\nb:1|c"), gostatsd.UnknownIP, ""))
+	received, _ := readDatagrams(out)
+	assert.Equal(t, "a:1|c\nb:1|c", received)
+}
+
+func TestStreamReceiverLimits(t *testing.T) {
+	t.Parallel()
+	out := make(chan []*Datagram, 100)
+	sr := NewStreamReceiver(out, 10, nil)
+
+	// Highly compressible data expands too far.
+	bomb := gzipped(t, bytes.Repeat([]byte("a:1|c\n"), 100000))
+	err := sr.receive(context.Background(), "test", "remote", compressionGzip, bytes.NewReader(bomb), gostatsd.UnknownIP, "")
+	assert.Equal(t, errExpansionTooHigh, err)
+	assert.EqualValues(t, 1, atomic.LoadUint64(&sr.counters[compressionGzip].errors))
+
+	// Uncompressed data has no expansion limit, but lines must fit in the buffer.
+	err = sr.receive(context.Background(), "test", "remote", compressionNone, bytes.NewReader(bytes.Repeat([]byte("a"), streamBufferSize+1)), gostatsd.UnknownIP, "")
+	assert.Equal(t, errLineTooLong, err)
+
+	err = sr.receive(context.Background(), "test", "remote", compressionNone, bytes.NewReader(bytes.Repeat([]byte("a:1|c\n"), 100000)), gostatsd.UnknownIP, "")
+	assert.NoError(t, err)
+	received, _ := readDatagrams(out)
+	assert.Equal(t, 100000, strings.Count(received, "a:1|c\n"))
+}
+
+func TestStreamReceiverHTTP(t *testing.T) {
+	t.Parallel()
+	out := make(chan []*Datagram, 100)
+	sr := NewStreamReceiver(out, DefaultMaxDecompressionRatio, nil)
+	srv := httptest.NewServer(sr.httpHandler(""))
+	defer srv.Close()
+
+	post := func(encoding string, body []byte) int {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/", bytes.NewReader(body))
+		require.NoError(t, err)
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusNoContent, post("", []byte(streamTestLines)))
+	assert.Equal(t, http.StatusNoContent, post("gzip", gzipped(t, []byte(streamTestLines))))
+	assert.Equal(t, http.StatusNoContent, post("snappy", snappyFramed([]byte(streamTestLines))))
+	received, _ := readDatagrams(out)
+	assert.Equal(t, strings.Repeat(streamTestLines, 3), received)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, post("br", []byte(streamTestLines)))
+	assert.Equal(t, http.StatusBadRequest, post("gzip", []byte(streamTestLines)))
+
+	resp, err := http.Get(srv.URL + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestStreamsCommand(t *testing.T) {
+	t.Parallel()
+	sr := NewStreamReceiver(nil, 0, nil)
+	var buf bytes.Buffer
+	require.NoError(t, sr.StreamsCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "No active streams\n", buf.String())
+
+	s := &stream{transport: "tcp", remote: "10.0.0.1:1234", compression: compressionGzip, started: time.Now(), bytesReceived: 10, bytesDecompressed: 100}
+	sr.streams[s] = struct{}{}
+	buf.Reset()
+	require.NoError(t, sr.StreamsCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "tcp 10.0.0.1:1234 compression:gzip bytes_received:10 bytes_decompressed:100 age:0s\n", buf.String())
+}
+
+func TestStreamReceiverTCPMaxConns(t *testing.T) {
+	t.Parallel()
+	out := make(chan []*Datagram, 100)
+	sr := NewStreamReceiver(out, DefaultMaxDecompressionRatio, nil)
+	sr.maxTCPConns = 2
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sr.ReceiveTCP(ctx, l, "")
+
+	var open []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		open = append(open, conn)
+	}
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&sr.tcpConns) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A connection past the limit is closed without being read.
+	rejected, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer rejected.Close()
+	require.NoError(t, rejected.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = rejected.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, atomic.LoadUint64(&sr.tcpConnsRejected))
+
+	// Once a connection closes, another is accepted.
+	require.NoError(t, open[0].Close())
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&sr.tcpConns) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte(streamTestLines))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	received, _ := readDatagrams(out)
+	assert.Equal(t, streamTestLines, received)
+	assert.EqualValues(t, 1, atomic.LoadUint64(&sr.tcpConnsRejected))
+}
+
+func TestStreamReceiverTCPIdleTimeout(t *testing.T) {
+	t.Parallel()
+	out := make(chan []*Datagram, 100)
+	sr := NewStreamReceiver(out, DefaultMaxDecompressionRatio, nil)
+	sr.tcpIdleTimeout = 100 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sr.ReceiveTCP(ctx, l, "")
+
+	// A connection which sends nothing is closed.
+	silent, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer silent.Close()
+
+	// As is one which goes quiet, after its lines are received.
+	quiet, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer quiet.Close()
+	_, err = quiet.Write([]byte(streamTestLines))
+	require.NoError(t, err)
+
+	for _, conn := range []net.Conn{silent, quiet} {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Error(t, err)
+		ne, ok := err.(net.Error)
+		assert.False(t, ok && ne.Timeout(), "connection was not closed by the receiver")
+	}
+	received, _ := readDatagrams(out)
+	assert.Equal(t, streamTestLines, received)
+	require.Eventually(t, func() bool {
+		return atomic.LoadUint64(&sr.tcpConnsIdleClosed) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, atomic.LoadInt64(&sr.tcpConns))
+}
+
+func TestStreamReceiverConnectionCounters(t *testing.T) {
+	t.Parallel()
+	out := make(chan []*Datagram, 100)
+	sr := NewStreamReceiver(out, DefaultMaxDecompressionRatio, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go sr.ReceiveTCP(ctx, tl, "")
+	hl, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go sr.ReceiveHTTP(ctx, hl, "")
+
+	tcp := &sr.conns[transportTCP]
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", tl.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(streamTestLines))
+		require.NoError(t, err)
+		conns = append(conns, conn)
+	}
+	received, _ := readDatagrams(out)
+	assert.Equal(t, strings.Repeat(streamTestLines, 2), received)
+	assert.EqualValues(t, 2, atomic.LoadUint64(&tcp.accepted))
+	assert.EqualValues(t, 2, atomic.LoadInt64(&tcp.active))
+	assert.EqualValues(t, 2*len(streamTestLines), atomic.LoadUint64(&tcp.bytesRead))
+
+	// A connection reset by the client is an error, one closed normally is not.
+	require.NoError(t, conns[0].Close())
+	require.NoError(t, conns[1].(*net.TCPConn).SetLinger(0))
+	require.NoError(t, conns[1].Close())
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&tcp.active) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 2, atomic.LoadUint64(&tcp.accepted))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&tcp.errors))
+
+	// HTTP requests on one keep-alive connection count as one connection.
+	transport := &http.Transport{}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Post("http://"+hl.Addr().String()+"/", "text/plain", strings.NewReader(streamTestLines))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+	httpConns := &sr.conns[transportHTTP]
+	assert.EqualValues(t, 1, atomic.LoadUint64(&httpConns.accepted))
+	assert.EqualValues(t, 1, atomic.LoadInt64(&httpConns.active))
+	assert.True(t, atomic.LoadUint64(&httpConns.bytesRead) > 3*uint64(len(streamTestLines)), "includes the headers")
+	transport.CloseIdleConnections()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&httpConns.active) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, atomic.LoadUint64(&httpConns.errors))
+
+	var buf bytes.Buffer
+	require.NoError(t, sr.ConnectionsCommand(context.Background(), nil, &buf))
+	assert.Equal(t, fmt.Sprintf("tcp active:0 accepted:2 bytes_read:%d errors:1 rejected:0 idle_closed:0\n", 2*len(streamTestLines))+
+		fmt.Sprintf("http active:0 accepted:1 bytes_read:%d errors:0\n", atomic.LoadUint64(&httpConns.bytesRead)), buf.String())
+}
@@ -0,0 +1,325 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/logging"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// supervisorInitialBackoff is the time before a component is first restarted after a panic, doubling with each
+	// consecutive restart.
+	supervisorInitialBackoff = 1 * time.Second
+	// supervisorMaxBackoff is the longest time before a component is restarted after a panic.
+	supervisorMaxBackoff = 30 * time.Second
+	// supervisorStableTime is how long a component must run without panicking for its restarts to be forgiven.
+	supervisorStableTime = 1 * time.Minute
+)
+
+// componentState is the state of every instance of a supervised component, such as the parser workers.
+type componentState struct {
+	instances  int
+	running    int
+	restarting int
+	panics     uint64
+	failed     bool
+	lastPanic  string
+}
+
+func (cs *componentState) status() string {
+	switch {
+	case cs.failed:
+		return "failed"
+	case cs.instances == 0:
+		// A component which only runs short-lived goroutines with Go is never restarted.
+		return "up"
+	case cs.restarting > 0:
+		return "restarting"
+	case cs.running > 0:
+		return "up"
+	default:
+		return "stopped"
+	}
+}
+
+// Supervisor runs the long-lived goroutines of the server, recovering from panics.  A component which panics is
+// restarted after a backoff, until it has been restarted maxRestarts times in a row, when it is marked as failed and
+// the server is shut down.  A nil *Supervisor recovers nothing.
+type Supervisor struct {
+	maxRestarts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	stableTime     time.Duration
+	now            func() time.Time
+	logger         log.FieldLogger
+
+	mu         sync.Mutex
+	components map[string]*componentState
+	failed     chan struct{}
+	err        error
+}
+
+// NewSupervisor returns a Supervisor which restarts a component up to maxRestarts times in a row before giving up.
+func NewSupervisor(maxRestarts int) *Supervisor {
+	return &Supervisor{
+		maxRestarts:    maxRestarts,
+		initialBackoff: supervisorInitialBackoff,
+		maxBackoff:     supervisorMaxBackoff,
+		stableTime:     supervisorStableTime,
+		now:            time.Now,
+		logger:         logging.Component("supervisor"),
+		components:     map[string]*componentState{},
+		failed:         make(chan struct{}),
+	}
+}
+
+// Wrap returns f run as an instance of component, restarting it if it panics.  The returned function returns when f
+// returns without panicking, or when it gives up restarting f.
+func (s *Supervisor) Wrap(component string, f func(ctx context.Context)) func(ctx context.Context) {
+	if s == nil {
+		return f
+	}
+	s.mu.Lock()
+	cs := s.component(component)
+	cs.instances++
+	s.mu.Unlock()
+	return func(ctx context.Context) {
+		restarts := 0
+		for {
+			s.update(func() { cs.running++ })
+			start := s.now()
+			panicked := s.run(ctx, component, f)
+			s.update(func() { cs.running-- })
+			if !panicked {
+				return
+			}
+			if s.now().Sub(start) >= s.stableTime {
+				restarts = 0
+			}
+			if restarts >= s.maxRestarts {
+				s.fail(component, cs)
+				return
+			}
+			backoff := s.backoff(restarts)
+			restarts++
+			s.logger.WithFields(log.Fields{
+				"supervised":          component,
+				logging.FieldDuration: backoff,
+			}).Warnf("Restarting, restart %d of %d", restarts, s.maxRestarts)
+			s.update(func() { cs.restarting++ })
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				s.update(func() { cs.restarting-- })
+				return
+			case <-timer.C:
+			}
+			s.update(func() { cs.restarting-- })
+		}
+	}
+}
+
+// Go runs f in a new goroutine, recovering from and counting a panic in it under component.  Unlike Wrap, f is not
+// restarted, as it is for short-lived goroutines such as the sends of a backend or the connections of the console.
+// A nil *Supervisor runs f with a plain go statement.
+func (s *Supervisor) Go(component string, f func()) {
+	if s == nil {
+		go f()
+		return
+	}
+	go s.recover(component, f)
+}
+
+// recover runs f, recovering from and counting a panic in it under component.  It returns true if f panicked.  A nil
+// *Supervisor recovers nothing.
+func (s *Supervisor) recover(component string, f func()) (panicked bool) {
+	if s == nil {
+		f()
+		return false
+	}
+	return s.run(context.Background(), component, func(context.Context) { f() })
+}
+
+// WrapFunc is Wrap for a function which has no context, such as an aggregator worker.  It is not restarted after a
+// panic once ctx is done.
+func (s *Supervisor) WrapFunc(ctx context.Context, component string, f func()) func() {
+	wrapped := s.Wrap(component, func(context.Context) { f() })
+	return func() {
+		wrapped(ctx)
+	}
+}
+
+// run runs f, returning true if it panicked.
+func (s *Supervisor) run(ctx context.Context, component string, f func(ctx context.Context)) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			s.logger.WithFields(log.Fields{
+				"supervised": component,
+				"panic":      fmt.Sprint(r),
+				"stack":      string(debug.Stack()),
+			}).Error("Recovered from panic")
+			s.mu.Lock()
+			cs := s.component(component)
+			cs.panics++
+			cs.lastPanic = fmt.Sprint(r)
+			s.mu.Unlock()
+		}
+	}()
+	f(ctx)
+	return false
+}
+
+func (s *Supervisor) backoff(restarts int) time.Duration {
+	backoff := s.initialBackoff
+	for i := 0; i < restarts && backoff < s.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.maxBackoff {
+		backoff = s.maxBackoff
+	}
+	return backoff
+}
+
+// fail marks the component as failed, and signals the server to shut down.
+func (s *Supervisor) fail(component string, cs *componentState) {
+	s.logger.WithField("supervised", component).Errorf("Giving up after %d restarts, shutting down", s.maxRestarts)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cs.failed = true
+	if s.err == nil {
+		s.err = fmt.Errorf("%s failed after %d restarts", component, s.maxRestarts)
+		close(s.failed)
+	}
+}
+
+func (s *Supervisor) update(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+}
+
+// component returns the state of component, creating it if it doesn't exist.  s.mu must be held.
+func (s *Supervisor) component(component string) *componentState {
+	cs, ok := s.components[component]
+	if !ok {
+		cs = &componentState{}
+		s.components[component] = cs
+	}
+	return cs
+}
+
+// Failed returns a channel which is closed when a component fails.  It is nil for a nil *Supervisor.
+func (s *Supervisor) Failed() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	return s.failed
+}
+
+// Err returns the error of the first component to fail, or nil.
+func (s *Supervisor) Err() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// names returns the name of each component, sorted.  s.mu must be held.
+func (s *Supervisor) names() []string {
+	names := make([]string, 0, len(s.components))
+	for name := range s.components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RunMetrics emits the number of panics recovered in each component every flush, until ctx is done.
+func (s *Supervisor) RunMetrics(ctx context.Context, statser statser.Statser) {
+	if s == nil {
+		return
+	}
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			s.emit(statser)
+		}
+	}
+}
+
+func (s *Supervisor) emit(statser statser.Statser) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range s.names() {
+		statser.Gauge("supervisor.panics_recovered", float64(s.components[name].panics), gostatsd.Tags{"component:" + name})
+	}
+}
+
+// HealthCommand is the console command to show the status of each component.  It fails if any component has failed.
+func (s *Supervisor) HealthCommand(ctx context.Context, args []string, w io.Writer) error {
+	if s == nil {
+		_, err := fmt.Fprintln(w, "ok")
+		return err
+	}
+	var buf bytes.Buffer
+	s.mu.Lock()
+	err := s.err
+	for _, name := range s.names() {
+		cs := s.components[name]
+		if cs.instances == 0 {
+			_, _ = fmt.Fprintf(&buf, "%-20s %-10s %d panics", name, cs.status(), cs.panics)
+		} else {
+			_, _ = fmt.Fprintf(&buf, "%-20s %-10s %d/%d running, %d panics", name, cs.status(), cs.running, cs.instances, cs.panics)
+		}
+		if cs.lastPanic != "" {
+			_, _ = fmt.Fprintf(&buf, ", last: %s", cs.lastPanic)
+		}
+		buf.WriteByte('\n')
+	}
+	s.mu.Unlock()
+	if err != nil {
+		// The error is returned before any output, so the API responds with an error status.
+		return fmt.Errorf("unhealthy, %v\n%s", err, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	}
+	_, err = fmt.Fprintf(w, "ok\n%s", buf.Bytes())
+	return err
+}
+
+// relistener returns a function which returns l the first time it is called, and a new listener on the same address
+// each time after, as a server closes its listener when it is restarted.  It panics if it can't listen, to be retried
+// by the supervisor.
+func relistener(l net.Listener) func() net.Listener {
+	first := true
+	return func() net.Listener {
+		if first {
+			first = false
+			return l
+		}
+		nl, err := net.Listen(l.Addr().Network(), l.Addr().String())
+		if err != nil {
+			panic(err)
+		}
+		return nl
+	}
+}
@@ -0,0 +1,150 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSupervisor(maxRestarts int) *Supervisor {
+	sup := NewSupervisor(maxRestarts)
+	sup.initialBackoff = time.Millisecond
+	sup.maxBackoff = 4 * time.Millisecond
+	return sup
+}
+
+func TestSupervisorRestartsAfterPanic(t *testing.T) {
+	t.Parallel()
+	sup := newTestSupervisor(3)
+	runs := 0
+	f := sup.Wrap("parser", func(ctx context.Context) {
+		runs++
+		if runs < 3 {
+			panic("boom")
+		}
+	})
+	f(context.Background())
+
+	assert.Equal(t, 3, runs)
+	assert.NoError(t, sup.Err())
+	var buf bytes.Buffer
+	require.NoError(t, sup.HealthCommand(context.Background(), nil, &buf))
+	assert.Equal(t, "ok\nparser               stopped    0/1 running, 2 panics, last: boom\n", buf.String())
+}
+
+func TestSupervisorGivesUp(t *testing.T) {
+	t.Parallel()
+	sup := newTestSupervisor(2)
+	runs := 0
+	f := sup.Wrap("flusher", func(ctx context.Context) {
+		runs++
+		panic("boom")
+	})
+	f(context.Background())
+
+	assert.Equal(t, 3, runs)
+	select {
+	case <-sup.Failed():
+	default:
+		t.Fatal("expected the supervisor to have failed")
+	}
+	assert.EqualError(t, sup.Err(), "flusher failed after 2 restarts")
+	err := sup.HealthCommand(context.Background(), nil, &bytes.Buffer{})
+	assert.EqualError(t, err, "unhealthy, flusher failed after 2 restarts\nflusher              failed     0/1 running, 3 panics, last: boom")
+}
+
+func TestSupervisorForgivesStableComponent(t *testing.T) {
+	t.Parallel()
+	sup := newTestSupervisor(1)
+	now := time.Unix(100, 0)
+	sup.now = func() time.Time { return now }
+	runs := 0
+	f := sup.Wrap("receiver", func(ctx context.Context) {
+		runs++
+		if runs < 4 {
+			// Each run lasts long enough for the previous restart to be forgiven.
+			now = now.Add(supervisorStableTime)
+			panic("boom")
+		}
+	})
+	f(context.Background())
+
+	assert.Equal(t, 4, runs)
+	assert.NoError(t, sup.Err())
+}
+
+func TestSupervisorStopsRestartingWhenDone(t *testing.T) {
+	t.Parallel()
+	sup := NewSupervisor(5)
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	f := sup.Wrap("console", func(ctx context.Context) {
+		runs++
+		cancel()
+		panic("boom")
+	})
+	f(ctx)
+
+	assert.Equal(t, 1, runs)
+	assert.NoError(t, sup.Err())
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	t.Parallel()
+	sup := NewSupervisor(10)
+	assert.Equal(t, 1*time.Second, sup.backoff(0))
+	assert.Equal(t, 4*time.Second, sup.backoff(2))
+	assert.Equal(t, 30*time.Second, sup.backoff(5))
+	assert.Equal(t, 30*time.Second, sup.backoff(100))
+}
+
+func TestNilSupervisor(t *testing.T) {
+	t.Parallel()
+	var sup *Supervisor
+	ran := false
+	sup.WrapFunc(context.Background(), "aggregator", func() { ran = true })()
+	assert.True(t, ran)
+	assert.Nil(t, sup.Failed())
+	assert.NoError(t, sup.Err())
+	assert.Panics(t, func() {
+		sup.Wrap("aggregator", func(ctx context.Context) { panic("boom") })(context.Background())
+	})
+}
+
+func TestSupervisorGo(t *testing.T) {
+	t.Parallel()
+	sup := NewSupervisor(0)
+	done := make(chan struct{})
+	gostatsd.Go(gostatsd.WithGoRunner(context.Background(), sup), "console_connection", func() {
+		defer close(done)
+		panic("boom")
+	})
+	<-done
+
+	require.Eventually(t, func() bool {
+		var buf bytes.Buffer
+		require.NoError(t, sup.HealthCommand(context.Background(), nil, &buf))
+		return buf.String() == "ok\nconsole_connection   up         1 panics, last: boom\n"
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, sup.Err())
+}
+
+func TestRelistener(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	next := relistener(l)
+	assert.Equal(t, l, next())
+	require.NoError(t, l.Close())
+
+	l2 := next()
+	defer l2.Close()
+	assert.Equal(t, l.Addr().String(), l2.Addr().String())
+}
@@ -0,0 +1,118 @@
+package statsd
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+)
+
+const (
+	// TagLimitTruncate drops the excess tags of a metric, and shortens keys and values which are too long.
+	TagLimitTruncate = "truncate"
+	// TagLimitReject rejects a line with too many tags, or a tag which is too long.
+	TagLimitReject = "reject"
+)
+
+var errTagLimit = errors.New("tag limit exceeded")
+
+// TagLimits normalizes the tags of received metrics, and enforces a maximum number of tags per metric and maximum
+// key and value lengths.
+type TagLimits struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	tagsDropped   uint64
+	tagsTruncated uint64
+
+	maxTags        int  // Maximum number of tags per metric, 0 for no limit
+	maxKeyLength   int  // Maximum length of the key of a tag, the part before the first :, 0 for no limit
+	maxValueLength int  // Maximum length of the value of a tag, the part after the first :, 0 for no limit
+	reject         bool // Reject lines which exceed a limit instead of truncating them
+	normalize      bool // Lowercase the keys and sort the tags
+}
+
+// NewTagLimits creates a new TagLimits, where policy is one of the TagLimit* values.  If normalize is true the keys
+// of tags are lowercased and the tags sorted, before the limits are applied.
+func NewTagLimits(maxTags, maxKeyLength, maxValueLength int, policy string, normalize bool) *TagLimits {
+	return &TagLimits{
+		maxTags:        maxTags,
+		maxKeyLength:   maxKeyLength,
+		maxValueLength: maxValueLength,
+		reject:         policy == TagLimitReject,
+		normalize:      normalize,
+	}
+}
+
+// apply normalizes tags in place and applies the limits, returning the tags and false if the line should be
+// rejected.
+func (tl *TagLimits) apply(tags gostatsd.Tags) (gostatsd.Tags, bool) {
+	if tl.normalize {
+		for i, tag := range tags {
+			key := tag
+			if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+				key = tag[:idx]
+			}
+			if lower := strings.ToLower(key); lower != key {
+				tags[i] = lower + tag[len(key):]
+			}
+		}
+		sort.Strings(tags)
+	}
+
+	if tl.maxKeyLength > 0 || tl.maxValueLength > 0 {
+		truncated := uint64(0)
+		for i, tag := range tags {
+			key, value, sep := tag, "", ""
+			if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+				key, value, sep = tag[:idx], tag[idx+1:], ":"
+			}
+			keyTooLong := tl.maxKeyLength > 0 && len(key) > tl.maxKeyLength
+			valueTooLong := tl.maxValueLength > 0 && len(value) > tl.maxValueLength
+			if !keyTooLong && !valueTooLong {
+				continue
+			}
+			if tl.reject {
+				return tags, false
+			}
+			if keyTooLong {
+				key = truncateString(key, tl.maxKeyLength)
+			}
+			if valueTooLong {
+				value = truncateString(value, tl.maxValueLength)
+			}
+			tags[i] = key + sep + value
+			truncated++
+		}
+		if truncated > 0 {
+			atomic.AddUint64(&tl.tagsTruncated, truncated)
+		}
+	}
+
+	if tl.maxTags > 0 && len(tags) > tl.maxTags {
+		if tl.reject {
+			return tags, false
+		}
+		atomic.AddUint64(&tl.tagsDropped, uint64(len(tags)-tl.maxTags))
+		tags = tags[:tl.maxTags]
+	}
+	return tags, true
+}
+
+// emit sends the number of tags dropped and truncated since startup.
+func (tl *TagLimits) emit(statser statser.Statser) {
+	statser.Gauge("parser.tags_dropped", float64(atomic.LoadUint64(&tl.tagsDropped)), nil)
+	statser.Gauge("parser.tags_truncated", float64(atomic.LoadUint64(&tl.tagsTruncated)), nil)
+}
+
+// truncateString returns s shortened to at most n bytes, without splitting a UTF-8 encoded character.
+func truncateString(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
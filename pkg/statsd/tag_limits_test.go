@@ -0,0 +1,98 @@
+package statsd
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTagLimitsParser(tl *TagLimits) (*DatagramParser, *countingHandler) {
+	ch := &countingHandler{}
+	return NewDatagramParser(nil, ch, ch, statser.NewNullStatser(), ParserOptions{TagLimits: tl}), ch
+}
+
+func TestTagLimitsTruncate(t *testing.T) {
+	t.Parallel()
+	tl := NewTagLimits(3, 4, 6, TagLimitTruncate, false)
+
+	tags, ok := tl.apply(gostatsd.Tags{"a:1", "b:2"})
+	assert.True(t, ok)
+	assert.Equal(t, gostatsd.Tags{"a:1", "b:2"}, tags)
+
+	tags, ok = tl.apply(gostatsd.Tags{"region:us-east-1", "env:production", "x", "y", "z"})
+	assert.True(t, ok)
+	assert.Equal(t, gostatsd.Tags{"regi:us-eas", "env:produc", "x"}, tags)
+	assert.EqualValues(t, 2, atomic.LoadUint64(&tl.tagsDropped))
+	assert.EqualValues(t, 2, atomic.LoadUint64(&tl.tagsTruncated))
+
+	// Multi-byte characters are not split.
+	tags, ok = tl.apply(gostatsd.Tags{"city:Bogotá"})
+	assert.True(t, ok)
+	assert.Equal(t, gostatsd.Tags{"city:Bogot"}, tags)
+}
+
+func TestTagLimitsReject(t *testing.T) {
+	t.Parallel()
+	tl := NewTagLimits(2, 4, 6, TagLimitReject, false)
+	for _, tags := range []gostatsd.Tags{{"a", "b", "c"}, {"region:a"}, {"env:production"}} {
+		_, ok := tl.apply(tags)
+		assert.False(t, ok, "%v", tags)
+	}
+	tags, ok := tl.apply(gostatsd.Tags{"env:prod", "b"})
+	assert.True(t, ok)
+	assert.Equal(t, gostatsd.Tags{"env:prod", "b"}, tags)
+	assert.Zero(t, atomic.LoadUint64(&tl.tagsDropped))
+	assert.Zero(t, atomic.LoadUint64(&tl.tagsTruncated))
+}
+
+func TestTagLimitsNormalize(t *testing.T) {
+	t.Parallel()
+	tl := NewTagLimits(2, 0, 0, TagLimitTruncate, true)
+
+	// Keys are lowercased but values are not, and the tags are sorted before the excess ones are dropped, so the
+	// same tags are kept whatever order they were sent in.
+	tags, ok := tl.apply(gostatsd.Tags{"Zone:B", "ENV:Prod", "App:Web"})
+	assert.True(t, ok)
+	assert.Equal(t, gostatsd.Tags{"app:Web", "env:Prod"}, tags)
+	tags, ok = tl.apply(gostatsd.Tags{"env:Prod", "zone:B", "app:Web"})
+	assert.True(t, ok)
+	assert.Equal(t, gostatsd.Tags{"app:Web", "env:Prod"}, tags)
+}
+
+func TestParseDatagramTagLimits(t *testing.T) {
+	t.Parallel()
+	dp, ch := newTagLimitsParser(NewTagLimits(2, 0, 0, TagLimitReject, true))
+	metrics, _, badLines, err := dp.handleDatagram(context.Background(), fakeIP, "listener:a", 0, []byte("a:1|c|#B:2,a:1\nb:1|c|#a,b,c\nc:1|c|#a,b"), time.Time{}, nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, metrics)
+	assert.EqualValues(t, 1, badLines)
+	assert.EqualValues(t, 1, atomic.LoadUint64(&dp.lineErrors.counts[parseErrorBadTags]))
+	require.Len(t, ch.metrics, 2)
+	// The listener tag is not counted against the limit.
+	assert.Equal(t, gostatsd.Tags{"a:1", "b:2", "listener:a"}, ch.metrics[0].Tags)
+	assert.Equal(t, gostatsd.Tags{"a", "b", "listener:a"}, ch.metrics[1].Tags)
+}
+
+func TestTagOrderAggregatesTogether(t *testing.T) {
+	t.Parallel()
+	dp, ch := newTagLimitsParser(NewTagLimits(0, 0, 0, TagLimitTruncate, true))
+	_, _, _, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte("a:1|c|#a:1,b:2\na:2|c|#b:2,A:1"), time.Time{}, nil)
+	require.NoError(t, err)
+
+	ma := newFakeAggregator()
+	now := time.Now()
+	for i := range ch.metrics {
+		m := &ch.metrics[i]
+		m.TagsKey = formatTagsKey(m.Tags, m.Hostname)
+		ma.Receive(m, now)
+	}
+	require.Len(t, ma.Counters["a"], 1)
+	assert.EqualValues(t, 3, ma.Counters["a"]["a:1,b:2"].Value)
+}
@@ -0,0 +1,80 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PercentThresholds holds the list of percentiles computed for timers, which can be changed while running.
+// Aggregators check for a change at the start of each flush, so a flush never mixes old and new thresholds.
+type PercentThresholds struct {
+	mu         sync.RWMutex
+	thresholds []float64
+	version    uint64 // Incremented on every change
+}
+
+// NewPercentThresholds creates a PercentThresholds holding the given percentiles.
+func NewPercentThresholds(thresholds []float64) *PercentThresholds {
+	return &PercentThresholds{
+		thresholds: thresholds,
+	}
+}
+
+// ParsePercentThresholds parses a list of percentiles, as provided to the set-thresholds command.  A negative
+// percentile computes the lower bound of the values rather than the upper bound.
+func ParsePercentThresholds(s []string) ([]float64, error) {
+	return parseFloatList("percentile", s, ValidatePercentThreshold)
+}
+
+// ParseTimerUnderThresholds parses a list of thresholds to count timer values at or under.
+func ParseTimerUnderThresholds(s []string) ([]float64, error) {
+	return parseFloatList("timer threshold", s, ValidateTimerUnderThreshold)
+}
+
+// Get returns the current percentiles, and a version which changes whenever they do.
+func (pt *PercentThresholds) Get() ([]float64, uint64) {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+	return pt.thresholds, pt.version
+}
+
+// Set replaces the percentiles, taking effect from the next flush.
+func (pt *PercentThresholds) Set(thresholds []float64) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.thresholds = thresholds
+	pt.version++
+}
+
+// SetCommand is the console command to replace the percentiles, taking a comma or space separated list.
+func (pt *PercentThresholds) SetCommand(ctx context.Context, args []string, w io.Writer) error {
+	fields := strings.FieldsFunc(strings.Join(args, ","), func(r rune) bool {
+		return r == ','
+	})
+	if len(fields) == 0 {
+		return errors.New("usage: set-thresholds <percentile>[,<percentile>...]")
+	}
+	thresholds, err := ParsePercentThresholds(fields)
+	if err != nil {
+		return err
+	}
+	pt.Set(thresholds)
+	_, err = io.WriteString(w, "thresholds set, effective from the next flush\n")
+	return err
+}
+
+// GetCommand is the console command to show the percentiles.
+func (pt *PercentThresholds) GetCommand(ctx context.Context, args []string, w io.Writer) error {
+	thresholds, _ := pt.Get()
+	s := make([]string, len(thresholds))
+	for i, t := range thresholds {
+		s[i] = strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	_, err := fmt.Fprintf(w, "%s\n", strings.Join(s, ","))
+	return err
+}
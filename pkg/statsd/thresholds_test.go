@@ -0,0 +1,98 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/aggregation"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePercentThresholds(t *testing.T) {
+	t.Parallel()
+	pt, err := ParsePercentThresholds([]string{"50", "99.9", "-10"})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{50, 99.9, -10}, pt)
+
+	for _, bad := range []string{"x", "101", "-101", "NaN"} {
+		_, err := ParsePercentThresholds([]string{"90", bad})
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParseTimerUnderThresholds(t *testing.T) {
+	t.Parallel()
+	ut, err := ParseTimerUnderThresholds([]string{"200", "0.5"})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{200, 0.5}, ut)
+
+	for _, bad := range []string{"x", "NaN", "+Inf"} {
+		_, err := ParseTimerUnderThresholds([]string{"200", bad})
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestPercentThresholdsCommands(t *testing.T) {
+	t.Parallel()
+	pt := NewPercentThresholds([]float64{90})
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	require.NoError(t, pt.GetCommand(ctx, nil, &buf))
+	assert.Equal(t, "90\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, pt.SetCommand(ctx, []string{"50,90", "99.5"}, &buf))
+	thresholds, version := pt.Get()
+	assert.Equal(t, []float64{50, 90, 99.5}, thresholds)
+	assert.EqualValues(t, 1, version)
+
+	buf.Reset()
+	require.NoError(t, pt.GetCommand(ctx, nil, &buf))
+	assert.Equal(t, "50,90,99.5\n", buf.String())
+
+	assert.Error(t, pt.SetCommand(ctx, nil, &buf))
+	assert.Error(t, pt.SetCommand(ctx, []string{","}, &buf))
+	assert.Error(t, pt.SetCommand(ctx, []string{"50,200"}, &buf))
+	thresholds, version = pt.Get()
+	assert.Equal(t, []float64{50, 90, 99.5}, thresholds)
+	assert.EqualValues(t, 1, version)
+}
+
+func TestPercentThresholdsChangeAtFlush(t *testing.T) {
+	t.Parallel()
+	pt := NewPercentThresholds([]float64{90})
+	ma := NewMetricAggregator(aggregation.Options{PercentThresholds: []float64{90}, ExpiryInterval: 5 * time.Minute}, nil, pt, nil)
+
+	percentiles := func() map[string]float64 {
+		result := map[string]float64{}
+		for _, p := range ma.Timers["x"][""].Percentiles {
+			result[p.Str] = p.Float
+		}
+		return result
+	}
+	receive := func() {
+		for i := 1; i <= 10; i++ {
+			ma.Receive(&gostatsd.Metric{Name: "x", Value: float64(i), Rate: 1, Type: gostatsd.TIMER}, time.Now())
+		}
+	}
+
+	receive()
+	ma.Flush(time.Second)
+	assert.Contains(t, percentiles(), "upper_90")
+	ma.Reset()
+
+	// A change between flushes applies to the whole of the next flush.
+	receive()
+	pt.Set([]float64{50, -20})
+	ma.Flush(time.Second)
+	p := percentiles()
+	assert.NotContains(t, p, "upper_90")
+	assert.Equal(t, 5.0, p["upper_50"])
+	assert.Equal(t, 9.0, p["lower_-20"])
+}
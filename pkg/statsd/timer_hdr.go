@@ -0,0 +1,27 @@
+package statsd
+
+import (
+	"github.com/atlassian/gostatsd"
+)
+
+// HDRLowestValue is the lowest value the HDR histograms of timers record, so a timer in milliseconds is recorded to
+// the microsecond.  Lower values are counted as this value.
+const HDRLowestValue = 0.001
+
+// TimerHDR selects timers with a name matching a pattern to have their values recorded in an HDR histogram rather
+// than kept as samples.  A nil *TimerHDR selects nothing.
+type TimerHDR struct {
+	match gostatsd.StringMatchList
+}
+
+// NewTimerHDR creates a TimerHDR which selects timers with a name matching any of match.
+func NewTimerHDR(match []string) *TimerHDR {
+	return &TimerHDR{
+		match: toStringMatch(match),
+	}
+}
+
+// Matches returns true if the timer name is recorded in an HDR histogram.
+func (th *TimerHDR) Matches(name string) bool {
+	return th != nil && th.match.MatchAny(name)
+}
@@ -0,0 +1,18 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimerHDRMatches(t *testing.T) {
+	t.Parallel()
+	th := NewTimerHDR([]string{"api.latency.*", "db.query"})
+	assert.True(t, th.Matches("api.latency.get"))
+	assert.True(t, th.Matches("db.query"))
+	assert.False(t, th.Matches("db.query.rows"))
+
+	var none *TimerHDR
+	assert.False(t, none.Matches("db.query"))
+}
@@ -0,0 +1,38 @@
+package statsd
+
+import (
+	"github.com/atlassian/gostatsd"
+)
+
+// TimerRateSuffix is appended to the name of a timer to name the gauge holding its per second rate.
+const TimerRateSuffix = ".rate"
+
+// timerRates returns a MetricMap with a gauge for each timer in m, named after the timer with TimerRateSuffix,
+// holding the number of timings per second in the interval, or nil if m has no timers.  It is the same value most
+// backends send as count_ps, under a name of its own.
+func timerRates(m *gostatsd.MetricMap) *gostatsd.MetricMap {
+	if len(m.Timers) == 0 {
+		return nil
+	}
+	rates := &gostatsd.MetricMap{
+		Counters: gostatsd.Counters{},
+		Timers:   gostatsd.Timers{},
+		Gauges:   gostatsd.Gauges{},
+		Sets:     gostatsd.Sets{},
+	}
+	m.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		name := key + TimerRateSuffix
+		gauges, ok := rates.Gauges[name]
+		if !ok {
+			gauges = map[string]gostatsd.Gauge{}
+			rates.Gauges[name] = gauges
+		}
+		gauges[tagsKey] = gostatsd.Gauge{
+			Value:     timer.PerSecond,
+			Timestamp: timer.Timestamp,
+			Hostname:  timer.Hostname,
+			Tags:      timer.Tags,
+		}
+	})
+	return rates
+}
@@ -0,0 +1,156 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/console"
+)
+
+// topDefaultN is the number of prefixes and names the top command lists if no number is given.
+const topDefaultN = 10
+
+// topCount is a prefix or name ranked by the top command.
+type topCount struct {
+	key   string
+	count int
+}
+
+// topStats are the number of series of each prefix, and the distinct names, of the metrics in one or more snapshots.
+type topStats struct {
+	series map[string]int      // Number of series, a name and tag set of any type, by prefix
+	names  map[string]struct{} // Every name
+}
+
+func newTopStats() *topStats {
+	return &topStats{
+		series: map[string]int{},
+		names:  map[string]struct{}{},
+	}
+}
+
+// add counts the series and names of the metrics in m.
+func (ts *topStats) add(m *gostatsd.MetricMap) {
+	addName := func(name string, tagged int) {
+		ts.series[metricPrefix(name)] += tagged
+		ts.names[name] = struct{}{}
+	}
+	for name, tagged := range m.Counters {
+		addName(name, len(tagged))
+	}
+	for name, tagged := range m.Timers {
+		addName(name, len(tagged))
+	}
+	for name, tagged := range m.Gauges {
+		addName(name, len(tagged))
+	}
+	for name, tagged := range m.Sets {
+		addName(name, len(tagged))
+	}
+}
+
+// merge adds the counts of other to ts.
+func (ts *topStats) merge(other *topStats) {
+	for prefix, n := range other.series {
+		ts.series[prefix] += n
+	}
+	for name := range other.names {
+		ts.names[name] = struct{}{}
+	}
+}
+
+// topPrefixes returns the n prefixes with the most series, most first, in order of prefix if tied.
+func (ts *topStats) topPrefixes(n int) []topCount {
+	counts := make([]topCount, 0, len(ts.series))
+	for prefix, count := range ts.series {
+		counts = append(counts, topCount{key: prefix, count: count})
+	}
+	return topN(counts, n)
+}
+
+// longestNames returns the n longest names, longest first, in order of name if tied.
+func (ts *topStats) longestNames(n int) []topCount {
+	counts := make([]topCount, 0, len(ts.names))
+	for name := range ts.names {
+		counts = append(counts, topCount{key: name, count: len(name)})
+	}
+	return topN(counts, n)
+}
+
+func topN(counts []topCount, n int) []topCount {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].count != counts[j].count {
+			return counts[i].count > counts[j].count
+		}
+		return counts[i].key < counts[j].key
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// metricPrefix returns the part of name before the first dot, or all of name if it has none.
+func metricPrefix(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// TopCommand returns the console command which lists the prefixes with the most series, and the longest names, of
+// the metrics received so far this interval.  A prefix is the part of a name before the first dot.
+func TopCommand(processer AggregateProcesser) console.Handler {
+	return func(ctx context.Context, args []string, w io.Writer) error {
+		n := topDefaultN
+		switch len(args) {
+		case 0:
+		case 1:
+			var err error
+			n, err = strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid number %q, usage: top [<n>]", args[0])
+			}
+		default:
+			return errors.New("usage: top [<n>]")
+		}
+
+		var mu sync.Mutex
+		stats := newTopStats()
+		wait := processer.Process(ctx, func(aggrID int, aggr Aggregator) {
+			aggr.Process(func(m *gostatsd.MetricMap) {
+				// Each aggregator's metrics are counted separately, so they are locked out for as short a time as
+				// possible.
+				s := newTopStats()
+				s.add(m)
+				mu.Lock()
+				stats.merge(s)
+				mu.Unlock()
+			})
+		})
+		wait()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		bw := bufio.NewWriter(w)
+		_, _ = fmt.Fprintf(bw, "Top %d prefixes by series:\n", n)
+		for _, c := range stats.topPrefixes(n) {
+			_, _ = fmt.Fprintf(bw, "%8d %s\n", c.count, c.key)
+		}
+		_, _ = fmt.Fprintf(bw, "Longest %d names:\n", n)
+		for _, c := range stats.longestNames(n) {
+			_, _ = fmt.Fprintf(bw, "%8d %s\n", c.count, c.key)
+		}
+		// Errors writing to the buffer are returned by Flush.
+		return bw.Flush()
+	}
+}
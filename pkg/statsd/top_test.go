@@ -0,0 +1,76 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopCommand(t *testing.T) {
+	t.Parallel()
+	agg := newFakeAggregator()
+	now := time.Now()
+	receive := func(m gostatsd.Metric) {
+		m.Rate = 1
+		m.TagsKey = formatTagsKey(m.Tags, m.Hostname)
+		agg.Receive(&m, now)
+	}
+	for i := 0; i < 3; i++ {
+		receive(gostatsd.Metric{Name: "api.requests", Value: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{fmt.Sprintf("host:%d", i)}})
+	}
+	receive(gostatsd.Metric{Name: "api.latency", Value: 5, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"env:prod"}})
+	receive(gostatsd.Metric{Name: "api.latency", Value: 5, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"env:dev"}})
+	receive(gostatsd.Metric{Name: "db.queries", Value: 2, Type: gostatsd.GAUGE})
+	receive(gostatsd.Metric{Name: "x", StringValue: "joe", Type: gostatsd.SET})
+	receive(gostatsd.Metric{Name: "a.very.long.metric.name", Value: 1, Type: gostatsd.COUNTER})
+	sa := &singleAggregator{agg: agg}
+	top := TopCommand(sa)
+
+	var out bytes.Buffer
+	require.NoError(t, top(context.Background(), []string{"2"}, &out))
+	assert.Equal(t, `Top 2 prefixes by series:
+       5 api
+       1 a
+Longest 2 names:
+      23 a.very.long.metric.name
+      12 api.requests
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, top(context.Background(), nil, &out))
+	assert.Equal(t, `Top 10 prefixes by series:
+       5 api
+       1 a
+       1 db
+       1 x
+Longest 10 names:
+      23 a.very.long.metric.name
+      12 api.requests
+      11 api.latency
+      10 db.queries
+       1 x
+`, out.String())
+
+	for _, args := range [][]string{{"0"}, {"x"}, {"1", "2"}} {
+		assert.Error(t, top(context.Background(), args, &out), "%v", args)
+	}
+}
+
+func TestTopStatsMerge(t *testing.T) {
+	t.Parallel()
+	a := newTopStats()
+	a.add(&gostatsd.MetricMap{Counters: gostatsd.Counters{"web.hits": {"": {}, "a:b": {}}}})
+	b := newTopStats()
+	b.add(&gostatsd.MetricMap{Counters: gostatsd.Counters{"web.hits": {"c:d": {}}, "web.misses": {"": {}}}})
+	a.merge(b)
+	// The same name from two aggregators is counted once, and each series is counted.
+	assert.Equal(t, []topCount{{key: "web", count: 4}}, a.topPrefixes(5))
+	assert.Equal(t, []topCount{{key: "web.misses", count: 10}, {key: "web.hits", count: 8}}, a.longestNames(5))
+}
@@ -0,0 +1,183 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MetricTracer logs each stage of processing for metrics whose name matches a glob, for a limited time.  The
+// parser logs the raw line, the parsed metric and its source, and the aggregator logs the aggregated value
+// after the metric has been applied.  A nil *MetricTracer traces nothing.
+type MetricTracer struct {
+	active int32 // Non-zero if a trace is active, must be read/written only using atomic instructions.
+
+	logger log.FieldLogger
+
+	mu    sync.RWMutex
+	glob  string
+	until time.Time
+	timer *time.Timer
+}
+
+// NewMetricTracer creates a MetricTracer with no active trace, which logs traced metrics to logger.
+func NewMetricTracer(logger log.FieldLogger) *MetricTracer {
+	return &MetricTracer{
+		logger: logger,
+	}
+}
+
+// Start starts tracing metrics whose name matches glob for the duration d, replacing any active trace.
+func (mt *MetricTracer) Start(glob string, d time.Duration) error {
+	if _, err := path.Match(glob, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %v", glob, err)
+	}
+	if d <= 0 {
+		return fmt.Errorf("invalid duration %v", d)
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if mt.timer != nil {
+		mt.timer.Stop()
+	}
+	until := time.Now().Add(d)
+	mt.glob = glob
+	mt.until = until
+	mt.timer = time.AfterFunc(d, func() {
+		mt.expire(until)
+	})
+	atomic.StoreInt32(&mt.active, 1)
+	mt.logger.Infof("Started tracing metrics matching %q for %v", glob, d)
+	return nil
+}
+
+// expire stops the trace which was started to run until the given time, if it has not been replaced.
+func (mt *MetricTracer) expire(until time.Time) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if mt.until.Equal(until) {
+		mt.stop("duration elapsed")
+	}
+}
+
+// Stop stops the active trace, if any.
+func (mt *MetricTracer) Stop(reason string) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.stop(reason)
+}
+
+func (mt *MetricTracer) stop(reason string) {
+	if mt.timer == nil {
+		return
+	}
+	atomic.StoreInt32(&mt.active, 0)
+	mt.timer.Stop()
+	mt.timer = nil
+	mt.logger.Infof("Stopped tracing metrics matching %q: %s", mt.glob, reason)
+}
+
+// Active returns true if a trace is in progress.  This is the only cost on the hot path when no trace is active.
+func (mt *MetricTracer) Active() bool {
+	return mt != nil && atomic.LoadInt32(&mt.active) != 0
+}
+
+// Matches returns true if a trace is active and name matches its glob.
+func (mt *MetricTracer) Matches(name string) bool {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	if mt.timer == nil {
+		return false
+	}
+	ok, _ := path.Match(mt.glob, name)
+	return ok
+}
+
+// TraceParsed logs a metric after it has been parsed from line.
+func (mt *MetricTracer) TraceParsed(line string, m *gostatsd.Metric, ip gostatsd.IP) {
+	mt.logger.WithFields(log.Fields{
+		"stage":  "parsed",
+		"line":   line,
+		"name":   m.Name,
+		"type":   m.Type.String(),
+		"value":  metricValue(m),
+		"rate":   m.Rate,
+		"tags":   m.Tags,
+		"source": ip,
+	}).Info("Traced metric")
+}
+
+// TraceAggregated logs the aggregated value of a metric after m has been applied to it.
+func (mt *MetricTracer) TraceAggregated(m *gostatsd.Metric, aggregated interface{}) {
+	mt.logger.WithFields(log.Fields{
+		"stage":      "aggregated",
+		"name":       m.Name,
+		"type":       m.Type.String(),
+		"tags":       m.TagsKey,
+		"value":      metricValue(m),
+		"aggregated": aggregated,
+	}).Info("Traced metric")
+}
+
+// metricValue returns the value of a metric as it was received.
+func metricValue(m *gostatsd.Metric) interface{} {
+	switch {
+	case m.Type == gostatsd.SET:
+		return m.StringValue
+	case len(m.Values) > 0:
+		return append([]float64{m.Value}, m.Values...)
+	default:
+		return m.Value
+	}
+}
+
+// Status writes a description of the active trace to w.
+func (mt *MetricTracer) Status(w io.Writer) error {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	if mt.timer == nil {
+		_, err := io.WriteString(w, "no active trace\n")
+		return err
+	}
+	_, err := fmt.Fprintf(w, "glob: %s\nremaining: %v\n", mt.glob, time.Until(mt.until).Truncate(time.Second))
+	return err
+}
+
+// TraceCommand is the console command to start a trace, taking the arguments <glob> <seconds>.
+func (mt *MetricTracer) TraceCommand(ctx context.Context, args []string, w io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("usage: trace <glob> <seconds>")
+	}
+	seconds, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return fmt.Errorf("invalid seconds %q: %v", args[1], err)
+	}
+	if err := mt.Start(args[0], time.Duration(seconds*float64(time.Second))); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "trace started\n")
+	return err
+}
+
+// StatusCommand is the console command to show the active trace.
+func (mt *MetricTracer) StatusCommand(ctx context.Context, args []string, w io.Writer) error {
+	return mt.Status(w)
+}
+
+// StopCommand is the console command to stop the active trace.
+func (mt *MetricTracer) StopCommand(ctx context.Context, args []string, w io.Writer) error {
+	mt.Stop("stopped from console")
+	_, err := io.WriteString(w, "trace stopped\n")
+	return err
+}
@@ -0,0 +1,129 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tracedEntries returns the fields of each traced metric logged to hook.
+func tracedEntries(hook *test.Hook) []logrus.Fields {
+	var traced []logrus.Fields
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Traced metric" {
+			traced = append(traced, entry.Data)
+		}
+	}
+	return traced
+}
+
+func TestMetricTracerParsedAndAggregated(t *testing.T) {
+	t.Parallel()
+	logger, hook := test.NewNullLogger()
+	mt := NewMetricTracer(logger)
+	require.NoError(t, mt.Start("web.*", time.Minute))
+
+	dp, ch := newTestParser(false)
+	dp.tracer = mt
+	_, _, _, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte("web.requests:3|c|@0.5|#env:prod\ndb.queries:1|c\nweb.requests:4|c|@0.5|#env:prod"), time.Time{}, nil)
+	require.NoError(t, err)
+
+	traced := tracedEntries(hook)
+	require.Len(t, traced, 2)
+	assert.Equal(t, logrus.Fields{
+		"stage":  "parsed",
+		"line":   "web.requests:3|c|@0.5|#env:prod",
+		"name":   "web.requests",
+		"type":   "counter",
+		"value":  3.0,
+		"rate":   0.5,
+		"tags":   gostatsd.Tags{"env:prod"},
+		"source": fakeIP,
+	}, traced[0])
+	assert.Equal(t, "web.requests:4|c|@0.5|#env:prod", traced[1]["line"])
+
+	hook.Reset()
+	ma := newFakeAggregator()
+	ma.tracer = mt
+	now := time.Now()
+	for _, m := range ch.metrics {
+		m := m
+		m.TagsKey = formatTagsKey(m.Tags, m.Hostname)
+		ma.Receive(&m, now)
+	}
+	traced = tracedEntries(hook)
+	require.Len(t, traced, 2)
+	assert.Equal(t, "aggregated", traced[0]["stage"])
+	assert.EqualValues(t, 6, traced[0]["aggregated"])
+	assert.EqualValues(t, 14, traced[1]["aggregated"])
+}
+
+func TestMetricTracerInactive(t *testing.T) {
+	t.Parallel()
+	logger, hook := test.NewNullLogger()
+	mt := NewMetricTracer(logger)
+	assert.False(t, mt.Active())
+	var none *MetricTracer
+	assert.False(t, none.Active())
+
+	dp, _ := newTestParser(false)
+	dp.tracer = mt
+	_, _, _, err := dp.handleDatagram(context.Background(), fakeIP, "", 0, []byte("web.requests:3|c"), time.Time{}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, tracedEntries(hook))
+
+	assert.Error(t, mt.Start("[", time.Minute))
+	assert.Error(t, mt.Start("*", 0))
+}
+
+func TestMetricTracerExpires(t *testing.T) {
+	t.Parallel()
+	logger, _ := test.NewNullLogger()
+	mt := NewMetricTracer(logger)
+	require.NoError(t, mt.Start("*", 10*time.Millisecond))
+	assert.True(t, mt.Active())
+	assert.True(t, mt.Matches("anything"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for mt.Active() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(t, mt.Active())
+	assert.False(t, mt.Matches("anything"))
+}
+
+func TestMetricTracerCommands(t *testing.T) {
+	t.Parallel()
+	logger, _ := test.NewNullLogger()
+	mt := NewMetricTracer(logger)
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	require.NoError(t, mt.StatusCommand(ctx, nil, &buf))
+	assert.Equal(t, "no active trace\n", buf.String())
+
+	buf.Reset()
+	assert.Error(t, mt.TraceCommand(ctx, []string{"web.*"}, &buf))
+	assert.Error(t, mt.TraceCommand(ctx, []string{"web.*", "x"}, &buf))
+	require.NoError(t, mt.TraceCommand(ctx, []string{"web.*", "60"}, &buf))
+	assert.Equal(t, "trace started\n", buf.String())
+	assert.True(t, mt.Matches("web.requests"))
+	assert.False(t, mt.Matches("db.queries"))
+
+	buf.Reset()
+	require.NoError(t, mt.StatusCommand(ctx, nil, &buf))
+	assert.Contains(t, buf.String(), "glob: web.*\n")
+
+	buf.Reset()
+	require.NoError(t, mt.StopCommand(ctx, nil, &buf))
+	assert.Equal(t, "trace stopped\n", buf.String())
+	assert.False(t, mt.Active())
+}
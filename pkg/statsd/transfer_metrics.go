@@ -0,0 +1,59 @@
+package statsd
+
+import (
+	"context"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	stats "github.com/atlassian/gostatsd/pkg/statser"
+)
+
+// transferMetrics emits the data sent by each backend which measures it since the internal metrics were last
+// flushed, such as the bytes written to the network.
+type transferMetrics struct {
+	backends []gostatsd.Backend
+	last     []gostatsd.TransferStats // The totals of each backend when last emitted, only accessed from RunMetrics
+}
+
+// newTransferMetrics creates a transferMetrics for backends, which may include nil entries.
+func newTransferMetrics(backends []gostatsd.Backend) *transferMetrics {
+	return &transferMetrics{
+		backends: backends,
+		last:     make([]gostatsd.TransferStats, len(backends)),
+	}
+}
+
+// RunMetrics emits the data sent by each backend at each flush of the internal metrics.  Stops when the context is
+// closed.
+func (tm *transferMetrics) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			tm.emit(statser)
+		}
+	}
+}
+
+func (tm *transferMetrics) emit(statser stats.Statser) {
+	for i, b := range tm.backends {
+		if b == nil {
+			continue
+		}
+		ts, ok := gostatsd.BackendTransferStats(b)
+		if !ok {
+			continue
+		}
+		delta := ts.Sub(tm.last[i])
+		tm.last[i] = ts
+		tags := gostatsd.Tags{"backend:" + b.Name()}
+		statser.Gauge("backend.bytes_serialized", float64(delta.BytesSerialized), tags)
+		statser.Gauge("backend.bytes_sent", float64(delta.BytesSent), tags)
+		statser.Gauge("backend.serialize_time", float64(delta.SerializeTime)/float64(time.Millisecond), tags)
+		statser.Gauge("backend.write_time", float64(delta.WriteTime)/float64(time.Millisecond), tags)
+	}
+}
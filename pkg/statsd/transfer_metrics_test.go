@@ -0,0 +1,44 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// transferBackend is a backend which measures the data it sends.
+type transferBackend struct {
+	timerBackend
+	transfer gostatsd.TransferCounter
+}
+
+func (tb *transferBackend) TransferStats() (gostatsd.TransferStats, bool) {
+	return tb.transfer.Stats(), true
+}
+
+func TestTransferMetricsEmitsSinceLastFlush(t *testing.T) {
+	t.Parallel()
+	tb := &transferBackend{}
+	tm := newTransferMetrics([]gostatsd.Backend{&timerBackend{}, nil, tb})
+	st := &taggedGaugeStatser{Statser: statser.NewNullStatser(), gauges: map[string]float64{}}
+
+	tb.transfer.Serialized(100, 2*time.Millisecond)
+	tb.transfer.Sent(40, 5*time.Millisecond)
+	tm.emit(st)
+	assert.Equal(t, map[string]float64{
+		"backend.bytes_serialized|backend:timer": 100,
+		"backend.bytes_sent|backend:timer":       40,
+		"backend.serialize_time|backend:timer":   2,
+		"backend.write_time|backend:timer":       5,
+	}, st.gauges)
+
+	tb.transfer.Sent(10, time.Millisecond)
+	tm.emit(st)
+	assert.Equal(t, 0.0, st.gauges["backend.bytes_serialized|backend:timer"])
+	assert.Equal(t, 10.0, st.gauges["backend.bytes_sent|backend:timer"])
+	assert.Equal(t, 1.0, st.gauges["backend.write_time|backend:timer"])
+}
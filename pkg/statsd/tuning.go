@@ -0,0 +1,280 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// tuningSampleInterval is how often the utilization of each stage is sampled for the tuning report.
+	tuningSampleInterval = 100 * time.Millisecond
+	// tuningSamples is the number of samples the tuning report covers, one minute.
+	tuningSamples = 600
+)
+
+// Tuning is the number of workers and the size of the queues of each stage of the pipeline.
+type Tuning struct {
+	MaxReaders       int
+	MaxParsers       int
+	MaxWorkers       int
+	MaxQueueSize     int
+	ReceiveBatchSize int
+	ReceiveQueueSize int
+
+	// Set when the values were chosen by AutoTune.
+	AutoTuned        bool
+	CPUs             int
+	PacketsPerSecond int
+}
+
+// AutoTune returns the tuning for cpus processors receiving packetsPerSecond packets, or 0 if the rate is unknown.
+// Without a rate every stage gets a worker per processor, as by default.  With a rate, each reader is expected to
+// handle 100000 packets per second, and each parser and aggregator 50000, up to one per processor (and at most 8
+// readers).  The queue of each aggregator holds about a second of metrics, and receive batches grow with the rate.
+func AutoTune(cpus, packetsPerSecond int) Tuning {
+	if cpus < 1 {
+		cpus = 1
+	}
+	t := Tuning{
+		MaxReaders:       minInt(8, cpus),
+		MaxParsers:       cpus,
+		MaxWorkers:       cpus,
+		MaxQueueSize:     DefaultMaxQueueSize,
+		ReceiveBatchSize: DefaultReceiveBatchSize,
+		ReceiveQueueSize: DefaultReceiveQueueSize,
+		AutoTuned:        true,
+		CPUs:             cpus,
+		PacketsPerSecond: packetsPerSecond,
+	}
+	if packetsPerSecond <= 0 {
+		return t
+	}
+	t.MaxReaders = clampInt(divideRoundUp(packetsPerSecond, 100000), 1, minInt(8, cpus))
+	t.MaxParsers = clampInt(divideRoundUp(packetsPerSecond, 50000), 1, cpus)
+	t.MaxWorkers = clampInt(divideRoundUp(packetsPerSecond, 50000), 1, cpus)
+	t.MaxQueueSize = clampInt(packetsPerSecond/t.MaxWorkers, 1000, 100000)
+	t.ReceiveBatchSize = clampInt(packetsPerSecond/2000, DefaultReceiveBatchSize, 200)
+	// Enough batches for a second of packets when the drop-oldest receive queue policy is used.
+	t.ReceiveQueueSize = clampInt(packetsPerSecond/t.ReceiveBatchSize, DefaultReceiveQueueSize, 10000)
+	return t
+}
+
+// tuning returns the tuning of the server.
+func (s *Server) tuning() Tuning {
+	return Tuning{
+		MaxReaders:       s.MaxReaders,
+		MaxParsers:       s.MaxParsers,
+		MaxWorkers:       s.MaxWorkers,
+		MaxQueueSize:     s.MaxQueueSize,
+		ReceiveBatchSize: s.ReceiveBatchSize,
+		ReceiveQueueSize: s.ReceiveQueueSize,
+	}
+}
+
+// applyTuning sets the tuning of the server.
+func (s *Server) applyTuning(t Tuning) {
+	s.MaxReaders = t.MaxReaders
+	s.MaxParsers = t.MaxParsers
+	s.MaxWorkers = t.MaxWorkers
+	s.MaxQueueSize = t.MaxQueueSize
+	s.ReceiveBatchSize = t.ReceiveBatchSize
+	s.ReceiveQueueSize = t.ReceiveQueueSize
+}
+
+// write writes the values of the tuning to w, one per line.
+func (t Tuning) write(w io.Writer) {
+	if t.AutoTuned {
+		rate := "an unknown rate"
+		if t.PacketsPerSecond > 0 {
+			rate = fmt.Sprintf("%d packets per second", t.PacketsPerSecond)
+		}
+		_, _ = fmt.Fprintf(w, "Auto-tuned for %d CPUs and %s\n", t.CPUs, rate)
+	}
+	for _, v := range []struct {
+		name  string
+		value int
+	}{
+		{ParamMaxReaders, t.MaxReaders},
+		{ParamMaxParsers, t.MaxParsers},
+		{ParamMaxWorkers, t.MaxWorkers},
+		{ParamMaxQueueSize, t.MaxQueueSize},
+		{ParamReceiveBatchSize, t.ReceiveBatchSize},
+		{ParamReceiveQueueSize, t.ReceiveQueueSize},
+	} {
+		_, _ = fmt.Fprintf(w, "%-20s %d\n", v.name, v.value)
+	}
+}
+
+// String returns the values of the tuning on a single line, for logging.
+func (t Tuning) String() string {
+	return fmt.Sprintf("%s=%d %s=%d %s=%d %s=%d %s=%d %s=%d",
+		ParamMaxReaders, t.MaxReaders, ParamMaxParsers, t.MaxParsers, ParamMaxWorkers, t.MaxWorkers,
+		ParamMaxQueueSize, t.MaxQueueSize, ParamReceiveBatchSize, t.ReceiveBatchSize, ParamReceiveQueueSize, t.ReceiveQueueSize)
+}
+
+// busyTracker accumulates the time the workers of a stage spend working, rather than waiting for work.  A nil
+// *busyTracker tracks nothing.
+type busyTracker struct {
+	busy int64 // Nanoseconds, must be read/written only using atomic instructions.
+
+	name    string
+	workers int
+
+	// Rings of the time of each sample and the busy total then, only used by the sampler.
+	times  []time.Time
+	totals []int64
+}
+
+// add records d spent working.
+func (bt *busyTracker) add(d time.Duration) {
+	if bt != nil {
+		atomic.AddInt64(&bt.busy, int64(d))
+	}
+}
+
+// queueGroup is a group of queues of the same capacity, such as the queues of the aggregators.
+type queueGroup struct {
+	name     string
+	capacity int
+	lens     []func() int
+	samples  []float64 // Ring of the occupancy of each queue sampled, as a fraction of the capacity
+	next     int
+}
+
+// tuningSampler samples the occupancy of the queues and the busy fraction of the workers of each stage, over the
+// last tuningSamples samples.
+type tuningSampler struct {
+	mu      sync.Mutex
+	queues  []*queueGroup
+	workers []*busyTracker
+	next    int // Index of the next sample in the rings of the busy trackers
+	sampled int // Number of samples taken, up to tuningSamples
+}
+
+// addQueues adds a group of queues to sample.
+func (ts *tuningSampler) addQueues(name string, capacity int, lens ...func() int) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.queues = append(ts.queues, &queueGroup{
+		name:     name,
+		capacity: capacity,
+		lens:     lens,
+		samples:  make([]float64, 0, tuningSamples*len(lens)),
+	})
+}
+
+// addWorkers returns a busyTracker for the workers of a stage, which is sampled.
+func (ts *tuningSampler) addWorkers(name string, workers int) *busyTracker {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	bt := &busyTracker{
+		name:    name,
+		workers: workers,
+		times:   make([]time.Time, tuningSamples),
+		totals:  make([]int64, tuningSamples),
+	}
+	ts.workers = append(ts.workers, bt)
+	return bt
+}
+
+// Run samples every tuningSampleInterval until ctx is done.
+func (ts *tuningSampler) Run(ctx context.Context) {
+	ticker := time.NewTicker(tuningSampleInterval)
+	defer ticker.Stop()
+	ts.sample(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			ts.sample(now)
+		}
+	}
+}
+
+// sample records the occupancy of each queue, and the busy total of each stage at now.
+func (ts *tuningSampler) sample(now time.Time) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, q := range ts.queues {
+		for _, l := range q.lens {
+			occupancy := float64(l()) / float64(q.capacity)
+			if len(q.samples) < cap(q.samples) {
+				q.samples = append(q.samples, occupancy)
+			} else {
+				q.samples[q.next] = occupancy
+				q.next = (q.next + 1) % len(q.samples)
+			}
+		}
+	}
+	for _, bt := range ts.workers {
+		bt.times[ts.next] = now
+		bt.totals[ts.next] = atomic.LoadInt64(&bt.busy)
+	}
+	ts.next = (ts.next + 1) % tuningSamples
+	if ts.sampled < tuningSamples {
+		ts.sampled++
+	}
+}
+
+// write writes the utilization of each stage to w.
+func (ts *tuningSampler) write(w io.Writer) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, q := range ts.queues {
+		if len(q.samples) == 0 {
+			continue
+		}
+		sorted := append([]float64(nil), q.samples...)
+		sort.Float64s(sorted)
+		pct := func(p int) float64 {
+			return 100 * sorted[(len(sorted)-1)*p/100]
+		}
+		_, _ = fmt.Fprintf(w, "queue %-20s p50 %.0f%% p90 %.0f%% p99 %.0f%% max %.0f%% of %d\n", q.name, pct(50), pct(90), pct(99), pct(100), q.capacity)
+	}
+	if ts.sampled < 2 {
+		return
+	}
+	newest := (ts.next + tuningSamples - 1) % tuningSamples
+	oldest := (ts.next + tuningSamples - ts.sampled) % tuningSamples
+	for _, bt := range ts.workers {
+		elapsed := bt.times[newest].Sub(bt.times[oldest])
+		if elapsed <= 0 || bt.workers == 0 {
+			continue
+		}
+		busy := float64(bt.totals[newest]-bt.totals[oldest]) / float64(elapsed) / float64(bt.workers)
+		_, _ = fmt.Fprintf(w, "workers %-18s busy %.0f%% of %d workers\n", bt.name, 100*busy, bt.workers)
+	}
+}
+
+// tuningCommand returns the console command which shows the tuning and the utilization of each stage.
+func tuningCommand(t Tuning, ts *tuningSampler) func(ctx context.Context, args []string, w io.Writer) error {
+	return func(ctx context.Context, args []string, w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		t.write(bw)
+		_, _ = fmt.Fprintf(bw, "Utilization over the last %s:\n", time.Duration(tuningSamples)*tuningSampleInterval)
+		ts.write(bw)
+		// Errors writing to the buffer are returned by Flush.
+		return bw.Flush()
+	}
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func divideRoundUp(a, b int) int {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,97 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoTune(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		cpus, pps int
+		expected  Tuning
+	}{
+		// Without a rate, every stage scales with the processors.
+		{16, 0, Tuning{MaxReaders: 8, MaxParsers: 16, MaxWorkers: 16, MaxQueueSize: 10000, ReceiveBatchSize: 50, ReceiveQueueSize: 100}},
+		{0, 0, Tuning{MaxReaders: 1, MaxParsers: 1, MaxWorkers: 1, MaxQueueSize: 10000, ReceiveBatchSize: 50, ReceiveQueueSize: 100}},
+		// A low rate needs a single worker per stage.
+		{16, 1000, Tuning{MaxReaders: 1, MaxParsers: 1, MaxWorkers: 1, MaxQueueSize: 1000, ReceiveBatchSize: 50, ReceiveQueueSize: 100}},
+		{16, 200000, Tuning{MaxReaders: 2, MaxParsers: 4, MaxWorkers: 4, MaxQueueSize: 50000, ReceiveBatchSize: 100, ReceiveQueueSize: 2000}},
+		// A high rate is limited by the processors.
+		{4, 2000000, Tuning{MaxReaders: 4, MaxParsers: 4, MaxWorkers: 4, MaxQueueSize: 100000, ReceiveBatchSize: 200, ReceiveQueueSize: 10000}},
+	}
+	for _, test := range tests {
+		actual := AutoTune(test.cpus, test.pps)
+		assert.True(t, actual.AutoTuned)
+		assert.Equal(t, test.pps, actual.PacketsPerSecond)
+		actual.AutoTuned, actual.CPUs, actual.PacketsPerSecond = false, 0, 0
+		assert.Equal(t, test.expected, actual, "%d CPUs, %d packets per second", test.cpus, test.pps)
+	}
+}
+
+func TestTuningSampler(t *testing.T) {
+	t.Parallel()
+	ts := &tuningSampler{}
+	var lens [2]int
+	ts.addQueues("aggregator", 100, func() int { return lens[0] }, func() int { return lens[1] })
+	busy := ts.addWorkers("parser", 2)
+
+	start := time.Unix(100, 0)
+	for i := 0; i < 10; i++ {
+		// One queue fills up while the other stays empty, and the workers are busy for half the time.
+		lens[0] = 10 * (i + 1)
+		busy.add(100 * time.Millisecond)
+		ts.sample(start.Add(time.Duration(i) * 100 * time.Millisecond))
+	}
+
+	var buf bytes.Buffer
+	ts.write(&buf)
+	assert.Equal(t, `queue aggregator           p50 0% p90 80% p99 90% max 100% of 100
+workers parser             busy 50% of 2 workers
+`, buf.String())
+}
+
+func TestTuningSamplerWraps(t *testing.T) {
+	t.Parallel()
+	ts := &tuningSampler{}
+	length := 100
+	ts.addQueues("aggregator", 100, func() int { return length })
+	busy := ts.addWorkers("aggregator", 1)
+
+	start := time.Unix(100, 0)
+	for i := 0; i < 2*tuningSamples; i++ {
+		if i == tuningSamples {
+			// Only the most recent samples are reported.
+			length = 0
+		}
+		if i >= tuningSamples {
+			busy.add(25 * time.Millisecond)
+		}
+		ts.sample(start.Add(time.Duration(i) * 100 * time.Millisecond))
+	}
+
+	var buf bytes.Buffer
+	ts.write(&buf)
+	assert.Equal(t, `queue aggregator           p50 0% p90 0% p99 0% max 0% of 100
+workers aggregator         busy 25% of 1 workers
+`, buf.String())
+}
+
+func TestTuningCommand(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	cmd := tuningCommand(AutoTune(16, 200000), &tuningSampler{})
+	require.NoError(t, cmd(context.Background(), nil, &buf))
+	lines := strings.Split(buf.String(), "\n")
+	require.Len(t, lines, 9)
+	assert.Equal(t, "Auto-tuned for 16 CPUs and 200000 packets per second", lines[0])
+	assert.Equal(t, "max-readers          2", lines[1])
+	assert.Equal(t, "receive-queue-size   2000", lines[6])
+	assert.Equal(t, "Utilization over the last 1m0s:", lines[7])
+}
@@ -16,6 +16,21 @@ type MetricHandler interface {
 	DispatchMetric(ctx context.Context, m *gostatsd.Metric) error
 }
 
+// Processor is a stage of the metric pipeline, applied in order with the others to each metric before it is
+// aggregated.  Embedders can add their own to enrich, rewrite or filter metrics.  Process may be called concurrently.
+type Processor interface {
+	// Process returns the metric to pass to the next stage, usually m after modifying it, or nil to drop it.
+	Process(m *gostatsd.Metric) *gostatsd.Metric
+}
+
+// ProcessorFunc is an adapter to allow the use of an ordinary function as a Processor.
+type ProcessorFunc func(m *gostatsd.Metric) *gostatsd.Metric
+
+// Process calls f(m).
+func (f ProcessorFunc) Process(m *gostatsd.Metric) *gostatsd.Metric {
+	return f(m)
+}
+
 // EventHandler can be used to handle events
 type EventHandler interface {
 	// DispatchEvent dispatches event to the next step in a pipeline.
@@ -24,6 +39,11 @@ type EventHandler interface {
 	WaitForEvents()
 }
 
+// LineCounter reports how many metrics and bad lines have been parsed since startup.
+type LineCounter interface {
+	LineCounts() (metricsReceived, badLines uint64)
+}
+
 // DispatcherProcessFunc is a function that gets executed by Dispatcher for each Aggregator, passing it into the function.
 type DispatcherProcessFunc func(int, Aggregator)
 
@@ -49,9 +69,15 @@ type Aggregator interface {
 
 // Datagram is a received UDP datagram that has not been parsed into Metric/Event(s)
 type Datagram struct {
-	IP       gostatsd.IP
-	Msg      []byte
-	DoneFunc func() // to be called once the datagram has been parsed and msg can be freed
+	IP          gostatsd.IP
+	Msg         []byte
+	Received    time.Time // when the datagram was read from the socket
+	ListenerTag string    // tag to add to all metrics and events, may be empty
+	DoneFunc    func()    // to be called once the datagram has been parsed and msg can be freed
+
+	ListenerType gostatsd.MetricType // type of metric expected by the listener, 0 for any type
+
+	Trace *gostatsd.PipelineTrace // timestamps of the datagram passing through the pipeline if it was sampled, usually nil
 }
 
 // MetricEmitter is an object that emits metrics.  Used to pass a Statser to the object
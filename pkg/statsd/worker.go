@@ -19,6 +19,7 @@ type worker struct {
 	metricsQueue chan *gostatsd.Metric
 	processChan  chan *processCommand
 	id           int
+	busy         *busyTracker // Time spent aggregating, may be nil
 }
 
 func (w *worker) work() {
@@ -28,7 +29,13 @@ func (w *worker) work() {
 			if !ok {
 				return
 			}
-			w.aggr.Receive(metric, time.Now())
+			if w.busy == nil {
+				w.aggr.Receive(metric, time.Now())
+				continue
+			}
+			now := time.Now()
+			w.aggr.Receive(metric, now)
+			w.busy.add(time.Since(now))
 		case cmd := <-w.processChan:
 			w.executeProcess(cmd)
 		}
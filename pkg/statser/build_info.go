@@ -0,0 +1,43 @@
+package statser
+
+import (
+	"context"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// BuildInfo sends the build_info and up gauges after every flush, following the Prometheus conventions for
+// describing a running server.  build_info is always 1 and is tagged with the version and commit, up is always 1
+// while the server is running.
+type BuildInfo struct {
+	statser Statser
+	tags    gostatsd.Tags
+}
+
+// NewBuildInfo creates a new BuildInfo, sending build_info with the supplied tags.
+func NewBuildInfo(statser Statser, tags gostatsd.Tags) *BuildInfo {
+	return &BuildInfo{
+		statser: statser,
+		tags:    tags,
+	}
+}
+
+// Run will run a BuildInfo in the background until the supplied context is closed.
+func (bi *BuildInfo) Run(ctx context.Context) {
+	flushed, unregister := bi.statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			bi.emit()
+		}
+	}
+}
+
+func (bi *BuildInfo) emit() {
+	bi.statser.Gauge("build_info", 1, bi.tags)
+	bi.statser.Gauge("up", 1, nil)
+}
@@ -0,0 +1,46 @@
+package statser
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildInfoEmitsOnFlush(t *testing.T) {
+	t.Parallel()
+	logger, hook := test.NewNullLogger()
+	statser := NewLoggingStatser(gostatsd.Tags{"internal:tag"}, log.NewEntry(logger))
+	bi := NewBuildInfo(statser, gostatsd.Tags{"version:1.2.3", "commit:abc123"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bi.Run(ctx)
+	}()
+
+	// Wait for Run to register for flushes before notifying.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(hook.AllEntries()) < 2 {
+		require.True(t, time.Now().Before(deadline), "timeout")
+		statser.NotifyFlush(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	entries := hook.AllEntries()
+	assert.Equal(t, "build_info", entries[0].Data["name"])
+	assert.Equal(t, 1.0, entries[0].Data["value"])
+	assert.Equal(t, gostatsd.Tags{"internal:tag", "version:1.2.3", "commit:abc123"}, entries[0].Data["tags"])
+	assert.Equal(t, "up", entries[1].Data["name"])
+	assert.Equal(t, 1.0, entries[1].Data["value"])
+	assert.Equal(t, gostatsd.Tags{"internal:tag"}, entries[1].Data["tags"])
+}
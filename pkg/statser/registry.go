@@ -0,0 +1,285 @@
+package statser
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// RegistryPrefix is the prefix of the name of every metric served by a Registry.
+const RegistryPrefix = "gostatsd_"
+
+// RegistryBuckets are the upper bounds in seconds of the buckets of the histogram of each timer in a Registry.
+var RegistryBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Kinds of metric family, as named by the Prometheus text format.
+const (
+	kindGauge     = "gauge"
+	kindCounter   = "counter"
+	kindHistogram = "histogram"
+)
+
+// Registry holds the internal metrics of gostatsd, to be served in the Prometheus text format.  A gauge holds its
+// last value, a counter the total of every count since startup, and a timer a histogram of its values in seconds.
+// The name of each metric is prefixed with RegistryPrefix, with a _total suffix for counters and _seconds for timers,
+// and its tags become labels.  A tag without a value becomes a label with the value "true".  The values are updated
+// with atomic instructions, so recording a metric in an existing series takes a read lock only.
+type Registry struct {
+	*registry
+	tags gostatsd.Tags // Added to every metric recorded through this Registry
+}
+
+type registry struct {
+	mu       sync.RWMutex
+	families map[string]*family
+}
+
+// family is the series of one metric name, all of the same kind.
+type family struct {
+	kind   string
+	series map[string]*series // By rendered labels
+}
+
+// series is the value of one metric name and set of labels.  The float64 values are stored as their bits, and must
+// be read/written only using atomic instructions.
+type series struct {
+	value   uint64   // Value of a gauge or counter
+	buckets []uint64 // Number of values in each of RegistryBuckets, not cumulative
+	count   uint64   // Number of values of a histogram
+	sum     uint64   // Sum of the values of a histogram
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		registry: &registry{families: map[string]*family{}},
+	}
+}
+
+// WithTags returns a Registry which records in to the same series as r, adding tags to every metric.
+func (r *Registry) WithTags(tags gostatsd.Tags) *Registry {
+	return &Registry{
+		registry: r.registry,
+		tags:     r.tags.Concat(tags),
+	}
+}
+
+// Gauge sets the value of a gauge.
+func (r *Registry) Gauge(name string, value float64, tags gostatsd.Tags) {
+	s := r.series(promName(name), kindGauge, r.labels(tags))
+	atomic.StoreUint64(&s.value, math.Float64bits(value))
+}
+
+// Count adds amount to a counter.
+func (r *Registry) Count(name string, amount float64, tags gostatsd.Tags) {
+	s := r.series(promName(name)+"_total", kindCounter, r.labels(tags))
+	addFloat(&s.value, amount)
+}
+
+// Timing adds a value in seconds to the histogram of a timer.
+func (r *Registry) Timing(name string, seconds float64, tags gostatsd.Tags) {
+	s := r.series(promName(name)+"_seconds", kindHistogram, r.labels(tags))
+	if i := sort.SearchFloat64s(RegistryBuckets, seconds); i < len(RegistryBuckets) {
+		atomic.AddUint64(&s.buckets[i], 1)
+	}
+	atomic.AddUint64(&s.count, 1)
+	addFloat(&s.sum, seconds)
+}
+
+// series returns the series of name and labels, creating it if needed.  If name is already used by a family of
+// another kind, the kind is appended to the name.
+func (r *registry) series(name, kind, labels string) *series {
+	r.mu.RLock()
+	f := r.families[name]
+	if f != nil && f.kind != kind {
+		name += "_" + kind
+		f = r.families[name]
+	}
+	var s *series
+	if f != nil {
+		s = f.series[labels]
+	}
+	r.mu.RUnlock()
+	if s != nil {
+		return s
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f = r.families[name]; f == nil {
+		f = &family{kind: kind, series: map[string]*series{}}
+		r.families[name] = f
+	}
+	if s = f.series[labels]; s == nil {
+		s = &series{}
+		if kind == kindHistogram {
+			s.buckets = make([]uint64, len(RegistryBuckets))
+		}
+		f.series[labels] = s
+	}
+	return s
+}
+
+// labels renders the tags of r and tags as labels sorted by name, such as a="1",b="2".  If two tags have the same
+// label name, the last one wins.
+func (r *Registry) labels(tags gostatsd.Tags) string {
+	if len(r.tags)+len(tags) == 0 {
+		return ""
+	}
+	values := make(map[string]string, len(r.tags)+len(tags))
+	for _, list := range []gostatsd.Tags{r.tags, tags} {
+		for _, tag := range list {
+			key, value := tag, "true"
+			if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+				key, value = tag[:idx], tag[idx+1:]
+			}
+			values[promLabelName(key)] = value
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(promLabelValue(values[name]))
+		sb.WriteByte('"')
+	}
+	return sb.String()
+}
+
+// WritePrometheus writes every metric in the Prometheus text format, sorted by name and labels, after the number of
+// goroutines and the heap in use.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeSample(bw, "# TYPE "+RegistryPrefix+"goroutines "+kindGauge+"\n", RegistryPrefix+"goroutines", "", float64(runtime.NumGoroutine()))
+	writeSample(bw, "# TYPE "+RegistryPrefix+"heap_alloc_bytes "+kindGauge+"\n", RegistryPrefix+"heap_alloc_bytes", "", float64(mem.HeapAlloc))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := r.families[name]
+		labels := make([]string, 0, len(f.series))
+		for l := range f.series {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		bw.WriteString("# TYPE " + name + " " + f.kind + "\n")
+		for _, l := range labels {
+			s := f.series[l]
+			if f.kind != kindHistogram {
+				writeSample(bw, "", name, l, math.Float64frombits(atomic.LoadUint64(&s.value)))
+				continue
+			}
+			sep := ""
+			if l != "" {
+				sep = ","
+			}
+			cumulative := uint64(0)
+			for i, bound := range RegistryBuckets {
+				cumulative += atomic.LoadUint64(&s.buckets[i])
+				writeSample(bw, "", name+"_bucket", l+sep+`le="`+formatFloat(bound)+`"`, float64(cumulative))
+			}
+			count := atomic.LoadUint64(&s.count)
+			writeSample(bw, "", name+"_bucket", l+sep+`le="+Inf"`, float64(count))
+			writeSample(bw, "", name+"_sum", l, math.Float64frombits(atomic.LoadUint64(&s.sum)))
+			writeSample(bw, "", name+"_count", l, float64(count))
+		}
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves every metric in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.WritePrometheus(w)
+}
+
+// writeSample writes header, then a line with the value of name and labels.
+func writeSample(w *bufio.Writer, header, name, labels string, value float64) {
+	w.WriteString(header)
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteByte('{')
+		w.WriteString(labels)
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// addFloat adds delta to the float64 whose bits are at addr.
+func addFloat(addr *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if atomic.CompareAndSwapUint64(addr, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+// promName returns name with RegistryPrefix, and every character which is invalid in a metric name replaced with _.
+func promName(name string) string {
+	return RegistryPrefix + strings.Map(func(r rune) rune {
+		if r == '_' || r == ':' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// promLabelName returns key with every character which is invalid in a label name replaced with _.
+func promLabelName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, key)
+	if name == "" || ('0' <= name[0] && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// labelValueEscaper escapes a label value for the Prometheus text format.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
@@ -0,0 +1,162 @@
+package statser
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// registryLines returns the lines written by r, without those of the runtime metrics which vary.
+func registryLines(t *testing.T, r *Registry) []string {
+	var buf bytes.Buffer
+	require.NoError(t, r.WritePrometheus(&buf))
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if !strings.Contains(line, "goroutines") && !strings.Contains(line, "heap_alloc_bytes") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestRegistryWritePrometheus(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	r.Gauge("parser.metrics_received", 5, nil)
+	r.Gauge("parser.metrics_received", 7, nil)
+	r.Count("backend.sent", 2, gostatsd.Tags{"backend:graphite"})
+	r.Count("backend.sent", 3, gostatsd.Tags{"backend:graphite"})
+	r.Count("backend.sent", 1, gostatsd.Tags{"backend:stdout", "noisy", "bad-key:a\"b"})
+	r.Timing("flusher.total_time", 0.02, nil)
+	r.Timing("flusher.total_time", 0.3, nil)
+	r.Timing("flusher.total_time", 60, nil)
+
+	assert.Equal(t, []string{
+		`# TYPE gostatsd_backend_sent_total counter`,
+		`gostatsd_backend_sent_total{backend="graphite"} 5`,
+		`gostatsd_backend_sent_total{backend="stdout",bad_key="a\"b",noisy="true"} 1`,
+		`# TYPE gostatsd_flusher_total_time_seconds histogram`,
+		`gostatsd_flusher_total_time_seconds_bucket{le="0.001"} 0`,
+		`gostatsd_flusher_total_time_seconds_bucket{le="0.005"} 0`,
+		`gostatsd_flusher_total_time_seconds_bucket{le="0.01"} 0`,
+		`gostatsd_flusher_total_time_seconds_bucket{le="0.025"} 1`,
+		`gostatsd_flusher_total_time_seconds_bucket{le="0.05"} 1`,
+		`gostatsd_flusher_total_time_seconds_bucket{le="0.1"} 1`,
+		`gostatsd_flusher_total_time_seconds_bucket{le="0.25"} 1`,
+		`gostatsd_flusher_total_time_seconds_bucket{le="0.5"} 2`,
+		`gostatsd_flusher_total_time_seconds_bucket{le="1"} 2`,
+		`gostatsd_flusher_total_time_seconds_bucket{le="2.5"} 2`,
+		`gostatsd_flusher_total_time_seconds_bucket{le="5"} 2`,
+		`gostatsd_flusher_total_time_seconds_bucket{le="10"} 2`,
+		`gostatsd_flusher_total_time_seconds_bucket{le="+Inf"} 3`,
+		`gostatsd_flusher_total_time_seconds_sum 60.32`,
+		`gostatsd_flusher_total_time_seconds_count 3`,
+		`# TYPE gostatsd_parser_metrics_received gauge`,
+		`gostatsd_parser_metrics_received 7`,
+	}, registryLines(t, r))
+}
+
+func TestRegistryWithTags(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	r.WithTags(gostatsd.Tags{"server:east"}).Gauge("queue", 1, gostatsd.Tags{"a:1"})
+	r.WithTags(gostatsd.Tags{"server:west"}).Gauge("queue", 2, nil)
+	// A name already used by another kind of metric has the kind appended.
+	r.Gauge("queue_seconds", 3, nil)
+	r.Timing("queue", 1, nil)
+	lines := registryLines(t, r)
+	assert.Equal(t, []string{
+		`# TYPE gostatsd_queue gauge`,
+		`gostatsd_queue{a="1",server="east"} 1`,
+		`gostatsd_queue{server="west"} 2`,
+	}, lines[:3])
+	assert.Contains(t, lines, `# TYPE gostatsd_queue_seconds gauge`)
+	assert.Contains(t, lines, `# TYPE gostatsd_queue_seconds_histogram histogram`)
+	assert.Contains(t, lines, `gostatsd_queue_seconds_histogram_count 1`)
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				r.Count("c", 1, nil)
+				r.Timing("t", 0.1, nil)
+			}
+		}()
+	}
+	wg.Wait()
+	lines := registryLines(t, r)
+	assert.Contains(t, lines, `gostatsd_c_total 8000`)
+	assert.Contains(t, lines, `gostatsd_t_seconds_count 8000`)
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	r.Gauge("a", 1, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "# TYPE gostatsd_goroutines gauge\n")
+	assert.Contains(t, w.Body.String(), "\ngostatsd_a 1\n")
+}
+
+// capturingStatser records the names of the metrics sent to it.
+type capturingStatser struct {
+	NullStatser
+	names []string
+}
+
+func (cs *capturingStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	cs.names = append(cs.names, "gauge:"+name)
+}
+
+func (cs *capturingStatser) Count(name string, amount float64, tags gostatsd.Tags) {
+	cs.names = append(cs.names, "count:"+name)
+}
+
+func (cs *capturingStatser) Increment(name string, tags gostatsd.Tags) {
+	cs.names = append(cs.names, "increment:"+name)
+}
+
+func (cs *capturingStatser) TimingMS(name string, ms float64, tags gostatsd.Tags) {
+	cs.names = append(cs.names, "timing:"+name)
+}
+
+func (cs *capturingStatser) TimingDuration(name string, d time.Duration, tags gostatsd.Tags) {
+	cs.names = append(cs.names, "timing:"+name)
+}
+
+func TestRegistryStatser(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	cs := &capturingStatser{}
+	s := NewRegistryStatser(r, cs)
+	s.Gauge("g", 1, nil)
+	s.Count("c", 2, nil)
+	s.Increment("c", nil)
+	s.TimingMS("t", 500, nil)
+	s.WithTags(gostatsd.Tags{"x:y"}).TimingDuration("t", 250*time.Millisecond, nil)
+
+	// Every metric is both recorded and sent on.
+	assert.Equal(t, []string{"gauge:g", "count:c", "increment:c", "timing:t", "timing:t"}, cs.names)
+	lines := registryLines(t, r)
+	assert.Contains(t, lines, `gostatsd_g 1`)
+	assert.Contains(t, lines, `gostatsd_c_total 3`)
+	assert.Contains(t, lines, `gostatsd_t_seconds_sum 0.5`)
+	assert.Contains(t, lines, `gostatsd_t_seconds_sum{x="y"} 0.25`)
+}
@@ -0,0 +1,70 @@
+package statser
+
+import (
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// RegistryStatser is a Statser which records metrics in a Registry, and submits them to another Statser, so the
+// internal metrics served from the Registry are the same as those sent through the pipeline.
+type RegistryStatser struct {
+	registry *Registry
+	statser  Statser
+}
+
+// NewRegistryStatser creates a new Statser which records metrics in registry before submitting them to statser.
+func NewRegistryStatser(registry *Registry, statser Statser) Statser {
+	return &RegistryStatser{
+		registry: registry,
+		statser:  statser,
+	}
+}
+
+func (rs *RegistryStatser) NotifyFlush(d time.Duration) {
+	rs.statser.NotifyFlush(d)
+}
+
+func (rs *RegistryStatser) RegisterFlush() (<-chan time.Duration, func()) {
+	return rs.statser.RegisterFlush()
+}
+
+// Gauge records and sends a gauge metric
+func (rs *RegistryStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	rs.registry.Gauge(name, value, tags)
+	rs.statser.Gauge(name, value, tags)
+}
+
+// Count records and sends a counter metric
+func (rs *RegistryStatser) Count(name string, amount float64, tags gostatsd.Tags) {
+	rs.registry.Count(name, amount, tags)
+	rs.statser.Count(name, amount, tags)
+}
+
+// Increment records and sends a counter metric with a value of 1
+func (rs *RegistryStatser) Increment(name string, tags gostatsd.Tags) {
+	rs.registry.Count(name, 1, tags)
+	rs.statser.Increment(name, tags)
+}
+
+// TimingMS records and sends a timing metric from a millisecond value
+func (rs *RegistryStatser) TimingMS(name string, ms float64, tags gostatsd.Tags) {
+	rs.registry.Timing(name, ms/1000, tags)
+	rs.statser.TimingMS(name, ms, tags)
+}
+
+// TimingDuration records and sends a timing metric from a time.Duration
+func (rs *RegistryStatser) TimingDuration(name string, d time.Duration, tags gostatsd.Tags) {
+	rs.registry.Timing(name, d.Seconds(), tags)
+	rs.statser.TimingDuration(name, d, tags)
+}
+
+// NewTimer returns a new timer with time set to now
+func (rs *RegistryStatser) NewTimer(name string, tags gostatsd.Tags) *Timer {
+	return newTimer(rs, name, tags)
+}
+
+// WithTags creates a new Statser with additional tags
+func (rs *RegistryStatser) WithTags(tags gostatsd.Tags) Statser {
+	return NewTaggedStatser(rs, tags)
+}
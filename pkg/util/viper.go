@@ -0,0 +1,51 @@
+// Package util has helpers to read configuration shared by the server and the backends, kept out of the root package
+// so the metric types don't depend on viper.
+package util
+
+import (
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+)
+
+// DisabledSubMetrics returns the timer sub-metrics disabled in the disabled-sub-metrics section of viper.
+func DisabledSubMetrics(viper *viper.Viper) gostatsd.TimerSubtypes {
+	subViper := viper.Sub("disabled-sub-metrics")
+	if subViper == nil {
+		return gostatsd.TimerSubtypes{}
+	}
+
+	subViper.SetDefault("lower", false)
+	subViper.SetDefault("lower-pct", false)
+	subViper.SetDefault("upper", false)
+	subViper.SetDefault("upper-pct", false)
+	subViper.SetDefault("count", false)
+	subViper.SetDefault("count-pct", false)
+	subViper.SetDefault("count-per-second", false)
+	subViper.SetDefault("mean", false)
+	subViper.SetDefault("mean-pct", false)
+	subViper.SetDefault("median", false)
+	subViper.SetDefault("std", false)
+	subViper.SetDefault("sum", false)
+	subViper.SetDefault("sum-pct", false)
+	subViper.SetDefault("sum-squares", false)
+	subViper.SetDefault("sum-squares-pct", false)
+
+	return gostatsd.TimerSubtypes{
+		Lower:          subViper.GetBool("lower"),
+		LowerPct:       subViper.GetBool("lower-pct"),
+		Upper:          subViper.GetBool("upper"),
+		UpperPct:       subViper.GetBool("upper-pct"),
+		Count:          subViper.GetBool("count"),
+		CountPct:       subViper.GetBool("count-pct"),
+		CountPerSecond: subViper.GetBool("count-per-second"),
+		Mean:           subViper.GetBool("mean"),
+		MeanPct:        subViper.GetBool("mean-pct"),
+		Median:         subViper.GetBool("median"),
+		StdDev:         subViper.GetBool("stddev"),
+		Sum:            subViper.GetBool("sum"),
+		SumPct:         subViper.GetBool("sum-pct"),
+		SumSquares:     subViper.GetBool("sum-squares"),
+		SumSquaresPct:  subViper.GetBool("sum-squares-pct"),
+	}
+}
@@ -1,11 +1,24 @@
 package gostatsd
 
-// Set is used for storing aggregated values for sets.
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/atlassian/gostatsd/pkg/hll"
+)
+
+// Set is used for storing aggregated values for sets.  Members are stored exactly in Values and IntValues,
+// unless the set has grown large enough to switch to an approximate Sketch.
 type Set struct {
 	Values    map[string]struct{}
-	Timestamp Nanotime // Last time value was updated
-	Hostname  string   // Hostname of the source of the metric
-	Tags      Tags     // The tags for the set
+	IntValues map[int64]struct{} // Members which are base 10 integers, stored separately to save memory
+	Sketch    *hll.Sketch        // If not nil, an estimate of the members, and Values and IntValues are nil
+	Timestamp Nanotime           // Last time value was updated
+	Hostname  string             // Hostname of the source of the metric
+	Tags      Tags               // The tags for the set
+
+	TTL time.Duration // Expiry interval set by the client, 0 to use the server's
 }
 
 // NewSet initialises a new set.
@@ -13,6 +26,87 @@ func NewSet(timestamp Nanotime, values map[string]struct{}, hostname string, tag
 	return Set{Values: values, Timestamp: timestamp, Hostname: hostname, Tags: tags.Copy()}
 }
 
+// Insert adds a member to the set.  If maxExact is greater than 0 and the set holds more than maxExact
+// members, the set switches to an approximate HyperLogLog sketch.
+func (s *Set) Insert(member string, maxExact int) {
+	n, isInt := parseCanonicalInt(member)
+	if s.Sketch != nil {
+		if isInt {
+			s.Sketch.InsertInt(n)
+		} else {
+			s.Sketch.InsertString(member)
+		}
+		return
+	}
+	if isInt {
+		if s.IntValues == nil {
+			s.IntValues = map[int64]struct{}{}
+		}
+		s.IntValues[n] = struct{}{}
+	} else {
+		if s.Values == nil {
+			s.Values = map[string]struct{}{}
+		}
+		s.Values[member] = struct{}{}
+	}
+	if maxExact > 0 && len(s.Values)+len(s.IntValues) > maxExact {
+		s.Sketch = hll.New()
+		for v := range s.Values {
+			s.Sketch.InsertString(v)
+		}
+		for v := range s.IntValues {
+			s.Sketch.InsertInt(v)
+		}
+		s.Values = nil
+		s.IntValues = nil
+	}
+}
+
+// Cardinality returns the number of distinct members of the set, which is an estimate if Approximate is true.
+func (s Set) Cardinality() int {
+	if s.Sketch != nil {
+		return int(s.Sketch.Estimate())
+	}
+	return len(s.Values) + len(s.IntValues)
+}
+
+// Approximate returns true if the set is tracked by a sketch, and the individual members are not known.
+func (s Set) Approximate() bool {
+	return s.Sketch != nil
+}
+
+// EachMember calls f with each member of the set.  Nothing is called for an approximate set.
+func (s Set) EachMember(f func(string)) {
+	for v := range s.Values {
+		f(v)
+	}
+	for v := range s.IntValues {
+		f(strconv.FormatInt(v, 10))
+	}
+}
+
+// parseCanonicalInt parses s if it is the canonical base 10 form of an int64, so that the member can be
+// formatted back to exactly the same string.  Strings such as "007" or "+7" are not canonical.
+func parseCanonicalInt(s string) (int64, bool) {
+	digits := s
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 || len(digits) > 19 || (digits[0] == '0' && len(s) > 1) {
+		return 0, false
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
 // Sets stores a map of sets by tags.
 type Sets map[string]map[string]Set
 
@@ -44,3 +138,23 @@ func (s Sets) Each(f func(string, string, Set)) {
 		}
 	}
 }
+
+// EachSorted iterates over each set in order of name, then tags.
+func (s Sets) EachSorted(f func(string, string, Set)) {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := s[key]
+		tagsKeys := make([]string, 0, len(value))
+		for tags := range value {
+			tagsKeys = append(tagsKeys, tags)
+		}
+		sort.Strings(tagsKeys)
+		for _, tags := range tagsKeys {
+			f(key, tags, value[tags])
+		}
+	}
+}
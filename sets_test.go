@@ -0,0 +1,72 @@
+package gostatsd
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetInsert(t *testing.T) {
+	t.Parallel()
+	s := NewSet(0, nil, "", nil)
+	for _, member := range []string{"1", "1", "-5", "0", "007", "+7", "-0", "abc", "99999999999999999999"} {
+		s.Insert(member, 0)
+	}
+	assert.Equal(t, map[int64]struct{}{1: {}, -5: {}, 0: {}}, s.IntValues)
+	assert.Equal(t, map[string]struct{}{"007": {}, "+7": {}, "-0": {}, "abc": {}, "99999999999999999999": {}}, s.Values)
+	assert.Equal(t, 8, s.Cardinality())
+	assert.False(t, s.Approximate())
+
+	var members []string
+	s.EachMember(func(member string) {
+		members = append(members, member)
+	})
+	sort.Strings(members)
+	assert.Equal(t, []string{"+7", "-0", "-5", "0", "007", "1", "99999999999999999999", "abc"}, members)
+}
+
+func TestSetInsertApproximate(t *testing.T) {
+	t.Parallel()
+	s := NewSet(0, nil, "", nil)
+	for i := 0; i < 10; i++ {
+		s.Insert(strconv.Itoa(i), 10)
+	}
+	assert.False(t, s.Approximate())
+
+	s.Insert("user", 10)
+	s.Insert("5", 10) // Duplicate
+	assert.True(t, s.Approximate())
+	assert.Nil(t, s.Values)
+	assert.Nil(t, s.IntValues)
+	assert.Equal(t, 11, s.Cardinality())
+	s.EachMember(func(member string) {
+		assert.Fail(t, "unexpected member", member)
+	})
+}
+
+func BenchmarkSetInsert1M(b *testing.B) {
+	const n = 1000000
+	ints := make([]string, n)
+	strs := make([]string, n)
+	for i := range ints {
+		ints[i] = strconv.Itoa(i)
+		strs[i] = "user" + ints[i]
+	}
+
+	run := func(members []string, maxExact int) func(*testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s := NewSet(0, nil, "", nil)
+				for _, member := range members {
+					s.Insert(member, maxExact)
+				}
+			}
+		}
+	}
+	b.Run("strings", run(strs, 0))
+	b.Run("ints", run(ints, 0))
+	b.Run("approximate", run(ints, 10000))
+}
@@ -1,6 +1,12 @@
 package gostatsd
 
-import "github.com/spf13/viper"
+import (
+	"sort"
+	"time"
+
+	"github.com/atlassian/gostatsd/pkg/exphist"
+	"github.com/atlassian/gostatsd/pkg/hdrhist"
+)
 
 // Timer is used for storing aggregated values for timers.
 type Timer struct {
@@ -19,6 +25,11 @@ type Timer struct {
 	Timestamp    Nanotime    // Last time value was updated
 	Hostname     string      // Hostname of the source of the metric
 	Tags         Tags        // The tags for the timer
+
+	TTL time.Duration // Expiry interval set by the client, 0 to use the server's
+
+	Histogram *exphist.Histogram // If not nil, the values folded in to an exponential histogram, and Values is empty
+	HDR       *hdrhist.Histogram // If not nil, the values recorded in an HDR histogram, and Values is empty
 }
 
 // NewTimer initialises a new timer.
@@ -63,44 +74,38 @@ func (t Timers) Each(f func(string, string, Timer)) {
 	}
 }
 
-func DisabledSubMetrics(viper *viper.Viper) TimerSubtypes {
-	subViper := viper.Sub("disabled-sub-metrics")
-	if subViper == nil {
-		return TimerSubtypes{}
+// EachSorted iterates over each timer in order of name, then tags.
+func (t Timers) EachSorted(f func(string, string, Timer)) {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
 	}
-
-	subViper.SetDefault("lower", false)
-	subViper.SetDefault("lower-pct", false)
-	subViper.SetDefault("upper", false)
-	subViper.SetDefault("upper-pct", false)
-	subViper.SetDefault("count", false)
-	subViper.SetDefault("count-pct", false)
-	subViper.SetDefault("count-per-second", false)
-	subViper.SetDefault("mean", false)
-	subViper.SetDefault("mean-pct", false)
-	subViper.SetDefault("median", false)
-	subViper.SetDefault("std", false)
-	subViper.SetDefault("sum", false)
-	subViper.SetDefault("sum-pct", false)
-	subViper.SetDefault("sum-squares", false)
-	subViper.SetDefault("sum-squares-pct", false)
-
-	return TimerSubtypes{
-		Lower:          subViper.GetBool("lower"),
-		LowerPct:       subViper.GetBool("lower-pct"),
-		Upper:          subViper.GetBool("upper"),
-		UpperPct:       subViper.GetBool("upper-pct"),
-		Count:          subViper.GetBool("count"),
-		CountPct:       subViper.GetBool("count-pct"),
-		CountPerSecond: subViper.GetBool("count-per-second"),
-		Mean:           subViper.GetBool("mean"),
-		MeanPct:        subViper.GetBool("mean-pct"),
-		Median:         subViper.GetBool("median"),
-		StdDev:         subViper.GetBool("stddev"),
-		Sum:            subViper.GetBool("sum"),
-		SumPct:         subViper.GetBool("sum-pct"),
-		SumSquares:     subViper.GetBool("sum-squares"),
-		SumSquaresPct:  subViper.GetBool("sum-squares-pct"),
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := t[key]
+		tagsKeys := make([]string, 0, len(value))
+		for tags := range value {
+			tagsKeys = append(tagsKeys, tags)
+		}
+		sort.Strings(tagsKeys)
+		for _, tags := range tagsKeys {
+			f(key, tags, value[tags])
+		}
 	}
+}
 
+// WithoutValues returns a copy of the timers with Values, Histogram and HDR set to nil.  The samples are not copied.
+func (t Timers) WithoutValues() Timers {
+	stripped := make(Timers, len(t))
+	for key, tagged := range t {
+		s := make(map[string]Timer, len(tagged))
+		for tagsKey, timer := range tagged {
+			timer.Values = nil
+			timer.Histogram = nil
+			timer.HDR = nil
+			s[tagsKey] = timer
+		}
+		stripped[key] = s
+	}
+	return stripped
 }
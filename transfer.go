@@ -0,0 +1,82 @@
+package gostatsd
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// TransferStats are the lifetime totals of the data a backend has sent.
+type TransferStats struct {
+	BytesSerialized uint64        // Bytes of payload serialized, before any compression
+	BytesSent       uint64        // Bytes written to the network, after any compression
+	SerializeTime   time.Duration // Time spent serializing and compressing payloads
+	WriteTime       time.Duration // Time spent writing payloads to the network, including waiting for the response
+}
+
+// Add returns the sum of ts and other.
+func (ts TransferStats) Add(other TransferStats) TransferStats {
+	return TransferStats{
+		BytesSerialized: ts.BytesSerialized + other.BytesSerialized,
+		BytesSent:       ts.BytesSent + other.BytesSent,
+		SerializeTime:   ts.SerializeTime + other.SerializeTime,
+		WriteTime:       ts.WriteTime + other.WriteTime,
+	}
+}
+
+// Sub returns the difference of ts and an earlier other, such as the data sent since other was taken.
+func (ts TransferStats) Sub(other TransferStats) TransferStats {
+	return TransferStats{
+		BytesSerialized: ts.BytesSerialized - other.BytesSerialized,
+		BytesSent:       ts.BytesSent - other.BytesSent,
+		SerializeTime:   ts.SerializeTime - other.SerializeTime,
+		WriteTime:       ts.WriteTime - other.WriteTime,
+	}
+}
+
+// TransferCounter accumulates the TransferStats of a backend.  It is safe to use concurrently, and the zero value is
+// ready to use.
+type TransferCounter struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	bytesSerialized uint64
+	bytesSent       uint64
+	serializeTime   int64
+	writeTime       int64
+}
+
+// Serialized records n bytes of payload serialized in d.
+func (tc *TransferCounter) Serialized(n int, d time.Duration) {
+	atomic.AddUint64(&tc.bytesSerialized, uint64(n))
+	atomic.AddInt64(&tc.serializeTime, int64(d))
+}
+
+// Sent records n bytes written to the network in d.
+func (tc *TransferCounter) Sent(n int, d time.Duration) {
+	atomic.AddUint64(&tc.bytesSent, uint64(n))
+	atomic.AddInt64(&tc.writeTime, int64(d))
+}
+
+// Stats returns the totals recorded so far.
+func (tc *TransferCounter) Stats() TransferStats {
+	return TransferStats{
+		BytesSerialized: atomic.LoadUint64(&tc.bytesSerialized),
+		BytesSent:       atomic.LoadUint64(&tc.bytesSent),
+		SerializeTime:   time.Duration(atomic.LoadInt64(&tc.serializeTime)),
+		WriteTime:       time.Duration(atomic.LoadInt64(&tc.writeTime)),
+	}
+}
+
+// CountingWriter counts the bytes written to the wrapped io.Writer, such as the payload written to a compressor.
+type CountingWriter struct {
+	W io.Writer
+	N int
+}
+
+// Write writes p to the wrapped io.Writer, counting the bytes written.
+func (cw *CountingWriter) Write(p []byte) (int, error) {
+	n, err := cw.W.Write(p)
+	cw.N += n
+	return n, err
+}